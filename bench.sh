@@ -0,0 +1,74 @@
+#!/bin/bash
+# Runs the stratum hot path benchmarks (job building, share checking, notify
+# serialization) and compares them to a baseline saved on this machine.
+#
+#   ./bench.sh          compare against the baseline, failing on regressions
+#   ./bench.sh save     save a new baseline
+#   ./bench.sh profile  also write CPU and memory profiles to .bench/
+#
+# BENCH_TOLERANCE is the slowdown in percent allowed before failing (default
+# 15), BENCH_COUNT the runs of each benchmark (default 5). With benchstat
+# installed its comparison is printed too. Baselines only mean something on
+# the machine that saved them, so .bench/ isn't committed
+set -e
+cd "$(dirname "$0")"
+
+dir=.bench
+baseline=$dir/baseline.txt
+current=$dir/current.txt
+tolerance=${BENCH_TOLERANCE:-15}
+count=${BENCH_COUNT:-5}
+pattern='NewJobFromTemplates|GetBlockHeader|CheckSolves|NotifySerialize|NotifyBroadcast'
+mkdir -p $dir
+
+flags=""
+if [ "$1" == "profile" ]; then
+	flags="-cpuprofile $dir/cpu.pprof -memprofile $dir/mem.pprof -o $dir/ngstratum.test"
+fi
+go test -run '^$' -bench "$pattern" -benchmem -count "$count" $flags ./cmd/ngstratum | tee $current
+
+if [ "$1" == "save" ]; then
+	cp $current $baseline
+	echo "Saved baseline to $baseline"
+	exit 0
+fi
+if [ "$1" == "profile" ]; then
+	echo "Profiles in $dir, ie go tool pprof $dir/ngstratum.test $dir/cpu.pprof"
+fi
+if [ ! -f $baseline ]; then
+	echo "No baseline yet, run ./bench.sh save first"
+	exit 0
+fi
+if command -v benchstat > /dev/null; then
+	benchstat $baseline $current
+fi
+
+# Compares the mean ns/op of each benchmark
+awk -v tolerance="$tolerance" '
+/^Benchmark/ {
+	for (i = 3; i < NF; i++) {
+		if ($(i+1) == "ns/op") {
+			sum[FILENAME, $1] += $i
+			runs[FILENAME, $1]++
+			names[$1] = 1
+		}
+	}
+}
+END {
+	failed = 0
+	for (name in names) {
+		if (!runs[ARGV[1], name] || !runs[ARGV[2], name]) {
+			continue
+		}
+		old = sum[ARGV[1], name] / runs[ARGV[1], name]
+		new = sum[ARGV[2], name] / runs[ARGV[2], name]
+		change = (new - old) / old * 100
+		status = "ok"
+		if (change > tolerance) {
+			status = "REGRESSION"
+			failed = 1
+		}
+		printf "%-50s %12.0f -> %12.0f ns/op %+7.1f%% %s\n", name, old, new, change, status
+	}
+	exit failed
+}' $baseline $current
@@ -1,7 +1,10 @@
 #!/bin/bash -x
 go-bindata -o cmd/ngweb/bindata.go ./sql/
+go-bindata -pkg migrate -o pkg/migrate/bindata.go -prefix sql/migrations/ ./sql/migrations/
+protoc --go_out=plugins=grpc,paths=source_relative:. pkg/adminrpc/admin.proto
 go build ./cmd/ngsign
 go build ./cmd/ngstratum
 go build ./cmd/ngweb
 go build ./cmd/ngcoinserver
 go build ./cmd/ngctl
+go build ./cmd/ngminersim
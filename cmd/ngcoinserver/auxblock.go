@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/pkg/errors"
+
+	"github.com/icook/ngpool/pkg/service"
+)
+
+// Work from createauxblock. The node builds the aux block itself, paying
+// the address we ask it to, so we only ever see its header hash
+type auxBlock struct {
+	Hash              string `json:"hash"`
+	ChainID           int    `json:"chainid"`
+	PreviousBlockHash string `json:"previousblockhash"`
+	CoinbaseValue     int64  `json:"coinbasevalue"`
+	Bits              string `json:"bits"`
+	Height            uint64 `json:"height"`
+}
+
+// The template stratum gets for aux work, shaped like getblocktemplate's
+// so it goes through the same pipeline. auxblockhash is what marks it as
+// one, blocks for it go back through submitauxblock
+func (a *auxBlock) template() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"height":            a.Height,
+		"coinbasevalue":     a.CoinbaseValue,
+		"previousblockhash": a.PreviousBlockHash,
+		"bits":              a.Bits,
+		"auxblockhash":      a.Hash,
+		"extras":            map[string]interface{}{"chainid": a.ChainID},
+	})
+}
+
+// UpdateBlock for TemplateType createauxblock. The node's work is asked for
+// paying the currency's BlockSubsidyAddress, and sent on whenever its hash
+// changes, which is on new blocks and when the node refreshes its
+// transactions
+func (c *CoinBuddy) updateAuxBlock() error {
+	code := strings.ToUpper(c.config.GetString("CurrencyCode"))
+	chainConfig, ok := service.Currency(code)
+	if !ok {
+		log.Error("No currency config, can't ask for aux work", "currency", code)
+		return errors.Errorf("No currency config for %s", code)
+	}
+	var work auxBlock
+	err := c.cs.client.Call(&work, "createauxblock",
+		(*chainConfig.BlockSubsidyAddress).String())
+	c.rpcHealth.Mark(err, time.Now())
+	if err != nil {
+		log.Error("Failed to get aux block", "err", err)
+		return err
+	}
+	if work.Hash == "" || work.ChainID == 0 {
+		log.Warn("Malformed aux block", "work", work)
+		return errors.New("Malformed aux block")
+	}
+	rawTemplate, err := work.template()
+	if err != nil {
+		return err
+	}
+
+	c.lastBlockMtx.Lock()
+	transmit := work.Hash != c.lastAuxHash
+	if transmit {
+		if work.Height > c.lastBlockHeight {
+			log.Info("Got new aux block from client", "height", work.Height)
+			c.lastBlockAt = time.Now()
+		}
+		c.lastAuxHash = work.Hash
+		c.lastBlockHeight = work.Height
+		c.lastBlockValue = work.CoinbaseValue
+		c.lastBlock = rawTemplate
+	}
+	c.lastBlockMtx.Unlock()
+	if transmit {
+		c.broadcast.Submit(json.RawMessage(rawTemplate))
+	}
+	return nil
+}
+
+// Nodes don't tell us when createauxblock's work changes between blocks, so
+// it's asked for again every AuxBlockPoll
+func (c *CoinBuddy) RunAuxBlockPoll() {
+	if c.config.GetString("TemplateType") != "createauxblock" {
+		return
+	}
+	for range time.Tick(c.config.GetDuration("AuxBlockPoll")) {
+		c.UpdateBlock()
+	}
+}
@@ -3,12 +3,13 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"github.com/icook/btcd/rpcclient"
+	"github.com/icook/ngpool/pkg/rpcclient"
 	log "github.com/inconshreveable/log15"
 	"github.com/mitchellh/go-homedir"
 	"github.com/pkg/errors"
 	"io"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"os/exec"
 	"path"
@@ -22,6 +23,8 @@ type Coinserver struct {
 	Config  map[string]string
 	client  *rpcclient.Client
 	command *exec.Cmd
+	// Started and stopped by someone else, we only talk to its RPC
+	remote bool
 }
 
 func NewCoinserver(overrideConfig map[string]string, blocknotify string, coinserverBinary string) *Coinserver {
@@ -64,24 +67,34 @@ func NewCoinserver(overrideConfig map[string]string, blocknotify string, coinser
 	// Start server
 	c.command = exec.Command(coinserverBinary, args...)
 
-	connCfg := &rpcclient.ConnConfig{
-		Host:         fmt.Sprintf("localhost:%v", config["rpcport"]),
-		User:         config["rpcuser"],
-		Pass:         config["rpcpassword"],
-		HTTPPostMode: true, // Bitcoin core only supports HTTP POST mode
-		DisableTLS:   true, // Bitcoin core does not provide TLS by default
-	}
-	client, err := rpcclient.New(connCfg, nil)
-	if err != nil {
-		log.Crit("Failed to initialize rpcclient", "err", err)
-		os.Exit(1)
-	}
-	c.client = client
+	c.client = rpcclient.New(rpcclient.Config{
+		URL:  fmt.Sprintf("http://localhost:%v/", config["rpcport"]),
+		User: config["rpcuser"],
+		Pass: config["rpcpassword"],
+	})
 
 	return c
 }
 
+// For a coinserver that's already running elsewhere, ie behind Tor or a
+// bastion host, reached through proxy if it's not nil
+func NewRemoteCoinserver(rpcURL string, user string, pass string, proxy *url.URL) *Coinserver {
+	return &Coinserver{
+		Config: map[string]string{},
+		client: rpcclient.New(rpcclient.Config{
+			URL:   rpcURL,
+			User:  user,
+			Pass:  pass,
+			Proxy: proxy,
+		}),
+		remote: true,
+	}
+}
+
 func (c *Coinserver) Stop() bool {
+	if c.remote {
+		return false
+	}
 	proc, err := c.getProcess()
 	if err != nil {
 		log.Warn("Failed to lookup pid for process from pidfile", "err", err)
@@ -152,6 +165,9 @@ func (c *Coinserver) kill(proc *os.Process) error {
 }
 
 func (c *Coinserver) Run() error {
+	if c.remote {
+		return nil
+	}
 	log.Debug("Starting coinserver", "bin", c.command.Path, "args", c.command.Args)
 	os.Mkdir(c.Config["datadir"], os.ModePerm)
 	done := make(chan interface{}, 1)
@@ -179,9 +195,10 @@ func (c *Coinserver) WaitUntilUp() error {
 	i := 0
 	tot := 900
 	for ; i < tot; i++ {
-		ret, err := c.client.GetInfo()
+		// We're polling anyway, so no retries
+		ret, err := c.client.RawRequestOnce("getinfo", nil)
 		if err == nil {
-			log.Info("Coinserver up", "time", i/10, "info", ret)
+			log.Info("Coinserver up", "time", i/10, "info", string(ret))
 			break
 		}
 		time.Sleep(100 * time.Millisecond)
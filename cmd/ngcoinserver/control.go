@@ -0,0 +1,39 @@
+package main
+
+import (
+	log "github.com/inconshreveable/log15"
+
+	"github.com/icook/ngpool/pkg/logging"
+	"github.com/icook/ngpool/pkg/service"
+)
+
+// Registers handlers for the commands ngctl svc sends, and starts watching
+// for them. There's nothing to drain, stratums pick another coinserver when
+// we go away
+func (c *CoinBuddy) setupControl() {
+	c.service.HandleControl(service.ControlReloadConfig, c.reloadConfig)
+	c.service.HandleControl(service.ControlRotateLogs, func(service.ControlCommand) error {
+		return c.logs.Reopen()
+	})
+	// The coinserver would otherwise be left running, holding its datadir
+	// lock so the new one can't start
+	c.service.BeforeRestart(c.Stop)
+	go c.service.WatchControl()
+}
+
+// LogLevel, LogModules and LogFormat apply without a restart. NodeConfig in
+// particular is written out when the coinserver starts
+func (c *CoinBuddy) reloadConfig(service.ControlCommand) error {
+	config, err := c.service.FetchConfig()
+	if err != nil {
+		return err
+	}
+	if err := c.logs.Reload(config); err != nil {
+		return err
+	}
+	pending := service.ChangedKeys(c.config, config, logging.RuntimeKeys...)
+	if len(pending) > 0 {
+		log.Warn("Config changes need a restart to apply", "keys", pending)
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+
+	"github.com/icook/ngpool/pkg/adminrpc"
+)
+
+// How long an admin call can take before giving up
+const adminTimeout = time.Second * 10
+
+var (
+	adminTLS      adminrpc.TLSFiles
+	adminSessions adminrpc.SessionSelector
+)
+
+func dialAdmin(addr string) *grpc.ClientConn {
+	conn, err := adminrpc.Dial(addr, adminTLS)
+	if err != nil {
+		log.Crit("Failed to connect to admin API", "addr", addr, "err", err)
+		os.Exit(1)
+	}
+	return conn
+}
+
+func adminContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), adminTimeout)
+}
+
+func adminFailed(err error) {
+	if err != nil {
+		log.Crit("Admin call failed", "err", err)
+		os.Exit(1)
+	}
+}
+
+func addSessionFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&adminSessions.Id, "id", "", "Session id")
+	cmd.Flags().StringVar(&adminSessions.Username, "username", "", "All of a user's sessions")
+	cmd.Flags().StringVar(&adminSessions.Worker, "worker", "", "Only this worker of --username")
+}
+
+// For adminCmd's subcommands and anything else talking to an admin API
+func addAdminTLSFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringVar(&adminTLS.CertFile, "cert", "admin.crt",
+		"Client certificate")
+	cmd.PersistentFlags().StringVar(&adminTLS.KeyFile, "key", "admin.key",
+		"Client certificate key")
+	cmd.PersistentFlags().StringVar(&adminTLS.CAFile, "ca", "ca.crt",
+		"CA the service's certificate is signed by")
+}
+
+func init() {
+	adminCmd := &cobra.Command{
+		Use:   "admin",
+		Short: "Control a stratum or ngweb through its gRPC admin API",
+		Run: func(cmd *cobra.Command, args []string) {
+			cmd.Help()
+		},
+	}
+	addAdminTLSFlags(adminCmd)
+
+	sessionsCmd := &cobra.Command{
+		Use:   "sessions [addr]",
+		Short: "List a stratum's sessions",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			client := adminrpc.NewStratumAdminClient(dialAdmin(args[0]))
+			ctx, cancel := adminContext()
+			defer cancel()
+			resp, err := client.ListSessions(ctx,
+				&adminrpc.ListSessionsRequest{Sessions: &adminSessions})
+			adminFailed(err)
+			fmt.Printf("%-16s %-20s %-12s %-16s %-8s %10s %12s %8s %8s\n", "id", "username",
+				"worker", "ip", "currency", "diff", "hashrate", "accepted", "rejected")
+			for _, s := range resp.Sessions {
+				diff := strconv.FormatFloat(s.Difficulty, 'g', 6, 64)
+				if s.StaticDifficulty {
+					diff += "*"
+				}
+				fmt.Printf("%-16s %-20s %-12s %-16s %-8s %10s %12s %8d %8d\n", s.Id, s.Username,
+					s.Worker, s.RemoteIp, s.Currency, diff, formatHashrate(s.Hashrate),
+					s.Accepted, s.Rejected)
+			}
+		}}
+	addSessionFlags(sessionsCmd)
+	adminCmd.AddCommand(sessionsCmd)
+
+	kickCmd := &cobra.Command{
+		Use:   "kick [addr]",
+		Short: "Disconnect sessions picked by --id or --username",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			client := adminrpc.NewStratumAdminClient(dialAdmin(args[0]))
+			ctx, cancel := adminContext()
+			defer cancel()
+			resp, err := client.Disconnect(ctx,
+				&adminrpc.DisconnectRequest{Sessions: &adminSessions})
+			adminFailed(err)
+			fmt.Println("Disconnected", resp.Disconnected)
+		}}
+	addSessionFlags(kickCmd)
+	adminCmd.AddCommand(kickCmd)
+
+	var static bool
+	setDiffCmd := &cobra.Command{
+		Use:   "setdiff [addr] [difficulty]",
+		Short: "Set the difficulty of sessions picked by --id or --username",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			diff, err := strconv.ParseFloat(args[1], 64)
+			if err != nil {
+				log.Crit("Invalid difficulty", "err", err)
+				os.Exit(1)
+			}
+			client := adminrpc.NewStratumAdminClient(dialAdmin(args[0]))
+			ctx, cancel := adminContext()
+			defer cancel()
+			resp, err := client.SetDifficulty(ctx, &adminrpc.SetDifficultyRequest{
+				Sessions:   &adminSessions,
+				Difficulty: diff,
+				Static:     static,
+			})
+			adminFailed(err)
+			fmt.Println("Updated", resp.Updated)
+		}}
+	addSessionFlags(setDiffCmd)
+	setDiffCmd.Flags().BoolVar(&static, "static", false,
+		"Keep the difficulty for the session rather than leaving vardiff to move it")
+	adminCmd.AddCommand(setDiffCmd)
+
+	adminCmd.AddCommand(&cobra.Command{
+		Use:   "stats [addr]",
+		Short: "Print a stratum's status",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			client := adminrpc.NewStratumAdminClient(dialAdmin(args[0]))
+			ctx, cancel := adminContext()
+			defer cancel()
+			resp, err := client.GetStats(ctx, &adminrpc.GetStatsRequest{})
+			adminFailed(err)
+			var out bytes.Buffer
+			json.Indent(&out, []byte(resp.StatusJson), "", "  ")
+			fmt.Println(out.String())
+		}})
+
+	var reason string
+	pauseCmd := &cobra.Command{
+		Use:   "pause [addr] [currency]",
+		Short: "Pause payouts of a currency, or all of them",
+		Args:  cobra.RangeArgs(1, 2),
+		Run: func(cmd *cobra.Command, args []string) {
+			client := adminrpc.NewPayoutAdminClient(dialAdmin(args[0]))
+			req := &adminrpc.PausePayoutsRequest{Reason: reason}
+			if len(args) > 1 {
+				req.Currency = strings.ToUpper(args[1])
+			}
+			ctx, cancel := adminContext()
+			defer cancel()
+			_, err := client.PausePayouts(ctx, req)
+			adminFailed(err)
+			fmt.Println("Paused")
+		}}
+	pauseCmd.Flags().StringVar(&reason, "reason", "", "Why payouts are paused")
+	adminCmd.AddCommand(pauseCmd)
+
+	adminCmd.AddCommand(&cobra.Command{
+		Use:   "resume [addr] [currency]",
+		Short: "Lift a pause of payouts",
+		Args:  cobra.RangeArgs(1, 2),
+		Run: func(cmd *cobra.Command, args []string) {
+			client := adminrpc.NewPayoutAdminClient(dialAdmin(args[0]))
+			req := &adminrpc.ResumePayoutsRequest{}
+			if len(args) > 1 {
+				req.Currency = strings.ToUpper(args[1])
+			}
+			ctx, cancel := adminContext()
+			defer cancel()
+			resp, err := client.ResumePayouts(ctx, req)
+			adminFailed(err)
+			if !resp.Resumed {
+				fmt.Println("Wasn't paused")
+				return
+			}
+			fmt.Println("Resumed")
+		}})
+
+	adminCmd.AddCommand(&cobra.Command{
+		Use:   "pauses [addr]",
+		Short: "List paused payouts",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			client := adminrpc.NewPayoutAdminClient(dialAdmin(args[0]))
+			ctx, cancel := adminContext()
+			defer cancel()
+			resp, err := client.ListPauses(ctx, &adminrpc.ListPausesRequest{})
+			adminFailed(err)
+			for _, p := range resp.Pauses {
+				currency := p.Currency
+				if currency == "" {
+					currency = "all"
+				}
+				fmt.Printf("%-8s %s %s\n", currency,
+					time.Unix(p.PausedAt, 0).Local().Format(time.RFC822), p.Reason)
+			}
+		}})
+	RootCmd.AddCommand(adminCmd)
+}
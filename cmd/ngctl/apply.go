@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/coreos/etcd/client"
+	"github.com/fatih/color"
+	log "github.com/inconshreveable/log15"
+	"github.com/sergi/go-diff/diffmatchpatch"
+	"github.com/spf13/cobra"
+)
+
+// Lines of unchanged context around each hunk of a diff
+const diffContext = 3
+
+// Adds diff and apply commands for a config key, for keeping configs in files
+// under version control. use names the args, which end with the file, and
+// keyPath picks the key from them. validator checks the file before it's
+// applied
+func addFileCommands(cmd *cobra.Command, use string, keyPath func(args []string) string,
+	validator func(etcdKeys client.KeysAPI, args []string) validateFunc) {
+	nargs := strings.Count(use, "[")
+
+	var exitCode bool
+	diffCmd := &cobra.Command{
+		Use:   "diff " + use,
+		Short: "Shows a unified diff from the stored config to a local file",
+		Args:  cobra.ExactArgs(nargs),
+		Run: func(cmd *cobra.Command, args []string) {
+			key := keyPath(args)
+			file := readConfigFile(args[len(args)-1])
+			current, _, _ := lookupKeyIndex(getEtcdKeys(), key)
+			diff := unifiedDiff(key, args[len(args)-1], current, file)
+			if diff == "" {
+				return
+			}
+			printDiff(diff)
+			if exitCode {
+				os.Exit(1)
+			}
+		}}
+	diffCmd.Flags().BoolVar(&exitCode, "exit-code", false, "Exit with 1 if there are differences")
+
+	var yes bool
+	applyCmd := &cobra.Command{
+		Use:   "apply " + use,
+		Short: "Pushes a local file to the config, if it hasn't changed since the diff",
+		Long: `Pushes a local file to the config after showing the diff. The write only
+succeeds if the stored config is still the one diffed against, so a change
+made meanwhile is never overwritten. A file that fails validation isn't
+applied`,
+		Args: cobra.ExactArgs(nargs),
+		Run: func(cmd *cobra.Command, args []string) {
+			etcdKeys := getEtcdKeys()
+			key := keyPath(args)
+			fileName := args[len(args)-1]
+			file := readConfigFile(fileName)
+			current, index, exists := lookupKeyIndex(etcdKeys, key)
+			diff := unifiedDiff(key, fileName, current, file)
+			if diff == "" && exists {
+				fmt.Println("No changes")
+				return
+			}
+			printDiff(diff)
+			problems := validator(etcdKeys, args)(file)
+			for _, problem := range problems {
+				color.Red(problem)
+			}
+			if len(problems) > 0 {
+				fmt.Println("Error: Not applying a config with problems")
+				os.Exit(1)
+			}
+			if !yes && !confirm("Apply (y,n): ") {
+				return
+			}
+			err := swapKey(etcdKeys, key, file, index, exists)
+			if err != nil {
+				log.Crit("Failed applying config", "keypath", key, "err", err)
+				os.Exit(1)
+			}
+			var previous *string
+			if exists {
+				previous = &current
+			}
+			recordHistory(etcdKeys, key, "apply "+fileName, previous, &file)
+			log.Info("Successfully applied config", "keypath", key)
+		}}
+	applyCmd.Flags().BoolVar(&yes, "yes", false, "Don't ask for confirmation")
+
+	cmd.AddCommand(diffCmd, applyCmd)
+}
+
+func readConfigFile(name string) string {
+	raw, err := ioutil.ReadFile(name)
+	if err != nil {
+		log.Crit("Unable to read config file", "err", err)
+		os.Exit(1)
+	}
+	return string(raw)
+}
+
+// Like lookupKey, with the index to compare-and-swap against
+func lookupKeyIndex(etcdKeys client.KeysAPI, configKeyPath string) (string, uint64, bool) {
+	res, err := etcdKeys.Get(context.Background(), configKeyPath, nil)
+	if cerr, ok := err.(client.Error); ok && cerr.Code == client.ErrorCodeKeyNotFound {
+		return "", 0, false
+	} else if err != nil {
+		log.Crit("Failed fetching config", "err", err)
+		os.Exit(1)
+	}
+	return res.Node.Value, res.Node.ModifiedIndex, true
+}
+
+// Writes value only if the key is still at index, or still doesn't exist
+func swapKey(etcdKeys client.KeysAPI, configKeyPath string, value string,
+	index uint64, exists bool) error {
+	opts := &client.SetOptions{PrevIndex: index}
+	if !exists {
+		opts = &client.SetOptions{PrevExist: client.PrevNoExist}
+	}
+	_, err := etcdKeys.Set(context.Background(), configKeyPath, value, opts)
+	if cerr, ok := err.(client.Error); ok &&
+		(cerr.Code == client.ErrorCodeTestFailed || cerr.Code == client.ErrorCodeNodeExist) {
+		return fmt.Errorf("%s changed since it was diffed, run apply again", configKeyPath)
+	}
+	return err
+}
+
+func printDiff(diff string) {
+	for _, line := range strings.SplitAfter(diff, "\n") {
+		switch {
+		case strings.HasPrefix(line, "+++"), strings.HasPrefix(line, "---"):
+			fmt.Print(line)
+		case strings.HasPrefix(line, "+"):
+			color.New(color.FgGreen).Print(line)
+		case strings.HasPrefix(line, "-"):
+			color.New(color.FgRed).Print(line)
+		case strings.HasPrefix(line, "@@"):
+			color.New(color.FgCyan).Print(line)
+		default:
+			fmt.Print(line)
+		}
+	}
+}
+
+type diffLine struct {
+	op   diffmatchpatch.Operation
+	text string
+}
+
+// A unified diff from one text to another, empty if they're the same
+func unifiedDiff(fromName string, toName string, from string, to string) string {
+	dmp := diffmatchpatch.New()
+	a, b, lineArray := dmp.DiffLinesToChars(from, to)
+	diffs := dmp.DiffCharsToLines(dmp.DiffMain(a, b, false), lineArray)
+
+	var lines []diffLine
+	for _, diff := range diffs {
+		for _, text := range strings.SplitAfter(diff.Text, "\n") {
+			if text != "" {
+				lines = append(lines, diffLine{diff.Type, text})
+			}
+		}
+	}
+	// The line number in each text that each line starts at
+	fromLine := make([]int, len(lines)+1)
+	toLine := make([]int, len(lines)+1)
+	fromLine[0], toLine[0] = 1, 1
+	for i, line := range lines {
+		fromLine[i+1], toLine[i+1] = fromLine[i], toLine[i]
+		if line.op != diffmatchpatch.DiffInsert {
+			fromLine[i+1]++
+		}
+		if line.op != diffmatchpatch.DiffDelete {
+			toLine[i+1]++
+		}
+	}
+
+	var out bytes.Buffer
+	for i := 0; i < len(lines); {
+		if lines[i].op == diffmatchpatch.DiffEqual {
+			i++
+			continue
+		}
+		// Take in every change close enough that their context would meet
+		last := i
+		for j := i + 1; j < len(lines) && j-last <= 2*diffContext+1; j++ {
+			if lines[j].op != diffmatchpatch.DiffEqual {
+				last = j
+			}
+		}
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := last + diffContext + 1
+		if end > len(lines) {
+			end = len(lines)
+		}
+
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromName, toName)
+		}
+		fromStart, fromCount := fromLine[start], fromLine[end]-fromLine[start]
+		toStart, toCount := toLine[start], toLine[end]-toLine[start]
+		// An empty range is given as the line before it
+		if fromCount == 0 {
+			fromStart--
+		}
+		if toCount == 0 {
+			toStart--
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", fromStart, fromCount, toStart, toCount)
+		for _, line := range lines[start:end] {
+			prefix := " "
+			switch line.op {
+			case diffmatchpatch.DiffInsert:
+				prefix = "+"
+			case diffmatchpatch.DiffDelete:
+				prefix = "-"
+			}
+			out.WriteString(prefix + line.text)
+			if !strings.HasSuffix(line.text, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		i = end
+	}
+	return out.String()
+}
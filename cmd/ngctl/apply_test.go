@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	assert.Equal(t, "", unifiedDiff("a", "b", "x: 1\n", "x: 1\n"))
+	assert.Equal(t, "--- /config/common\n+++ common.yaml\n"+
+		"@@ -1,3 +1,3 @@\n a: 1\n-b: 2\n+b: 3\n c: 4\n",
+		unifiedDiff("/config/common", "common.yaml", "a: 1\nb: 2\nc: 4\n", "a: 1\nb: 3\nc: 4\n"))
+	// A new key is all additions
+	assert.Equal(t, "--- a\n+++ b\n@@ -0,0 +1,1 @@\n+x: 1\n", unifiedDiff("a", "b", "", "x: 1\n"))
+
+	// Changes far apart get their own hunks with 3 lines of context
+	from := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n"
+	to := "one\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\ntwelve\n"
+	assert.Equal(t, "--- a\n+++ b\n"+
+		"@@ -1,4 +1,4 @@\n-1\n+one\n 2\n 3\n 4\n"+
+		"@@ -9,4 +9,4 @@\n 9\n 10\n 11\n-12\n+twelve\n",
+		unifiedDiff("a", "b", from, to))
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/fatih/color"
+	log "github.com/inconshreveable/log15"
+	"github.com/spf13/cobra"
+
+	"github.com/icook/ngpool/pkg/blockarchive"
+)
+
+func init() {
+	blocksCmd := &cobra.Command{
+		Use:   "blocks",
+		Short: "Block candidates archived by ngstratum",
+	}
+
+	var (
+		dir string
+		raw bool
+	)
+	inspectCmd := &cobra.Command{
+		Use:   "inspect [hash]",
+		Short: "Decode an archived block candidate",
+		Long: `Decodes a block from ngstratum's BlockArchiveDir next to the template it
+was built from, the share that solved it and every coinserver's answer,
+pointing out where the block and template disagree. The hash can be in
+either byte order, and a unique prefix is enough`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			path, err := blockarchive.Find(dir, args[0])
+			if err != nil {
+				log.Crit("Unable to find block", "err", err)
+				os.Exit(1)
+			}
+			rec, err := blockarchive.Load(path)
+			if err != nil {
+				log.Crit("Unable to load block", "path", path, "err", err)
+				os.Exit(1)
+			}
+			if raw {
+				out, _ := json.MarshalIndent(rec, "", "  ")
+				fmt.Println(string(out))
+				return
+			}
+			printArchivedBlock(rec)
+		}}
+	inspectCmd.Flags().StringVarP(&dir, "dir", "d", ".", "The stratum's BlockArchiveDir")
+	inspectCmd.Flags().BoolVar(&raw, "raw", false, "Print the archived record as JSON")
+
+	blocksCmd.AddCommand(inspectCmd)
+	RootCmd.AddCommand(blocksCmd)
+}
+
+// The parts of the archived template worth comparing with the block
+type archivedTemplate struct {
+	Height            int64
+	PreviousBlockhash string
+	Bits              string
+	CurTime           int64
+	CoinbaseValue     int64
+	Transactions      []json.RawMessage
+}
+
+func printArchivedBlock(rec *blockarchive.Record) {
+	warn := color.New(color.FgRed)
+	fmt.Printf("%s block at height %d, submitted %s\n", rec.Currency, rec.Height,
+		rec.SubmittedAt.Format(time.RFC3339))
+	fmt.Printf("  archived hash  %s\n", rec.Hash)
+	fmt.Printf("  %-14s %s\n  %-14s %s\n", rec.PowAlgo+" hash", rec.PowHash, "target", rec.Target)
+	if rec.Share != nil {
+		fmt.Printf("  solved by      %s.%s at difficulty %v, %s\n", rec.Share.Username,
+			rec.Share.Worker, rec.Share.Difficulty, rec.Share.MinedAt.Format(time.RFC3339))
+	} else {
+		fmt.Println("  solved by      the built in CPU miner")
+	}
+
+	fmt.Println("\nCoinserver responses")
+	if len(rec.Responses) == 0 {
+		fmt.Println("  none")
+	}
+	sources := make([]string, 0, len(rec.Responses))
+	for source := range rec.Responses {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	for _, source := range sources {
+		res := rec.Responses[source]
+		line := fmt.Sprintf("  %-20s %-9s %6dms %s\n", source, res.Result, res.LatencyMS, res.Reason)
+		if res.Result == "accepted" {
+			fmt.Print(line)
+		} else {
+			warn.Print(line)
+		}
+	}
+
+	var tmpl archivedTemplate
+	if err := json.Unmarshal(rec.Template, &tmpl); err != nil {
+		warn.Printf("\nUnable to decode the template: %s\n", err)
+	}
+	data, err := hex.DecodeString(rec.Block)
+	if err != nil {
+		warn.Printf("\nBlock isn't valid hex: %s\n", err)
+		return
+	}
+	fmt.Printf("\nBlock, %d bytes\n", len(data))
+	var header wire.BlockHeader
+	if err := header.Deserialize(bytes.NewReader(data)); err != nil {
+		warn.Printf("  Unable to decode the header: %s\n", err)
+		return
+	}
+	fmt.Printf("  version        %#08x\n", header.Version)
+	fmt.Printf("  previous block %s\n", header.PrevBlock)
+	if tmpl.PreviousBlockhash != "" && tmpl.PreviousBlockhash != header.PrevBlock.String() {
+		warn.Printf("                 template has %s\n", tmpl.PreviousBlockhash)
+	}
+	fmt.Printf("  merkle root    %s\n", header.MerkleRoot)
+	fmt.Printf("  time           %d (%s)\n", header.Timestamp.Unix(),
+		header.Timestamp.UTC().Format(time.RFC3339))
+	if tmpl.CurTime != 0 && header.Timestamp.Unix() < tmpl.CurTime-7200 {
+		warn.Printf("                 well before the template's %d\n", tmpl.CurTime)
+	}
+	fmt.Printf("  bits           %08x\n", header.Bits)
+	if tmpl.Bits != "" && tmpl.Bits != fmt.Sprintf("%08x", header.Bits) {
+		warn.Printf("                 template has %s\n", tmpl.Bits)
+	}
+	fmt.Printf("  nonce          %08x\n", header.Nonce)
+
+	var block wire.MsgBlock
+	if err := block.Deserialize(bytes.NewReader(data)); err != nil {
+		// Merge mined blocks carry an AuxPoW after the header
+		warn.Printf("  Unable to decode transactions (merge mined?): %s\n", err)
+		return
+	}
+	fmt.Printf("\nTransactions   %d\n", len(block.Transactions))
+	if len(tmpl.Transactions)+1 != len(block.Transactions) {
+		warn.Printf("               template had %d plus the coinbase\n", len(tmpl.Transactions))
+	}
+	hashes := make([]chainhash.Hash, len(block.Transactions))
+	for i, tx := range block.Transactions {
+		hashes[i] = tx.TxHash()
+	}
+	if root := merkleRoot(hashes); root != header.MerkleRoot {
+		warn.Printf("  merkle root of the transactions is %s\n", root)
+	}
+	if len(block.Transactions) == 0 {
+		return
+	}
+	coinbase := block.Transactions[0]
+	fmt.Printf("  coinbase       %s\n", coinbase.TxHash())
+	for _, in := range coinbase.TxIn {
+		fmt.Printf("    script sig   %x\n", in.SignatureScript)
+	}
+	var total int64
+	for i, out := range coinbase.TxOut {
+		total += out.Value
+		fmt.Printf("    out %-3d %16d %x\n", i, out.Value, out.PkScript)
+	}
+	fmt.Printf("    total    %16d\n", total)
+	if tmpl.CoinbaseValue != 0 && total > tmpl.CoinbaseValue {
+		warn.Printf("    more than the template's coinbase value of %d\n", tmpl.CoinbaseValue)
+	}
+}
+
+// The merkle root of transaction hashes, the last of a level paired with
+// itself when there's an odd number
+func merkleRoot(hashes []chainhash.Hash) chainhash.Hash {
+	if len(hashes) == 0 {
+		return chainhash.Hash{}
+	}
+	for len(hashes) > 1 {
+		if len(hashes)%2 == 1 {
+			hashes = append(hashes, hashes[len(hashes)-1])
+		}
+		next := make([]chainhash.Hash, len(hashes)/2)
+		for i := range next {
+			var pair [chainhash.HashSize * 2]byte
+			copy(pair[:], hashes[i*2][:])
+			copy(pair[chainhash.HashSize:], hashes[i*2+1][:])
+			next[i] = chainhash.DoubleHashH(pair[:])
+		}
+		hashes = next
+	}
+	return hashes[0]
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMerkleRoot(t *testing.T) {
+	genesis := chaincfg.MainNetParams.GenesisBlock
+	assert.Equal(t, genesis.Header.MerkleRoot,
+		merkleRoot([]chainhash.Hash{genesis.Transactions[0].TxHash()}))
+
+	a, b, c := chainhash.HashH([]byte("a")), chainhash.HashH([]byte("b")), chainhash.HashH([]byte("c"))
+	pair := func(x, y chainhash.Hash) chainhash.Hash {
+		return chainhash.DoubleHashH(append(x[:], y[:]...))
+	}
+	assert.Equal(t, pair(a, b), merkleRoot([]chainhash.Hash{a, b}))
+	// An odd one out is paired with itself
+	assert.Equal(t, pair(pair(a, b), pair(c, c)), merkleRoot([]chainhash.Hash{a, b, c}))
+	assert.Equal(t, chainhash.Hash{}, merkleRoot(nil))
+}
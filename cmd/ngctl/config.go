@@ -29,9 +29,12 @@ func init() {
 		Use: "edit",
 		Run: func(cmd *cobra.Command, args []string) {
 			etcdKeys := getEtcdKeys()
-			editKey(etcdKeys, "/config/common")
+			editKey(etcdKeys, "/config/common", validateYAML)
 		},
 	})
+	addFileCommands(commonCmd, "[file]",
+		func(args []string) string { return "/config/common" },
+		func(etcdKeys client.KeysAPI, args []string) validateFunc { return validateYAML })
 
 	coinserverCmd := &cobra.Command{
 		Use: "coinserver",
@@ -49,9 +52,19 @@ func init() {
 	}
 	setupConfigCommands(stratumCmd, "stratum")
 
+	// Currencies kept one to a key, which services reload without a restart
+	currencyCmd := &cobra.Command{
+		Use: "currency",
+		Run: func(cmd *cobra.Command, args []string) {
+			cmd.Help()
+		},
+	}
+	setupConfigCommands(currencyCmd, "currencies")
+
 	RootCmd.AddCommand(commonCmd)
 	RootCmd.AddCommand(stratumCmd)
 	RootCmd.AddCommand(coinserverCmd)
+	RootCmd.AddCommand(currencyCmd)
 }
 
 func setupConfigCommands(cmd *cobra.Command, serviceType string) {
@@ -88,17 +101,12 @@ func setupConfigCommands(cmd *cobra.Command, serviceType string) {
 
 			etcdKeys := getEtcdKeys()
 			def := getDefaultConfig(serviceType)
-			newConfig, save := modifyLoop(def, keyPath)
+			validate := serviceValidator(etcdKeys, serviceType, name)
+			newConfig, save := modifyLoop(def, keyPath, validate)
 			if !save {
 				return
 			}
-			_, err := etcdKeys.Set(
-				context.Background(), keyPath, newConfig, nil)
-			if err != nil {
-				log.Crit("Failed pushing config", "err", err)
-				os.Exit(1)
-			}
-			log.Info("Successfully pushed config", "keypath", keyPath)
+			writeKey(etcdKeys, keyPath, newConfig, "new")
 		}}
 
 	var editCmd = &cobra.Command{
@@ -110,7 +118,8 @@ func setupConfigCommands(cmd *cobra.Command, serviceType string) {
 			name := args[0]
 			configKeyPath := "/config/" + serviceType + "/" + name
 
-			editKey(etcdKeys, configKeyPath)
+			editKey(etcdKeys, configKeyPath,
+				serviceValidator(etcdKeys, serviceType, name))
 		}}
 
 	var cloneCmd = &cobra.Command{
@@ -123,17 +132,12 @@ func setupConfigCommands(cmd *cobra.Command, serviceType string) {
 			values := getKey(etcdKeys, configKeyPath)
 
 			keyPath := "/config/" + serviceType + "/" + args[1]
-			newConfig, save := modifyLoop(values, keyPath)
+			validate := serviceValidator(etcdKeys, serviceType, args[1])
+			newConfig, save := modifyLoop(values, keyPath, validate)
 			if !save {
 				return
 			}
-			_, err := etcdKeys.Set(
-				context.Background(), keyPath, newConfig, nil)
-			if err != nil {
-				log.Crit("Failed pushing config", "err", err)
-				os.Exit(1)
-			}
-			log.Info("Successfully pushed config", "keypath", keyPath)
+			writeKey(etcdKeys, keyPath, newConfig, "clone "+args[0])
 		}}
 
 	var rmCmd = &cobra.Command{
@@ -144,7 +148,7 @@ func setupConfigCommands(cmd *cobra.Command, serviceType string) {
 			etcdKeys := getEtcdKeys()
 			name := args[0]
 			configKeyPath := "/config/" + serviceType + "/" + name
-			rmKey(etcdKeys, configKeyPath)
+			rmKey(etcdKeys, configKeyPath, "rm")
 		}}
 
 	var mvCmd = &cobra.Command{
@@ -158,9 +162,14 @@ func setupConfigCommands(cmd *cobra.Command, serviceType string) {
 			configKeyPath := "/config/" + serviceType + "/" + name
 			newConfigKeyPath := "/config/" + serviceType + "/" + newName
 			values := getKey(etcdKeys, configKeyPath)
-			writeKey(etcdKeys, newConfigKeyPath, values)
-			rmKey(etcdKeys, configKeyPath)
+			writeKey(etcdKeys, newConfigKeyPath, values, "mv "+name)
+			rmKey(etcdKeys, configKeyPath, "rm")
 		}}
 
 	cmd.AddCommand(newCmd, rmCmd, lsCmd, mvCmd, editCmd, cloneCmd)
+	addFileCommands(cmd, "[name] [file]",
+		func(args []string) string { return "/config/" + serviceType + "/" + args[0] },
+		func(etcdKeys client.KeysAPI, args []string) validateFunc {
+			return serviceValidator(etcdKeys, serviceType, args[0])
+		})
 }
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/fatih/color"
+	log "github.com/inconshreveable/log15"
+	"github.com/spf13/cobra"
+
+	"github.com/icook/ngpool/pkg/migrate"
+)
+
+func init() {
+	dbCmd := &cobra.Command{
+		Use:   "db",
+		Short: "Database schema migrations",
+		Run: func(cmd *cobra.Command, args []string) {
+			cmd.Help()
+		},
+	}
+	dbCmd.PersistentFlags().StringVar(&dbConnectionString, "db", "",
+		"Postgres connection string. Defaults to the api DbConnectionString in the common config")
+
+	dbCmd.AddCommand(&cobra.Command{
+		Use:   "status",
+		Short: "List migrations and whether they've been applied",
+		Run: func(cmd *cobra.Command, args []string) {
+			statuses, err := getMigrator().Status()
+			if err != nil {
+				log.Crit("Failed to load migration status", "err", err)
+				os.Exit(1)
+			}
+			for _, s := range statuses {
+				name := fmt.Sprintf("%04d_%s", s.Version, s.Name)
+				if s.AppliedAt == nil {
+					color.Yellow("%-40s pending", name)
+				} else {
+					color.Green("%-40s applied %s", name, s.AppliedAt.Local().Format(time.RFC3339))
+				}
+			}
+		}})
+
+	var (
+		target   int
+		baseline int
+	)
+	migrateCmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Apply pending migrations",
+		Long: `Apply pending migrations, up to --to or all of them. A database provisioned
+before migrations were tracked must be marked with --baseline first, ie
+--baseline 1 if it was created from the original tables.sql, then migrated
+again to apply the rest`,
+		Run: func(cmd *cobra.Command, args []string) {
+			migrator := getMigrator()
+			if baseline > 0 {
+				err := migrator.Baseline(baseline)
+				if err != nil {
+					log.Crit("Failed to baseline", "err", err)
+					os.Exit(1)
+				}
+				fmt.Println("Marked migrations up to", baseline, "as applied")
+				return
+			}
+			applied, err := migrator.Up(target)
+			for _, m := range applied {
+				color.Green("Applied %04d_%s", m.Version, m.Name)
+			}
+			if err != nil {
+				log.Crit("Migration failed", "err", err)
+				os.Exit(1)
+			}
+			if len(applied) == 0 {
+				fmt.Println("Nothing to migrate")
+			}
+		}}
+	migrateCmd.Flags().IntVar(&target, "to", 0, "Only migrate up to this version")
+	migrateCmd.Flags().IntVar(&baseline, "baseline", 0,
+		"Mark migrations up to this version as applied without running them")
+
+	var (
+		steps int
+		yes   bool
+	)
+	rollbackCmd := &cobra.Command{
+		Use:   "rollback",
+		Short: "Roll back the most recently applied migrations",
+		Run: func(cmd *cobra.Command, args []string) {
+			if !yes && !confirm(fmt.Sprintf(
+				"Roll back %d migration(s)? This may drop data (y,n): ", steps)) {
+				return
+			}
+			rolledBack, err := getMigrator().Down(steps)
+			for _, m := range rolledBack {
+				color.Yellow("Rolled back %04d_%s", m.Version, m.Name)
+			}
+			if err != nil {
+				log.Crit("Rollback failed", "err", err)
+				os.Exit(1)
+			}
+			if len(rolledBack) == 0 {
+				fmt.Println("Nothing to roll back")
+			}
+		}}
+	rollbackCmd.Flags().IntVar(&steps, "steps", 1, "How many migrations to roll back")
+	rollbackCmd.Flags().BoolVar(&yes, "yes", false, "Don't ask for confirmation")
+
+	dbCmd.AddCommand(migrateCmd, rollbackCmd)
+	RootCmd.AddCommand(dbCmd)
+}
+
+func getMigrator() *migrate.Migrator {
+	migrations, err := migrate.Embedded()
+	if err != nil {
+		log.Crit("Invalid embedded migrations", "err", err)
+		os.Exit(1)
+	}
+	// Only go to etcd for the connection string if we weren't given one
+	var config map[string]interface{}
+	if dbConnectionString == "" {
+		config = loadCommonConfig()
+	}
+	return migrate.NewMigrator(connectDB(config), migrations)
+}
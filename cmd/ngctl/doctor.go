@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/fatih/color"
+	log "github.com/inconshreveable/log15"
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/cobra"
+
+	"github.com/icook/ngpool/pkg/service"
+)
+
+func init() {
+	var staleAfter time.Duration
+	doctorCmd := &cobra.Command{
+		Use:   "doctor",
+		Short: "Cross-checks every config and service status in etcd",
+		Run: func(cmd *cobra.Command, args []string) {
+			etcdKeys := getEtcdKeys()
+			d := loadDoctorState(etcdKeys)
+			d.staleAfter = staleAfter
+			findings := d.check()
+			for _, f := range findings {
+				say := color.Yellow
+				if f.severity == severityError {
+					say = color.Red
+				}
+				say("%s %s: %s", f.severity, f.subject, f.problem)
+				if f.fix != "" {
+					fmt.Printf("  %s\n", f.fix)
+				}
+			}
+			if len(findings) == 0 {
+				color.Green("No problems found")
+			}
+			for _, f := range findings {
+				if f.severity == severityError {
+					os.Exit(1)
+				}
+			}
+		}}
+	doctorCmd.Flags().DurationVar(&staleAfter, "stale", time.Minute*5,
+		"How long since a service's last status update before it's reported as stale")
+	RootCmd.AddCommand(doctorCmd)
+}
+
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+)
+
+// Something ngctl doctor found, with what to do about it
+type finding struct {
+	severity string
+	// ie "stratum/3333" or "currency/LTC"
+	subject string
+	problem string
+	fix     string
+}
+
+// Everything doctor checks, as read from etcd
+type doctorState struct {
+	common map[string]interface{}
+	// By service type ("stratum" or "coinserver") then name, raw YAML
+	configs map[string]map[string]string
+	// Per-currency keys, raw YAML by code
+	currencyKeys map[string]string
+	// By namespace then service ID
+	statuses   map[string]map[string]*service.ServiceStatus
+	now        time.Time
+	staleAfter time.Duration
+}
+
+func loadDoctorState(etcdKeys client.KeysAPI) *doctorState {
+	d := &doctorState{
+		common:   map[string]interface{}{},
+		configs:  map[string]map[string]string{},
+		statuses: map[string]map[string]*service.ServiceStatus{},
+		now:      time.Now(),
+	}
+	if raw, ok := lookupKey(etcdKeys, "/config/common"); ok {
+		parsed, err := parseConfig(*raw)
+		if err != nil {
+			log.Crit("Unable to parse common config", "err", err)
+			os.Exit(1)
+		}
+		d.common = parsed
+	}
+	for _, serviceType := range []string{"stratum", "coinserver"} {
+		d.configs[serviceType] = listKeys(etcdKeys, "/config/"+serviceType)
+		d.statuses[serviceType] = runningServices(etcdKeys, serviceType)
+	}
+	d.currencyKeys = listKeys(etcdKeys, "/config/currencies")
+	return d
+}
+
+// The values of a directory's keys, by key name. Empty if there's no such
+// directory
+func listKeys(etcdKeys client.KeysAPI, dir string) map[string]string {
+	values := map[string]string{}
+	res, err := etcdKeys.Get(context.Background(), dir, &client.GetOptions{Recursive: true})
+	if cerr, ok := err.(client.Error); ok && cerr.Code == client.ErrorCodeKeyNotFound {
+		return values
+	} else if err != nil {
+		log.Crit("Unable to contact etcd", "err", err)
+		os.Exit(1)
+	}
+	for _, node := range res.Node.Nodes {
+		values[node.Key[strings.LastIndexByte(node.Key, '/')+1:]] = node.Value
+	}
+	return values
+}
+
+// Runs every check, returning findings errors first
+func (d *doctorState) check() []finding {
+	var findings []finding
+	report := func(severity string, subject string, fix string, format string, args ...interface{}) {
+		findings = append(findings, finding{severity, subject, fmt.Sprintf(format, args...), fix})
+	}
+	for _, serviceType := range []string{"stratum", "coinserver"} {
+		configs := d.configs[serviceType]
+		for _, name := range sortedNames(configs) {
+			others := map[string]string{}
+			for other, raw := range configs {
+				if other != name {
+					others[other] = raw
+				}
+			}
+			for _, problem := range validateConfig(serviceType, configs[name],
+				configSection(d.common, serviceType), others) {
+				report(severityError, serviceType+"/"+name,
+					fmt.Sprintf("Fix with ngctl %s edit %s", serviceType, name), "%s", problem)
+			}
+		}
+	}
+
+	currencies := d.currencies()
+	codes := []string{}
+	for code := range currencies {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		if _, err := service.DecodeCurrency(code, currencies[code]); err != nil {
+			report(severityError, "currency/"+code,
+				fmt.Sprintf("Fix with ngctl currency edit %s", code), "%v", err)
+		}
+	}
+
+	// Currency codes each coinserver config serves, and each running one
+	configured := map[string][]string{}
+	for _, name := range sortedNames(d.configs["coinserver"]) {
+		config, err := parseConfig(d.configs["coinserver"][name])
+		if err != nil {
+			continue
+		}
+		merged := mergeConfig(configSection(d.common, "coinserver"), config)
+		code, _ := configValue(merged, "CurrencyCode").(string)
+		code = strings.ToUpper(code)
+		if code == "" {
+			report(severityError, "coinserver/"+name,
+				fmt.Sprintf("Fix with ngctl coinserver edit %s", name), "has no CurrencyCode")
+			continue
+		}
+		if _, ok := currencies[code]; !ok {
+			report(severityError, "coinserver/"+name,
+				fmt.Sprintf("Add it with ngctl currency new %s, or fix CurrencyCode", code),
+				"CurrencyCode %s isn't a configured currency", code)
+		}
+		configured[code] = append(configured[code], name)
+	}
+	running := map[string]bool{}
+	for _, status := range d.statuses["coinserver"] {
+		running[strings.ToUpper(status.Labels["currency"])] = true
+	}
+
+	shareChains := configSection(d.common, "ShareChains")
+	for _, name := range sortedNames(d.configs["stratum"]) {
+		subject := "stratum/" + name
+		config, err := parseConfig(d.configs["stratum"][name])
+		if err != nil {
+			continue
+		}
+		merged := mergeConfig(configSection(d.common, "stratum"), config)
+		if chain, ok := configValue(merged, "ShareChainName").(string); ok &&
+			configValue(shareChains, chain) == nil {
+			report(severityError, subject, "Add it to ShareChains with ngctl common edit",
+				"ShareChainName %s isn't in the common config's ShareChains", chain)
+		}
+		for _, key := range stratumTemplateKeys(merged) {
+			code := strings.ToUpper(key.Currency)
+			if _, ok := currencies[code]; !ok {
+				report(severityError, subject,
+					fmt.Sprintf("Add it with ngctl currency new %s", code),
+					"mines %s, which isn't a configured currency", code)
+				continue
+			}
+			if len(configured[code]) == 0 {
+				report(severityError, subject,
+					"Create one with ngctl coinserver new",
+					"mines %s, but no coinserver config has CurrencyCode %s", code, code)
+			} else if !running[code] {
+				report(severityWarning, subject,
+					fmt.Sprintf("Start coinserver %s", strings.Join(configured[code], " or ")),
+					"mines %s, but no coinserver for it is running", code)
+			}
+		}
+	}
+
+	for _, namespace := range sortedNamespaces(d.statuses) {
+		statuses := d.statuses[namespace]
+		for _, id := range sortedServiceIDs(statuses) {
+			subject := namespace + "/" + id
+			if _, ok := d.configs[namespace][id]; !ok {
+				report(severityWarning, subject,
+					fmt.Sprintf("Create it with ngctl %s new %s, or stop the service", namespace, id),
+					"is running without a config")
+			}
+			age := d.now.Sub(statuses[id].UpdateTime)
+			if age > d.staleAfter {
+				report(severityWarning, subject,
+					fmt.Sprintf("Check it's still running, or remove /status/%s/%s from etcd", namespace, id),
+					"status last updated %s ago", age.Truncate(time.Second))
+			}
+		}
+	}
+
+	sort.SliceStable(findings, func(i, j int) bool {
+		return findings[i].severity == severityError && findings[j].severity != severityError
+	})
+	return findings
+}
+
+// Currencies from the common config, replaced by any per-currency keys of
+// the same code, the way services load them
+func (d *doctorState) currencies() map[string]interface{} {
+	currencies := map[string]interface{}{}
+	for code, raw := range configSection(d.common, "Currencies") {
+		currencies[strings.ToUpper(code)] = raw
+	}
+	for code, raw := range d.currencyKeys {
+		parsed, err := parseConfig(raw)
+		if err != nil {
+			// Reported when the currency is decoded
+			currencies[strings.ToUpper(code)] = nil
+			continue
+		}
+		currencies[strings.ToUpper(code)] = parsed
+	}
+	return currencies
+}
+
+// The fields of ngstratum's TemplateKey doctor needs
+type templateKey struct {
+	Currency string
+	Algo     string
+}
+
+// The BaseCurrency, ExtraBaseCurrencies and AuxCurrencies of a stratum
+// config. Ones that don't decode are left out, the schema reports them
+func stratumTemplateKeys(config map[string]interface{}) []templateKey {
+	var keys []templateKey
+	var base templateKey
+	if mapstructure.Decode(configValue(config, "BaseCurrency"), &base) == nil && base.Currency != "" {
+		keys = append(keys, base)
+	}
+	for _, name := range []string{"ExtraBaseCurrencies", "AuxCurrencies"} {
+		var more []templateKey
+		if mapstructure.Decode(configValue(config, name), &more) == nil {
+			keys = append(keys, more...)
+		}
+	}
+	return keys
+}
+
+func sortedNames(m map[string]string) []string {
+	names := []string{}
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedNamespaces(statuses map[string]map[string]*service.ServiceStatus) []string {
+	var namespaces []string
+	for namespace := range statuses {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/icook/ngpool/pkg/service"
+)
+
+func TestDoctorCheck(t *testing.T) {
+	now := time.Now()
+	common, err := parseConfig(`
+ShareChains:
+  LTC_T:
+    algo: scrypt
+Currencies:
+  BAD_T:
+    powalgorithm: scrypt
+stratum:
+  ShareChainName: LTC_T
+`)
+	assert.NoError(t, err)
+	d := &doctorState{
+		common: common,
+		configs: map[string]map[string]string{
+			"stratum": {
+				"3333": `
+StratumBind: 127.0.0.1:3333
+BaseCurrency: {Currency: LTC_T, Algo: scrypt, TemplateType: getblocktemplate}
+AuxCurrencies:
+  - {Currency: DOGE_T, Algo: scrypt, TemplateType: getblocktemplate_aux}
+`,
+				"4444": `
+StratumBind: 127.0.0.1:3333
+ShareChainName: BTC_T
+BaseCurrency: {Currency: LTC_T, Algo: scrypt, TemplateType: getblocktemplate}
+`,
+			},
+			"coinserver": {
+				"ltc": "CurrencyCode: ltc_t",
+			},
+		},
+		currencyKeys: map[string]string{"LTC_T": `
+subsidyaddress: mucHkBoHAF8DTQWFuwQXHiewqi3ZBDNNWh
+powalgorithm: scrypt
+pubkeyaddrid: "6f"
+privkeyaddrid: "ef"
+netmagic: 0xfeed0301
+blockmatureconfirms: 100
+payouttransactionfee: 10
+`},
+		statuses: map[string]map[string]*service.ServiceStatus{
+			"stratum": {
+				"3333": {UpdateTime: now},
+				"5555": {UpdateTime: now.Add(-time.Hour)},
+			},
+			"coinserver": {},
+		},
+		now:        now,
+		staleAfter: time.Minute * 5,
+	}
+
+	var got []string
+	for _, f := range d.check() {
+		got = append(got, f.severity+" "+f.subject+": "+f.problem)
+	}
+	assert.Equal(t, []string{
+		"error stratum/3333: StratumBind: port 3333 also used by stratum 4444 (StratumBind)",
+		"error stratum/4444: StratumBind: port 3333 also used by stratum 3333 (StratumBind)",
+		`error currency/BAD_T: Invalid PrivKeyAddrID ""`,
+		"error stratum/3333: mines DOGE_T, which isn't a configured currency",
+		"error stratum/4444: ShareChainName BTC_T isn't in the common config's ShareChains",
+		"warning stratum/3333: mines LTC_T, but no coinserver for it is running",
+		"warning stratum/4444: mines LTC_T, but no coinserver for it is running",
+		"warning stratum/5555: is running without a config",
+		"warning stratum/5555: status last updated 1h0m0s ago",
+	}, got)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/fatih/color"
+	log "github.com/inconshreveable/log15"
+	"github.com/sergi/go-diff/diffmatchpatch"
+	"github.com/spf13/cobra"
+)
+
+// Every config write made through ngctl leaves an entry under
+// /config-history, mirroring the config's key, ie a change to
+// /config/stratum/3333 is saved at /config-history/stratum/3333/<version>.
+// Versions are zero padded nanosecond timestamps, so they sort in order
+const historyPrefix = "/config-history/"
+
+type historyEntry struct {
+	Version string    `json:"-"`
+	Time    time.Time `json:"time"`
+	Editor  string    `json:"editor"`
+	Action  string    `json:"action"`
+	// The value before the change, nil if the key didn't exist
+	Previous *string `json:"previous"`
+	// Patch from previous to the new value, in diffmatchpatch's text format
+	Diff string `json:"diff"`
+}
+
+func init() {
+	configCmd := &cobra.Command{
+		Use:   "config",
+		Short: "History of config changes",
+		Run: func(cmd *cobra.Command, args []string) {
+			cmd.Help()
+		},
+	}
+
+	var (
+		limit    int
+		showDiff bool
+	)
+	historyCmd := &cobra.Command{
+		Use:   "history [key]",
+		Short: "List changes to a config, ie common or stratum/3333",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			entries := loadHistory(getEtcdKeys(), configKeyPath(args[0]))
+			if len(entries) == 0 {
+				fmt.Println("No history for", configKeyPath(args[0]))
+				return
+			}
+			if limit > 0 && len(entries) > limit {
+				entries = entries[len(entries)-limit:]
+			}
+			for _, entry := range entries {
+				color.Green("%s %s %s %s", entry.Version,
+					entry.Time.Local().Format(time.RFC3339), entry.Editor, entry.Action)
+				if showDiff {
+					fmt.Println(entry.Diff)
+				}
+			}
+		}}
+	historyCmd.Flags().IntVar(&limit, "limit", 20, "Show only the most recent changes, 0 for all")
+	historyCmd.Flags().BoolVar(&showDiff, "diff", false, "Print each change's diff")
+
+	var yes bool
+	rollbackCmd := &cobra.Command{
+		Use:   "rollback [key] [version]",
+		Short: "Undo a change to a config, restoring the value from before it",
+		Long: `Undo a change to a config, restoring the value from before it. Without a
+version the latest change is undone. The rollback is itself recorded, so it
+can be undone too`,
+		Args: cobra.RangeArgs(1, 2),
+		Run: func(cmd *cobra.Command, args []string) {
+			etcdKeys := getEtcdKeys()
+			keyPath := configKeyPath(args[0])
+			entries := loadHistory(etcdKeys, keyPath)
+			if len(entries) == 0 {
+				fmt.Println("Error: No history for", keyPath)
+				os.Exit(1)
+			}
+			entry := entries[len(entries)-1]
+			if len(args) > 1 {
+				entry = nil
+				for _, e := range entries {
+					if e.Version == args[1] {
+						entry = e
+					}
+				}
+				if entry == nil {
+					fmt.Println("Error: No version", args[1], "for", keyPath)
+					os.Exit(1)
+				}
+			}
+
+			current, _ := lookupKey(etcdKeys, keyPath)
+			fmt.Println(describeChange(current, entry.Previous))
+			if !yes && !confirm("Roll back (y,n): ") {
+				return
+			}
+			action := "rollback " + entry.Version
+			if entry.Previous == nil {
+				rmKey(etcdKeys, keyPath, action)
+			} else {
+				writeKey(etcdKeys, keyPath, *entry.Previous, action)
+			}
+		}}
+	rollbackCmd.Flags().BoolVar(&yes, "yes", false, "Don't ask for confirmation")
+
+	configCmd.AddCommand(historyCmd, rollbackCmd)
+	RootCmd.AddCommand(configCmd)
+}
+
+// Accepts either a full key path or one relative to /config
+func configKeyPath(key string) string {
+	if strings.HasPrefix(key, "/config/") {
+		return key
+	}
+	return "/config/" + strings.Trim(key, "/")
+}
+
+func historyDir(configKeyPath string) string {
+	return historyPrefix + strings.TrimPrefix(configKeyPath, "/config/")
+}
+
+func historyVersion(t time.Time) string {
+	return fmt.Sprintf("%020d", t.UnixNano())
+}
+
+// Who's making the change. NGCTL_EDITOR overrides the local user@host, for
+// when ngctl runs somewhere shared
+func editorIdentity() string {
+	if editor := os.Getenv("NGCTL_EDITOR"); editor != "" {
+		return editor
+	}
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return name
+	}
+	return name + "@" + host
+}
+
+func makeDiff(previous *string, next *string) string {
+	var from, to string
+	if previous != nil {
+		from = *previous
+	}
+	if next != nil {
+		to = *next
+	}
+	dmp := diffmatchpatch.New()
+	return dmp.PatchToText(dmp.PatchMake(from, to))
+}
+
+func describeChange(from *string, to *string) string {
+	if to == nil {
+		return "Key will be removed"
+	}
+	var current string
+	if from != nil {
+		current = *from
+	}
+	dmp := diffmatchpatch.New()
+	return dmp.DiffPrettyText(dmp.DiffMain(current, *to, false))
+}
+
+// Saves a history entry for a write that's already been made. The write
+// succeeded, so failing here only loses the audit trail and isn't fatal
+func recordHistory(etcdKeys client.KeysAPI, configKeyPath string, action string,
+	previous *string, next *string) {
+	now := time.Now().UTC()
+	entry := &historyEntry{
+		Time:     now,
+		Editor:   editorIdentity(),
+		Action:   action,
+		Previous: previous,
+		Diff:     makeDiff(previous, next),
+	}
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		log.Error("Failed to serialize config history", "err", err)
+		return
+	}
+	historyKey := historyDir(configKeyPath) + "/" + historyVersion(now)
+	_, err = etcdKeys.Set(context.Background(), historyKey, string(raw), nil)
+	if err != nil {
+		log.Error("Failed to record config history", "key", historyKey, "err", err)
+	}
+}
+
+// Oldest first
+func loadHistory(etcdKeys client.KeysAPI, configKeyPath string) []*historyEntry {
+	res, err := etcdKeys.Get(context.Background(), historyDir(configKeyPath),
+		&client.GetOptions{Sort: true})
+	if cerr, ok := err.(client.Error); ok && cerr.Code == client.ErrorCodeKeyNotFound {
+		return nil
+	} else if err != nil {
+		log.Crit("Unable to contact etcd", "err", err)
+		os.Exit(1)
+	}
+	entries := []*historyEntry{}
+	for _, node := range res.Node.Nodes {
+		// A config's history dir can hold history dirs of configs below it
+		if node.Dir {
+			continue
+		}
+		var entry historyEntry
+		if err := json.Unmarshal([]byte(node.Value), &entry); err != nil {
+			log.Warn("Skipping unreadable history entry", "key", node.Key, "err", err)
+			continue
+		}
+		entry.Version = node.Key[strings.LastIndexByte(node.Key, '/')+1:]
+		entries = append(entries, &entry)
+	}
+	return entries
+}
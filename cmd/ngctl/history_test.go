@@ -0,0 +1,21 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistoryPaths(t *testing.T) {
+	assert.Equal(t, "/config/stratum/3333", configKeyPath("stratum/3333"))
+	assert.Equal(t, "/config/common", configKeyPath("/config/common"))
+	assert.Equal(t, "/config-history/stratum/3333", historyDir("/config/stratum/3333"))
+}
+
+func TestHistoryVersionSorts(t *testing.T) {
+	early := historyVersion(time.Unix(999, 0))
+	late := historyVersion(time.Unix(1000, 0))
+	assert.Len(t, early, 20)
+	assert.True(t, early < late)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/spf13/cobra"
+
+	"github.com/icook/ngpool/pkg/adminrpc"
+)
+
+// A service to tail, by its admin API's address
+type logSource struct {
+	name string
+	addr string
+}
+
+type logLine struct {
+	source string
+	entry  *adminrpc.LogEntry
+}
+
+// Oldest first. Lines logged at the same time keep their services' order
+func sortLogLines(lines []logLine) {
+	sort.SliceStable(lines, func(i, j int) bool {
+		a, b := lines[i], lines[j]
+		if a.entry.Time != b.entry.Time {
+			return a.entry.Time < b.entry.Time
+		}
+		if a.source != b.source {
+			return a.source < b.source
+		}
+		return a.entry.Seq < b.entry.Seq
+	})
+}
+
+// Interleaves lines from several services by time. Lines are held for delay
+// before they're printed, so a line from a service that's slower to send
+// still goes out in order
+type logMerger struct {
+	delay   time.Duration
+	pending []logLine
+}
+
+func (m *logMerger) add(lines ...logLine) {
+	m.pending = append(m.pending, lines...)
+}
+
+// The lines logged before now less delay, in order
+func (m *logMerger) flush(now time.Time) []logLine {
+	sortLogLines(m.pending)
+	cutoff := now.Add(-m.delay).UnixNano()
+	i := sort.Search(len(m.pending), func(i int) bool {
+		return m.pending[i].entry.Time > cutoff
+	})
+	ready := m.pending[:i:i]
+	m.pending = m.pending[i:]
+	return ready
+}
+
+func formatLogLine(line logLine, width int) string {
+	var out strings.Builder
+	fmt.Fprintf(&out, "%s %-*s %-4s %s",
+		time.Unix(0, line.entry.Time).Local().Format("01-02 15:04:05.000"),
+		width, line.source, strings.ToUpper(line.entry.Level), line.entry.Msg)
+	for i := 0; i+1 < len(line.entry.Ctx); i += 2 {
+		value := line.entry.Ctx[i+1]
+		if value == "" || strings.ContainsAny(value, " =\"\n") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(&out, " %s=%s", line.entry.Ctx[i], value)
+	}
+	return out.String()
+}
+
+// Services given as admin addresses (host:port) or as a discovery namespace,
+// optionally with a service ID (stratum/3333), whose services publish their
+// admin address in the "admin" label
+func resolveLogSources(args []string) []logSource {
+	var sources []logSource
+	for _, arg := range args {
+		if strings.Contains(arg, ":") {
+			sources = append(sources, logSource{name: arg, addr: arg})
+			continue
+		}
+		parts := strings.SplitN(arg, "/", 2)
+		statuses := runningServices(getEtcdKeys(), parts[0])
+		found := false
+		for _, id := range sortedServiceIDs(statuses) {
+			if len(parts) > 1 && id != parts[1] {
+				continue
+			}
+			addr := statuses[id].Labels["admin"]
+			if addr == "" {
+				log.Warn("Service doesn't publish an admin address, set its AdminEndpoint",
+					"service", parts[0]+"/"+id)
+				continue
+			}
+			sources = append(sources, logSource{name: parts[0] + "/" + id, addr: addr})
+			found = true
+		}
+		if !found {
+			log.Crit("No services with an admin address found", "service", arg)
+			os.Exit(1)
+		}
+	}
+	return sources
+}
+
+func reportMissed(source string, missed uint64) {
+	if missed > 0 {
+		fmt.Fprintf(os.Stderr, "%s: %d records dropped from its buffer before they were sent\n",
+			source, missed)
+	}
+}
+
+func tailLogs(sources []logSource, req adminrpc.TailLogsRequest, delay time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	width := 0
+	for _, source := range sources {
+		if len(source.name) > width {
+			width = len(source.name)
+		}
+	}
+
+	// Each service's buffered records come first, and are printed together
+	// before following
+	streams := make([]adminrpc.LogAdmin_TailLogsClient, len(sources))
+	var backlog []logLine
+	for i, source := range sources {
+		client := adminrpc.NewLogAdminClient(dialAdmin(source.addr))
+		stream, err := client.TailLogs(ctx, &req)
+		var resp *adminrpc.TailLogsResponse
+		if err == nil {
+			resp, err = stream.Recv()
+		}
+		if err != nil {
+			log.Crit("Failed to tail logs", "service", source.name, "err", err)
+			os.Exit(1)
+		}
+		reportMissed(source.name, resp.Missed)
+		for _, entry := range resp.Entries {
+			backlog = append(backlog, logLine{source.name, entry})
+		}
+		streams[i] = stream
+	}
+	sortLogLines(backlog)
+	for _, line := range backlog {
+		fmt.Println(formatLogLine(line, width))
+	}
+	if !req.Follow {
+		return
+	}
+
+	lines := make(chan []logLine)
+	var wg sync.WaitGroup
+	for i, source := range sources {
+		wg.Add(1)
+		go func(source logSource, stream adminrpc.LogAdmin_TailLogsClient) {
+			defer wg.Done()
+			for {
+				resp, err := stream.Recv()
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "%s: stopped following, %s\n", source.name, err)
+					return
+				}
+				reportMissed(source.name, resp.Missed)
+				batch := make([]logLine, len(resp.Entries))
+				for i, entry := range resp.Entries {
+					batch[i] = logLine{source.name, entry}
+				}
+				lines <- batch
+			}
+		}(source, streams[i])
+	}
+	go func() {
+		wg.Wait()
+		close(lines)
+	}()
+
+	merger := &logMerger{delay: delay}
+	ticker := time.NewTicker(time.Millisecond * 100)
+	defer ticker.Stop()
+	for {
+		select {
+		case batch, ok := <-lines:
+			if !ok {
+				merger.delay = 0
+				for _, line := range merger.flush(time.Now()) {
+					fmt.Println(formatLogLine(line, width))
+				}
+				os.Exit(1)
+			}
+			merger.add(batch...)
+		case now := <-ticker.C:
+			for _, line := range merger.flush(now) {
+				fmt.Println(formatLogLine(line, width))
+			}
+		}
+	}
+}
+
+func init() {
+	var (
+		req   adminrpc.TailLogsRequest
+		delay time.Duration
+	)
+	logsCmd := &cobra.Command{
+		Use:   "logs [service|addr...]",
+		Short: "Print, or with -f follow, the recent logs of services through their admin APIs",
+		Long: `Prints the records services keep in their LogBuffer, merged by time.
+Services are given by admin address (host:port), or by discovery namespace
+(stratum) or namespace and service ID (stratum/3333) for services that publish
+their AdminEndpoint.`,
+		Args: cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			tailLogs(resolveLogSources(args), req, delay)
+		}}
+	addAdminTLSFlags(logsCmd)
+	logsCmd.Flags().BoolVarP(&req.Follow, "follow", "f", false,
+		"Keep printing records as they're logged")
+	logsCmd.Flags().Int32VarP(&req.Limit, "lines", "n", 100,
+		"Buffered records to print from each service first, 0 for all")
+	logsCmd.Flags().StringVar(&req.Level, "level", "",
+		"Only records at this level or above, ie warn")
+	logsCmd.Flags().DurationVar(&delay, "delay", time.Second,
+		"How long followed records are held to merge them in order")
+	RootCmd.AddCommand(logsCmd)
+}
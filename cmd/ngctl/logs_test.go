@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/icook/ngpool/pkg/adminrpc"
+)
+
+func testLogLine(source string, seq uint64, at time.Time) logLine {
+	return logLine{source, &adminrpc.LogEntry{Seq: seq, Time: at.UnixNano(), Level: "info"}}
+}
+
+func TestLogMerger(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	m := &logMerger{delay: time.Second}
+	m.add(testLogLine("b", 1, now.Add(-time.Second*3)), testLogLine("b", 2, now))
+	m.add(testLogLine("a", 7, now.Add(-time.Second*2)), testLogLine("a", 8, now.Add(-time.Second*3)))
+
+	ready := m.flush(now)
+	assert.Len(t, ready, 3)
+	assert.Equal(t, "a", ready[0].source)
+	assert.Equal(t, uint64(8), ready[0].entry.Seq)
+	assert.Equal(t, "b", ready[1].source)
+	assert.Equal(t, uint64(7), ready[2].entry.Seq)
+
+	// A line from a slower service that's still within the delay goes out in
+	// order with the held one
+	m.add(testLogLine("a", 9, now.Add(-time.Millisecond*500)))
+	ready = m.flush(now.Add(time.Second * 2))
+	assert.Len(t, ready, 2)
+	assert.Equal(t, uint64(9), ready[0].entry.Seq)
+	assert.Equal(t, uint64(2), ready[1].entry.Seq)
+	assert.Len(t, m.flush(now.Add(time.Hour)), 0)
+}
+
+func TestFormatLogLine(t *testing.T) {
+	at := time.Date(2018, 3, 4, 5, 6, 7, 8000000, time.Local)
+	line := logLine{"stratum/3333", &adminrpc.LogEntry{Time: at.UnixNano(), Level: "eror",
+		Msg: "Share rejected", Ctx: []string{"worker", "rig1", "err", "low diff", "module", ""}}}
+	assert.Equal(t,
+		`03-04 05:06:07.008 stratum/3333   EROR Share rejected worker=rig1 err="low diff" module=""`,
+		formatLogLine(line, 14))
+}
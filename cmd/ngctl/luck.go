@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/levigross/grequests"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	RootCmd.AddCommand(&cobra.Command{
+		Use:   "luck [urlbase]",
+		Short: "Show 7 and 30 day luck for each sharechain and currency",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			resp, err := grequests.Get(args[0]+"/v1/luck", nil)
+			if err != nil {
+				log.Crit("Failed to get luck", "err", err)
+				os.Exit(1)
+			}
+			type Luck struct {
+				ShareChain string
+				Currency   string
+				Blocks     int
+				Expected   float64
+				Luck       *float64
+			}
+			var vals struct {
+				Data struct {
+					Luck map[string][]Luck
+				}
+			}
+			err = resp.JSON(&vals)
+			if err != nil {
+				log.Crit("Invalid response", "err", err)
+				os.Exit(1)
+			}
+
+			fmt.Printf("%-6s %-16s %-8s %8s %10s %8s\n",
+				"window", "sharechain", "currency", "blocks", "expected", "luck")
+			for _, window := range []string{"7d", "30d"} {
+				for _, l := range vals.Data.Luck[window] {
+					luck := "-"
+					if l.Luck != nil {
+						luck = fmt.Sprintf("%.1f%%", *l.Luck*100)
+					}
+					fmt.Printf("%-6s %-16s %-8s %8d %10.2f %8s\n",
+						window, l.ShareChain, l.Currency, l.Blocks, l.Expected, luck)
+				}
+			}
+		}})
+}
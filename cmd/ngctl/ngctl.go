@@ -5,6 +5,8 @@ import (
 	"context"
 	"fmt"
 	"github.com/coreos/etcd/client"
+	"github.com/fatih/color"
+	"github.com/icook/ngpool/pkg/service"
 	log "github.com/inconshreveable/log15"
 	"github.com/sergi/go-diff/diffmatchpatch"
 	"github.com/spf13/cobra"
@@ -24,11 +26,17 @@ var RootCmd = &cobra.Command{
 	},
 }
 
-var endpoints []string
+var (
+	endpoints  []string
+	deployment string
+)
 
 func init() {
 	RootCmd.PersistentFlags().StringSliceVar(
 		&endpoints, "endpoints", []string{"http://127.0.0.1:4001", "http://127.0.0.1:2379"}, "gRPC endpoints")
+	RootCmd.PersistentFlags().StringVar(&deployment, "deployment",
+		service.DeploymentFromEnv(),
+		"Pool deployment to manage when several share etcd, defaults to $"+service.DeploymentEnv)
 }
 
 func getDefaultConfig(serviceType string) string {
@@ -47,11 +55,18 @@ func getEtcdKeys() client.KeysAPI {
 		log.Crit("Failed to make etcd client", "err", err)
 		os.Exit(1)
 	}
-	keysAPI := client.NewKeysAPI(etcd)
+	if err := service.ValidateDeployment(deployment); err != nil {
+		log.Crit("Invalid deployment", "err", err)
+		os.Exit(1)
+	}
+	keysAPI := service.NewDeploymentKeysAPI(etcd, deployment)
 	return keysAPI
 }
 
-func modifyLoop(currentVal string, keyPath string) (string, bool) {
+// Validates a config before it's pushed, returning a list of problems
+type validateFunc func(string) []string
+
+func modifyLoop(currentVal string, keyPath string, validate validateFunc) (string, bool) {
 	tmpFile := mktmp(currentVal)
 	defer os.Remove(tmpFile.Name())
 
@@ -64,12 +79,23 @@ func modifyLoop(currentVal string, keyPath string) (string, bool) {
 			return "", false
 		}
 		fmt.Println(dmp.DiffPrettyText(diffs))
+		var problems []string
+		if validate != nil {
+			problems = validate(newConfig)
+		}
+		for _, problem := range problems {
+			color.Red(problem)
+		}
+		prompt := "Push changes (y,n,e): "
+		if len(problems) > 0 {
+			prompt = "Config is invalid, can't push (n,e): "
+		}
 		for {
 			reader := bufio.NewReader(os.Stdin)
-			fmt.Print("Push changes (y,n,e): ")
+			fmt.Print(prompt)
 			text, _ := reader.ReadString('\n')
 			input := strings.TrimSpace(text)
-			if input == "y" {
+			if input == "y" && len(problems) == 0 {
 				return newConfig, true
 			} else if input == "e" {
 				break
@@ -130,46 +156,137 @@ func mktmp(contents string) *os.File {
 	return tmpFile
 }
 
-func rmKey(etcdKeys client.KeysAPI, configKeyPath string) {
-	// Get current config
+func rmKey(etcdKeys client.KeysAPI, configKeyPath string, action string) {
+	// Get current config, so it can be restored from history
+	previous, _ := lookupKey(etcdKeys, configKeyPath)
 	_, err := etcdKeys.Delete(context.Background(), configKeyPath, nil)
 	if err != nil {
 		log.Crit("Failed to rm key", "key", configKeyPath, "err", err)
 		os.Exit(1)
 	}
+	recordHistory(etcdKeys, configKeyPath, action, previous, nil)
 	log.Info("Removed config", "keypath", configKeyPath)
 }
 
 func getKey(etcdKeys client.KeysAPI, configKeyPath string) string {
-	// Get current config
+	currentVal, ok := lookupKey(etcdKeys, configKeyPath)
+	if !ok {
+		log.Warn("Key empty, starting empty", "key", configKeyPath)
+		return ""
+	}
+	return *currentVal
+}
+
+// Returns nil if the key doesn't exist
+func lookupKey(etcdKeys client.KeysAPI, configKeyPath string) (*string, bool) {
 	configResp, err := etcdKeys.Get(context.Background(), configKeyPath, nil)
-	var currentVal = ""
 	if cerr, ok := err.(client.Error); ok && cerr.Code == client.ErrorCodeKeyNotFound {
-		log.Warn("Key empty, starting empty", "key", configKeyPath)
+		return nil, false
 	} else if err != nil {
 		log.Crit("Failed fetching config", "err", err)
 		os.Exit(1)
-	} else {
-		currentVal = string(configResp.Node.Value)
 	}
-	return currentVal
+	val := string(configResp.Node.Value)
+	return &val, true
 }
 
-func editKey(etcdKeys client.KeysAPI, configKeyPath string) {
+func editKey(etcdKeys client.KeysAPI, configKeyPath string, validate validateFunc) {
 	currentVal := getKey(etcdKeys, configKeyPath)
-	newConfig, save := modifyLoop(currentVal, configKeyPath)
+	newConfig, save := modifyLoop(currentVal, configKeyPath, validate)
 	if !save {
 		return
 	}
-	writeKey(etcdKeys, configKeyPath, newConfig)
+	writeKey(etcdKeys, configKeyPath, newConfig, "edit")
 }
 
-func writeKey(etcdKeys client.KeysAPI, configKeyPath string, newConfig string) {
+// Writes a config and records the change in its history. action is a short
+// note on what made the change, ie "edit"
+func writeKey(etcdKeys client.KeysAPI, configKeyPath string, newConfig string, action string) {
+	previous, _ := lookupKey(etcdKeys, configKeyPath)
 	_, err := etcdKeys.Set(context.Background(), configKeyPath, newConfig, nil)
 	if err != nil {
 		log.Crit("Failed pushing config, dumping", "err", err)
 		fmt.Println(newConfig)
 		os.Exit(1)
 	}
+	recordHistory(etcdKeys, configKeyPath, action, previous, &newConfig)
 	log.Info("Successfully wrote config", "keypath", configKeyPath)
 }
+
+// Returns a validateFunc for a config of the service type. The common config
+// and sibling configs are loaded once up front, not on every edit
+func serviceValidator(etcdKeys client.KeysAPI, serviceType string, name string) validateFunc {
+	if serviceType == "currencies" {
+		return currencyValidator(name)
+	}
+	common := map[string]interface{}{}
+	if parsed, err := parseConfig(getKey(etcdKeys, "/config/common")); err != nil {
+		log.Warn("Unable to parse common config", "err", err)
+	} else {
+		common = configSection(parsed, serviceType)
+	}
+
+	others := map[string]string{}
+	res, err := etcdKeys.Get(context.Background(), "/config/"+serviceType,
+		&client.GetOptions{Recursive: true})
+	if err != nil {
+		// No other configs of this type yet is fine
+		if cerr, ok := err.(client.Error); !ok || cerr.Code != client.ErrorCodeKeyNotFound {
+			log.Crit("Unable to contact etcd", "err", err)
+			os.Exit(1)
+		}
+	} else {
+		for _, node := range res.Node.Nodes {
+			lbi := strings.LastIndexByte(node.Key, '/') + 1
+			if node.Key[lbi:] != name {
+				others[node.Key[lbi:]] = node.Value
+			}
+		}
+	}
+
+	return func(raw string) []string {
+		return validateConfig(serviceType, raw, common, others)
+	}
+}
+
+// Currencies are checked by decoding them the same way services will
+func currencyValidator(code string) validateFunc {
+	return func(raw string) []string {
+		config, err := parseConfig(raw)
+		if err != nil {
+			return []string{"invalid YAML: " + err.Error()}
+		}
+		if _, err := service.DecodeCurrency(strings.ToUpper(code), config); err != nil {
+			return []string{err.Error()}
+		}
+		return nil
+	}
+}
+
+// The common config has no schema of its own, but it must at least parse or
+// every service will fail to boot
+func validateYAML(raw string) []string {
+	if _, err := parseConfig(raw); err != nil {
+		return []string{"invalid YAML: " + err.Error()}
+	}
+	return nil
+}
+
+// Looks up a key case insensitively, like viper
+func configValue(config map[string]interface{}, key string) interface{} {
+	for name, val := range config {
+		if strings.EqualFold(name, key) {
+			return val
+		}
+	}
+	return nil
+}
+
+// Returns a section of the common config, ie "api" or "stratum". Empty if
+// it's missing
+func configSection(config map[string]interface{}, name string) map[string]interface{} {
+	if section, ok := normalizeMap(configValue(config, name)); ok {
+		return section
+	}
+	return map[string]interface{}{}
+}
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fatih/color"
+	log "github.com/inconshreveable/log15"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/spf13/cast"
+	"github.com/spf13/cobra"
+
+	"github.com/icook/ngpool/pkg/common"
+)
+
+// Overrides the api section's DbConnectionString from the common config
+var dbConnectionString string
+
+func setupPayoutAdminCommands(payoutsCmd *cobra.Command) {
+	payoutsCmd.PersistentFlags().StringVar(&dbConnectionString, "db", "",
+		"Postgres connection string. Defaults to the api DbConnectionString in the common config")
+
+	payoutsCmd.AddCommand(&cobra.Command{
+		Use:   "unpaid [currency]",
+		Short: "List unpaid balances by user, optionally for one currency",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			currency := ""
+			if len(args) > 0 {
+				currency = strings.ToUpper(args[0])
+			}
+			db := connectDB(loadCommonConfig())
+			balances, err := unpaidBalances(db, currency)
+			if err != nil {
+				log.Crit("Failed to load balances", "err", err)
+				os.Exit(1)
+			}
+			totals := map[string]int64{}
+			for _, b := range balances {
+				fmt.Printf("%-8s %-6d %-20s %16s  %s", b.Currency, b.UserID, b.Username,
+					formatAmount(b.Amount), b.Address.String)
+				if b.Held {
+					color.New(color.FgRed).Print("  held")
+				} else if !b.Address.Valid {
+					color.New(color.FgYellow).Print("  no address")
+				}
+				fmt.Println()
+				totals[b.Currency] += b.Amount
+			}
+			for _, code := range sortedKeys(totals) {
+				fmt.Printf("%-8s total %s\n", code, formatAmount(totals[code]))
+			}
+		}})
+
+	var tier string
+	previewCmd := &cobra.Command{
+		Use:   "preview [currency]",
+		Short: "Show who would be paid in the next payout batch for a currency",
+		Long: `Show who would be paid in the next payout batch for a currency. The batch
+picks up after the open payout run's cursor for the tier, if there is one.
+Amounts are before transaction and on-demand fees`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			currency := strings.ToUpper(args[0])
+			config := loadCommonConfig()
+			db := connectDB(config)
+			batch, err := previewBatch(db, config, currency, tier)
+			if err != nil {
+				log.Crit("Failed to preview batch", "err", err)
+				os.Exit(1)
+			}
+			if len(batch.Payees) == 0 {
+				fmt.Println("Nothing to pay")
+				return
+			}
+			fmt.Printf("%s %s tier, users after %d, dust threshold %s\n",
+				currency, tier, batch.Cursor, formatAmount(batch.DustThreshold))
+			var total int64
+			for _, p := range batch.Payees {
+				fmt.Printf("%-6d %-40s %16s credits=%d", p.UserID, p.Address,
+					formatAmount(p.Amount), p.Credits)
+				if p.Amount < batch.DustThreshold {
+					color.New(color.FgYellow).Print("  deferred (dust)")
+				} else {
+					total += p.Amount
+				}
+				fmt.Println()
+			}
+			fmt.Printf("total %s\n", formatAmount(total))
+		}}
+	previewCmd.Flags().StringVar(&tier, "tier", "default", "Payout tier to preview")
+	payoutsCmd.AddCommand(previewCmd)
+
+	var reason string
+	holdCmd := &cobra.Command{
+		Use:   "hold [currency] [address]",
+		Short: "Stop paying an address until it's released",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			db := connectDB(loadCommonConfig())
+			_, err := db.Exec(
+				`INSERT INTO payout_hold (currency, address, reason) VALUES ($1, $2, $3)
+				ON CONFLICT (currency, address) DO UPDATE SET reason = $3`,
+				strings.ToUpper(args[0]), args[1], reason)
+			if err != nil {
+				log.Crit("Failed to hold address", "err", err)
+				os.Exit(1)
+			}
+			log.Info("Held address", "currency", strings.ToUpper(args[0]), "address", args[1])
+		}}
+	holdCmd.Flags().StringVar(&reason, "reason", "", "Note recorded with the hold")
+	payoutsCmd.AddCommand(holdCmd)
+
+	payoutsCmd.AddCommand(&cobra.Command{
+		Use:   "release [currency] [address]",
+		Short: "Resume paying a held address",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			db := connectDB(loadCommonConfig())
+			res, err := db.Exec(
+				`DELETE FROM payout_hold WHERE currency = $1 AND address = $2`,
+				strings.ToUpper(args[0]), args[1])
+			if err != nil {
+				log.Crit("Failed to release address", "err", err)
+				os.Exit(1)
+			}
+			if affect, err := res.RowsAffected(); err == nil && affect == 0 {
+				fmt.Println("Error: Address isn't held")
+				os.Exit(1)
+			}
+			log.Info("Released address", "currency", strings.ToUpper(args[0]), "address", args[1])
+		}})
+
+	var yes bool
+	retryCmd := &cobra.Command{
+		Use:   "retry [txhash]",
+		Short: "Unwind a failed payout transaction so its credits are paid again",
+		Long: `Unwind a failed payout transaction so its credits are paid again. Its
+payouts are removed, its credits and on-demand requests become unpaid, and the
+UTXOs it spent are made spendable again.
+
+Only use this on a transaction the network has rejected (ie a double spend or
+invalid signature). If it can still confirm, users will be paid twice`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			db := connectDB(loadCommonConfig())
+			summary, err := payoutTransactionSummary(db, args[0])
+			if err != nil {
+				log.Crit("Failed to load payout transaction", "err", err)
+				os.Exit(1)
+			}
+			fmt.Printf("%s %s: %d payouts totalling %s, sent %s\n", summary.Currency,
+				args[0], summary.Payouts, formatAmount(summary.Amount), summary.Sent)
+			if !yes && !confirm("Unwind this transaction (y,n): ") {
+				return
+			}
+			err = retryPayoutTransaction(db, args[0])
+			if err != nil {
+				log.Crit("Failed to unwind payout transaction", "err", err)
+				os.Exit(1)
+			}
+			log.Info("Unwound payout transaction, credits will be paid in the next run", "hash", args[0])
+		}}
+	retryCmd.Flags().BoolVar(&yes, "yes", false, "Don't ask for confirmation")
+	payoutsCmd.AddCommand(retryCmd)
+
+	var topUpYes bool
+	topUpCmd := &cobra.Command{
+		Use:   "topup [currency] [txid] [vout] [amount]",
+		Short: "Record coins sent from the cold wallet to the hot wallet",
+		Long: `Record coins sent from the cold wallet to the hot wallet, once the
+transaction has confirmed, so payouts can spend them. The output must pay the
+currency's SubsidyAddress, and amount is in satoshis. Payouts halted for a
+top-up (the hot_wallet_low alert) resume on their next attempt`,
+		Args: cobra.ExactArgs(4),
+		Run: func(cmd *cobra.Command, args []string) {
+			currency := strings.ToUpper(args[0])
+			vout, err := strconv.Atoi(args[2])
+			if err != nil || vout < 0 {
+				fmt.Println("Error: vout must be a positive integer")
+				os.Exit(1)
+			}
+			amount, err := strconv.ParseInt(args[3], 10, 64)
+			if err != nil || amount <= 0 {
+				fmt.Println("Error: amount must be a positive number of satoshis")
+				os.Exit(1)
+			}
+			config := loadCommonConfig()
+			address := subsidyAddress(config, currency)
+			if address == "" {
+				log.Crit("No SubsidyAddress configured", "currency", currency)
+				os.Exit(1)
+			}
+			fmt.Printf("%s %s:%d, %s to %s\n", currency, args[1], vout,
+				formatAmount(amount), address)
+			if !topUpYes && !confirm("Record this top-up (y,n): ") {
+				return
+			}
+			err = recordTopUp(connectDB(config), currency, args[1], vout, amount, address)
+			if err != nil {
+				log.Crit("Failed to record top-up", "err", err)
+				os.Exit(1)
+			}
+			log.Info("Recorded hot wallet top-up", "currency", currency, "txid", args[1])
+		}}
+	topUpCmd.Flags().BoolVar(&topUpYes, "yes", false, "Don't ask for confirmation")
+	payoutsCmd.AddCommand(topUpCmd)
+}
+
+func loadCommonConfig() map[string]interface{} {
+	config, err := parseConfig(getKey(getEtcdKeys(), "/config/common"))
+	if err != nil {
+		log.Crit("Unable to parse common config", "err", err)
+		os.Exit(1)
+	}
+	return config
+}
+
+func connectDB(config map[string]interface{}) *sqlx.DB {
+	conn := dbConnectionString
+	if conn == "" {
+		conn = cast.ToString(configValue(configSection(config, "api"), "DbConnectionString"))
+	}
+	if conn == "" {
+		log.Crit("No DbConnectionString in the api config, use --db")
+		os.Exit(1)
+	}
+	db, err := sqlx.Connect("postgres", conn)
+	if err != nil {
+		log.Crit("Failed to connect to db", "err", err)
+		os.Exit(1)
+	}
+	return db
+}
+
+func confirm(prompt string) bool {
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Print(prompt)
+		text, _ := reader.ReadString('\n')
+		switch strings.TrimSpace(text) {
+		case "y":
+			return true
+		case "n":
+			return false
+		}
+	}
+}
+
+func formatAmount(satoshis int64) string {
+	return fmt.Sprintf("%.8f", float64(satoshis)/1e8)
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type unpaidBalance struct {
+	Currency string
+	UserID   int `db:"user_id"`
+	Username string
+	Amount   int64
+	Address  sql.NullString
+	Held     bool
+}
+
+func unpaidBalances(db *sqlx.DB, currency string) ([]unpaidBalance, error) {
+	var balances []unpaidBalance
+	err := db.Select(&balances,
+		`SELECT credit.currency, credit.user_id, COALESCE(users.username, '') AS username,
+		SUM(credit.amount) AS amount, payout_address.address,
+		payout_hold.address IS NOT NULL AS held
+		FROM credit
+		JOIN users ON users.id = credit.user_id
+		LEFT JOIN payout_address ON payout_address.user_id = credit.user_id
+			AND payout_address.currency = credit.currency
+		LEFT JOIN payout_hold ON payout_hold.currency = credit.currency
+			AND payout_hold.address = payout_address.address
+		WHERE credit.payout_transaction IS NULL AND ($1 = '' OR credit.currency = $1)
+		GROUP BY 1, 2, 3, 5, 6
+		ORDER BY 1, 4 DESC`, currency)
+	return balances, err
+}
+
+type previewPayee struct {
+	UserID  int `db:"user_id"`
+	Address string
+	Amount  int64
+	Credits int
+}
+
+type payoutPreview struct {
+	Cursor        int
+	DustThreshold int64
+	Payees        []previewPayee
+}
+
+// Mirrors the batch selection in ngweb's getCreatePayout
+func previewBatch(db *sqlx.DB, config map[string]interface{}, currency string,
+	tier string) (*payoutPreview, error) {
+	api := configSection(config, "api")
+	batchSize := cast.ToInt(configValue(api, "PayoutBatchSize"))
+	if batchSize == 0 {
+		batchSize = 250
+	}
+	tiers := []string{}
+	for name := range configSection(api, "PayoutTiers") {
+		tiers = append(tiers, name)
+	}
+	sort.Strings(tiers)
+	currencyConfig := configSection(configSection(config, "Currencies"), currency)
+	preview := &payoutPreview{
+		DustThreshold: cast.ToInt64(configValue(currencyConfig, "DustThreshold")),
+	}
+	if preview.DustThreshold == 0 {
+		preview.DustThreshold = 546
+	}
+
+	err := db.Get(&preview.Cursor,
+		`SELECT user_cursor FROM payout_run
+		WHERE currency = $1 AND tier = $2 AND finished_at IS NULL`, currency, tier)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	err = db.Select(&preview.Payees,
+		`SELECT credit.user_id, payout_address.address,
+		SUM(credit.amount) AS amount, COUNT(*) AS credits
+		FROM credit JOIN payout_address ON
+		credit.user_id = payout_address.user_id AND payout_address.currency = $1
+		WHERE credit.currency = $1 AND credit.payout_transaction IS NULL
+		AND credit.user_id IN (
+			SELECT credit.user_id FROM credit
+			JOIN payout_address ON
+			credit.user_id = payout_address.user_id AND payout_address.currency = $1
+			JOIN users ON credit.user_id = users.id
+			LEFT JOIN payout_preference AS pref ON
+			pref.user_id = credit.user_id AND pref.currency = $1
+			LEFT JOIN payout_preference AS pref_all ON
+			pref_all.user_id = credit.user_id AND pref_all.currency = ''
+			WHERE credit.currency = $1 AND credit.payout_transaction IS NULL
+			AND credit.user_id > $2
+			AND payout_address.address NOT IN (
+				SELECT address FROM payout_hold WHERE currency = $1)
+			AND (users.payout_tier = $4 OR
+				($4 = 'default' AND users.payout_tier <> ALL($5)) OR
+				($4 = 'ondemand' AND users.id IN (
+					SELECT user_id FROM payout_request
+					WHERE currency = $1 AND payout_transaction IS NULL
+					AND dropped_at IS NULL)))
+			AND ($4 = 'ondemand' OR NOT EXISTS (
+				SELECT 1 FROM payout JOIN payout_transaction ON
+				payout_transaction.hash = payout.payout_transaction
+				WHERE payout.user_id = credit.user_id AND payout_transaction.currency = $1
+				AND COALESCE(payout_transaction.sent, now()) > now() - interval '1 second' *
+					COALESCE(pref.payout_interval, pref_all.payout_interval, 0)))
+			GROUP BY credit.user_id
+			HAVING $4 = 'ondemand' OR SUM(credit.amount) >=
+				COALESCE(MAX(pref.min_payout), MAX(pref_all.min_payout), $6)
+			ORDER BY credit.user_id LIMIT $3)
+		GROUP BY 1, 2
+		ORDER BY 1`,
+		currency, preview.Cursor, batchSize, tier, pq.Array(tiers),
+		cast.ToInt64(configValue(currencyConfig, "MinimumPayout")))
+	if err != nil {
+		return nil, err
+	}
+	return preview, nil
+}
+
+type payoutTxSummary struct {
+	Currency  string
+	Confirmed bool
+	Sent      sql.NullString
+	Payouts   int
+	Amount    int64
+}
+
+func payoutTransactionSummary(db *sqlx.DB, hash string) (*payoutTxSummary, error) {
+	var summary payoutTxSummary
+	err := db.Get(&summary,
+		`SELECT pt.currency, pt.confirmed, pt.sent::varchar AS sent,
+		COUNT(payout.user_id) AS payouts, COALESCE(SUM(payout.amount), 0) AS amount
+		FROM payout_transaction AS pt
+		LEFT JOIN payout ON payout.payout_transaction = pt.hash
+		WHERE pt.hash = $1
+		GROUP BY 1, 2, 3`, hash)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("No payout transaction %s", hash)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &summary, nil
+}
+
+// Undoes everything postPayout recorded for a transaction, in one database
+// transaction
+func retryPayoutTransaction(db *sqlx.DB, hash string) error {
+	var pt struct {
+		SignedTX  string `db:"signed_tx"`
+		Confirmed bool
+	}
+	err := db.Get(&pt,
+		`SELECT encode(signed_tx, 'hex') AS signed_tx, confirmed
+		FROM payout_transaction WHERE hash = $1`, hash)
+	if err != nil {
+		return err
+	}
+	if pt.Confirmed {
+		return fmt.Errorf("Transaction is confirmed, it didn't fail")
+	}
+	payoutTx, err := common.HexStringToTX(pt.SignedTX)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// A later payout may have spent our change, and unwinding this one would
+	// leave it spending a UTXO that doesn't exist
+	var spentChange int
+	err = tx.Get(&spentChange,
+		`SELECT COUNT(*) FROM utxo WHERE hash = $1 AND spent = true`, hash)
+	if err != nil {
+		return err
+	}
+	if spentChange > 0 {
+		return fmt.Errorf("Change from this transaction was spent by a later payout, retry that first")
+	}
+	_, err = tx.Exec(`DELETE FROM utxo WHERE hash = $1`, hash)
+	if err != nil {
+		return err
+	}
+
+	for _, in := range payoutTx.TxIn {
+		// UTXOs from blocks and from payout change are stored in opposite
+		// byte orders, so match either
+		prev := in.PreviousOutPoint
+		_, err = tx.Exec(
+			`UPDATE utxo SET spent = false
+			WHERE (hash = $1 OR hash = $2) AND vout = $3`,
+			hex.EncodeToString(prev.Hash[:]), prev.Hash.String(), prev.Index)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`DELETE FROM payout WHERE payout_transaction = $1`, hash)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		`UPDATE credit SET payout_transaction = NULL WHERE payout_transaction = $1`, hash)
+	if err != nil {
+		return err
+	}
+	// Requests go back to pending, unless the user has made another since
+	_, err = tx.Exec(
+		`UPDATE payout_request SET payout_transaction = NULL, fee = 0
+		WHERE payout_transaction = $1 AND NOT EXISTS (
+			SELECT 1 FROM payout_request AS pending
+			WHERE pending.user_id = payout_request.user_id
+			AND pending.currency = payout_request.currency
+			AND pending.payout_transaction IS NULL
+			AND pending.dropped_at IS NULL)`, hash)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM payout_request WHERE payout_transaction = $1`, hash)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM payout_transaction WHERE hash = $1`, hash)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// The currency's SubsidyAddress, from its own key or the common config's
+// Currencies. Empty if it isn't configured
+func subsidyAddress(config map[string]interface{}, currency string) string {
+	currencies := configSection(config, "currencies")
+	if raw, ok := lookupKey(getEtcdKeys(), "/config/currencies/"+currency); ok {
+		if parsed, err := parseConfig(*raw); err == nil {
+			currencies = map[string]interface{}{currency: parsed}
+		}
+	}
+	currencyConfig, _ := normalizeMap(configValue(currencies, currency))
+	return cast.ToString(configValue(currencyConfig, "SubsidyAddress"))
+}
+
+// Adds a cold wallet transaction's output as a spendable hot wallet UTXO.
+// txid is in the usual (RPC) byte order, UTXOs are kept reversed like the
+// coinbases stratum records
+func recordTopUp(db *sqlx.DB, currency string, txid string, vout int,
+	amount int64, address string) error {
+	hash, err := hex.DecodeString(txid)
+	if err != nil || len(hash) != 32 {
+		return fmt.Errorf("%s isn't a transaction id", txid)
+	}
+	common.ReverseBytes(hash)
+	_, err = db.Exec(
+		`INSERT INTO utxo (hash, vout, amount, currency, address, spendable)
+		VALUES ($1, $2, $3, $4, $5, true)`,
+		hex.EncodeToString(hash), vout, amount, currency, address)
+	if pqe, ok := err.(*pq.Error); ok && pqe.Code == "23505" {
+		return fmt.Errorf("%s is already recorded", txid)
+	}
+	return err
+}
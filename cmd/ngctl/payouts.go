@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/levigross/grequests"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	payoutsCmd := &cobra.Command{
+		Use: "payouts",
+		Run: func(cmd *cobra.Command, args []string) {
+			cmd.Help()
+		},
+	}
+	payoutsCmd.AddCommand(&cobra.Command{
+		Use:   "schedule [urlbase]",
+		Short: "Show payout schedule state for each currency and tier",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			resp, err := grequests.Get(args[0]+"/v1/payoutschedule", nil)
+			if err != nil {
+				log.Crit("Failed to get payout schedule", "err", err)
+				os.Exit(1)
+			}
+			type Run struct {
+				ID         int
+				UserCursor int `json:"user_cursor"`
+				Batches    int
+				StartedAt  time.Time `json:"started_at"`
+			}
+			type Schedule struct {
+				Schedule string
+				LastRun  *Run       `json:"last_run"`
+				OpenRun  *Run       `json:"open_run"`
+				NextDue  *time.Time `json:"next_due"`
+				Users    int
+			}
+			var vals struct {
+				Data struct {
+					Schedules map[string]map[string]Schedule `json:"payout_schedules"`
+				}
+			}
+			err = resp.JSON(&vals)
+			if err != nil {
+				log.Crit("Invalid response", "err", err)
+				os.Exit(1)
+			}
+
+			var currencies []string
+			for code := range vals.Data.Schedules {
+				currencies = append(currencies, code)
+			}
+			sort.Strings(currencies)
+			for _, code := range currencies {
+				tiers := vals.Data.Schedules[code]
+				var names []string
+				for name := range tiers {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				for _, name := range names {
+					s := tiers[name]
+					fmt.Printf("%-8s %-10s %-12s users=%d", code, name, s.Schedule, s.Users)
+					if s.OpenRun != nil {
+						fmt.Printf(" running (run %d, %d batches, cursor %d)",
+							s.OpenRun.ID, s.OpenRun.Batches, s.OpenRun.UserCursor)
+					} else if s.NextDue != nil {
+						fmt.Printf(" next due %s", s.NextDue.Local().Format(time.RFC822))
+					} else {
+						fmt.Print(" due now")
+					}
+					fmt.Println()
+				}
+			}
+		}})
+	setupPayoutAdminCommands(payoutsCmd)
+	RootCmd.AddCommand(payoutsCmd)
+}
@@ -0,0 +1,571 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	"gopkg.in/yaml.v2"
+
+	"github.com/icook/ngpool/pkg/alert"
+	"github.com/icook/ngpool/pkg/logging"
+)
+
+type fieldKind int
+
+const (
+	kindString fieldKind = iota
+	kindInt
+	kindFloat
+	kindBool
+	// A string parsed by time.ParseDuration, ie "10s"
+	kindDuration
+	// A host:port to listen on. Empty means disabled
+	kindBind
+	// A port number as a string, ie for coinserver node configs which are
+	// passed through to the daemon as strings
+	kindPort
+	kindMap
+	kindList
+)
+
+var kindNames = map[fieldKind]string{
+	kindString:   "string",
+	kindInt:      "integer",
+	kindFloat:    "number",
+	kindBool:     "boolean",
+	kindDuration: "duration",
+	kindBind:     "host:port",
+	kindPort:     "port",
+	kindMap:      "map",
+	kindList:     "list",
+}
+
+type schemaField struct {
+	Kind     fieldKind
+	Required bool
+	// For maps, the known keys. Keys not listed here are validated against
+	// Elem, or rejected if Elem is nil
+	Fields map[string]*schemaField
+	// For lists, the type of each item. For maps, the type of any key not in
+	// Fields
+	Elem *schemaField
+	// Extra validation run after the type is checked
+	Check func(interface{}) error
+}
+
+func checkLogLevel(val interface{}) error {
+	_, err := log.LvlFromString(val.(string))
+	return err
+}
+
+func checkLogFormat(val interface{}) error {
+	switch val.(string) {
+	case logging.FormatConsole, logging.FormatLogfmt, logging.FormatJSON:
+		return nil
+	}
+	return fmt.Errorf("must be %s, %s or %s",
+		logging.FormatConsole, logging.FormatLogfmt, logging.FormatJSON)
+}
+
+var logSchema = map[string]*schemaField{
+	"LogLevel":      {Kind: kindString, Check: checkLogLevel},
+	"LogFile":       {Kind: kindString},
+	"LogFormat":     {Kind: kindString, Check: checkLogFormat},
+	"LogModules":    {Kind: kindMap, Elem: &schemaField{Kind: kindString, Check: checkLogLevel}},
+	"LogMaxSize":    {Kind: kindInt},
+	"LogMaxBackups": {Kind: kindInt},
+	"LogBuffer":     {Kind: kindInt},
+}
+
+func checkAlertSink(val interface{}) error {
+	switch val.(string) {
+	case "webhook", "pagerduty", "telegram":
+		return nil
+	}
+	return fmt.Errorf("must be webhook, pagerduty or telegram")
+}
+
+func checkAlertEvent(val interface{}) error {
+	switch val.(string) {
+	case alert.BlockFound, alert.BlockOrphaned, alert.CoinserverDown,
+		alert.DiscoveryDown, alert.HotWalletLow, alert.PayoutFailed, alert.RejectRate:
+		return nil
+	}
+	return fmt.Errorf("unknown alert event %s", val)
+}
+
+func checkAlertSeverity(val interface{}) error {
+	switch strings.ToLower(val.(string)) {
+	case alert.SeverityInfo, alert.SeverityWarning, alert.SeverityCritical:
+		return nil
+	}
+	return fmt.Errorf("must be %s, %s or %s",
+		alert.SeverityInfo, alert.SeverityWarning, alert.SeverityCritical)
+}
+
+var alertSchema = map[string]*schemaField{
+	"Alerts": {Kind: kindList, Elem: &schemaField{Kind: kindMap, Fields: map[string]*schemaField{
+		"Type":        {Kind: kindString, Required: true, Check: checkAlertSink},
+		"URL":         {Kind: kindString},
+		"RoutingKey":  {Kind: kindString},
+		"BotToken":    {Kind: kindString},
+		"ChatID":      {Kind: kindString},
+		"Events":      {Kind: kindList, Elem: &schemaField{Kind: kindString, Check: checkAlertEvent}},
+		"MinSeverity": {Kind: kindString, Check: checkAlertSeverity},
+	}}},
+	"AlertRateLimit": {Kind: kindDuration},
+	"AlertTemplates": {Kind: kindMap, Elem: &schemaField{Kind: kindString}},
+}
+
+var templateKeySchema = &schemaField{Kind: kindMap, Fields: map[string]*schemaField{
+	"Currency":     {Kind: kindString, Required: true},
+	"Algo":         {Kind: kindString, Required: true},
+	"TemplateType": {Kind: kindString, Required: true},
+}}
+
+// Options for one of a stratum's extra Ports, keyed by bind
+var portSchema = &schemaField{Kind: kindMap, Fields: map[string]*schemaField{
+	"VardiffMin":     {Kind: kindFloat},
+	"VardiffMax":     {Kind: kindFloat},
+	"VardiffTarget":  {Kind: kindFloat},
+	"DiffMultiplier": {Kind: kindFloat},
+	"FastAck":        {Kind: kindBool},
+	"Currencies":     {Kind: kindList, Elem: &schemaField{Kind: kindString}},
+}}
+
+// Schemas for each service type's config. Keys are matched case
+// insensitively, like viper does. These need to be kept in step with the keys
+// read in each service's ParseConfig
+var configSchemas = map[string]*schemaField{
+	"stratum": {Kind: kindMap, Fields: map[string]*schemaField{
+		"DbConnectionString":        {Kind: kindString},
+		"EnableCpuminer":            {Kind: kindBool},
+		"StratumBind":               {Kind: kindBind},
+		"VardiffMin":                {Kind: kindFloat},
+		"VardiffMax":                {Kind: kindFloat},
+		"VardiffTarget":             {Kind: kindFloat},
+		"ProtocolErrorBanThreshold": {Kind: kindInt},
+		"ProtocolErrorBanTime":      {Kind: kindDuration},
+		"MaxConnsPerIP":             {Kind: kindInt},
+		"MaxConnsPerASN":            {Kind: kindInt},
+		"ConnRatePerIP":             {Kind: kindInt},
+		"ConnRatePerASN":            {Kind: kindInt},
+		"ASNDatabase":               {Kind: kindString},
+		"ConnLimitOverrides":        {Kind: kindMap, Elem: &schemaField{Kind: kindInt}},
+		"MaxPortSessions":           {Kind: kindInt},
+		"MaxPoolSessions":           {Kind: kindInt},
+		"SessionRedirect":           {Kind: kindString},
+		"Verifiers":                 {Kind: kindList, Elem: &schemaField{Kind: kindString}},
+		"VerifierTimeout":           {Kind: kindDuration},
+		"CoinbasePayoutRefresh":     {Kind: kindDuration},
+		"SnapshotMaxAge":            {Kind: kindDuration},
+		"CoinserverTemplates":       {Kind: kindBool},
+		"TemplatePushBind":          {Kind: kindBind},
+		"TemplatePushToken":         {Kind: kindString},
+		"NiceHash":                  {Kind: kindBool},
+		"NiceHashMinDiff":           {Kind: kindMap, Elem: &schemaField{Kind: kindFloat}},
+		"MinJobInterval":            {Kind: kindDuration},
+		"ProtocolSniffTimeout":      {Kind: kindDuration},
+		"HealthCheckPath":           {Kind: kindString},
+		"HashrateDecay":             {Kind: kindDuration},
+		"Region":                    {Kind: kindString},
+		"PublicEndpoint":            {Kind: kindString},
+		"AdminBind":                 {Kind: kindBind},
+		"AdminCert":                 {Kind: kindString},
+		"AdminKey":                  {Kind: kindString},
+		"AdminCA":                   {Kind: kindString},
+		"AdminEndpoint":             {Kind: kindString},
+		"Steering":                  {Kind: kindBool},
+		"SteeringInterval":          {Kind: kindDuration},
+		"SteeringImbalance":         {Kind: kindFloat},
+		"SteeringBatch":             {Kind: kindInt},
+		"RegionNetworks": {Kind: kindMap,
+			Elem: &schemaField{Kind: kindList, Elem: &schemaField{Kind: kindString}}},
+		"RegionLatency": {Kind: kindMap,
+			Elem: &schemaField{Kind: kindMap, Elem: &schemaField{Kind: kindFloat}}},
+		"TemplateCheckGrace":          {Kind: kindDuration},
+		"TemplateCheckValueTolerance": {Kind: kindFloat},
+		"DynamicAux":                  {Kind: kindBool},
+		"BlobFormat":                  {Kind: kindString},
+		"TemplateMaxAge":              {Kind: kindDuration},
+		"ShareWorkers":                {Kind: kindInt},
+		"SendQueue":                   {Kind: kindInt},
+		"WriteTimeout":                {Kind: kindDuration},
+		"VersionRollingMask":          {Kind: kindString},
+		"ShareChainName":              {Kind: kindString, Required: true},
+		"BaseCurrency":                withRequired(templateKeySchema),
+		"AuxCurrencies":               {Kind: kindList, Elem: templateKeySchema},
+		"ExtraBaseCurrencies":         {Kind: kindList, Elem: templateKeySchema},
+		"BaseCurrencySplit":           {Kind: kindString},
+		"BaseCurrencyWeights":         {Kind: kindMap, Elem: &schemaField{Kind: kindFloat}},
+		"ProxyProtocol":               {Kind: kindBool},
+		"ProxyProtocolTrusted":        {Kind: kindList, Elem: &schemaField{Kind: kindString}},
+		"JobDryRun":                   {Kind: kindBool},
+		"Extranonce1Size":             {Kind: kindInt},
+		"ExtranoncePrefix":            {Kind: kindString},
+		"IdleAuthTimeout":             {Kind: kindDuration},
+		"IdleShareTimeout":            {Kind: kindDuration},
+		"IdleResponseTimeout":         {Kind: kindDuration},
+		"IdleWarnBefore":              {Kind: kindDuration},
+		"TCPKeepAlive":                {Kind: kindDuration},
+		"Export":                      {Kind: kindString},
+		"ExportURL":                   {Kind: kindString},
+		"ExportShareTopic":            {Kind: kindString},
+		"ExportBlockTopic":            {Kind: kindString},
+		"ExportBuffer":                {Kind: kindInt},
+		"NearTargetFactor":            {Kind: kindFloat},
+		"PasswordDiff":                {Kind: kindBool},
+		"SuggestDiff":                 {Kind: kindBool},
+		"WorkerDiffMemory":            {Kind: kindDuration},
+		"RetargetGrace":               {Kind: kindDuration},
+		"RetainedJobs":                {Kind: kindInt},
+		"JobMaxAge":                   {Kind: kindDuration},
+		"StaleShareDepth":             {Kind: kindInt},
+		"AuxCleanJobs":                {Kind: kindString},
+		"MinCleanJobsInterval":        {Kind: kindDuration},
+		"AlertRejectRate":             {Kind: kindFloat},
+		"AlertRejectWindow":           {Kind: kindDuration},
+		"AlertRejectMinShares":        {Kind: kindInt},
+		"PasswordPayoutPrefs":         {Kind: kindBool},
+		"BlockArchiveDir":             {Kind: kindString},
+		"BlockArchiveMaxAge":          {Kind: kindDuration},
+		"BlockArchiveMaxBlocks":       {Kind: kindInt},
+		"Ports":                       {Kind: kindMap, Elem: portSchema},
+		"PortDrainTimeout":            {Kind: kindDuration},
+		"DiffMultiplier":              {Kind: kindFloat},
+		"FastAck":                     {Kind: kindBool},
+		"TraceSessions":               {Kind: kindList, Elem: &schemaField{Kind: kindString}},
+	}},
+	"coinserver": {Kind: kindMap, Fields: map[string]*schemaField{
+		"CoinserverBinary":      {Kind: kindString},
+		"TemplateType":          {Kind: kindString},
+		"CurrencyCode":          {Kind: kindString},
+		"HashingAlgo":           {Kind: kindString},
+		"BlockListenerBind":     {Kind: kindBind},
+		"EventListenerBind":     {Kind: kindBind},
+		"TemplateMaxAge":        {Kind: kindDuration},
+		"TemplateRules":         {Kind: kindList, Elem: &schemaField{Kind: kindString}},
+		"TemplateRefresh":       {Kind: kindDuration},
+		"TemplateRefreshMinFee": {Kind: kindInt},
+		"AuxBlockPoll":          {Kind: kindDuration},
+		"NodeRPCURL":            {Kind: kindString},
+		"NodeRPCProxy":          {Kind: kindString},
+		// Written out as the daemon's config file, so everything must be a
+		// string
+		"NodeConfig": {Kind: kindMap, Elem: &schemaField{Kind: kindString},
+			Fields: map[string]*schemaField{
+				"port":    {Kind: kindPort},
+				"rpcport": {Kind: kindPort},
+			}},
+	}},
+}
+
+// Services that set up logging through pkg/logging and alerts through
+// pkg/alert share their keys
+func init() {
+	for _, name := range []string{"stratum", "coinserver"} {
+		for key, field := range logSchema {
+			configSchemas[name].Fields[key] = field
+		}
+		for key, field := range alertSchema {
+			configSchemas[name].Fields[key] = field
+		}
+	}
+}
+
+func (f *schemaField) lookup(key string) *schemaField {
+	for name, sub := range f.Fields {
+		if strings.EqualFold(name, key) {
+			return sub
+		}
+	}
+	return nil
+}
+
+func withRequired(f *schemaField) *schemaField {
+	cp := *f
+	cp.Required = true
+	return &cp
+}
+
+// A port some field of a config listens on, for collision checks
+type listenPort struct {
+	path string
+	host string
+	port int
+}
+
+func (l listenPort) wildcard() bool {
+	return l.host == "" || l.host == "0.0.0.0" || l.host == "::"
+}
+
+func (l listenPort) collides(o listenPort) bool {
+	return l.port == o.port && (l.host == o.host || l.wildcard() || o.wildcard())
+}
+
+type configValidator struct {
+	errors []string
+	ports  []listenPort
+}
+
+func (v *configValidator) errorf(path string, format string, args ...interface{}) {
+	v.errors = append(v.errors, path+": "+fmt.Sprintf(format, args...))
+}
+
+func (v *configValidator) validate(path string, field *schemaField, val interface{}) {
+	ok := true
+	switch field.Kind {
+	case kindString:
+		_, ok = val.(string)
+	case kindInt:
+		_, ok = val.(int)
+	case kindFloat:
+		switch val.(type) {
+		case int, float64:
+		default:
+			ok = false
+		}
+	case kindBool:
+		_, ok = val.(bool)
+	case kindDuration:
+		var s string
+		if s, ok = val.(string); ok {
+			if _, err := time.ParseDuration(s); err != nil {
+				v.errorf(path, "%v", err)
+				return
+			}
+		}
+	case kindBind:
+		var s string
+		if s, ok = val.(string); ok && s != "" {
+			host, portRaw, err := net.SplitHostPort(s)
+			port, perr := strconv.Atoi(portRaw)
+			if err != nil || perr != nil || port < 1 || port > 65535 {
+				v.errorf(path, "'%s' is not a valid host:port", s)
+				return
+			}
+			v.ports = append(v.ports, listenPort{path, host, port})
+		}
+	case kindPort:
+		var s string
+		if s, ok = val.(string); ok {
+			port, err := strconv.Atoi(s)
+			if err != nil || port < 1 || port > 65535 {
+				v.errorf(path, "'%s' is not a valid port", s)
+				return
+			}
+			v.ports = append(v.ports, listenPort{path, "", port})
+		}
+	case kindMap:
+		var m map[string]interface{}
+		if m, ok = normalizeMap(val); ok {
+			v.validateMap(path, field, m)
+		}
+	case kindList:
+		var items []interface{}
+		if items, ok = val.([]interface{}); ok {
+			for i, item := range items {
+				v.validate(fmt.Sprintf("%s[%d]", path, i), field.Elem, item)
+			}
+		}
+	}
+	if !ok {
+		v.errorf(path, "expected %s, got '%v'", kindNames[field.Kind], val)
+		return
+	}
+	if field.Check != nil {
+		if err := field.Check(val); err != nil {
+			v.errorf(path, "%v", err)
+		}
+	}
+}
+
+func (v *configValidator) validateMap(path string, field *schemaField, m map[string]interface{}) {
+	prefix := ""
+	if path != "" {
+		prefix = path + "."
+	}
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		sub := field.lookup(key)
+		if sub == nil {
+			sub = field.Elem
+		}
+		if sub == nil {
+			v.errorf(prefix+key, "unknown key")
+			continue
+		}
+		v.validate(prefix+key, sub, m[key])
+	}
+}
+
+// Checks required fields are present. This runs against the config merged
+// over the service type's section of the common config, since that's what
+// the service actually sees
+func (v *configValidator) checkRequired(path string, field *schemaField, val interface{}) {
+	m, ok := normalizeMap(val)
+	if !ok {
+		return
+	}
+	lower := map[string]interface{}{}
+	for key, sub := range m {
+		lower[strings.ToLower(key)] = sub
+	}
+	names := []string{}
+	for name := range field.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sub := field.Fields[name]
+		subPath := name
+		if path != "" {
+			subPath = path + "." + name
+		}
+		subVal, ok := lower[strings.ToLower(name)]
+		if !ok || subVal == nil {
+			if sub.Required {
+				v.errorf(subPath, "required")
+			}
+			continue
+		}
+		if sub.Kind == kindMap {
+			v.checkRequired(subPath, sub, subVal)
+		} else if sub.Kind == kindList && sub.Elem.Kind == kindMap {
+			if items, ok := subVal.([]interface{}); ok {
+				for i, item := range items {
+					v.checkRequired(fmt.Sprintf("%s[%d]", subPath, i), sub.Elem, item)
+				}
+			}
+		}
+	}
+}
+
+// Any peer allowed to send a PROXY header picks its own address, so the
+// trusted balancers have to be listed, 0.0.0.0/0 to trust every peer
+func (v *configValidator) checkProxyProtocol(merged map[string]interface{}) {
+	if enabled, _ := merged["proxyprotocol"].(bool); !enabled {
+		return
+	}
+	if trusted, _ := merged["proxyprotocoltrusted"].([]interface{}); len(trusted) == 0 {
+		v.errorf("ProxyProtocolTrusted", "required with ProxyProtocol, 0.0.0.0/0 trusts every peer")
+	}
+}
+
+// YAML decodes maps with interface{} keys, we want strings
+func normalizeMap(val interface{}) (map[string]interface{}, bool) {
+	switch m := val.(type) {
+	case map[string]interface{}:
+		return m, true
+	case map[interface{}]interface{}:
+		out := map[string]interface{}{}
+		for key, sub := range m {
+			out[fmt.Sprint(key)] = sub
+		}
+		return out, true
+	case nil:
+		return map[string]interface{}{}, true
+	}
+	return nil, false
+}
+
+func parseConfig(raw string) (map[string]interface{}, error) {
+	var parsed interface{}
+	if err := yaml.Unmarshal([]byte(raw), &parsed); err != nil {
+		return nil, err
+	}
+	m, ok := normalizeMap(parsed)
+	if !ok {
+		return nil, fmt.Errorf("config must be a map of keys to values")
+	}
+	return m, nil
+}
+
+// Merges over onto base, recursing into maps. Keys compare case
+// insensitively like viper
+func mergeConfig(base map[string]interface{}, over map[string]interface{}) map[string]interface{} {
+	out := map[string]interface{}{}
+	for key, val := range base {
+		out[strings.ToLower(key)] = val
+	}
+	for key, val := range over {
+		key = strings.ToLower(key)
+		baseMap, baseOk := normalizeMap(out[key])
+		overMap, overOk := normalizeMap(val)
+		if out[key] != nil && baseOk && overOk && val != nil {
+			out[key] = mergeConfig(baseMap, overMap)
+		} else {
+			out[key] = val
+		}
+	}
+	return out
+}
+
+// Validates a service config against its type's schema. common is the
+// service type's section of the common config, which the service config is
+// merged over at boot. others are the other configs of the same service
+// type, keyed by name, to check for ports that would collide. Returns a list
+// of problems, empty if the config is good
+func validateConfig(serviceType string, raw string, common map[string]interface{},
+	others map[string]string) []string {
+	schema, ok := configSchemas[serviceType]
+	if !ok {
+		return nil
+	}
+	config, err := parseConfig(raw)
+	if err != nil {
+		return []string{"invalid YAML: " + err.Error()}
+	}
+
+	v := &configValidator{}
+	v.validateMap("", schema, config)
+	merged := mergeConfig(common, config)
+	v.checkRequired("", schema, merged)
+	if serviceType == "stratum" {
+		v.checkProxyProtocol(merged)
+	}
+
+	for i, a := range v.ports {
+		for _, b := range v.ports[i+1:] {
+			if a.collides(b) {
+				v.errorf(a.path, "port %d also used by %s", a.port, b.path)
+			}
+		}
+	}
+
+	names := []string{}
+	for name := range others {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		other, err := parseConfig(others[name])
+		if err != nil {
+			continue
+		}
+		// Only explicit binds, node ports are likely on different hosts
+		ov := &configValidator{}
+		ov.validateMap("", schema, other)
+		for _, a := range v.ports {
+			if a.host == "" {
+				continue
+			}
+			for _, b := range ov.ports {
+				if b.host != "" && a.collides(b) {
+					v.errorf(a.path, "port %d also used by %s %s (%s)",
+						a.port, serviceType, name, b.path)
+				}
+			}
+		}
+	}
+	return v.errors
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateConfigValid(t *testing.T) {
+	common := map[string]interface{}{"ShareChainName": "LTC_T"}
+	problems := validateConfig("stratum", `
+StratumBind: 127.0.0.1:3333
+VardiffMin: 1
+MinJobInterval: 10s
+BaseCurrency:
+  Currency: LTC_T
+  Algo: scrypt
+  TemplateType: getblocktemplate
+`, common, nil)
+	assert.Empty(t, problems)
+}
+
+func TestValidateConfigProblems(t *testing.T) {
+	others := map[string]string{"4444": "StratumBind: 127.0.0.1:4444"}
+	problems := validateConfig("stratum", `
+StratumBind: 127.0.0.1:4444
+Bogus: 1
+VardiffMin: lots
+MinJobInterval: 5q
+AuxCurrencies:
+  - Currency: DOGE_T
+`, nil, others)
+	assert.Contains(t, problems, "Bogus: unknown key")
+	assert.Contains(t, problems, "VardiffMin: expected number, got 'lots'")
+	assert.Contains(t, problems, "ShareChainName: required")
+	assert.Contains(t, problems, "BaseCurrency: required")
+	assert.Contains(t, problems, "AuxCurrencies[0].Algo: required")
+	assert.Contains(t, problems, "StratumBind: port 4444 also used by stratum 4444 (StratumBind)")
+	assert.Len(t, problems, 8)
+}
+
+func TestValidateConfigPortCollision(t *testing.T) {
+	problems := validateConfig("coinserver", `
+BlockListenerBind: 127.0.0.1:3000
+NodeConfig:
+  port: 19000
+  rpcport: "3000"
+`, nil, nil)
+	assert.Equal(t, []string{
+		"NodeConfig.port: expected port, got '19000'",
+		"BlockListenerBind: port 3000 also used by NodeConfig.rpcport",
+	}, problems)
+}
+
+func TestValidateConfigProxyProtocol(t *testing.T) {
+	common := map[string]interface{}{"ShareChainName": "LTC_T"}
+	config := `
+ProxyProtocol: true
+BaseCurrency:
+  Currency: LTC_T
+  Algo: scrypt
+  TemplateType: getblocktemplate
+`
+	assert.Equal(t, []string{
+		"ProxyProtocolTrusted: required with ProxyProtocol, 0.0.0.0/0 trusts every peer",
+	}, validateConfig("stratum", config, common, nil))
+	assert.Empty(t, validateConfig("stratum", config+`ProxyProtocolTrusted: ["10.0.0.0/8"]
+`, common, nil))
+}
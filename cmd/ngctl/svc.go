@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/fatih/color"
+	log "github.com/inconshreveable/log15"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/icook/ngpool/pkg/service"
+)
+
+var controlHelp = map[string]string{
+	service.ControlReloadConfig: "Re-reads config from etcd. Keys that can't apply live are logged as needing a restart",
+	service.ControlRotateLogs:   "Reopens LogFile, after logrotate has moved it",
+	service.ControlDrain:        "Stops a stratum taking new miners and fails its /readyz",
+	service.ControlRestart:      "Restarts the process in place, same arguments",
+	service.ControlSnapshot:     "Saves a stratum's queued shares and PPLNS window now, as it does when stopping",
+}
+
+func init() {
+	svcCmd := &cobra.Command{
+		Use:   "svc",
+		Short: "Manages running services through etcd",
+		Run: func(cmd *cobra.Command, args []string) {
+			cmd.Help()
+		},
+	}
+	svcCmd.AddCommand(&cobra.Command{
+		Use:   "ls [namespace]",
+		Short: "Lists running services, ie stratum or coinserver",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			etcdKeys := getEtcdKeys()
+			statuses := runningServices(etcdKeys, args[0])
+			for _, id := range sortedServiceIDs(statuses) {
+				labels := []string{}
+				for k, v := range statuses[id].Labels {
+					labels = append(labels, k+"="+v)
+				}
+				sort.Strings(labels)
+				color.Green(id)
+				fmt.Printf("  updated %s\n  %s\n",
+					statuses[id].UpdateTime.Format(time.RFC3339), strings.Join(labels, " "))
+			}
+		}})
+
+	for _, command := range service.ControlCommands {
+		command := command
+		var (
+			timeout time.Duration
+			all     bool
+		)
+		controlCmd := &cobra.Command{
+			Use:   command + " [namespace] [serviceID...]",
+			Short: controlHelp[command],
+			Args:  cobra.MinimumNArgs(1),
+			Run: func(cmd *cobra.Command, args []string) {
+				etcdKeys := getEtcdKeys()
+				namespace, ids := args[0], args[1:]
+				if all {
+					ids = sortedServiceIDs(runningServices(etcdKeys, namespace))
+				}
+				if len(ids) == 0 {
+					log.Crit("No services given, list some or pass --all")
+					os.Exit(1)
+				}
+				failed := false
+				for _, id := range ids {
+					err := sendControl(etcdKeys, namespace, id, command, timeout)
+					if err != nil {
+						color.Red("%s: %s", id, err)
+						failed = true
+						continue
+					}
+					color.Green("%s: %s done", id, command)
+				}
+				if failed {
+					os.Exit(1)
+				}
+			}}
+		controlCmd.Flags().DurationVar(&timeout, "timeout", time.Second*30,
+			"How long to wait for each service to run the command")
+		controlCmd.Flags().BoolVar(&all, "all", false,
+			"Send to every running service in the namespace, one at a time")
+		svcCmd.AddCommand(controlCmd)
+	}
+
+	RootCmd.AddCommand(svcCmd)
+}
+
+func runningServices(etcdKeys client.KeysAPI, namespace string) map[string]*service.ServiceStatus {
+	statuses, err := loadServiceStatuses(etcdKeys, namespace)
+	if err != nil {
+		log.Crit("Unable to contact etcd", "err", err)
+		os.Exit(1)
+	}
+	return statuses
+}
+
+func loadServiceStatuses(etcdKeys client.KeysAPI, namespace string) (map[string]*service.ServiceStatus, error) {
+	statuses := map[string]*service.ServiceStatus{}
+	res, err := etcdKeys.Get(context.Background(), "/status/"+namespace,
+		&client.GetOptions{Recursive: true})
+	if cerr, ok := err.(client.Error); ok && cerr.Code == client.ErrorCodeKeyNotFound {
+		return statuses, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, node := range res.Node.Nodes {
+		var status service.ServiceStatus
+		json.Unmarshal([]byte(node.Value), &status)
+		status.ServiceID = node.Key[strings.LastIndexByte(node.Key, '/')+1:]
+		statuses[status.ServiceID] = &status
+	}
+	return statuses, nil
+}
+
+func sortedServiceIDs(statuses map[string]*service.ServiceStatus) []string {
+	ids := make([]string, 0, len(statuses))
+	for id := range statuses {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Writes the command to the service's control key and waits for the service
+// to write back the result. The command expires after timeout, so a service
+// that's down doesn't run it whenever it comes back
+func sendControl(etcdKeys client.KeysAPI, namespace string, serviceID string,
+	command string, timeout time.Duration) error {
+	key := service.ControlKey(namespace, serviceID)
+	issued := time.Now().UTC()
+	raw, _ := json.Marshal(service.ControlCommand{
+		Command:  command,
+		IssuedAt: issued,
+	})
+	res, err := etcdKeys.Set(context.Background(), key, string(raw),
+		&client.SetOptions{TTL: timeout})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	watcher := etcdKeys.Watcher(key, &client.WatcherOptions{AfterIndex: res.Node.ModifiedIndex})
+	res, err = watcher.Next(ctx)
+	if err == context.DeadlineExceeded {
+		return errors.Errorf("No response after %s, is it running?", timeout)
+	} else if err != nil {
+		return err
+	}
+	if res.Action == "expire" || res.Action == "delete" {
+		return errors.New("Command expired before it was run")
+	}
+	var result service.ControlCommand
+	err = json.Unmarshal([]byte(res.Node.Value), &result)
+	if err != nil || result.HandledAt == nil || !result.IssuedAt.Equal(issued) {
+		return errors.New("Command was replaced by another before it was run")
+	}
+	if result.Error != "" {
+		return errors.New(result.Error)
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/levigross/grequests"
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/cobra"
+
+	"github.com/icook/ngpool/pkg/common"
+	"github.com/icook/ngpool/pkg/service"
+)
+
+// Clears the terminal and moves the cursor to the top left
+const clearScreen = "\033[H\033[2J"
+
+func init() {
+	var (
+		interval time.Duration
+		blocks   int
+	)
+	topCmd := &cobra.Command{
+		Use:   "top [urlbase]",
+		Short: "Live view of stratum instances, and recent blocks if given the web API",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			var urlbase string
+			if len(args) > 0 {
+				urlbase = args[0]
+			}
+			etcdKeys := getEtcdKeys()
+			t := &topState{prev: map[string]topSample{}}
+			for {
+				fmt.Print(clearScreen)
+				fmt.Print(t.refresh(etcdKeys, urlbase, blocks, time.Now()))
+				time.Sleep(interval)
+			}
+		}}
+	topCmd.Flags().DurationVar(&interval, "interval", time.Second*2, "Time between refreshes")
+	topCmd.Flags().IntVar(&blocks, "blocks", 5, "Recent blocks to show")
+	RootCmd.AddCommand(topCmd)
+}
+
+// Share counts of a stratum at one refresh, to work out rates from the next
+type topSample struct {
+	at       time.Time
+	accepted uint64
+	rejected uint64
+}
+
+type topRow struct {
+	id          string
+	region      string
+	draining    bool
+	connections int
+	miners      int
+	hashrate    float64
+	// Shares per minute since the last refresh, nil on the first
+	accepted *float64
+	rejected *float64
+}
+
+type topBlock struct {
+	Currency string    `json:"currency"`
+	Height   int64     `json:"height"`
+	Status   string    `json:"status"`
+	MinedAt  time.Time `json:"mined_at"`
+	Effort   *float64  `json:"effort"`
+}
+
+type topState struct {
+	prev map[string]topSample
+}
+
+// Fetches everything and renders a screen. Errors are shown in place of what
+// couldn't be fetched, so a blip doesn't end the session
+func (t *topState) refresh(etcdKeys client.KeysAPI, urlbase string, blockCount int,
+	now time.Time) string {
+	var out bytes.Buffer
+	var rows []topRow
+	statuses, err := loadServiceStatuses(etcdKeys, "stratum")
+	if err != nil {
+		fmt.Fprintf(&out, "Failed to read etcd: %s\n", err)
+	} else {
+		rows = t.rows(statuses, now)
+	}
+
+	var recent []topBlock
+	var blockErr error
+	if urlbase != "" && blockCount > 0 {
+		recent, blockErr = fetchRecentBlocks(urlbase, blockCount)
+	}
+	renderTop(&out, rows, recent, now)
+	if blockErr != nil {
+		fmt.Fprintf(&out, "Failed to fetch blocks: %s\n", blockErr)
+	}
+	return out.String()
+}
+
+func (t *topState) rows(statuses map[string]*service.ServiceStatus, now time.Time) []topRow {
+	next := map[string]topSample{}
+	var rows []topRow
+	for _, id := range sortedServiceIDs(statuses) {
+		row, sample := summarizeStratum(id, statuses[id], now)
+		if prev, ok := t.prev[id]; ok {
+			minutes := now.Sub(prev.at).Minutes()
+			if minutes > 0 {
+				accepted := shareRate(prev.accepted, sample.accepted, minutes)
+				rejected := shareRate(prev.rejected, sample.rejected, minutes)
+				row.accepted, row.rejected = &accepted, &rejected
+			}
+		}
+		next[id] = sample
+		rows = append(rows, row)
+	}
+	t.prev = next
+	return rows
+}
+
+// Counts are summed over connected clients, so they fall when miners leave.
+// That isn't negative work, just nothing we can measure
+func shareRate(prev uint64, cur uint64, minutes float64) float64 {
+	if cur < prev {
+		return 0
+	}
+	return float64(cur-prev) / minutes
+}
+
+func summarizeStratum(id string, status *service.ServiceStatus, now time.Time) (topRow, topSample) {
+	row := topRow{id: id, region: status.Labels["region"]}
+	sample := topSample{at: now}
+	var decoded common.StratumStatus
+	if err := mapstructure.Decode(status.Status, &decoded); err != nil {
+		return row, sample
+	}
+	row.draining = decoded.Draining
+	row.connections = len(decoded.Clients)
+	row.hashrate = decoded.Hashrate.Port
+	row.miners = len(decoded.Hashrate.Addresses)
+	for _, client := range decoded.Clients {
+		sample.accepted += client.Shares.Accepted
+		sample.rejected += client.Shares.Rejected()
+	}
+	return row, sample
+}
+
+func fetchRecentBlocks(urlbase string, count int) ([]topBlock, error) {
+	resp, err := grequests.Get(urlbase+"/v1/blocks", &grequests.RequestOptions{
+		Params: map[string]string{"page_size": strconv.Itoa(count)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Ok {
+		return nil, fmt.Errorf("%s returned %d", urlbase, resp.StatusCode)
+	}
+	var vals struct {
+		Data struct {
+			Blocks []topBlock
+		}
+	}
+	err = resp.JSON(&vals)
+	return vals.Data.Blocks, err
+}
+
+func renderTop(out *bytes.Buffer, rows []topRow, blocks []topBlock, now time.Time) {
+	var (
+		totalConns int
+		totalRate  float64
+	)
+	for _, row := range rows {
+		totalConns += row.connections
+		totalRate += row.hashrate
+	}
+	fmt.Fprintf(out, "ngpool  %s  %d stratum, %d connections, %s\n\n",
+		now.Format("15:04:05"), len(rows), totalConns, formatHashrate(totalRate))
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STRATUM\tREGION\tSTATE\tCONNS\tMINERS\tHASHRATE\tACCEPT/M\tREJECT/M")
+	for _, row := range rows {
+		state := "up"
+		if row.draining {
+			state = "draining"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\t%s\t%s\n", row.id, row.region, state,
+			row.connections, row.miners, formatHashrate(row.hashrate),
+			formatRate(row.accepted), formatRate(row.rejected))
+	}
+	w.Flush()
+
+	if len(blocks) == 0 {
+		return
+	}
+	sort.SliceStable(blocks, func(i, j int) bool {
+		return blocks[i].MinedAt.After(blocks[j].MinedAt)
+	})
+	fmt.Fprintln(out)
+	w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CURRENCY\tHEIGHT\tSTATUS\tEFFORT\tMINED")
+	for _, block := range blocks {
+		effort := "-"
+		if block.Effort != nil {
+			effort = fmt.Sprintf("%.0f%%", *block.Effort*100)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s ago\n", block.Currency, block.Height,
+			block.Status, effort, now.Sub(block.MinedAt).Truncate(time.Second))
+	}
+	w.Flush()
+}
+
+func formatRate(rate *float64) string {
+	if rate == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f", *rate)
+}
+
+func formatHashrate(rate float64) string {
+	units := []string{"H/s", "KH/s", "MH/s", "GH/s", "TH/s", "PH/s", "EH/s"}
+	i := 0
+	for rate >= 1000 && i < len(units)-1 {
+		rate /= 1000
+		i++
+	}
+	return fmt.Sprintf("%.2f %s", rate, units[i])
+}
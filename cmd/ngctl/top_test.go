@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/icook/ngpool/pkg/service"
+)
+
+func topTestStatus(accepted float64, draining bool) *service.ServiceStatus {
+	return &service.ServiceStatus{
+		Labels: map[string]string{"region": "eu"},
+		Status: map[string]interface{}{
+			"clients": []interface{}{
+				map[string]interface{}{"username": "alice",
+					"shares": map[string]interface{}{"accepted": accepted, "stale": 2.0}},
+				map[string]interface{}{"username": "bob",
+					"shares": map[string]interface{}{"accepted": 10.0}},
+			},
+			"hashrate": map[string]interface{}{
+				"port":      2500000.0,
+				"addresses": map[string]interface{}{"alice": 2000000.0, "bob": 500000.0},
+			},
+			"draining": draining,
+		},
+	}
+}
+
+func TestTopRows(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	state := &topState{prev: map[string]topSample{}}
+	rows := state.rows(map[string]*service.ServiceStatus{
+		"s1": topTestStatus(20, false)}, now)
+	assert.Len(t, rows, 1)
+	assert.Equal(t, 2, rows[0].connections)
+	assert.Equal(t, 2, rows[0].miners)
+	assert.Nil(t, rows[0].accepted)
+
+	now = now.Add(time.Second * 30)
+	rows = state.rows(map[string]*service.ServiceStatus{
+		"s1": topTestStatus(50, true)}, now)
+	assert.Equal(t, 60.0, *rows[0].accepted)
+	assert.Equal(t, 0.0, *rows[0].rejected)
+	assert.True(t, rows[0].draining)
+
+	// A miner leaving takes its counts with it
+	assert.Equal(t, 0.0, shareRate(60, 20, 1))
+}
+
+func TestRenderTop(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	accepted := 60.0
+	effort := 1.25
+	var out bytes.Buffer
+	renderTop(&out, []topRow{
+		{id: "s1", region: "eu", connections: 2, hashrate: 2500000, accepted: &accepted},
+		{id: "s2", draining: true, hashrate: 500000},
+	}, []topBlock{
+		{Currency: "LTC", Height: 10, Status: "immature", MinedAt: now.Add(-time.Minute)},
+		{Currency: "DOGE", Height: 20, Status: "immature", MinedAt: now.Add(-time.Second),
+			Effort: &effort},
+	}, now)
+	lines := strings.Split(out.String(), "\n")
+	assert.Contains(t, lines[0], "2 stratum, 2 connections, 3.00 MH/s")
+	assert.Contains(t, out.String(), "draining")
+	assert.Contains(t, out.String(), "60.0")
+	// Newest block first
+	assert.True(t, strings.Index(out.String(), "DOGE") < strings.Index(out.String(), "LTC"))
+	assert.Contains(t, out.String(), "125%")
+}
+
+func TestFormatHashrate(t *testing.T) {
+	assert.Equal(t, "512.00 H/s", formatHashrate(512))
+	assert.Equal(t, "1.50 GH/s", formatHashrate(1.5e9))
+}
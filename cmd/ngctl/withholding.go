@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/fatih/color"
+	log "github.com/inconshreveable/log15"
+	"github.com/levigross/grequests"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	var limit int
+	withholdingCmd := &cobra.Command{
+		Use:   "withholding [urlbase]",
+		Short: "Show the workers most likely to be withholding blocks",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			resp, err := grequests.Get(args[0]+"/v1/withholding", &grequests.RequestOptions{
+				Params: map[string]string{"limit": fmt.Sprint(limit)},
+			})
+			if err != nil {
+				log.Crit("Failed to get withholding", "err", err)
+				os.Exit(1)
+			}
+			type Worker struct {
+				Username    string
+				Worker      string
+				NearTarget  int `json:"near_target"`
+				Solves      int
+				Expected    float64
+				Probability float64
+				Flagged     bool
+			}
+			var vals struct {
+				Data struct {
+					Window  string
+					Flagged int
+					Workers []Worker
+				}
+			}
+			err = resp.JSON(&vals)
+			if err != nil {
+				log.Crit("Invalid response", "err", err)
+				os.Exit(1)
+			}
+
+			fmt.Printf("%d workers flagged in the last %s\n", vals.Data.Flagged, vals.Data.Window)
+			fmt.Printf("%-20s %-12s %10s %8s %10s %12s\n",
+				"username", "worker", "near", "solves", "expected", "probability")
+			for _, w := range vals.Data.Workers {
+				fmt.Printf("%-20s %-12s %10d %8d %10.2f %12.2g",
+					w.Username, w.Worker, w.NearTarget, w.Solves, w.Expected, w.Probability)
+				if w.Flagged {
+					color.New(color.FgRed).Print("  flagged")
+				}
+				fmt.Println()
+			}
+		}}
+	withholdingCmd.Flags().IntVar(&limit, "limit", 20, "Workers to show")
+	RootCmd.AddCommand(withholdingCmd)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+
+	"github.com/icook/ngpool/pkg/stratumtest"
+)
+
+func init() {
+	var (
+		vars    = stratumtest.DefaultVars()
+		timeout time.Duration
+		golden  string
+		verbose bool
+	)
+	checkCmd := &cobra.Command{
+		Use:   "check [host:port]",
+		Short: "Run the stratum conformance scripts against a server",
+		Long: `Runs each of the stratumtest scripts on its own connection, checking the
+server answers subscribe, authorize and submit the way miners expect, and
+copes with malformed and out of order requests. The shares submitted are
+never valid, so it's safe against a live pool as long as the difficulty
+isn't tiny. With --golden, transcripts are also compared with the files
+cmd/ngstratum/testdata/conformance holds for ngstratum`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			failed := false
+			for _, result := range stratumtest.Check(args[0], stratumtest.Suite, vars, timeout) {
+				err := result.Err
+				if err == nil && golden != "" {
+					err = stratumtest.Golden(filepath.Join(golden, result.Script.Name+".golden"),
+						result.Transcript, false)
+				}
+				if err != nil {
+					failed = true
+					color.Red("FAIL %s: %s", result.Script.Name, err)
+				} else {
+					color.Green("ok   %s", result.Script.Name)
+				}
+				if verbose || err != nil {
+					fmt.Print(result.Transcript)
+				}
+			}
+			if failed {
+				os.Exit(1)
+			}
+		}}
+	flags := checkCmd.Flags()
+	flags.StringVarP(&vars.User, "user", "u", vars.User, "Username to authorize as")
+	flags.StringVarP(&vars.Password, "password", "p", vars.Password, "Password to authorize with")
+	flags.DurationVar(&timeout, "timeout", stratumtest.DefaultTimeout, "How long to wait for each answer")
+	flags.StringVar(&golden, "golden", "", "Directory of golden transcripts to compare with")
+	flags.BoolVarP(&verbose, "verbose", "v", false, "Print every transcript, not just failures")
+	RootCmd.AddCommand(checkCmd)
+}
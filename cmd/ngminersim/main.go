@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/spf13/cobra"
+
+	"github.com/icook/ngpool/pkg/service"
+)
+
+var RootCmd = &cobra.Command{
+	Use:   "ngminersim",
+	Short: "Simulated miners for load testing a stratum",
+	Run: func(cmd *cobra.Command, args []string) {
+		cmd.Help()
+	},
+}
+
+func init() {
+	var (
+		config   SimConfig
+		algoName string
+		duration time.Duration
+		report   time.Duration
+	)
+	runCmd := &cobra.Command{
+		Use:   "run [host:port]",
+		Short: "Connect simulated miners and submit shares until stopped",
+		Long: `Connect simulated miners and submit shares until stopped. Valid shares are
+really hashed, so keep the stratum's difficulty tiny (ie --password d=0.0001
+with a low VardiffMin) or the rate won't be met`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			algo, ok := service.AlgoConfig[algoName]
+			if !ok {
+				log.Crit("Unknown algo", "algo", algoName)
+				os.Exit(1)
+			}
+			config.Addr = args[0]
+			config.Algo = algo
+			if err := config.Validate(); err != nil {
+				log.Crit("Invalid options", "err", err)
+				os.Exit(1)
+			}
+
+			rand.Seed(time.Now().UnixNano())
+			sim := NewSimulator(config)
+			sim.Start()
+			ticker := time.NewTicker(report)
+			defer ticker.Stop()
+			sigs := make(chan os.Signal, 1)
+			signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+			var timeout <-chan time.Time
+			if duration > 0 {
+				timeout = time.After(duration)
+			}
+		loop:
+			for {
+				select {
+				case <-ticker.C:
+					sim.Report()
+				case <-sigs:
+					break loop
+				case <-timeout:
+					break loop
+				}
+			}
+			sim.Stop()
+			sim.Report()
+		}}
+	flags := runCmd.Flags()
+	flags.IntVarP(&config.Conns, "conns", "n", 10, "Stratum connections to open")
+	flags.StringVarP(&config.Username, "user", "u", "minersim",
+		"Username, each connection is a worker of it")
+	flags.StringVarP(&config.Password, "password", "p", "x", "Password, ie d=0.0001 to fix the difficulty")
+	flags.StringVar(&algoName, "algo", "sha256d", "PoW algorithm of the stratum")
+	flags.Float64VarP(&config.Rate, "rate", "r", 6, "Shares per minute per connection")
+	flags.Float64Var(&config.InvalidPct, "invalid", 0, "Percent of shares above the share target")
+	flags.Float64Var(&config.StalePct, "stale", 0, "Percent of shares for old or unknown jobs")
+	flags.Float64Var(&config.DuplicatePct, "duplicate", 0, "Percent of shares resubmitting the last one")
+	flags.DurationVar(&config.RampUp, "rampup", time.Second*10, "Spread connecting over this long")
+	flags.DurationVarP(&duration, "duration", "d", 0, "Stop after this long, 0 to run until interrupted")
+	flags.DurationVar(&report, "report", time.Second*10, "How often to log stats")
+	RootCmd.AddCommand(runCmd)
+}
+
+func main() {
+	if err := RootCmd.Execute(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
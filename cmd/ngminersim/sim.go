@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/pkg/errors"
+
+	"github.com/icook/ngpool/pkg/service"
+	"github.com/icook/ngpool/pkg/stratumclient"
+)
+
+// Kinds of share a simulated miner submits
+const (
+	shareValid     = "valid"
+	shareInvalid   = "invalid"
+	shareStale     = "stale"
+	shareDuplicate = "duplicate"
+)
+
+// How long to wait before reconnecting a dropped miner
+const simReconnectInterval = time.Second * 5
+
+type SimConfig struct {
+	Addr     string
+	Conns    int
+	Username string
+	Password string
+	Algo     *service.Algo
+	// Shares per minute per connection
+	Rate float64
+	// Percentages of shares that should be rejected. The rest are valid
+	InvalidPct   float64
+	StalePct     float64
+	DuplicatePct float64
+	// Connections are opened evenly over this long
+	RampUp time.Duration
+}
+
+func (c *SimConfig) Validate() error {
+	if c.Conns <= 0 {
+		return errors.New("Need at least one connection")
+	}
+	if c.Rate <= 0 {
+		return errors.New("Rate must be positive")
+	}
+	for _, pct := range []float64{c.InvalidPct, c.StalePct, c.DuplicatePct} {
+		if pct < 0 {
+			return errors.New("Percentages can't be negative")
+		}
+	}
+	if c.InvalidPct+c.StalePct+c.DuplicatePct > 100 {
+		return errors.New("Percentages add up to more than 100")
+	}
+	return nil
+}
+
+// Picks a kind of share from roll, uniform in [0, 100)
+func (c *SimConfig) pickKind(roll float64) string {
+	if roll < c.InvalidPct {
+		return shareInvalid
+	}
+	roll -= c.InvalidPct
+	if roll < c.StalePct {
+		return shareStale
+	}
+	roll -= c.StalePct
+	if roll < c.DuplicatePct {
+		return shareDuplicate
+	}
+	return shareValid
+}
+
+type simStats struct {
+	connected    int
+	connects     uint64
+	connectFails uint64
+	disconnects  uint64
+	// By kind of share
+	submitted map[string]uint64
+	// "accepted", or the stratum's description of why it was rejected
+	results map[string]uint64
+	// Valid shares not found before the next was due, the difficulty is too
+	// high for the rate
+	missed    uint64
+	latency   time.Duration
+	responses uint64
+	mtx       sync.Mutex
+}
+
+func (s *simStats) submit(kind string, share *stratumclient.Share) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.submitted[kind]++
+	result := "accepted"
+	if !share.Accepted {
+		result = share.Error
+		if result == "" {
+			result = fmt.Sprintf("error %d", share.ErrorCode)
+		}
+	}
+	s.results[result]++
+	s.latency += share.Latency
+	s.responses++
+}
+
+// Simulator runs Conns miners against a stratum, each submitting shares at
+// Rate with a mix of valid and bad ones
+type Simulator struct {
+	config SimConfig
+	stats  *simStats
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func NewSimulator(config SimConfig) *Simulator {
+	return &Simulator{
+		config: config,
+		stats: &simStats{
+			submitted: map[string]uint64{},
+			results:   map[string]uint64{},
+		},
+		stop: make(chan struct{}),
+	}
+}
+
+func (s *Simulator) Start() {
+	spacing := s.config.RampUp / time.Duration(s.config.Conns)
+	for i := 0; i < s.config.Conns; i++ {
+		s.wg.Add(1)
+		go func(i int) {
+			defer s.wg.Done()
+			select {
+			case <-time.After(spacing * time.Duration(i)):
+			case <-s.stop:
+				return
+			}
+			s.runMiner(i)
+		}(i)
+	}
+}
+
+func (s *Simulator) Stop() {
+	close(s.stop)
+	s.wg.Wait()
+}
+
+func (s *Simulator) stopped() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Keeps one miner connected until the simulator stops
+func (s *Simulator) runMiner(i int) {
+	username := fmt.Sprintf("%s.sim%d", s.config.Username, i)
+	for !s.stopped() {
+		client, err := stratumclient.Dial(s.config.Addr, username, s.config.Password, s.config.Algo)
+		s.stats.mtx.Lock()
+		if err != nil {
+			s.stats.connectFails++
+		} else {
+			s.stats.connects++
+			s.stats.connected++
+		}
+		s.stats.mtx.Unlock()
+		if err != nil {
+			log.Debug("Failed to connect", "worker", username, "err", err)
+		} else {
+			err = s.mine(client)
+			client.Close()
+			s.stats.mtx.Lock()
+			s.stats.connected--
+			if err != nil {
+				s.stats.disconnects++
+			}
+			s.stats.mtx.Unlock()
+			if err == nil {
+				return
+			}
+			log.Debug("Miner disconnected", "worker", username, "err", err)
+		}
+		select {
+		case <-time.After(simReconnectInterval):
+		case <-s.stop:
+		}
+	}
+}
+
+// Submits shares until the simulator stops (nil) or the connection fails
+func (s *Simulator) mine(client *stratumclient.Client) error {
+	interval := time.Duration(float64(time.Minute) / s.config.Rate)
+	// Start at a random point so connections don't submit in lockstep
+	next := time.Now().Add(time.Duration(rand.Int63n(int64(interval))))
+	var last *stratumclient.Share
+	for {
+		select {
+		case <-time.After(time.Until(next)):
+		case <-s.stop:
+			return nil
+		}
+		next = next.Add(interval)
+		if err := client.Err(); err != nil {
+			return err
+		}
+		job, err := client.WaitJob(interval)
+		if err != nil {
+			return err
+		}
+
+		kind := s.config.pickKind(rand.Float64() * 100)
+		if kind == shareDuplicate && last == nil {
+			kind = shareValid
+		}
+		var share *stratumclient.Share
+		switch kind {
+		case shareValid:
+			share, err = client.FindShare(job, next)
+			if err != nil {
+				s.stats.mtx.Lock()
+				s.stats.missed++
+				s.stats.mtx.Unlock()
+				continue
+			}
+		case shareInvalid:
+			share, err = client.LowDiffShare(job)
+		case shareStale:
+			stale := client.StaleJob()
+			if stale == nil {
+				// No old job yet, one the stratum never sent is rejected
+				// the same way
+				unknown := *job
+				unknown.ID = "stale"
+				stale = &unknown
+			}
+			share, err = client.LowDiffShare(stale)
+		case shareDuplicate:
+			resubmit := *last
+			share = &resubmit
+		}
+		if err != nil {
+			return err
+		}
+		if err := client.Submit(share); err != nil {
+			return err
+		}
+		s.stats.submit(kind, share)
+		if kind == shareValid && share.Accepted {
+			last = share
+		}
+	}
+}
+
+func sortedCounts(counts map[string]uint64) []interface{} {
+	keys := []string{}
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	ret := []interface{}{}
+	for _, key := range keys {
+		ret = append(ret, key, counts[key])
+	}
+	return ret
+}
+
+func (s *Simulator) Report() {
+	s.stats.mtx.Lock()
+	defer s.stats.mtx.Unlock()
+	var avgLatency time.Duration
+	if s.stats.responses > 0 {
+		avgLatency = s.stats.latency / time.Duration(s.stats.responses)
+	}
+	log.Info("Connections", "connected", s.stats.connected,
+		"connects", s.stats.connects, "failed", s.stats.connectFails,
+		"dropped", s.stats.disconnects)
+	log.Info("Shares submitted", sortedCounts(s.stats.submitted)...)
+	log.Info("Share results", append(sortedCounts(s.stats.results),
+		"missed", s.stats.missed, "avg_latency", avgLatency)...)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSimConfigValidate(t *testing.T) {
+	config := SimConfig{Conns: 10, Rate: 6, InvalidPct: 5, StalePct: 5, DuplicatePct: 5}
+	assert.NoError(t, config.Validate())
+
+	bad := config
+	bad.Conns = 0
+	assert.Error(t, bad.Validate())
+	bad = config
+	bad.Rate = 0
+	assert.Error(t, bad.Validate())
+	bad = config
+	bad.StalePct = -1
+	assert.Error(t, bad.Validate())
+	bad = config
+	bad.InvalidPct = 95
+	assert.Error(t, bad.Validate())
+}
+
+func TestPickKind(t *testing.T) {
+	config := SimConfig{InvalidPct: 10, StalePct: 5, DuplicatePct: 1}
+	assert.Equal(t, shareInvalid, config.pickKind(0))
+	assert.Equal(t, shareInvalid, config.pickKind(9.9))
+	assert.Equal(t, shareStale, config.pickKind(10))
+	assert.Equal(t, shareStale, config.pickKind(14.9))
+	assert.Equal(t, shareDuplicate, config.pickKind(15))
+	assert.Equal(t, shareValid, config.pickKind(16))
+	assert.Equal(t, shareValid, config.pickKind(99.9))
+
+	assert.Equal(t, shareValid, (&SimConfig{}).pickKind(0))
+}
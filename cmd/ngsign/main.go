@@ -5,6 +5,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/btcsuite/btcd/btcec"
 	"github.com/btcsuite/btcd/chaincfg"
@@ -20,11 +21,13 @@ import (
 	"github.com/icook/ngpool/pkg/service"
 )
 
+// Signs and submits a single payout batch. Returns false when there was
+// nothing left to pay
 func sign(config *service.ChainConfig, urlbase string,
-	addresses map[string]*btcec.PrivateKey) error {
+	addresses map[string]*btcec.PrivateKey) (bool, error) {
 	resp, err := grequests.Get(urlbase+"/v1/createpayout/"+config.Code, nil)
 	if err != nil {
-		return err
+		return false, err
 	}
 	type Payout struct {
 		Errors []interface{}
@@ -36,24 +39,26 @@ func sign(config *service.ChainConfig, urlbase string,
 	var vals Payout
 	err = resp.JSON(&vals)
 	if err != nil {
-		return err
+		return false, err
 	}
 	if len(vals.Errors) > 0 {
 		log.Error("Error from server", "errors", vals.Errors)
-		return errors.New("Error from remote")
+		return false, errors.New("Error from remote")
 	}
 	if vals.Data.TX == "" {
 		log.Info("No transaction to process at this time", "curr", config.Code)
-		return nil
+		return false, nil
 	}
 	var payout = vals.Data
 	log.Info("Got pending payout",
+		"run", payout.PayoutMeta.RunID,
+		"cursor", payout.PayoutMeta.Cursor,
 		"outputs", len(payout.PayoutMeta.PayoutMaps),
 		"tx_size_wo_sigs", len(payout.TX))
 
 	redeemTx, err := common.HexStringToTX(payout.TX)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	lookupKey := func(a btcutil.Address) (*btcec.PrivateKey, bool, error) {
@@ -72,17 +77,17 @@ func sign(config *service.ChainConfig, urlbase string,
 		}
 		if inputAddress == "" {
 			log.Error("Failed linking input to UTXO", "i", i, "prevout", input.PreviousOutPoint)
-			return errors.New("Failed to find UTXO linking to input")
+			return false, errors.New("Failed to find UTXO linking to input")
 		}
 
 		addr, err := btcutil.DecodeAddress(inputAddress, config.Params)
 		if err != nil {
-			return errors.New("Invalid address in UTXO from server")
+			return false, errors.New("Invalid address in UTXO from server")
 		}
 
 		pkScript, err := txscript.PayToAddrScript(addr)
 		if err != nil {
-			return err
+			return false, err
 		}
 
 		sigScript, err := txscript.SignTxOutput(config.Params,
@@ -106,13 +111,13 @@ func sign(config *service.ChainConfig, urlbase string,
 			},
 		})
 	if err != nil {
-		return err
+		return false, err
 	}
 	if resp.StatusCode != 200 {
 		log.Error("Payout submission failed", "ret", resp.String())
-		return errors.New("Got non-200 from submission")
+		return false, errors.New("Got non-200 from submission")
 	}
-	return nil
+	return true, nil
 }
 
 // Loads currency config from the remote
@@ -148,6 +153,16 @@ func loadAddresses(addrs []string, params *chaincfg.Params) (map[string]*btcec.P
 	return ret, nil
 }
 
+var maxTime time.Duration
+var maxBatches int
+
+func init() {
+	RootCmd.Flags().DurationVar(&maxTime, "max-time", 0,
+		"stop starting new batches after this long, resuming on the next run (0 is unlimited)")
+	RootCmd.Flags().IntVar(&maxBatches, "max-batches", 0,
+		"maximum batches to send per currency (0 is unlimited)")
+}
+
 var RootCmd = &cobra.Command{
 	Use:   "ngsign [urlbase] [keyfile]",
 	Short: "Sign raw transactions",
@@ -168,7 +183,8 @@ var RootCmd = &cobra.Command{
 		}
 
 		loadCommon(urlbase)
-		for _, curr := range service.CurrencyConfig {
+		start := time.Now()
+		for _, curr := range service.Currencies() {
 			logger := log.New("currency", curr.Code)
 			subcfg := config.Sub(curr.Code)
 			if subcfg == nil {
@@ -181,9 +197,22 @@ var RootCmd = &cobra.Command{
 				os.Exit(1)
 			}
 
-			err = sign(curr, args[0], addresses)
-			if err != nil {
-				logger.Crit("Failed signing", "err", err)
+			// Each batch is committed server side before we move on, so
+			// stopping at any point just resumes from the run's cursor next
+			// time
+			for batch := 0; maxBatches == 0 || batch < maxBatches; batch++ {
+				if maxTime != 0 && time.Since(start) > maxTime {
+					logger.Info("Time limit reached, remaining batches deferred")
+					return
+				}
+				sent, err := sign(curr, urlbase, addresses)
+				if err != nil {
+					logger.Crit("Failed signing", "err", err)
+					break
+				}
+				if !sent {
+					break
+				}
 			}
 		}
 	},
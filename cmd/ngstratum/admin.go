@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/icook/ngpool/pkg/adminrpc"
+)
+
+// A difficulty set through the admin API or suggested by the miner, applied
+// by the client's write loop
+type diffRequest struct {
+	diff   float64
+	static bool
+	// From mining.suggest_difficulty, which a static difficulty overrides
+	suggested bool
+}
+
+// Serves adminrpc.StratumAdmin and LogAdmin on AdminBind, if set
+func (n *StratumServer) startAdmin() error {
+	bind := n.config.GetString("AdminBind")
+	if bind == "" {
+		return nil
+	}
+	server, err := adminrpc.NewServer(adminrpc.TLSFiles{
+		CertFile: n.config.GetString("AdminCert"),
+		KeyFile:  n.config.GetString("AdminKey"),
+		CAFile:   n.config.GetString("AdminCA"),
+	})
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", bind)
+	if err != nil {
+		return errors.Wrap(err, "Admin listen")
+	}
+	adminrpc.RegisterStratumAdminServer(server, &stratumAdmin{n})
+	adminrpc.RegisterLogs(server, n.logs.Buffer())
+	log.Info("Serving admin API", "bind", bind)
+	go func() {
+		err := server.Serve(listener)
+		log.Error("Admin API stopped", "err", err)
+	}()
+	return nil
+}
+
+// Runs fn on UpdateStatus's goroutine, which owns the client list. fn must
+// not block
+func (n *StratumServer) withClients(fn func(map[string]*StratumClient)) {
+	done := make(chan struct{})
+	n.clientQuery <- func(clients map[string]*StratumClient) {
+		fn(clients)
+		close(done)
+	}
+	<-done
+}
+
+// Connected clients matching sel, all of them for a nil or empty sel
+func (n *StratumServer) selectClients(sel *adminrpc.SessionSelector) []*StratumClient {
+	var matched []*StratumClient
+	n.withClients(func(clients map[string]*StratumClient) {
+		for _, client := range clients {
+			if client.hasShutdown {
+				continue
+			}
+			if sel.GetId() != "" && client.id != sel.GetId() {
+				continue
+			}
+			if sel.GetUsername() != "" && client.username != sel.GetUsername() {
+				continue
+			}
+			if sel.GetWorker() != "" && client.worker != sel.GetWorker() {
+				continue
+			}
+			matched = append(matched, client)
+		}
+	})
+	return matched
+}
+
+// Without a selector an operation would hit every miner, which is never
+// what's meant
+func requireSelector(sel *adminrpc.SessionSelector) error {
+	if sel.GetId() == "" && sel.GetUsername() == "" {
+		return status.Error(codes.InvalidArgument, "Sessions must be picked by id or username")
+	}
+	return nil
+}
+
+type stratumAdmin struct {
+	n *StratumServer
+}
+
+func (a *stratumAdmin) ListSessions(ctx context.Context,
+	req *adminrpc.ListSessionsRequest) (*adminrpc.ListSessionsResponse, error) {
+	resp := &adminrpc.ListSessionsResponse{}
+	for _, client := range a.n.selectClients(req.GetSessions()) {
+		s := client.status()
+		resp.Sessions = append(resp.Sessions, &adminrpc.Session{
+			Id:               client.id,
+			Username:         s.Username,
+			Worker:           s.Name,
+			RemoteIp:         s.RemoteIP,
+			Currency:         s.Currency,
+			Difficulty:       s.Difficulty,
+			StaticDifficulty: client.staticDiff,
+			Hashrate:         s.Hashrate,
+			ConnectedAt:      client.connectedAt.Unix(),
+			Accepted:         s.Shares.Accepted,
+			Rejected:         s.Shares.Rejected(),
+		})
+	}
+	return resp, nil
+}
+
+func (a *stratumAdmin) Disconnect(ctx context.Context,
+	req *adminrpc.DisconnectRequest) (*adminrpc.DisconnectResponse, error) {
+	if err := requireSelector(req.GetSessions()); err != nil {
+		return nil, err
+	}
+	clients := a.n.selectClients(req.GetSessions())
+	for _, client := range clients {
+		client.log.Info("Disconnected by admin")
+		client.Stop()
+	}
+	return &adminrpc.DisconnectResponse{Disconnected: int32(len(clients))}, nil
+}
+
+func (a *stratumAdmin) SetDifficulty(ctx context.Context,
+	req *adminrpc.SetDifficultyRequest) (*adminrpc.SetDifficultyResponse, error) {
+	if err := requireSelector(req.GetSessions()); err != nil {
+		return nil, err
+	}
+	if req.Difficulty <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "Difficulty must be above zero")
+	}
+	dr := diffRequest{diff: req.Difficulty, static: req.Static}
+	var updated int32
+	for _, client := range a.n.selectClients(req.GetSessions()) {
+		select {
+		case client.diffRequest <- dr:
+			updated++
+		case <-client.shutdown:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return &adminrpc.SetDifficultyResponse{Updated: updated}, nil
+}
+
+func (a *stratumAdmin) GetStats(ctx context.Context,
+	req *adminrpc.GetStatsRequest) (*adminrpc.GetStatsResponse, error) {
+	raw, err := json.Marshal(a.n.lastStatus.Load())
+	if err != nil {
+		return nil, err
+	}
+	return &adminrpc.GetStatsResponse{StatusJson: string(raw)}, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+type asnRange struct {
+	start net.IP
+	end   net.IP
+	asn   uint32
+}
+
+// ASNDatabase maps IPs to the autonomous system announcing them, from the
+// free iptoasn.com dumps (ip2asn-combined.tsv, optionally gzipped). Each line
+// is a range start, range end, AS number, country and description separated
+// by tabs. AS 0 marks unrouted space. The whole table is held in memory,
+// around 500k ranges
+type ASNDatabase struct {
+	ranges []asnRange
+}
+
+func LoadASNDatabase(path string) (*ASNDatabase, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	return ReadASNDatabase(r)
+}
+
+func ReadASNDatabase(r io.Reader) (*ASNDatabase, error) {
+	db := &ASNDatabase{}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 3 {
+			continue
+		}
+		start := net.ParseIP(fields[0]).To16()
+		end := net.ParseIP(fields[1]).To16()
+		if start == nil || end == nil {
+			return nil, errors.Errorf("Invalid range on line %d", line)
+		}
+		asn, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return nil, errors.Errorf("Invalid AS number on line %d", line)
+		}
+		if asn == 0 {
+			continue
+		}
+		db.ranges = append(db.ranges, asnRange{start, end, uint32(asn)})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(db.ranges, func(i, j int) bool {
+		return bytes.Compare(db.ranges[i].start, db.ranges[j].start) < 0
+	})
+	return db, nil
+}
+
+// Returns the AS number for an IP, or 0 if it isn't in the table
+func (d *ASNDatabase) Lookup(ip net.IP) uint32 {
+	if d == nil {
+		return 0
+	}
+	ip = ip.To16()
+	if ip == nil {
+		return 0
+	}
+	// The last range starting at or before ip
+	i := sort.Search(len(d.ranges), func(i int) bool {
+		return bytes.Compare(d.ranges[i].start, ip) > 0
+	}) - 1
+	if i < 0 || bytes.Compare(ip, d.ranges[i].end) > 0 {
+		return 0
+	}
+	return d.ranges[i].asn
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testASNTable = "1.0.0.0\t1.0.0.255\t13335\tUS\tCLOUDFLARENET\n" +
+	"1.0.1.0\t1.0.3.255\t0\tNone\tNot routed\n" +
+	"1.0.4.0\t1.0.7.255\t38803\tAU\tWPL-AS-AP\n" +
+	"2001:200::\t2001:200:ffff:ffff:ffff:ffff:ffff:ffff\t2500\tJP\tWIDE-BB\n"
+
+func TestASNDatabase(t *testing.T) {
+	db, err := ReadASNDatabase(strings.NewReader(testASNTable))
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(13335), db.Lookup(net.ParseIP("1.0.0.0")))
+	assert.Equal(t, uint32(13335), db.Lookup(net.ParseIP("1.0.0.255")))
+	assert.Equal(t, uint32(0), db.Lookup(net.ParseIP("1.0.2.1")))
+	assert.Equal(t, uint32(38803), db.Lookup(net.ParseIP("1.0.5.9")))
+	assert.Equal(t, uint32(0), db.Lookup(net.ParseIP("1.0.8.0")))
+	assert.Equal(t, uint32(0), db.Lookup(net.ParseIP("0.9.9.9")))
+	assert.Equal(t, uint32(2500), db.Lookup(net.ParseIP("2001:200::1")))
+
+	var nilDB *ASNDatabase
+	assert.Equal(t, uint32(0), nilDB.Lookup(net.ParseIP("1.0.0.1")))
+
+	_, err = ReadASNDatabase(strings.NewReader("1.0.0.0\tnope\t1\n"))
+	assert.Error(t, err)
+}
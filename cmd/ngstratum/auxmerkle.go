@@ -0,0 +1,71 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Bounds on the merge mining merkle tree search. Every size up to
+// auxMerkleMaxSize is tried with each nonce below auxMerkleNonceLimit before
+// giving up, so unlucky chain ids can't hang job creation
+const (
+	auxMerkleMaxSize    = 256
+	auxMerkleNonceLimit = 4096
+)
+
+// Where the merge mined chains sit in the merkle tree committed to in the
+// parent coinbase. Aux daemons work out the slot for their chain id from size
+// and nonce, so this is exactly what they'll check the branch against
+type AuxMerkleParams struct {
+	Size  uint32 `json:"size"`
+	Nonce uint32 `json:"nonce"`
+	// Slot by currency code
+	Slots map[string]uint32 `json:"slots"`
+}
+
+// The slot a chain id takes in a tree of size with nonce, as aux daemons
+// compute it (getExpectedIndex in namecoin's auxpow.cpp)
+func auxMerkleSlot(nonce uint32, chainID int, size uint32) uint32 {
+	slot := nonce
+	slot = slot*1103515245 + 12345
+	slot += uint32(chainID)
+	slot = slot*1103515245 + 12345
+	return slot % size
+}
+
+// Picks the smallest size, then the smallest nonce for it, that gives every
+// chain its own slot. The answer depends only on the chain ids, so stratums
+// with the same aux chains always commit to the same tree. chainIDs is by
+// currency code
+func findAuxMerkleParams(chainIDs map[string]int) (*AuxMerkleParams, error) {
+	seen := map[int]string{}
+	for code, id := range chainIDs {
+		if other, ok := seen[id]; ok {
+			return nil, errors.Errorf("%s and %s both have chain id %d",
+				code, other, id)
+		}
+		seen[id] = code
+	}
+	for size := uint32(1); size <= auxMerkleMaxSize; size *= 2 {
+		if int(size) < len(chainIDs) {
+			continue
+		}
+	Nonce:
+		for nonce := uint32(0); nonce < auxMerkleNonceLimit; nonce++ {
+			taken := make(map[uint32]bool, len(chainIDs))
+			for _, id := range chainIDs {
+				slot := auxMerkleSlot(nonce, id, size)
+				if taken[slot] {
+					continue Nonce
+				}
+				taken[slot] = true
+			}
+			params := &AuxMerkleParams{Size: size, Nonce: nonce, Slots: map[string]uint32{}}
+			for code, id := range chainIDs {
+				params.Slots[code] = auxMerkleSlot(nonce, id, size)
+			}
+			return params, nil
+		}
+	}
+	return nil, errors.Errorf("No merkle slots for %d aux chains within size %d and nonce %d",
+		len(chainIDs), auxMerkleMaxSize, auxMerkleNonceLimit)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindAuxMerkleParams(t *testing.T) {
+	params, err := findAuxMerkleParams(map[string]int{})
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1), params.Size)
+	assert.Equal(t, uint32(0), params.Nonce)
+
+	chainIDs := map[string]int{"NMC": 1, "SYS": 16, "HUC": 8, "EMC": 6, "XMY": 90}
+	params, err = findAuxMerkleParams(chainIDs)
+	assert.NoError(t, err)
+	taken := map[uint32]bool{}
+	for code, id := range chainIDs {
+		slot := auxMerkleSlot(params.Nonce, id, params.Size)
+		assert.Equal(t, slot, params.Slots[code])
+		assert.False(t, taken[slot])
+		taken[slot] = true
+	}
+	// Nothing smaller fits, so every stratum picks the same
+	collides := func(size, nonce uint32) bool {
+		taken := map[uint32]bool{}
+		for _, id := range chainIDs {
+			slot := auxMerkleSlot(nonce, id, size)
+			if taken[slot] {
+				return true
+			}
+			taken[slot] = true
+		}
+		return false
+	}
+	for size := uint32(1); size <= params.Size; size *= 2 {
+		for nonce := uint32(0); nonce < auxMerkleNonceLimit; nonce++ {
+			if size == params.Size && nonce == params.Nonce {
+				break
+			}
+			assert.True(t, collides(size, nonce))
+		}
+	}
+
+	// The same chain id twice can never fit
+	_, err = findAuxMerkleParams(map[string]int{"NMC": 1, "XNMC": 1})
+	assert.Error(t, err)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/seehuhn/sha256d"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/icook/ngpool/pkg/service"
+)
+
+// The root a branch leads to, the way aux daemons compute it
+// (CheckMerkleBranch in namecoin's auxpow.cpp)
+func checkMerkleBranch(hash []byte, branch [][]byte, mask uint32) []byte {
+	for _, other := range branch {
+		hsh := sha256d.New()
+		if mask&1 == 1 {
+			hsh.Write(other)
+			hsh.Write(hash)
+		} else {
+			hsh.Write(hash)
+			hsh.Write(other)
+		}
+		hash = hsh.Sum(nil)
+		mask >>= 1
+	}
+	return hash
+}
+
+func testLeaves(count int) [][]byte {
+	leaves := make([][]byte, count)
+	for i := range leaves {
+		hsh := sha256d.New()
+		hsh.Write([]byte{byte(i)})
+		leaves[i] = hsh.Sum(nil)
+	}
+	return leaves
+}
+
+func TestMerkleBranchAt(t *testing.T) {
+	for count := 1; count <= 9; count++ {
+		leaves := testLeaves(count)
+		root := merkleRoot(leaves)
+		for index := 0; index < count; index++ {
+			branch, mask := merkleBranchAt(leaves, uint32(index))
+			assert.Equal(t, uint32(index), mask, "leaves=%d index=%d", count, index)
+			assert.Equal(t, root, checkMerkleBranch(leaves[index], branch, mask),
+				"leaves=%d index=%d", count, index)
+		}
+	}
+}
+
+// Builds a parent block with txCount transactions around an aux block and
+// reads the AuxPoW back out of it, checking the parent coinbase branch leads
+// to the parent header's merkle root and the chain branch to the merge mining
+// root
+func TestAuxPoWBranches(t *testing.T) {
+	for _, txCount := range []int{0, 1, 2, 4, 5} {
+		t.Run(fmt.Sprintf("txs=%d", txCount), func(t *testing.T) {
+			tmpl := BlockTemplate{}
+			for _, txid := range testLeaves(txCount) {
+				tmpl.Transactions = append(tmpl.Transactions,
+					GBTTransaction{Hash: fmt.Sprintf("%x", txid)})
+			}
+			coinbase := wire.NewMsgTx(1)
+			coinbase.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{}, 0xffffffff),
+				[]byte{0x01, 0x02}, nil))
+			coinbase.AddTxOut(wire.NewTxOut(5000000000, []byte{0x51}))
+			var coinbaseRaw bytes.Buffer
+			assert.NoError(t, coinbase.Serialize(&coinbaseRaw))
+			coinbaseHash := coinbase.TxHash()
+
+			parentHeader := make([]byte, 80)
+			copy(parentHeader[36:68], tmpl.merkleRoot(coinbaseHash[:]))
+
+			chains := testLeaves(3)
+			aux := &AuxChainJob{blockHeader: make([]byte, 80)}
+			aux.blockchainMerkleBranch, aux.blockchainMerkleMask = merkleBranchAt(chains, 2)
+			block := bytes.NewReader(aux.GetBlock(coinbaseRaw.Bytes(), make([]byte, 32),
+				tmpl.merkleBranch(), parentHeader))
+
+			block.Seek(80, 0)
+			var decoded wire.MsgTx
+			assert.NoError(t, decoded.Deserialize(block))
+			block.Seek(32, 1)
+			readBranch := func() ([][]byte, uint32) {
+				count, err := wire.ReadVarInt(block, 0)
+				assert.NoError(t, err)
+				branch := make([][]byte, count)
+				for i := range branch {
+					branch[i] = make([]byte, 32)
+					block.Read(branch[i])
+				}
+				var mask uint32
+				assert.NoError(t, binary.Read(block, binary.LittleEndian, &mask))
+				return branch, mask
+			}
+			branch, mask := readBranch()
+			assert.Equal(t, uint32(0), mask)
+			decodedHash := decoded.TxHash()
+			assert.Equal(t, parentHeader[36:68], checkMerkleBranch(decodedHash[:], branch, mask))
+
+			branch, mask = readBranch()
+			assert.Equal(t, uint32(2), mask)
+			assert.Equal(t, merkleRoot(chains), checkMerkleBranch(chains[2], branch, mask))
+		})
+	}
+}
+
+// createauxblock work merge mined under a main chain. A solve is only the
+// AuxPoW, submitted under the node's hash
+func TestAuxBlockJob(t *testing.T) {
+	templates, algo := benchTemplates(t, 2)
+	auxConfig, _ := service.Currency("BENCH_T")
+	service.RegisterCurrency(&service.ChainConfig{
+		Code:                "AUXB_T",
+		Params:              auxConfig.Params,
+		BlockSubsidyAddress: auxConfig.BlockSubsidyAddress,
+	})
+	auxHash := fmt.Sprintf("%064x", 0xabcdef)
+	templates[TemplateKey{Currency: "AUXB_T", Algo: "sha256d", TemplateType: "createauxblock"}] =
+		[]byte(`{"height": 50, "coinbasevalue": 1000, "previousblockhash": "` +
+			fmt.Sprintf("%064x", 2) + `", "bits": "207fffff", "auxblockhash": "` + auxHash +
+			`", "extras": {"chainid": 7}}`)
+	job, err := NewJobFromTemplates(templates, algo, nil)
+	assert.NoError(t, err)
+	if !assert.Len(t, job.auxChains, 1) {
+		return
+	}
+	aux := job.auxChains[0]
+	assert.Equal(t, auxHash, aux.headerHash.String())
+	assert.Equal(t, int64(1000), aux.subsidy)
+
+	aux.target = new(big.Int).Lsh(big.NewInt(1), 256)
+	blocks, _, _, _, err := job.CheckSolves([]byte{0, 0, 0, 0}, make([]byte, extranonceSize), nil, nil)
+	assert.NoError(t, err)
+	block := blocks["AUXB_T"]
+	if !assert.NotNil(t, block) {
+		return
+	}
+	assert.Equal(t, auxHash, block.auxBlockHash)
+	assert.Nil(t, block.coinbaseHash)
+	hash, _ := chainhash.NewHashFromStr(auxHash)
+	assert.Equal(t, hex.EncodeToString(hash[:]), block.getBlockHash())
+
+	// The AuxPoW ends with the parent header, there's no aux block after it
+	var coinbase wire.MsgTx
+	assert.NoError(t, coinbase.Deserialize(bytes.NewReader(block.data)))
+	assert.Equal(t, job.GetBlockHeader([]byte{0, 0, 0, 0}, coinbase.TxHash().CloneBytes()),
+		block.data[len(block.data)-80:])
+}
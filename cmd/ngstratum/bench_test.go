@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil"
+	"github.com/icook/ngpool/pkg/common"
+	"github.com/icook/ngpool/pkg/service"
+)
+
+// Benchmarks for the paths every job and every share go through. bench.sh
+// runs them and compares against a saved baseline
+
+// A template paying to a testnet address, with txCount transactions of about
+// 250 bytes each. Bits are mainnet difficulty 1, so shares hashed against it
+// practically never solve a block
+func benchTemplates(b testing.TB, txCount int) (map[TemplateKey][]byte, *service.Algo) {
+	params := &chaincfg.TestNet3Params
+	subsidyAddr, err := btcutil.DecodeAddress("mucHkBoHAF8DTQWFuwQXHiewqi3ZBDNNWh", params)
+	if err != nil {
+		b.Fatal(err)
+	}
+	common.RegisterAddressCodec("BENCH_T", &common.Base58Codec{Params: params})
+	service.RegisterCurrency(&service.ChainConfig{
+		Code:                "BENCH_T",
+		Params:              params,
+		BlockSubsidyAddress: &subsidyAddr,
+	})
+
+	txs := make([]map[string]interface{}, txCount)
+	for i := range txs {
+		data := make([]byte, 250)
+		data[0] = byte(i)
+		data[1] = byte(i >> 8)
+		txid := make([]byte, 32)
+		txid[0] = byte(i)
+		txid[1] = byte(i >> 8)
+		txs[i] = map[string]interface{}{
+			"data": hex.EncodeToString(data),
+			"txid": hex.EncodeToString(txid),
+			"hash": hex.EncodeToString(txid),
+			"fee":  1000,
+		}
+	}
+	raw, err := json.Marshal(map[string]interface{}{
+		"version":           0x20000000,
+		"previousblockhash": fmt.Sprintf("%064x", 1),
+		"transactions":      txs,
+		"coinbasevalue":     5000000000 + 1000*txCount,
+		"bits":              "1d00ffff",
+		"curtime":           1500000000,
+		"height":            1000,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	key := TemplateKey{Currency: "BENCH_T", Algo: "sha256d", TemplateType: "getblocktemplate"}
+	return map[TemplateKey][]byte{key: raw}, service.AlgoConfig["sha256d"]
+}
+
+func benchJob(b testing.TB, txCount int) *Job {
+	templates, algo := benchTemplates(b, txCount)
+	job, err := NewJobFromTemplates(templates, algo, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return job
+}
+
+func BenchmarkNewJobFromTemplates(b *testing.B) {
+	for _, txCount := range []int{0, 500, 3000} {
+		b.Run(fmt.Sprintf("txs=%d", txCount), func(b *testing.B) {
+			templates, algo := benchTemplates(b, txCount)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := NewJobFromTemplates(templates, algo, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGetBlockHeader(b *testing.B) {
+	job := benchJob(b, 3000)
+	nonce := make([]byte, 4)
+	coinbaseHash := make([]byte, 32)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		job.GetBlockHeader(nonce, coinbaseHash)
+	}
+}
+
+// The whole share check: coinbase with the miner's extranonce, merkle root,
+// header and PoW hash
+func BenchmarkCheckSolves(b *testing.B) {
+	job := benchJob(b, 3000)
+	nonce := make([]byte, 4)
+	extranonce := make([]byte, extranonceSize)
+	shareTarget := job.algo.ShareTarget(1)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		nonce[0] = byte(i)
+		nonce[1] = byte(i >> 8)
+		_, _, _, _, err := job.CheckSolves(nonce, extranonce, nil, shareTarget)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// CheckSolves over a session's reused buffers, what checkShare does
+func BenchmarkCheckSolvesFast(b *testing.B) {
+	job := benchJob(b, 3000)
+	nonce := make([]byte, 4)
+	extranonce := make([]byte, extranonceSize)
+	shareTarget := job.algo.ShareTarget(1)
+	var scratch shareScratch
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		nonce[0] = byte(i)
+		nonce[1] = byte(i >> 8)
+		_, _, _, _, err := job.CheckSolvesFast(&scratch, nonce, extranonce, nil, shareTarget)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Serializing a new job's mining.notify, done once per job
+func BenchmarkNotifySerialize(b *testing.B) {
+	job := benchJob(b, 3000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fresh := &Job{MainChainJob: job.MainChainJob}
+		if _, err := fresh.notifyTail(true); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Building each client's mining.notify from the shared tail, done for every
+// client on every job
+func BenchmarkNotifyBroadcast(b *testing.B) {
+	job := benchJob(b, 3000)
+	jids := make([]string, 1000)
+	for i := range jids {
+		jids[i] = fmt.Sprintf("%08x", i)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tail, err := job.notifyTail(false)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, jid := range jids {
+			_ = append(notifyHead(jid), tail...)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+)
+
+// How work is presented to JSON-RPC 2.0 (login mode) miners. Rather than
+// building the header themselves, these miners are handed a blob to hash.
+// They write a nonce into it at a fixed offset and send back the nonce along
+// with the hash they got
+type BlobFormat struct {
+	Name string
+	// Builds the blob for a job with the nonce zeroed. The session's
+	// extranonce must be mixed in, so each session's work is unique
+	Blob        func(j *Job, extranonce []byte) ([]byte, error)
+	NonceOffset int
+	NonceSize   int
+	// Hashes a blob with the nonce filled in, for checking the result the
+	// miner sent
+	Hash func(j *Job, blob []byte) ([]byte, error)
+}
+
+// Keyed by name, selected with the BlobFormat config key. Chains whose work
+// isn't a bitcoin style header (Cryptonote) register their own in init
+var BlobFormats = map[string]*BlobFormat{}
+
+func RegisterBlobFormat(format *BlobFormat) {
+	BlobFormats[format.Name] = format
+}
+
+// Copies the blob with the nonce written in
+func (f *BlobFormat) withNonce(blob []byte, nonce []byte) ([]byte, error) {
+	if len(nonce) != f.NonceSize {
+		return nil, errors.Errorf("Nonce must be %d bytes, got %d", f.NonceSize, len(nonce))
+	}
+	if len(blob) < f.NonceOffset+f.NonceSize {
+		return nil, errors.Errorf("Blob too short for nonce, %d bytes", len(blob))
+	}
+	out := make([]byte, len(blob))
+	copy(out, blob)
+	copy(out[f.NonceOffset:], nonce)
+	return out, nil
+}
+
+// Checks the hash a miner sent for a nonce. Miners that don't send a result
+// are let through, the share is checked either way
+func (f *BlobFormat) checkResult(j *Job, extranonce []byte, nonce []byte, result []byte) error {
+	blob, err := f.Blob(j, extranonce)
+	if err != nil {
+		return err
+	}
+	blob, err = f.withNonce(blob, nonce)
+	if err != nil {
+		return err
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	hsh, err := f.Hash(j, blob)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(hsh, result) {
+		return errors.New("Result doesn't match hash")
+	}
+	return nil
+}
+
+func init() {
+	// The block header itself, nonce last. This is what the jobs we build
+	// from getblocktemplate hash, so shares are checked as usual
+	RegisterBlobFormat(&BlobFormat{
+		Name: "header",
+		Blob: func(j *Job, extranonce []byte) ([]byte, error) {
+			coinbase := bytes.Buffer{}
+			coinbase.Write(j.coinbase1)
+			coinbase.Write(extranonce)
+			coinbase.Write(j.coinbase2)
+
+			hasher := getHasher()
+			defer putHasher(hasher)
+			hasher.Write(coinbase.Bytes())
+			return j.GetBlockHeader([]byte{0, 0, 0, 0}, hasher.Sum(nil)), nil
+		},
+		NonceOffset: 76,
+		NonceSize:   4,
+		Hash: func(j *Job, blob []byte) ([]byte, error) {
+			return j.algo.PoWHash(blob)
+		},
+	})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlobFormatCheckResult(t *testing.T) {
+	// A Cryptonote style blob, nonce in the middle
+	format := &BlobFormat{
+		Name: "test",
+		Blob: func(j *Job, extranonce []byte) ([]byte, error) {
+			blob := make([]byte, 76)
+			copy(blob[60:], extranonce)
+			return blob, nil
+		},
+		NonceOffset: 39,
+		NonceSize:   4,
+		Hash: func(j *Job, blob []byte) ([]byte, error) {
+			hsh := sha256.Sum256(blob)
+			return hsh[:], nil
+		},
+	}
+	extranonce := stratum2Extranonce([]byte{1, 2, 3, 4})
+	nonce := []byte{0xde, 0xad, 0xbe, 0xef}
+
+	blob, _ := format.Blob(nil, extranonce)
+	filled, err := format.withNonce(blob, nonce)
+	assert.NoError(t, err)
+	assert.Equal(t, nonce, filled[39:43])
+	assert.Equal(t, make([]byte, 4), blob[39:43], "original blob is untouched")
+
+	result, _ := format.Hash(nil, filled)
+	assert.NoError(t, format.checkResult(nil, extranonce, nonce, result))
+	// Results are optional
+	assert.NoError(t, format.checkResult(nil, extranonce, nonce, nil))
+	// Hash of another session's work
+	assert.Error(t, format.checkResult(nil, stratum2Extranonce([]byte{4, 3, 2, 1}), nonce, result))
+	assert.Error(t, format.checkResult(nil, extranonce, []byte{1, 2}, result))
+}
+
+func TestDecodeMiningSubmit2(t *testing.T) {
+	ms, err := DecodeMiningSubmit2(map[string]interface{}{
+		"id":     "52fdfc07",
+		"job_id": "2182654f",
+		"nonce":  "21000000",
+		"result": "726b7baca682d535",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "2182654f", ms.JobID)
+	assert.Equal(t, []byte{0x21, 0, 0, 0}, ms.Nonce)
+	assert.Equal(t, []byte{0x72, 0x6b, 0x7b, 0xac, 0xa6, 0x82, 0xd5, 0x35}, ms.Result)
+	// Filled in by the client, which knows its extranonce2 size
+	assert.Nil(t, ms.Extranonce2)
+
+	_, err = DecodeMiningSubmit2(map[string]interface{}{"nonce": "zz"})
+	assert.Error(t, err)
+}
+
+func TestGetTargetHexLowDiff(t *testing.T) {
+	assert.Equal(t, GetTargetHex(1), GetTargetHex(0))
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"github.com/icook/ngpool/pkg/blockarchive"
+)
+
+// BlockArchive writes each block candidate to a blockarchive.Store as it's
+// submitted. Coinservers answer afterwards, so the most recent blocks are
+// kept to be written again with each answer
+type BlockArchive struct {
+	store  *blockarchive.Store
+	recent []*blockarchive.Record
+	// Records in flight to disk, for Wait
+	writes sync.WaitGroup
+	mtx    sync.Mutex
+}
+
+func NewBlockArchive(store *blockarchive.Store) *BlockArchive {
+	return &BlockArchive{store: store}
+}
+
+// Archives a block that's about to be submitted. share is nil for the
+// built in CPU miner. The encoding and disk write happen in the background,
+// so submission isn't held up
+func (a *BlockArchive) Add(currency string, block *BlockSolve, share *Share, now time.Time) {
+	rec := &blockarchive.Record{
+		Version:     blockarchive.FormatVersion,
+		Currency:    currency,
+		Height:      block.height,
+		Hash:        block.getBlockHash(),
+		PowAlgo:     block.powalgo,
+		SubmittedAt: now,
+		Responses:   map[string]*blockarchive.Response{},
+	}
+	if block.powhash != nil {
+		rec.PowHash = fmt.Sprintf("%064x", block.powhash)
+	}
+	if block.target != nil {
+		rec.Target = fmt.Sprintf("%064x", block.target)
+	}
+	if share != nil {
+		rec.Share = &blockarchive.Share{
+			Username:   share.username,
+			Worker:     share.worker,
+			Difficulty: share.difficulty,
+			MinedAt:    share.time,
+			BlockRatio: share.blockRatio,
+		}
+	}
+	a.mtx.Lock()
+	a.recent = append(a.recent, rec)
+	if len(a.recent) > blockSubmitKeep {
+		a.recent = a.recent[len(a.recent)-blockSubmitKeep:]
+	}
+	a.mtx.Unlock()
+
+	a.writes.Add(1)
+	go func() {
+		defer a.writes.Done()
+		a.mtx.Lock()
+		rec.Block = hex.EncodeToString(block.data)
+		if block.rawTemplate != nil {
+			rec.Template = json.RawMessage(block.rawTemplate)
+		}
+		a.write(rec)
+		a.mtx.Unlock()
+
+		removed, err := a.store.Prune(now)
+		if err != nil {
+			log.Warn("Failed pruning block archive", "err", err)
+		} else if removed > 0 {
+			log.Debug("Pruned block archive", "removed", removed)
+		}
+	}()
+}
+
+// Records a coinserver's answer to submitblock, like SubmitTracker.Result
+func (a *BlockArchive) Result(currency string, hash string, source string,
+	reason string, err error, now time.Time) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	for i := len(a.recent) - 1; i >= 0; i-- {
+		rec := a.recent[i]
+		if rec.Currency != currency || rec.Hash != hash {
+			continue
+		}
+		res := &blockarchive.Response{
+			Result:    submitResult(reason, err),
+			Reason:    reason,
+			LatencyMS: int64(now.Sub(rec.SubmittedAt) / time.Millisecond),
+		}
+		if err != nil {
+			res.Reason = err.Error()
+		}
+		rec.Responses[source] = res
+		// Not encoded yet means Add's write is still to come, and it'll
+		// include this
+		if rec.Block != "" {
+			a.write(rec)
+		}
+		return
+	}
+}
+
+// Called holding mtx
+func (a *BlockArchive) write(rec *blockarchive.Record) {
+	if err := a.store.Write(rec); err != nil {
+		log.Error("Failed archiving block", "hash", rec.Hash, "err", err)
+	}
+}
+
+// Waits for blocks being archived to reach disk
+func (a *BlockArchive) Wait() {
+	a.writes.Wait()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/icook/ngpool/pkg/blockarchive"
+)
+
+func TestBlockArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blockarchive")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := blockarchive.NewStore(dir, 0, 0)
+	assert.NoError(t, err)
+	archive := NewBlockArchive(store)
+
+	now := time.Unix(1500000000, 0).UTC()
+	block := &BlockSolve{
+		data:    make([]byte, 81),
+		height:  5,
+		powalgo: "sha256d",
+		powhash: big.NewInt(0xff),
+		target:  big.NewInt(0xffff),
+		// Fields BlockTemplate doesn't decode are kept
+		rawTemplate: []byte(`{"height":5,"bits":"207fffff","mweb":"01"}`),
+	}
+	share := &Share{username: "user", worker: "rig", difficulty: 16, time: now}
+	archive.Add("BTC", block, share, now)
+	hash := block.getBlockHash()
+	archive.Result("BTC", hash, "cs1", "bad-txnmrklroot", nil, now.Add(time.Second))
+	archive.Wait()
+	archive.Result("BTC", hash, "cs2", "", errors.New("timeout"), now.Add(time.Second*2))
+	// Not one of ours
+	archive.Result("LTC", hash, "cs3", "", nil, now)
+
+	rec, err := blockarchive.Load(filepath.Join(dir, hash+".json.gz"))
+	assert.NoError(t, err)
+	assert.Equal(t, "BTC", rec.Currency)
+	assert.EqualValues(t, 5, rec.Height)
+	assert.Equal(t, hex.EncodeToString(block.data), rec.Block)
+	assert.Equal(t, "00000000000000000000000000000000000000000000000000000000000000ff", rec.PowHash)
+	assert.JSONEq(t, `{"height":5,"bits":"207fffff","mweb":"01"}`, string(rec.Template))
+	assert.Equal(t, &blockarchive.Share{Username: "user", Worker: "rig",
+		Difficulty: 16, MinedAt: now}, rec.Share)
+	assert.Equal(t, map[string]*blockarchive.Response{
+		"cs1": {Result: submitRejected, Reason: "bad-txnmrklroot", LatencyMS: 1000},
+		"cs2": {Result: submitError, Reason: "timeout", LatencyMS: 2000},
+	}, rec.Responses)
+
+	// CPU miner blocks have no share
+	cpuBlock := &BlockSolve{data: make([]byte, 80), height: 6}
+	cpuBlock.data[0] = 1
+	archive.Add("BTC", cpuBlock, nil, now)
+	archive.Wait()
+	rec, err = blockarchive.Load(filepath.Join(dir, cpuBlock.getBlockHash()+".json.gz"))
+	assert.NoError(t, err)
+	assert.Nil(t, rec.Share)
+	assert.Empty(t, rec.Responses)
+}
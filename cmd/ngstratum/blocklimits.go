@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/pkg/errors"
+)
+
+// Room left in aux chain blocks for the AuxPoW: the parent coinbase, its
+// merkle branch, the aux chain merkle branch and the parent header. The
+// daemon doesn't know about any of it when filling the template
+const auxPowReserve = 2000
+
+// What a block, or a part of one, counts against the template's limits
+type blockUsage struct {
+	size   int64
+	weight int64
+	sigOps int64
+}
+
+func (u *blockUsage) add(o blockUsage) {
+	u.size += o.size
+	u.weight += o.weight
+	u.sigOps += o.sigOps
+}
+
+func (u *blockUsage) sub(o blockUsage) {
+	u.size -= o.size
+	u.weight -= o.weight
+	u.sigOps -= o.sigOps
+}
+
+// Once segwit is active sigops are counted as cost, legacy sigops weighing
+// four each, and that's what the template's sigops and sigoplimit are in
+func (b *BlockTemplate) segwit() bool {
+	for _, rule := range b.Rules {
+		if rule == "segwit" || rule == "!segwit" {
+			return true
+		}
+	}
+	return false
+}
+
+// Weight is only given by segwit aware daemons. Without it there's no
+// witness data, so it's four times the size
+func (t *GBTTransaction) usage() blockUsage {
+	size := int64(len(t.Data) / 2)
+	weight := t.Weight
+	if weight == 0 {
+		weight = size * blockchain.WitnessScaleFactor
+	}
+	return blockUsage{size: size, weight: weight, sigOps: t.SigOps}
+}
+
+// The coinbase has no witness data of ours, and its sigops are all legacy:
+// one for each P2PKH output
+func coinbaseUsage(raw []byte, segwit bool) (blockUsage, error) {
+	var tx wire.MsgTx
+	err := tx.Deserialize(bytes.NewReader(raw))
+	if err != nil {
+		return blockUsage{}, err
+	}
+	var sigOps int64
+	for _, in := range tx.TxIn {
+		sigOps += int64(txscript.GetSigOpCount(in.SignatureScript))
+	}
+	for _, out := range tx.TxOut {
+		sigOps += int64(txscript.GetSigOpCount(out.PkScript))
+	}
+	if segwit {
+		sigOps *= blockchain.WitnessScaleFactor
+	}
+	size := int64(len(raw))
+	return blockUsage{
+		size:   size,
+		weight: size * blockchain.WitnessScaleFactor,
+		sigOps: sigOps,
+	}, nil
+}
+
+// Whether usage is within every limit the template gave. Daemons that don't
+// report a limit leave it zero, and it isn't checked
+func (b *BlockTemplate) withinLimits(u blockUsage) bool {
+	return (b.SizeLimit <= 0 || u.size <= b.SizeLimit) &&
+		(b.WeightLimit <= 0 || u.weight <= b.WeightLimit) &&
+		(b.SigOpLimit <= 0 || u.sigOps <= b.SigOpLimit)
+}
+
+// Makes sure the block built from the template with this coinbase fits the
+// size, weight and sigop limits. The daemon leaves room for a small coinbase,
+// but ours can be bigger with payout splits, masternode payments and a long
+// tag. If it doesn't fit, transactions are dropped lowest fee rate first,
+// along with anything spending them, and their fees come off CoinbaseValue.
+// overhead is anything else in the block, in bytes. Returns how many
+// transactions were dropped
+func (b *BlockTemplate) fitLimits(coinbase []byte, overhead int64) (int, error) {
+	cbUsage, err := coinbaseUsage(coinbase, b.segwit())
+	if err != nil {
+		return 0, errors.Wrap(err, "Invalid coinbase")
+	}
+	total := blockUsage{
+		// The transaction count can only shrink, so its current size is an
+		// upper bound
+		size: int64(wire.MaxBlockHeaderPayload+
+			wire.VarIntSerializeSize(uint64(len(b.Transactions)+1))) + overhead,
+	}
+	total.weight = total.size * blockchain.WitnessScaleFactor
+	total.add(cbUsage)
+	usages := make([]blockUsage, len(b.Transactions))
+	for i := range b.Transactions {
+		usages[i] = b.Transactions[i].usage()
+		total.add(usages[i])
+	}
+	if b.withinLimits(total) {
+		return 0, nil
+	}
+
+	// Depends are 1 based indexes of earlier transactions in the template
+	dependents := make([][]int, len(b.Transactions))
+	for i, tx := range b.Transactions {
+		for _, dep := range tx.Depends {
+			if dep >= 1 && int(dep) <= len(b.Transactions) {
+				dependents[dep-1] = append(dependents[dep-1], i)
+			}
+		}
+	}
+	order := make([]int, len(b.Transactions))
+	for i := range order {
+		order[i] = i
+	}
+	feeRate := func(i int) float64 {
+		return float64(b.Transactions[i].Fee) / float64(usages[i].weight+1)
+	}
+	sort.SliceStable(order, func(x, y int) bool {
+		return feeRate(order[x]) < feeRate(order[y])
+	})
+
+	dropped := make([]bool, len(b.Transactions))
+	var droppedFees int64
+	var drop func(int)
+	drop = func(i int) {
+		if dropped[i] {
+			return
+		}
+		dropped[i] = true
+		total.sub(usages[i])
+		droppedFees += b.Transactions[i].Fee
+		for _, dependent := range dependents[i] {
+			drop(dependent)
+		}
+	}
+	for _, i := range order {
+		if b.withinLimits(total) {
+			break
+		}
+		drop(i)
+	}
+	if !b.withinLimits(total) {
+		return 0, errors.Errorf(
+			"Block with no transactions is over limits: size %d, weight %d, sigops %d",
+			total.size, total.weight, total.sigOps)
+	}
+
+	// Keep the template's order, since transactions must come after those
+	// they spend, and renumber Depends to match
+	newIndex := make([]int64, len(b.Transactions))
+	var kept []GBTTransaction
+	for i, tx := range b.Transactions {
+		if dropped[i] {
+			continue
+		}
+		kept = append(kept, tx)
+		newIndex[i] = int64(len(kept))
+	}
+	for i := range kept {
+		depends := make([]int64, 0, len(kept[i].Depends))
+		for _, dep := range kept[i].Depends {
+			if dep >= 1 && int(dep) <= len(newIndex) {
+				depends = append(depends, newIndex[dep-1])
+			}
+		}
+		kept[i].Depends = depends
+	}
+	count := len(b.Transactions) - len(kept)
+	b.Transactions = kept
+	b.CoinbaseValue -= droppedFees
+	return count, nil
+}
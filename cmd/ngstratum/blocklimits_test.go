@@ -0,0 +1,112 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil"
+	"github.com/icook/ngpool/pkg/common"
+	"github.com/icook/ngpool/pkg/service"
+	"github.com/stretchr/testify/assert"
+)
+
+func limitsTestCoinbase(t *testing.T, tmpl *BlockTemplate) []byte {
+	params := &chaincfg.TestNet3Params
+	subsidyAddr, _ := btcutil.DecodeAddress("mucHkBoHAF8DTQWFuwQXHiewqi3ZBDNNWh", params)
+	common.RegisterAddressCodec("LTC_T", &common.Base58Codec{Params: params})
+	config := &service.ChainConfig{
+		Code:                "LTC_T",
+		Params:              params,
+		BlockSubsidyAddress: &subsidyAddr,
+	}
+	coinbase, err := tmpl.createCoinbase(config, make([]byte, extranonceSize))
+	assert.NoError(t, err)
+	return coinbase
+}
+
+func limitsTestTx(size int, fee int64, depends ...int64) GBTTransaction {
+	return GBTTransaction{
+		Data:    strings.Repeat("00", size),
+		Fee:     fee,
+		SigOps:  1,
+		Depends: depends,
+	}
+}
+
+func TestFitLimits(t *testing.T) {
+	tmpl := &BlockTemplate{
+		Height:        1000,
+		CoinbaseValue: 5000000000,
+		Transactions: []GBTTransaction{
+			limitsTestTx(1000, 5000),
+			// Cheapest, and takes the transaction spending it along
+			limitsTestTx(1000, 1000),
+			limitsTestTx(1000, 10000, 2),
+			limitsTestTx(1000, 4000),
+			limitsTestTx(1000, 20000, 4),
+		},
+	}
+	coinbase := limitsTestCoinbase(t, tmpl)
+
+	// No limits from the daemon, nothing to enforce
+	dropped, err := tmpl.fitLimits(coinbase, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, dropped)
+
+	// Header and transaction count are 81 bytes
+	tmpl.SizeLimit = int64(81 + len(coinbase) + 3000)
+	dropped, err = tmpl.fitLimits(coinbase, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, dropped)
+	assert.Equal(t, int64(5000000000-11000), tmpl.CoinbaseValue)
+	assert.Equal(t, []int64{5000, 4000, 20000}, []int64{
+		tmpl.Transactions[0].Fee, tmpl.Transactions[1].Fee, tmpl.Transactions[2].Fee})
+	// Renumbered to the spent transaction's new place
+	assert.Equal(t, []int64{2}, tmpl.Transactions[2].Depends)
+
+	// Fits now, so nothing more goes
+	dropped, err = tmpl.fitLimits(coinbase, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, dropped)
+
+	// Room for the AuxPoW pushes it back over
+	dropped, err = tmpl.fitLimits(coinbase, 500)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, dropped)
+	assert.Equal(t, int64(5000000000-35000), tmpl.CoinbaseValue)
+
+	tmpl.SizeLimit = int64(len(coinbase))
+	_, err = tmpl.fitLimits(coinbase, 0)
+	assert.Error(t, err)
+}
+
+func TestFitLimitsSigOps(t *testing.T) {
+	tmpl := &BlockTemplate{
+		Height:        1000,
+		CoinbaseValue: 5000000000,
+		Transactions: []GBTTransaction{
+			limitsTestTx(200, 3000),
+			limitsTestTx(200, 2000),
+			limitsTestTx(200, 1000),
+		},
+	}
+	coinbase := limitsTestCoinbase(t, tmpl)
+
+	// The coinbase's P2PKH output is a sigop too
+	tmpl.SigOpLimit = 3
+	dropped, err := tmpl.fitLimits(coinbase, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, dropped)
+	assert.Len(t, tmpl.Transactions, 2)
+	assert.Equal(t, int64(5000000000-1000), tmpl.CoinbaseValue)
+
+	// With segwit both are counted as cost, four per legacy sigop
+	tmpl.Rules = []string{"csv", "!segwit"}
+	tmpl.SigOpLimit = 8
+	tmpl.Transactions[0].SigOps = 4
+	tmpl.Transactions[1].SigOps = 4
+	dropped, err = tmpl.fitLimits(coinbase, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, dropped)
+}
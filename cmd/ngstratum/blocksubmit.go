@@ -0,0 +1,168 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// Results a coinserver can give for a block submission
+const (
+	submitPending  = "pending"
+	submitAccepted = "accepted"
+	submitRejected = "rejected"
+	// The RPC call itself failed, so we don't know what the node thinks
+	submitError = "error"
+	// Never answered within blockSubmitTimeout
+	submitNoResponse = "no_response"
+)
+
+// How long a coinserver gets to answer a submitblock before it's reported as
+// not responding
+const blockSubmitTimeout = time.Minute
+
+// Submissions kept for the status
+const blockSubmitKeep = 20
+
+type SubmitResult struct {
+	Result string `json:"result"`
+	Reason string `json:"reason,omitempty"`
+	// Milliseconds from handing the block out to getting an answer
+	LatencyMS int64 `json:"latency_ms"`
+}
+
+type BlockSubmission struct {
+	Currency    string    `json:"currency"`
+	Height      int64     `json:"height"`
+	Hash        string    `json:"hash"`
+	SubmittedAt time.Time `json:"submitted_at"`
+	// The coinserver that accepted the block first, "" until one does
+	FirstAccepted string `json:"first_accepted"`
+	// Set when one coinserver accepted the block and another rejected it,
+	// which means they aren't following the same chain or rules
+	Inconsistent bool                     `json:"inconsistent"`
+	Results      map[string]*SubmitResult `json:"results"`
+}
+
+// SubmitTracker follows a solved block as it's submitted to every coinserver
+// of its currency at once. Whichever node accepts first has the best chance
+// of getting it out before a competing block, so that's recorded, and nodes
+// answering differently are flagged since one of them is forked or broken
+type SubmitTracker struct {
+	submissions []*BlockSubmission
+	mtx         sync.Mutex
+}
+
+func NewSubmitTracker() *SubmitTracker {
+	return &SubmitTracker{}
+}
+
+// Records a block about to be submitted to sources
+func (t *SubmitTracker) Start(currency string, hash string, height int64,
+	sources []string, now time.Time) {
+	sub := &BlockSubmission{
+		Currency:    currency,
+		Height:      height,
+		Hash:        hash,
+		SubmittedAt: now,
+		Results:     map[string]*SubmitResult{},
+	}
+	for _, source := range sources {
+		sub.Results[source] = &SubmitResult{Result: submitPending}
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.submissions = append(t.submissions, sub)
+	if len(t.submissions) > blockSubmitKeep {
+		t.submissions = t.submissions[len(t.submissions)-blockSubmitKeep:]
+	}
+}
+
+// A "duplicate" answer means the node already had the block, normally
+// because another node we submitted to relayed it first. That's as good as
+// accepting it
+func submitResult(reason string, err error) string {
+	switch {
+	case err != nil:
+		return submitError
+	case reason == "" || reason == "duplicate":
+		return submitAccepted
+	default:
+		return submitRejected
+	}
+}
+
+// Records a coinserver's answer to submitblock
+func (t *SubmitTracker) Result(currency string, hash string, source string,
+	reason string, err error, now time.Time) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	var sub *BlockSubmission
+	for i := len(t.submissions) - 1; i >= 0; i-- {
+		if t.submissions[i].Currency == currency && t.submissions[i].Hash == hash {
+			sub = t.submissions[i]
+			break
+		}
+	}
+	if sub == nil {
+		return
+	}
+	res := &SubmitResult{
+		Result:    submitResult(reason, err),
+		Reason:    reason,
+		LatencyMS: int64(now.Sub(sub.SubmittedAt) / time.Millisecond),
+	}
+	if err != nil {
+		res.Reason = err.Error()
+	}
+	sub.Results[source] = res
+
+	if res.Result == submitAccepted && reason == "" && sub.FirstAccepted == "" {
+		sub.FirstAccepted = source
+		log.Info("Block accepted", "currency", currency, "height", sub.Height,
+			"hash", hash, "coinserver", source, "latency_ms", res.LatencyMS)
+	}
+	if sub.Inconsistent {
+		return
+	}
+	var accepted, rejected []string
+	for src, other := range sub.Results {
+		switch other.Result {
+		case submitAccepted:
+			accepted = append(accepted, src)
+		case submitRejected:
+			rejected = append(rejected, src)
+		}
+	}
+	if len(accepted) > 0 && len(rejected) > 0 {
+		sub.Inconsistent = true
+		sort.Strings(accepted)
+		sort.Strings(rejected)
+		log.Error("Coinservers disagree on a block, a node may be forked",
+			"currency", currency, "height", sub.Height, "hash", hash,
+			"accepted", accepted, "rejected", rejected)
+	}
+}
+
+// Recent submissions, newest first. Coinservers still pending past
+// blockSubmitTimeout are shown as not responding
+func (t *SubmitTracker) Status(now time.Time) []*BlockSubmission {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	ret := []*BlockSubmission{}
+	for i := len(t.submissions) - 1; i >= 0; i-- {
+		sub := *t.submissions[i]
+		sub.Results = map[string]*SubmitResult{}
+		for source, res := range t.submissions[i].Results {
+			cp := *res
+			if cp.Result == submitPending && now.Sub(sub.SubmittedAt) > blockSubmitTimeout {
+				cp.Result = submitNoResponse
+			}
+			sub.Results[source] = &cp
+		}
+		ret = append(ret, &sub)
+	}
+	return ret
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubmitTracker(t *testing.T) {
+	tr := NewSubmitTracker()
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	tr.Start("LTC", "aa", 100, []string{"cs1", "cs2", "cs3"}, now)
+
+	// Relayed by cs2 before we got to cs1
+	tr.Result("LTC", "aa", "cs2", "", nil, now.Add(time.Millisecond*20))
+	tr.Result("LTC", "aa", "cs1", "duplicate", nil, now.Add(time.Millisecond*50))
+	// Unknown blocks are ignored
+	tr.Result("LTC", "bb", "cs1", "", nil, now)
+
+	status := tr.Status(now.Add(time.Second))
+	assert.Len(t, status, 1)
+	sub := status[0]
+	assert.Equal(t, "cs2", sub.FirstAccepted)
+	assert.False(t, sub.Inconsistent)
+	assert.Equal(t, int64(20), sub.Results["cs2"].LatencyMS)
+	assert.Equal(t, submitAccepted, sub.Results["cs1"].Result)
+	assert.Equal(t, submitPending, sub.Results["cs3"].Result)
+
+	status = tr.Status(now.Add(blockSubmitTimeout * 2))
+	assert.Equal(t, submitNoResponse, status[0].Results["cs3"].Result)
+
+	tr.Result("LTC", "aa", "cs3", "high-hash", nil, now.Add(time.Second))
+	status = tr.Status(now.Add(time.Second))
+	assert.True(t, status[0].Inconsistent)
+	assert.Equal(t, "high-hash", status[0].Results["cs3"].Reason)
+}
+
+func TestSubmitTrackerErrors(t *testing.T) {
+	tr := NewSubmitTracker()
+	now := time.Now()
+	tr.Start("DOGE", "cc", 5, []string{"cs1", "cs2"}, now)
+	tr.Result("DOGE", "cc", "cs1", "", errors.New("connection refused"), now)
+	tr.Result("DOGE", "cc", "cs2", "", nil, now)
+
+	sub := tr.Status(now)[0]
+	// A failed call doesn't mean the node disagrees
+	assert.False(t, sub.Inconsistent)
+	assert.Equal(t, submitError, sub.Results["cs1"].Result)
+	assert.Equal(t, "connection refused", sub.Results["cs1"].Reason)
+
+	for i := 0; i < blockSubmitKeep+5; i++ {
+		tr.Start("DOGE", "dd", int64(i), nil, now)
+	}
+	status := tr.Status(now)
+	assert.Len(t, status, blockSubmitKeep)
+	assert.Equal(t, int64(blockSubmitKeep+4), status[0].Height)
+}
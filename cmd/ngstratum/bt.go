@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
 	"math/big"
+	"sort"
 
 	"github.com/btcsuite/btcd/blockchain"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
@@ -62,6 +64,101 @@ type BlockTemplate struct {
 	Extras            struct {
 		ChainID int
 	}
+	// Set by coinbuddy on createauxblock work, the header hash of the block
+	// the node built. There's nothing else of the block, only what's needed
+	// to merge mine it
+	AuxBlockHash string
+
+	// Some chains require part of the coinbase to go to a founder/dev fund.
+	// The payment is included in CoinbaseValue
+	Founder                *GBTPayee
+	FounderPaymentsStarted bool `json:"founder_payments_started"`
+
+	// Dash/PIVX style chains pay masternodes, and periodically a governance
+	// superblock, out of the coinbase. Blocks without these are rejected
+	Masternode         GBTPayees
+	Superblock         GBTPayees
+	SuperblocksStarted bool `json:"superblocks_started"`
+	SuperblocksEnabled bool `json:"superblocks_enabled"`
+
+	// On "coinbase" payout sharechains, who the pool's part of the coinbase
+	// is split between. Nil pays it all to BlockSubsidyAddress
+	payoutWindow *PayoutWindow
+	// The currency's TemplateHooks, set by applyHooks
+	hooks []templateHook
+	// The getblocktemplate JSON as the coinserver gave it, which has fields
+	// we don't decode
+	raw []byte
+}
+
+// A coinbase output required by the network, as given in the template
+type GBTPayee struct {
+	Payee  string
+	Script string
+	Amount int64
+}
+
+// Older daemons give a single object for masternode, newer ones a list
+type GBTPayees []GBTPayee
+
+func (p *GBTPayees) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '{' {
+		var single GBTPayee
+		if err := json.Unmarshal(data, &single); err != nil {
+			return err
+		}
+		*p = GBTPayees{single}
+		return nil
+	}
+	var list []GBTPayee
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*p = GBTPayees(list)
+	return nil
+}
+
+func (p *GBTPayee) pkScript(chainConfig *service.ChainConfig) ([]byte, error) {
+	if p.Script != "" {
+		return hex.DecodeString(p.Script)
+	}
+	codec, err := common.GetAddressCodec(chainConfig.Code)
+	if err != nil {
+		return nil, err
+	}
+	script, err := codec.PayToScript(p.Payee)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid payee address %s", p.Payee)
+	}
+	return script, nil
+}
+
+// Outputs the template says we must pay, which come out of CoinbaseValue
+// before anything else. Superblock payments aren't always included in
+// CoinbaseValue depending on the daemon, but paying ourselves less than the
+// maximum is always valid, so we deduct them regardless
+func (b *BlockTemplate) requiredPayees() []*GBTPayee {
+	var payees []*GBTPayee
+	if b.Founder != nil && b.FounderPaymentsStarted {
+		payees = append(payees, b.Founder)
+	}
+	// Dash sends an empty masternode payee before payments start, so skip
+	// anything without an amount and somewhere to send it
+	for i := range b.Masternode {
+		mn := &b.Masternode[i]
+		if mn.Amount > 0 && (mn.Payee != "" || mn.Script != "") {
+			payees = append(payees, mn)
+		}
+	}
+	if b.SuperblocksEnabled || b.SuperblocksStarted {
+		for i := range b.Superblock {
+			sb := &b.Superblock[i]
+			if sb.Amount > 0 && (sb.Payee != "" || sb.Script != "") {
+				payees = append(payees, sb)
+			}
+		}
+	}
+	return append(payees, b.hookPayees()...)
 }
 
 func (t *BlockTemplate) getTarget() (*big.Int, error) {
@@ -73,11 +170,12 @@ func (t *BlockTemplate) getTarget() (*big.Int, error) {
 	return blockchain.CompactToBig(bitsUint), nil
 }
 
+// The coinbase's merkle branch, which is also the parent coinbase branch in
+// AuxPoW. The coinbase is always the first transaction, so its mask is zero
+// and the branch doesn't depend on the coinbase itself
 func (b *BlockTemplate) merkleBranch() [][]byte {
-	branch := [][]byte{}
-	// Create a list of txn hashes with a placeholder for the coinbase that is
-	// =nil={0}
-	hashes := [][]byte{{}}
+	// A placeholder for the coinbase, then the txn hashes
+	hashes := [][]byte{nil}
 	for _, txn := range b.Transactions {
 		txID, err := hex.DecodeString(txn.getTxID())
 		if err != nil {
@@ -86,31 +184,7 @@ func (b *BlockTemplate) merkleBranch() [][]byte {
 		common.ReverseBytes(txID)
 		hashes = append(hashes, txID)
 	}
-	for {
-		if len(hashes) <= 1 {
-			break
-		}
-		branch = append(branch, hashes[1])
-		newHashes := [][]byte{}
-		for i := 0; i < len(hashes); i = i + 2 {
-			// We're generating the next higher level of the tree
-			if len(hashes[i]) == 0 { // if we encounter the placeholder, keep it
-				newHashes = append(newHashes, hashes[i])
-				// If we don't have a pair of hashes (odd list size) the rule is hash with itself
-			} else if i+1 >= len(hashes) {
-				hsh := sha256d.New()
-				hsh.Write(append(hashes[i], hashes[i]...))
-				newHashes = append(newHashes, hsh.Sum(nil))
-				// Hash the pair together to form next higher level in tree
-			} else {
-				hsh := sha256d.New()
-				hsh.Write(append(hashes[i], hashes[i+1]...))
-				newHashes = append(newHashes, hsh.Sum(nil))
-			}
-		}
-		// Operate next iteration of loop on the newly generated level of the tree
-		hashes = newHashes
-	}
+	branch, _ := merkleBranchAt(hashes, 0)
 	return branch
 }
 
@@ -130,15 +204,149 @@ func (b *BlockTemplate) createCoinbaseSplit(chainConfig *service.ChainConfig, ex
 	return parts[0], parts[1], nil
 }
 
-func (b *BlockTemplate) createCoinbase(chainConfig *service.ChainConfig, extra []byte) ([]byte, error) {
-	// Create the script to pay to the provided payment address.
+// Builds the coinbase outputs. The first output always pays
+// BlockSubsidyAddress, since that's the UTXO we track for payouts. It gets
+// CoinbaseValue minus the required payees, configured splits and miners paid
+// directly
+func (b *BlockTemplate) coinbaseOutputs(chainConfig *service.ChainConfig) ([]*wire.TxOut, error) {
+	outputs, _, err := b.coinbasePayout(chainConfig)
+	return outputs, err
+}
+
+// The coinbase outputs, and how the pool's part was split between miners if
+// there's a payoutWindow
+func (b *BlockTemplate) coinbasePayout(chainConfig *service.ChainConfig) ([]*wire.TxOut, []*CoinbasePayee, error) {
 	pkScript, err := txscript.PayToAddrScript(*chainConfig.BlockSubsidyAddress)
+	if err != nil {
+		return nil, nil, err
+	}
+	subsidy := &wire.TxOut{PkScript: pkScript}
+	outputs := []*wire.TxOut{subsidy}
+
+	remaining := b.CoinbaseValue
+	for _, payee := range b.requiredPayees() {
+		script, err := payee.pkScript(chainConfig)
+		if err != nil {
+			return nil, nil, err
+		}
+		outputs = append(outputs, &wire.TxOut{Value: payee.Amount, PkScript: script})
+		remaining -= payee.Amount
+	}
+	if remaining <= 0 {
+		return nil, nil, errors.Errorf("Required payees exceed coinbase value %d",
+			b.CoinbaseValue)
+	}
+
+	var split int64
+	for _, s := range chainConfig.CoinbaseSplits {
+		script, err := txscript.PayToAddrScript(s.Address)
+		if err != nil {
+			return nil, nil, err
+		}
+		value := int64(float64(remaining) * s.Percent / 100)
+		outputs = append(outputs, &wire.TxOut{Value: value, PkScript: script})
+		split += value
+	}
+	subsidy.Value = remaining - split
+
+	payees := b.payoutWindow.split(subsidy.Value)
+	for _, p := range payees {
+		if p.Address == "" {
+			continue
+		}
+		outputs = append(outputs, &wire.TxOut{Value: p.Amount, PkScript: p.script})
+		subsidy.Value -= p.Amount
+	}
+	return outputs, payees, nil
+}
+
+// How a block's CoinbaseValue splits between transaction fees and the chain's
+// own subsidy, saved with solved blocks for fee revenue reporting
+type blockReward struct {
+	fees        int64
+	baseSubsidy int64
+	// Including the coinbase
+	txCount int
+}
+
+// Transactions without a fee from the coinserver count as paying none
+func (b *BlockTemplate) reward() blockReward {
+	var fees int64
+	for _, tx := range b.Transactions {
+		fees += tx.Fee
+	}
+	return blockReward{
+		fees:        fees,
+		baseSubsidy: b.CoinbaseValue - fees,
+		txCount:     len(b.Transactions) + 1,
+	}
+}
+
+// The amount paid to BlockSubsidyAddress, which is what gets credited to
+// miners, and the split recorded for ngweb on coinbase payout sharechains
+func (b *BlockTemplate) poolSubsidy(chainConfig *service.ChainConfig) (int64, []*CoinbasePayee, error) {
+	outputs, payees, err := b.coinbasePayout(chainConfig)
+	if err != nil {
+		return 0, nil, err
+	}
+	return outputs[0].Value, payees, nil
+}
+
+// The template's coinbaseaux values concatenated in key order, for chains
+// that expect them in the coinbase
+func (b *BlockTemplate) coinbaseAuxData() ([]byte, error) {
+	keys := []string{}
+	for key := range b.CoinbaseAux {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	data := []byte{}
+	for _, key := range keys {
+		decoded, err := hex.DecodeString(b.CoinbaseAux[key])
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid coinbaseaux %s", key)
+		}
+		data = append(data, decoded...)
+	}
+	return data, nil
+}
+
+// Builds the coinbase scriptSig. BIP34 requires the height be the first push,
+// then come the aux flags, the extranonce (and merged mining commitment) in
+// extra, and finally our tag
+func (b *BlockTemplate) coinbaseScript(chainConfig *service.ChainConfig, extra []byte) ([]byte, error) {
+	builder := txscript.NewScriptBuilder().AddInt64(int64(b.Height))
+	if chainConfig.CoinbaseAuxFlags {
+		flags, err := b.coinbaseAuxData()
+		if err != nil {
+			return nil, err
+		}
+		if len(flags) > 0 {
+			builder.AddData(flags)
+		}
+	}
+	builder.AddData(extra)
+	if len(chainConfig.CoinbaseTag) > 0 {
+		builder.AddData(chainConfig.CoinbaseTag)
+	}
+	cbScript, err := builder.Script()
+	if err != nil {
+		return nil, err
+	}
+	if len(cbScript) > blockchain.MaxCoinbaseScriptLen {
+		return nil, errors.Errorf("Coinbase script is %d bytes, more than the limit of %d",
+			len(cbScript), blockchain.MaxCoinbaseScriptLen)
+	}
+	return cbScript, nil
+}
+
+func (b *BlockTemplate) createCoinbase(chainConfig *service.ChainConfig, extra []byte) ([]byte, error) {
+	outputs, err := b.coinbaseOutputs(chainConfig)
 	if err != nil {
 		return nil, err
 	}
 
-	cbScript, err := txscript.NewScriptBuilder().AddInt64(int64(b.Height)).
-		AddData(extra).Script()
+	cbScript, err := b.coinbaseScript(chainConfig, extra)
 	if err != nil {
 		return nil, err
 	}
@@ -151,10 +359,9 @@ func (b *BlockTemplate) createCoinbase(chainConfig *service.ChainConfig, extra [
 		SignatureScript:  cbScript,
 		Sequence:         wire.MaxTxInSequenceNum,
 	})
-	tx.AddTxOut(&wire.TxOut{
-		Value:    b.CoinbaseValue,
-		PkScript: pkScript,
-	})
+	for _, out := range outputs {
+		tx.AddTxOut(out)
+	}
 
 	buf := bytes.Buffer{}
 	tx.Serialize(&buf)
@@ -175,48 +382,45 @@ func (b *BlockTemplate) merkleRoot(coinbaseHash []byte) []byte {
 	return merkleRoot(hashes)
 }
 
-func auxMerkleBranch(merkleBase [][]byte, followHash []byte) ([][]byte, uint32) {
-	branch := [][]byte{}
-	hashes := merkleBase
-	for i := 0; i < len(hashes); i = i + 1 {
-		if hashes[i] == nil {
-			hashes[i] = []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+// The merkle branch from the leaf at index up to the root, with the mask
+// that goes with it in AuxPoW: bit n is set when the level n sibling is on
+// the left, which makes the mask the leaf's index. An unpaired node at the
+// end of a level is hashed with itself, so it's its own sibling. nil leaves
+// are empty slots and count as zeros
+func merkleBranchAt(leaves [][]byte, index uint32) ([][]byte, uint32) {
+	hashes := make([][]byte, len(leaves))
+	for i, leaf := range leaves {
+		if leaf == nil {
+			leaf = make([]byte, chainhash.HashSize)
 		}
+		hashes[i] = leaf
 	}
-	follow := followHash[:]
-	var level uint32 = 0
-	var bitMask uint32
-	for {
-		if len(hashes) <= 1 {
-			break
+	branch := [][]byte{}
+	var mask uint32
+	for level := uint(0); len(hashes) > 1; level++ {
+		sibling := index ^ 1
+		if int(sibling) >= len(hashes) {
+			sibling = index
+		}
+		branch = append(branch, hashes[sibling])
+		if index&1 == 1 {
+			mask |= 1 << level
 		}
 		newHashes := [][]byte{}
 		for i := 0; i < len(hashes); i = i + 2 {
-			hsh := sha256d.New()
-			if i+1 >= len(hashes) {
-				hsh.Write(append(hashes[i], hashes[i]...))
-				newHashes = append(newHashes, hsh.Sum(nil))
-				// Hash the pair together to form next higher level in tree
-			} else {
-				hsh.Write(append(hashes[i], hashes[i+1]...))
-				newHashes = append(newHashes, hsh.Sum(nil))
-			}
-
-			// If we're hashing the relevant block hash
-			if bytes.Compare(hashes[i], follow) == 0 {
-				branch = append(branch, hashes[i+1])
-				follow = hsh.Sum(nil)
-				// bitmask already set to 0
-			} else if bytes.Compare(hashes[i+1], follow) == 0 {
-				bitMask |= (1 << level)
-				branch = append(branch, hashes[i])
-				follow = hsh.Sum(nil)
+			right := hashes[i]
+			if i+1 < len(hashes) {
+				right = hashes[i+1]
 			}
+			hsh := sha256d.New()
+			hsh.Write(hashes[i])
+			hsh.Write(right)
+			newHashes = append(newHashes, hsh.Sum(nil))
 		}
-		// Operate next iteration of loop on the newly generated level of the tree
 		hashes = newHashes
+		index /= 2
 	}
-	return branch, bitMask
+	return branch, mask
 }
 
 func merkleRoot(hashes [][]byte) []byte {
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Counters for a currency we've mined, so operators can see how often each
+// aux chain is actually solving. Stats are kept when a chain drops out of the
+// job, and carry on if it comes back
+type chainStat struct {
+	Aux    bool  `json:"aux"`
+	Active bool  `json:"active"`
+	Height int64 `json:"height"`
+	// When the chain was first added to a job
+	AddedAt time.Time `json:"added_at"`
+	// Time spent in jobs, not counting the current stint if Active
+	activeFor   time.Duration
+	activeSince time.Time
+	// Share difficulty submitted while the chain was in the job
+	Shares    float64    `json:"shares"`
+	Blocks    int        `json:"blocks"`
+	LastSolve *time.Time `json:"last_solve"`
+}
+
+type chainStatStatus struct {
+	chainStat
+	ActiveSeconds float64 `json:"active_seconds"`
+	BlocksPerHour float64 `json:"blocks_per_hour"`
+}
+
+type ChainStats struct {
+	chains map[string]*chainStat
+	mtx    sync.Mutex
+}
+
+func NewChainStats() *ChainStats {
+	return &ChainStats{chains: map[string]*chainStat{}}
+}
+
+// Updates which currencies are in the current job. heights has every
+// currency in the job, main is the base currency
+func (c *ChainStats) SetActive(main string, heights map[string]int64, now time.Time) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for code, stat := range c.chains {
+		if _, ok := heights[code]; !ok && stat.Active {
+			stat.Active = false
+			stat.activeFor += now.Sub(stat.activeSince)
+		}
+	}
+	for code, height := range heights {
+		stat, ok := c.chains[code]
+		if !ok {
+			stat = &chainStat{AddedAt: now}
+			c.chains[code] = stat
+		}
+		if !stat.Active {
+			stat.Active = true
+			stat.activeSince = now
+		}
+		stat.Aux = code != main
+		stat.Height = height
+	}
+}
+
+func (c *ChainStats) AddShare(currencies []string, difficulty float64,
+	blocks map[string]*BlockSolve, at time.Time) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, code := range currencies {
+		if stat, ok := c.chains[code]; ok {
+			stat.Shares += difficulty
+		}
+	}
+	for code := range blocks {
+		if stat, ok := c.chains[code]; ok {
+			stat.Blocks++
+			solved := at
+			stat.LastSolve = &solved
+		}
+	}
+}
+
+func (c *ChainStats) Status(now time.Time) map[string]*chainStatStatus {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	ret := map[string]*chainStatStatus{}
+	for code, stat := range c.chains {
+		active := stat.activeFor
+		if stat.Active {
+			active += now.Sub(stat.activeSince)
+		}
+		status := &chainStatStatus{
+			chainStat:     *stat,
+			ActiveSeconds: active.Seconds(),
+		}
+		if active > 0 {
+			status.BlocksPerHour = float64(stat.Blocks) / active.Hours()
+		}
+		ret[code] = status
+	}
+	return ret
+}
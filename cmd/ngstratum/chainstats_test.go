@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChainStatsAuxComesAndGoes(t *testing.T) {
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewChainStats()
+	c.SetActive("LTC", map[string]int64{"LTC": 100, "DOGE": 50}, now)
+	c.AddShare([]string{"LTC", "DOGE"}, 2, map[string]*BlockSolve{"DOGE": nil}, now)
+
+	// DOGE coinserver goes away for an hour
+	now = now.Add(time.Hour)
+	c.SetActive("LTC", map[string]int64{"LTC": 101}, now)
+	c.AddShare([]string{"LTC"}, 2, nil, now)
+	now = now.Add(time.Hour)
+	c.SetActive("LTC", map[string]int64{"LTC": 102, "DOGE": 51}, now)
+	now = now.Add(time.Hour)
+
+	status := c.Status(now)
+	assert.True(t, status["DOGE"].Aux)
+	assert.True(t, status["DOGE"].Active)
+	assert.False(t, status["LTC"].Aux)
+	assert.Equal(t, 2.0, status["DOGE"].Shares)
+	assert.Equal(t, 4.0, status["LTC"].Shares)
+	assert.Equal(t, 1, status["DOGE"].Blocks)
+	// Only the two hours DOGE was in the job count
+	assert.Equal(t, 7200.0, status["DOGE"].ActiveSeconds)
+	assert.Equal(t, 0.5, status["DOGE"].BlocksPerHour)
+	assert.Equal(t, int64(51), status["DOGE"].Height)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"io"
@@ -10,6 +11,8 @@ import (
 	"math/rand"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dustin/go-broadcast"
@@ -17,9 +20,16 @@ import (
 	"github.com/mitchellh/mapstructure"
 
 	"github.com/icook/ngpool/pkg/common"
+	"github.com/icook/ngpool/pkg/logging"
 )
 
 type StratumClient struct {
+	// Unix nanoseconds, zero for never. Set by the read loop and checked by
+	// the write loop, so accessed atomically. Kept first for alignment
+	authorizedAt  int64
+	lastShareAt   int64
+	lastMessageAt int64
+
 	id string
 
 	// State information
@@ -34,18 +44,69 @@ type StratumClient struct {
 	// wait for a job to be pushed and handle the response as a special case
 	loginMsgID int64
 	diff       float64
-
-	write       chan []byte
+	// Set when the miner fixed its difficulty with d= in the password, and
+	// vardiff leaves it alone
+	staticDiff bool
+	// From mining.suggest_difficulty or suggest_target before authorizing,
+	// the starting difficulty if the password doesn't set one
+	suggestedDiff float64
+	// Picked with pc= in the password, nil for every currency mined
+	payoutCurrencies payoutCurrencies
+	// Version bits negotiated with mining.configure, 0 if the client can't
+	// roll the version. Accessed atomically
+	versionMask uint32
+
+	// Messages waiting for flushLoop, bounded by PortConfig.SendQueue
+	write       chan net.Buffers
+	diffRequest chan diffRequest
 	jobListener chan interface{}
-	jobCast     broadcast.Broadcaster
-	newShare    chan *Share
-	submit      chan *MiningSubmit
-	vardiff     *VarDiff
+	// The main chain this connection mines
+	lane      *MainChainLane
+	jobCast   broadcast.Broadcaster
+	newShare  chan *Share
+	validator *ShareValidator
+	// Holds a *clientJobBook. Only the write loop stores to it
+	jobBook atomic.Value
+	// Holds a *diffHistory, stored to by setDiff
+	diffHistory atomic.Value
+	// getjob requests from JSON-RPC 2.0 miners, answered by the write loop
+	// since it owns the job book
+	getJob  chan *int64
+	vardiff *VarDiff
+	// The port the miner connected to
+	bind string
+	// The port's DiffMultiplier, 0 is taken as 1
+	diffMultiplier float64
+	// 1 if every frame is logged, see SessionTracer. Accessed atomically
+	tracing int32
+	// The port's FastAck
+	fastAck bool
+	// Difficulty owed for bad shares that were acknowledged before they
+	// were checked, see fastAckPenalty
+	penalty fastAckPenalty
+	// Reused by every share check, see shareScratch
+	scratch     shareScratch
 	shutdown    chan interface{}
 	hasShutdown bool
+	stopOnce    sync.Once
 	shareWindow common.Window
 	log         log.Logger
 	conn        net.Conn
+
+	remoteIP   string
+	protoStats common.ProtocolStats
+	shareStats common.ShareStats
+	ipTracker  *IPTracker
+
+	port *PortConfig
+	// The last job id's counter, see makeJobID. Only used by the write loop
+	jobCounter uint16
+	// Set once we've sent client.reconnect, so we don't send it again
+	steered bool
+
+	connectedAt time.Time
+	// The idle deadline the miner was last warned about
+	idleWarned time.Time
 }
 
 var XMRdiff1 = big.Int{}
@@ -55,38 +116,70 @@ func init() {
 		"0xffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff", 0)
 }
 
-func NewClient(conn net.Conn, jobCast broadcast.Broadcaster, newShare chan *Share, vardiff *VarDiff) *StratumClient {
+func NewClient(conn net.Conn, lane *MainChainLane, newShare chan *Share,
+	validator *ShareValidator, vardiff *VarDiff, ipTracker *IPTracker,
+	port *PortConfig, extranonce1 []byte) *StratumClient {
 	sc := &StratumClient{
 		rpcVersion2: false,
 		subscribed:  false,
 		conn:        conn,
-		id:          randomString(),
+		id:          hex.EncodeToString(extranonce1),
 		attrs:       map[string]string{},
-		jobCast:     jobCast,
+		lane:        lane,
+		jobCast:     lane.jobCast,
 		jobListener: make(chan interface{}),
 		shutdown:    make(chan interface{}),
-		submit:      make(chan *MiningSubmit),
+		getJob:      make(chan *int64),
 		vardiff:     vardiff,
-		write:       make(chan []byte, 10),
+		write:       make(chan net.Buffers, port.sendQueue()),
+		diffRequest: make(chan diffRequest),
 		newShare:    newShare,
+		validator:   validator,
 		shareWindow: common.NewWindow(50),
+		remoteIP:    remoteIP(conn),
+		ipTracker:   ipTracker,
+		port:        port,
+		connectedAt: time.Now(),
 	}
-	sc.log = log.New("clientid", sc.id)
+	sc.log = logging.New("client", "clientid", sc.id, "ip", sc.remoteIP)
+	sc.updateTrace()
+	sc.jobBook.Store(&clientJobBook{})
+	sc.diffHistory.Store(&diffHistory{})
 	return sc
 }
 
 func (c *StratumClient) Stop() {
-	// Either write or read thread exit trigger shutdown, so it might get
-	// called multiple times
-	if c.hasShutdown {
-		return
-	}
+	// The read and write loops and share validators can all trigger
+	// shutdown, so it might get called multiple times
+	c.stopOnce.Do(c.stop)
+}
 
+func (c *StratumClient) stop() {
 	c.log.Info("Client disconnect")
 	close(c.shutdown)
 	c.hasShutdown = true
 	err := c.conn.Close()
+	// The broadcaster hands each job to every listener in turn, and takes
+	// unregistrations between jobs. The write loop may already be gone, so
+	// take any job it's stuck handing us until we're unregistered
+	unregistered := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-c.jobListener:
+			case <-unregistered:
+				return
+			}
+		}
+	}()
 	c.jobCast.Unregister(c.jobListener)
+	close(unregistered)
+	c.port.Extranonces.Release(c.Extranonce1())
+	c.port.Lanes.Release(c.lane)
+	// A static difficulty will be asked for again in the password
+	if !c.staticDiff {
+		c.port.WorkerDiffs.Save(c.username, c.worker, c.diff, time.Now())
+	}
 	if err != nil {
 		c.log.Warn("Error closing", "err", err)
 	}
@@ -95,33 +188,59 @@ func (c *StratumClient) Stop() {
 func (c *StratumClient) Start() {
 	go c.readLoop()
 	go c.writeLoop()
+	go c.flushLoop()
 }
 
 // Handle calculating a users difficulty and push a write if it's changed
 func (c *StratumClient) updateDiff() error {
+	if c.staticDiff {
+		return nil
+	}
 	rate := c.shareWindow.RateMinute()
 	newDiff := c.vardiff.ComputeNew(c.diff, rate)
 	if c.diff == newDiff {
 		return nil
 	}
 	c.log.Info("Moving to new diff", "diff", newDiff, "rate", rate)
-	c.diff = newDiff
+	return c.setDiff(newDiff)
+}
+
+// Converts a difficulty to the miner's units, its diff1 target being
+// DiffMultiplier times easier than ours
+func (c *StratumClient) minerDiff(diff float64) float64 {
+	if c.diffMultiplier == 0 {
+		return diff
+	}
+	return diff * c.diffMultiplier
+}
+
+// The reverse of minerDiff, for difficulties the miner asks for
+func (c *StratumClient) poolDiff(diff float64) float64 {
+	if c.diffMultiplier == 0 {
+		return diff
+	}
+	return diff / c.diffMultiplier
+}
+
+func (c *StratumClient) setDiff(diff float64) error {
+	if c.diff == diff {
+		return nil
+	}
+	if c.diff > 0 {
+		history := c.diffHistory.Load().(*diffHistory)
+		c.diffHistory.Store(history.with(c.diff, time.Now()))
+	}
+	c.diff = diff
+	// JSON-RPC 2.0 miners get the new target with their next job
 	if !c.rpcVersion2 {
 		return c.send(&StratumMessage{
 			Method: "mining.set_difficulty",
-			Params: []float64{c.diff},
+			Params: []float64{c.minerDiff(c.diff)},
 		})
 	}
 	return nil
 }
 
-type ClientJob struct {
-	job           *Job
-	id            string
-	difficulty    float64
-	submissionMap map[string]bool
-}
-
 func (c *StratumClient) Extranonce1() []byte {
 	// We encode it from hex, so it must be right...
 	out, _ := hex.DecodeString(c.id)
@@ -130,16 +249,45 @@ func (c *StratumClient) Extranonce1() []byte {
 
 func (c *StratumClient) status() common.StratumClientStatus {
 	return common.StratumClientStatus{
-		c.username,
-		c.shareWindow.RateSecond() * 65536,
-		c.worker,
-		c.diff,
+		Username:    c.username,
+		Hashrate:    c.shareWindow.RateSecond() * 65536,
+		Name:        c.worker,
+		Difficulty:  c.diff,
+		RemoteIP:    c.remoteIP,
+		Currency:    c.lane.key.Currency,
+		Protocol:    loadProtocolStats(&c.protoStats),
+		Shares:      loadShareStats(&c.shareStats),
+		PenaltyOwed: c.penalty.Owed(),
 	}
 }
 
+// Count a protocol error against this connection and its IP. If the IP
+// crosses the ban threshold the connection is dropped
+func (c *StratumClient) protocolError(kind int) {
+	incrProtocolStat(&c.protoStats, kind)
+	if c.ipTracker == nil {
+		return
+	}
+	if c.ipTracker.Record(c.remoteIP, kind) {
+		c.log.Warn("Banning IP for protocol errors", "stats", loadProtocolStats(&c.protoStats))
+		c.Stop()
+	}
+}
+
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
 // Taken directly from https://github.com/sammy007/monero-stratum/util/util.go
 // All original copyrights apply
 func GetTargetHex(diff int64) string {
+	if diff < 1 {
+		diff = 1
+	}
 	padded := make([]byte, 32)
 	diffBuff := new(big.Int).Div(&XMRdiff1, big.NewInt(diff)).Bytes()
 	copy(padded[32-len(diffBuff):], diffBuff)
@@ -152,84 +300,69 @@ func GetTargetHex(diff int64) string {
 func (c *StratumClient) writeLoop() {
 	defer c.Stop()
 
-	jobBook := map[string]*ClientJob{}
-	writer := bufio.NewWriter(c.conn)
-	var resp []byte
 	var raw interface{}
 	var ticker = time.NewTicker(time.Second * 60)
-	var submission *MiningSubmit
+	defer ticker.Stop()
+	var idleTicker = time.NewTicker(idleCheckInterval)
+	defer idleTicker.Stop()
+	var lastJob *Job
+	var throttle = newJobThrottle(c.port)
+	// Fires when a held back job may be sent, nil if none is held
+	var throttled <-chan time.Time
 	for {
 		select {
 		case <-c.shutdown:
 			return
-		// Anything that writes to the client pushes onto this channel
-		case resp = <-c.write:
-			writer.Write(resp)
-			err := writer.Flush()
-			if err != nil {
-				c.log.Debug("Error writing", "err", err)
-				return // Disconnect
+		case <-throttled:
+			throttled = nil
+			job, clean := throttle.flush(time.Now())
+			if job == nil {
+				continue
+			}
+			lastJob = job
+			if err := c.sendJob(job, clean); err != nil {
+				c.log.Error("Failed write response", "err", err)
+				return
 			}
 		// Periodically recalculate difficulty
 		case <-ticker.C:
 			c.updateDiff()
-		// Job listener won't recieve jobs until mining.authorize in the read
-		// loop
-		case submission = <-c.submit:
-			if submission == nil {
-				c.log.Error("Got nil on submit channel")
-				return
+		case req := <-c.diffRequest:
+			diff := c.vardiff.Clamp(req.diff)
+			if req.suggested {
+				if !c.staticDiff {
+					c.log.Info("Difficulty suggested by miner", "diff", diff)
+					c.setDiff(diff)
+				}
+				break
 			}
-			clientJob, ok := jobBook[submission.JobID]
-			if !ok {
-				c.sendError(submission.ID, StratumErrorStale)
-				continue
+			c.log.Info("Difficulty set by admin", "diff", diff, "static", req.static)
+			c.staticDiff = req.static
+			c.setDiff(diff)
+		case now := <-idleTicker.C:
+			if c.checkIdle(now) {
+				return // Disconnect
 			}
-			submissionKey := submission.GetKey()
-			if _, ok := clientJob.submissionMap[submissionKey]; ok {
-				c.sendError(submission.ID, StratumErrorDuplicate)
+		case id := <-c.getJob:
+			if lastJob == nil {
+				c.sendError(id, StratumErrorOther)
 				continue
 			}
-			job := clientJob.job
-
-			// Generate combined extranonce and diff target
-			extranonce := append(c.Extranonce1(), submission.Extranonce2...)
-
-			targetFl := big.Float{}
-			targetFl.SetFloat64(clientJob.difficulty)
-			targetFl.Mul(clientJob.job.algo.ShareDiff1, &targetFl)
-			target, _ := targetFl.Int(&big.Int{})
-			blocks, validShare, currencies, err := job.CheckSolves(
-				submission.Nonce, extranonce, target)
+			params, err := c.stratum2Job(lastJob)
 			if err != nil {
-				c.log.Warn("Unexpected error CheckSolves", "job", clientJob)
-				c.sendError(submission.ID, StratumErrorOther)
+				c.log.Error("Failed to get stratum params", "err", err)
+				c.sendError(id, StratumErrorOther)
 				continue
 			}
-			err = nil
-			if validShare {
-				err = c.send(&StratumResponse{
-					ID:     submission.ID,
-					Result: true,
-				})
-				if err != nil {
-					c.log.Error("Failed write response", "err", err)
-					return
-				}
-			} else {
-				c.sendError(submission.ID, StratumErrorLowDiff)
-				continue
-			}
-			clientJob.submissionMap[submissionKey] = true
-			c.newShare <- &Share{
-				username:   c.username,
-				worker:     c.worker,
-				time:       time.Now(),
-				currencies: currencies,
-				difficulty: clientJob.difficulty,
-				blocks:     blocks,
+			err = c.send(&Stratum2Response{
+				ID:      id,
+				JSONRPC: "2.0",
+				Result:  params,
+			})
+			if err != nil {
+				c.log.Error("Failed write response", "err", err)
+				return
 			}
-			c.shareWindow.Add(clientJob.difficulty)
 
 		case raw = <-c.jobListener:
 			if raw == nil {
@@ -241,78 +374,286 @@ func (c *StratumClient) writeLoop() {
 				c.log.Warn("Bad job from broadcast", "job", raw)
 				continue
 			}
-			jid := randomString()
-			jobBook[jid] = &ClientJob{
-				job:           newJob,
-				id:            jid,
-				difficulty:    c.diff,
-				submissionMap: make(map[string]bool),
+			// Work updates that come faster than the port allows are held
+			// back, and the newest sent once the interval is up
+			job, clean := throttle.push(newJob, time.Now())
+			if job == nil {
+				c.log.Debug("Holding back job update, too soon after last")
+				if throttled == nil {
+					throttled = time.After(throttle.wait(time.Now()))
+				}
+				continue
 			}
+			lastJob = job
+			if err := c.sendJob(job, clean); err != nil {
+				c.log.Error("Failed write response", "err", err)
+				return
+			}
+		}
+	}
+}
 
-			if c.rpcVersion2 {
-				params, err := newJob.GetStratum2Params(c.Extranonce1())
-				if err != nil {
-					c.log.Error("Failed to get stratum params", "err", err)
-					continue
-				}
-				params["target"] = GetTargetHex(int64(c.diff))
-				params["job_id"] = jid
-
-				if !c.subscribed {
-					c.subscribed = true
-					err = c.send(&Stratum2Response{
-						ID:      &c.loginMsgID,
-						JSONRPC: "2.0",
-						Result: map[string]interface{}{
-							"id":     c.id,
-							"status": "OK",
-							"job":    params,
-						}})
-					if err != nil {
-						c.log.Error("Failed write response", "err", err)
-						return
-					}
-				} else {
-					err = c.send(&Stratum2Message{
-						JSONRPC: "2.0",
-						Method:  "job",
-						Params:  params,
-					})
-					if err != nil {
-						c.log.Error("Failed write response", "err", err)
-						return
-					}
-				}
-			} else {
-				params, err := newJob.GetStratumParams()
-				if err != nil {
-					c.log.Error("Failed to get stratum params", "err", err)
-					continue
-				}
-				params = append([]interface{}{jid}, params...)
+// Sends a job notification, returning an error only if the connection
+// failed. Only called from the write loop
+func (c *StratumClient) sendJob(job *Job, clean bool) error {
+	if c.rpcVersion2 {
+		params, err := c.stratum2Job(job)
+		if err != nil {
+			c.log.Error("Failed to get stratum params", "err", err)
+			return nil
+		}
+		if !c.subscribed {
+			c.subscribed = true
+			return c.send(&Stratum2Response{
+				ID:      &c.loginMsgID,
+				JSONRPC: "2.0",
+				Result: map[string]interface{}{
+					"id":     c.id,
+					"status": "OK",
+					"job":    params,
+				}})
+		}
+		return c.send(&Stratum2Message{
+			JSONRPC: "2.0",
+			Method:  "job",
+			Params:  params,
+		})
+	}
+	jid := c.addClientJob(job)
+	// Only the job id differs between clients, the rest is shared
+	tail, err := job.notifyTail(clean)
+	if err != nil {
+		c.log.Error("Failed to get stratum params", "err", err)
+		return nil
+	}
+	c.log.Debug("Sending job", "jid", jid, "clean", clean)
+	c.enqueue(net.Buffers{notifyHead(jid), tail})
+	return nil
+}
 
-				err = c.send(&StratumMessage{
-					Method: "mining.notify",
-					Params: params,
-				})
-				if err != nil {
-					c.log.Error("Failed write response", "err", err)
-					return
-				}
-			}
+// Only called from the write loop, so there's never a concurrent store to
+// lose a job to
+func (c *StratumClient) addClientJob(job *Job) string {
+	c.jobCounter++
+	jid := makeJobID(job.height, job.templateHash, c.jobCounter)
+	book := c.jobBook.Load().(*clientJobBook)
+	clientJob := NewClientJob(jid, job, c.diff, time.Now())
+	c.jobBook.Store(book.with(clientJob, c.port.retainedJobs(), c.port.JobMaxAge))
+	return jid
+}
+
+// Finds the job and claims the submission, then queues the share to be
+// checked. Runs on the read loop
+func (c *StratumClient) submitShare(submission *MiningSubmit) {
+	// Rejected shares count too, the miner's still working
+	atomic.StoreInt64(&c.lastShareAt, time.Now().UnixNano())
+	sizes := stratumNonceSizes
+	sizes.extranonce2 = c.port.Extranonces.Extranonce2Size()
+	if c.rpcVersion2 {
+		sizes.nonce = c.port.BlobFormat.NonceSize
+		// JSON-RPC 2.0 miners only iterate the nonce, their extranonce2 is
+		// always zeros
+		submission.Extranonce2 = make([]byte, sizes.extranonce2)
+	}
+	book := c.jobBook.Load().(*clientJobBook)
+	clientJob, result := classifySubmission(book,
+		submission, sizes, time.Now(), c.port.JobMaxAge, c.port.StaleShareDepth)
+	if result != ShareAccepted {
+		c.rejectShare(submission.ID, result)
+		return
+	}
+	if c.fastAck {
+		if err := c.sendShareAccepted(submission.ID); err != nil {
+			c.log.Error("Failed write response", "err", err)
+		}
+	}
+	c.validator.Submit(&shareTask{
+		client:     c,
+		clientJob:  clientJob,
+		submission: submission,
+		key:        submission.GetKey(),
+		received:   time.Now(),
+		acked:      c.fastAck,
+		stale:      clientJob.job.height < book.latest().job.height,
+	})
+}
+
+// Checks a submission on a validator goroutine. Anything touched here must be
+// safe to use alongside the read and write loops
+func (c *StratumClient) checkShare(task *shareTask) {
+	submission, clientJob := task.submission, task.clientJob
+	job := clientJob.job
+	// Rejected submissions are released, so resending one gets the same
+	// answer rather than a duplicate error
+	reject := func(result ShareResult) {
+		clientJob.submissions.Delete(task.key)
+		if task.acked {
+			// Too late to tell the miner, so it pays for the share out of
+			// its next good ones
+			c.log.Debug("Penalizing share acknowledged early", "reason", result)
+			incrShareStat(&c.shareStats, result)
+			incrShareStat(&c.port.Shares, result)
+			c.penalty.add(clientJob.difficulty)
+			return
+		}
+		c.rejectShare(submission.ID, result)
+	}
+
+	// Generate combined extranonce
+	extranonce := append(c.Extranonce1(), submission.Extranonce2...)
+	if c.rpcVersion2 {
+		err := c.port.BlobFormat.checkResult(job, extranonce, submission.Nonce, submission.Result)
+		if err != nil {
+			c.log.Info("Rejecting JSON-RPC 2.0 submit", "err", err)
+			reject(ShareBadResult)
+			c.protocolError(ProtocolParseError)
+			return
+		}
+	}
+
+	var version []byte
+	if submission.VersionBits != nil {
+		// The job's chain may differ from the one we negotiated with, so
+		// its algo bits are masked again
+		mask := atomic.LoadUint32(&c.versionMask) &^ multiAlgoMask(job.currencyConfig)
+		rolled, err := rollVersion(binary.LittleEndian.Uint32(job.version),
+			binary.BigEndian.Uint32(submission.VersionBits), mask)
+		if err != nil {
+			c.log.Info("Rejecting rolled version", "err", err)
+			reject(ShareBadVersion)
+			return
+		}
+		version = make([]byte, 4)
+		binary.LittleEndian.PutUint32(version, rolled)
+	}
+
+	difficulty := clientJob.difficulty
+	blocks, validShare, currencies, blockRatio, err := job.CheckSolvesFast(&c.scratch,
+		submission.Nonce, extranonce, version, clientJob.target)
+	if err == nil && !validShare && c.port.RetargetGrace > 0 {
+		// Maybe worked out against a difficulty we only just moved off
+		history := c.diffHistory.Load().(*diffHistory)
+		graceDiff := history.graceDiff(difficulty, task.received, c.port.RetargetGrace)
+		if graceDiff > 0 {
+			difficulty = graceDiff
+			blocks, validShare, currencies, blockRatio, err = job.CheckSolvesFast(&c.scratch,
+				submission.Nonce, extranonce, version, job.algo.ShareTarget(graceDiff))
 		}
 	}
+	if err != nil {
+		c.log.Warn("Unexpected error CheckSolves", "job", clientJob.id, "err", err)
+		reject(ShareOther)
+		return
+	}
+	if task.stale && len(blocks) > 0 {
+		// Built on a block that's been replaced, it could only orphan
+		c.log.Info("Dropping solve from a stale job", "job", clientJob.id)
+		blocks = nil
+	}
+	if !validShare {
+		reject(ShareLowDiff)
+		return
+	}
+	if !task.acked {
+		if err := c.sendShareAccepted(submission.ID); err != nil {
+			c.log.Error("Failed write response", "err", err)
+		}
+	}
+	incrShareStat(&c.shareStats, ShareAccepted)
+	incrShareStat(&c.port.Shares, ShareAccepted)
+	c.shareWindow.Add(difficulty)
+	credited := c.penalty.settle(difficulty)
+	if credited == 0 && len(blocks) == 0 {
+		return
+	}
+	c.newShare <- &Share{
+		username:   c.username,
+		worker:     c.worker,
+		time:       task.received,
+		currencies: currencies,
+		difficulty: credited,
+		blocks:     blocks,
+		blockRatio: blockRatio,
+		// Checked against the job's currencies rather than the port's,
+		// since aux chains come and go
+		payoutWeights: c.payoutCurrencies.forShare(currencies),
+	}
+}
+
+func (c *StratumClient) sendShareAccepted(id *int64) error {
+	if c.rpcVersion2 {
+		return c.send(&Stratum2Response{
+			ID:      id,
+			JSONRPC: "2.0",
+			Result:  map[string]interface{}{"status": "OK"},
+		})
+	}
+	return c.send(&StratumResponse{
+		ID:     id,
+		Result: true,
+	})
+}
 
+// Builds a JSON-RPC 2.0 job at the current difficulty, with a blob unique to
+// this session
+func (c *StratumClient) stratum2Job(job *Job) (map[string]interface{}, error) {
+	params, err := job.GetStratum2Params(c.port.BlobFormat, c.Extranonce1())
+	if err != nil {
+		return nil, err
+	}
+	params["job_id"] = c.addClientJob(job)
+	params["target"] = GetTargetHex(int64(c.diff))
+	params["id"] = c.id
+	return params, nil
 }
 
-func (c *StratumClient) authorize() {
-	c.updateDiff()
+func (c *StratumClient) authorize(password string) {
+	atomic.CompareAndSwapInt64(&c.authorizedAt, 0, time.Now().UnixNano())
+	c.updateTrace()
+	var pd passwordDiff
+	if c.port.PasswordDiff {
+		pd = parsePasswordDiff(password)
+	}
+	if pd.diff > 0 {
+		diff := c.vardiff.Clamp(c.poolDiff(pd.diff))
+		c.log.Info("Using difficulty from password", "diff", diff, "static", pd.static)
+		c.staticDiff = pd.static
+		c.setDiff(diff)
+	} else if c.suggestedDiff > 0 {
+		diff := c.vardiff.Clamp(c.suggestedDiff)
+		c.log.Info("Using difficulty suggested by miner", "diff", diff)
+		c.setDiff(diff)
+	} else if diff, ok := c.port.WorkerDiffs.Load(c.username, c.worker, time.Now()); ok {
+		c.log.Info("Resuming worker's last difficulty", "diff", diff)
+		c.setDiff(c.vardiff.Clamp(diff))
+	} else {
+		c.updateDiff()
+	}
+	c.payoutCurrencies = parsePayoutCurrencies(password)
+	if c.payoutCurrencies != nil {
+		c.log.Info("Using payout currencies from password", "currencies", c.payoutCurrencies)
+	}
+	if prefs := parsePayoutPreferences(password); prefs != nil {
+		c.port.PayoutPrefs.Save(c.username, prefs)
+	}
 	c.log.Debug("Subscribing to jobs")
 	c.jobCast.Register(c.jobListener)
 	// Start the time window for hashrate average right now
 	c.shareWindow.Add(0)
 }
 
+// Usernames are pool accounts. A miner set up with its wallet address
+// instead would never be credited for its shares, so it's refused with an
+// error the miner will show. Checked with the lane currency's address codec
+func (c *StratumClient) usernameIsAddress() bool {
+	codec, err := common.GetAddressCodec(c.lane.key.Currency)
+	if err != nil {
+		return false
+	}
+	_, err = codec.PayToScript(c.username)
+	return err == nil
+}
+
 func parseUser(input string) (string, string) {
 	// We ignore passwords. Trim worker name just in case
 	var username, worker string
@@ -342,6 +683,8 @@ func (c *StratumClient) readLoop() {
 			c.sendError(nil, StratumErrorOther)
 			return
 		}
+		atomic.StoreInt64(&c.lastMessageAt, time.Now().UnixNano())
+		c.trace("in", raw)
 		var msg StratumMessage
 		err = json.Unmarshal(raw, &msg)
 		if err != nil {
@@ -350,19 +693,50 @@ func (c *StratumClient) readLoop() {
 			}
 			c.log.Warn("Error unmarshaling", "err", err, "content", string(raw))
 			c.sendError(nil, StratumErrorOther)
+			c.protocolError(ProtocolParseError)
+			if c.hasShutdown {
+				return
+			}
 			continue
 		}
 		if msg.ID == nil {
 			c.log.Warn("Null ID from StratumMessage")
 			c.sendError(nil, StratumErrorOther)
+			c.protocolError(ProtocolParseError)
+			if c.hasShutdown {
+				return
+			}
 			continue
 		}
 		c.log.Debug("Recieve", "msg", msg)
 		switch msg.Method {
+		case "mining.configure":
+			mc, err := DecodeMiningConfigure(msg.Params)
+			if err != nil {
+				c.sendError(msg.ID, StratumErrorOther)
+				c.protocolError(ProtocolParseError)
+				break
+			}
+			result, mask, err := mc.negotiate(c.port.VersionRollingMask)
+			if err != nil {
+				c.sendError(msg.ID, StratumErrorOther)
+				c.protocolError(ProtocolParseError)
+				break
+			}
+			atomic.StoreUint32(&c.versionMask, mask)
+			err = c.send(&StratumResponse{
+				ID:     msg.ID,
+				Result: result,
+			})
+			if err != nil {
+				c.log.Error("Failed write response", "err", err)
+				return
+			}
 		case "mining.subscribe":
 			if c.subscribed {
 				c.sendError(msg.ID, StratumErrorOther)
-				continue
+				c.protocolError(ProtocolOutOfOrder)
+				break
 			}
 			ms := DecodeMiningSubscribe(msg.Params)
 			if ms.UserAgent != "" {
@@ -380,8 +754,11 @@ func (c *StratumClient) readLoop() {
 						[]interface{}{"mining.set_difficulty", diffSub},
 						[]interface{}{"mining.notify", notifySub},
 					},
-					c.id, // A per connection extranonce to ensure they're iterating different attempts from peers
-					4,    // extranonce2 size (the one they iterate)
+					// A per connection extranonce to ensure they're iterating
+					// different attempts from peers
+					c.id,
+					// extranonce2 size (the one they iterate)
+					c.port.Extranonces.Extranonce2Size(),
 				}})
 			if err != nil {
 				c.log.Error("Failed write response", "err", err)
@@ -391,7 +768,8 @@ func (c *StratumClient) readLoop() {
 		case "mining.authorize":
 			if !c.subscribed {
 				c.sendError(msg.ID, StratumErrorNotSubbed)
-				continue
+				c.protocolError(ProtocolOutOfOrder)
+				break
 			}
 			ma, err := DecodeMiningAuthorize(msg.Params)
 			if err != nil {
@@ -399,6 +777,12 @@ func (c *StratumClient) readLoop() {
 				continue
 			}
 			c.username, c.worker = parseUser(ma.Username)
+			if c.usernameIsAddress() {
+				c.log.Info("Refusing a payout address as username", "username", c.username)
+				c.username, c.worker = "", ""
+				c.sendError(msg.ID, StratumErrorUnauth)
+				break
+			}
 			err = c.send(&StratumResponse{
 				ID:     msg.ID,
 				Result: true,
@@ -407,11 +791,12 @@ func (c *StratumClient) readLoop() {
 				c.log.Error("Failed write response", "err", err)
 				return
 			}
-			c.authorize()
+			c.authorize(ma.Password)
 		case "mining.submit":
 			if !c.subscribed {
 				c.sendError(msg.ID, StratumErrorNotSubbed)
-				continue
+				c.protocolError(ProtocolOutOfOrder)
+				break
 			}
 			ms, err := DecodeMiningSubmit(msg.Params)
 			if err != nil {
@@ -419,40 +804,90 @@ func (c *StratumClient) readLoop() {
 				continue
 			}
 			ms.ID = msg.ID
-			c.submit <- ms
+			c.submitShare(ms)
 		// JSON RPC 2.0 -------------------------------------
-		case "submit":
-			var ms2 MiningSubmit2
-			err := mapstructure.Decode(msg.Params, &ms2)
-			if err != nil {
+		case "login":
+			if c.subscribed || c.rpcVersion2 {
 				c.sendError(msg.ID, StratumErrorOther)
-				continue
-			}
-
-			nonce, _ := hex.DecodeString(ms2.Nonce)
-			ms := &MiningSubmit{
-				JobID:       ms2.JobID,
-				Nonce:       nonce,
-				Extranonce2: []byte{0, 0, 0, 0},
+				c.protocolError(ProtocolOutOfOrder)
+				break
 			}
-			c.submit <- ms
-		case "login":
-			c.rpcVersion2 = true
-			c.loginMsgID = *msg.ID
 			var login Login
 			err := mapstructure.Decode(msg.Params, &login)
-			if err != nil {
+			if err != nil || login.Login == "" {
 				c.sendError(msg.ID, StratumErrorOther)
 				continue
 			}
+			c.rpcVersion2 = true
+			c.loginMsgID = *msg.ID
 			c.username, c.worker = parseUser(login.Login)
+			if c.usernameIsAddress() {
+				c.log.Info("Refusing a payout address as username", "username", c.username)
+				c.username, c.worker = "", ""
+				c.sendError(msg.ID, StratumErrorUnauth)
+				c.rpcVersion2 = false
+				break
+			}
 			c.attrs["useragent"] = login.Agent
-			c.authorize()
+			c.authorize(login.Pass)
+		case "getjob":
+			if !c.checkSession(msg.ID, msg.Params) {
+				break
+			}
+			// The write loop answers it, and may already have quit
+			select {
+			case c.getJob <- msg.ID:
+			case <-c.shutdown:
+				return
+			}
+		case "submit":
+			if !c.checkSession(msg.ID, msg.Params) {
+				break
+			}
+			ms, err := DecodeMiningSubmit2(msg.Params)
+			if err != nil {
+				c.sendError(msg.ID, StratumErrorOther)
+				c.protocolError(ProtocolParseError)
+				break
+			}
+			ms.ID = msg.ID
+			c.submitShare(ms)
+		case "keepalived":
+			if !c.checkSession(msg.ID, msg.Params) {
+				break
+			}
+			err = c.send(&Stratum2Response{
+				ID:      msg.ID,
+				JSONRPC: "2.0",
+				Result:  map[string]interface{}{"status": "KEEPALIVED"},
+			})
+			if err != nil {
+				c.log.Error("Failed write response", "err", err)
+				return
+			}
+		case "mining.suggest_difficulty", "mining.suggest_target":
+			if !c.suggestDiff(&msg) {
+				return
+			}
 		case "mining.extranonce.subscribe":
-			// Signal that we do not support this method
-			c.sendError(msg.ID, StratumErrorOther)
+			// NiceHash requires this to be acknowledged. We never change
+			// extranonce1 on an open connection, so there's nothing else to
+			// do. Otherwise signal that we do not support this method
+			if c.port.NiceHash {
+				err = c.send(&StratumResponse{
+					ID:     msg.ID,
+					Result: true,
+				})
+				if err != nil {
+					c.log.Error("Failed write response", "err", err)
+					return
+				}
+			} else {
+				c.sendError(msg.ID, StratumErrorOther)
+			}
 		default:
 			c.log.Warn("Invalid message method", "method", msg.Method)
+			c.protocolError(ProtocolUnknownMethod)
 		}
 
 		if c.hasShutdown {
@@ -461,13 +896,53 @@ func (c *StratumClient) readLoop() {
 	}
 }
 
+// JSON-RPC 2.0 requests after login must carry the session id we gave out.
+// Sends an error and returns false if they don't
+func (c *StratumClient) checkSession(id *int64, params interface{}) bool {
+	if !c.rpcVersion2 || !c.subscribed {
+		c.sendError(id, StratumErrorUnauth)
+		c.protocolError(ProtocolOutOfOrder)
+		return false
+	}
+	var session Stratum2Session
+	err := mapstructure.Decode(params, &session)
+	if err != nil || session.ID != c.id {
+		c.sendError(id, StratumErrorUnauth)
+		c.protocolError(ProtocolOutOfOrder)
+		return false
+	}
+	return true
+}
+
 func (c *StratumClient) sendError(id *int64, code int) error {
-	err := stratumErrors[code]
+	return c.sendStratumError(id, stratumErrors[code])
+}
+
+// Tells the miner why their share was rejected, and counts it against them
+func (c *StratumClient) rejectShare(id *int64, result ShareResult) error {
+	c.log.Debug("Rejecting share", "reason", result)
+	incrShareStat(&c.shareStats, result)
+	incrShareStat(&c.port.Shares, result)
+	return c.sendStratumError(id, shareRejectErrors[result])
+}
+
+func (c *StratumClient) sendStratumError(id *int64, err *StratumError) error {
+	if c.rpcVersion2 {
+		return c.send(&Stratum2Response{
+			ID:      id,
+			JSONRPC: "2.0",
+			Error:   &Stratum2Error{Code: -1, Message: err.Desc},
+		})
+	}
 	resp := &StratumResponse{
 		ID:     id,
 		Result: nil,
 		Error:  []interface{}{err.Code, err.Desc, err.TB},
 	}
+	// NiceHash treats a null result as a protocol error rather than a reject
+	if c.port.NiceHash {
+		resp.Result = false
+	}
 	return c.send(resp)
 }
 
@@ -478,10 +953,58 @@ func (c *StratumClient) send(respObj interface{}) error {
 	}
 	resp = append(resp, '\n')
 	c.log.Debug("Sending response", "resp", respObj)
-	c.write <- resp
+	c.enqueue(net.Buffers{resp})
 	return nil
 }
 
+// Queues a message for flushLoop. Validator goroutines and job broadcasts
+// send too, and mustn't get stuck on a client, so one that lets SendQueue
+// messages back up is disconnected
+func (c *StratumClient) enqueue(msg net.Buffers) {
+	c.trace("out", msg...)
+	select {
+	case c.write <- msg:
+	case <-c.shutdown:
+	default:
+		c.log.Info("Send queue full, disconnecting")
+		c.port.SlowConsumers.addQueueFull()
+		c.Stop()
+	}
+}
+
+// Writes queued messages to the connection. Everything waiting goes out in
+// one vectored write, so a clean job storm doesn't cost a syscall per message
+func (c *StratumClient) flushLoop() {
+	defer c.Stop()
+	for {
+		var bufs net.Buffers
+		select {
+		case <-c.shutdown:
+			return
+		case msg := <-c.write:
+			bufs = append(bufs, msg...)
+		}
+	drain:
+		for {
+			select {
+			case msg := <-c.write:
+				bufs = append(bufs, msg...)
+			default:
+				break drain
+			}
+		}
+		err := writeWithDeadline(c.conn, bufs, c.port.WriteTimeout)
+		if isTimeout(err) {
+			c.log.Info("Write timed out, disconnecting", "timeout", c.port.WriteTimeout)
+			c.port.SlowConsumers.addWriteTimeout()
+			return
+		} else if err != nil {
+			c.log.Debug("Error writing", "err", err)
+			return // Disconnect
+		}
+	}
+}
+
 func randomString() string {
 	randBytes := make([]byte, 4)
 	rand.Read(randBytes)
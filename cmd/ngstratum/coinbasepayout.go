@@ -0,0 +1,259 @@
+package main
+
+import (
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+
+	"github.com/icook/ngpool/pkg/common"
+	"github.com/icook/ngpool/pkg/service"
+)
+
+// The PPLNS window is this many times the shares a block is expected to take,
+// the same as ngweb's pplns payout method
+const coinbasePPLNSN = 2
+
+// Gets the sharechain fee, rounding, and shares from unknown usernames, as in
+// ngweb
+const feeUserID = 1
+
+// A miner's part of a block on a "coinbase" payout sharechain. Those with an
+// Address are paid an output of the coinbase. The rest are held in the output
+// to BlockSubsidyAddress, and ngweb credits them from coinbase_payout
+type CoinbasePayee struct {
+	UserID  int
+	Address string
+	Amount  int64
+	script  []byte
+}
+
+// A snapshot of the sharechain's PPLNS window and its miners' payout
+// addresses on one currency, which coinbases are split by
+type PayoutWindow struct {
+	// Share difficulty by user id
+	shares map[int]float64
+	total  float64
+	// By user id, only for users with a valid payout address
+	addresses map[int]string
+	scripts   map[int][]byte
+	fee       float64
+	maxPayees int
+	dust      int64
+}
+
+// Splits value, what the pool keeps of the coinbase after required payees and
+// CoinbaseSplits, between the window's miners. Up to maxPayees with a payout
+// address and at least dust owed are paid directly, largest first. The
+// returned payees add up to value
+func (w *PayoutWindow) split(value int64) []*CoinbasePayee {
+	if w == nil || w.total <= 0 {
+		return nil
+	}
+	payable := value - int64(w.fee*float64(value))
+	ids := []int{}
+	for id := range w.shares {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	var (
+		payees   []*CoinbasePayee
+		assigned int64
+	)
+	for _, id := range ids {
+		amount := int64(w.shares[id] / w.total * float64(payable))
+		if amount <= 0 {
+			continue
+		}
+		payees = append(payees, &CoinbasePayee{UserID: id, Amount: amount})
+		assigned += amount
+	}
+	sort.SliceStable(payees, func(i, j int) bool {
+		return payees[i].Amount > payees[j].Amount
+	})
+
+	var direct int
+	var feePayee *CoinbasePayee
+	for _, p := range payees {
+		if p.UserID == feeUserID {
+			feePayee = p
+			continue
+		}
+		script, ok := w.scripts[p.UserID]
+		if !ok || p.Amount < w.dust || direct >= w.maxPayees {
+			continue
+		}
+		p.Address = w.addresses[p.UserID]
+		p.script = script
+		direct++
+	}
+	// The fee and whatever rounding left behind
+	if rest := value - assigned; rest > 0 {
+		if feePayee == nil {
+			feePayee = &CoinbasePayee{UserID: feeUserID}
+			payees = append(payees, feePayee)
+		}
+		feePayee.Amount += rest
+	}
+	// Directly paid first, in output order
+	sort.SliceStable(payees, func(i, j int) bool {
+		return payees[i].Address != "" && payees[j].Address == ""
+	})
+	return payees
+}
+
+// CoinbasePayouts keeps a PayoutWindow per currency up to date from the
+// database. A window's length depends on the block target, so it's taken
+// from the latest job for the currency
+type CoinbasePayouts struct {
+	db         *sqlx.DB
+	shareChain *service.ShareChainConfig
+	interval   time.Duration
+
+	// Block target by currency code
+	targets map[string]*big.Int
+	windows map[string]*PayoutWindow
+	mtx     sync.Mutex
+}
+
+func NewCoinbasePayouts(db *sqlx.DB, shareChain *service.ShareChainConfig,
+	interval time.Duration) *CoinbasePayouts {
+	return &CoinbasePayouts{
+		db:         db,
+		shareChain: shareChain,
+		interval:   interval,
+		targets:    map[string]*big.Int{},
+		windows:    map[string]*PayoutWindow{},
+	}
+}
+
+// The latest window for currency, nil until one has been loaded. Jobs built
+// without a window pay everything to BlockSubsidyAddress, and ngweb credits
+// their blocks as PPLNS
+func (c *CoinbasePayouts) Window(currency string, target *big.Int) *PayoutWindow {
+	if c == nil {
+		return nil
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	_, known := c.targets[currency]
+	c.targets[currency] = target
+	if !known {
+		go c.refresh(currency)
+	}
+	return c.windows[currency]
+}
+
+func (c *CoinbasePayouts) Run() {
+	ticker := time.NewTicker(c.interval)
+	for range ticker.C {
+		c.mtx.Lock()
+		currencies := []string{}
+		for currency := range c.targets {
+			currencies = append(currencies, currency)
+		}
+		c.mtx.Unlock()
+		for _, currency := range currencies {
+			c.refresh(currency)
+		}
+	}
+}
+
+func (c *CoinbasePayouts) refresh(currency string) {
+	c.mtx.Lock()
+	target := c.targets[currency]
+	c.mtx.Unlock()
+	window, err := c.load(currency, target)
+	if err != nil {
+		log.Error("Failed to load coinbase payout window", "currency", currency, "err", err)
+		return
+	}
+	log.Debug("Loaded coinbase payout window", "currency", currency,
+		"users", len(window.shares), "addresses", len(window.addresses),
+		"difficulty", window.total)
+	c.mtx.Lock()
+	c.windows[currency] = window
+	c.mtx.Unlock()
+}
+
+func (c *CoinbasePayouts) load(currency string, target *big.Int) (*PayoutWindow, error) {
+	config, ok := service.Currency(currency)
+	if !ok {
+		return nil, errors.Errorf("No currency config for %s", currency)
+	}
+	blockTarget, _ := new(big.Float).SetInt(target).Float64()
+	sharesToFind, _ := c.shareChain.Algo.Diff1SharesForTarget(blockTarget)
+	sharesToFind *= coinbasePPLNSN
+
+	// The newest shares until there's sharesToFind, including the one that
+	// crosses it, like ngweb's collectShares. Each is credited by what its
+	// miner picked with pc=, as in ngweb's payoutWeightSQL
+	var rows []struct {
+		UserID     *int `db:"id"`
+		Difficulty float64
+	}
+	err := c.db.Select(&rows,
+		`SELECT users.id, SUM(window_share.credited) AS difficulty FROM (
+			SELECT username, difficulty,
+			difficulty * COALESCE((payout_weights->>$3)::float8,
+				CASE WHEN payout_weights IS NULL THEN 1 ELSE 0 END) AS credited,
+			SUM(difficulty) OVER (ORDER BY mined_at DESC) AS running
+			FROM share WHERE sharechain = $1
+		) window_share
+		LEFT JOIN users ON users.username = window_share.username
+		WHERE window_share.running - window_share.difficulty < $2
+		GROUP BY users.id`,
+		c.shareChain.Name, sharesToFind, currency)
+	if err != nil {
+		return nil, errors.Wrap(err, "Loading PPLNS window")
+	}
+	window := &PayoutWindow{
+		shares:    map[int]float64{},
+		addresses: map[int]string{},
+		scripts:   map[int][]byte{},
+		fee:       c.shareChain.Fee,
+		maxPayees: config.CoinbaseMaxPayees,
+		dust:      config.DustThreshold,
+	}
+	for _, row := range rows {
+		userID := feeUserID
+		if row.UserID != nil {
+			userID = *row.UserID
+		}
+		window.shares[userID] += row.Difficulty
+		window.total += row.Difficulty
+	}
+
+	var addresses []struct {
+		UserID  int `db:"user_id"`
+		Address string
+	}
+	err = c.db.Select(&addresses,
+		`SELECT user_id, address FROM payout_address
+		WHERE currency = $1 AND address IS NOT NULL`, currency)
+	if err != nil {
+		return nil, errors.Wrap(err, "Loading payout addresses")
+	}
+	codec, err := common.GetAddressCodec(currency)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addresses {
+		if _, ok := window.shares[a.UserID]; !ok {
+			continue
+		}
+		script, err := codec.PayToScript(a.Address)
+		if err != nil {
+			log.Warn("Invalid payout address, user will be credited instead",
+				"user_id", a.UserID, "currency", currency, "err", err)
+			continue
+		}
+		window.addresses[a.UserID] = a.Address
+		window.scripts[a.UserID] = script
+	}
+	return window, nil
+}
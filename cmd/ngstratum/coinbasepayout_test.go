@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/icook/ngpool/pkg/service"
+)
+
+func testPayoutWindow() *PayoutWindow {
+	return &PayoutWindow{
+		shares: map[int]float64{
+			feeUserID: 10,
+			2:         50,
+			3:         30,
+			4:         9.95,
+			5:         0.05,
+		},
+		total: 100,
+		addresses: map[int]string{
+			2: "two",
+			3: "three",
+			5: "five",
+		},
+		scripts: map[int][]byte{
+			2: {2},
+			3: {3},
+			5: {5},
+		},
+		fee:       0.01,
+		maxPayees: 10,
+		dust:      546,
+	}
+}
+
+func TestPayoutWindowSplit(t *testing.T) {
+	w := testPayoutWindow()
+	payees := w.split(1000000)
+	var total int64
+	for _, p := range payees {
+		total += p.Amount
+	}
+	assert.Equal(t, int64(1000000), total)
+
+	// Largest first among the directly paid. 4 has no address and 5 is owed
+	// less than dust, so they're held with the fee
+	assert.Len(t, payees, 5)
+	assert.Equal(t, 2, payees[0].UserID)
+	assert.Equal(t, "two", payees[0].Address)
+	assert.Equal(t, int64(495000), payees[0].Amount)
+	assert.Equal(t, 3, payees[1].UserID)
+	assert.Equal(t, int64(297000), payees[1].Amount)
+	held := map[int]int64{}
+	for _, p := range payees[2:] {
+		assert.Equal(t, "", p.Address)
+		held[p.UserID] = p.Amount
+	}
+	assert.Equal(t, int64(98504), held[4])
+	assert.Equal(t, int64(495), held[5])
+	// Its own 10% of 990000, the 1% fee and rounding
+	assert.Equal(t, int64(109001), held[feeUserID])
+
+	// Past maxPayees the smallest wait to be credited
+	w.maxPayees = 1
+	payees = w.split(1000000)
+	assert.Equal(t, "two", payees[0].Address)
+	assert.Equal(t, "", payees[1].Address)
+
+	// Nothing to split without shares, or without a window at all
+	assert.Nil(t, (&PayoutWindow{}).split(1000000))
+	var none *PayoutWindow
+	assert.Nil(t, none.split(1000000))
+}
+
+func TestCoinbasePayoutOutputs(t *testing.T) {
+	params := &chaincfg.TestNet3Params
+	subsidyAddr, _ := btcutil.DecodeAddress("mucHkBoHAF8DTQWFuwQXHiewqi3ZBDNNWh", params)
+	config := &service.ChainConfig{
+		Code:                "LTC_T",
+		Params:              params,
+		BlockSubsidyAddress: &subsidyAddr,
+	}
+	tmpl := BlockTemplate{
+		CoinbaseValue: 1000000,
+		payoutWindow:  testPayoutWindow(),
+	}
+	subsidy, payees, err := tmpl.poolSubsidy(config)
+	assert.NoError(t, err)
+	assert.Len(t, payees, 5)
+
+	outputs, err := tmpl.coinbaseOutputs(config)
+	assert.NoError(t, err)
+	assert.Len(t, outputs, 3)
+	assert.Equal(t, []byte{2}, outputs[1].PkScript)
+	assert.Equal(t, int64(495000), outputs[1].Value)
+	assert.Equal(t, []byte{3}, outputs[2].PkScript)
+	// What was held back stays with the pool for ngweb to credit
+	assert.Equal(t, int64(208000), outputs[0].Value)
+	assert.Equal(t, outputs[0].Value, subsidy)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/icook/ngpool/pkg/stratumtest"
+)
+
+var updateGolden = flag.Bool("update", false, "Rewrite golden files from this run")
+
+// Runs the stratumtest suite against a devserve style server, comparing each
+// transcript with testdata/conformance. After an intended protocol change,
+// regenerate them with go test -run Conformance -update
+func TestConformance(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Starts a stratum server")
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	ng := NewStratumServer()
+	defer ng.Stop()
+	ng.ConfigureDev("sha256d", addr)
+	ng.config.Set("LogLevel", "crit")
+	ng.ParseConfig()
+	// A real difficulty, so the suite's zero nonces never make a block
+	src := NewMockTemplateSource(ng.port.Lanes.lanes[0].key, time.Hour, "1d00ffff",
+		ng.newTemplate, ng.getBlockCast(devCurrency))
+	src.Start()
+	ng.templateSources = append(ng.templateSources, src)
+	ng.Start()
+
+	vars := stratumtest.DefaultVars()
+	// A fixed difficulty, which set_difficulty echoes
+	vars.Password = "d=1"
+	// Miners connecting before the first job are dropped, so wait for one
+	deadline := time.Now().Add(time.Second * 10)
+	for {
+		result := stratumtest.Check(addr, stratumtest.Suite[:1], vars, time.Second)[0]
+		if result.Err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Server never came up: ", result.Err)
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+
+	for _, result := range stratumtest.Check(addr, stratumtest.Suite, vars, time.Second*5) {
+		assert.NoError(t, result.Err)
+		path := filepath.Join("testdata", "conformance", result.Script.Name+".golden")
+		assert.NoError(t, stratumtest.Golden(path, result.Transcript, *updateGolden))
+	}
+}
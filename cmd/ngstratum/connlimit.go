@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cast"
+)
+
+// Limits on stratum connections from one source. 0 disables each. Rates are
+// new connections per minute
+type ConnLimits struct {
+	PerIP      int
+	PerASN     int
+	RatePerIP  int
+	RatePerASN int
+}
+
+func (l ConnLimits) enabled() bool {
+	return l.PerIP > 0 || l.PerASN > 0 || l.RatePerIP > 0 || l.RatePerASN > 0
+}
+
+// A source allowed more connections than the defaults, ie a proxy farm
+// funnelling many rigs through a few IPs
+type connOverride struct {
+	network *net.IPNet
+	asn     uint32
+	// Concurrent connections allowed, 0 for no limit
+	max int
+}
+
+type connCount struct {
+	open int
+	// Connections started in the current minute
+	window      time.Time
+	windowCount int
+}
+
+// ConnLimiter stops a single IP or network (by AS number) from taking every
+// connection slot, ie a botnet or a misconfigured farm reconnecting in a
+// loop. Checked once the client's real IP is known, after any PROXY header
+type ConnLimiter struct {
+	limits    ConnLimits
+	overrides []*connOverride
+	asnDB     *ASNDatabase
+
+	ips      map[string]*connCount
+	asns     map[uint32]*connCount
+	rejected map[string]uint64
+	mtx      sync.Mutex
+}
+
+// overrides are keyed by a CIDR, a single IP or an AS number ("AS13335"),
+// with the number of concurrent connections to allow. For a CIDR that's per
+// IP in it. Matching sources skip every other limit
+func NewConnLimiter(limits ConnLimits, overrides map[string]interface{},
+	asnDB *ASNDatabase) (*ConnLimiter, error) {
+	if !limits.enabled() {
+		return nil, nil
+	}
+	if (limits.PerASN > 0 || limits.RatePerASN > 0) && asnDB == nil {
+		return nil, errors.New("ASN limits need an ASNDatabase")
+	}
+	l := &ConnLimiter{
+		limits:   limits,
+		asnDB:    asnDB,
+		ips:      map[string]*connCount{},
+		asns:     map[uint32]*connCount{},
+		rejected: map[string]uint64{},
+	}
+	for key, raw := range overrides {
+		max, err := cast.ToIntE(raw)
+		if err != nil || max < 0 {
+			return nil, errors.Errorf("Invalid connection limit %v for %s", raw, key)
+		}
+		o := &connOverride{max: max}
+		upper := strings.ToUpper(key)
+		if strings.HasPrefix(upper, "AS") {
+			asn, err := strconv.ParseUint(upper[2:], 10, 32)
+			if err != nil {
+				return nil, errors.Errorf("Invalid AS number %s", key)
+			}
+			o.asn = uint32(asn)
+		} else {
+			cidr := key
+			if !strings.Contains(cidr, "/") {
+				ip := net.ParseIP(cidr)
+				if ip == nil {
+					return nil, errors.Errorf("Invalid IP %s", key)
+				}
+				bits := 128
+				if ip.To4() != nil {
+					bits = 32
+				}
+				cidr += "/" + strconv.Itoa(bits)
+			}
+			_, o.network, err = net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, err
+			}
+		}
+		l.overrides = append(l.overrides, o)
+	}
+	return l, nil
+}
+
+func (l *ConnLimiter) override(ip net.IP, asn uint32) *connOverride {
+	for _, o := range l.overrides {
+		if o.network != nil && ip != nil && o.network.Contains(ip) {
+			return o
+		}
+		if o.asn != 0 && o.asn == asn {
+			return o
+		}
+	}
+	return nil
+}
+
+// Returns the limit a new connection would break, or "" if there's room.
+// Starts a new rate window when the minute has turned
+func (c *connCount) check(max int, rate int, now time.Time) string {
+	if max > 0 && c.open >= max {
+		return "connections"
+	}
+	minute := now.Truncate(time.Minute)
+	if !c.window.Equal(minute) {
+		c.window = minute
+		c.windowCount = 0
+	}
+	if rate > 0 && c.windowCount >= rate {
+		return "rate"
+	}
+	return ""
+}
+
+// Takes a connection slot for ip, returning a func to give it back when the
+// connection closes. Errors say which limit was hit
+func (l *ConnLimiter) Acquire(ip string, now time.Time) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	parsed := net.ParseIP(ip)
+	var asn uint32
+	if l.asnDB != nil && parsed != nil {
+		asn = l.asnDB.Lookup(parsed)
+	}
+
+	maxIP, maxASN := l.limits.PerIP, l.limits.PerASN
+	rateIP, rateASN := l.limits.RatePerIP, l.limits.RatePerASN
+	if o := l.override(parsed, asn); o != nil {
+		maxIP, maxASN, rateIP, rateASN = 0, 0, 0, 0
+		if o.network != nil {
+			maxIP = o.max
+		} else {
+			maxASN = o.max
+		}
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	ipCount, ok := l.ips[ip]
+	if !ok {
+		ipCount = &connCount{}
+		l.ips[ip] = ipCount
+	}
+	if reason := ipCount.check(maxIP, rateIP, now); reason != "" {
+		l.rejected["ip_"+reason]++
+		return nil, errors.Errorf("Too many %s from IP", reason)
+	}
+	var asnCount *connCount
+	if asn != 0 {
+		asnCount, ok = l.asns[asn]
+		if !ok {
+			asnCount = &connCount{}
+			l.asns[asn] = asnCount
+		}
+		if reason := asnCount.check(maxASN, rateASN, now); reason != "" {
+			l.rejected["asn_"+reason]++
+			return nil, errors.Errorf("Too many %s from AS%d", reason, asn)
+		}
+	}
+
+	ipCount.open++
+	ipCount.windowCount++
+	if asnCount != nil {
+		asnCount.open++
+		asnCount.windowCount++
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mtx.Lock()
+			defer l.mtx.Unlock()
+			ipCount.open--
+			if asnCount != nil {
+				asnCount.open--
+			}
+		})
+	}, nil
+}
+
+// Forgets sources with no open connections whose rate window has passed
+func (l *ConnLimiter) Prune(now time.Time) {
+	if l == nil {
+		return
+	}
+	minute := now.Truncate(time.Minute)
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	for ip, count := range l.ips {
+		if count.open == 0 && count.window.Before(minute) {
+			delete(l.ips, ip)
+		}
+	}
+	for asn, count := range l.asns {
+		if count.open == 0 && count.window.Before(minute) {
+			delete(l.asns, asn)
+		}
+	}
+}
+
+type connLimitStatus struct {
+	// Connections refused, by limit hit
+	Rejected map[string]uint64 `json:"rejected"`
+	// The networks holding the most connections
+	TopASNs map[string]int `json:"top_asns"`
+}
+
+// Number of networks listed in the status
+const connLimitTopASNs = 10
+
+func (l *ConnLimiter) Stats() *connLimitStatus {
+	if l == nil {
+		return nil
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	status := &connLimitStatus{
+		Rejected: map[string]uint64{},
+		TopASNs:  map[string]int{},
+	}
+	for reason, count := range l.rejected {
+		status.Rejected[reason] = count
+	}
+	type asnOpen struct {
+		asn  uint32
+		open int
+	}
+	var top []asnOpen
+	for asn, count := range l.asns {
+		if count.open == 0 {
+			continue
+		}
+		top = append(top, asnOpen{asn, count.open})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].open != top[j].open {
+			return top[i].open > top[j].open
+		}
+		return top[i].asn < top[j].asn
+	})
+	for i, entry := range top {
+		if i == connLimitTopASNs {
+			break
+		}
+		status.TopASNs[fmt.Sprintf("AS%d", entry.asn)] = entry.open
+	}
+	return status
+}
+
+// Closes its slot with the ConnLimiter when the connection closes, however
+// that happens
+type limitedConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	c.release()
+	return c.Conn.Close()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnLimiterPerIP(t *testing.T) {
+	l, err := NewConnLimiter(ConnLimits{PerIP: 2}, nil, nil)
+	assert.NoError(t, err)
+	now := time.Now()
+	release1, err := l.Acquire("10.0.0.1", now)
+	assert.NoError(t, err)
+	_, err = l.Acquire("10.0.0.1", now)
+	assert.NoError(t, err)
+	_, err = l.Acquire("10.0.0.1", now)
+	assert.Error(t, err)
+	_, err = l.Acquire("10.0.0.2", now)
+	assert.NoError(t, err)
+
+	// Releasing twice only gives back one slot
+	release1()
+	release1()
+	_, err = l.Acquire("10.0.0.1", now)
+	assert.NoError(t, err)
+	_, err = l.Acquire("10.0.0.1", now)
+	assert.Error(t, err)
+	assert.Equal(t, uint64(2), l.Stats().Rejected["ip_connections"])
+
+	disabled, err := NewConnLimiter(ConnLimits{}, nil, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, disabled)
+	release, err := disabled.Acquire("10.0.0.1", now)
+	assert.NoError(t, err)
+	release()
+}
+
+func TestConnLimiterRate(t *testing.T) {
+	l, err := NewConnLimiter(ConnLimits{RatePerIP: 2}, nil, nil)
+	assert.NoError(t, err)
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 2; i++ {
+		release, err := l.Acquire("10.0.0.1", now)
+		assert.NoError(t, err)
+		release()
+	}
+	_, err = l.Acquire("10.0.0.1", now.Add(time.Second*30))
+	assert.Error(t, err)
+	_, err = l.Acquire("10.0.0.1", now.Add(time.Minute))
+	assert.NoError(t, err)
+}
+
+func TestConnLimiterASN(t *testing.T) {
+	db, err := ReadASNDatabase(strings.NewReader(testASNTable))
+	assert.NoError(t, err)
+	_, err = NewConnLimiter(ConnLimits{PerASN: 2}, nil, nil)
+	assert.Error(t, err)
+
+	l, err := NewConnLimiter(ConnLimits{PerIP: 1, PerASN: 2},
+		map[string]interface{}{"AS38803": 0, "1.0.0.7": 5}, db)
+	assert.NoError(t, err)
+	now := time.Now()
+	_, err = l.Acquire("1.0.0.1", now)
+	assert.NoError(t, err)
+	_, err = l.Acquire("1.0.0.2", now)
+	assert.NoError(t, err)
+	// Another IP, but the same network
+	_, err = l.Acquire("1.0.0.3", now)
+	assert.Error(t, err)
+	assert.Equal(t, map[string]int{"AS13335": 2}, l.Stats().TopASNs)
+
+	// A proxy farm with its own limit
+	for i := 0; i < 5; i++ {
+		_, err = l.Acquire("1.0.0.7", now)
+		assert.NoError(t, err)
+	}
+	_, err = l.Acquire("1.0.0.7", now)
+	assert.Error(t, err)
+
+	// Unlimited network
+	for i := 0; i < 10; i++ {
+		_, err = l.Acquire("1.0.5.1", now)
+		assert.NoError(t, err)
+	}
+
+	_, err = NewConnLimiter(ConnLimits{PerIP: 1}, map[string]interface{}{"ASx": 1}, nil)
+	assert.Error(t, err)
+	_, err = NewConnLimiter(ConnLimits{PerIP: 1}, map[string]interface{}{"10.0.0.0/33": 1}, nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sync/atomic"
+
+	log "github.com/inconshreveable/log15"
+
+	"github.com/icook/ngpool/pkg/logging"
+	"github.com/icook/ngpool/pkg/service"
+)
+
+// Config keys reconcilePorts applies
+var portKeys = []string{"Ports", "PortDrainTimeout", "VardiffMin", "VardiffMax",
+	"VardiffTarget", "DiffMultiplier", "FastAck"}
+
+// Registers handlers for the commands ngctl svc sends, and starts watching
+// for them
+func (n *StratumServer) setupControl() {
+	n.service.HandleControl(service.ControlReloadConfig, n.reloadConfig)
+	n.service.HandleControl(service.ControlRotateLogs, func(service.ControlCommand) error {
+		return n.logs.Reopen()
+	})
+	n.service.HandleControl(service.ControlDrain, func(service.ControlCommand) error {
+		atomic.StoreInt32(&n.draining, 1)
+		log.Info("Draining, no longer accepting miners")
+		return nil
+	})
+	n.service.HandleControl(service.ControlSnapshot, func(service.ControlCommand) error {
+		return n.saveSnapshot()
+	})
+	n.service.BeforeRestart(n.Stop)
+	go n.service.WatchControl()
+}
+
+// LogLevel, LogModules, LogFormat, TraceSessions and the ports we listen on
+// apply without a restart. Everything else is read once at startup
+func (n *StratumServer) reloadConfig(service.ControlCommand) error {
+	config, err := n.service.FetchConfig()
+	if err != nil {
+		return err
+	}
+	if err := n.logs.Reload(config); err != nil {
+		return err
+	}
+	if err := n.reconcilePorts(config); err != nil {
+		return err
+	}
+	for _, key := range portKeys {
+		n.config.Set(key, config.Get(key))
+	}
+	n.retrace(config.GetStringSlice("TraceSessions"))
+	n.config.Set("TraceSessions", config.Get("TraceSessions"))
+	live := append([]string{"TraceSessions"}, portKeys...)
+	pending := service.ChangedKeys(n.config, config, append(live, logging.RuntimeKeys...)...)
+	if len(pending) > 0 {
+		log.Warn("Config changes need a restart to apply", "keys", pending)
+	}
+	return nil
+}
+
+// A draining server turns away new miners and fails /readyz, so load
+// balancers stop sending them, while connected miners carry on until they
+// leave or we're restarted
+func (n *StratumServer) isDraining() bool {
+	return atomic.LoadInt32(&n.draining) == 1
+}
+
+// Swaps the sessions traced, updating those already connected
+func (n *StratumServer) retrace(entries []string) {
+	n.port.Trace.Set(entries)
+	n.withClients(func(clients map[string]*StratumClient) {
+		for _, client := range clients {
+			client.updateTrace()
+		}
+	})
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/pkg/errors"
+
+	"github.com/icook/ngpool/pkg/service"
+)
+
+// Several stratum instances can serve a share chain behind one name. Each
+// claims its own extranonce prefix in etcd when ExtranoncePrefix is "auto",
+// and block solves are claimed before they're submitted and saved, so one
+// found twice is only counted once
+const (
+	extranonceClaimTTL = time.Minute
+	solveClaimTTL      = time.Hour
+)
+
+// What extranonce claims need from the service, so they can be tested
+// without etcd
+type prefixClaimer interface {
+	Claim(key string, ttl time.Duration) (bool, error)
+	Release(key string) error
+}
+
+// Prefixes are claimed under each currency mined, since that's what work can
+// collide on, whichever share chain it's credited to. Stratums mining
+// {DOGE,LTC} and {LTC} then can't both take a prefix for LTC
+func extranonceClaimKey(currency string, prefix string) string {
+	return fmt.Sprintf("/extranonce/%s/%s", currency, prefix)
+}
+
+// An extranonce prefix held under every currency we mine
+type ExtranonceClaim struct {
+	prefix     string
+	claimer    prefixClaimer
+	currencies []string
+	mtx        sync.Mutex
+}
+
+// Claims the first one byte prefix free under all the currencies. Losing it
+// to another instance later is fatal, since from then on we could hand out the
+// same extranonce1s, see Keep
+func NewExtranonceClaim(claimer prefixClaimer, currencies []string) (*ExtranonceClaim, error) {
+	seen := map[string]bool{}
+	var codes []string
+	for _, code := range currencies {
+		if !seen[code] {
+			seen[code] = true
+			codes = append(codes, code)
+		}
+	}
+	sort.Strings(codes)
+	for i := 0; i < 256; i++ {
+		prefix := hex.EncodeToString([]byte{byte(i)})
+		ok, err := claimPrefix(claimer, codes, prefix)
+		if err != nil {
+			return nil, errors.Wrap(err, "claiming extranonce prefix")
+		}
+		if ok {
+			log.Info("Claimed extranonce prefix", "prefix", prefix, "currencies", codes)
+			return &ExtranonceClaim{prefix: prefix, claimer: claimer, currencies: codes}, nil
+		}
+	}
+	return nil, errors.Errorf("No extranonce prefix is free for all of %s",
+		strings.Join(codes, ","))
+}
+
+// Claims prefix under every currency or none of them, giving back the ones
+// taken if another is held elsewhere
+func claimPrefix(claimer prefixClaimer, currencies []string, prefix string) (bool, error) {
+	var taken []string
+	for _, code := range currencies {
+		key := extranonceClaimKey(code, prefix)
+		ok, err := claimer.Claim(key, extranonceClaimTTL)
+		if err == nil && ok {
+			taken = append(taken, key)
+			continue
+		}
+		for _, key := range taken {
+			if rerr := claimer.Release(key); rerr != nil {
+				// It expires on its own
+				log.Warn("Failed to release extranonce prefix claim", "key", key, "err", rerr)
+			}
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (c *ExtranonceClaim) Prefix() string {
+	return c.prefix
+}
+
+// Claims our prefix for a currency we've started mining, like a dynamic aux
+// chain. false if another stratum holds it there, in which case we mustn't
+// mine the currency
+func (c *ExtranonceClaim) Add(currency string) (bool, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, code := range c.currencies {
+		if code == currency {
+			return true, nil
+		}
+	}
+	ok, err := claimPrefix(c.claimer, []string{currency}, c.prefix)
+	if ok {
+		c.currencies = append(c.currencies, currency)
+		log.Info("Claimed extranonce prefix", "prefix", c.prefix, "currency", currency)
+	}
+	return ok, err
+}
+
+// Renews the claims until the process exits
+func (c *ExtranonceClaim) Keep() {
+	for range time.Tick(extranonceClaimTTL / 3) {
+		if err := c.renew(); err != nil {
+			log.Crit("Extranonce prefix claimed by another stratum", "err", err)
+			os.Exit(1)
+		}
+	}
+}
+
+// Errors only if a claim was lost
+func (c *ExtranonceClaim) renew() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, code := range c.currencies {
+		key := extranonceClaimKey(code, c.prefix)
+		ok, err := c.claimer.Claim(key, extranonceClaimTTL)
+		if err != nil {
+			// Someone else can only take it once it expires
+			log.Warn("Failed to renew extranonce prefix claim", "key", key, "err", err)
+			continue
+		}
+		if !ok {
+			return errors.Errorf("Lost extranonce prefix claim %s", key)
+		}
+	}
+	return nil
+}
+
+// Whether we're the first stratum to find block. Blocks are submitted if
+// etcd can't be reached or doesn't do claims, a duplicate is better than a
+// lost block
+func (n *StratumServer) claimSolve(currency string, block *BlockSolve) bool {
+	if n.service == nil {
+		return true
+	}
+	key := fmt.Sprintf("/solves/%s/%s", currency, block.getBlockHash())
+	ok, err := n.service.Claim(key, solveClaimTTL)
+	if err == service.ErrNoClaims {
+		return true
+	} else if err != nil {
+		log.Warn("Failed to claim block solve, submitting anyway", "key", key, "err", err)
+		return true
+	}
+	return ok
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Claims held in memory by one owner
+type memClaimer struct {
+	owner  string
+	owners map[string]string
+}
+
+func (m *memClaimer) Claim(key string, ttl time.Duration) (bool, error) {
+	if held, ok := m.owners[key]; ok && held != m.owner {
+		return false, nil
+	}
+	m.owners[key] = m.owner
+	return true, nil
+}
+
+func (m *memClaimer) Release(key string) error {
+	if m.owners[key] == m.owner {
+		delete(m.owners, key)
+	}
+	return nil
+}
+
+func TestExtranonceClaimPerCurrency(t *testing.T) {
+	owners := map[string]string{}
+	a := &memClaimer{owner: "a", owners: owners}
+	b := &memClaimer{owner: "b", owners: owners}
+	c := &memClaimer{owner: "c", owners: owners}
+
+	claim, err := NewExtranonceClaim(a, []string{"LTC", "DOGE", "LTC"})
+	assert.NoError(t, err)
+	assert.Equal(t, "00", claim.Prefix())
+	assert.Equal(t, "a", owners["/extranonce/LTC/00"])
+	assert.Equal(t, "a", owners["/extranonce/DOGE/00"])
+
+	// Mining only LTC still collides with a on 00
+	claim, err = NewExtranonceClaim(b, []string{"LTC"})
+	assert.NoError(t, err)
+	assert.Equal(t, "01", claim.Prefix())
+
+	// 01 is free on VTC but not LTC, so the VTC claim is given back
+	claim, err = NewExtranonceClaim(c, []string{"VTC", "LTC"})
+	assert.NoError(t, err)
+	assert.Equal(t, "02", claim.Prefix())
+	_, held := owners["/extranonce/VTC/00"]
+	assert.False(t, held)
+	_, held = owners["/extranonce/VTC/01"]
+	assert.False(t, held)
+	assert.Equal(t, "c", owners["/extranonce/VTC/02"])
+}
+
+func TestExtranonceClaimAdd(t *testing.T) {
+	owners := map[string]string{}
+	a := &memClaimer{owner: "a", owners: owners}
+	b := &memClaimer{owner: "b", owners: owners}
+
+	claim, err := NewExtranonceClaim(a, []string{"LTC"})
+	assert.NoError(t, err)
+	other, err := NewExtranonceClaim(b, []string{"DOGE"})
+	assert.NoError(t, err)
+	assert.Equal(t, "00", other.Prefix())
+
+	// DOGE's 00 is b's, so a can't start merge mining it
+	ok, err := claim.Add("DOGE")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	ok, err = claim.Add("NMC")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"LTC", "NMC"}, claim.currencies)
+	assert.NoError(t, claim.renew())
+
+	// Losing any claim is an error
+	owners["/extranonce/NMC/00"] = "b"
+	assert.Error(t, claim.renew())
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/dustin/go-broadcast"
+	log "github.com/inconshreveable/log15"
+	"github.com/seehuhn/sha256d"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/icook/ngpool/pkg/service"
+)
+
+const devCurrency = "DEV"
+
+func init() {
+	var (
+		algo     string
+		bind     string
+		interval time.Duration
+		bits     string
+	)
+	devserveCmd := &cobra.Command{
+		Use:   "devserve",
+		Short: "Run a standalone stratum server on a fake chain, for development",
+		Long: `Runs a stratum server fed by a built in mock coinserver. The fake chain
+advances every interval, or whenever a block is solved. No etcd, database or
+coinservers are needed, so stratum changes can be tried with a CPU miner:
+
+    ngstratum devserve --algo scrypt
+    minerd -a scrypt -o stratum+tcp://127.0.0.1:3333 -u dev -p x`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if _, ok := service.AlgoConfig[algo]; !ok {
+				fmt.Printf("Unknown algo %s\n", algo)
+				os.Exit(1)
+			}
+			ng := NewStratumServer()
+			defer ng.Stop()
+			ng.ConfigureDev(algo, bind)
+			ng.ParseConfig()
+
+			src := NewMockTemplateSource(ng.port.Lanes.lanes[0].key, interval, bits,
+				ng.newTemplate, ng.getBlockCast(devCurrency))
+			src.Start()
+			ng.templateSources = append(ng.templateSources, src)
+			ng.Start()
+
+			sigs := make(chan os.Signal, 1)
+			signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+			<-sigs
+		}}
+	devserveCmd.Flags().StringVar(&algo, "algo", "sha256d", "Proof of work algorithm")
+	devserveCmd.Flags().StringVar(&bind, "bind", "127.0.0.1:3333", "Stratum listen address")
+	devserveCmd.Flags().DurationVar(&interval, "interval", time.Second*30,
+		"How often the fake chain gets a new block")
+	devserveCmd.Flags().StringVar(&bits, "bits", "207fffff",
+		"Compact network target for the fake chain. The default solves almost every share")
+	RootCmd.AddCommand(devserveCmd)
+}
+
+// Sets up config for running standalone, in place of ConfigureService
+func (n *StratumServer) ConfigureDev(algo string, bind string) {
+	service.SetupCurrencies(map[string]interface{}{
+		devCurrency: map[string]interface{}{
+			"code":                 devCurrency,
+			"subsidyaddress":       "mucHkBoHAF8DTQWFuwQXHiewqi3ZBDNNWh",
+			"powalgorithm":         algo,
+			"pubkeyaddrid":         "6f",
+			"privkeyaddrid":        "ef",
+			"netmagic":             0x6e676476,
+			"blockmatureconfirms":  1,
+			"payouttransactionfee": 1,
+		},
+	})
+	service.SetupShareChains(map[string]interface{}{
+		devCurrency: map[string]interface{}{
+			"payoutmethod": "pplns",
+			"algo":         algo,
+		},
+	})
+
+	n.config = viper.New()
+	n.config.Set("LogLevel", "info")
+	n.config.Set("StratumBind", bind)
+	n.config.Set("ShareChainName", devCurrency)
+	n.config.Set("BaseCurrency", map[string]interface{}{
+		"Currency":     devCurrency,
+		"Algo":         algo,
+		"TemplateType": "getblocktemplate",
+	})
+}
+
+// Generates templates for a fake chain. Everything about a block is derived
+// from its height, so runs are reproducible apart from timestamps
+type MockTemplateSource struct {
+	tmplKey     TemplateKey
+	interval    time.Duration
+	bits        string
+	newTemplate chan *Template
+	blockCast   broadcast.Broadcaster
+	height      int64
+	shutdown    chan interface{}
+}
+
+func NewMockTemplateSource(tmplKey TemplateKey, interval time.Duration, bits string,
+	newTemplate chan *Template, blockCast broadcast.Broadcaster) *MockTemplateSource {
+	return &MockTemplateSource{
+		tmplKey:     tmplKey,
+		interval:    interval,
+		bits:        bits,
+		newTemplate: newTemplate,
+		blockCast:   blockCast,
+		height:      1,
+		shutdown:    make(chan interface{}),
+	}
+}
+
+func mockBlockHash(height int64) string {
+	var hasher = sha256d.New()
+	fmt.Fprintf(hasher, "ngpool mock block %d", height)
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+func (m *MockTemplateSource) template(now time.Time) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"version":           0x20000000,
+		"previousblockhash": mockBlockHash(m.height - 1),
+		"transactions":      []interface{}{},
+		"coinbasevalue":     5000000000,
+		"bits":              m.bits,
+		"curtime":           now.Unix(),
+		"mintime":           now.Unix() - 600,
+		"height":            m.height,
+	})
+}
+
+func (m *MockTemplateSource) push() {
+	data, err := m.template(time.Now())
+	if err != nil {
+		log.Error("Failed to generate mock template", "err", err)
+		return
+	}
+	log.Info("Mock chain at new height", "height", m.height)
+	m.newTemplate <- &Template{
+		key:    m.tmplKey,
+		data:   data,
+		source: "mock",
+	}
+}
+
+func (m *MockTemplateSource) Start() {
+	solves := make(chan interface{})
+	m.blockCast.Register(solves)
+	go func() {
+		defer m.blockCast.Unregister(solves)
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+		m.push()
+		for {
+			select {
+			case <-m.shutdown:
+				return
+			case <-ticker.C:
+			case msg := <-solves:
+				block, ok := msg.(*BlockSolve)
+				if !ok || block.height != m.height {
+					continue
+				}
+				log.Info("Mock chain block solved", "height", block.height,
+					"hash", block.getBlockHash())
+			}
+			m.height++
+			m.push()
+		}
+	}()
+}
+
+func (m *MockTemplateSource) Stop() {
+	close(m.shutdown)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMockTemplateDeterministic(t *testing.T) {
+	m := NewMockTemplateSource(TemplateKey{}, time.Second, "207fffff", nil, nil)
+	now := time.Unix(1500000000, 0)
+	m.height = 5
+	first, err := m.template(now)
+	assert.NoError(t, err)
+	second, err := m.template(now)
+	assert.NoError(t, err)
+	assert.Equal(t, first, second)
+
+	var tmpl BlockTemplate
+	assert.NoError(t, json.Unmarshal(first, &tmpl))
+	assert.EqualValues(t, 5, tmpl.Height)
+	assert.Equal(t, mockBlockHash(4), tmpl.PreviousBlockhash)
+	assert.Equal(t, "207fffff", tmpl.Bits)
+
+	// Each height builds on the last
+	m.height = 6
+	next, err := m.template(now)
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(next, &tmpl))
+	assert.Equal(t, mockBlockHash(5), tmpl.PreviousBlockhash)
+	assert.NotEqual(t, mockBlockHash(4), mockBlockHash(5))
+}
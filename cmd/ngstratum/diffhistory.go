@@ -0,0 +1,52 @@
+package main
+
+import (
+	"time"
+)
+
+// How many of a session's previous difficulties are remembered
+const diffHistoryLen = 4
+
+type diffChange struct {
+	diff float64
+	// When the session moved off the difficulty
+	until time.Time
+}
+
+// A session's recent difficulties, newest first. When vardiff raises the
+// difficulty, miners keep submitting shares worked out against the old one for
+// a few seconds, sometimes on jobs sent after the change. Those are credited
+// at the old difficulty rather than rejected. Never modified once stored, so
+// validator goroutines can read it while the write loop replaces it, like
+// clientJobBook
+type diffHistory struct {
+	changes []diffChange
+}
+
+// Records that the session moved off diff at now
+func (h *diffHistory) with(diff float64, now time.Time) *diffHistory {
+	changes := make([]diffChange, 0, diffHistoryLen)
+	changes = append(changes, diffChange{diff: diff, until: now})
+	for _, change := range h.changes {
+		if len(changes) == diffHistoryLen {
+			break
+		}
+		changes = append(changes, change)
+	}
+	return &diffHistory{changes: changes}
+}
+
+// The lowest difficulty under diff that the session was still on within grace
+// of at, 0 if there isn't one
+func (h *diffHistory) graceDiff(diff float64, at time.Time, grace time.Duration) float64 {
+	var lowest float64
+	for _, change := range h.changes {
+		if change.until.Add(grace).Before(at) {
+			break
+		}
+		if change.diff < diff && (lowest == 0 || change.diff < lowest) {
+			lowest = change.diff
+		}
+	}
+	return lowest
+}
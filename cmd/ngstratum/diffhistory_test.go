@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffHistory(t *testing.T) {
+	now := time.Now()
+	grace := time.Second * 5
+	h := &diffHistory{}
+	assert.Equal(t, 0.0, h.graceDiff(64, now, grace))
+
+	// 16 -> 32 -> 64, a second apart
+	h = h.with(16, now)
+	h = h.with(32, now.Add(time.Second))
+	assert.Equal(t, 16.0, h.graceDiff(64, now.Add(time.Second*2), grace))
+	// Only 32 was left recently enough
+	assert.Equal(t, 32.0, h.graceDiff(64, now.Add(time.Second*5+time.Millisecond*500), grace))
+	assert.Equal(t, 0.0, h.graceDiff(64, now.Add(time.Second*7), grace))
+	// Vardiff went down, so the old difficulty is no help
+	assert.Equal(t, 0.0, h.graceDiff(8, now.Add(time.Second*2), grace))
+
+	for i := 0; i < diffHistoryLen*2; i++ {
+		h = h.with(float64(i), now)
+	}
+	assert.Len(t, h.changes, diffHistoryLen)
+	assert.Equal(t, float64(diffHistoryLen*2-1), h.changes[0].diff)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/icook/ngpool/pkg/service"
+)
+
+type testSink struct {
+	err  error
+	sent map[string][][]byte
+}
+
+func (s *testSink) Send(topic string, records [][]byte) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.sent[topic] = append(s.sent[topic], records...)
+	return nil
+}
+
+func TestExportRecord(t *testing.T) {
+	e := &Exporter{shareTopic: "shares", blockTopic: "blocks",
+		shareChain: "LTC_T", stratum: "s1"}
+	minedAt := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	topic, raw, err := e.record(service.Event{Data: service.ShareEvent{
+		Username: "joe", Worker: "rig1", Difficulty: 16,
+		Currencies: []string{"LTC_T", "DOGE_T"}, MinedAt: minedAt}})
+	assert.NoError(t, err)
+	assert.Equal(t, "shares", topic)
+	assert.JSONEq(t, `{"type": "share", "version": 1, "sharechain": "LTC_T",
+		"stratum": "s1", "username": "joe", "worker": "rig1", "difficulty": 16,
+		"currencies": ["LTC_T", "DOGE_T"], "blocks": 0,
+		"mined_at": "2018-01-01T00:00:00Z"}`, string(raw))
+
+	topic, raw, err = e.record(service.Event{Data: service.BlockEvent{
+		Currency: "LTC_T", Height: 100, Hash: "ab", Subsidy: 50,
+		PowAlgo: "scrypt", MinedBy: "joe", MinedAt: minedAt}})
+	assert.NoError(t, err)
+	assert.Equal(t, "blocks", topic)
+	var block BlockRecord
+	assert.NoError(t, json.Unmarshal(raw, &block))
+	assert.Equal(t, "block", block.Type)
+	assert.Equal(t, int64(100), block.Height)
+
+	topic, _, err = e.record(service.Event{Data: service.JobEvent{}})
+	assert.NoError(t, err)
+	assert.Equal(t, "", topic)
+}
+
+func TestExporterRetry(t *testing.T) {
+	sink := &testSink{err: errors.New("down"), sent: map[string][][]byte{}}
+	e := &Exporter{sink: sink, maxPending: 3}
+	for i := 0; i < 5; i++ {
+		e.add("shares", []byte(fmt.Sprint(i)))
+	}
+	e.add("blocks", []byte("b"))
+	assert.Error(t, e.flush())
+	// The oldest went once over maxPending
+	assert.Equal(t, map[string]int64{"sent": 0, "dropped": 3, "pending": 3}, e.Stats())
+
+	sink.err = nil
+	assert.NoError(t, e.flush())
+	assert.Equal(t, [][]byte{[]byte("3"), []byte("4")}, sink.sent["shares"])
+	assert.Equal(t, [][]byte{[]byte("b")}, sink.sent["blocks"])
+	assert.Equal(t, map[string]int64{"sent": 3, "dropped": 3, "pending": 0}, e.Stats())
+
+	var nilExporter *Exporter
+	assert.Nil(t, nilExporter.Stats())
+}
+
+func TestKafkaRESTSink(t *testing.T) {
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/topics/ngpool.shares", r.URL.Path)
+		assert.Equal(t, "application/vnd.kafka.json.v2+json", r.Header.Get("Content-Type"))
+		raw, _ := ioutil.ReadAll(r.Body)
+		body = string(raw)
+	}))
+	defer srv.Close()
+
+	sink := &kafkaRESTSink{url: srv.URL, client: http.DefaultClient}
+	err := sink.Send("ngpool.shares", [][]byte{[]byte(`{"a":1}`), []byte(`{"a":2}`)})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"records": [{"value": {"a": 1}}, {"value": {"a": 2}}]}`, body)
+}
+
+func TestNATSSink(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+	lines := make(chan string, 10)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "INFO {\"server_id\":\"test\"}\r\n")
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimSpace(line)
+			if line == "PING" {
+				fmt.Fprintf(conn, "PONG\r\n")
+				continue
+			}
+			lines <- line
+		}
+	}()
+
+	sink, err := newNATSSink("nats://user:pw@"+ln.Addr().String(), "test")
+	assert.NoError(t, err)
+	err = sink.Send("ngpool.blocks", [][]byte{[]byte(`{"a":1}`)})
+	assert.NoError(t, err)
+
+	connect := <-lines
+	assert.True(t, strings.HasPrefix(connect, "CONNECT "))
+	assert.Contains(t, connect, `"user":"user"`)
+	assert.Equal(t, "PUB ngpool.blocks 7", <-lines)
+	assert.Equal(t, `{"a":1}`, <-lines)
+
+	_, err = newNATSSink("127.0.0.1:4222", "test")
+	assert.Error(t, err)
+}
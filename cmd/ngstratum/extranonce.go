@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/hex"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// The coinbase has room for extranonce1 and extranonce2 together, the space
+// extraNonceMagic holds while the coinbase is built
+var extranonceSize = len(extraNonceMagic)
+
+const (
+	// Fewer than this many extranonce2 bytes and fast miners run through
+	// their space between jobs
+	minExtranonce2Size = 2
+	minExtranonce1Size = 2
+)
+
+// Hands out the extranonce1 of each connection on a port. Each is the
+// instance's prefix followed by a counter, and the counter skips values still
+// held by an open connection, so no two miners ever iterate the same work.
+// Stratum instances mining the same currencies must be given different
+// prefixes to get the same guarantee between them
+type ExtranonceAllocator struct {
+	prefix []byte
+	size   int
+	// Number of distinct extranonce1s the counter can make
+	space uint64
+	next  uint64
+	inUse map[string]bool
+	mtx   sync.Mutex
+}
+
+// size is the full length of the extranonce1 including prefix. The remainder
+// of the coinbase's extranonce space goes to extranonce2
+func NewExtranonceAllocator(prefix []byte, size int) (*ExtranonceAllocator, error) {
+	if size < minExtranonce1Size || size > extranonceSize-minExtranonce2Size {
+		return nil, errors.Errorf("Extranonce1 size must be between %d and %d bytes",
+			minExtranonce1Size, extranonceSize-minExtranonce2Size)
+	}
+	if len(prefix) >= size {
+		return nil, errors.Errorf(
+			"Extranonce prefix of %d bytes leaves no room in a %d byte extranonce1",
+			len(prefix), size)
+	}
+	return &ExtranonceAllocator{
+		prefix: prefix,
+		size:   size,
+		space:  1 << uint(8*(size-len(prefix))),
+		inUse:  map[string]bool{},
+	}, nil
+}
+
+// Parses the hex prefix from config
+func NewExtranonceAllocatorHex(prefix string, size int) (*ExtranonceAllocator, error) {
+	raw, err := hex.DecodeString(prefix)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid extranonce prefix")
+	}
+	return NewExtranonceAllocator(raw, size)
+}
+
+// Errors if every extranonce1 is held by an open connection
+func (a *ExtranonceAllocator) Allocate() ([]byte, error) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if uint64(len(a.inUse)) >= a.space {
+		return nil, errors.New("Extranonce space exhausted")
+	}
+	for {
+		counter := a.next % a.space
+		a.next++
+		extranonce1 := make([]byte, a.size)
+		copy(extranonce1, a.prefix)
+		// Big endian, so allocations read as a sequence in logs
+		for i := a.size - 1; i >= len(a.prefix); i-- {
+			extranonce1[i] = byte(counter)
+			counter >>= 8
+		}
+		key := string(extranonce1)
+		if !a.inUse[key] {
+			a.inUse[key] = true
+			return extranonce1, nil
+		}
+	}
+}
+
+// Returns an extranonce1 for reuse once its connection has closed
+func (a *ExtranonceAllocator) Release(extranonce1 []byte) {
+	a.mtx.Lock()
+	delete(a.inUse, string(extranonce1))
+	a.mtx.Unlock()
+}
+
+func (a *ExtranonceAllocator) Extranonce2Size() int {
+	return extranonceSize - a.size
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtranonceAllocator(t *testing.T) {
+	a, err := NewExtranonceAllocator([]byte{0xab}, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, a.Extranonce2Size())
+
+	first, err := a.Allocate()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0xab, 0}, first)
+
+	// Fill the rest of the 256 values the counter byte allows
+	seen := map[string]bool{string(first): true}
+	for i := 1; i < 256; i++ {
+		e, err := a.Allocate()
+		assert.NoError(t, err)
+		assert.Equal(t, byte(0xab), e[0])
+		assert.False(t, seen[string(e)], "allocated twice")
+		seen[string(e)] = true
+	}
+	_, err = a.Allocate()
+	assert.Error(t, err)
+
+	// Released values are handed out again, held ones are skipped
+	a.Release([]byte{0xab, 7})
+	e, err := a.Allocate()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0xab, 7}, e)
+}
+
+func TestExtranonceAllocatorConfig(t *testing.T) {
+	_, err := NewExtranonceAllocator(nil, 1)
+	assert.Error(t, err)
+	_, err = NewExtranonceAllocator(nil, 7)
+	assert.Error(t, err)
+	_, err = NewExtranonceAllocator([]byte{1, 2}, 2)
+	assert.Error(t, err)
+	_, err = NewExtranonceAllocatorHex("zz", 4)
+	assert.Error(t, err)
+
+	a, err := NewExtranonceAllocatorHex("0102", 4)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, a.Extranonce2Size())
+	e, err := a.Allocate()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{1, 2, 0, 0}, e)
+}
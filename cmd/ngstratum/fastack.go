@@ -0,0 +1,43 @@
+package main
+
+import (
+	"sync"
+)
+
+// With FastAck a submit is answered as soon as it passes the checks that
+// don't need hashing (known job, sizes, duplicates, age), and the share is
+// hashed afterwards. A far away farm then isn't waiting on the validators,
+// but a bad share can't be rejected once it's been accepted. Instead the
+// difficulty it would have been credited is owed, and taken out of the
+// session's next good shares
+type fastAckPenalty struct {
+	owed float64
+	mtx  sync.Mutex
+}
+
+func (p *fastAckPenalty) add(difficulty float64) {
+	p.mtx.Lock()
+	p.owed += difficulty
+	p.mtx.Unlock()
+}
+
+// Pays what's owed out of a good share's difficulty, returning what's left
+// to credit
+func (p *fastAckPenalty) settle(difficulty float64) float64 {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.owed >= difficulty {
+		p.owed -= difficulty
+		return 0
+	}
+	difficulty -= p.owed
+	p.owed = 0
+	return difficulty
+}
+
+// Difficulty still owed
+func (p *fastAckPenalty) Owed() float64 {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.owed
+}
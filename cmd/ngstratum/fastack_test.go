@@ -0,0 +1,19 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFastAckPenalty(t *testing.T) {
+	var p fastAckPenalty
+	assert.Equal(t, 16.0, p.settle(16))
+
+	p.add(16)
+	p.add(8)
+	assert.Equal(t, 0.0, p.settle(16))
+	assert.Equal(t, 8.0, p.Owed())
+	assert.Equal(t, 8.0, p.settle(16))
+	assert.Equal(t, 0.0, p.Owed())
+}
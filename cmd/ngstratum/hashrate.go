@@ -0,0 +1,94 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/icook/ngpool/pkg/common"
+)
+
+// Keeps decayed hashrate estimates for every worker and username mining on
+// this port, as well as the port as a whole. Shares are weighted by their
+// difficulty and converted to hashes with the share chain's HashesPerShare
+type HashrateTracker struct {
+	tau            time.Duration
+	hashesPerShare float64
+
+	port      *common.DecayedRate
+	addresses map[string]*common.DecayedRate
+	workers   map[string]map[string]*common.DecayedRate
+	mtx       sync.Mutex
+}
+
+func NewHashrateTracker(tau time.Duration, hashesPerShare int64) *HashrateTracker {
+	return &HashrateTracker{
+		tau:            tau,
+		hashesPerShare: float64(hashesPerShare),
+		port:           common.NewDecayedRate(tau, time.Now()),
+		addresses:      map[string]*common.DecayedRate{},
+		workers:        map[string]map[string]*common.DecayedRate{},
+	}
+}
+
+func (h *HashrateTracker) AddShare(username string, worker string,
+	difficulty float64, at time.Time) {
+	weight := difficulty * h.hashesPerShare
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	h.port.Add(weight, at)
+	addr, ok := h.addresses[username]
+	if !ok {
+		addr = common.NewDecayedRate(h.tau, at)
+		h.addresses[username] = addr
+		h.workers[username] = map[string]*common.DecayedRate{}
+	}
+	addr.Add(weight, at)
+	w, ok := h.workers[username][worker]
+	if !ok {
+		w = common.NewDecayedRate(h.tau, at)
+		h.workers[username][worker] = w
+	}
+	w.Add(weight, at)
+}
+
+// Forgets workers and usernames that haven't submitted a share in idle. By
+// then their estimate is close enough to zero not to be worth reporting
+func (h *HashrateTracker) Prune(idle time.Duration, now time.Time) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	for username, workers := range h.workers {
+		for name, w := range workers {
+			if w.Idle(now) > idle {
+				delete(workers, name)
+			}
+		}
+		if len(workers) == 0 {
+			delete(h.workers, username)
+			delete(h.addresses, username)
+		}
+	}
+}
+
+func (h *HashrateTracker) Status(now time.Time) common.HashrateStatus {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	status := common.HashrateStatus{
+		Port:      h.port.Rate(now),
+		Addresses: map[string]float64{},
+		Workers:   map[string]map[string]float64{},
+		LastSeen:  map[string]map[string]int64{},
+	}
+	for username, addr := range h.addresses {
+		status.Addresses[username] = addr.Rate(now)
+		workers := map[string]float64{}
+		lastSeen := map[string]int64{}
+		for name, w := range h.workers[username] {
+			workers[name] = w.Rate(now)
+			lastSeen[name] = w.Last().Unix()
+		}
+		status.Workers[username] = workers
+		status.LastSeen[username] = lastSeen
+	}
+	return status
+}
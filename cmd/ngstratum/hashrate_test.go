@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashrateTracker(t *testing.T) {
+	now := time.Now()
+	h := NewHashrateTracker(time.Minute, 65536)
+	for i := 0; i < 600; i++ {
+		now = now.Add(time.Second)
+		h.AddShare("alice", "rig1", 1, now)
+		h.AddShare("alice", "rig2", 1, now)
+		h.AddShare("bob", "rig1", 2, now)
+	}
+	status := h.Status(now)
+	assert.InEpsilon(t, 65536*4, status.Port, 0.1)
+	assert.InEpsilon(t, 65536*2, status.Addresses["alice"], 0.1)
+	assert.InEpsilon(t, 65536, status.Workers["alice"]["rig1"], 0.1)
+	assert.InEpsilon(t, 65536*2, status.Workers["bob"]["rig1"], 0.1)
+	assert.Equal(t, now.Unix(), status.LastSeen["bob"]["rig1"])
+
+	// Bob stops mining
+	for i := 0; i < 600; i++ {
+		now = now.Add(time.Second)
+		h.AddShare("alice", "rig1", 1, now)
+	}
+	h.Prune(5*time.Minute, now)
+	status = h.Status(now)
+	assert.NotContains(t, status.Addresses, "bob")
+	assert.NotContains(t, status.Workers["alice"], "rig2")
+	assert.Contains(t, status.Workers["alice"], "rig1")
+	assert.NotContains(t, status.LastSeen, "bob")
+}
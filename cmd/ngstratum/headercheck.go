@@ -0,0 +1,97 @@
+package main
+
+import (
+	"math/big"
+	"sync"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/pkg/errors"
+)
+
+// A session's buffers for checking its shares. Almost every share solves
+// nothing, so rather than assembling the coinbase and header in fresh
+// buffers the way CheckSolves does, they're built over the last share's and
+// only the PoW hash is compared. Shares of one session can be checked by
+// several validators at once, so it's locked while in use
+type shareScratch struct {
+	coinbase []byte
+	header   []byte
+	// Merkle root, reversed PoW hash, and the hash as a number
+	root     [chainhash.HashSize]byte
+	reversed [chainhash.HashSize]byte
+	hash     big.Int
+	mtx      sync.Mutex
+}
+
+// Like CheckSolves, but with the coinbase and header built in scratch. When
+// the hash meets a block target the share goes through CheckSolves again,
+// which assembles the blocks
+func (j *Job) CheckSolvesFast(scratch *shareScratch, nonce []byte, extraNonce []byte, version []byte, shareTarget *big.Int) (map[string]*BlockSolve, bool, []string, float64, error) {
+	scratch.mtx.Lock()
+	hash, err := j.headerHash(scratch, nonce, extraNonce, version)
+	if err != nil {
+		scratch.mtx.Unlock()
+		return nil, false, nil, 0, err
+	}
+	solved := hash.Cmp(j.target) <= 0
+	for _, mj := range j.auxChains {
+		solved = solved || hash.Cmp(mj.target) <= 0
+	}
+	validShare := shareTarget != nil && hash.Cmp(shareTarget) <= 0
+	blockRatio, _ := new(big.Float).Quo(new(big.Float).SetInt(hash),
+		new(big.Float).SetInt(j.target)).Float64()
+	scratch.mtx.Unlock()
+	if solved {
+		return j.CheckSolves(nonce, extraNonce, version, shareTarget)
+	}
+
+	currencies := make([]string, 0, len(j.auxChains)+1)
+	currencies = append(currencies, j.currencyConfig.Code)
+	for _, mj := range j.auxChains {
+		currencies = append(currencies, mj.currencyConfig.Code)
+	}
+	return nil, validShare, currencies, blockRatio, nil
+}
+
+// The little endian PoW hash of a submission's header, as a number. It's
+// scratch's, and only good until scratch is next used
+func (j *Job) headerHash(scratch *shareScratch, nonce []byte, extraNonce []byte, version []byte) (*big.Int, error) {
+	scratch.coinbase = append(scratch.coinbase[:0], j.coinbase1...)
+	scratch.coinbase = append(scratch.coinbase, extraNonce...)
+	scratch.coinbase = append(scratch.coinbase, j.coinbase2...)
+
+	hasher := getHasher()
+	defer putHasher(hasher)
+	hasher.Write(scratch.coinbase)
+	root := hasher.Sum(scratch.root[:0])
+	for _, branch := range j.merkleBranch {
+		hasher.Reset()
+		hasher.Write(root)
+		hasher.Write(branch)
+		root = hasher.Sum(scratch.root[:0])
+	}
+
+	header := append(scratch.header[:0], j.version...)
+	if version != nil {
+		copy(header[0:4], version)
+	}
+	header = append(header, j.prevBlockHash...)
+	header = append(header, root...)
+	header = append(header, j.time...)
+	header = append(header, j.bits...)
+	header = append(header, nonce...)
+	scratch.header = header
+
+	headerHsh, err := j.algo.PoWHash(header)
+	if err != nil {
+		return nil, err
+	}
+	if len(headerHsh) != chainhash.HashSize {
+		return nil, errors.Errorf("PoW hash is %d bytes, expected %d",
+			len(headerHsh), chainhash.HashSize)
+	}
+	for i, b := range headerHsh {
+		scratch.reversed[chainhash.HashSize-1-i] = b
+	}
+	return scratch.hash.SetBytes(scratch.reversed[:]), nil
+}
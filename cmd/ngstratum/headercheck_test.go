@@ -0,0 +1,44 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckSolvesFast(t *testing.T) {
+	job := benchJob(t, 20)
+	extranonce := make([]byte, extranonceSize)
+	var scratch shareScratch
+	check := func(nonce []byte, version []byte, shareTarget *big.Int) {
+		blocks, valid, currencies, ratio, err := job.CheckSolves(nonce, extranonce, version, shareTarget)
+		assert.NoError(t, err)
+		fastBlocks, fastValid, fastCurrencies, fastRatio, err := job.CheckSolvesFast(
+			&scratch, nonce, extranonce, version, shareTarget)
+		assert.NoError(t, err)
+		assert.Equal(t, valid, fastValid)
+		assert.Equal(t, currencies, fastCurrencies)
+		assert.Equal(t, ratio, fastRatio)
+		assert.Equal(t, len(blocks), len(fastBlocks))
+		for code, block := range blocks {
+			assert.Equal(t, block.data, fastBlocks[code].data)
+		}
+	}
+
+	easy := job.algo.ShareTarget(0.0001)
+	for i := 0; i < 50; i++ {
+		nonce := []byte{byte(i), 0, 0, 0}
+		check(nonce, nil, easy)
+		check(nonce, []byte{0x00, 0x20, 0x00, 0x20}, easy)
+		check(nonce, nil, nil)
+	}
+
+	// Every hash solves the block now, so it's assembled by CheckSolves
+	job.target = new(big.Int).Lsh(big.NewInt(1), 256)
+	blocks, valid, _, _, err := job.CheckSolvesFast(&scratch, []byte{1, 2, 3, 4}, extranonce, nil, easy)
+	assert.NoError(t, err)
+	assert.True(t, valid)
+	assert.Len(t, blocks, 1)
+	check([]byte{1, 2, 3, 4}, nil, easy)
+}
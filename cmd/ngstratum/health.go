@@ -0,0 +1,70 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Registers the checks behind /healthz and /readyz. Only the listener check
+// counts for liveness, the rest say whether we've got work worth sending
+// miners to and somewhere to submit blocks
+func (n *StratumServer) setupHealthChecks() {
+	n.health.AddCheck("listener", true, func() error {
+		return n.listenerHealth.Check(0, time.Now())
+	})
+	n.health.AddCheck("template", false, func() error {
+		n.lastJobMtx.Lock()
+		defer n.lastJobMtx.Unlock()
+		return jobFreshness(n.lastJob != nil, n.lastJobAt,
+			n.config.GetDuration("TemplateMaxAge"), time.Now())
+	})
+	n.health.AddCheck("draining", false, func() error {
+		if n.isDraining() {
+			return errors.New("Draining")
+		}
+		return nil
+	})
+	// Standalone (devserve) there's no discovery backend, and nowhere to submit blocks
+	if n.service == nil {
+		return
+	}
+	n.health.AddCheck("discovery", false, n.service.DiscoveryCheck)
+	n.health.AddCheck("coinserver_rpc", false, n.checkCoinservers)
+}
+
+func jobFreshness(hasJob bool, lastJobAt time.Time, maxAge time.Duration, now time.Time) error {
+	if !hasJob {
+		return errors.New("No job yet")
+	}
+	if age := now.Sub(lastJobAt); maxAge > 0 && age > maxAge {
+		return errors.Errorf("No new job for %s", age.Truncate(time.Second))
+	}
+	return nil
+}
+
+// Passes if any coinserver of a base currency answers RPC. Aux chains are
+// left out, we can still mine without them. With several base currencies
+// one is enough, new miners are only given lanes that have work
+func (n *StratumServer) checkCoinservers() error {
+	base := n.port.Lanes.Currencies()
+	n.coinserverMtx.Lock()
+	defer n.coinserverMtx.Unlock()
+	now := time.Now()
+	var lastErr error
+	for _, cw := range n.coinserverWatchers {
+		lane := n.port.Lanes.Lane(cw.tmplKey.Currency)
+		if lane == nil || lane.key != cw.tmplKey {
+			continue
+		}
+		// Allow a missed ping or two before calling it unreachable
+		lastErr = cw.rpcHealth.Check(coinserverPingInterval*3, now)
+		if lastErr == nil {
+			return nil
+		}
+	}
+	if lastErr == nil {
+		return errors.Errorf("No coinservers for %s", base)
+	}
+	return errors.Wrapf(lastErr, "No reachable coinservers for %s", base)
+}
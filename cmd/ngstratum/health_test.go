@@ -0,0 +1,16 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobFreshness(t *testing.T) {
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.Error(t, jobFreshness(false, time.Time{}, 0, now))
+	assert.NoError(t, jobFreshness(true, now.Add(-time.Hour*5), 0, now))
+	assert.NoError(t, jobFreshness(true, now.Add(-time.Minute), time.Hour, now))
+	assert.Error(t, jobFreshness(true, now.Add(-time.Hour*2), time.Hour, now))
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Reasons a session is reaped
+const (
+	IdleNeverAuthorized = iota
+	IdleNoShares
+	IdleUnresponsive
+	idleReasonCount
+)
+
+var idleReasonNames = [idleReasonCount]string{
+	IdleNeverAuthorized: "never_authorized",
+	IdleNoShares:        "no_shares",
+	IdleUnresponsive:    "unresponsive",
+}
+
+// Shown to the miner in the warning before disconnect
+var idleReasonMessages = [idleReasonCount]string{
+	IdleNeverAuthorized: "no mining.authorize received",
+	IdleNoShares:        "no shares submitted",
+	IdleUnresponsive:    "nothing received from the miner",
+}
+
+// How often each client checks whether it's idle
+const idleCheckInterval = time.Second * 5
+
+// Disconnects sessions that are holding a connection (and an extranonce1)
+// without mining. Each timeout is 0 to disable it
+type IdleReaper struct {
+	// From connecting to authorizing
+	AuthTimeout time.Duration
+	// From authorizing, or the last submitted share, to the next share. Must
+	// be well above the time a miner on minimum difficulty takes to find one
+	ShareTimeout time.Duration
+	// From the last message of any kind. Catches half open connections,
+	// where the miner is gone but our writes still succeed
+	ResponseTimeout time.Duration
+	// Stratum miners are sent client.show_message this long before they're
+	// disconnected, so whoever runs them can see why in their logs
+	WarnBefore time.Duration
+	// TCP keepalive period for miner connections, 0 for the OS default
+	KeepAlive time.Duration
+
+	reaped [idleReasonCount]uint64
+}
+
+// When the session did what it did, zero for never
+type idleState struct {
+	connectedAt  time.Time
+	authorizedAt time.Time
+	lastShare    time.Time
+	lastMessage  time.Time
+}
+
+// Returns the reason the session will next be reaped for and when, the
+// earliest if there are several. ok is false if none of the timeouts apply
+func (r *IdleReaper) deadline(s idleState) (reason int, at time.Time, ok bool) {
+	consider := func(candidate int, timeout time.Duration, since time.Time) {
+		if timeout <= 0 {
+			return
+		}
+		candidateAt := since.Add(timeout)
+		if !ok || candidateAt.Before(at) {
+			reason, at, ok = candidate, candidateAt, true
+		}
+	}
+	if s.authorizedAt.IsZero() {
+		consider(IdleNeverAuthorized, r.AuthTimeout, s.connectedAt)
+	} else if s.lastShare.After(s.authorizedAt) {
+		consider(IdleNoShares, r.ShareTimeout, s.lastShare)
+	} else {
+		consider(IdleNoShares, r.ShareTimeout, s.authorizedAt)
+	}
+	lastMessage := s.lastMessage
+	if lastMessage.IsZero() {
+		lastMessage = s.connectedAt
+	}
+	consider(IdleUnresponsive, r.ResponseTimeout, lastMessage)
+	return
+}
+
+func (r *IdleReaper) record(reason int) {
+	atomic.AddUint64(&r.reaped[reason], 1)
+}
+
+// Sessions reaped since startup, by reason
+func (r *IdleReaper) Stats() map[string]uint64 {
+	stats := map[string]uint64{}
+	for reason, name := range idleReasonNames {
+		stats[name] = atomic.LoadUint64(&r.reaped[reason])
+	}
+	return stats
+}
+
+// Applies the keepalive policy to a freshly accepted connection
+func (r *IdleReaper) configureConn(conn net.Conn) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	tcpConn.SetKeepAlive(true)
+	if r.KeepAlive > 0 {
+		tcpConn.SetKeepAlivePeriod(r.KeepAlive)
+	}
+}
+
+func unixNanoTime(nano int64) time.Time {
+	if nano == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nano)
+}
+
+// The read loop marks activity, the write loop checks it, so the times are
+// stored atomically
+func (c *StratumClient) idleState() idleState {
+	return idleState{
+		connectedAt:  c.connectedAt,
+		authorizedAt: unixNanoTime(atomic.LoadInt64(&c.authorizedAt)),
+		lastShare:    unixNanoTime(atomic.LoadInt64(&c.lastShareAt)),
+		lastMessage:  unixNanoTime(atomic.LoadInt64(&c.lastMessageAt)),
+	}
+}
+
+// Warns the miner as it gets close to being reaped, and returns true once
+// it's due to be disconnected. Runs on the write loop
+func (c *StratumClient) checkIdle(now time.Time) bool {
+	reaper := c.port.Idle
+	reason, at, ok := reaper.deadline(c.idleState())
+	if !ok {
+		return false
+	}
+	if !now.Before(at) {
+		c.log.Info("Disconnecting idle session", "reason", idleReasonNames[reason])
+		reaper.record(reason)
+		return true
+	}
+	// Warn once per deadline, a miner that recovers and goes idle again gets
+	// warned again. show_message is a stratum method, JSON-RPC 2.0 miners
+	// have no equivalent
+	if reaper.WarnBefore > 0 && !c.rpcVersion2 && c.subscribed &&
+		!at.Equal(c.idleWarned) && now.After(at.Add(-reaper.WarnBefore)) {
+		c.idleWarned = at
+		return c.send(&StratumMessage{
+			Method: "client.show_message",
+			Params: []string{fmt.Sprintf("Disconnecting in %s: %s",
+				at.Sub(now).Round(time.Second), idleReasonMessages[reason])},
+		}) != nil
+	}
+	return false
+}
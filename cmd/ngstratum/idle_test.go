@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdleDeadline(t *testing.T) {
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := &IdleReaper{
+		AuthTimeout:     time.Minute,
+		ShareTimeout:    time.Minute * 30,
+		ResponseTimeout: time.Minute * 10,
+	}
+
+	reason, at, ok := r.deadline(idleState{connectedAt: start})
+	assert.True(t, ok)
+	assert.Equal(t, IdleNeverAuthorized, reason)
+	assert.Equal(t, start.Add(time.Minute), at)
+
+	// Authorized but quiet, the response timeout comes first
+	state := idleState{connectedAt: start, authorizedAt: start, lastMessage: start}
+	reason, at, _ = r.deadline(state)
+	assert.Equal(t, IdleUnresponsive, reason)
+	assert.Equal(t, start.Add(time.Minute*10), at)
+
+	// Talking but not submitting
+	state.lastMessage = start.Add(time.Minute * 25)
+	reason, at, _ = r.deadline(state)
+	assert.Equal(t, IdleNoShares, reason)
+	assert.Equal(t, start.Add(time.Minute*30), at)
+
+	// Shares push the deadline back
+	state.lastShare = start.Add(time.Minute * 25)
+	reason, at, _ = r.deadline(state)
+	assert.Equal(t, IdleUnresponsive, reason)
+	assert.Equal(t, start.Add(time.Minute*35), at)
+
+	_, _, ok = (&IdleReaper{}).deadline(state)
+	assert.False(t, ok)
+}
+
+func TestIdleStats(t *testing.T) {
+	r := &IdleReaper{}
+	r.record(IdleNoShares)
+	r.record(IdleNoShares)
+	r.record(IdleUnresponsive)
+	assert.Equal(t, map[string]uint64{
+		"never_authorized": 0,
+		"no_shares":        2,
+		"unresponsive":     1,
+	}, r.Stats())
+}
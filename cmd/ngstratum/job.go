@@ -6,10 +6,13 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"math/big"
+	"sync"
+	"time"
 
 	"github.com/btcsuite/btcd/blockchain"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/wire"
+	log "github.com/inconshreveable/log15"
 	"github.com/pkg/errors"
 	"github.com/seehuhn/sha256d"
 
@@ -22,16 +25,29 @@ type Job struct {
 	heights   map[string]int64
 	auxChains []*AuxChainJob
 	algo      *service.Algo
+	// How auxChains were laid out in the merge mining merkle tree
+	auxMerkle *AuxMerkleParams
+	// Identifies the templates in job ids, see makeJobID
+	templateHash uint32
+
+	// mining.notify from after the job id on, the same for every client so
+	// it's serialized once. Indexed by clean_jobs
+	notifyOnce  sync.Once
+	notifyTails [2][]byte
+	notifyErr   error
 }
 
-func NewJobFromTemplates(templates map[TemplateKey][]byte, algo *service.Algo) (*Job, error) {
+// payouts may be nil, it's only set for "coinbase" payout sharechains
+func NewJobFromTemplates(templates map[TemplateKey][]byte, algo *service.Algo,
+	payouts *CoinbasePayouts) (*Job, error) {
 	var (
 		mainJobSet      bool
 		mainJobTemplate *BlockTemplate
 	)
 	job := Job{
-		heights: map[string]int64{},
-		algo:    algo,
+		heights:      map[string]int64{},
+		algo:         algo,
+		templateHash: templatesHash(templates),
 	}
 	for tmplKey, tmplRaw := range templates {
 		var tmpl BlockTemplate
@@ -39,14 +55,22 @@ func NewJobFromTemplates(templates map[TemplateKey][]byte, algo *service.Algo) (
 		if err != nil {
 			return nil, errors.Wrapf(err, "Unable to deserialize template: %v", string(tmplRaw))
 		}
-		chainConfig, ok := service.CurrencyConfig[tmplKey.Currency]
+		tmpl.raw = tmplRaw
+		chainConfig, ok := service.Currency(tmplKey.Currency)
 		if !ok {
 			return nil, errors.Errorf("No currency config for %s", tmplKey.Currency)
 		}
+		if err := tmpl.applyHooks(tmplRaw, chainConfig); err != nil {
+			return nil, err
+		}
 
 		switch tmplKey.TemplateType {
-		case "getblocktemplate_aux":
-			auxChainJob, err := NewAuxChainJob(&tmpl, chainConfig, algo)
+		case "getblocktemplate_aux", "createauxblock":
+			newAuxChainJob := NewAuxChainJob
+			if tmplKey.TemplateType == "createauxblock" {
+				newAuxChainJob = NewAuxBlockJob
+			}
+			auxChainJob, err := newAuxChainJob(&tmpl, chainConfig, algo)
 			if err != nil {
 				return nil, err
 			}
@@ -57,6 +81,13 @@ func NewJobFromTemplates(templates map[TemplateKey][]byte, algo *service.Algo) (
 				return nil, errors.Errorf("You can only have one base currency template")
 			}
 			mainJobSet = true
+			if payouts != nil {
+				target, err := tmpl.getTarget()
+				if err != nil {
+					return nil, errors.Wrap(err, "Error generating target")
+				}
+				tmpl.payoutWindow = payouts.Window(chainConfig.Code, target)
+			}
 			mainChainJob, err := NewMainChainJob(&tmpl, chainConfig, algo)
 			if err != nil {
 				return nil, err
@@ -73,38 +104,33 @@ func NewJobFromTemplates(templates map[TemplateKey][]byte, algo *service.Algo) (
 	}
 
 	// Build the merge mining merkle tree
-	var merkleSize = 1
-	var merkleBase [][]byte
-	var merkleNonce uint32 = 0
-MerkleLoop:
-	for {
-		// A candidate for the size of our blockchain merkle tree. If it fails
-		// we iterate
-		merkleBase = make([][]byte, merkleSize)
-		for _, mj := range job.auxChains {
-			var slot uint32 = merkleNonce
-			slot = slot*1103515245 + 12345
-			slot += uint32(mj.chainID)
-			slot = slot*1103515245 + 12345
-			slotNum := slot % uint32(merkleSize)
-			if merkleBase[slotNum] != nil {
-				merkleSize *= 2
-				continue MerkleLoop
-			}
-			merkleBase[slotNum] = mj.headerHash.CloneBytes()
-		}
-		break
+	chainIDs := map[string]int{}
+	for _, mj := range job.auxChains {
+		chainIDs[mj.currencyConfig.Code] = mj.chainID
+	}
+	params, err := findAuxMerkleParams(chainIDs)
+	if err != nil {
+		return nil, err
+	}
+	job.auxMerkle = params
+	// Empty slots are zeros
+	merkleBase := make([][]byte, params.Size)
+	for i := range merkleBase {
+		merkleBase[i] = make([]byte, chainhash.HashSize)
+	}
+	for _, mj := range job.auxChains {
+		merkleBase[params.Slots[mj.currencyConfig.Code]] = mj.headerHash.CloneBytes()
 	}
 
 	for _, mj := range job.auxChains {
-		branch, mask := auxMerkleBranch(merkleBase, mj.headerHash.CloneBytes())
+		branch, mask := merkleBranchAt(merkleBase, params.Slots[mj.currencyConfig.Code])
 		mj.blockchainMerkleBranch = branch
 		mj.blockchainMerkleMask = mask
 	}
 
 	mmCoinbase := bytes.Buffer{}
 	if len(job.auxChains) > 0 {
-		mmCoinbase.Write([]byte{0xfa, 0xbe, 'm', 'm'})
+		mmCoinbase.Write(mergedMiningMagic)
 		if len(job.auxChains) > 1 {
 			merkleRoot := merkleRoot(merkleBase)
 			common.ReverseBytes(merkleRoot)
@@ -117,11 +143,11 @@ MerkleLoop:
 		}
 		// Merkle size
 		encodedMerkleSize := make([]byte, 4)
-		binary.LittleEndian.PutUint32(encodedMerkleSize[0:], uint32(merkleSize))
+		binary.LittleEndian.PutUint32(encodedMerkleSize[0:], params.Size)
 		mmCoinbase.Write(encodedMerkleSize)
 		// Nonce
 		encodedNonce := make([]byte, 4)
-		binary.LittleEndian.PutUint32(encodedNonce, uint32(merkleNonce))
+		binary.LittleEndian.PutUint32(encodedNonce, params.Nonce)
 		mmCoinbase.Write(encodedNonce)
 	}
 
@@ -129,23 +155,90 @@ MerkleLoop:
 	if err != nil {
 		return nil, errors.Wrap(err, "Unable to create coinbase")
 	}
+	// Only now is the coinbase known, so only now can we check the block
+	// fits. Dropping transactions changes the coinbase value, the merkle
+	// branch and the subsidy, so the main chain job is built again
+	coinbase := bytes.Buffer{}
+	coinbase.Write(coinbase1)
+	coinbase.Write(make([]byte, extranonceSize))
+	coinbase.Write(coinbase2)
+	dropped, err := mainJobTemplate.fitLimits(coinbase.Bytes(), 0)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s block", job.currencyConfig.Code)
+	}
+	if dropped > 0 {
+		log.Warn("Dropped transactions to fit block limits",
+			"currency", job.currencyConfig.Code, "dropped", dropped)
+		mainChainJob, err := NewMainChainJob(mainJobTemplate, job.currencyConfig, algo)
+		if err != nil {
+			return nil, err
+		}
+		job.MainChainJob = *mainChainJob
+		coinbase1, coinbase2, err = mainJobTemplate.createCoinbaseSplit(
+			job.currencyConfig, mmCoinbase.Bytes())
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to create coinbase")
+		}
+	}
 	job.coinbase1 = coinbase1
 	job.coinbase2 = coinbase2
 	return &job, nil
 }
 
-func (j *Job) SetFlush(lastJobSetFlush interface{}) (bool, interface{}) {
+// When jobs tell miners to drop their work (clean_jobs). New main chain
+// blocks always do
+type cleanJobsPolicy struct {
+	// Whether new aux chain blocks do: "flushaux" as each currency's FlushAux
+	// says, "always" or "never"
+	aux string
+	// Clean jobs for new aux chain blocks closer than this to the last clean
+	// job go out as ordinary updates. 0 disables
+	minInterval time.Duration
+}
+
+var auxCleanJobsModes = map[string]bool{"flushaux": true, "always": true, "never": true}
+
+func (p cleanJobsPolicy) flushAux(config *service.ChainConfig) bool {
+	switch p.aux {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+	return config.FlushAux
+}
+
+// Whether a job SetFlush made clean stays clean, given when the lane last
+// sent a clean job. A new main chain block makes miners' work stale however
+// recently they were flushed, so only aux flushes are throttled
+func (p cleanJobsPolicy) throttle(j *Job, lastClean time.Time, now time.Time) bool {
+	if !j.cleanJobs || !j.auxFlush {
+		return j.cleanJobs
+	}
+	return p.minInterval <= 0 || now.Sub(lastClean) >= p.minInterval
+}
+
+// Decides whether the job is clean, from the heights of the lane's last job.
+// Jobs for an earlier block than the last are to be ignored
+func (j *Job) SetFlush(lastJobSetFlush interface{}, policy cleanJobsPolicy) (bool, interface{}) {
 	switch prev := lastJobSetFlush.(type) {
+	case nil:
+		// The lane's first job
+		j.cleanJobs = true
 	case map[string]int64:
 		if j.height > prev[j.currencyConfig.Code] {
 			j.cleanJobs = true
-			return false, j.height
+			return false, j.heights
 		} else if j.height < prev[j.currencyConfig.Code] {
 			return true, nil
 		}
 		for _, aux := range j.auxChains {
-			if aux.currencyConfig.FlushAux && aux.height > prev[aux.currencyConfig.Code] {
+			// An aux chain that's just been added has nothing to go stale,
+			// so it never causes a flush
+			prevHeight, ok := prev[aux.currencyConfig.Code]
+			if ok && policy.flushAux(aux.currencyConfig) && aux.height > prevHeight {
 				j.cleanJobs = true
+				j.auxFlush = true
 				return false, j.heights
 			}
 		}
@@ -153,24 +246,21 @@ func (j *Job) SetFlush(lastJobSetFlush interface{}) (bool, interface{}) {
 	return false, j.heights
 }
 
-func (j *Job) GetStratum2Params(extranonce1 []byte) (map[string]interface{}, error) {
-	coinbase := bytes.Buffer{}
-	coinbase.Write(j.coinbase1)
-	coinbase.Write(extranonce1)
-	// Empty bytes to fill in user selected extranonce2. Easier to do this than
-	// conditionally change extranonce placeholder for jsonrpc 2, since users
-	// don't pick extranonces in jsonrpc 2 (XMR)
-	coinbase.Write([]byte{0, 0, 0, 0})
-	coinbase.Write(j.coinbase2)
-
-	var hasher = sha256d.New()
-	hasher.Write(coinbase.Bytes())
-	coinbaseHash := hasher.Sum(nil)
-
-	header := j.GetBlockHeader([]byte{0, 0, 0, 0}, coinbaseHash)
+// JSON-RPC 2.0 miners don't pick an extranonce2, they only iterate the nonce,
+// so the rest of the extranonce after extranonce1 is zeros
+func stratum2Extranonce(extranonce1 []byte) []byte {
+	extranonce := make([]byte, extranonceSize)
+	copy(extranonce, extranonce1)
+	return extranonce
+}
 
+func (j *Job) GetStratum2Params(format *BlobFormat, extranonce1 []byte) (map[string]interface{}, error) {
+	blob, err := format.Blob(j, stratum2Extranonce(extranonce1))
+	if err != nil {
+		return nil, err
+	}
 	return map[string]interface{}{
-		"blob": hex.EncodeToString(header[:76]),
+		"blob": hex.EncodeToString(blob),
 	}, nil
 }
 
@@ -191,7 +281,46 @@ func (j *Job) GetStratumParams() ([]interface{}, error) {
 	}, nil
 }
 
-func (j *Job) CheckSolves(nonce []byte, extraNonce []byte, shareTarget *big.Int) (map[string]*BlockSolve, bool, []string, error) {
+// The start of a mining.notify, up to and including the client's job id
+func notifyHead(jid string) []byte {
+	return []byte(`{"id":null,"method":"mining.notify","params":["` + jid + `"`)
+}
+
+// The rest of a mining.notify after notifyHead, with clean_jobs set to clean.
+// Together they're what marshaling a StratumMessage gives
+func (j *Job) notifyTail(clean bool) ([]byte, error) {
+	j.notifyOnce.Do(func() {
+		params, err := j.GetStratumParams()
+		if err != nil {
+			j.notifyErr = err
+			return
+		}
+		for i, c := range []bool{false, true} {
+			// clean_jobs is always the last param
+			params[len(params)-1] = c
+			encoded, err := json.Marshal(params)
+			if err != nil {
+				j.notifyErr = err
+				return
+			}
+			// Drop the opening [, the params continue after the job id
+			tail := append([]byte{','}, encoded[1:]...)
+			j.notifyTails[i] = append(tail, '}', '\n')
+		}
+	})
+	if j.notifyErr != nil {
+		return nil, j.notifyErr
+	}
+	if clean {
+		return j.notifyTails[1], nil
+	}
+	return j.notifyTails[0], nil
+}
+
+// version overrides the job's block version when the miner has rolled it, nil
+// uses the job's. Also returns the hash over the main chain's target, so a
+// ratio of 1 or less is a main chain block
+func (j *Job) CheckSolves(nonce []byte, extraNonce []byte, version []byte, shareTarget *big.Int) (map[string]*BlockSolve, bool, []string, float64, error) {
 	var ret = map[string]*BlockSolve{}
 	var validShare = false
 
@@ -200,24 +329,27 @@ func (j *Job) CheckSolves(nonce []byte, extraNonce []byte, shareTarget *big.Int)
 	coinbase.Write(extraNonce)
 	coinbase.Write(j.coinbase2)
 
-	var hasher = sha256d.New()
+	hasher := getHasher()
 	hasher.Write(coinbase.Bytes())
 	coinbaseHash := hasher.Sum(nil)
+	putHasher(hasher)
 
 	header := j.GetBlockHeader(nonce, coinbaseHash)
+	if version != nil {
+		copy(header[0:4], version)
+	}
 	headerHsh, err := j.algo.PoWHash(header)
 	if err != nil {
-		return nil, false, nil, err
+		return nil, false, nil, 0, err
 	}
 	hashObj, err := chainhash.NewHash(headerHsh)
 	if err != nil {
-		return nil, false, nil, err
+		return nil, false, nil, 0, err
 	}
 	bigHsh := blockchain.HashToBig(hashObj)
-	// Share targets are in opposite endian of block targets (i think..), so
-	// the comparison direction is opposite as well. Here we check if hash >
-	// target, but below we check if hash < network_target
-	if shareTarget != nil && bigHsh.Cmp(shareTarget) >= 0 {
+	// Share and block targets are both compared against the little endian
+	// hash, see Algo.ShareTarget
+	if shareTarget != nil && bigHsh.Cmp(shareTarget) <= 0 {
 		validShare = true
 	}
 
@@ -229,6 +361,9 @@ func (j *Job) CheckSolves(nonce []byte, extraNonce []byte, shareTarget *big.Int)
 			subsidyAddress: (*j.currencyConfig.BlockSubsidyAddress).String(),
 			powalgo:        j.algo.Name,
 			subsidy:        j.subsidy,
+			payees:         j.payees,
+			reward:         j.template.reward(),
+			rawTemplate:    j.template.raw,
 			height:         j.height,
 			powhash:        bigHsh,
 			target:         j.target,
@@ -241,15 +376,20 @@ func (j *Job) CheckSolves(nonce []byte, extraNonce []byte, shareTarget *big.Int)
 			ret[mj.currencyConfig.Code] = &BlockSolve{
 				data:           mj.GetBlock(coinbase.Bytes(), headerHsh, j.merkleBranch, header),
 				subsidy:        mj.subsidy,
+				reward:         mj.template.reward(),
+				rawTemplate:    mj.template.raw,
 				height:         mj.height,
 				coinbaseHash:   mj.coinbaseHash,
 				subsidyAddress: (*mj.currencyConfig.BlockSubsidyAddress).String(),
 				powhash:        bigHsh,
 				target:         mj.target,
+				auxBlockHash:   mj.auxBlockHash,
 			}
 		}
 	}
-	return ret, validShare, currencies, nil
+	blockRatio, _ := new(big.Float).Quo(new(big.Float).SetInt(bigHsh),
+		new(big.Float).SetInt(j.target)).Float64()
+	return ret, validShare, currencies, blockRatio, nil
 }
 
 type MainChainJob struct {
@@ -257,6 +397,8 @@ type MainChainJob struct {
 	// For saving to database on solve
 	subsidy int64
 	height  int64
+	// Miners' parts of the block, when paid in the coinbase
+	payees []*CoinbasePayee
 
 	// For making the block header for mining/solve
 	bits          []byte
@@ -270,16 +412,22 @@ type MainChainJob struct {
 	// For checking solve and submitblock encoding
 	target       *big.Int
 	transactions [][]byte
+	// Written after the transactions, from TemplateHooks
+	blockSuffix []byte
+	// What the job was built from, for DryRun to check against
+	template *BlockTemplate
 
 	// for miners
 	cleanJobs bool
+	// Set by SetFlush when the job is only clean for a new aux chain block
+	auxFlush bool
 }
 
 func setAlgoVersion(version uint32, config *service.ChainConfig, algo *service.Algo) uint32 {
 	if config.MultiAlgo {
 		algoCode := config.MultiAlgoMap[algo.Name]
 		// Clear all algo bits
-		version &= ^uint32(((2 ^ config.MultiAlgoBitWidth) - 1) << config.MultiAlgoBitShift)
+		version &= ^multiAlgoMask(config)
 		// Inject algo bits for desired algo
 		version |= (algoCode << config.MultiAlgoBitShift)
 	}
@@ -296,7 +444,7 @@ func NewMainChainJob(tmpl *BlockTemplate, config *service.ChainConfig,
 	encodedTime := make([]byte, 4)
 	binary.LittleEndian.PutUint32(encodedTime[0:], uint32(tmpl.CurTime))
 	encodedVersion := make([]byte, 4)
-	version := uint32(tmpl.Version)
+	version := tmpl.hookVersion(uint32(tmpl.Version))
 	version = setAlgoVersion(version, config, algo)
 	binary.LittleEndian.PutUint32(encodedVersion[0:], version)
 
@@ -321,9 +469,15 @@ func NewMainChainJob(tmpl *BlockTemplate, config *service.ChainConfig,
 		transactions = append(transactions, decoded)
 	}
 
+	subsidy, payees, err := tmpl.poolSubsidy(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error building coinbase outputs")
+	}
+
 	job := &MainChainJob{
 		height:  tmpl.Height,
-		subsidy: tmpl.CoinbaseValue,
+		subsidy: subsidy,
+		payees:  payees,
 
 		currencyConfig: config,
 		transactions:   transactions,
@@ -333,13 +487,15 @@ func NewMainChainJob(tmpl *BlockTemplate, config *service.ChainConfig,
 		prevBlockHash:  encodedPrevBlockHash,
 		target:         target,
 		merkleBranch:   tmpl.merkleBranch(),
-		cleanJobs:      true, // TODO: change me
+		blockSuffix:    tmpl.blockSuffix(),
+		template:       tmpl,
 	}
 	return job, nil
 }
 
 func (j *MainChainJob) GetBlockHeader(nonce []byte, coinbaseHash []byte) []byte {
-	var hasher = sha256d.New()
+	hasher := getHasher()
+	defer putHasher(hasher)
 	buf := bytes.Buffer{}
 	buf.Write(j.version)
 	buf.Write(j.prevBlockHash)
@@ -371,6 +527,7 @@ func (j *MainChainJob) GetBlock(header []byte, coinbase []byte) []byte {
 	for _, t := range j.transactions {
 		block.Write(t)
 	}
+	block.Write(j.blockSuffix)
 	return block.Bytes()
 }
 
@@ -387,9 +544,13 @@ type AuxChainJob struct {
 	blockchainMerkleBranch [][]byte
 	blockchainMerkleMask   uint32
 	transactions           [][]byte
+	blockSuffix            []byte
 	coinbase               []byte
 	coinbaseHash           []byte
 	target                 *big.Int
+	template               *BlockTemplate
+	// The node's hash for createauxblock work, see NewAuxBlockJob
+	auxBlockHash string
 }
 
 func NewAuxChainJob(template *BlockTemplate, config *service.ChainConfig,
@@ -401,7 +562,7 @@ func NewAuxChainJob(template *BlockTemplate, config *service.ChainConfig,
 
 	blkHeader := bytes.Buffer{}
 	encodedVersion := make([]byte, 4)
-	version := uint32(template.Version)
+	version := template.hookVersion(uint32(template.Version))
 	// Set flag for an AuxPoW block
 	version |= (1 << 8)
 	version |= (uint32(template.Extras.ChainID) << 16)
@@ -422,6 +583,18 @@ func NewAuxChainJob(template *BlockTemplate, config *service.ChainConfig,
 	if err != nil {
 		return nil, err
 	}
+	dropped, err := template.fitLimits(coinbase, auxPowReserve)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s block", config.Code)
+	}
+	if dropped > 0 {
+		log.Warn("Dropped transactions to fit block limits",
+			"currency", config.Code, "dropped", dropped)
+		coinbase, err = template.createCoinbase(config, []byte{})
+		if err != nil {
+			return nil, err
+		}
+	}
 	var hasher = sha256d.New()
 	hasher.Write(coinbase)
 	coinbaseHash := hasher.Sum(nil)
@@ -460,50 +633,94 @@ func NewAuxChainJob(template *BlockTemplate, config *service.ChainConfig,
 		return nil, errors.New("Null chainid")
 	}
 
+	subsidy, _, err := template.poolSubsidy(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error building coinbase outputs")
+	}
+
 	acj := &AuxChainJob{
 		height:  template.Height,
-		subsidy: template.CoinbaseValue,
+		subsidy: subsidy,
 
 		currencyConfig: config,
 		target:         target,
 		coinbase:       coinbase,
 		coinbaseHash:   coinbaseHash,
 		transactions:   transactions,
+		blockSuffix:    template.blockSuffix(),
 		chainID:        template.Extras.ChainID,
 		headerHash:     hashObj,
 		blockHeader:    blkHeader.Bytes(),
+		template:       template,
 	}
 	return acj, nil
 }
-func (j *AuxChainJob) GetBlock(coinbase []byte, parentHash []byte, coinbaseBranch [][]byte, parentHeader []byte) []byte {
-	block := bytes.Buffer{}
-	block.Write(j.blockHeader)
-	block.Write(coinbase)
-	block.Write(parentHash)
-	// Coinbase merkle branch
-	wire.WriteVarInt(&block, 0, uint64(len(coinbaseBranch)))
-	for _, branch := range coinbaseBranch {
-		block.Write(branch)
-	}
-	// Coinbase branch mask is always all zeros (right, right, right...)
-	block.Write([]byte{0, 0, 0, 0})
 
-	// Blockchain merkle branch
-	wire.WriteVarInt(&block, 0, uint64(len(j.blockchainMerkleBranch)))
-	for _, branch := range j.blockchainMerkleBranch {
-		block.Write(branch)
+// An aux chain job from createauxblock work. The node built the block, so
+// all there is to it is the header hash that goes in the merge mining tree.
+// Solves are submitted with submitauxblock, and the node pays
+// coinbasevalue to the address coinbuddy asked for, BlockSubsidyAddress
+func NewAuxBlockJob(template *BlockTemplate, config *service.ChainConfig,
+	algo *service.Algo) (*AuxChainJob, error) {
+	target, err := template.getTarget()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating target")
 	}
-	// Coinbase branch mask is always all zeros (right, right, right...)
-	encodedMask := make([]byte, 4)
-	binary.LittleEndian.PutUint32(encodedMask, j.blockchainMerkleMask)
-	block.Write(encodedMask)
+	hashObj, err := chainhash.NewHashFromStr(template.AuxBlockHash)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid auxblockhash")
+	}
+	if template.Extras.ChainID == 0 {
+		return nil, errors.New("Null chainid")
+	}
+	return &AuxChainJob{
+		height:         template.Height,
+		subsidy:        template.CoinbaseValue,
+		currencyConfig: config,
+		target:         target,
+		chainID:        template.Extras.ChainID,
+		headerHash:     hashObj,
+		template:       template,
+		auxBlockHash:   template.AuxBlockHash,
+	}, nil
+}
 
-	block.Write(parentHeader)
+func (j *AuxChainJob) GetBlock(coinbase []byte, parentHash []byte, coinbaseBranch [][]byte, parentHeader []byte) []byte {
+	block := bytes.Buffer{}
+	// The node has the rest of the block, and takes only the AuxPoW
+	if j.auxBlockHash != "" {
+		j.writeAuxPoW(&block, coinbase, parentHash, coinbaseBranch, parentHeader)
+		return block.Bytes()
+	}
+	block.Write(j.blockHeader)
+	j.writeAuxPoW(&block, coinbase, parentHash, coinbaseBranch, parentHeader)
 	wire.WriteVarInt(&block, 0, uint64(len(j.transactions)+1))
 	block.Write(j.coinbase)
 
 	for _, t := range j.transactions {
 		block.Write(t)
 	}
+	block.Write(j.blockSuffix)
 	return block.Bytes()
 }
+
+func (j *AuxChainJob) writeAuxPoW(block *bytes.Buffer, coinbase []byte, parentHash []byte, coinbaseBranch [][]byte, parentHeader []byte) {
+	block.Write(coinbase)
+	block.Write(parentHash)
+	// The coinbase is the parent block's first transaction, so its branch
+	// mask is zero, see BlockTemplate.merkleBranch
+	writeMerkleBranch(block, coinbaseBranch, 0)
+	writeMerkleBranch(block, j.blockchainMerkleBranch, j.blockchainMerkleMask)
+	block.Write(parentHeader)
+}
+
+// A merkle branch as AuxPoW serializes it, the hashes then the mask
+func writeMerkleBranch(block *bytes.Buffer, branch [][]byte, mask uint32) {
+	wire.WriteVarInt(block, 0, uint64(len(branch)))
+	for _, hash := range branch {
+		block.Write(hash)
+	}
+	encodedMask := make([]byte, 4)
+	binary.LittleEndian.PutUint32(encodedMask, mask)
+	block.Write(encodedMask)
+}
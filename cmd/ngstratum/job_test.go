@@ -1,10 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcutil"
 	"github.com/davecgh/go-spew/spew"
+	"github.com/icook/ngpool/pkg/common"
+	"github.com/icook/ngpool/pkg/service"
 	"github.com/stretchr/testify/assert"
 	"math/big"
 	"testing"
+	"time"
 )
 
 func TestTarget(t *testing.T) {
@@ -42,9 +50,11 @@ func TestAuxBranch(t *testing.T) {
 			0x2b, 0xc4, 0x15, 0x12, 0xf7, 0x30, 0x99, 0x90, 0xe5, 0xfc, 0x1f, 0x47,
 			0x22, 0x6e, 0x94, 0xbd, 0xc, 0x8f, 0xa8, 0xf8, 0xea, 0x59},
 	}
-	branch, mask := auxMerkleBranch(input, input[2])
+	branch, mask := merkleBranchAt(input, 2)
 	spew.Dump(branch)
-	assert.Equal(t, uint32(1), mask)
+	// The mask is the slot, which aux daemons check against their expected
+	// index
+	assert.Equal(t, uint32(2), mask)
 	assert.Equal(t, correct, branch)
 }
 
@@ -70,3 +80,257 @@ func TestBranch(t *testing.T) {
 	}
 	assert.Equal(t, correct, tmpl.merkleBranch())
 }
+
+func TestCoinbaseOutputs(t *testing.T) {
+	params := &chaincfg.TestNet3Params
+	subsidyAddr, _ := btcutil.DecodeAddress("mucHkBoHAF8DTQWFuwQXHiewqi3ZBDNNWh", params)
+	donateAddr, _ := btcutil.DecodeAddress("mipcBbFg9gMiCh81Kj8tqqdgoZub1ZJRfn", params)
+	common.RegisterAddressCodec("LTC_T", &common.Base58Codec{Params: params})
+	config := &service.ChainConfig{
+		Code:                "LTC_T",
+		Params:              params,
+		BlockSubsidyAddress: &subsidyAddr,
+		CoinbaseSplits: []service.CoinbaseSplit{
+			{Name: "donation", Address: donateAddr, Percent: 1},
+		},
+	}
+	tmpl := BlockTemplate{
+		CoinbaseValue: 5000000000,
+		Founder: &GBTPayee{
+			Payee:  "mipcBbFg9gMiCh81Kj8tqqdgoZub1ZJRfn",
+			Amount: 1000000000,
+		},
+	}
+	outputs, err := tmpl.coinbaseOutputs(config)
+	assert.NoError(t, err)
+	// Founder payments haven't started, so only the split applies
+	assert.Len(t, outputs, 2)
+	assert.Equal(t, int64(4950000000), outputs[0].Value)
+
+	tmpl.FounderPaymentsStarted = true
+	outputs, err = tmpl.coinbaseOutputs(config)
+	assert.NoError(t, err)
+	assert.Len(t, outputs, 3)
+	assert.Equal(t, int64(1000000000), outputs[1].Value)
+	assert.Equal(t, int64(40000000), outputs[2].Value)
+	assert.Equal(t, int64(3960000000), outputs[0].Value)
+}
+
+func TestMasternodePayees(t *testing.T) {
+	params := &chaincfg.TestNet3Params
+	subsidyAddr, _ := btcutil.DecodeAddress("mucHkBoHAF8DTQWFuwQXHiewqi3ZBDNNWh", params)
+	common.RegisterAddressCodec("LTC_T", &common.Base58Codec{Params: params})
+	config := &service.ChainConfig{
+		Code:                "LTC_T",
+		Params:              params,
+		BlockSubsidyAddress: &subsidyAddr,
+	}
+	raw := `{
+		"coinbasevalue": 5000000000,
+		"masternode": {"payee": "mipcBbFg9gMiCh81Kj8tqqdgoZub1ZJRfn", "script": "", "amount": 2500000000},
+		"superblocks_started": true,
+		"superblock": [
+			{"payee": "", "script": "76a914a32b5c4b9e8a1e5a3b2f2d4f3e3c1a1b2c3d4e5f88ac", "amount": 100000000},
+			{"payee": "", "script": "", "amount": 0}
+		]
+	}`
+	var tmpl BlockTemplate
+	err := json.Unmarshal([]byte(raw), &tmpl)
+	assert.NoError(t, err)
+	assert.Len(t, tmpl.Masternode, 1)
+
+	outputs, err := tmpl.coinbaseOutputs(config)
+	assert.NoError(t, err)
+	assert.Len(t, outputs, 3)
+	assert.Equal(t, int64(2400000000), outputs[0].Value)
+	assert.Equal(t, int64(2500000000), outputs[1].Value)
+	assert.Equal(t, int64(100000000), outputs[2].Value)
+
+	// Newer daemons send a list of masternode payees
+	err = json.Unmarshal([]byte(`[{"payee": "mipcBbFg9gMiCh81Kj8tqqdgoZub1ZJRfn", "amount": 1}]`),
+		&tmpl.Masternode)
+	assert.NoError(t, err)
+	assert.Len(t, tmpl.Masternode, 1)
+	assert.Equal(t, int64(1), tmpl.Masternode[0].Amount)
+}
+
+func TestCoinbaseScript(t *testing.T) {
+	config := &service.ChainConfig{
+		Code:             "LTC_T",
+		CoinbaseTag:      []byte("/ngpool/"),
+		CoinbaseAuxFlags: true,
+	}
+	tmpl := BlockTemplate{
+		Height:      1000,
+		CoinbaseAux: map[string]string{"flags": "062f503253482f"},
+	}
+	script, err := tmpl.coinbaseScript(config, extraNonceMagic)
+	assert.NoError(t, err)
+	pushes, err := txscript.PushedData(script)
+	assert.NoError(t, err)
+	// Height 1000 little endian, as BIP34 requires
+	assert.Equal(t, [][]byte{
+		{0xe8, 0x03},
+		{0x06, 0x2f, 0x50, 0x32, 0x53, 0x48, 0x2f},
+		extraNonceMagic,
+		[]byte("/ngpool/"),
+	}, pushes)
+
+	// The tag still fits alongside a merged mining commitment
+	config.CoinbaseAuxFlags = false
+	config.CoinbaseTag = bytes.Repeat([]byte{'a'}, service.MaxCoinbaseTagLen)
+	tmpl.Height = 0x7fffffff
+	script, err = tmpl.coinbaseScript(config, append(make([]byte, 44), extraNonceMagic...))
+	assert.NoError(t, err)
+	assert.Len(t, script, 100)
+
+	// But with aux flags it won't
+	config.CoinbaseAuxFlags = true
+	_, err = tmpl.coinbaseScript(config, append(make([]byte, 44), extraNonceMagic...))
+	assert.Error(t, err)
+
+	tmpl.CoinbaseAux = map[string]string{"flags": "zz"}
+	_, err = tmpl.coinbaseScript(config, extraNonceMagic)
+	assert.Error(t, err)
+}
+
+func TestNotifyTail(t *testing.T) {
+	job := &Job{MainChainJob: MainChainJob{
+		prevBlockHash: []byte{1, 2},
+		coinbase1:     []byte{3},
+		coinbase2:     []byte{4},
+		merkleBranch:  [][]byte{{5}, {6}},
+		version:       []byte{0, 0, 0, 0x20},
+		bits:          []byte{7},
+		time:          []byte{8},
+		cleanJobs:     true,
+	}}
+	for _, clean := range []bool{true, false} {
+		params, err := job.GetStratumParams()
+		assert.NoError(t, err)
+		params[len(params)-1] = clean
+		expected, err := json.Marshal(&StratumMessage{
+			Method: "mining.notify",
+			Params: append([]interface{}{"abcd"}, params...),
+		})
+		assert.NoError(t, err)
+
+		tail, err := job.notifyTail(clean)
+		assert.NoError(t, err)
+		notify := append(notifyHead("abcd"), tail...)
+		assert.Equal(t, string(expected)+"\n", string(notify))
+	}
+}
+
+func TestSetFlushPolicy(t *testing.T) {
+	btc := &service.ChainConfig{Code: "BTC"}
+	nmc := &service.ChainConfig{Code: "NMC", FlushAux: true}
+	newJob := func(auxHeight int64) *Job {
+		return &Job{
+			MainChainJob: MainChainJob{currencyConfig: btc, height: 10},
+			auxChains:    []*AuxChainJob{{height: auxHeight, currencyConfig: nmc}},
+			heights:      map[string]int64{"BTC": 10, "NMC": auxHeight},
+		}
+	}
+
+	// The lane's first job is clean
+	job := newJob(5)
+	_, last := job.SetFlush(nil, cleanJobsPolicy{})
+	assert.True(t, job.cleanJobs)
+
+	for _, step := range []struct {
+		aux   string
+		clean bool
+	}{
+		{"flushaux", true},
+		{"never", false},
+		{"always", true},
+	} {
+		job = newJob(6)
+		job.SetFlush(last, cleanJobsPolicy{aux: step.aux})
+		assert.Equal(t, step.clean, job.cleanJobs, step.aux)
+	}
+	nmc.FlushAux = false
+	job = newJob(6)
+	job.SetFlush(last, cleanJobsPolicy{aux: "flushaux"})
+	assert.False(t, job.cleanJobs)
+	job = newJob(6)
+	job.SetFlush(last, cleanJobsPolicy{aux: "always"})
+	assert.True(t, job.cleanJobs)
+}
+
+func TestCleanJobsThrottle(t *testing.T) {
+	btc := &service.ChainConfig{Code: "BTC"}
+	nmc := &service.ChainConfig{Code: "NMC", FlushAux: true}
+	newJob := func(height int64, auxHeight int64) *Job {
+		return &Job{
+			MainChainJob: MainChainJob{currencyConfig: btc, height: height},
+			auxChains:    []*AuxChainJob{{height: auxHeight, currencyConfig: nmc}},
+			heights:      map[string]int64{"BTC": height, "NMC": auxHeight},
+		}
+	}
+	now := time.Unix(1500000000, 0)
+	policy := cleanJobsPolicy{aux: "flushaux", minInterval: time.Minute}
+	_, last := newJob(10, 5).SetFlush(nil, policy)
+
+	// A new aux block within the interval is throttled
+	aux := newJob(10, 6)
+	aux.SetFlush(last, policy)
+	assert.True(t, aux.cleanJobs)
+	assert.True(t, policy.throttle(aux, time.Time{}, now))
+	assert.False(t, policy.throttle(aux, now.Add(-30*time.Second), now))
+	assert.True(t, policy.throttle(aux, now.Add(-time.Minute), now))
+	assert.True(t, cleanJobsPolicy{}.throttle(aux, now, now))
+
+	// A new main chain block within it stays clean, even with a new aux
+	// block too
+	for _, main := range []*Job{newJob(11, 5), newJob(11, 6)} {
+		main.SetFlush(last, policy)
+		assert.True(t, policy.throttle(main, now.Add(-30*time.Second), now))
+	}
+
+	refresh := newJob(10, 5)
+	refresh.SetFlush(last, policy)
+	assert.False(t, policy.throttle(refresh, time.Time{}, now))
+}
+
+func TestBlockReward(t *testing.T) {
+	tmpl := BlockTemplate{
+		CoinbaseValue: 2500001500,
+		Transactions:  []GBTTransaction{{Fee: 1000}, {Fee: 500}, {}},
+	}
+	assert.Equal(t, blockReward{fees: 1500, baseSubsidy: 2500000000, txCount: 4}, tmpl.reward())
+	assert.Equal(t, blockReward{baseSubsidy: 100, txCount: 1}, (&BlockTemplate{CoinbaseValue: 100}).reward())
+}
+
+func TestSetFlush(t *testing.T) {
+	btc := &service.ChainConfig{Code: "BTC"}
+	newJob := func(height int64) *Job {
+		return &Job{
+			MainChainJob: MainChainJob{currencyConfig: btc, height: height},
+			heights:      map[string]int64{"BTC": height},
+		}
+	}
+	var last interface{} = map[string]int64{}
+	for _, step := range []struct {
+		height int64
+		ignore bool
+		clean  bool
+	}{
+		{10, false, true},
+		// A refreshed template for the same block keeps miners' work
+		{10, false, false},
+		{11, false, true},
+		// Back to back blocks both flush
+		{12, false, true},
+		{11, true, false},
+	} {
+		job := newJob(step.height)
+		ignore, next := job.SetFlush(last, cleanJobsPolicy{})
+		assert.Equal(t, step.ignore, ignore)
+		assert.Equal(t, step.clean, job.cleanJobs)
+		if !ignore {
+			last = next
+		}
+	}
+}
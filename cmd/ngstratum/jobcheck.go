@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/pkg/errors"
+	"github.com/seehuhn/sha256d"
+
+	"github.com/icook/ngpool/pkg/service"
+)
+
+// Merged mining commitment marker in the parent coinbase
+var mergedMiningMagic = []byte{0xfa, 0xbe, 'm', 'm'}
+
+// Builds the block a miner's share would become, with a zero nonce and
+// extranonce, and checks it's put together the way the coinserver expects.
+// A broken job would have miners hashing for blocks that get rejected, so
+// it's better not to send it at all. Transactions other than the coinbase
+// aren't decoded, since their format varies too much between coins
+func (j *Job) DryRun() error {
+	coinbase := bytes.Buffer{}
+	coinbase.Write(j.coinbase1)
+	coinbase.Write(make([]byte, extranonceSize))
+	coinbase.Write(j.coinbase2)
+	hasher := sha256d.New()
+	hasher.Write(coinbase.Bytes())
+	coinbaseHash := hasher.Sum(nil)
+
+	header := j.GetBlockHeader(make([]byte, 4), coinbaseHash)
+	err := j.checkHeader(header, coinbaseHash)
+	if err != nil {
+		return errors.Wrapf(err, "%s header", j.currencyConfig.Code)
+	}
+	err = checkCoinbase(coinbase.Bytes(), j.template, j.currencyConfig)
+	if err != nil {
+		return errors.Wrapf(err, "%s coinbase", j.currencyConfig.Code)
+	}
+	err = checkTxCount(j.GetBlock(header, coinbase.Bytes()), len(j.transactions)+1)
+	if err != nil {
+		return errors.Wrapf(err, "%s block", j.currencyConfig.Code)
+	}
+	if _, err := j.algo.PoWHash(header); err != nil {
+		return errors.Wrapf(err, "%s PoW hash", j.currencyConfig.Code)
+	}
+
+	for _, mj := range j.auxChains {
+		if !bytes.Contains(coinbase.Bytes(), mergedMiningMagic) {
+			return errors.Errorf("%s merged mining commitment missing from coinbase",
+				mj.currencyConfig.Code)
+		}
+		// The node built the block, we've no header or coinbase to check
+		if mj.auxBlockHash != "" {
+			continue
+		}
+		if len(mj.blockHeader) != wire.MaxBlockHeaderPayload {
+			return errors.Errorf("%s header is %d bytes", mj.currencyConfig.Code,
+				len(mj.blockHeader))
+		}
+		err := checkCoinbase(mj.coinbase, mj.template, mj.currencyConfig)
+		if err != nil {
+			return errors.Wrapf(err, "%s coinbase", mj.currencyConfig.Code)
+		}
+	}
+	return nil
+}
+
+// Decodes the header and compares each field with the template, which
+// catches any that were written in the wrong byte order
+func (j *Job) checkHeader(header []byte, coinbaseHash []byte) error {
+	if len(header) != wire.MaxBlockHeaderPayload {
+		return errors.Errorf("%d bytes, not %d", len(header), wire.MaxBlockHeaderPayload)
+	}
+	var decoded wire.BlockHeader
+	err := decoded.Deserialize(bytes.NewReader(header))
+	if err != nil {
+		return err
+	}
+	tmpl := j.template
+	if decoded.PrevBlock.String() != tmpl.PreviousBlockhash {
+		return errors.Errorf("previous block %s, template has %s",
+			decoded.PrevBlock, tmpl.PreviousBlockhash)
+	}
+	bits, err := hex.DecodeString(tmpl.Bits)
+	if err != nil || len(bits) != 4 {
+		return errors.Errorf("template has invalid bits %s", tmpl.Bits)
+	}
+	if decoded.Bits != binary.BigEndian.Uint32(bits) {
+		return errors.Errorf("bits %08x, template has %s", decoded.Bits, tmpl.Bits)
+	}
+	if decoded.Timestamp.Unix() != tmpl.CurTime {
+		return errors.Errorf("time %d, template has %d", decoded.Timestamp.Unix(), tmpl.CurTime)
+	}
+	if blockchain.CompactToBig(decoded.Bits).Cmp(j.target) != 0 {
+		return errors.New("bits don't match the job's target")
+	}
+	// Multi algo bits are ours to set, the rest should be what the template
+	// asked for
+	mask := multiAlgoMask(j.currencyConfig)
+	if uint32(decoded.Version)&^mask != uint32(tmpl.Version)&^mask {
+		return errors.Errorf("version %08x, template has %08x", decoded.Version, tmpl.Version)
+	}
+	// The merkle branch sent to miners must give the same root as hashing
+	// every transaction
+	if !bytes.Equal(header[36:68], tmpl.merkleRoot(coinbaseHash)) {
+		return errors.New("merkle root from branch doesn't match the transactions")
+	}
+	return nil
+}
+
+// The coinbase must decode, spend nothing, pay no more than the template
+// allows and include every payee the network requires
+func checkCoinbase(raw []byte, tmpl *BlockTemplate, chainConfig *service.ChainConfig) error {
+	var tx wire.MsgTx
+	reader := bytes.NewReader(raw)
+	err := tx.Deserialize(reader)
+	if err != nil {
+		return err
+	}
+	if reader.Len() != 0 {
+		return errors.Errorf("%d bytes after the transaction", reader.Len())
+	}
+	if !blockchain.IsCoinBaseTx(&tx) {
+		return errors.New("not a coinbase transaction")
+	}
+	var total int64
+	outputs := map[string]int64{}
+	for _, out := range tx.TxOut {
+		total += out.Value
+		outputs[hex.EncodeToString(out.PkScript)] += out.Value
+	}
+	if total > tmpl.CoinbaseValue {
+		return errors.Errorf("pays %d, more than the coinbase value %d",
+			total, tmpl.CoinbaseValue)
+	}
+	for _, payee := range tmpl.requiredPayees() {
+		script, err := payee.pkScript(chainConfig)
+		if err != nil {
+			return err
+		}
+		if outputs[hex.EncodeToString(script)] < payee.Amount {
+			return errors.Errorf("missing required payment of %d to %x",
+				payee.Amount, script)
+		}
+	}
+	return nil
+}
+
+// Blocks are the header, a transaction count, then the transactions
+func checkTxCount(block []byte, expected int) error {
+	reader := bytes.NewReader(block[wire.MaxBlockHeaderPayload:])
+	count, err := wire.ReadVarInt(reader, 0)
+	if err != nil {
+		return err
+	}
+	if count != uint64(expected) {
+		return errors.Errorf("transaction count is %d, has %d transactions", count, expected)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/icook/ngpool/pkg/common"
+	"github.com/icook/ngpool/pkg/service"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckCoinbase(t *testing.T) {
+	params := &chaincfg.TestNet3Params
+	subsidyAddr, _ := btcutil.DecodeAddress("mucHkBoHAF8DTQWFuwQXHiewqi3ZBDNNWh", params)
+	common.RegisterAddressCodec("LTC_T", &common.Base58Codec{Params: params})
+	config := &service.ChainConfig{
+		Code:                "LTC_T",
+		Params:              params,
+		BlockSubsidyAddress: &subsidyAddr,
+	}
+	tmpl := &BlockTemplate{
+		Height:        1000,
+		CoinbaseValue: 5000000000,
+		Masternode: GBTPayees{
+			{Payee: "mipcBbFg9gMiCh81Kj8tqqdgoZub1ZJRfn", Amount: 2500000000},
+		},
+	}
+	coinbase, err := tmpl.createCoinbase(config, make([]byte, extranonceSize))
+	assert.NoError(t, err)
+	assert.NoError(t, checkCoinbase(coinbase, tmpl, config))
+
+	// Trailing garbage would shift every transaction after it
+	assert.Error(t, checkCoinbase(append(coinbase, 0x00), tmpl, config))
+
+	// Paying more than the template allows
+	tmpl.CoinbaseValue = 4000000000
+	assert.Error(t, checkCoinbase(coinbase, tmpl, config))
+	tmpl.CoinbaseValue = 5000000000
+
+	// A masternode payee the coinbase doesn't pay
+	tmpl.Masternode[0].Amount = 2600000000
+	assert.Error(t, checkCoinbase(coinbase, tmpl, config))
+}
+
+func TestCheckTxCount(t *testing.T) {
+	block := make([]byte, wire.MaxBlockHeaderPayload)
+	block = append(block, 0x03)
+	assert.NoError(t, checkTxCount(block, 3))
+	assert.Error(t, checkTxCount(block, 2))
+	// Nothing after the header
+	assert.Error(t, checkTxCount(block[:wire.MaxBlockHeaderPayload], 1))
+}
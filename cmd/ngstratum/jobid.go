@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Job ids sent to miners are the main chain height, the start of a hash of
+// the templates the job was built from, and a counter for the session, in 8, 8
+// and 4 hex digits. Sending the same job to a session twice gives a new id, and
+// a share for a job that's no longer retained can still be told stale from one
+// for a job that never existed
+const jobIDLen = 20
+
+func makeJobID(height int64, templateHash uint32, counter uint16) string {
+	return fmt.Sprintf("%08x%08x%04x", uint32(height), templateHash, counter)
+}
+
+// The height a job id was made with, false if it isn't one of ours
+func jobIDHeight(id string) (int64, bool) {
+	if len(id) != jobIDLen {
+		return 0, false
+	}
+	height, err := strconv.ParseUint(id[:8], 16, 32)
+	if err != nil {
+		return 0, false
+	}
+	if _, err := strconv.ParseUint(id[8:], 16, 48); err != nil {
+		return 0, false
+	}
+	return int64(height), true
+}
+
+// The first 4 bytes of a sha256 over every template, in key order
+func templatesHash(templates map[TemplateKey][]byte) uint32 {
+	keys := make([]TemplateKey, 0, len(templates))
+	for key := range templates {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Currency != keys[j].Currency {
+			return keys[i].Currency < keys[j].Currency
+		}
+		return keys[i].TemplateType < keys[j].TemplateType
+	})
+	hasher := sha256.New()
+	for _, key := range keys {
+		hasher.Write([]byte(key.Currency + "/" + key.TemplateType + "\n"))
+		hasher.Write(templates[key])
+	}
+	return binary.BigEndian.Uint32(hasher.Sum(nil))
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobID(t *testing.T) {
+	id := makeJobID(1234567, 0xdeadbeef, 7)
+	assert.Equal(t, "0012d687deadbeef0007", id)
+	height, ok := jobIDHeight(id)
+	assert.True(t, ok)
+	assert.Equal(t, int64(1234567), height)
+
+	_, ok = jobIDHeight("deadbeef")
+	assert.False(t, ok)
+	_, ok = jobIDHeight("0012d687deadbeef000z")
+	assert.False(t, ok)
+
+	// The same templates hash the same however the map is built
+	templates := map[TemplateKey][]byte{
+		{Currency: "LTC", TemplateType: "getblocktemplate"}:      []byte(`{"height": 1}`),
+		{Currency: "DOGE", TemplateType: "getblocktemplate_aux"}: []byte(`{"height": 2}`),
+	}
+	hash := templatesHash(templates)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, hash, templatesHash(templates))
+	}
+	templates[TemplateKey{Currency: "DOGE", TemplateType: "getblocktemplate_aux"}] = []byte(`{"height": 3}`)
+	assert.NotEqual(t, hash, templatesHash(templates))
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"time"
+)
+
+// Holds back job notifications that don't start a new block so a connection
+// gets them at most every PortConfig.MinJobInterval. The newest held job isn't
+// dropped, it goes out once the interval is up, and flushes work if any job
+// it replaced would have. Only used by the write loop
+type jobThrottle struct {
+	interval time.Duration
+	niceHash bool
+
+	lastSent   time.Time
+	lastHeight int64
+	pending    *Job
+	// Whether any job held since the last send asked for clean jobs
+	pendingClean bool
+}
+
+func newJobThrottle(port *PortConfig) *jobThrottle {
+	return &jobThrottle{interval: port.MinJobInterval, niceHash: port.NiceHash}
+}
+
+// Returns the job to send now and whether it flushes work, or nil if it's
+// held for flush
+func (t *jobThrottle) push(job *Job, now time.Time) (*Job, bool) {
+	newBlock := job.height != t.lastHeight
+	if !newBlock && t.interval > 0 && now.Sub(t.lastSent) < t.interval {
+		t.pending = job
+		t.pendingClean = t.pendingClean || job.cleanJobs
+		return nil, false
+	}
+	// Only new blocks flush work in NiceHash mode
+	clean := (job.cleanJobs || t.pendingClean) && (newBlock || !t.niceHash)
+	t.sent(job, now)
+	return job, clean
+}
+
+// How long until the held job may be sent
+func (t *jobThrottle) wait(now time.Time) time.Duration {
+	return t.interval - now.Sub(t.lastSent)
+}
+
+// The held job and whether it flushes work, or nil if nothing is held
+func (t *jobThrottle) flush(now time.Time) (*Job, bool) {
+	job := t.pending
+	if job == nil {
+		return nil, false
+	}
+	clean := t.pendingClean && !t.niceHash
+	t.sent(job, now)
+	return job, clean
+}
+
+func (t *jobThrottle) sent(job *Job, now time.Time) {
+	t.lastSent = now
+	t.lastHeight = job.height
+	t.pending = nil
+	t.pendingClean = false
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func throttleJob(height int64, clean bool) *Job {
+	return &Job{MainChainJob: MainChainJob{height: height, cleanJobs: clean}}
+}
+
+func TestJobThrottleDeliversHeldJob(t *testing.T) {
+	throttle := newJobThrottle(&PortConfig{MinJobInterval: time.Second * 10})
+	now := time.Unix(1500000000, 0)
+
+	first := throttleJob(100, true)
+	job, clean := throttle.push(first, now)
+	assert.Equal(t, first, job)
+	assert.True(t, clean)
+
+	// An aux chain flush, then a plain update, both too soon
+	now = now.Add(time.Second * 2)
+	job, _ = throttle.push(throttleJob(100, true), now)
+	assert.Nil(t, job)
+	assert.Equal(t, time.Second*8, throttle.wait(now))
+	now = now.Add(time.Second * 2)
+	latest := throttleJob(100, false)
+	job, _ = throttle.push(latest, now)
+	assert.Nil(t, job)
+
+	// The newest goes out once the interval is up, still flushing work
+	now = now.Add(time.Second * 6)
+	job, clean = throttle.flush(now)
+	assert.Equal(t, latest, job)
+	assert.True(t, clean)
+	job, _ = throttle.flush(now)
+	assert.Nil(t, job)
+
+	// The interval starts again from the held job's send
+	job, _ = throttle.push(throttleJob(100, false), now.Add(time.Second))
+	assert.Nil(t, job)
+	job, clean = throttle.flush(now.Add(time.Second * 10))
+	assert.NotNil(t, job)
+	assert.False(t, clean)
+}
+
+func TestJobThrottleNewBlock(t *testing.T) {
+	throttle := newJobThrottle(&PortConfig{MinJobInterval: time.Second * 10, NiceHash: true})
+	now := time.Unix(1500000000, 0)
+
+	throttle.push(throttleJob(100, true), now)
+	job, _ := throttle.push(throttleJob(100, true), now.Add(time.Second))
+	assert.Nil(t, job)
+
+	// New blocks go out right away and replace anything held
+	block := throttleJob(101, true)
+	job, clean := throttle.push(block, now.Add(time.Second*2))
+	assert.Equal(t, block, job)
+	assert.True(t, clean)
+	job, _ = throttle.flush(now.Add(time.Second * 12))
+	assert.Nil(t, job)
+
+	// Only new blocks flush work in NiceHash mode
+	throttle.push(throttleJob(101, true), now.Add(time.Second*3))
+	job, clean = throttle.flush(now.Add(time.Second * 12))
+	assert.NotNil(t, job)
+	assert.False(t, clean)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-broadcast"
+	"github.com/pkg/errors"
+
+	"github.com/icook/ngpool/pkg/lbroadcast"
+)
+
+// How connections are shared between main chains
+const (
+	// Each new connection goes to the next main chain in turn
+	LaneSplitRoundRobin = "roundrobin"
+	// New connections go to whichever main chain is furthest below its
+	// share of BaseCurrencyWeights
+	LaneSplitWeighted = "weighted"
+)
+
+// One main chain a port mines. A port with several (ie LTC and DOGE, both
+// scrypt, neither merge mined) builds separate jobs for each, and every
+// connection mines a single lane for its whole session. Aux chains are merge
+// mined in all of them
+type MainChainLane struct {
+	key     TemplateKey
+	weight  float64
+	jobCast broadcast.Broadcaster
+	// Last job pushed, for deciding whether the next one flushes. Only
+	// touched by listenTemplates
+	lastJobFlush interface{}
+	// When the lane last sent a clean job, for MinCleanJobsInterval
+	lastCleanAt time.Time
+
+	// Guarded by the LaneSplitter's mtx
+	clients int
+	hasJob  bool
+}
+
+// Assigns connections to lanes
+type LaneSplitter struct {
+	lanes []*MainChainLane
+	mode  string
+	next  int
+	mtx   sync.Mutex
+}
+
+// weights are by currency code, missing ones default to 1. Unused unless
+// mode is LaneSplitWeighted
+func NewLaneSplitter(keys []TemplateKey, mode string,
+	weights map[string]float64) (*LaneSplitter, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("No base currencies")
+	}
+	if mode != LaneSplitRoundRobin && mode != LaneSplitWeighted {
+		return nil, errors.Errorf("Unknown split %s", mode)
+	}
+	s := &LaneSplitter{mode: mode}
+	seen := map[string]bool{}
+	for _, key := range keys {
+		if key.TemplateType != "getblocktemplate" {
+			return nil, errors.Errorf("Base currency %s has template type %s",
+				key.Currency, key.TemplateType)
+		}
+		if key.Algo != keys[0].Algo {
+			return nil, errors.Errorf("Base currencies %s and %s have different algos",
+				keys[0].Currency, key.Currency)
+		}
+		if seen[key.Currency] {
+			return nil, errors.Errorf("Base currency %s listed twice", key.Currency)
+		}
+		seen[key.Currency] = true
+		weight := 1.0
+		if w, ok := weights[key.Currency]; ok {
+			weight = w
+		}
+		if weight <= 0 {
+			return nil, errors.Errorf("Weight for %s must be above zero", key.Currency)
+		}
+		s.lanes = append(s.lanes, &MainChainLane{
+			key:     key,
+			weight:  weight,
+			jobCast: lbroadcast.NewLastBroadcaster(10),
+		})
+	}
+	return s, nil
+}
+
+// The lane mining currency as its main chain, nil if there's none
+func (s *LaneSplitter) Lane(currency string) *MainChainLane {
+	for _, lane := range s.lanes {
+		if lane.key.Currency == currency {
+			return lane
+		}
+	}
+	return nil
+}
+
+// The lanes a new template affects. A main chain template only changes its
+// own lane's jobs, an aux chain is in every lane except the one mining it as
+// a main chain
+func (s *LaneSplitter) lanesFor(key TemplateKey) []*MainChainLane {
+	if key.TemplateType == "getblocktemplate" {
+		if lane := s.Lane(key.Currency); lane != nil {
+			return []*MainChainLane{lane}
+		}
+		return nil
+	}
+	return s.lanes
+}
+
+// Picks the templates that make up a lane's job
+func (l *MainChainLane) templates(latest map[TemplateKey][]byte) map[TemplateKey][]byte {
+	tmpls := map[TemplateKey][]byte{}
+	for key, data := range latest {
+		if key == l.key ||
+			(key.IsAux() && key.Currency != l.key.Currency) {
+			tmpls[key] = data
+		}
+	}
+	return tmpls
+}
+
+func (s *LaneSplitter) setHasJob(lane *MainChainLane) {
+	s.mtx.Lock()
+	lane.hasJob = true
+	s.mtx.Unlock()
+}
+
+// Chooses a lane for a new connection, from those mining one of currencies
+// or any lane for none. Lanes without a job yet are skipped unless none have
+// one
+func (s *LaneSplitter) Assign(currencies []string) *MainChainLane {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	var candidates, ready []*MainChainLane
+	for _, lane := range s.lanes {
+		if len(currencies) > 0 && !containsCurrency(currencies, lane.key.Currency) {
+			continue
+		}
+		candidates = append(candidates, lane)
+		if lane.hasJob {
+			ready = append(ready, lane)
+		}
+	}
+	if len(ready) == 0 {
+		ready = candidates
+	}
+
+	var chosen *MainChainLane
+	switch s.mode {
+	case LaneSplitWeighted:
+		for _, lane := range ready {
+			if chosen == nil ||
+				float64(lane.clients)/lane.weight < float64(chosen.clients)/chosen.weight {
+				chosen = lane
+			}
+		}
+	default:
+		chosen = ready[s.next%len(ready)]
+		s.next++
+	}
+	chosen.clients++
+	return chosen
+}
+
+func (s *LaneSplitter) Release(lane *MainChainLane) {
+	s.mtx.Lock()
+	lane.clients--
+	s.mtx.Unlock()
+}
+
+func containsCurrency(currencies []string, currency string) bool {
+	for _, c := range currencies {
+		if c == currency {
+			return true
+		}
+	}
+	return false
+}
+
+// ie "LTC/DOGE", for logs and errors
+func (s *LaneSplitter) Currencies() string {
+	var currencies []string
+	for _, lane := range s.lanes {
+		currencies = append(currencies, lane.key.Currency)
+	}
+	return strings.Join(currencies, "/")
+}
+
+// Connections in each lane, by currency
+func (s *LaneSplitter) Stats() map[string]int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	stats := map[string]int{}
+	for _, lane := range s.lanes {
+		stats[lane.key.Currency] = lane.clients
+	}
+	return stats
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	ltcKey  = TemplateKey{Currency: "LTC", Algo: "scrypt", TemplateType: "getblocktemplate"}
+	dogeKey = TemplateKey{Currency: "DOGE", Algo: "scrypt", TemplateType: "getblocktemplate"}
+)
+
+func TestNewLaneSplitter(t *testing.T) {
+	_, err := NewLaneSplitter([]TemplateKey{ltcKey, dogeKey}, LaneSplitRoundRobin, nil)
+	assert.NoError(t, err)
+
+	_, err = NewLaneSplitter([]TemplateKey{ltcKey, ltcKey}, LaneSplitRoundRobin, nil)
+	assert.Error(t, err)
+	btcKey := TemplateKey{Currency: "BTC", Algo: "sha256d", TemplateType: "getblocktemplate"}
+	_, err = NewLaneSplitter([]TemplateKey{ltcKey, btcKey}, LaneSplitRoundRobin, nil)
+	assert.Error(t, err)
+	_, err = NewLaneSplitter([]TemplateKey{ltcKey}, "random", nil)
+	assert.Error(t, err)
+	_, err = NewLaneSplitter([]TemplateKey{ltcKey, dogeKey}, LaneSplitWeighted,
+		map[string]float64{"DOGE": 0})
+	assert.Error(t, err)
+}
+
+func TestLaneAssignRoundRobin(t *testing.T) {
+	s, _ := NewLaneSplitter([]TemplateKey{ltcKey, dogeKey}, LaneSplitRoundRobin, nil)
+	ltc, doge := s.Lane("LTC"), s.Lane("DOGE")
+
+	// Before any jobs every lane is fair game
+	assert.Equal(t, ltc, s.Assign(nil))
+	assert.Equal(t, doge, s.Assign(nil))
+
+	// Only lanes with work once some have it
+	s.setHasJob(doge)
+	assert.Equal(t, doge, s.Assign(nil))
+	assert.Equal(t, doge, s.Assign(nil))
+
+	s.setHasJob(ltc)
+	first := s.Assign(nil)
+	assert.NotEqual(t, first, s.Assign(nil))
+	assert.Equal(t, 6, s.Stats()["LTC"]+s.Stats()["DOGE"])
+
+	s.Release(doge)
+	assert.Equal(t, 5, s.Stats()["LTC"]+s.Stats()["DOGE"])
+}
+
+func TestLaneAssignWeighted(t *testing.T) {
+	s, _ := NewLaneSplitter([]TemplateKey{ltcKey, dogeKey}, LaneSplitWeighted,
+		map[string]float64{"LTC": 3})
+	s.setHasJob(s.Lane("LTC"))
+	s.setHasJob(s.Lane("DOGE"))
+	for i := 0; i < 8; i++ {
+		s.Assign(nil)
+	}
+	assert.Equal(t, map[string]int{"LTC": 6, "DOGE": 2}, s.Stats())
+
+	// Disconnects are refilled first
+	s.Release(s.Lane("DOGE"))
+	s.Release(s.Lane("DOGE"))
+	assert.Equal(t, s.Lane("DOGE"), s.Assign(nil))
+}
+
+func TestLaneAssignCurrencies(t *testing.T) {
+	s, _ := NewLaneSplitter([]TemplateKey{ltcKey, dogeKey}, LaneSplitRoundRobin, nil)
+	ltc, doge := s.Lane("LTC"), s.Lane("DOGE")
+	assert.Equal(t, doge, s.Assign([]string{"DOGE"}))
+	assert.Equal(t, doge, s.Assign([]string{"DOGE"}))
+
+	// A port's only lane is used before it has a job, even when others have
+	s.setHasJob(doge)
+	assert.Equal(t, ltc, s.Assign([]string{"LTC"}))
+	assert.Equal(t, map[string]int{"LTC": 1, "DOGE": 2}, s.Stats())
+}
+
+func TestLaneTemplates(t *testing.T) {
+	s, _ := NewLaneSplitter([]TemplateKey{ltcKey, dogeKey}, LaneSplitRoundRobin, nil)
+	dogeAux := TemplateKey{Currency: "DOGE", Algo: "scrypt", TemplateType: "getblocktemplate_aux"}
+	viaAux := TemplateKey{Currency: "VIA", Algo: "scrypt", TemplateType: "getblocktemplate_aux"}
+	latest := map[TemplateKey][]byte{
+		ltcKey:  []byte("ltc"),
+		dogeKey: []byte("doge"),
+		dogeAux: []byte("doge aux"),
+		viaAux:  []byte("via aux"),
+	}
+	assert.Equal(t, map[TemplateKey][]byte{
+		ltcKey:  []byte("ltc"),
+		dogeAux: []byte("doge aux"),
+		viaAux:  []byte("via aux"),
+	}, s.Lane("LTC").templates(latest))
+	// DOGE can't be merge mined under itself
+	assert.Equal(t, map[TemplateKey][]byte{
+		dogeKey: []byte("doge"),
+		viaAux:  []byte("via aux"),
+	}, s.Lane("DOGE").templates(latest))
+
+	assert.Equal(t, []*MainChainLane{s.Lane("DOGE")}, s.lanesFor(dogeKey))
+	assert.Len(t, s.lanesFor(viaAux), 2)
+}
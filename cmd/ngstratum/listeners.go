@@ -0,0 +1,336 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/pkg/errors"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// What sessions on a port start with
+type PortSettings struct {
+	VarDiff *VarDiff
+	// Difficulties sent to miners are multiplied by this, and ones they send
+	// divided by it, for miners that count difficulty against another diff1
+	DiffMultiplier float64
+	// The main chains sessions are assigned from, nil for all of them
+	Currencies []string
+	// Answer submits once they pass the checks that don't need hashing, see
+	// FastAck
+	FastAck bool
+}
+
+func (p *PortSettings) Equal(o *PortSettings) bool {
+	return p.DiffMultiplier == o.DiffMultiplier && p.VarDiff.Equal(o.VarDiff) &&
+		p.FastAck == o.FastAck &&
+		strings.Join(p.Currencies, "/") == strings.Join(o.Currencies, "/")
+}
+
+// A port miners connect to. Sessions take the port's settings when they
+// start and keep them, so changing a port only affects new sessions
+type stratumListener struct {
+	bind     string
+	listener net.Listener
+	// Holds the *PortSettings new sessions get
+	settings atomic.Value
+	closed   int32
+}
+
+func (l *stratumListener) Settings() *PortSettings {
+	return l.settings.Load().(*PortSettings)
+}
+
+func (l *stratumListener) isClosed() bool {
+	return atomic.LoadInt32(&l.closed) == 1
+}
+
+// The stratum ports we're listening on, reconciled against the config when
+// it's reloaded
+type ListenerSet struct {
+	listeners map[string]*stratumListener
+	accept    func(*stratumListener, net.Conn)
+	// net.Listen, swapped out by tests
+	listen func(bind string) (net.Listener, error)
+	mtx    sync.Mutex
+}
+
+func NewListenerSet(accept func(*stratumListener, net.Conn)) *ListenerSet {
+	return &ListenerSet{
+		listeners: map[string]*stratumListener{},
+		accept:    accept,
+		listen: func(bind string) (net.Listener, error) {
+			return net.Listen("tcp", bind)
+		},
+	}
+}
+
+// Opens the ports in wanted we aren't listening on, gives open ones their
+// new settings, and closes the rest, returning the binds closed. New ports
+// are all bound before anything else changes, so if one of them fails the
+// set is left as it was
+func (s *ListenerSet) Reconcile(wanted map[string]*PortSettings) (closed []string, err error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	opened := map[string]*stratumListener{}
+	for bind, settings := range wanted {
+		if _, ok := s.listeners[bind]; ok {
+			continue
+		}
+		listener, err := s.listen(bind)
+		if err != nil {
+			for _, l := range opened {
+				l.listener.Close()
+			}
+			return nil, errors.Wrapf(err, "listening on %s", bind)
+		}
+		l := &stratumListener{bind: bind, listener: listener}
+		l.settings.Store(settings)
+		opened[bind] = l
+	}
+
+	for bind, l := range s.listeners {
+		settings, ok := wanted[bind]
+		if !ok {
+			atomic.StoreInt32(&l.closed, 1)
+			l.listener.Close()
+			delete(s.listeners, bind)
+			closed = append(closed, bind)
+			log.Info("Closed stratum port", "bind", bind)
+			continue
+		}
+		if !settings.Equal(l.Settings()) {
+			l.settings.Store(settings)
+			log.Info("Stratum port difficulty changed, applies to new sessions",
+				"bind", bind, "min", settings.VarDiff.Min(), "max", settings.VarDiff.Max(),
+				"multiplier", settings.DiffMultiplier)
+		}
+	}
+	for bind, l := range opened {
+		s.listeners[bind] = l
+		log.Info("Listening stratum", "endpoint", bind)
+		go s.serve(l)
+	}
+	sort.Strings(closed)
+	return closed, nil
+}
+
+// Whether we're listening on bind
+func (s *ListenerSet) Has(bind string) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	_, ok := s.listeners[bind]
+	return ok
+}
+
+// The binds we're listening on, sorted
+func (s *ListenerSet) Binds() []string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	binds := make([]string, 0, len(s.listeners))
+	for bind := range s.listeners {
+		binds = append(binds, bind)
+	}
+	sort.Strings(binds)
+	return binds
+}
+
+func (s *ListenerSet) serve(l *stratumListener) {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			if l.isClosed() {
+				return
+			}
+			log.Warn("Failed to accept connection", "bind", l.bind, "err", err)
+			continue
+		}
+		go s.accept(l, conn)
+	}
+}
+
+// Per port overrides from the Ports config key, unset ones take the main
+// VardiffMin, VardiffMax, VardiffTarget, DiffMultiplier and FastAck.
+// Currencies limits the port to some of the base currencies, by default it
+// mines all
+type PortOptions struct {
+	VardiffMin     float64
+	VardiffMax     float64
+	VardiffTarget  float64
+	DiffMultiplier float64
+	FastAck        bool
+	Currencies     []string
+}
+
+// The ports the config asks for: StratumBind and each of Ports, with the
+// settings sessions on them should start with. StratumBind is advertised
+// through discovery, so it's only read at startup
+func (n *StratumServer) configPorts(config *viper.Viper) (map[string]*PortSettings, error) {
+	defaults := PortOptions{
+		VardiffMin:     config.GetFloat64("VardiffMin"),
+		VardiffMax:     config.GetFloat64("VardiffMax"),
+		VardiffTarget:  config.GetFloat64("VardiffTarget"),
+		DiffMultiplier: config.GetFloat64("DiffMultiplier"),
+		FastAck:        config.GetBool("FastAck"),
+	}
+	stratumBind := n.config.GetString("StratumBind")
+	settings, err := n.portSettings(defaults)
+	if err != nil {
+		return nil, errors.Wrapf(err, "port %s", stratumBind)
+	}
+	ports := map[string]*PortSettings{stratumBind: settings}
+	for bind, raw := range config.GetStringMap("Ports") {
+		opts := defaults
+		if raw != nil {
+			fields, err := cast.ToStringMapE(raw)
+			if err != nil {
+				return nil, errors.Wrapf(err, "port %s", bind)
+			}
+			for key, val := range fields {
+				var dst *float64
+				switch strings.ToLower(key) {
+				case "currencies":
+					if opts.Currencies, err = cast.ToStringSliceE(val); err != nil {
+						return nil, errors.Wrapf(err, "port %s: %s", bind, key)
+					}
+					continue
+				case "fastack":
+					if opts.FastAck, err = cast.ToBoolE(val); err != nil {
+						return nil, errors.Wrapf(err, "port %s: %s", bind, key)
+					}
+					continue
+				case "vardiffmin":
+					dst = &opts.VardiffMin
+				case "vardiffmax":
+					dst = &opts.VardiffMax
+				case "vardifftarget":
+					dst = &opts.VardiffTarget
+				case "diffmultiplier":
+					dst = &opts.DiffMultiplier
+				default:
+					return nil, errors.Errorf("port %s: unknown option %s", bind, key)
+				}
+				if *dst, err = cast.ToFloat64E(val); err != nil {
+					return nil, errors.Wrapf(err, "port %s: %s", bind, key)
+				}
+			}
+		}
+		settings, err := n.portSettings(opts)
+		if err != nil {
+			return nil, errors.Wrapf(err, "port %s", bind)
+		}
+		ports[bind] = settings
+	}
+	return ports, nil
+}
+
+// Builds a port's settings, with VardiffMin raised to the algorithm's floor
+// in NiceHash mode
+func (n *StratumServer) portSettings(opts PortOptions) (*PortSettings, error) {
+	if opts.DiffMultiplier <= 0 {
+		return nil, errors.Errorf("DiffMultiplier must be positive, got %v", opts.DiffMultiplier)
+	}
+	var currencies []string
+	for _, currency := range opts.Currencies {
+		currency = strings.ToUpper(currency)
+		if n.port.Lanes.Lane(currency) == nil {
+			return nil, errors.Errorf("%s isn't one of the base currencies %s",
+				currency, n.port.Lanes.Currencies())
+		}
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+	if n.port.NiceHash {
+		floor := NiceHashMinDiff[n.shareChain.AlgoName]
+		if diff, ok := n.config.GetStringMap("NiceHashMinDiff")[n.shareChain.AlgoName]; ok {
+			floor = cast.ToFloat64(diff)
+		}
+		if opts.VardiffMin < floor {
+			log.Info("Raising VardiffMin to NiceHash floor", "floor", floor, "algo", n.shareChain.AlgoName)
+			opts.VardiffMin = floor
+		}
+	}
+	if opts.VardiffMax < opts.VardiffMin {
+		opts.VardiffMax = opts.VardiffMin
+	}
+	return &PortSettings{
+		VarDiff:        NewVarDiff(opts.VardiffMin, opts.VardiffMax, opts.VardiffTarget),
+		DiffMultiplier: opts.DiffMultiplier,
+		Currencies:     currencies,
+		FastAck:        opts.FastAck,
+	}, nil
+}
+
+// Brings the ports we listen on in line with config, draining any that
+// were removed
+func (n *StratumServer) reconcilePorts(config *viper.Viper) error {
+	ports, err := n.configPorts(config)
+	if err != nil {
+		return err
+	}
+	closed, err := n.listeners.Reconcile(ports)
+	if err != nil {
+		return err
+	}
+	for _, bind := range closed {
+		n.drainPort(bind, n.reconnectEndpoint(), config.GetDuration("PortDrainTimeout"))
+	}
+	return nil
+}
+
+// Where miners on a closed port are sent, "" if there's nowhere they could
+// reach
+func (n *StratumServer) reconnectEndpoint() string {
+	endpoint := n.config.GetString("PublicEndpoint")
+	if endpoint == "" {
+		endpoint = n.config.GetString("StratumBind")
+	}
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return ""
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		return ""
+	}
+	return endpoint
+}
+
+// Moves sessions off a port that's been closed. Each is sent
+// client.reconnect to endpoint, and whoever's still connected after timeout
+// is disconnected. With no endpoint they're disconnected right away
+func (n *StratumServer) drainPort(bind string, endpoint string, timeout time.Duration) {
+	var moved []*StratumClient
+	n.withClients(func(clients map[string]*StratumClient) {
+		for _, client := range clients {
+			if client.bind == bind && !client.hasShutdown {
+				moved = append(moved, client)
+			}
+		}
+	})
+	log.Info("Draining closed stratum port", "bind", bind, "sessions", len(moved),
+		"endpoint", endpoint)
+	if endpoint == "" {
+		timeout = 0
+	} else {
+		for _, client := range moved {
+			if err := client.reconnect(endpoint); err != nil {
+				client.log.Warn("Failed to send client.reconnect", "err", err)
+			}
+		}
+	}
+	time.AfterFunc(timeout, func() {
+		// Reopened since, the sessions can stay
+		if n.listeners.Has(bind) {
+			return
+		}
+		for _, client := range moved {
+			client.Stop()
+		}
+	})
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/icook/ngpool/pkg/common"
+)
+
+func TestListenerSetReconcile(t *testing.T) {
+	accepted := make(chan string, 1)
+	set := NewListenerSet(func(l *stratumListener, conn net.Conn) {
+		conn.Close()
+		accepted <- l.bind
+	})
+	addrs := map[string]net.Addr{}
+	set.listen = func(bind string) (net.Listener, error) {
+		if bind == "bad" {
+			return nil, errors.New("address in use")
+		}
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err == nil {
+			addrs[bind] = listener.Addr()
+		}
+		return listener, err
+	}
+	low := &PortSettings{VarDiff: NewVarDiff(1, 64, 20), DiffMultiplier: 1}
+	high := &PortSettings{VarDiff: NewVarDiff(1024, 65536, 20), DiffMultiplier: 1}
+
+	closed, err := set.Reconcile(map[string]*PortSettings{"main": low, "big": high})
+	assert.NoError(t, err)
+	assert.Empty(t, closed)
+	assert.Equal(t, []string{"big", "main"}, set.Binds())
+	conn, err := net.Dial("tcp", addrs["big"].String())
+	assert.NoError(t, err)
+	conn.Close()
+	assert.Equal(t, "big", <-accepted)
+
+	// One port failing leaves everything as it was
+	_, err = set.Reconcile(map[string]*PortSettings{"main": high, "new": low, "bad": low})
+	assert.Error(t, err)
+	assert.Equal(t, []string{"big", "main"}, set.Binds())
+	assert.True(t, low.Equal(set.listeners["main"].Settings()))
+
+	big := set.listeners["big"]
+	closed, err = set.Reconcile(map[string]*PortSettings{"main": high})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"big"}, closed)
+	assert.Equal(t, []string{"main"}, set.Binds())
+	assert.True(t, big.isClosed())
+	assert.True(t, high.Equal(set.listeners["main"].Settings()))
+	_, err = net.Dial("tcp", addrs["big"].String())
+	assert.Error(t, err)
+}
+
+func TestConfigPorts(t *testing.T) {
+	n := &StratumServer{config: viper.New(), port: &PortConfig{}}
+	n.config.Set("StratumBind", "0.0.0.0:3333")
+	config := viper.New()
+	config.Set("StratumBind", "0.0.0.0:4444")
+	config.Set("VardiffMin", 1)
+	config.Set("VardiffMax", 64)
+	config.Set("VardiffTarget", 20)
+	config.Set("DiffMultiplier", 1)
+	config.Set("Ports", map[string]interface{}{
+		"0.0.0.0:3334": map[string]interface{}{"VardiffMin": 1024, "vardiffmax": "4096", "DiffMultiplier": 65536},
+		"0.0.0.0:3335": nil,
+	})
+
+	ports, err := n.configPorts(config)
+	assert.NoError(t, err)
+	// StratumBind is only read at startup
+	assert.Len(t, ports, 3)
+	assert.True(t, NewVarDiff(1, 64, 20).Equal(ports["0.0.0.0:3333"].VarDiff))
+	assert.True(t, NewVarDiff(1024, 4096, 20).Equal(ports["0.0.0.0:3334"].VarDiff))
+	assert.True(t, NewVarDiff(1, 64, 20).Equal(ports["0.0.0.0:3335"].VarDiff))
+	assert.Equal(t, 1.0, ports["0.0.0.0:3333"].DiffMultiplier)
+	assert.Equal(t, 65536.0, ports["0.0.0.0:3334"].DiffMultiplier)
+
+	config.Set("Ports", map[string]interface{}{
+		"0.0.0.0:3334": map[string]interface{}{"DiffMultiplier": 0},
+	})
+	_, err = n.configPorts(config)
+	assert.Error(t, err)
+
+	n.port.Lanes, _ = NewLaneSplitter([]TemplateKey{ltcKey, dogeKey}, LaneSplitRoundRobin, nil)
+	config.Set("Ports", map[string]interface{}{
+		"0.0.0.0:3334": map[string]interface{}{"Currencies": []interface{}{"doge"}},
+	})
+	ports, err = n.configPorts(config)
+	assert.NoError(t, err)
+	assert.Nil(t, ports["0.0.0.0:3333"].Currencies)
+	assert.Equal(t, []string{"DOGE"}, ports["0.0.0.0:3334"].Currencies)
+	config.Set("Ports", map[string]interface{}{
+		"0.0.0.0:3334": map[string]interface{}{"Currencies": []interface{}{"BTC"}},
+	})
+	_, err = n.configPorts(config)
+	assert.Error(t, err)
+
+	config.Set("Ports", map[string]interface{}{
+		"0.0.0.0:3334": map[string]interface{}{"Diff": 1},
+	})
+	_, err = n.configPorts(config)
+	assert.Error(t, err)
+}
+
+func TestReconnectEndpoint(t *testing.T) {
+	n := &StratumServer{config: viper.New()}
+	n.config.Set("StratumBind", "0.0.0.0:3333")
+	assert.Equal(t, "", n.reconnectEndpoint())
+	n.config.Set("PublicEndpoint", "pool.example.com:3333")
+	assert.Equal(t, "pool.example.com:3333", n.reconnectEndpoint())
+}
+
+func TestClientDiffMultiplier(t *testing.T) {
+	c := &StratumClient{}
+	assert.Equal(t, 8.0, c.minerDiff(8))
+	c.diffMultiplier = 65536
+	assert.Equal(t, 65536.0*8, c.minerDiff(8))
+	assert.Equal(t, 8.0, c.poolDiff(c.minerDiff(8)))
+}
+
+func TestUsernameIsAddress(t *testing.T) {
+	common.RegisterAddressCodec("LTC_T", &common.Base58Codec{Params: &chaincfg.TestNet3Params})
+	c := &StratumClient{lane: &MainChainLane{key: TemplateKey{Currency: "LTC_T"}}}
+	c.username = "mucHkBoHAF8DTQWFuwQXHiewqi3ZBDNNWh"
+	assert.True(t, c.usernameIsAddress())
+	c.username = "alice"
+	assert.False(t, c.usernameIsAddress())
+	// Nothing to check against without a codec
+	c.lane.key.Currency = "NONE"
+	c.username = "mucHkBoHAF8DTQWFuwQXHiewqi3ZBDNNWh"
+	assert.False(t, c.usernameIsAddress())
+}
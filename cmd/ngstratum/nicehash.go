@@ -0,0 +1,94 @@
+package main
+
+import (
+	"time"
+
+	"github.com/icook/ngpool/pkg/common"
+)
+
+// Minimum share difficulty NiceHash will accept from a pool, per algorithm.
+// NiceHash stops sending hash to pools that go below these, so ports in
+// NiceHash mode floor vardiff at these values. Overridable with the
+// NiceHashMinDiff config map
+var NiceHashMinDiff = map[string]float64{
+	"scrypt":    65536,
+	"sha256d":   500000,
+	"lyra2rev2": 2,
+	"x17":       0.5,
+}
+
+// PortConfig holds settings that change how clients on this stratum port are
+// handled
+type PortConfig struct {
+	// Enables NiceHash compatible behavior: extranonce.subscribe is
+	// acknowledged, clean jobs are only sent on new blocks, and rejected
+	// shares return a false result
+	NiceHash bool
+	// Minimum time between job notifications that don't start a new block.
+	// The newest one held back is sent when it's up, and new blocks are
+	// always sent immediately
+	MinJobInterval time.Duration
+	// Work format for JSON-RPC 2.0 (login mode) miners
+	BlobFormat *BlobFormat
+	// Version bits miners may roll, 0 if version rolling is disabled
+	VersionRollingMask uint32
+	// Gives each connection its extranonce1, and decides the extranonce2 size
+	Extranonces *ExtranonceAllocator
+	// Timeouts for sessions that connect but don't mine
+	Idle *IdleReaper
+	// The main chains mined, and which each connection gets
+	Lanes *LaneSplitter
+	// Honor d= and sd= difficulty options in the miner's password
+	PasswordDiff bool
+	// Saves mp= and pi= payout options from the miner's password, nil if
+	// they're ignored
+	PayoutPrefs *PayoutPrefWriter
+	// Take mining.suggest_difficulty and suggest_target as a starting point
+	// for vardiff
+	SuggestDiff bool
+	// Difficulties of workers that disconnected recently, nil if disabled
+	WorkerDiffs *WorkerDiffs
+	// How long after a retarget shares meeting the previous difficulty are
+	// still accepted, see diffHistory. 0 disables
+	RetargetGrace time.Duration
+	// Messages that may wait to be written to a connection before it's
+	// dropped as too slow. 0 uses defaultSendQueue
+	SendQueue int
+	// How long a write to a connection may block before it's dropped as too
+	// slow. 0 disables
+	WriteTimeout time.Duration
+	// Sessions dropped by SendQueue and WriteTimeout
+	SlowConsumers SlowConsumers
+	// How many of a session's most recent jobs shares are accepted for. 0
+	// uses defaultRetainedJobs
+	RetainedJobs int
+	// How long after it was sent a job stops being accepted, unless it's the
+	// session's latest. 0 disables
+	JobMaxAge time.Duration
+	// How many blocks behind the latest a job's shares are still credited,
+	// as stale shares miners had no chance to avoid. They can't solve blocks.
+	// 0 credits only the current block's
+	StaleShareDepth int64
+	// Sessions that have every frame logged, nil traces nobody
+	Trace *SessionTracer
+	// Share results across every session on the port, for RejectMonitor
+	Shares common.ShareStats
+}
+
+const defaultSendQueue = 64
+
+const defaultRetainedJobs = 16
+
+func (p *PortConfig) retainedJobs() int {
+	if p.RetainedJobs <= 0 {
+		return defaultRetainedJobs
+	}
+	return p.RetainedJobs
+}
+
+func (p *PortConfig) sendQueue() int {
+	if p.SendQueue <= 0 {
+		return defaultSendQueue
+	}
+	return p.SendQueue
+}
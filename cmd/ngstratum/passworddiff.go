@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Difficulty a miner asked for in its password, the way most pools take it.
+// d=8192 fixes the difficulty for the session, sd=1024 only starts there and
+// leaves vardiff to move it. Options are separated by commas, semicolons or
+// spaces, and anything else in the password is ignored, ie "x,d=8192"
+type passwordDiff struct {
+	diff   float64
+	static bool
+}
+
+func parsePasswordDiff(password string) passwordDiff {
+	var pd passwordDiff
+	fields := strings.FieldsFunc(password, func(r rune) bool {
+		return r == ',' || r == ';' || r == ' '
+	})
+	for _, field := range fields {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		diff, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || diff <= 0 {
+			continue
+		}
+		switch strings.ToLower(parts[0]) {
+		case "d":
+			pd = passwordDiff{diff: diff, static: true}
+		case "sd":
+			// A static difficulty wins over a starting one
+			if !pd.static {
+				pd = passwordDiff{diff: diff}
+			}
+		}
+	}
+	return pd
+}
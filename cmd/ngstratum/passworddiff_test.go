@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePasswordDiff(t *testing.T) {
+	assert.Equal(t, passwordDiff{diff: 8192, static: true}, parsePasswordDiff("d=8192"))
+	assert.Equal(t, passwordDiff{diff: 1024}, parsePasswordDiff("x,sd=1024"))
+	assert.Equal(t, passwordDiff{diff: 0.5, static: true}, parsePasswordDiff("sd=64; D=0.5"))
+	assert.Equal(t, passwordDiff{diff: 16, static: true}, parsePasswordDiff("d=16 sd=64"))
+	assert.Equal(t, passwordDiff{}, parsePasswordDiff("x"))
+	assert.Equal(t, passwordDiff{}, parsePasswordDiff("d=abc,sd=-1,d="))
+	assert.Equal(t, passwordDiff{}, parsePasswordDiff(""))
+}
+
+func TestVarDiffClamp(t *testing.T) {
+	v := NewVarDiff(0.125, 16384, 20)
+	assert.Equal(t, 16384.0, v.Clamp(100000))
+	assert.Equal(t, 0.125, v.Clamp(0.01))
+	assert.Equal(t, 1000.0, v.Clamp(1000))
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// Currencies a miner asked to be credited in with pc= in the password, by
+// weight. pc=VTC only credits VTC blocks, pc=VTC:3,pc=DOGE:1 credits both with
+// DOGE at a third of VTC. Nil when the miner didn't ask, and its shares count
+// toward every currency they were mined on
+type payoutCurrencies map[string]float64
+
+func parsePayoutCurrencies(password string) payoutCurrencies {
+	var pc payoutCurrencies
+	fields := strings.FieldsFunc(password, func(r rune) bool {
+		return r == ',' || r == ';' || r == ' '
+	})
+	for _, field := range fields {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 || strings.ToLower(parts[0]) != "pc" {
+			continue
+		}
+		code := strings.ToUpper(parts[1])
+		weight := 1.0
+		if i := strings.Index(code, ":"); i != -1 {
+			w, err := strconv.ParseFloat(code[i+1:], 64)
+			if err != nil || w <= 0 {
+				continue
+			}
+			code, weight = code[:i], w
+		}
+		if code == "" {
+			continue
+		}
+		if pc == nil {
+			pc = payoutCurrencies{}
+		}
+		pc[code] = weight
+	}
+	return pc
+}
+
+// The weights for a share mined on currencies, the list CheckSolves returns.
+// Picks the share wasn't mined on are dropped, and the rest scaled so the
+// heaviest counts fully. Nil if nothing is left, ie the aux chain the miner
+// wanted has gone, so the share isn't wasted
+func (pc payoutCurrencies) forShare(currencies []string) map[string]float64 {
+	var max float64
+	for _, code := range currencies {
+		if pc[code] > max {
+			max = pc[code]
+		}
+	}
+	if max == 0 {
+		return nil
+	}
+	weights := map[string]float64{}
+	for _, code := range currencies {
+		if w, ok := pc[code]; ok {
+			weights[code] = w / max
+		}
+	}
+	return weights
+}
+
+// For the share table's payout_weights, NULL without weights
+func payoutWeightsValue(weights map[string]float64) interface{} {
+	if weights == nil {
+		return nil
+	}
+	raw, _ := json.Marshal(weights)
+	return string(raw)
+}
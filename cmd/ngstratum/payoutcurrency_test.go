@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePayoutCurrencies(t *testing.T) {
+	assert.Equal(t, payoutCurrencies{"VTC": 1}, parsePayoutCurrencies("x,pc=vtc"))
+	assert.Equal(t, payoutCurrencies{"VTC": 3, "DOGE": 1},
+		parsePayoutCurrencies("d=64,pc=VTC:3;PC=DOGE:1"))
+	assert.Nil(t, parsePayoutCurrencies("x,d=64"))
+	assert.Nil(t, parsePayoutCurrencies("pc=,pc=VTC:0,pc=DOGE:abc,pc=:2"))
+}
+
+func TestPayoutCurrenciesForShare(t *testing.T) {
+	pc := payoutCurrencies{"VTC": 3, "DOGE": 1, "BTC": 6}
+	// BTC isn't in the job, so VTC is the heaviest that counts
+	assert.Equal(t, map[string]float64{"VTC": 1, "DOGE": 1.0 / 3},
+		pc.forShare([]string{"VTC", "DOGE", "LTC"}))
+	assert.Nil(t, pc.forShare([]string{"LTC"}))
+	var none payoutCurrencies
+	assert.Nil(t, none.forShare([]string{"LTC"}))
+
+	assert.Nil(t, payoutWeightsValue(nil))
+	assert.Equal(t, `{"VTC":1}`, payoutWeightsValue(map[string]float64{"VTC": 1}))
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/jmoiron/sqlx"
+)
+
+// Payout settings a miner picked in its password. mp=0.5 waits until the
+// balance reaches 0.5 coins, and pi=24h pays at most once a day. Either can
+// name a currency, ie mp=LTC:0.5, otherwise it's for every currency. nil
+// fields are left as they were
+type payoutPreference struct {
+	// Satoshis
+	minPayout *int64
+	// Seconds
+	interval *int
+}
+
+// Keyed by currency, "" for every currency. Nil when the password has none
+func parsePayoutPreferences(password string) map[string]*payoutPreference {
+	var prefs map[string]*payoutPreference
+	fields := strings.FieldsFunc(password, func(r rune) bool {
+		return r == ',' || r == ';' || r == ' '
+	})
+	for _, field := range fields {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := strings.ToLower(parts[0])
+		if key != "mp" && key != "pi" {
+			continue
+		}
+		var currency string
+		val := parts[1]
+		if i := strings.Index(val, ":"); i != -1 {
+			currency, val = strings.ToUpper(val[:i]), val[i+1:]
+		}
+		pref := &payoutPreference{}
+		if prefs != nil && prefs[currency] != nil {
+			pref = prefs[currency]
+		}
+		switch key {
+		case "mp":
+			coins, err := strconv.ParseFloat(val, 64)
+			if err != nil || coins < 0 || coins > 21e6 {
+				continue
+			}
+			satoshis := int64(coins*1e8 + 0.5)
+			pref.minPayout = &satoshis
+		case "pi":
+			interval, err := time.ParseDuration(val)
+			if err != nil || interval < 0 || interval > maxPayoutInterval {
+				continue
+			}
+			seconds := int(interval / time.Second)
+			pref.interval = &seconds
+		}
+		if prefs == nil {
+			prefs = map[string]*payoutPreference{}
+		}
+		prefs[currency] = pref
+	}
+	return prefs
+}
+
+// Longer and a miner's coins could sit unpaid for good. ngweb's API has the
+// same limit
+const maxPayoutInterval = time.Hour * 24 * 30
+
+type payoutPrefWrite struct {
+	username string
+	prefs    map[string]*payoutPreference
+}
+
+// Saves payout preferences from miners' passwords to the database, where
+// ngweb's payout batcher reads them. Writes happen on Run's goroutine, not
+// the client's, and a password seen before isn't written again each time the
+// miner reconnects
+type PayoutPrefWriter struct {
+	db    *sqlx.DB
+	queue chan payoutPrefWrite
+	// Last saved, by username and currency. Only touched by Run
+	saved map[string]payoutPreference
+}
+
+func NewPayoutPrefWriter(db *sqlx.DB) *PayoutPrefWriter {
+	return &PayoutPrefWriter{
+		db:    db,
+		queue: make(chan payoutPrefWrite, 256),
+		saved: map[string]payoutPreference{},
+	}
+}
+
+// Queues a miner's preferences to be saved. Safe to call on a nil writer,
+// which drops them
+func (w *PayoutPrefWriter) Save(username string, prefs map[string]*payoutPreference) {
+	if w == nil {
+		return
+	}
+	select {
+	case w.queue <- payoutPrefWrite{username, prefs}:
+	default:
+		log.Warn("Payout preference queue full, dropping", "username", username)
+	}
+}
+
+func (w *PayoutPrefWriter) Run() {
+	for write := range w.queue {
+		for currency, pref := range write.prefs {
+			key := write.username + "/" + currency
+			if last, ok := w.saved[key]; ok && samePayoutPreference(&last, pref) {
+				continue
+			}
+			// Users who haven't registered with ngweb have nowhere to be
+			// paid, so there's no row for them. Anyone can connect with a
+			// username, so what the user set through the API is left alone
+			_, err := w.db.Exec(
+				`INSERT INTO payout_preference (user_id, currency, min_payout, payout_interval, source)
+				SELECT id, $2, $3, $4, 'password' FROM users WHERE username = $1
+				ON CONFLICT (user_id, currency) DO UPDATE SET
+				min_payout = COALESCE(EXCLUDED.min_payout, payout_preference.min_payout),
+				payout_interval = COALESCE(EXCLUDED.payout_interval, payout_preference.payout_interval),
+				updated_at = now()
+				WHERE payout_preference.source = 'password'`,
+				write.username, currency, pref.minPayout, pref.interval)
+			if err != nil {
+				log.Error("Failed to save payout preference", "username", write.username, "err", err)
+				continue
+			}
+			w.saved[key] = *pref
+		}
+	}
+}
+
+func samePayoutPreference(a *payoutPreference, b *payoutPreference) bool {
+	sameInt64 := (a.minPayout == nil) == (b.minPayout == nil) &&
+		(a.minPayout == nil || *a.minPayout == *b.minPayout)
+	sameInt := (a.interval == nil) == (b.interval == nil) &&
+		(a.interval == nil || *a.interval == *b.interval)
+	return sameInt64 && sameInt
+}
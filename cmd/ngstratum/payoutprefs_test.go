@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePayoutPreferences(t *testing.T) {
+	prefs := parsePayoutPreferences("x,mp=0.5;MP=ltc:2,pi=24h,d=64")
+	assert.Len(t, prefs, 2)
+	assert.Equal(t, int64(50000000), *prefs[""].minPayout)
+	assert.Equal(t, 86400, *prefs[""].interval)
+	assert.Equal(t, int64(200000000), *prefs["LTC"].minPayout)
+	assert.Nil(t, prefs["LTC"].interval)
+
+	assert.Nil(t, parsePayoutPreferences("x,d=64,pc=VTC"))
+	// Unparseable, negative and over a month are ignored
+	assert.Nil(t, parsePayoutPreferences("mp=abc,mp=-1,pi=soon,pi=-1h,pi=1000h"))
+}
+
+func TestSamePayoutPreference(t *testing.T) {
+	a, b := int64(5), int64(5)
+	day := 86400
+	assert.True(t, samePayoutPreference(&payoutPreference{minPayout: &a},
+		&payoutPreference{minPayout: &b}))
+	assert.False(t, samePayoutPreference(&payoutPreference{minPayout: &a},
+		&payoutPreference{minPayout: &a, interval: &day}))
+	assert.True(t, samePayoutPreference(&payoutPreference{}, &payoutPreference{}))
+}
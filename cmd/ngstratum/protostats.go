@@ -0,0 +1,134 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/icook/ngpool/pkg/common"
+)
+
+// Categories of protocol misbehavior we count. Broken miner firmware tends to
+// produce parse errors and unknown methods, while probing bots usually send
+// messages out of order (submit before subscribe, etc)
+const (
+	ProtocolParseError = iota
+	ProtocolUnknownMethod
+	ProtocolOutOfOrder
+)
+
+func incrProtocolStat(stats *common.ProtocolStats, kind int) {
+	switch kind {
+	case ProtocolParseError:
+		atomic.AddUint64(&stats.ParseErrors, 1)
+	case ProtocolUnknownMethod:
+		atomic.AddUint64(&stats.UnknownMethods, 1)
+	case ProtocolOutOfOrder:
+		atomic.AddUint64(&stats.OutOfOrder, 1)
+	}
+}
+
+func loadProtocolStats(stats *common.ProtocolStats) common.ProtocolStats {
+	return common.ProtocolStats{
+		ParseErrors:    atomic.LoadUint64(&stats.ParseErrors),
+		UnknownMethods: atomic.LoadUint64(&stats.UnknownMethods),
+		OutOfOrder:     atomic.LoadUint64(&stats.OutOfOrder),
+	}
+}
+
+type ipEntry struct {
+	stats       common.ProtocolStats
+	lastSeen    time.Time
+	bannedUntil time.Time
+}
+
+// IPTracker aggregates protocol errors by remote IP across all connections and
+// bans IPs that accumulate too many of them. A threshold of zero disables
+// banning, but errors are still counted for the status output
+type IPTracker struct {
+	threshold   uint64
+	banDuration time.Duration
+
+	ips map[string]*ipEntry
+	mtx sync.Mutex
+}
+
+func NewIPTracker(threshold uint64, banDuration time.Duration) *IPTracker {
+	return &IPTracker{
+		threshold:   threshold,
+		banDuration: banDuration,
+		ips:         map[string]*ipEntry{},
+	}
+}
+
+// Record a protocol error for an IP. Returns true if the IP is now banned
+func (t *IPTracker) Record(ip string, kind int) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	entry, ok := t.ips[ip]
+	if !ok {
+		entry = &ipEntry{}
+		t.ips[ip] = entry
+	}
+	now := time.Now()
+	entry.expire(now)
+	entry.lastSeen = now
+	incrProtocolStat(&entry.stats, kind)
+	if t.threshold == 0 {
+		return false
+	}
+	if entry.bannedUntil.IsZero() && entry.stats.Total() >= t.threshold {
+		entry.bannedUntil = now.Add(t.banDuration)
+	}
+	return now.Before(entry.bannedUntil)
+}
+
+// The counts that got an IP banned are kept for the status until the ban
+// ends, then it starts counting fresh
+func (e *ipEntry) expire(now time.Time) {
+	if !e.bannedUntil.IsZero() && !now.Before(e.bannedUntil) {
+		e.bannedUntil = time.Time{}
+		e.stats = common.ProtocolStats{}
+	}
+}
+
+func (t *IPTracker) IsBanned(ip string) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	entry, ok := t.ips[ip]
+	if !ok {
+		return false
+	}
+	now := time.Now()
+	entry.expire(now)
+	return now.Before(entry.bannedUntil)
+}
+
+// Drop IPs we haven't seen an error from in maxAge, and which aren't currently
+// banned. Keeps the map from growing forever on a public port
+func (t *IPTracker) Prune(maxAge time.Duration) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	now := time.Now()
+	for ip, entry := range t.ips {
+		if now.Sub(entry.lastSeen) > maxAge && now.After(entry.bannedUntil) {
+			delete(t.ips, ip)
+		}
+	}
+}
+
+func (t *IPTracker) Statuses() map[string]common.IPProtocolStatus {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	now := time.Now()
+	var ret = map[string]common.IPProtocolStatus{}
+	for ip, entry := range t.ips {
+		entry.expire(now)
+		status := common.IPProtocolStatus{ProtocolStats: entry.stats}
+		if !entry.bannedUntil.IsZero() {
+			status.BannedUntil = entry.bannedUntil.Unix()
+		}
+		ret[ip] = status
+	}
+	return ret
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIPTrackerBan(t *testing.T) {
+	tracker := NewIPTracker(3, time.Minute)
+	assert.False(t, tracker.Record("10.0.0.1", ProtocolParseError))
+	assert.False(t, tracker.Record("10.0.0.1", ProtocolUnknownMethod))
+	assert.False(t, tracker.IsBanned("10.0.0.1"))
+	assert.True(t, tracker.Record("10.0.0.1", ProtocolOutOfOrder))
+	assert.True(t, tracker.IsBanned("10.0.0.1"))
+	assert.False(t, tracker.IsBanned("10.0.0.2"))
+
+	// The counts stay in the status while the ban lasts
+	status := tracker.Statuses()["10.0.0.1"]
+	assert.Equal(t, uint64(3), status.Total())
+	assert.NotZero(t, status.BannedUntil)
+
+	// and start again once it's over
+	tracker.ips["10.0.0.1"].bannedUntil = time.Now().Add(-time.Second)
+	assert.False(t, tracker.IsBanned("10.0.0.1"))
+	status = tracker.Statuses()["10.0.0.1"]
+	assert.Equal(t, uint64(0), status.Total())
+	assert.Zero(t, status.BannedUntil)
+	assert.False(t, tracker.Record("10.0.0.1", ProtocolParseError))
+}
+
+func TestIPTrackerDisabled(t *testing.T) {
+	tracker := NewIPTracker(0, time.Minute)
+	for i := 0; i < 100; i++ {
+		assert.False(t, tracker.Record("10.0.0.1", ProtocolParseError))
+	}
+	assert.Equal(t, uint64(100), tracker.Statuses()["10.0.0.1"].ParseErrors)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Behind a TCP load balancer every connection comes from the balancer's
+// address. With the PROXY protocol (v1 text or v2 binary, as sent by HAProxy
+// and most cloud balancers) the balancer starts each connection with a header
+// carrying the client's real address, which we use in its place for banning
+// and logging
+type ProxyProtocol struct {
+	// Peers that must send a header
+	trusted []*net.IPNet
+}
+
+// trusted is a list of CIDRs or single IPs of the load balancers. It can't be
+// empty, since any peer allowed to send a header can pick its own address and
+// get around bans and per-IP limits. 0.0.0.0/0 trusts everyone, for ports only
+// the balancer can reach
+func NewProxyProtocol(trusted []string) (*ProxyProtocol, error) {
+	if len(trusted) == 0 {
+		return nil, errors.New("No trusted balancers, use 0.0.0.0/0 to trust every peer")
+	}
+	p := &ProxyProtocol{}
+	for _, raw := range trusted {
+		if !strings.Contains(raw, "/") {
+			ip := net.ParseIP(raw)
+			if ip == nil {
+				return nil, errors.Errorf("Invalid IP %s", raw)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			raw += "/" + strconv.Itoa(bits)
+		}
+		_, network, err := net.ParseCIDR(raw)
+		if err != nil {
+			return nil, err
+		}
+		p.trusted = append(p.trusted, network)
+	}
+	return p, nil
+}
+
+// Whether a connection from addr starts with a header. Others are treated as
+// direct connections, so only the balancer can claim to be someone else
+func (p *ProxyProtocol) Expects(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range p.trusted {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// A connection reporting the client address from its PROXY header
+type proxiedConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+var (
+	proxyV1Prefix = []byte("PROXY ")
+	proxyV2Sig    = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// The longest a v1 header can be, including the CRLF
+const proxyV1MaxLength = 107
+
+// Reads a PROXY header off the front of a connection, returning the client's
+// address. Nil without an error means the balancer sent no address (v1
+// UNKNOWN, or a v2 LOCAL health check) and the connection's own should be
+// used
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	peek, err := r.Peek(len(proxyV2Sig))
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read PROXY header")
+	}
+	if bytes.Equal(peek, proxyV2Sig) {
+		return readProxyV2(r)
+	}
+	if bytes.HasPrefix(peek, proxyV1Prefix) {
+		return readProxyV1(r)
+	}
+	return nil, errors.New("Missing PROXY header")
+}
+
+// ie "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to read PROXY header")
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyV1MaxLength {
+			return nil, errors.New("PROXY header too long")
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("PROXY header not terminated by CRLF")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.Errorf("Invalid PROXY header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, errors.Errorf("Invalid PROXY source address %s", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, errors.Errorf("Invalid PROXY source port %s", fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+const (
+	proxyV2Local = 0x20
+	proxyV2Proxy = 0x21
+
+	proxyV2TCP4 = 0x11
+	proxyV2TCP6 = 0x21
+)
+
+// 12 byte signature, version and command, address family, then the length of
+// the addresses and any TLVs that follow
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errors.Wrap(err, "Failed to read PROXY header")
+	}
+	command, family := header[12], header[13]
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, errors.Wrap(err, "Failed to read PROXY header")
+	}
+	switch command {
+	case proxyV2Local:
+		return nil, nil
+	case proxyV2Proxy:
+	default:
+		return nil, errors.Errorf("Invalid PROXY v2 command %#x", command)
+	}
+
+	var ipLen int
+	switch family {
+	case proxyV2TCP4:
+		ipLen = net.IPv4len
+	case proxyV2TCP6:
+		ipLen = net.IPv6len
+	default:
+		// UDP and unix sockets don't have an address we can use
+		return nil, nil
+	}
+	// Source and destination addresses, then source and destination ports
+	if len(body) < ipLen*2+4 {
+		return nil, errors.New("PROXY v2 header too short for its addresses")
+	}
+	ip := make(net.IP, ipLen)
+	copy(ip, body[:ipLen])
+	port := binary.BigEndian.Uint16(body[ipLen*2:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
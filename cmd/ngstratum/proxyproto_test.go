@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyV1(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader(
+		"PROXY TCP4 192.168.0.1 192.168.0.11 56324 3333\r\n{\"id\": 1}\n"))
+	addr, err := readProxyHeader(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.0.1:56324", addr.String())
+	// The stratum message that follows is untouched
+	rest, _ := r.ReadString('\n')
+	assert.Equal(t, "{\"id\": 1}\n", rest)
+
+	addr, err = readProxyHeader(bufio.NewReader(strings.NewReader(
+		"PROXY TCP6 2001:db8::1 2001:db8::2 4000 3333\r\n")))
+	assert.NoError(t, err)
+	assert.Equal(t, "[2001:db8::1]:4000", addr.String())
+
+	addr, err = readProxyHeader(bufio.NewReader(strings.NewReader(
+		"PROXY UNKNOWN\r\n")))
+	assert.NoError(t, err)
+	assert.Nil(t, addr)
+
+	for _, header := range []string{
+		"PROXY TCP4 2001:db8::1 192.168.0.11 56324 3333\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 99999 3333\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 56324 3333\n",
+		"PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n",
+		"{\"id\": 1, \"method\": \"mining.subscribe\"}\n",
+	} {
+		_, err := readProxyHeader(bufio.NewReader(strings.NewReader(header)))
+		assert.Error(t, err, header)
+	}
+}
+
+func TestProxyV2(t *testing.T) {
+	header := func(command byte, family byte, body []byte) []byte {
+		buf := bytes.NewBuffer(append([]byte{}, proxyV2Sig...))
+		buf.Write([]byte{command, family, 0, byte(len(body))})
+		buf.Write(body)
+		buf.WriteString("{}\n")
+		return buf.Bytes()
+	}
+	ipv4 := []byte{10, 0, 0, 5, 10, 0, 0, 1, 0x1f, 0x90, 0x0d, 0x05}
+	r := bufio.NewReader(bytes.NewReader(header(proxyV2Proxy, proxyV2TCP4, ipv4)))
+	addr, err := readProxyHeader(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.5:8080", addr.String())
+	rest, _ := r.ReadString('\n')
+	assert.Equal(t, "{}\n", rest)
+
+	// TLVs after the addresses are skipped
+	withTLV := append(append([]byte{}, ipv4...), 0x04, 0, 1, 0xff)
+	addr, err = readProxyHeader(bufio.NewReader(bytes.NewReader(
+		header(proxyV2Proxy, proxyV2TCP4, withTLV))))
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.5:8080", addr.String())
+
+	ipv6 := make([]byte, 36)
+	ipv6[0], ipv6[1], ipv6[15] = 0x20, 0x01, 1
+	ipv6[33] = 80
+	addr, err = readProxyHeader(bufio.NewReader(bytes.NewReader(
+		header(proxyV2Proxy, proxyV2TCP6, ipv6))))
+	assert.NoError(t, err)
+	assert.Equal(t, "[2001::1]:80", addr.String())
+
+	// Health checks from the balancer itself
+	addr, err = readProxyHeader(bufio.NewReader(bytes.NewReader(
+		header(proxyV2Local, 0, nil))))
+	assert.NoError(t, err)
+	assert.Nil(t, addr)
+
+	_, err = readProxyHeader(bufio.NewReader(bytes.NewReader(
+		header(proxyV2Proxy, proxyV2TCP4, ipv4[:6]))))
+	assert.Error(t, err)
+	_, err = readProxyHeader(bufio.NewReader(bytes.NewReader(
+		header(0x22, proxyV2TCP4, ipv4))))
+	assert.Error(t, err)
+}
+
+func TestProxyProtocolExpects(t *testing.T) {
+	_, err := NewProxyProtocol(nil)
+	assert.Error(t, err)
+	all, err := NewProxyProtocol([]string{"0.0.0.0/0", "::/0"})
+	assert.NoError(t, err)
+	assert.True(t, all.Expects(&net.TCPAddr{IP: net.ParseIP("1.2.3.4")}))
+	assert.True(t, all.Expects(&net.TCPAddr{IP: net.ParseIP("2001:db8::1")}))
+
+	p, err := NewProxyProtocol([]string{"10.0.0.0/8", "192.168.1.5"})
+	assert.NoError(t, err)
+	assert.True(t, p.Expects(&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}))
+	assert.True(t, p.Expects(&net.TCPAddr{IP: net.ParseIP("192.168.1.5")}))
+	assert.False(t, p.Expects(&net.TCPAddr{IP: net.ParseIP("192.168.1.6")}))
+
+	_, err = NewProxyProtocol([]string{"nope"})
+	assert.Error(t, err)
+}
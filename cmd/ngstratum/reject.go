@@ -0,0 +1,137 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/icook/ngpool/pkg/common"
+)
+
+// What became of a share submission. Everything but ShareAccepted is a reject,
+// answered with the matching stratum error and counted in the worker's share
+// stats
+type ShareResult int
+
+const (
+	ShareAccepted ShareResult = iota
+	// The job id isn't one we gave out, or it's so old we've forgotten it
+	ShareJobNotFound
+	// For a job we know, but a newer block has been sent since
+	ShareStale
+	ShareDuplicate
+	ShareLowDiff
+	// The nonce or extranonce2 isn't the size we told the miner to use
+	ShareBadNonceSize
+	ShareBadVersion
+	ShareBadResult
+	ShareOther
+)
+
+var shareResultNames = map[ShareResult]string{
+	ShareAccepted:     "accepted",
+	ShareJobNotFound:  "job_not_found",
+	ShareStale:        "stale",
+	ShareDuplicate:    "duplicate",
+	ShareLowDiff:      "low_difficulty",
+	ShareBadNonceSize: "bad_nonce_size",
+	ShareBadVersion:   "bad_version",
+	ShareBadResult:    "bad_result",
+	ShareOther:        "other",
+}
+
+func (r ShareResult) String() string {
+	return shareResultNames[r]
+}
+
+// Job not found and stale share a code, since miners generally treat 21 as
+// stale either way, but the description tells them which it was
+var shareRejectErrors = map[ShareResult]*StratumError{
+	ShareJobNotFound:  &StratumError{Code: StratumErrorStale, Desc: "Job not found", TB: nil},
+	ShareStale:        &StratumError{Code: StratumErrorStale, Desc: "Stale share", TB: nil},
+	ShareDuplicate:    stratumErrors[StratumErrorDuplicate],
+	ShareLowDiff:      stratumErrors[StratumErrorLowDiff],
+	ShareBadNonceSize: &StratumError{Code: StratumErrorOther, Desc: "Invalid nonce size", TB: nil},
+	ShareBadVersion:   stratumErrors[StratumErrorBadVersion],
+	ShareBadResult:    stratumErrors[StratumErrorBadResult],
+	ShareOther:        stratumErrors[StratumErrorOther],
+}
+
+// Sizes of the nonce and extranonce2 a miner must submit. Stratum miners are
+// told the extranonce2 size on subscribe, and iterate a 4 byte header nonce.
+// The extranonce2 size here is the default, ports can change it
+type nonceSizes struct {
+	nonce       int
+	extranonce2 int
+}
+
+var stratumNonceSizes = nonceSizes{nonce: 4, extranonce2: 4}
+
+// Classifies a submission before the expensive hashing, looking up the job and
+// claiming the submission's key against duplicates. On ShareAccepted the
+// caller owns the claim, and must release it if the share is later rejected.
+// Jobs other than the latest expire maxAge after they were sent, 0 disables.
+// Jobs up to staleDepth blocks behind the latest are still accepted
+func classifySubmission(book *clientJobBook, submission *MiningSubmit,
+	sizes nonceSizes, now time.Time, maxAge time.Duration, staleDepth int64) (*ClientJob, ShareResult) {
+	latest := book.latest()
+	clientJob, ok := book.jobs[submission.JobID]
+	if !ok {
+		// One of ours that's been dropped, for an earlier block
+		height, ours := jobIDHeight(submission.JobID)
+		if ours && latest != nil && height < latest.job.height {
+			return nil, ShareStale
+		}
+		return nil, ShareJobNotFound
+	}
+	if latest != nil && clientJob.job.height < latest.job.height-staleDepth {
+		return clientJob, ShareStale
+	}
+	if maxAge > 0 && clientJob != latest && now.Sub(clientJob.sent) > maxAge {
+		return clientJob, ShareStale
+	}
+	if len(submission.Nonce) != sizes.nonce ||
+		len(submission.Extranonce2) != sizes.extranonce2 {
+		return clientJob, ShareBadNonceSize
+	}
+	if _, dup := clientJob.submissions.LoadOrStore(submission.GetKey(), true); dup {
+		return clientJob, ShareDuplicate
+	}
+	return clientJob, ShareAccepted
+}
+
+func incrShareStat(stats *common.ShareStats, result ShareResult) {
+	switch result {
+	case ShareAccepted:
+		atomic.AddUint64(&stats.Accepted, 1)
+	case ShareJobNotFound:
+		atomic.AddUint64(&stats.JobNotFound, 1)
+	case ShareStale:
+		atomic.AddUint64(&stats.Stale, 1)
+	case ShareDuplicate:
+		atomic.AddUint64(&stats.Duplicate, 1)
+	case ShareLowDiff:
+		atomic.AddUint64(&stats.LowDiff, 1)
+	case ShareBadNonceSize:
+		atomic.AddUint64(&stats.BadNonceSize, 1)
+	case ShareBadVersion:
+		atomic.AddUint64(&stats.BadVersion, 1)
+	case ShareBadResult:
+		atomic.AddUint64(&stats.BadResult, 1)
+	default:
+		atomic.AddUint64(&stats.Other, 1)
+	}
+}
+
+func loadShareStats(stats *common.ShareStats) common.ShareStats {
+	return common.ShareStats{
+		Accepted:     atomic.LoadUint64(&stats.Accepted),
+		JobNotFound:  atomic.LoadUint64(&stats.JobNotFound),
+		Stale:        atomic.LoadUint64(&stats.Stale),
+		Duplicate:    atomic.LoadUint64(&stats.Duplicate),
+		LowDiff:      atomic.LoadUint64(&stats.LowDiff),
+		BadNonceSize: atomic.LoadUint64(&stats.BadNonceSize),
+		BadVersion:   atomic.LoadUint64(&stats.BadVersion),
+		BadResult:    atomic.LoadUint64(&stats.BadResult),
+		Other:        atomic.LoadUint64(&stats.Other),
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/icook/ngpool/pkg/common"
+)
+
+func testSubmission(jobID string, nonce []byte) *MiningSubmit {
+	return &MiningSubmit{
+		JobID:       jobID,
+		Extranonce2: []byte{0, 0, 0, 1},
+		Nonce:       nonce,
+	}
+}
+
+func TestClassifySubmission(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	book := &clientJobBook{}
+	old := &ClientJob{id: "old", job: &Job{MainChainJob: MainChainJob{height: 10}}}
+	book = book.with(old, defaultRetainedJobs, 0)
+	sameBlock := &ClientJob{id: "same", job: &Job{MainChainJob: MainChainJob{height: 10}}}
+	book = book.with(sameBlock, defaultRetainedJobs, 0)
+	nonce := []byte{1, 2, 3, 4}
+
+	_, result := classifySubmission(book, testSubmission("missing", nonce),
+		stratumNonceSizes, now, 0, 0)
+	assert.Equal(t, ShareJobNotFound, result)
+
+	// A job for the same block is still good after a newer job
+	clientJob, result := classifySubmission(book, testSubmission("old", nonce),
+		stratumNonceSizes, now, 0, 0)
+	assert.Equal(t, ShareAccepted, result)
+	assert.Equal(t, old, clientJob)
+	_, result = classifySubmission(book, testSubmission("old", nonce), stratumNonceSizes, now, 0, 0)
+	assert.Equal(t, ShareDuplicate, result)
+
+	_, result = classifySubmission(book, testSubmission("same", []byte{1, 2, 3}),
+		stratumNonceSizes, now, 0, 0)
+	assert.Equal(t, ShareBadNonceSize, result)
+	sub := testSubmission("same", nonce)
+	sub.Extranonce2 = []byte{1}
+	_, result = classifySubmission(book, sub, stratumNonceSizes, now, 0, 0)
+	assert.Equal(t, ShareBadNonceSize, result)
+
+	newJob := &ClientJob{id: "new", job: &Job{MainChainJob: MainChainJob{height: 11}}}
+	book = book.with(newJob, defaultRetainedJobs, 0)
+	_, result = classifySubmission(book, testSubmission("same", []byte{5, 6, 7, 8}),
+		stratumNonceSizes, now, 0, 0)
+	assert.Equal(t, ShareStale, result)
+	_, result = classifySubmission(book, testSubmission("new", nonce), stratumNonceSizes, now, 0, 0)
+	assert.Equal(t, ShareAccepted, result)
+
+	// Within the stale depth the last block's jobs are still good
+	_, result = classifySubmission(book, testSubmission("same", []byte{5, 6, 7, 8}),
+		stratumNonceSizes, now, 0, 1)
+	assert.Equal(t, ShareAccepted, result)
+	_, result = classifySubmission(book, testSubmission("same", []byte{5, 6, 7, 9}),
+		stratumNonceSizes, now, 0, 0)
+	assert.Equal(t, ShareStale, result)
+
+	// A job that's been dropped is stale if the id says it was for an
+	// earlier block
+	_, result = classifySubmission(book, testSubmission(makeJobID(10, 0xabcd, 3), nonce),
+		stratumNonceSizes, now, 0, 0)
+	assert.Equal(t, ShareStale, result)
+	_, result = classifySubmission(book, testSubmission(makeJobID(11, 0xabcd, 3), nonce),
+		stratumNonceSizes, now, 0, 0)
+	assert.Equal(t, ShareJobNotFound, result)
+
+	// Past maxAge only the latest job is still good
+	book = &clientJobBook{}
+	book = book.with(&ClientJob{id: "a", sent: now, job: &Job{}}, defaultRetainedJobs, 0)
+	book = book.with(&ClientJob{id: "b", sent: now.Add(time.Second), job: &Job{}},
+		defaultRetainedJobs, 0)
+	later := now.Add(time.Minute * 11)
+	_, result = classifySubmission(book, testSubmission("a", nonce),
+		stratumNonceSizes, later, time.Minute*10, 0)
+	assert.Equal(t, ShareStale, result)
+	_, result = classifySubmission(book, testSubmission("b", nonce),
+		stratumNonceSizes, later, time.Minute*10, 0)
+	assert.Equal(t, ShareAccepted, result)
+}
+
+func TestShareRejectErrors(t *testing.T) {
+	for result := range shareResultNames {
+		if result == ShareAccepted {
+			continue
+		}
+		assert.NotNil(t, shareRejectErrors[result], result.String())
+	}
+	assert.Equal(t, StratumErrorStale, shareRejectErrors[ShareStale].Code)
+	assert.Equal(t, StratumErrorLowDiff, shareRejectErrors[ShareLowDiff].Code)
+}
+
+func TestShareStats(t *testing.T) {
+	var stats common.ShareStats
+	incrShareStat(&stats, ShareAccepted)
+	incrShareStat(&stats, ShareStale)
+	incrShareStat(&stats, ShareLowDiff)
+	incrShareStat(&stats, ShareLowDiff)
+	loaded := loadShareStats(&stats)
+	assert.Equal(t, uint64(1), loaded.Accepted)
+	assert.Equal(t, uint64(2), loaded.LowDiff)
+	assert.Equal(t, uint64(3), loaded.Rejected())
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"time"
+
+	"github.com/icook/ngpool/pkg/alert"
+	"github.com/icook/ngpool/pkg/common"
+)
+
+type rejectSample struct {
+	at       time.Time
+	accepted uint64
+	rejected uint64
+}
+
+// RejectMonitor raises an alert when the port's share reject rate over the
+// last window goes above a threshold, which usually means a broken coinserver
+// or job rather than bad miners
+type RejectMonitor struct {
+	threshold float64
+	window    time.Duration
+	minShares uint64
+	alerts    *alert.Alerter
+	samples   []rejectSample
+}
+
+// Returns nil, which never alerts, when threshold is 0
+func NewRejectMonitor(threshold float64, window time.Duration, minShares uint64,
+	alerts *alert.Alerter) *RejectMonitor {
+	if threshold <= 0 {
+		return nil
+	}
+	return &RejectMonitor{
+		threshold: threshold,
+		window:    window,
+		minShares: minShares,
+		alerts:    alerts,
+	}
+}
+
+// Takes the port's share counters. Returns the reject rate over the window,
+// or -1 if too few shares came in to tell
+func (m *RejectMonitor) Check(stats common.ShareStats, now time.Time) float64 {
+	if m == nil {
+		return -1
+	}
+	m.samples = append(m.samples, rejectSample{now, stats.Accepted, stats.Rejected()})
+	// Keep the newest sample at least a window old as the baseline
+	for len(m.samples) > 1 && now.Sub(m.samples[1].at) >= m.window {
+		m.samples = m.samples[1:]
+	}
+	first := m.samples[0]
+	accepted := stats.Accepted - first.accepted
+	rejected := stats.Rejected() - first.rejected
+	total := accepted + rejected
+	if total == 0 || total < m.minShares {
+		return -1
+	}
+	rate := float64(rejected) / float64(total)
+	if rate >= m.threshold {
+		m.alerts.Fire(alert.RejectRate, "", map[string]interface{}{
+			"percent":  rate * 100,
+			"rejected": rejected,
+			"total":    total,
+		})
+	}
+	return rate
+}
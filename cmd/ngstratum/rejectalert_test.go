@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/icook/ngpool/pkg/common"
+)
+
+func TestRejectMonitor(t *testing.T) {
+	assert.Nil(t, NewRejectMonitor(0, time.Minute, 10, nil))
+
+	m := NewRejectMonitor(0.5, time.Minute, 10, nil)
+	now := time.Now()
+	assert.Equal(t, -1.0, m.Check(common.ShareStats{}, now))
+	// Too few shares to say
+	assert.Equal(t, -1.0, m.Check(common.ShareStats{Accepted: 2, Stale: 3}, now.Add(time.Second*10)))
+	assert.InEpsilon(t, 0.6, m.Check(common.ShareStats{Accepted: 8, Stale: 12},
+		now.Add(time.Second*30)), 0.001)
+	// Shares from before the window drop out
+	assert.InEpsilon(t, 0.2, m.Check(common.ShareStats{Accepted: 48, Stale: 22},
+		now.Add(time.Second*100)), 0.001)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/pkg/errors"
+)
+
+// SessionLimiter caps the miners connected to this port, and to every port on
+// our sharechain together. Sessions on other ports are counted from their
+// published status, so the pool limit is only as fresh as service discovery
+type SessionLimiter struct {
+	maxPort int
+	maxPool int
+	// Sessions open on the other ports of our sharechain
+	peerSessions func() int
+
+	open     int
+	rejected map[string]uint64
+	mtx      sync.Mutex
+}
+
+// Returns nil, which lets everything through, when both limits are 0
+func NewSessionLimiter(maxPort int, maxPool int, peerSessions func() int) *SessionLimiter {
+	if maxPort <= 0 && maxPool <= 0 {
+		return nil
+	}
+	if peerSessions == nil {
+		peerSessions = func() int { return 0 }
+	}
+	return &SessionLimiter{
+		maxPort:      maxPort,
+		maxPool:      maxPool,
+		peerSessions: peerSessions,
+		rejected:     map[string]uint64{},
+	}
+}
+
+// Takes a session slot, returning a func to give it back when the session
+// closes. Errors say which limit was hit
+func (l *SessionLimiter) Acquire() (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	peers := l.peerSessions()
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.maxPort > 0 && l.open >= l.maxPort {
+		l.rejected["port_sessions"]++
+		return nil, errors.New("Port is full")
+	}
+	if l.maxPool > 0 && l.open+peers >= l.maxPool {
+		l.rejected["pool_sessions"]++
+		return nil, errors.New("Pool is full")
+	}
+	l.open++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mtx.Lock()
+			l.open--
+			l.mtx.Unlock()
+		})
+	}, nil
+}
+
+type sessionLimitStatus struct {
+	Open     int               `json:"open"`
+	MaxPort  int               `json:"max_port"`
+	MaxPool  int               `json:"max_pool"`
+	Rejected map[string]uint64 `json:"rejected"`
+}
+
+func (l *SessionLimiter) Stats() *sessionLimitStatus {
+	if l == nil {
+		return nil
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	status := &sessionLimitStatus{
+		Open:     l.open,
+		MaxPort:  l.maxPort,
+		MaxPool:  l.maxPool,
+		Rejected: map[string]uint64{},
+	}
+	for reason, count := range l.rejected {
+		status.Rejected[reason] = count
+	}
+	return status
+}
+
+// Turns away a miner over the session limits. Their first message is answered
+// with an error so they don't sit waiting on a subscribe reply, then they're
+// sent client.reconnect to redirect if there's somewhere to go
+func shedSession(conn net.Conn, reader *bufio.Reader, timeout time.Duration,
+	reason error, redirect string) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	line, err := reader.ReadSlice('\n')
+	if err != nil {
+		return
+	}
+	var msg StratumMessage
+	if err := json.Unmarshal(line, &msg); err != nil {
+		return
+	}
+	resp, _ := json.Marshal(&StratumResponse{
+		ID:    msg.ID,
+		Error: []interface{}{StratumErrorOther, reason.Error(), nil},
+	})
+	out := append(resp, '\n')
+	if host, portRaw, err := net.SplitHostPort(redirect); err == nil {
+		if port, err := strconv.Atoi(portRaw); err == nil {
+			reconnect, _ := json.Marshal(&StratumMessage{
+				Method: "client.reconnect",
+				Params: []interface{}{host, port, 0},
+			})
+			out = append(out, append(reconnect, '\n')...)
+		}
+	}
+	if _, err := conn.Write(out); err != nil {
+		log.Debug("Failed to shed session", "ip", remoteIP(conn), "err", err)
+	}
+}
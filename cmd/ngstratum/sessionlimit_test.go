@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionLimiter(t *testing.T) {
+	peers := 5
+	l := NewSessionLimiter(2, 8, func() int { return peers })
+	release1, err := l.Acquire()
+	assert.NoError(t, err)
+	_, err = l.Acquire()
+	assert.NoError(t, err)
+	_, err = l.Acquire()
+	assert.Error(t, err)
+
+	// Releasing twice only gives back one slot
+	release1()
+	release1()
+	peers = 7
+	_, err = l.Acquire()
+	assert.Error(t, err)
+	peers = 5
+	_, err = l.Acquire()
+	assert.NoError(t, err)
+
+	stats := l.Stats()
+	assert.Equal(t, 2, stats.Open)
+	assert.Equal(t, map[string]uint64{"port_sessions": 1, "pool_sessions": 1}, stats.Rejected)
+
+	disabled := NewSessionLimiter(0, 0, nil)
+	assert.Nil(t, disabled)
+	release, err := disabled.Acquire()
+	assert.NoError(t, err)
+	release()
+	assert.Nil(t, disabled.Stats())
+}
+
+func TestShedSession(t *testing.T) {
+	server, client := net.Pipe()
+	go func() {
+		client.Write([]byte(`{"id": 1, "method": "mining.subscribe", "params": []}` + "\n"))
+	}()
+	done := make(chan []byte)
+	go func() {
+		out, _ := ioutil.ReadAll(client)
+		done <- out
+	}()
+	shedSession(server, bufio.NewReader(server), time.Second, errors.New("Port is full"),
+		"eu.example.com:3333")
+	assert.Equal(t, `{"id":1,"result":null,"error":[20,"Port is full",null]}`+"\n"+
+		`{"id":null,"method":"client.reconnect","params":["eu.example.com",3333,0]}`+"\n",
+		string(<-done))
+}
+
+func TestSteeringLeastLoaded(t *testing.T) {
+	s := NewSteering(&steeringPolicy{region: "eu"}, "btc", "self")
+	assert.Nil(t, s.LeastLoaded())
+	s.peers["us1"] = &stratumPeer{ID: "us1", Region: "us", Endpoint: "us1:3333", Clients: 1}
+	s.peers["eu1"] = &stratumPeer{ID: "eu1", Region: "eu", Endpoint: "eu1:3333", Clients: 10}
+	s.peers["eu2"] = &stratumPeer{ID: "eu2", Region: "eu", Endpoint: "eu2:3333", Clients: 4}
+	assert.Equal(t, "eu2", s.LeastLoaded().ID)
+	assert.Equal(t, 15, s.PeerSessions())
+}
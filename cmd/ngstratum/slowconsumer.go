@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Sessions disconnected for not keeping up with what we send them, so one
+// stalled connection can't hold up anything else
+type SlowConsumers struct {
+	// Let SendQueue messages back up
+	queueFull uint64
+	// A write took longer than WriteTimeout, ie a miner behind a dead NAT
+	writeTimeout uint64
+}
+
+func (s *SlowConsumers) addQueueFull() {
+	atomic.AddUint64(&s.queueFull, 1)
+}
+
+func (s *SlowConsumers) addWriteTimeout() {
+	atomic.AddUint64(&s.writeTimeout, 1)
+}
+
+// Sessions disconnected since startup, by reason
+func (s *SlowConsumers) Stats() map[string]uint64 {
+	return map[string]uint64{
+		"queue_full":    atomic.LoadUint64(&s.queueFull),
+		"write_timeout": atomic.LoadUint64(&s.writeTimeout),
+	}
+}
+
+// Writes bufs to conn, giving up after timeout. 0 waits as long as it takes
+func writeWithDeadline(conn net.Conn, bufs net.Buffers, timeout time.Duration) error {
+	if timeout > 0 {
+		if err := conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+			return err
+		}
+	}
+	_, err := bufs.WriteTo(conn)
+	return err
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
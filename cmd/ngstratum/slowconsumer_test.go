@@ -0,0 +1,36 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteWithDeadline(t *testing.T) {
+	// Pipes have no buffer, so nobody reading is a stalled miner
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	err := writeWithDeadline(server, net.Buffers{[]byte("job\n")}, time.Millisecond*20)
+	assert.Error(t, err)
+	assert.True(t, isTimeout(err))
+
+	go ioutil.ReadAll(client)
+	err = writeWithDeadline(server, net.Buffers{[]byte("job\n")}, time.Second)
+	assert.NoError(t, err)
+	server.Close()
+	err = writeWithDeadline(server, net.Buffers{[]byte("job\n")}, 0)
+	assert.Error(t, err)
+	assert.False(t, isTimeout(err))
+}
+
+func TestSlowConsumerStats(t *testing.T) {
+	var s SlowConsumers
+	s.addQueueFull()
+	s.addWriteTimeout()
+	s.addWriteTimeout()
+	assert.Equal(t, map[string]uint64{"queue_full": 1, "write_timeout": 2}, s.Stats())
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/pkg/errors"
+
+	"github.com/icook/ngpool/pkg/common"
+)
+
+// Round state is snapshotted when the stratum stops, and on the snapshot
+// control command: queued shares are written to the database first so
+// restarts don't drop them from the PPLNS window, then the coinbase payout
+// windows are saved beside the config cache. On start saved windows are used
+// until they're reloaded, so the first jobs still pay miners directly
+const roundStateName = "round"
+
+// How long Stop waits for queued shares to be written
+const shareFlushTimeout = time.Second * 15
+
+type windowSnapshot struct {
+	Shares    map[int]float64 `json:"shares"`
+	Addresses map[int]string  `json:"addresses"`
+	Fee       float64         `json:"fee"`
+	MaxPayees int             `json:"max_payees"`
+	Dust      int64           `json:"dust"`
+}
+
+type roundSnapshot struct {
+	ShareChain string                     `json:"sharechain"`
+	Windows    map[string]*windowSnapshot `json:"windows"`
+}
+
+// The windows last loaded, by currency
+func (c *CoinbasePayouts) snapshot() map[string]*windowSnapshot {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	windows := map[string]*windowSnapshot{}
+	for currency, w := range c.windows {
+		windows[currency] = &windowSnapshot{
+			Shares:    w.shares,
+			Addresses: w.addresses,
+			Fee:       w.fee,
+			MaxPayees: w.maxPayees,
+			Dust:      w.dust,
+		}
+	}
+	return windows
+}
+
+// Puts saved windows in place until they're reloaded. Targets aren't
+// restored, so each currency is still reloaded as soon as a job asks for it
+func (c *CoinbasePayouts) restore(windows map[string]*windowSnapshot) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for currency, snap := range windows {
+		codec, err := common.GetAddressCodec(currency)
+		if err != nil {
+			log.Warn("Not restoring coinbase payout window", "currency", currency, "err", err)
+			continue
+		}
+		window := &PayoutWindow{
+			shares:    snap.Shares,
+			addresses: map[int]string{},
+			scripts:   map[int][]byte{},
+			fee:       snap.Fee,
+			maxPayees: snap.MaxPayees,
+			dust:      snap.Dust,
+		}
+		if window.shares == nil {
+			window.shares = map[int]float64{}
+		}
+		for _, difficulty := range window.shares {
+			window.total += difficulty
+		}
+		for userID, address := range snap.Addresses {
+			script, err := codec.PayToScript(address)
+			if err != nil {
+				continue
+			}
+			window.addresses[userID] = address
+			window.scripts[userID] = script
+		}
+		c.windows[currency] = window
+	}
+}
+
+// Waits for the shares queued so far to be handled by ListenShares
+func (n *StratumServer) flushShares(timeout time.Duration) error {
+	flushed := make(chan struct{})
+	deadline := time.After(timeout)
+	select {
+	case n.newShare <- &Share{flushed: flushed}:
+	case <-deadline:
+		return errors.Errorf("Share queue still full after %s", timeout)
+	}
+	select {
+	case <-flushed:
+		return nil
+	case <-deadline:
+		return errors.Errorf("Queued shares not written after %s", timeout)
+	}
+}
+
+func (n *StratumServer) saveSnapshot() error {
+	if err := n.flushShares(shareFlushTimeout); err != nil {
+		return err
+	}
+	if n.service == nil || n.coinbasePayouts == nil {
+		return nil
+	}
+	snap := roundSnapshot{
+		ShareChain: n.shareChain.Name,
+		Windows:    n.coinbasePayouts.snapshot(),
+	}
+	if err := n.service.SaveState(roundStateName, snap); err != nil {
+		return err
+	}
+	log.Info("Saved round snapshot", "windows", len(snap.Windows))
+	return nil
+}
+
+// Restores the last snapshot if it's for our sharechain and no older than
+// SnapshotMaxAge
+func (n *StratumServer) restoreSnapshot() {
+	if n.service == nil || n.coinbasePayouts == nil {
+		return
+	}
+	var snap roundSnapshot
+	savedAt, err := n.service.LoadState(roundStateName, &snap)
+	if err != nil {
+		log.Debug("No round snapshot to restore", "err", err)
+		return
+	}
+	age := time.Since(savedAt)
+	if snap.ShareChain != n.shareChain.Name || age > n.config.GetDuration("SnapshotMaxAge") {
+		log.Info("Ignoring stale round snapshot", "sharechain", snap.ShareChain,
+			"saved_at", savedAt)
+		return
+	}
+	n.coinbasePayouts.restore(snap.Windows)
+	log.Info("Restored round snapshot", "windows", len(snap.Windows), "age", age)
+}
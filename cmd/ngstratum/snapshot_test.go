@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/icook/ngpool/pkg/common"
+)
+
+func TestRoundSnapshot(t *testing.T) {
+	common.RegisterAddressCodec("LTC_T", &common.Base58Codec{Params: &chaincfg.TestNet3Params})
+	w := testPayoutWindow()
+	w.addresses[2] = "mucHkBoHAF8DTQWFuwQXHiewqi3ZBDNNWh"
+	saved := &CoinbasePayouts{windows: map[string]*PayoutWindow{"LTC_T": w, "DOGE": w}}
+
+	raw, err := json.Marshal(roundSnapshot{ShareChain: "LTC_T", Windows: saved.snapshot()})
+	assert.NoError(t, err)
+	var snap roundSnapshot
+	assert.NoError(t, json.Unmarshal(raw, &snap))
+
+	restored := NewCoinbasePayouts(nil, nil, time.Minute)
+	restored.restore(snap.Windows)
+	// No codec for DOGE, so it waits to be loaded
+	assert.Len(t, restored.windows, 1)
+	window := restored.windows["LTC_T"]
+	assert.Equal(t, w.shares, window.shares)
+	assert.InDelta(t, w.total, window.total, 1e-9)
+	assert.Equal(t, w.fee, window.fee)
+	assert.Equal(t, w.maxPayees, window.maxPayees)
+	assert.Equal(t, w.dust, window.dust)
+	// Scripts are rebuilt, leaving out addresses that aren't valid anymore
+	assert.Equal(t, map[int]string{2: "mucHkBoHAF8DTQWFuwQXHiewqi3ZBDNNWh"}, window.addresses)
+	assert.Len(t, window.scripts[2], 25)
+	// Targets aren't restored, so the first job still loads a fresh window
+	assert.Len(t, restored.targets, 0)
+}
+
+func TestFlushShares(t *testing.T) {
+	n := &StratumServer{newShare: make(chan *Share, 1)}
+	n.newShare <- &Share{}
+	assert.Error(t, n.flushShares(time.Millisecond*10))
+
+	n = &StratumServer{newShare: make(chan *Share, 2)}
+	go func() {
+		for share := range n.newShare {
+			if share.flushed != nil {
+				close(share.flushed)
+			}
+		}
+	}()
+	n.newShare <- &Share{}
+	assert.NoError(t, n.flushShares(time.Second))
+	close(n.newShare)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+)
+
+const (
+	ProtocolStratum = "stratum"
+	ProtocolHTTP    = "http"
+)
+
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("POST "), []byte("HEAD "), []byte("OPTIONS "),
+}
+
+// Guesses the protocol from the first bytes a client sends. Stratum is
+// newline delimited JSON, so anything that doesn't look like an HTTP request
+// line is handed to the stratum client to deal with
+func sniffProtocol(peek []byte) string {
+	for _, method := range httpMethods {
+		if bytes.HasPrefix(peek, method) {
+			return ProtocolHTTP
+		}
+	}
+	return ProtocolStratum
+}
+
+// A connection with some bytes already buffered from sniffing. Reads drain
+// the buffer before going to the socket
+type sniffedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *sniffedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// Figures out what the client is speaking and hands it off. Stratum clients
+// always speak first, so a client that sends nothing before the timeout is
+// dropped
+func (n *StratumServer) handleConn(port *stratumListener, conn net.Conn) {
+	n.port.Idle.configureConn(conn)
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(n.config.GetDuration("ProtocolSniffTimeout")))
+	if n.proxyProtocol != nil && n.proxyProtocol.Expects(conn.RemoteAddr()) {
+		addr, err := readProxyHeader(reader)
+		if err != nil {
+			log.Info("Dropping connection with invalid PROXY header",
+				"ip", remoteIP(conn), "err", err)
+			conn.Close()
+			return
+		}
+		if addr != nil {
+			conn = &proxiedConn{conn, addr}
+		}
+	}
+	// Checked here rather than on accept so that it's the client's IP, not
+	// the load balancer's
+	if ip := remoteIP(conn); n.ipTracker.IsBanned(ip) {
+		log.Debug("Rejecting connection from banned IP", "ip", ip)
+		conn.Close()
+		return
+	}
+	// Longest HTTP method we look for is 8 bytes. Short stratum messages
+	// still work since Peek returns what it got along with the error
+	peek, err := reader.Peek(8)
+	if err != nil && len(peek) == 0 {
+		log.Debug("Connection closed before sending anything",
+			"ip", remoteIP(conn), "err", err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	switch sniffProtocol(peek) {
+	case ProtocolHTTP:
+		n.handleHTTP(conn, reader)
+	default:
+		if n.isDraining() {
+			log.Debug("Refusing miner while draining", "ip", remoteIP(conn))
+			conn.Close()
+			return
+		}
+		release, err := n.connLimiter.Acquire(remoteIP(conn), time.Now())
+		if err != nil {
+			log.Debug("Refusing connection over limit", "ip", remoteIP(conn), "err", err)
+			conn.Close()
+			return
+		}
+		conn = &limitedConn{conn, release}
+		releaseSession, err := n.sessionLimiter.Acquire()
+		if err != nil {
+			log.Debug("Refusing miner over session limit", "ip", remoteIP(conn), "err", err)
+			shedSession(conn, reader, n.config.GetDuration("ProtocolSniffTimeout"), err,
+				n.sessionRedirect())
+			return
+		}
+		conn = &limitedConn{conn, releaseSession}
+		extranonce1, err := n.port.Extranonces.Allocate()
+		if err != nil {
+			log.Warn("Refusing connection", "ip", remoteIP(conn), "err", err)
+			conn.Close()
+			return
+		}
+		settings := port.Settings()
+		lane := n.port.Lanes.Assign(settings.Currencies)
+		client := NewClient(&sniffedConn{conn, reader}, lane, n.newShare, n.validator,
+			settings.VarDiff, n.ipTracker, n.port, extranonce1)
+		client.bind = port.bind
+		client.diffMultiplier = settings.DiffMultiplier
+		client.fastAck = settings.FastAck
+		client.Start()
+		n.newClient <- client
+	}
+}
+
+// Where miners over the session limits are sent, "" for nowhere
+func (n *StratumServer) sessionRedirect() string {
+	if redirect := n.config.GetString("SessionRedirect"); redirect != "" {
+		return redirect
+	}
+	if n.steering == nil {
+		return ""
+	}
+	if peer := n.steering.LeastLoaded(); peer != nil {
+		return peer.Endpoint
+	}
+	return ""
+}
+
+// Answers health probes from load balancers and orchestration (/healthz and
+// /readyz), and tells getwork miners (which speak JSON-RPC over HTTP) to use
+// stratum instead of silently failing
+func (n *StratumServer) handleHTTP(conn net.Conn, reader *bufio.Reader) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(n.config.GetDuration("ProtocolSniffTimeout")))
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		log.Debug("Invalid HTTP request", "ip", remoteIP(conn), "err", err)
+		return
+	}
+
+	var (
+		status = 200
+		body   interface{}
+	)
+	isProbe := req.Method == "GET" || req.Method == "HEAD"
+	if isProbe && (req.URL.Path == "/healthz" || req.URL.Path == "/readyz") {
+		var results map[string]string
+		status, results = n.health.Status(req.URL.Path == "/healthz")
+		body = map[string]interface{}{"healthy": status == 200, "checks": results}
+	} else if isProbe && req.URL.Path == n.config.GetString("HealthCheckPath") {
+		n.lastJobMtx.Lock()
+		hasJob := n.lastJob != nil
+		n.lastJobMtx.Unlock()
+		// Not worth sending miners here if we've got no work to give them
+		if !hasJob {
+			status = 503
+		}
+		body = map[string]interface{}{"healthy": hasJob}
+	} else {
+		// Getwork requests are POSTs with a JSON-RPC body. We respond with a
+		// JSON-RPC error so the miner's log shows something useful
+		var rpcReq struct {
+			ID     interface{} `json:"id"`
+			Method string      `json:"method"`
+		}
+		raw, _ := ioutil.ReadAll(io.LimitReader(req.Body, 1<<16))
+		json.Unmarshal(raw, &rpcReq)
+		if rpcReq.Method == "getwork" {
+			log.Info("Rejected getwork client", "ip", remoteIP(conn))
+		}
+		msg := fmt.Sprintf("This port only speaks stratum, connect with stratum+tcp://%s",
+			n.config.GetString("StratumBind"))
+		status = 400
+		body = map[string]interface{}{
+			"id":     rpcReq.ID,
+			"result": nil,
+			"error":  map[string]interface{}{"code": -1, "message": msg},
+		}
+	}
+
+	encoded, _ := json.Marshal(body)
+	resp := &http.Response{
+		StatusCode:    status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		ContentLength: int64(len(encoded)),
+		Body:          ioutil.NopCloser(bytes.NewReader(encoded)),
+		Close:         true,
+		// Lets Write know to leave the body off for HEAD
+		Request: req,
+	}
+	resp.Write(conn)
+}
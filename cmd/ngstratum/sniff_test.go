@@ -0,0 +1,14 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSniffProtocol(t *testing.T) {
+	assert.Equal(t, ProtocolStratum, sniffProtocol([]byte(`{"id": 1, "method": "mining.subscribe"`)))
+	assert.Equal(t, ProtocolHTTP, sniffProtocol([]byte("GET /health HTTP/1.1")))
+	assert.Equal(t, ProtocolHTTP, sniffProtocol([]byte("POST / HTTP/1.1")))
+	assert.Equal(t, ProtocolStratum, sniffProtocol([]byte("GE")))
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/cast"
+
+	"github.com/icook/ngpool/pkg/common"
+	"github.com/icook/ngpool/pkg/service"
+)
+
+// Another stratum port mining the same sharechain, discovered through etcd
+type stratumPeer struct {
+	ID       string
+	Region   string
+	Endpoint string
+	Clients  int
+}
+
+// A connected client that's a candidate to be moved
+type steerable struct {
+	ID       string
+	RemoteIP string
+}
+
+// Decides which clients should be sent client.reconnect, and where to. Clients
+// are moved to a port in their own region if we're not in it (or the closest
+// region by configured latency), and clients are shed to the least loaded
+// port in our region when we have noticeably more than it
+type steeringPolicy struct {
+	region string
+	// Remote IP ranges for each region, used to guess a client's region
+	networks map[string][]*net.IPNet
+	// Latency in ms between regions, keyed by from then to
+	latency map[string]map[string]float64
+	// How far above the least loaded port our client count can get before
+	// we start moving clients, ie 0.2 for 20%
+	imbalance float64
+	// Maximum clients moved per round
+	batch int
+}
+
+func (p *steeringPolicy) clientRegion(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	regions := []string{}
+	for region := range p.networks {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+	for _, region := range regions {
+		for _, network := range p.networks[region] {
+			if network.Contains(parsed) {
+				return region
+			}
+		}
+	}
+	return ""
+}
+
+func (p *steeringPolicy) distance(from string, to string) (float64, bool) {
+	if from == to {
+		return 0, true
+	}
+	ms, ok := p.latency[from][to]
+	return ms, ok
+}
+
+// Returns the least loaded peer closest to region, and its distance
+func (p *steeringPolicy) nearestPeer(region string, peers []*stratumPeer) (*stratumPeer, float64) {
+	var (
+		best     *stratumPeer
+		bestDist float64
+	)
+	for _, peer := range peers {
+		dist, ok := p.distance(region, peer.Region)
+		if !ok {
+			continue
+		}
+		if best == nil || dist < bestDist || (dist == bestDist && peer.Clients < best.Clients) {
+			best = peer
+			bestDist = dist
+		}
+	}
+	return best, bestDist
+}
+
+// Returns the peer each client should be moved to, keyed by client id
+func (p *steeringPolicy) plan(clients []steerable, peers []*stratumPeer) map[string]*stratumPeer {
+	moves := map[string]*stratumPeer{}
+	if len(peers) == 0 {
+		return moves
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ID < clients[j].ID })
+
+	for _, client := range clients {
+		if len(moves) >= p.batch {
+			return moves
+		}
+		region := p.clientRegion(client.RemoteIP)
+		if region == "" || region == p.region {
+			continue
+		}
+		peer, dist := p.nearestPeer(region, peers)
+		if peer == nil {
+			continue
+		}
+		if ourDist, ok := p.distance(region, p.region); ok && ourDist <= dist {
+			continue
+		}
+		moves[client.ID] = peer
+		peer.Clients++
+	}
+
+	// Shed load to the least loaded port in our region
+	remaining := len(clients) - len(moves)
+	for _, client := range clients {
+		if len(moves) >= p.batch {
+			break
+		}
+		if _, ok := moves[client.ID]; ok {
+			continue
+		}
+		var target *stratumPeer
+		for _, peer := range peers {
+			if peer.Region == p.region && (target == nil || peer.Clients < target.Clients) {
+				target = peer
+			}
+		}
+		// Moving a client to a peer one behind us would just swap the
+		// imbalance, so require a gap of more than one client as well
+		if target == nil || float64(remaining) <= float64(target.Clients)*(1+p.imbalance) ||
+			remaining-target.Clients <= 1 {
+			break
+		}
+		moves[client.ID] = target
+		target.Clients++
+		remaining--
+	}
+	return moves
+}
+
+// Watches the other stratum ports on our sharechain so we know where clients
+// can be sent
+type Steering struct {
+	policy     *steeringPolicy
+	shareChain string
+	self       string
+	peers      map[string]*stratumPeer
+	mtx        sync.Mutex
+}
+
+func NewSteering(policy *steeringPolicy, shareChain string, self string) *Steering {
+	return &Steering{
+		policy:     policy,
+		shareChain: shareChain,
+		self:       self,
+		peers:      map[string]*stratumPeer{},
+	}
+}
+
+func (s *Steering) Watch(updates chan service.ServiceStatusUpdate) {
+	for {
+		update := <-updates
+		if update.ServiceID == s.self {
+			continue
+		}
+		s.mtx.Lock()
+		switch update.Action {
+		case "removed":
+			delete(s.peers, update.ServiceID)
+		case "added", "updated":
+			labels := update.Status.Labels
+			if labels["sharechain"] != s.shareChain || labels["public_endpoint"] == "" {
+				break
+			}
+			var status common.StratumStatus
+			err := mapstructure.Decode(update.Status.Status, &status)
+			if err != nil {
+				log.Warn("Invalid stratum peer status", "id", update.ServiceID, "err", err)
+				break
+			}
+			// Don't send miners somewhere that's turning them away
+			if status.Draining {
+				delete(s.peers, update.ServiceID)
+				break
+			}
+			s.peers[update.ServiceID] = &stratumPeer{
+				ID:       update.ServiceID,
+				Region:   labels["region"],
+				Endpoint: labels["public_endpoint"],
+				Clients:  len(status.Clients),
+			}
+		}
+		s.mtx.Unlock()
+	}
+}
+
+// Runs a round of steering, returning the endpoint each client should be sent
+// to
+func (s *Steering) Plan(clients []steerable) map[string]*stratumPeer {
+	s.mtx.Lock()
+	// Copy since planning adjusts client counts
+	peers := make([]*stratumPeer, 0, len(s.peers))
+	for _, peer := range s.peers {
+		cp := *peer
+		peers = append(peers, &cp)
+	}
+	s.mtx.Unlock()
+	sort.Slice(peers, func(i, j int) bool { return peers[i].ID < peers[j].ID })
+	return s.policy.plan(clients, peers)
+}
+
+// Sessions open on every peer, for the pool wide session limit
+func (s *Steering) PeerSessions() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	var total int
+	for _, peer := range s.peers {
+		total += peer.Clients
+	}
+	return total
+}
+
+// The least loaded peer, preferring those in our region. Nil without peers
+func (s *Steering) LeastLoaded() *stratumPeer {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	var best *stratumPeer
+	for _, peer := range s.peers {
+		if best == nil {
+			best = peer
+			continue
+		}
+		local, bestLocal := peer.Region == s.policy.region, best.Region == s.policy.region
+		if local != bestLocal {
+			if local {
+				best = peer
+			}
+			continue
+		}
+		if peer.Clients < best.Clients || (peer.Clients == best.Clients && peer.ID < best.ID) {
+			best = peer
+		}
+	}
+	return best
+}
+
+func newSteeringPolicy(region string, rawNetworks map[string]interface{},
+	rawLatency map[string]interface{}, imbalance float64, batch int) (*steeringPolicy, error) {
+	p := &steeringPolicy{
+		region:    region,
+		networks:  map[string][]*net.IPNet{},
+		latency:   map[string]map[string]float64{},
+		imbalance: imbalance,
+		batch:     batch,
+	}
+	for region, raw := range rawNetworks {
+		for _, cidr := range cast.ToStringSlice(raw) {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, err
+			}
+			p.networks[region] = append(p.networks[region], network)
+		}
+	}
+	for from, raw := range rawLatency {
+		p.latency[from] = map[string]float64{}
+		for to, ms := range cast.ToStringMap(raw) {
+			p.latency[from][to] = cast.ToFloat64(ms)
+		}
+	}
+	return p, nil
+}
+
+// Asks the miner to reconnect to another stratum port. Most miners reconnect
+// straight away, those that don't will just keep mining here
+func (c *StratumClient) reconnect(endpoint string) error {
+	host, portRaw, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portRaw)
+	if err != nil {
+		return err
+	}
+	msg, err := json.Marshal(&StratumMessage{
+		Method: "client.reconnect",
+		Params: []interface{}{host, port, 0},
+	})
+	if err != nil {
+		return err
+	}
+	c.steered = true
+	c.log.Info("Sending client.reconnect", "endpoint", endpoint)
+	c.enqueue(net.Buffers{append(msg, '\n')})
+	return nil
+}
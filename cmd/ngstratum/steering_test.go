@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testPolicy() *steeringPolicy {
+	_, eu, _ := net.ParseCIDR("10.1.0.0/16")
+	_, asia, _ := net.ParseCIDR("10.2.0.0/16")
+	return &steeringPolicy{
+		region: "us",
+		networks: map[string][]*net.IPNet{
+			"eu":   {eu},
+			"asia": {asia},
+		},
+		latency: map[string]map[string]float64{
+			"asia": {"us": 150, "eu": 200},
+		},
+		imbalance: 0.2,
+		batch:     10,
+	}
+}
+
+func TestSteeringRegion(t *testing.T) {
+	p := testPolicy()
+	euPeer := &stratumPeer{ID: "eu1", Region: "eu", Endpoint: "eu.pool:3333"}
+	clients := []steerable{
+		{"a", "10.1.0.5"}, // eu, has a port there
+		{"b", "10.2.0.5"}, // asia, no port there and we're closest
+		{"c", "10.9.0.5"}, // unknown region
+		{"d", "bad ip"},
+	}
+	moves := p.plan(clients, []*stratumPeer{euPeer})
+	assert.Equal(t, map[string]*stratumPeer{"a": euPeer}, moves)
+}
+
+func TestSteeringLoad(t *testing.T) {
+	p := testPolicy()
+	peer := &stratumPeer{ID: "us2", Region: "us", Endpoint: "us2.pool:3333", Clients: 2}
+	clients := []steerable{}
+	for _, id := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		clients = append(clients, steerable{id, "10.9.0.1"})
+	}
+	moves := p.plan(clients, []*stratumPeer{peer})
+	// 8 vs 2 evens out at 5 each
+	assert.Len(t, moves, 3)
+	assert.Equal(t, 5, peer.Clients)
+
+	// Already balanced, nothing moves
+	peer.Clients = 7
+	assert.Len(t, p.plan(clients, []*stratumPeer{peer}), 0)
+}
+
+func TestSteeringBatch(t *testing.T) {
+	p := testPolicy()
+	p.batch = 1
+	peer := &stratumPeer{ID: "us2", Region: "us", Endpoint: "us2.pool:3333"}
+	clients := []steerable{{"a", "10.9.0.1"}, {"b", "10.9.0.1"}, {"c", "10.9.0.1"}}
+	assert.Len(t, p.plan(clients, []*stratumPeer{peer}), 1)
+}
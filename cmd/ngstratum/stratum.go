@@ -4,18 +4,19 @@ import (
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
 	"math/big"
-	"net"
 	"net/http"
 	"os"
+	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	sq "github.com/Masterminds/squirrel"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/dustin/go-broadcast"
-	"github.com/icook/btcd/rpcclient"
 	log "github.com/inconshreveable/log15"
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
@@ -23,10 +24,14 @@ import (
 	"github.com/mitchellh/mapstructure"
 	"github.com/r3labs/sse"
 	"github.com/seehuhn/sha256d"
+	"github.com/spf13/cast"
 	"github.com/spf13/viper"
 
+	"github.com/icook/ngpool/pkg/alert"
+	"github.com/icook/ngpool/pkg/blockarchive"
 	"github.com/icook/ngpool/pkg/common"
-	"github.com/icook/ngpool/pkg/lbroadcast"
+	"github.com/icook/ngpool/pkg/logging"
+	"github.com/icook/ngpool/pkg/rpcclient"
 	"github.com/icook/ngpool/pkg/service"
 )
 
@@ -39,9 +44,27 @@ type BlockSolve struct {
 	powalgo        string
 	data           []byte
 	subsidyAddress string
+	// How the block was split between miners on a coinbase payout
+	// sharechain, nil otherwise
+	payees []*CoinbasePayee
+	reward blockReward
+	// IDs of the coinservers to submit to, or nil for all of them
+	submitTo map[string]bool
+	// The template the block was built from, for the block archive
+	rawTemplate []byte
+	// Set for createauxblock work, whose block the node builds. data is then
+	// only the AuxPoW, submitted with submitauxblock
+	auxBlockHash string
 }
 
 func (b *BlockSolve) getBlockHash() string {
+	// Stored like the hashes we compute, in internal byte order
+	if b.auxBlockHash != "" {
+		hash, err := chainhash.NewHashFromStr(b.auxBlockHash)
+		if err == nil {
+			return hex.EncodeToString(hash[:])
+		}
+	}
 	var hasher = sha256d.New()
 	hasher.Write(b.data[:80])
 	ret := hasher.Sum(nil)
@@ -55,11 +78,19 @@ type Share struct {
 	difficulty float64
 	currencies []string
 	blocks     map[string]*BlockSolve
+	// The share's hash over the main chain target, see CheckSolves
+	blockRatio float64
+	// By currency code, nil unless the miner picked with pc=
+	payoutWeights map[string]float64
+	// Set on the marker flushShares queues, closed once it's reached
+	flushed chan struct{}
 }
 
 type Template struct {
 	key  TemplateKey
 	data []byte
+	// The coinserver (or push source) the template came from
+	source string
 }
 
 type TemplateKey struct {
@@ -68,6 +99,12 @@ type TemplateKey struct {
 	TemplateType string
 }
 
+// Whether the template is for a merge mined chain, from getblocktemplate or
+// createauxblock
+func (k TemplateKey) IsAux() bool {
+	return k.TemplateType == "getblocktemplate_aux" || k.TemplateType == "createauxblock"
+}
+
 type StratumServer struct {
 	config     *viper.Viper
 	tmplKeys   []TemplateKey
@@ -75,47 +112,307 @@ type StratumServer struct {
 	shareChain *service.ShareChainConfig
 
 	coinserverWatchers map[string]*CoinserverWatcher
+	coinserverMtx      *sync.Mutex
+	templateSources    []TemplateSource
 	newShare           chan *Share
 	newTemplate        chan *Template
+	removeTemplate     chan TemplateKey
 	newClient          chan *StratumClient
-	jobCast            broadcast.Broadcaster
+	clientQuery        chan func(map[string]*StratumClient)
 	service            *service.Service
-	vardiff            *VarDiff
+	listeners          *ListenerSet
+	validator          *ShareValidator
+	verifiers          *VerifierPool
+	coinbasePayouts    *CoinbasePayouts
+	ipTracker          *IPTracker
+	connLimiter        *ConnLimiter
+	sessionLimiter     *SessionLimiter
+	hashrate           *HashrateTracker
+	steering           *Steering
+	templateChecker    *TemplateChecker
+	chainStats         *ChainStats
+	port               *PortConfig
+	proxyProtocol      *ProxyProtocol
+	extranonceClaim    *ExtranonceClaim
+	health             *service.Health
+	listenerHealth     *service.Heartbeat
+	logs               *logging.Logging
+	events             *service.EventBus
+	exporter           *Exporter
+	submissions        *SubmitTracker
+	blockArchive       *BlockArchive
+	alerts             *alert.Alerter
+	rejectMonitor      *RejectMonitor
+	// Set by the drain control command, 1 once we've stopped taking miners
+	draining int32
+	// The status last built by UpdateStatus, for the admin API
+	lastStatus atomic.Value
 
 	lastJob    *Job
+	lastJobAt  time.Time
 	lastJobMtx *sync.Mutex
 
 	// Keyed by currency code
 	blockCast    map[string]broadcast.Broadcaster
 	blockCastMtx *sync.Mutex
+
+	cleanJobs cleanJobsPolicy
 }
 
 func NewStratumServer() *StratumServer {
 	ng := &StratumServer{
-		newTemplate:  make(chan *Template),
-		newShare:     make(chan *Share),
-		newClient:    make(chan *StratumClient),
-		blockCast:    make(map[string]broadcast.Broadcaster),
-		blockCastMtx: &sync.Mutex{},
-		lastJobMtx:   &sync.Mutex{},
-		jobCast:      lbroadcast.NewLastBroadcaster(10),
+		newTemplate:    make(chan *Template),
+		removeTemplate: make(chan TemplateKey),
+		chainStats:     NewChainStats(),
+		events:         service.NewEventBus(),
+		submissions:    NewSubmitTracker(),
+		newShare:       make(chan *Share, shareQueueSize),
+		newClient:      make(chan *StratumClient),
+		clientQuery:    make(chan func(map[string]*StratumClient)),
+		blockCast:      make(map[string]broadcast.Broadcaster),
+		blockCastMtx:   &sync.Mutex{},
+		lastJobMtx:     &sync.Mutex{},
+		health:         service.NewHealth(),
+		listenerHealth: service.NewHeartbeat("stratum listen"),
+
+		coinserverWatchers: map[string]*CoinserverWatcher{},
+		coinserverMtx:      &sync.Mutex{},
 	}
 	return ng
 }
 
 func (n *StratumServer) ConfigureService(name string, etcdEndpoints []string) {
 	n.service = service.NewService("stratum", etcdEndpoints)
+	// One bus for everything, so service.up and service.down from our
+	// watchers come through it too
+	n.service.Events = n.events
 	n.config = n.service.LoadCommonConfig()
 	n.service.LoadServiceConfig(n.config, name)
 }
 
 func (n *StratumServer) ParseConfig() {
 	n.config.SetDefault("LogLevel", "info")
+	// LogFile, LogFormat, LogModules and rotation, see pkg/logging
+	logging.SetDefaults(n.config)
 	n.config.SetDefault("EnableCpuminer", false)
 	n.config.SetDefault("StratumBind", "127.0.0.1:3333")
 	n.config.SetDefault("VardiffMin", 0.125)
 	n.config.SetDefault("VardiffMax", 16384)
 	n.config.SetDefault("VardiffTarget", 20)
+	// More ports to listen on beside StratumBind, keyed by bind, each
+	// optionally with its own VardiffMin, VardiffMax, VardiffTarget,
+	// DiffMultiplier, FastAck and Currencies.
+	// Ports and the Vardiff keys apply on reload-config: new ports are
+	// bound, changed difficulty applies to new sessions, and sessions on
+	// removed ports are sent client.reconnect to PublicEndpoint then
+	// disconnected after PortDrainTimeout
+	n.config.SetDefault("Ports", map[string]interface{}{})
+	n.config.SetDefault("PortDrainTimeout", "5m")
+	// Difficulties sent to miners with mining.set_difficulty are multiplied
+	// by this, and ones they ask for divided by it, for miner software that
+	// counts difficulty against another diff1 than the algorithm's (ie 65536
+	// for some scrypt miners). Can be set per port in Ports
+	n.config.SetDefault("DiffMultiplier", 1)
+	// Answer submits once they pass the checks that don't need hashing, and
+	// hash them afterwards, for far away farms. Bad shares found then can't
+	// be rejected, so what they'd have been credited is taken out of the
+	// session's next good shares. Can be set per port in Ports
+	n.config.SetDefault("FastAck", false)
+	// Sessions to log every stratum frame of, by IP, username or
+	// username.worker, ie ["10.0.0.5", "alice.rig3"]. Applies on
+	// reload-config, to sessions already connected too
+	n.config.SetDefault("TraceSessions", []string{})
+	// Let miners pick their difficulty with d=8192 (static) or sd=1024
+	// (starting, vardiff takes over) in their password. Either way it's kept
+	// within VardiffMin and VardiffMax
+	n.config.SetDefault("PasswordDiff", true)
+	// Let miners pick a minimum payout (mp=0.5) and how often they're paid
+	// (pi=24h) in their password, saved for ngweb's payouts. Passwords
+	// aren't checked, so anyone knowing a username can change them. Needs
+	// the database
+	n.config.SetDefault("PasswordPayoutPrefs", false)
+	// Start vardiff from the difficulty miners ask for with
+	// mining.suggest_difficulty or mining.suggest_target, within VardiffMin
+	// and VardiffMax. d= and sd= in the password win over it
+	n.config.SetDefault("SuggestDiff", true)
+	// How long a worker's difficulty is remembered after it disconnects, so
+	// it starts there if it comes back. 0 disables
+	n.config.SetDefault("WorkerDiffMemory", "30m")
+	// Shares meeting a session's previous difficulty are accepted for this
+	// long after vardiff raises it, since miners take a moment to catch up.
+	// 0 disables
+	n.config.SetDefault("RetargetGrace", "5s")
+	// Shares are accepted for a session's last RetainedJobs jobs, as long as
+	// they're for the current block. Jobs other than the latest also stop
+	// being accepted JobMaxAge after they were sent, 0 disables
+	n.config.SetDefault("RetainedJobs", 16)
+	n.config.SetDefault("JobMaxAge", "10m")
+	// Shares for jobs up to StaleShareDepth blocks behind are still accepted
+	// and credited, though they can't solve blocks. New aux chain blocks
+	// send clean jobs as AuxCleanJobs says: "flushaux" by the currency's
+	// FlushAux, "always" or "never". Aux clean jobs within
+	// MinCleanJobsInterval of the last clean job go out as ordinary updates,
+	// 0 disables
+	n.config.SetDefault("StaleShareDepth", 0)
+	n.config.SetDefault("AuxCleanJobs", "flushaux")
+	n.config.SetDefault("MinCleanJobsInterval", "0s")
+	// Number of protocol errors from a single IP before it's banned. 0
+	// disables banning
+	n.config.SetDefault("ProtocolErrorBanThreshold", 0)
+	n.config.SetDefault("ProtocolErrorBanTime", "10m")
+	// Concurrent stratum connections, and new connections per minute, allowed
+	// from one IP or one AS number. 0 disables each. ASN limits need
+	// ASNDatabase, an iptoasn.com ip2asn-combined.tsv (optionally .gz).
+	// ConnLimitOverrides allows an IP (or each IP in a CIDR) or "AS1234" the
+	// given number of connections (0 for unlimited) and no other limits, for
+	// proxy farms
+	n.config.SetDefault("MaxConnsPerIP", 0)
+	n.config.SetDefault("MaxConnsPerASN", 0)
+	n.config.SetDefault("ConnRatePerIP", 0)
+	n.config.SetDefault("ConnRatePerASN", 0)
+	n.config.SetDefault("ASNDatabase", "")
+	n.config.SetDefault("ConnLimitOverrides", map[string]interface{}{})
+	// Miners connected to this port, and to every port on our sharechain
+	// (counted from their published status), before new ones are turned
+	// away. 0 disables each. Refused miners get an error and client.reconnect
+	// to SessionRedirect, or to the least loaded peer when it's empty
+	n.config.SetDefault("MaxPortSessions", 0)
+	n.config.SetDefault("MaxPoolSessions", 0)
+	n.config.SetDefault("SessionRedirect", "")
+	// Pull templates from discovered coinservers. If disabled coinservers are
+	// still used for block submission, and templates must be pushed in
+	n.config.SetDefault("CoinserverTemplates", true)
+	n.config.SetDefault("TemplatePushBind", "")
+	n.config.SetDefault("TemplatePushToken", "")
+	n.config.SetDefault("NiceHash", false)
+	n.config.SetDefault("MinJobInterval", "0s")
+	// The stratum port also answers HTTP, for load balancer health checks
+	// and to turn away getwork miners
+	n.config.SetDefault("ProtocolSniffTimeout", "10s")
+	// Read the client's real address from a PROXY protocol header (v1 or v2)
+	// at the start of each connection. Only connections from
+	// ProxyProtocolTrusted (CIDRs or IPs) are expected to send one, and it
+	// must be set, to 0.0.0.0/0 if only the balancer can reach the port
+	n.config.SetDefault("ProxyProtocol", false)
+	n.config.SetDefault("ProxyProtocolTrusted", []string{})
+	n.config.SetDefault("HealthCheckPath", "/health")
+	// /healthz and /readyz are also answered on the stratum port. /readyz
+	// fails if no new job has been made for TemplateMaxAge, which should be
+	// many block times of the base currency. 0 only requires that we have a
+	// job
+	n.config.SetDefault("TemplateMaxAge", "0s")
+	// Time for a share's weight in hashrate estimates to fall by 1/e
+	n.config.SetDefault("HashrateDecay", "5m")
+	// Published in our status labels so other ports can send miners here.
+	// PublicEndpoint defaults to StratumBind
+	n.config.SetDefault("Region", "")
+	n.config.SetDefault("PublicEndpoint", "")
+	// Serves the gRPC admin API (adminrpc.StratumAdmin) when set. Clients
+	// must present a certificate signed by AdminCA
+	n.config.SetDefault("AdminBind", "")
+	n.config.SetDefault("AdminCert", "")
+	n.config.SetDefault("AdminKey", "")
+	n.config.SetDefault("AdminCA", "")
+	// Where ngctl reaches AdminBind, published in our status labels so
+	// `ngctl logs stratum` can find us. Left out when empty
+	n.config.SetDefault("AdminEndpoint", "")
+	// Sends client.reconnect to move miners to a port in their region, or to
+	// a less loaded port in ours. Client regions are guessed from
+	// RegionNetworks (region -> list of CIDRs), and RegionLatency (region ->
+	// region -> ms) picks the closest region when theirs has no ports
+	n.config.SetDefault("Steering", false)
+	n.config.SetDefault("SteeringInterval", "1m")
+	n.config.SetDefault("SteeringImbalance", 0.2)
+	n.config.SetDefault("SteeringBatch", 10)
+	// When a currency has several coinservers their templates are compared,
+	// and an alert raised if they disagree for longer than the grace period
+	n.config.SetDefault("TemplateCheckGrace", "30s")
+	n.config.SetDefault("TemplateCheckValueTolerance", 0.25)
+	// Every job is built into a block with a fake solve and checked before
+	// it's sent to miners. Broken jobs are logged and dropped
+	n.config.SetDefault("JobDryRun", true)
+	// Merge mine any aux chain coinserver of our algo that shows up in
+	// service discovery, not just those listed in AuxCurrencies
+	n.config.SetDefault("DynamicAux", false)
+	// Further main chains of the same algo to mine alongside BaseCurrency,
+	// each with its own jobs. Connections are split between them
+	// "roundrobin", or "weighted" by BaseCurrencyWeights (currency code to
+	// weight, default 1). Ports can be limited to some of them with their
+	// Currencies option
+	n.config.SetDefault("ExtraBaseCurrencies", []interface{}{})
+	n.config.SetDefault("BaseCurrencySplit", LaneSplitRoundRobin)
+	// Work format handed to JSON-RPC 2.0 (login mode) miners. See BlobFormats
+	n.config.SetDefault("BlobFormat", "header")
+	// Version bits miners may roll with BIP310, as a hex number. MultiAlgo
+	// bits of the base currency are always left out. Empty disables
+	n.config.SetDefault("VersionRollingMask", "1fffe000")
+	// Goroutines checking submitted shares. 0 uses one per CPU
+	n.config.SetDefault("ShareWorkers", 0)
+	// Messages (jobs, share responses) that may wait to be written to a
+	// miner before it's disconnected as too slow to keep up. Job broadcasts
+	// never wait on a slow miner
+	n.config.SetDefault("SendQueue", 64)
+	// How long a single write to a miner may block, ie behind a dead NAT,
+	// before it's disconnected. "0s" waits for TCP to give up
+	n.config.SetDefault("WriteTimeout", "30s")
+	// Addresses of "ngstratum verifier" processes (unix socket paths or
+	// host:port) to hash shares, for algos too slow to hash alongside
+	// serving miners. Shares are hashed locally if none answer within
+	// VerifierTimeout
+	n.config.SetDefault("Verifiers", []string{})
+	n.config.SetDefault("VerifierTimeout", "2s")
+	// On "coinbase" payout sharechains, how often the PPLNS window and payout
+	// addresses that coinbases are split by are reloaded from the database
+	n.config.SetDefault("CoinbasePayoutRefresh", "30s")
+	// Those windows are saved when we stop and used on start until they're
+	// reloaded, unless they were saved longer ago than this
+	n.config.SetDefault("SnapshotMaxAge", "10m")
+	// Bytes of the 8 byte extranonce given to each connection as extranonce1,
+	// the rest is the extranonce2 miners iterate. ExtranoncePrefix (hex) starts
+	// every extranonce1, and must differ between stratum instances mining the
+	// same currencies so they never hand out the same one. "auto" claims a
+	// free one byte prefix in etcd among the stratums mining our currencies
+	n.config.SetDefault("Extranonce1Size", 4)
+	n.config.SetDefault("ExtranoncePrefix", "")
+	// Sessions are disconnected if they haven't authorized within
+	// IdleAuthTimeout of connecting, gone IdleShareTimeout without submitting
+	// a share, or sent nothing at all for IdleResponseTimeout. Stratum miners
+	// get a client.show_message IdleWarnBefore the disconnect. 0 disables
+	// each. TCPKeepAlive is the keepalive period, 0 for the OS default
+	n.config.SetDefault("IdleAuthTimeout", "1m")
+	n.config.SetDefault("IdleShareTimeout", "30m")
+	n.config.SetDefault("IdleResponseTimeout", "10m")
+	n.config.SetDefault("IdleWarnBefore", "1m")
+	n.config.SetDefault("TCPKeepAlive", "1m")
+	// Stream accepted shares and block solves as JSON (see ShareRecord and
+	// BlockRecord) to "nats" or "kafka-rest" at ExportURL, for analytics
+	// outside the pool. Up to ExportBuffer records wait while the sink is
+	// down, then the oldest are dropped
+	n.config.SetDefault("Export", "")
+	n.config.SetDefault("ExportURL", "")
+	n.config.SetDefault("ExportShareTopic", "ngpool.shares")
+	n.config.SetDefault("ExportBlockTopic", "ngpool.blocks")
+	n.config.SetDefault("ExportBuffer", 10000)
+	// Shares whose hash is within NearTargetFactor of the main chain target
+	// have it saved as block_ratio, for ngweb to catch workers withholding
+	// blocks. 0 saves none
+	n.config.SetDefault("NearTargetFactor", 16)
+	// Every block candidate is written to BlockArchiveDir as gzipped JSON:
+	// the block, its template, the share and each coinserver's answer, for
+	// ngctl blocks inspect. The oldest are removed past BlockArchiveMaxBlocks
+	// or BlockArchiveMaxAge, 0 disabling either. No directory archives
+	// nothing
+	n.config.SetDefault("BlockArchiveDir", "")
+	n.config.SetDefault("BlockArchiveMaxAge", "2160h")
+	n.config.SetDefault("BlockArchiveMaxBlocks", 1000)
+	// Alerts, AlertRateLimit and AlertTemplates, see pkg/alert
+	alert.SetDefaults(n.config)
+	// Alert when more than AlertRejectRate (a fraction) of the port's shares
+	// over AlertRejectWindow were rejected, once at least
+	// AlertRejectMinShares came in. 0 disables
+	n.config.SetDefault("AlertRejectRate", 0)
+	n.config.SetDefault("AlertRejectWindow", "10m")
+	n.config.SetDefault("AlertRejectMinShares", 100)
 
 	scn := n.config.GetString("ShareChainName")
 	sc, ok := service.ShareChain[scn]
@@ -130,23 +427,38 @@ func (n *StratumServer) ParseConfig() {
 	// TODO: Ensure that all template keys match the algo of the sharechain
 	n.shareChain = sc
 
-	db, err := sqlx.Connect("postgres", n.config.GetString("DbConnectionString"))
+	// Without a service we're running standalone (devserve), and shares are
+	// only logged
+	if n.service != nil {
+		db, err := sqlx.Connect("postgres", n.config.GetString("DbConnectionString"))
+		if err != nil {
+			log.Crit("Failed to connect to db", "err", err)
+			os.Exit(1)
+		}
+		n.db = db
+	}
+
+	logs, err := logging.Setup(logging.ReadConfig(n.config))
 	if err != nil {
-		log.Crit("Failed to connect to db", "err", err)
+		log.Crit("Unable to set up logging", "err", err)
 		os.Exit(1)
 	}
-	n.db = db
+	n.logs = logs
 
-	levelConfig := n.config.GetString("LogLevel")
-	level, err := log.LvlFromString(levelConfig)
+	source := "ngstratum"
+	if n.service != nil {
+		source = n.service.Name
+	}
+	alertConfig, err := alert.ReadConfig(n.config, source)
+	if err != nil {
+		log.Crit("Invalid alert config", "err", err)
+		os.Exit(1)
+	}
+	n.alerts, err = alert.New(alertConfig)
 	if err != nil {
-		log.Crit("Unable to parse log level", "configval", levelConfig, "err", err)
+		log.Crit("Invalid alert config", "err", err)
 		os.Exit(1)
 	}
-	handler := log.CallerFileHandler(log.StdoutHandler)
-	handler = log.LvlFilterHandler(level, handler)
-	log.Root().SetHandler(handler)
-	log.Info("Set log level", "level", level)
 
 	var tmplKeys []TemplateKey
 	val := n.config.Get("AuxCurrencies")
@@ -163,43 +475,332 @@ func (n *StratumServer) ParseConfig() {
 		log.Error("Invalid configuration, 'BaseCurrency' of improper format", "err", err)
 		return
 	}
-	n.tmplKeys = append(tmplKeys, tmplKey)
+	var baseKeys []TemplateKey
+	err = mapstructure.Decode(n.config.Get("ExtraBaseCurrencies"), &baseKeys)
+	if err != nil {
+		log.Error("Invalid configuration, 'ExtraBaseCurrencies' of improper format", "err", err)
+		return
+	}
+	baseKeys = append([]TemplateKey{tmplKey}, baseKeys...)
+	weights := map[string]float64{}
+	for currency, weight := range n.config.GetStringMap("BaseCurrencyWeights") {
+		weights[strings.ToUpper(currency)] = cast.ToFloat64(weight)
+	}
+	lanes, err := NewLaneSplitter(baseKeys, n.config.GetString("BaseCurrencySplit"), weights)
+	if err != nil {
+		log.Crit("Invalid base currency config", "err", err)
+		os.Exit(1)
+	}
+	n.tmplKeys = append(tmplKeys, baseKeys...)
+	if err := checkTemplateHooks(); err != nil {
+		log.Crit("Invalid currency config", "err", err)
+		os.Exit(1)
+	}
 
-	n.vardiff = NewVarDiff(
-		n.config.GetFloat64("VardiffMin"),
-		n.config.GetFloat64("VardiffMax"),
-		n.config.GetFloat64("VardiffTarget"),
+	if !auxCleanJobsModes[n.config.GetString("AuxCleanJobs")] {
+		log.Crit("Invalid AuxCleanJobs", "setting", n.config.GetString("AuxCleanJobs"))
+		os.Exit(1)
+	}
+	if n.config.GetInt64("StaleShareDepth") < 0 {
+		log.Crit("StaleShareDepth can't be negative")
+		os.Exit(1)
+	}
+	n.cleanJobs = cleanJobsPolicy{
+		aux:         n.config.GetString("AuxCleanJobs"),
+		minInterval: n.config.GetDuration("MinCleanJobsInterval"),
+	}
+
+	blobFormat, ok := BlobFormats[n.config.GetString("BlobFormat")]
+	if !ok {
+		log.Crit("Invalid BlobFormat", "setting", n.config.GetString("BlobFormat"))
+		os.Exit(1)
+	}
+	var versionMask uint32
+	if raw := n.config.GetString("VersionRollingMask"); raw != "" {
+		versionMask, err = parseVersionMask(raw)
+		if err != nil {
+			log.Crit("Invalid VersionRollingMask", "err", err)
+			os.Exit(1)
+		}
+		for _, key := range baseKeys {
+			config, _ := service.Currency(key.Currency)
+			versionMask &^= multiAlgoMask(config)
+		}
+	}
+	extranoncePrefix := n.config.GetString("ExtranoncePrefix")
+	if extranoncePrefix == "auto" {
+		if n.service == nil {
+			log.Crit("ExtranoncePrefix auto needs etcd")
+			os.Exit(1)
+		}
+		var currencies []string
+		for _, key := range n.tmplKeys {
+			currencies = append(currencies, key.Currency)
+		}
+		n.extranonceClaim, err = NewExtranonceClaim(n.service, currencies)
+		if err != nil {
+			log.Crit("Failed to claim extranonce prefix", "err", err)
+			os.Exit(1)
+		}
+		go n.extranonceClaim.Keep()
+		extranoncePrefix = n.extranonceClaim.Prefix()
+	}
+	extranonces, err := NewExtranonceAllocatorHex(
+		extranoncePrefix, n.config.GetInt("Extranonce1Size"))
+	if err != nil {
+		log.Crit("Invalid extranonce config", "err", err)
+		os.Exit(1)
+	}
+	n.port = &PortConfig{
+		NiceHash:           n.config.GetBool("NiceHash"),
+		MinJobInterval:     n.config.GetDuration("MinJobInterval"),
+		BlobFormat:         blobFormat,
+		VersionRollingMask: versionMask,
+		Extranonces:        extranonces,
+		Lanes:              lanes,
+		PasswordDiff:       n.config.GetBool("PasswordDiff"),
+		SuggestDiff:        n.config.GetBool("SuggestDiff"),
+		WorkerDiffs:        NewWorkerDiffs(n.config.GetDuration("WorkerDiffMemory")),
+		RetargetGrace:      n.config.GetDuration("RetargetGrace"),
+		SendQueue:          n.config.GetInt("SendQueue"),
+		WriteTimeout:       n.config.GetDuration("WriteTimeout"),
+		RetainedJobs:       n.config.GetInt("RetainedJobs"),
+		JobMaxAge:          n.config.GetDuration("JobMaxAge"),
+		StaleShareDepth:    n.config.GetInt64("StaleShareDepth"),
+		Trace:              NewSessionTracer(n.config.GetStringSlice("TraceSessions")),
+		Idle: &IdleReaper{
+			AuthTimeout:     n.config.GetDuration("IdleAuthTimeout"),
+			ShareTimeout:    n.config.GetDuration("IdleShareTimeout"),
+			ResponseTimeout: n.config.GetDuration("IdleResponseTimeout"),
+			WarnBefore:      n.config.GetDuration("IdleWarnBefore"),
+			KeepAlive:       n.config.GetDuration("TCPKeepAlive"),
+		},
+	}
+	// NiceHash penalizes pools that push work updates constantly
+	if n.port.NiceHash && n.port.MinJobInterval == 0 {
+		n.port.MinJobInterval = time.Second * 10
+	}
+	n.listeners = NewListenerSet(n.handleConn)
+	if n.config.GetBool("PasswordPayoutPrefs") && n.db != nil {
+		n.port.PayoutPrefs = NewPayoutPrefWriter(n.db)
+	}
+	n.hashrate = NewHashrateTracker(
+		n.config.GetDuration("HashrateDecay"),
+		n.shareChain.Algo.HashesPerShare,
+	)
+	// Session limits use the peers steering watches, to count sessions and
+	// find somewhere to send miners we turn away
+	sessionLimits := n.config.GetInt("MaxPortSessions") > 0 || n.config.GetInt("MaxPoolSessions") > 0
+	if n.service != nil && (n.config.GetBool("Steering") || sessionLimits) {
+		policy, err := newSteeringPolicy(
+			n.config.GetString("Region"),
+			n.config.GetStringMap("RegionNetworks"),
+			n.config.GetStringMap("RegionLatency"),
+			n.config.GetFloat64("SteeringImbalance"),
+			n.config.GetInt("SteeringBatch"),
+		)
+		if err != nil {
+			log.Crit("Invalid RegionNetworks", "err", err)
+			os.Exit(1)
+		}
+		n.steering = NewSteering(policy, n.shareChain.Name, n.service.Name)
+	}
+	n.templateChecker = NewTemplateChecker(
+		n.config.GetDuration("TemplateCheckGrace"),
+		n.config.GetFloat64("TemplateCheckValueTolerance"),
+	)
+	workers := n.config.GetInt("ShareWorkers")
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	n.validator = NewShareValidator(workers)
+	n.verifiers = NewVerifierPool(n.config.GetStringSlice("Verifiers"),
+		n.config.GetDuration("VerifierTimeout"))
+	// Standalone there are no miners' addresses to pay, so it all goes to
+	// BlockSubsidyAddress as usual
+	if n.shareChain.PayoutMethod == "coinbase" && n.db != nil {
+		n.coinbasePayouts = NewCoinbasePayouts(n.db, n.shareChain,
+			n.config.GetDuration("CoinbasePayoutRefresh"))
+	}
+	if n.config.GetBool("ProxyProtocol") {
+		n.proxyProtocol, err = NewProxyProtocol(
+			n.config.GetStringSlice("ProxyProtocolTrusted"))
+		if err != nil {
+			log.Crit("Invalid ProxyProtocolTrusted", "err", err)
+			os.Exit(1)
+		}
+	}
+	if kind := n.config.GetString("Export"); kind != "" {
+		var stratumName string
+		if n.service != nil {
+			stratumName = n.service.Name
+		}
+		n.exporter, err = NewExporter(kind,
+			n.config.GetString("ExportURL"),
+			n.config.GetString("ExportShareTopic"),
+			n.config.GetString("ExportBlockTopic"),
+			n.config.GetInt("ExportBuffer"),
+			n.shareChain.Name,
+			stratumName)
+		if err != nil {
+			log.Crit("Invalid export config", "err", err)
+			os.Exit(1)
+		}
+	}
+	if dir := n.config.GetString("BlockArchiveDir"); dir != "" {
+		store, err := blockarchive.NewStore(dir,
+			n.config.GetDuration("BlockArchiveMaxAge"),
+			n.config.GetInt("BlockArchiveMaxBlocks"))
+		if err != nil {
+			log.Crit("Invalid BlockArchiveDir", "dir", dir, "err", err)
+			os.Exit(1)
+		}
+		n.blockArchive = NewBlockArchive(store)
+	}
+	n.ipTracker = NewIPTracker(
+		uint64(n.config.GetInt64("ProtocolErrorBanThreshold")),
+		n.config.GetDuration("ProtocolErrorBanTime"),
+	)
+	var asnDB *ASNDatabase
+	if path := n.config.GetString("ASNDatabase"); path != "" {
+		asnDB, err = LoadASNDatabase(path)
+		if err != nil {
+			log.Crit("Unable to load ASNDatabase", "path", path, "err", err)
+			os.Exit(1)
+		}
+	}
+	n.connLimiter, err = NewConnLimiter(ConnLimits{
+		PerIP:      n.config.GetInt("MaxConnsPerIP"),
+		PerASN:     n.config.GetInt("MaxConnsPerASN"),
+		RatePerIP:  n.config.GetInt("ConnRatePerIP"),
+		RatePerASN: n.config.GetInt("ConnRatePerASN"),
+	}, n.config.GetStringMap("ConnLimitOverrides"), asnDB)
+	if err != nil {
+		log.Crit("Invalid connection limits", "err", err)
+		os.Exit(1)
+	}
+	var peerSessions func() int
+	if n.steering != nil {
+		peerSessions = n.steering.PeerSessions
+	}
+	n.sessionLimiter = NewSessionLimiter(
+		n.config.GetInt("MaxPortSessions"),
+		n.config.GetInt("MaxPoolSessions"),
+		peerSessions,
+	)
+	n.rejectMonitor = NewRejectMonitor(
+		n.config.GetFloat64("AlertRejectRate"),
+		n.config.GetDuration("AlertRejectWindow"),
+		uint64(n.config.GetInt("AlertRejectMinShares")),
+		n.alerts,
 	)
 }
 
 func (n *StratumServer) Start() {
+	// Before any jobs are built, so a window they load isn't replaced
+	n.restoreSnapshot()
+	n.setupHealthChecks()
+	n.validator.Start()
 	go n.listenTemplates()
+	if n.coinbasePayouts != nil {
+		go n.coinbasePayouts.Run()
+	}
+	go n.alerts.WatchEvents(n.events)
+	if n.port.PayoutPrefs != nil {
+		go n.port.PayoutPrefs.Run()
+	}
+	if n.exporter != nil {
+		go n.exporter.Run(n.events.Subscribe(exportBatchSize*2, n.exporter.Topics()...))
+	}
 
-	updates, err := n.service.ServiceWatcher("coinserver")
-	if err != nil {
-		log.Crit("Failed to start coinserver watcher", "err", err)
+	if bind := n.config.GetString("TemplatePushBind"); bind != "" {
+		src := NewHTTPTemplateSource(bind, n.config.GetString("TemplatePushToken"),
+			n.tmplKeys, n.newTemplate)
+		src.Start()
+		n.templateSources = append(n.templateSources, src)
+	}
+
+	if n.service != nil {
+		n.startDiscovery()
+	}
+
+	if err := n.startAdmin(); err != nil {
+		log.Crit("Failed to start admin API", "err", err)
 		os.Exit(1)
 	}
-	go n.HandleCoinserverWatcherUpdates(updates)
-	go n.service.KeepAlive(map[string]string{
-		"endpoint": n.config.GetString("StratumBind"),
-	})
 
 	if n.config.GetBool("EnableCpuminer") {
 		go n.Miner()
 	}
-	go n.ListenMiners()
+	n.ListenMiners()
 	go n.ListenShares()
 	go n.UpdateStatus()
 }
 
+// Finds coinservers and publishes our status through the discovery backend
+func (n *StratumServer) startDiscovery() {
+	updates, err := n.service.ServiceWatcher("coinserver")
+	if err != nil {
+		log.Crit("Failed to start coinserver watcher", "err", err)
+		os.Exit(1)
+	}
+	go n.HandleCoinserverWatcherUpdates(updates)
+	go n.service.WatchCurrencies()
+	publicEndpoint := n.config.GetString("PublicEndpoint")
+	if publicEndpoint == "" {
+		publicEndpoint = n.config.GetString("StratumBind")
+	}
+	labels := map[string]string{
+		"endpoint":        n.config.GetString("StratumBind"),
+		"public_endpoint": publicEndpoint,
+		"region":          n.config.GetString("Region"),
+		"sharechain":      n.shareChain.Name,
+	}
+	if admin := n.config.GetString("AdminEndpoint"); admin != "" {
+		labels["admin"] = admin
+	}
+	go n.service.KeepAlive(labels)
+	if n.steering != nil {
+		peerUpdates, err := n.service.ServiceWatcher("stratum")
+		if err != nil {
+			log.Crit("Failed to start stratum watcher", "err", err)
+			os.Exit(1)
+		}
+		go n.steering.Watch(peerUpdates)
+	}
+	n.setupControl()
+}
+
 func (n *StratumServer) UpdateStatus() {
 	var clients = map[string]*StratumClient{}
 	var ticker = time.NewTicker(time.Second * 1)
+	// A nil channel never fires, so steering is skipped when disabled
+	var steeringTick <-chan time.Time
+	if n.steering != nil && n.config.GetBool("Steering") {
+		steeringTick = time.NewTicker(n.config.GetDuration("SteeringInterval")).C
+	}
 	for {
 		select {
 		case newClient := <-n.newClient:
 			clients[newClient.id] = newClient
+		case query := <-n.clientQuery:
+			query(clients)
+		case <-steeringTick:
+			var candidates []steerable
+			for _, client := range clients {
+				// Only move miners that have logged in, so we know they're
+				// really mining
+				if client.hasShutdown || client.steered || client.username == "" {
+					continue
+				}
+				candidates = append(candidates, steerable{client.id, client.remoteIP})
+			}
+			for clientID, peer := range n.steering.Plan(candidates) {
+				err := clients[clientID].reconnect(peer.Endpoint)
+				if err != nil {
+					log.Warn("Failed to steer client", "peer", peer.ID, "err", err)
+				}
+			}
 		case <-ticker.C:
 			var clientStatuses = []common.StratumClientStatus{}
 			for _, client := range clients {
@@ -209,43 +810,142 @@ func (n *StratumServer) UpdateStatus() {
 				}
 				clientStatuses = append(clientStatuses, client.status())
 			}
-			n.service.PushStatus <- map[string]interface{}{
-				"clients": clientStatuses,
+			n.ipTracker.Prune(time.Hour)
+			now := time.Now()
+			n.connLimiter.Prune(now)
+			n.port.WorkerDiffs.Prune(now)
+			n.hashrate.Prune(n.config.GetDuration("HashrateDecay")*10, now)
+			n.rejectMonitor.Check(loadShareStats(&n.port.Shares), now)
+			status := map[string]interface{}{
+				"clients":      clientStatuses,
+				"protocol_ips": n.ipTracker.Statuses(),
+				"hashrate":     n.hashrate.Status(now),
+				// Coinservers for a currency that disagree on the chain tip
+				"template_divergence": n.templateChecker.Check(now),
+				"chains":              n.chainStats.Status(now),
+				// Sessions disconnected for idling, by reason
+				"reaped": n.port.Idle.Stats(),
+				// Sessions disconnected for not keeping up with writes
+				"slow_consumers": n.port.SlowConsumers.Stats(),
+				"draining":       n.isDraining(),
+				// Connections mining each main chain
+				"lanes": n.port.Lanes.Stats(),
+				// Events slow subscribers missed, by topic
+				"events_dropped": n.events.Dropped(),
+				"export":         n.exporter.Stats(),
+				// Recent blocks and how each coinserver answered them
+				"block_submissions": n.submissions.Status(now),
+				// Connections refused by MaxConnsPerIP and friends
+				"conn_limits":    n.connLimiter.Stats(),
+				"session_limits": n.sessionLimiter.Stats(),
+				"verifiers":      n.verifiers.Stats(),
+				"aux_merkle":     n.auxMerkleStatus(),
+				"ports":          n.listeners.Binds(),
+			}
+			n.lastStatus.Store(status)
+			if n.service == nil {
+				continue
 			}
+			n.service.PushStatus <- status
 		}
 	}
 }
 
+// A share's block_ratio for the database, NULL unless it's within
+// NearTargetFactor of the main chain target
+func (n *StratumServer) nearTarget(blockRatio float64) interface{} {
+	factor := n.config.GetFloat64("NearTargetFactor")
+	if factor <= 0 || blockRatio > factor {
+		return nil
+	}
+	return blockRatio
+}
+
 func (n *StratumServer) ListenShares() {
 	log.Debug("Starting ListenShares")
 	for {
 		share := <-n.newShare
+		if share.flushed != nil {
+			close(share.flushed)
+			continue
+		}
 		log.Debug("Got share", "share", share)
+		for currencyCode, block := range share.blocks {
+			if !n.claimSolve(currencyCode, block) {
+				log.Warn("Block already found by another stratum", "currency", currencyCode,
+					"hash", block.getBlockHash(), "height", block.height)
+				delete(share.blocks, currencyCode)
+			}
+		}
+		n.hashrate.AddShare(share.username, share.worker, share.difficulty, share.time)
+		n.chainStats.AddShare(share.currencies, share.difficulty, share.blocks, share.time)
 
 		// Fire off submissions for all blocks first, before touching SQL
 		for currencyCode, block := range share.blocks {
-			n.blockCast[currencyCode].Submit(block)
+			n.submitBlock(currencyCode, block, share)
+		}
+		n.events.Publish(service.EventShareAccepted, service.ShareEvent{
+			Username:   share.username,
+			Worker:     share.worker,
+			Difficulty: share.difficulty,
+			Currencies: share.currencies,
+			Blocks:     len(share.blocks),
+			MinedAt:    share.time,
+		})
+		for currencyCode, block := range share.blocks {
+			n.events.Publish(service.EventBlockFound, service.BlockEvent{
+				Currency: currencyCode,
+				Height:   block.height,
+				Hash:     block.getBlockHash(),
+				Subsidy:  block.subsidy,
+				PowAlgo:  block.powalgo,
+				MinedBy:  share.username,
+				MinedAt:  share.time,
+			})
+		}
+		if n.db == nil {
+			log.Info("Share accepted", "username", share.username,
+				"worker", share.worker, "difficulty", share.difficulty,
+				"blocks", len(share.blocks))
+			continue
 		}
 
 		// Insert a block and UTXO (the coinbase) for each solve
 		for currencyCode, block := range share.blocks {
-			_, err := n.db.Exec(
-				`INSERT INTO utxo (hash, vout, amount, currency, address)
-				VALUES ($1, $2, $3, $4, $5)`,
-				hex.EncodeToString(block.coinbaseHash),
-				0, // Coinbase UTXO is always first and only UTXO
-				block.subsidy,
-				currencyCode,
-				block.subsidyAddress)
-			if err != nil {
-				log.Error("Failed to save block UTXO", "err", err)
+			// The node built createauxblock blocks, we don't know their
+			// coinbase
+			if block.coinbaseHash != nil {
+				_, err := n.db.Exec(
+					`INSERT INTO utxo (hash, vout, amount, currency, address)
+					VALUES ($1, $2, $3, $4, $5)`,
+					hex.EncodeToString(block.coinbaseHash),
+					0, // Our coinbase UTXO is always the first output
+					block.subsidy,
+					currencyCode,
+					block.subsidyAddress)
+				if err != nil {
+					log.Error("Failed to save block UTXO", "err", err)
+				}
 			}
 
-			_, err = n.db.Exec(
+			// createauxblock solves are only the AuxPoW, the node has the
+			// block and its transactions
+			var (
+				fees    *int64
+				txCount *int
+				size    *int
+			)
+			if block.auxBlockHash == "" {
+				dataLen := len(block.data)
+				fees, txCount, size = &block.reward.fees, &block.reward.txCount, &dataLen
+			}
+			_, err := n.db.Exec(
 				`INSERT INTO block
 				(height, currency, powalgo, hash, powhash, subsidy, mined_at,
-					mined_by, target, coinbase_hash)
-				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+					mined_by, target, coinbase_hash, sharechain, fees,
+					base_subsidy, tx_count, size)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12,
+					$13, $14, $15)`,
 				block.height,
 				currencyCode,
 				block.powalgo,
@@ -255,8 +955,30 @@ func (n *StratumServer) ListenShares() {
 				share.time,
 				share.username,
 				block.target.String(),
-				hex.EncodeToString(block.coinbaseHash))
-
+				hex.EncodeToString(block.coinbaseHash),
+				n.shareChain.Name,
+				fees,
+				block.reward.baseSubsidy,
+				txCount,
+				size)
+			if err != nil {
+				log.Error("Failed to save block", "err", err)
+			}
+			// ngweb credits the payees that weren't paid directly from
+			// these, the rest are for the record
+			for _, p := range block.payees {
+				var address *string
+				if p.Address != "" {
+					address = &p.Address
+				}
+				_, err = n.db.Exec(
+					`INSERT INTO coinbase_payout (blockhash, user_id, amount, address)
+					VALUES ($1, $2, $3, $4)`,
+					block.getBlockHash(), p.UserID, p.Amount, address)
+				if err != nil {
+					log.Error("Failed to save coinbase payout", "err", err)
+				}
+			}
 		}
 		mt := share.time.Truncate(time.Minute)
 		psql := sq.StatementBuilder.PlaceholderFormat(sq.Dollar)
@@ -267,8 +989,10 @@ func (n *StratumServer) ListenShares() {
 			Suffix(`ON CONFLICT (cat, key, minute) DO UPDATE SET
 				difficulty = minute_share.difficulty + ?,
 				shares = minute_share.shares + 1`, share.difficulty)
-		for _, tmpl := range n.tmplKeys {
-			base = base.Values(mt, "currency", tmpl.Currency, share.difficulty, 1, n.shareChain.Name, n.service.Name)
+		// The job's currencies rather than our config, since aux chains can
+		// come and go
+		for _, currency := range share.currencies {
+			base = base.Values(mt, "currency", currency, share.difficulty, 1, n.shareChain.Name, n.service.Name)
 		}
 		qstring, args, err := base.ToSql()
 		_, err = n.db.Exec(qstring, args...)
@@ -278,13 +1002,17 @@ func (n *StratumServer) ListenShares() {
 
 		// Log the users share
 		_, err = n.db.Exec(
-			`INSERT INTO share (username, difficulty, mined_at, sharechain, currencies)
-			VALUES ($1, $2, $3, $4, $5)`,
+			`INSERT INTO share (username, worker, difficulty, mined_at, sharechain, currencies,
+				payout_weights, block_ratio)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
 			share.username,
+			share.worker,
 			share.difficulty,
 			share.time,
 			n.shareChain.Name,
-			pq.StringArray(share.currencies))
+			pq.StringArray(share.currencies),
+			payoutWeightsValue(share.payoutWeights),
+			n.nearTarget(share.blockRatio))
 		if err != nil {
 			log.Error("Failed to save share", "err", err)
 		}
@@ -296,32 +1024,97 @@ func (n *StratumServer) listenTemplates() {
 	// When new templates are available a new job is created and broadcasted
 	// over jobBroadcast
 	latestTemp := map[TemplateKey][]byte{}
-	var lastJobFlush interface{}
+	lanes := n.port.Lanes
 	for {
-		newTemplate := <-n.newTemplate
-		log.Info("Got new template", "key", newTemplate.key)
-		latestTemp[newTemplate.key] = newTemplate.data
-		job, err := NewJobFromTemplates(latestTemp, n.shareChain.Algo)
-		ignore, lastJobFlush := job.SetFlush(lastJobFlush)
-		if err != nil {
-			log.Error("Error generating job", "err", err)
-			continue
+		var changed TemplateKey
+		select {
+		case newTemplate := <-n.newTemplate:
+			log.Info("Got new template", "key", newTemplate.key)
+			latestTemp[newTemplate.key] = newTemplate.data
+			n.templateChecker.Record(newTemplate.key.Currency, newTemplate.source,
+				newTemplate.data, time.Now())
+			changed = newTemplate.key
+		case key := <-n.removeTemplate:
+			// The last coinserver for an aux chain went away. Keep mining the
+			// others, the new job won't flush since no heights went up
+			if _, ok := latestTemp[key]; !ok {
+				continue
+			}
+			log.Info("Removing aux chain from jobs", "key", key)
+			delete(latestTemp, key)
+			changed = key
 		}
-		if ignore {
-			log.Info("Ignoring stale job")
-			continue
+		for _, lane := range lanes.lanesFor(changed) {
+			// Aux templates can arrive before the lane's main chain has one
+			if _, ok := latestTemp[lane.key]; !ok {
+				continue
+			}
+			n.pushJob(lane, lane.templates(latestTemp))
+		}
+	}
+}
+
+// Builds and broadcasts a new job for one lane
+func (n *StratumServer) pushJob(lane *MainChainLane, templates map[TemplateKey][]byte) {
+	job, err := NewJobFromTemplates(templates, n.verifiers.Algo(n.shareChain.Algo),
+		n.coinbasePayouts)
+	if err != nil {
+		log.Error("Error generating job", "err", err)
+		return
+	}
+	if n.config.GetBool("JobDryRun") {
+		err = job.DryRun()
+		if err != nil {
+			log.Error("Refusing to broadcast broken job", "err", err)
+			return
 		}
-		n.lastJobMtx.Lock()
-		n.lastJob = job
-		n.lastJobMtx.Unlock()
-		n.jobCast.Submit(job)
-		log.Info("New job pushed", "lastJobFlush", lastJobFlush)
+	}
+	var ignore bool
+	ignore, lane.lastJobFlush = job.SetFlush(lane.lastJobFlush, n.cleanJobs)
+	now := time.Now()
+	n.chainStats.SetActive(job.currencyConfig.Code, job.heights, now)
+	if ignore {
+		log.Info("Ignoring stale job")
+		return
+	}
+	job.cleanJobs = n.cleanJobs.throttle(job, lane.lastCleanAt, now)
+	if job.cleanJobs {
+		lane.lastCleanAt = now
+	}
+	n.lastJobMtx.Lock()
+	n.lastJob = job
+	n.lastJobAt = time.Now()
+	n.lastJobMtx.Unlock()
+	n.port.Lanes.setHasJob(lane)
+	lane.jobCast.Submit(job)
+	n.events.Publish(service.EventJobNew, service.JobEvent{
+		Currency: lane.key.Currency,
+		Heights:  job.heights,
+		Flush:    job.cleanJobs,
+	})
+	log.Info("New job pushed", "currency", lane.key.Currency,
+		"lastJobFlush", lane.lastJobFlush)
+	if len(job.auxChains) > 0 {
+		log.Debug("Aux merkle tree", "size", job.auxMerkle.Size,
+			"nonce", job.auxMerkle.Nonce, "slots", job.auxMerkle.Slots)
 	}
 }
 
+// Merge mining tree of the latest job, to check against what aux daemons
+// expect. Nil before the first job
+func (n *StratumServer) auxMerkleStatus() *AuxMerkleParams {
+	n.lastJobMtx.Lock()
+	defer n.lastJobMtx.Unlock()
+	if n.lastJob == nil {
+		return nil
+	}
+	return n.lastJob.auxMerkle
+}
+
 func (n *StratumServer) Miner() {
 	listener := make(chan interface{})
-	n.jobCast.Register(listener)
+	// The CPU miner only mines the first main chain
+	n.port.Lanes.lanes[0].jobCast.Register(listener)
 	jobLock := sync.Mutex{}
 	var job *Job
 
@@ -362,12 +1155,12 @@ func (n *StratumServer) Miner() {
 			var nonce = make([]byte, 4)
 			binary.BigEndian.PutUint32(nonce, i)
 
-			solves, _, _, err := job.CheckSolves(nonce, extraNonceMagic, nil)
+			solves, _, _, _, err := job.CheckSolves(nonce, extraNonceMagic, nil, nil)
 			if err != nil {
 				log.Warn("Failed to check solves for job", "err", err)
 			}
 			for currencyCode, block := range solves {
-				n.blockCast[currencyCode].Submit(block)
+				n.submitBlock(currencyCode, block, nil)
 			}
 			if len(solves) > 0 {
 				time.Sleep(time.Second * 10)
@@ -379,18 +1172,35 @@ func (n *StratumServer) Miner() {
 }
 
 func (n *StratumServer) Stop() {
+	for _, src := range n.templateSources {
+		src.Stop()
+	}
+	if err := n.saveSnapshot(); err != nil {
+		log.Error("Failed to save round snapshot", "err", err)
+	}
 }
 
+// How often CoinserverWatchers check the coinserver is reachable
+const coinserverPingInterval = time.Second * 30
+
+// CoinserverWatcher is a TemplateSource for a single coinbuddy, and also
+// handles submitting solved blocks to it
 type CoinserverWatcher struct {
 	id          string
 	tmplKey     TemplateKey
 	endpoint    string
 	status      string
+	submitOnly  bool
 	newTemplate chan *Template
 	blockCast   broadcast.Broadcaster
 	wg          sync.WaitGroup
 	shutdown    chan interface{}
 	log         log.Logger
+	// Beats each time coinbuddy's RPC proxy answers
+	rpcHealth   *service.Heartbeat
+	submissions *SubmitTracker
+	// Nil unless BlockArchiveDir is set
+	archive *BlockArchive
 }
 
 func (cw *CoinserverWatcher) Stop() {
@@ -405,10 +1215,12 @@ func (cw *CoinserverWatcher) Stop() {
 }
 
 func (cw *CoinserverWatcher) Start() {
-	cw.log = log.New("coin", cw.tmplKey.Currency, "id", cw.id)
+	cw.log = logging.New("coinserver", "coin", cw.tmplKey.Currency, "id", cw.id)
 	cw.wg = sync.WaitGroup{}
 	cw.shutdown = make(chan interface{})
-	go cw.RunTemplateBroadcaster()
+	if !cw.submitOnly {
+		go cw.RunTemplateBroadcaster()
+	}
 	go cw.RunBlockCastListener()
 }
 
@@ -416,17 +1228,7 @@ func (cw *CoinserverWatcher) RunBlockCastListener() {
 	cw.wg.Add(1)
 	defer cw.wg.Done()
 
-	connCfg := &rpcclient.ConnConfig{
-		Host:         cw.endpoint[7:] + "rpc",
-		User:         "",
-		Pass:         "",
-		HTTPPostMode: true, // Bitcoin core only supports HTTP POST mode
-		DisableTLS:   true, // Bitcoin core does not provide TLS by default
-	}
-	client, err := rpcclient.New(connCfg, nil)
-	if err != nil {
-		panic(err)
-	}
+	client := rpcclient.New(rpcclient.Config{URL: cw.endpoint + "rpc"})
 
 	listener := make(chan interface{})
 	cw.blockCast.Register(listener)
@@ -435,31 +1237,50 @@ func (cw *CoinserverWatcher) RunBlockCastListener() {
 		cw.blockCast.Unregister(listener)
 		close(listener)
 	}()
+	// Make sure we could submit a block if we found one. The ping runs in
+	// its own goroutine so a hung coinserver doesn't hold up submission
+	ping := func() {
+		_, err := client.GetBlockCount()
+		cw.rpcHealth.Mark(err, time.Now())
+	}
+	go ping()
+	pingTicker := time.NewTicker(coinserverPingInterval)
+	defer pingTicker.Stop()
 	for {
 		select {
 		case <-cw.shutdown:
 			return
+		case <-pingTicker.C:
+			go ping()
 		case msg := <-listener:
-			newBlock := msg.(*BlockSolve)
-			if err != nil {
-				cw.log.Error("Invalid type recieved from blockCast", "err", err)
+			newBlock, ok := msg.(*BlockSolve)
+			if !ok {
+				cw.log.Error("Invalid type recieved from blockCast", "msg", msg)
 				continue
 			}
-			hexString := hex.EncodeToString(newBlock.data)
-			encodedBlock, err := json.Marshal(hexString)
-			if err != nil {
-				cw.log.Error("Failed to json marshal a string", "err", err)
+			if newBlock.submitTo != nil && !newBlock.submitTo[cw.id] {
 				continue
 			}
-			params := []json.RawMessage{
-				encodedBlock,
-				[]byte{'[', ']'},
+			var reason string
+			var err error
+			if newBlock.auxBlockHash != "" {
+				reason, err = client.SubmitAuxBlock(newBlock.auxBlockHash, newBlock.data)
+			} else {
+				reason, err = client.SubmitBlock(newBlock.data)
+			}
+			now := time.Now()
+			cw.submissions.Result(cw.tmplKey.Currency, newBlock.getBlockHash(),
+				cw.id, reason, err, now)
+			if cw.archive != nil {
+				cw.archive.Result(cw.tmplKey.Currency, newBlock.getBlockHash(),
+					cw.id, reason, err, now)
 			}
-			res, err := client.RawRequest("submitblock", params)
 			if err != nil {
 				cw.log.Info("Error submitting block", "err", err)
+			} else if reason != "" {
+				cw.log.Warn("Block rejected", "reason", reason, "height", newBlock.height)
 			} else {
-				cw.log.Info("Submitted block", "result", string(res), "height", newBlock.height)
+				cw.log.Info("Submitted block", "height", newBlock.height)
 			}
 		}
 	}
@@ -468,7 +1289,7 @@ func (cw *CoinserverWatcher) RunBlockCastListener() {
 func (cw *CoinserverWatcher) RunTemplateBroadcaster() {
 	cw.wg.Add(1)
 	defer cw.wg.Done()
-	logger := log.New("id", cw.id, "tmplKey", cw.tmplKey)
+	logger := logging.New("coinserver", "id", cw.id, "tmplKey", cw.tmplKey)
 	client := &sse.Client{
 		URL:        cw.endpoint + "blocks",
 		Connection: &http.Client{},
@@ -518,8 +1339,9 @@ func (cw *CoinserverWatcher) RunTemplateBroadcaster() {
 					lastEvent.Data = decoded
 					logger.Debug("Got new template", "data", string(decoded))
 					cw.newTemplate <- &Template{
-						data: lastEvent.Data,
-						key:  cw.tmplKey,
+						data:   lastEvent.Data,
+						key:    cw.tmplKey,
+						source: cw.id,
 					}
 					if cw.status != "live" {
 						logger.Info("CoinserverWatcher is now LIVE")
@@ -531,30 +1353,19 @@ func (cw *CoinserverWatcher) RunTemplateBroadcaster() {
 	}
 }
 
+// Binds StratumBind and Ports. Connections are accepted in the background
 func (n *StratumServer) ListenMiners() {
-	endpoint := n.config.GetString("StratumBind")
-	listener, err := net.Listen("tcp", endpoint)
+	err := n.reconcilePorts(n.config)
+	n.listenerHealth.Mark(err, time.Now())
 	if err != nil {
 		log.Crit("Failed to listen stratum", "err", err)
 		os.Exit(1)
 	}
-	log.Info("Listening stratum", "endpoint", endpoint)
-	defer listener.Close()
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Warn("Failed to accept connection", "err", err)
-			continue
-		}
-		client := NewClient(conn, n.jobCast, n.newShare, n.vardiff)
-		client.Start()
-		n.newClient <- client
-	}
 }
 
 func (n *StratumServer) HandleCoinserverWatcherUpdates(
 	updates chan service.ServiceStatusUpdate) {
-	coinserverWatchers := map[string]*CoinserverWatcher{}
+	coinserverWatchers := n.coinserverWatchers
 	log.Info("Listening for new coinserver services")
 	for {
 		update := <-updates
@@ -563,6 +1374,23 @@ func (n *StratumServer) HandleCoinserverWatcherUpdates(
 			if csw, ok := coinserverWatchers[update.ServiceID]; ok {
 				log.Info("Coinserver shutdown", "id", update.ServiceID)
 				go csw.Stop()
+				n.coinserverMtx.Lock()
+				delete(coinserverWatchers, update.ServiceID)
+				n.coinserverMtx.Unlock()
+				n.templateChecker.Remove(update.ServiceID)
+				if !csw.tmplKey.IsAux() {
+					continue
+				}
+				remaining := false
+				for _, other := range coinserverWatchers {
+					if other.tmplKey == csw.tmplKey {
+						remaining = true
+						break
+					}
+				}
+				if !remaining {
+					n.removeTemplate <- csw.tmplKey
+				}
 			}
 		case "updated":
 			log.Debug("Coinserver status update", "id", update.ServiceID, "new_status", update.Status)
@@ -584,6 +1412,10 @@ func (n *StratumServer) HandleCoinserverWatcherUpdates(
 					break
 				}
 			}
+			if !found && n.acceptDynamicAux(tmplKey) {
+				log.Info("Adding dynamic aux chain", "id", update.ServiceID, "key", tmplKey)
+				found = true
+			}
 			if !found {
 				log.Debug("Ignoring coinserver", "id", update.ServiceID, "key", tmplKey)
 				continue
@@ -593,7 +1425,9 @@ func (n *StratumServer) HandleCoinserverWatcherUpdates(
 			// blockCast and pushes new templates to newTemplate channel
 			cw := n.NewCoinserverWatcher(
 				labels["endpoint"], update.ServiceID, tmplKey)
+			n.coinserverMtx.Lock()
 			coinserverWatchers[update.ServiceID] = cw
+			n.coinserverMtx.Unlock()
 			cw.Start()
 			log.Debug("New coinserver detected", "id", update.ServiceID, "tmplKey", tmplKey)
 		default:
@@ -602,20 +1436,94 @@ func (n *StratumServer) HandleCoinserverWatcherUpdates(
 	}
 }
 
+// Whether a coinserver not in our config can be merge mined
+func (n *StratumServer) acceptDynamicAux(tmplKey TemplateKey) bool {
+	if !n.config.GetBool("DynamicAux") || !tmplKey.IsAux() {
+		return false
+	}
+	if tmplKey.Algo != n.shareChain.AlgoName {
+		return false
+	}
+	if _, ok := service.Currency(tmplKey.Currency); !ok {
+		return false
+	}
+	// The currency set was claimed at startup, this one needs our prefix too
+	if n.extranonceClaim != nil {
+		ok, err := n.extranonceClaim.Add(tmplKey.Currency)
+		if err != nil || !ok {
+			log.Warn("Not merge mining, extranonce prefix is held by another stratum",
+				"currency", tmplKey.Currency, "err", err)
+			return false
+		}
+	}
+	return true
+}
+
 func (n *StratumServer) NewCoinserverWatcher(endpoint string, name string,
 	tmplKey TemplateKey) *CoinserverWatcher {
 	blockCast := n.getBlockCast(tmplKey.Currency)
 	cw := &CoinserverWatcher{
 		endpoint:    endpoint,
 		status:      "starting",
+		submitOnly:  !n.config.GetBool("CoinserverTemplates"),
 		newTemplate: n.newTemplate,
 		blockCast:   blockCast,
 		id:          name,
 		tmplKey:     tmplKey,
+		rpcHealth:   service.NewHeartbeat("coinserver RPC call"),
+		submissions: n.submissions,
+		archive:     n.blockArchive,
 	}
 	return cw
 }
 
+// Coinservers of a currency that have answered RPC recently. If none have
+// we still try them all, a node might have come back since the last ping
+func (n *StratumServer) submitTargets(currency string, now time.Time) map[string]bool {
+	n.coinserverMtx.Lock()
+	defer n.coinserverMtx.Unlock()
+	healthy := map[string]bool{}
+	all := map[string]bool{}
+	for id, cw := range n.coinserverWatchers {
+		if cw.tmplKey.Currency != currency {
+			continue
+		}
+		all[id] = true
+		if cw.rpcHealth.Check(coinserverPingInterval*3, now) == nil {
+			healthy[id] = true
+		}
+	}
+	if len(healthy) == 0 {
+		if len(all) > 0 {
+			log.Warn("No healthy coinservers to submit block to, trying all",
+				"currency", currency)
+		}
+		return all
+	}
+	return healthy
+}
+
+// Submits a solved block to every healthy coinserver of its currency at
+// once, rather than only the one its template came from, so it propagates
+// from several places and is less likely to be orphaned
+// share is nil for blocks from the CPU miner
+func (n *StratumServer) submitBlock(currency string, block *BlockSolve, share *Share) {
+	now := time.Now()
+	// Standalone there's no coinservers, the mock source takes every block
+	if n.service != nil {
+		block.submitTo = n.submitTargets(currency, now)
+		sources := make([]string, 0, len(block.submitTo))
+		for id := range block.submitTo {
+			sources = append(sources, id)
+		}
+		n.submissions.Start(currency, block.getBlockHash(), block.height, sources, now)
+	}
+	if n.blockArchive != nil {
+		n.blockArchive.Add(currency, block, share, now)
+	}
+	n.getBlockCast(currency).Submit(block)
+}
+
 func (n *StratumServer) getBlockCast(key string) broadcast.Broadcaster {
 	n.blockCastMtx.Lock()
 	if _, ok := n.blockCast[key]; !ok {
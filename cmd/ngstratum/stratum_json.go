@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/hex"
+	"github.com/mitchellh/mapstructure"
 	"github.com/pkg/errors"
 )
 
@@ -18,6 +19,10 @@ const (
 	StratumErrorLowDiff   = 23
 	StratumErrorUnauth    = 24
 	StratumErrorNotSubbed = 25
+	// Only sent to JSON-RPC 2.0 miners, whose submits include the hash
+	StratumErrorBadResult = 26
+	// Rolled version bits outside the negotiated mask
+	StratumErrorBadVersion = 27
 )
 
 var stratumErrors = map[int]*StratumError{
@@ -27,6 +32,8 @@ var stratumErrors = map[int]*StratumError{
 	23: &StratumError{Code: 23, Desc: "Low difficulty share", TB: nil},
 	24: &StratumError{Code: 24, Desc: "Unauthorized worker", TB: nil},
 	25: &StratumError{Code: 25, Desc: "Not subscribed", TB: nil},
+	26: &StratumError{Code: 26, Desc: "Invalid result hash", TB: nil},
+	27: &StratumError{Code: 27, Desc: "Invalid version bits", TB: nil},
 }
 
 type StratumResponse struct {
@@ -89,6 +96,10 @@ type MiningSubmit struct {
 	Extranonce2 []byte
 	Time        []byte
 	Nonce       []byte
+	// The hash JSON-RPC 2.0 miners send with their nonce
+	Result []byte
+	// Big endian, only sent by miners rolling the version (BIP310)
+	VersionBits []byte
 
 	// Hacky, but we put the StratumMessage ID on here for easy replying from
 	// different goroutine. Now our channel reciever doesn't have to make type
@@ -98,7 +109,8 @@ type MiningSubmit struct {
 
 func (m *MiningSubmit) GetKey() string {
 	// Generates a unique string for identifying duplicate shares
-	return m.JobID + string(m.Extranonce2) + string(m.Time) + string(m.Nonce)
+	return m.JobID + string(m.Extranonce2) + string(m.Time) + string(m.Nonce) +
+		string(m.VersionBits)
 }
 
 func DecodeMiningSubmit(raw interface{}) (*MiningSubmit, error) {
@@ -107,8 +119,9 @@ func DecodeMiningSubmit(raw interface{}) (*MiningSubmit, error) {
 		return nil, errors.New("Non array passed")
 	}
 	ma := MiningSubmit{}
-	if len(params) != 5 {
-		return nil, errors.New("Submit must have 5 fields")
+	// The sixth is version bits, from miners using version rolling
+	if len(params) != 5 && len(params) != 6 {
+		return nil, errors.New("Submit must have 5 or 6 fields")
 	}
 	if username, ok := params[0].(string); ok {
 		ma.Username = username
@@ -137,6 +150,20 @@ func DecodeMiningSubmit(raw interface{}) (*MiningSubmit, error) {
 		}
 		ma.Nonce = out
 	}
+	if len(params) == 6 {
+		versionBits, ok := params[5].(string)
+		if !ok {
+			return nil, errors.New("Version bits must be a string")
+		}
+		out, err := hex.DecodeString(versionBits)
+		if err != nil {
+			return nil, err
+		}
+		if len(out) != 4 {
+			return nil, errors.New("Version bits must be 4 bytes")
+		}
+		ma.VersionBits = out
+	}
 	return &ma, nil
 }
 
@@ -161,6 +188,18 @@ type Login struct {
 	Agent string
 }
 
+// JSON RPC 2.0 errors are an object rather than an array
+type Stratum2Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Params for getjob and keepalived, which only carry the session id we gave
+// out at login
+type Stratum2Session struct {
+	ID string
+}
+
 // {"id": "52fdfc07", "job_id": "2182654f", "nonce": "21000000", "result": "726b7baca682d535a540c65d84ed74385014d3a5f404828eedeb656c0b7b2053"}
 type MiningSubmit2 struct {
 	ID     string
@@ -168,3 +207,25 @@ type MiningSubmit2 struct {
 	Nonce  string
 	Result string
 }
+
+// The session id is checked separately, see checkSession
+func DecodeMiningSubmit2(raw interface{}) (*MiningSubmit, error) {
+	var ms2 MiningSubmit2
+	err := mapstructure.Decode(raw, &ms2)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hex.DecodeString(ms2.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	result, err := hex.DecodeString(ms2.Result)
+	if err != nil {
+		return nil, err
+	}
+	return &MiningSubmit{
+		JobID:  ms2.JobID,
+		Nonce:  nonce,
+		Result: result,
+	}, nil
+}
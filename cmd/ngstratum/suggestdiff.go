@@ -0,0 +1,91 @@
+package main
+
+import (
+	"math/big"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+
+	"github.com/icook/ngpool/pkg/service"
+)
+
+// mining.suggest_difficulty's params, [difficulty]
+func decodeSuggestDifficulty(raw interface{}) (float64, error) {
+	params, ok := raw.([]interface{})
+	if !ok || len(params) < 1 {
+		return 0, errors.New("Suggest difficulty must have a difficulty")
+	}
+	diff, ok := params[0].(float64)
+	if !ok || diff <= 0 {
+		return 0, errors.New("Invalid suggested difficulty")
+	}
+	return diff, nil
+}
+
+// mining.suggest_target's params, [target] with the target in hex like
+// mining.set_target's, converted to a difficulty of algo
+func decodeSuggestTarget(raw interface{}, algo *service.Algo) (float64, error) {
+	params, ok := raw.([]interface{})
+	if !ok || len(params) < 1 {
+		return 0, errors.New("Suggest target must have a target")
+	}
+	hexTarget, ok := params[0].(string)
+	if !ok {
+		return 0, errors.New("Invalid suggested target")
+	}
+	target, ok := new(big.Int).SetString(strings.TrimPrefix(hexTarget, "0x"), 16)
+	if !ok || target.Sign() <= 0 {
+		return 0, errors.New("Invalid suggested target")
+	}
+	return algo.ShareDifficulty(target), nil
+}
+
+// Handles mining.suggest_difficulty and mining.suggest_target. Before
+// authorizing the suggestion is where vardiff starts, after it's applied
+// right away. Either way vardiff carries on from it, and it's kept within
+// VardiffMin and VardiffMax. Returns false if the connection should close
+func (c *StratumClient) suggestDiff(msg *StratumMessage) bool {
+	var (
+		diff float64
+		err  error
+	)
+	if msg.Method == "mining.suggest_target" {
+		algo, ok := service.AlgoConfig[c.lane.key.Algo]
+		if !ok {
+			err = errors.Errorf("No algo %s", c.lane.key.Algo)
+		} else {
+			diff, err = decodeSuggestTarget(msg.Params, algo)
+		}
+	} else {
+		diff, err = decodeSuggestDifficulty(msg.Params)
+		diff = c.poolDiff(diff)
+	}
+	if err != nil {
+		c.log.Info("Invalid difficulty suggestion", "method", msg.Method, "err", err)
+		c.sendError(msg.ID, StratumErrorOther)
+		c.protocolError(ProtocolParseError)
+		return true
+	}
+	err = c.send(&StratumResponse{
+		ID:     msg.ID,
+		Result: c.port.SuggestDiff,
+	})
+	if err != nil {
+		c.log.Error("Failed write response", "err", err)
+		return false
+	}
+	if !c.port.SuggestDiff {
+		return true
+	}
+	if atomic.LoadInt64(&c.authorizedAt) == 0 {
+		c.suggestedDiff = diff
+		return true
+	}
+	select {
+	case c.diffRequest <- diffRequest{diff: diff, suggested: true}:
+	case <-c.shutdown:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/icook/ngpool/pkg/service"
+)
+
+func TestDecodeSuggestDifficulty(t *testing.T) {
+	diff, err := decodeSuggestDifficulty([]interface{}{1024.0})
+	assert.NoError(t, err)
+	assert.Equal(t, 1024.0, diff)
+
+	for _, params := range []interface{}{
+		[]interface{}{},
+		[]interface{}{"1024"},
+		[]interface{}{-1.0},
+		map[string]interface{}{},
+	} {
+		_, err := decodeSuggestDifficulty(params)
+		assert.Error(t, err)
+	}
+}
+
+func TestDecodeSuggestTarget(t *testing.T) {
+	algo := service.AlgoConfig["sha256d"]
+	target := algo.ShareTarget(512)
+	diff, err := decodeSuggestTarget([]interface{}{target.Text(16)}, algo)
+	assert.NoError(t, err)
+	assert.InEpsilon(t, 512.0, diff, 0.0001)
+
+	for _, params := range []interface{}{
+		[]interface{}{},
+		[]interface{}{"zz"},
+		[]interface{}{"0"},
+		[]interface{}{512.0},
+	} {
+		_, err := decodeSuggestTarget(params, algo)
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+
+	log "github.com/inconshreveable/log15"
+
+	"github.com/icook/ngpool/pkg/logging"
+)
+
+// A TemplateSource acquires block templates for one or more TemplateKeys and
+// pushes them onto the StratumServer's newTemplate channel, where they are fed
+// into NewJobFromTemplates. CoinserverWatcher is the default implementation,
+// pulling from coinbuddy over SSE
+type TemplateSource interface {
+	Start()
+	Stop()
+}
+
+// Templates are a few MB at most, even for chains with huge blocks
+const maxPushTemplateSize = 32 * 1024 * 1024
+
+// HTTPTemplateSource accepts templates POSTed by an external block template
+// generator. The body is a getblocktemplate style JSON object (including
+// "extras" for aux templates, as coinbuddy would provide), and the template
+// key is given by query params, ie:
+//
+//	POST /template?currency=LTC_T&algo=scrypt&template_type=getblocktemplate
+type HTTPTemplateSource struct {
+	bind        string
+	token       string
+	tmplKeys    []TemplateKey
+	newTemplate chan *Template
+	server      *http.Server
+	log         log.Logger
+}
+
+func NewHTTPTemplateSource(bind string, token string, tmplKeys []TemplateKey,
+	newTemplate chan *Template) *HTTPTemplateSource {
+	return &HTTPTemplateSource{
+		bind:        bind,
+		token:       token,
+		tmplKeys:    tmplKeys,
+		newTemplate: newTemplate,
+		log:         logging.New("templates", "template_source", "http", "bind", bind),
+	}
+}
+
+func (h *HTTPTemplateSource) Start() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/template", h.handlePush)
+	h.server = &http.Server{
+		Addr:    h.bind,
+		Handler: mux,
+	}
+	go func() {
+		err := h.server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			h.log.Error("Template push listener failed", "err", err)
+		}
+	}()
+	h.log.Info("Listening for pushed templates")
+}
+
+func (h *HTTPTemplateSource) Stop() {
+	if h.server == nil {
+		return
+	}
+	h.server.Close()
+}
+
+func (h *HTTPTemplateSource) handlePush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	// Compared in constant time so the token can't be guessed byte by byte
+	if h.token != "" && subtle.ConstantTimeCompare(
+		[]byte(r.Header.Get("Authorization")), []byte("Bearer "+h.token)) != 1 {
+		http.Error(w, "invalid token", http.StatusForbidden)
+		return
+	}
+	query := r.URL.Query()
+	tmplKey := TemplateKey{
+		Currency:     query.Get("currency"),
+		Algo:         query.Get("algo"),
+		TemplateType: query.Get("template_type"),
+	}
+	found := false
+	for _, key := range h.tmplKeys {
+		if key == tmplKey {
+			found = true
+			break
+		}
+	}
+	if !found {
+		http.Error(w, "template key not used by this stratum", http.StatusNotFound)
+		return
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxPushTemplateSize))
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+	// Catch garbage here so the pusher gets an error, instead of it only
+	// showing up in the job generation logs
+	var tmpl BlockTemplate
+	err = json.Unmarshal(data, &tmpl)
+	if err != nil {
+		http.Error(w, "invalid template: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.log.Debug("Got pushed template", "key", tmplKey, "height", tmpl.Height)
+	// Each pushing host is treated as its own coinserver for cross checking
+	source, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		source = r.RemoteAddr
+	}
+	h.newTemplate <- &Template{
+		data:   data,
+		key:    tmplKey,
+		source: "push:" + source,
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
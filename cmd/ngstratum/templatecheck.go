@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// The parts of a template that every healthy coinserver for a currency should
+// agree on
+type templateSummary struct {
+	Height            int64     `json:"height"`
+	PreviousBlockhash string    `json:"previousblockhash"`
+	CoinbaseValue     int64     `json:"coinbasevalue"`
+	ReceivedAt        time.Time `json:"received_at"`
+}
+
+// Reported in our status while coinservers for a currency disagree
+type TemplateDivergence struct {
+	Currency string                      `json:"currency"`
+	Since    time.Time                   `json:"since"`
+	Reason   string                      `json:"reason"`
+	Sources  map[string]*templateSummary `json:"sources"`
+}
+
+// Compares the latest template from each coinserver of a currency. Coinservers
+// briefly disagree every time a block is found, so a divergence is only
+// reported once it's lasted longer than grace. A node that's forked or stuck
+// will stay on the wrong height or prevhash and get flagged, before we've
+// spent long mining on its chain
+type TemplateChecker struct {
+	grace time.Duration
+	// Largest allowed coinbase value difference as a fraction, since
+	// coinservers with different mempools will collect different fees
+	valueTolerance float64
+
+	// Keyed by currency, then the coinserver the template came from
+	latest map[string]map[string]*templateSummary
+	// When each currency started disagreeing
+	since map[string]time.Time
+	// Currencies we've already logged an alert for
+	alerted map[string]bool
+	mtx     sync.Mutex
+}
+
+func NewTemplateChecker(grace time.Duration, valueTolerance float64) *TemplateChecker {
+	return &TemplateChecker{
+		grace:          grace,
+		valueTolerance: valueTolerance,
+		latest:         map[string]map[string]*templateSummary{},
+		since:          map[string]time.Time{},
+		alerted:        map[string]bool{},
+	}
+}
+
+func (t *TemplateChecker) Record(currency string, source string, data []byte, now time.Time) {
+	var summary templateSummary
+	err := json.Unmarshal(data, &summary)
+	if err != nil {
+		// Job generation will complain about this template
+		return
+	}
+	summary.ReceivedAt = now
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if _, ok := t.latest[currency]; !ok {
+		t.latest[currency] = map[string]*templateSummary{}
+	}
+	t.latest[currency][source] = &summary
+}
+
+// Forget a coinserver that's gone away
+func (t *TemplateChecker) Remove(source string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	for _, sources := range t.latest {
+		delete(sources, source)
+	}
+}
+
+// Returns why the templates disagree, or "" if they agree
+func (t *TemplateChecker) compare(sources map[string]*templateSummary) string {
+	var first *templateSummary
+	for _, summary := range sources {
+		if first == nil {
+			first = summary
+			continue
+		}
+		if summary.Height != first.Height {
+			return "height"
+		}
+		if summary.PreviousBlockhash != first.PreviousBlockhash {
+			return "previousblockhash"
+		}
+		diff := summary.CoinbaseValue - first.CoinbaseValue
+		if diff < 0 {
+			diff = -diff
+		}
+		larger := summary.CoinbaseValue
+		if first.CoinbaseValue > larger {
+			larger = first.CoinbaseValue
+		}
+		if float64(diff) > float64(larger)*t.valueTolerance {
+			return "coinbasevalue"
+		}
+	}
+	return ""
+}
+
+// Compares templates for every currency with more than one coinserver, logging
+// when a divergence starts and ends. Returns the current divergences
+func (t *TemplateChecker) Check(now time.Time) []*TemplateDivergence {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	currencies := []string{}
+	for currency := range t.latest {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+
+	divergences := []*TemplateDivergence{}
+	for _, currency := range currencies {
+		sources := t.latest[currency]
+		reason := ""
+		if len(sources) > 1 {
+			reason = t.compare(sources)
+		}
+		if reason == "" {
+			if t.alerted[currency] {
+				log.Info("Coinserver templates agree again", "currency", currency)
+			}
+			delete(t.since, currency)
+			delete(t.alerted, currency)
+			continue
+		}
+		since, ok := t.since[currency]
+		if !ok {
+			t.since[currency] = now
+			continue
+		}
+		if now.Sub(since) < t.grace {
+			continue
+		}
+		div := &TemplateDivergence{
+			Currency: currency,
+			Since:    since,
+			Reason:   reason,
+			Sources:  map[string]*templateSummary{},
+		}
+		for source, summary := range sources {
+			cp := *summary
+			div.Sources[source] = &cp
+		}
+		if !t.alerted[currency] {
+			log.Error("Coinserver templates diverged, a node may be forked or stuck",
+				"currency", currency, "reason", reason, "since", since, "sources", div.Sources)
+			t.alerted[currency] = true
+		}
+		divergences = append(divergences, div)
+	}
+	return divergences
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTemplateCheckerAgree(t *testing.T) {
+	now := time.Now()
+	c := NewTemplateChecker(30*time.Second, 0.25)
+	c.Record("LTC", "cs1", []byte(`{"height": 10, "previousblockhash": "aa", "coinbasevalue": 100}`), now)
+	c.Record("LTC", "cs2", []byte(`{"height": 10, "previousblockhash": "aa", "coinbasevalue": 110}`), now)
+	assert.Empty(t, c.Check(now))
+	assert.Empty(t, c.Check(now.Add(time.Minute)))
+}
+
+func TestTemplateCheckerDiverge(t *testing.T) {
+	now := time.Now()
+	c := NewTemplateChecker(30*time.Second, 0.25)
+	c.Record("LTC", "cs1", []byte(`{"height": 10, "previousblockhash": "aa", "coinbasevalue": 100}`), now)
+	c.Record("LTC", "cs2", []byte(`{"height": 11, "previousblockhash": "bb", "coinbasevalue": 100}`), now)
+	// A new block, cs1 hasn't caught up yet
+	assert.Empty(t, c.Check(now))
+	assert.Empty(t, c.Check(now.Add(10*time.Second)))
+
+	// cs1 is stuck
+	divs := c.Check(now.Add(31 * time.Second))
+	assert.Len(t, divs, 1)
+	assert.Equal(t, "LTC", divs[0].Currency)
+	assert.Equal(t, "height", divs[0].Reason)
+	assert.Len(t, divs[0].Sources, 2)
+
+	// Removing the stuck coinserver clears it
+	c.Remove("cs1")
+	assert.Empty(t, c.Check(now.Add(32*time.Second)))
+}
+
+func TestTemplateCheckerCoinbaseValue(t *testing.T) {
+	now := time.Now()
+	c := NewTemplateChecker(0, 0.25)
+	c.Record("LTC", "cs1", []byte(`{"height": 10, "previousblockhash": "aa", "coinbasevalue": 100}`), now)
+	c.Record("LTC", "cs2", []byte(`{"height": 10, "previousblockhash": "aa", "coinbasevalue": 50}`), now)
+	c.Check(now)
+	divs := c.Check(now)
+	assert.Len(t, divs, 1)
+	assert.Equal(t, "coinbasevalue", divs[0].Reason)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+
+	"github.com/icook/ngpool/pkg/service"
+)
+
+// Chain specific handling of getblocktemplate fields BlockTemplate doesn't
+// decode, ie treasury payees or MWEB. Hooks are registered by name with
+// RegisterTemplateHook, and a currency runs those named in its TemplateHooks.
+// Every func is optional
+type TemplateHook struct {
+	// Reads what the hook needs from the raw template. The result is handed
+	// to the other funcs as data
+	Parse func(raw []byte) (interface{}, error)
+	// Coinbase outputs the chain requires, paid out of CoinbaseValue before
+	// the pool's part like masternode payees
+	Payees func(data interface{}) []*GBTPayee
+	// Adjusts the block header version, before multi-algo bits are set
+	Version func(data interface{}, version uint32) uint32
+	// Bytes written after the block's transactions
+	BlockSuffix func(data interface{}) []byte
+}
+
+var TemplateHooks = map[string]*TemplateHook{}
+
+func RegisterTemplateHook(name string, hook *TemplateHook) {
+	if _, ok := TemplateHooks[name]; ok {
+		panic("Template hook registered twice: " + name)
+	}
+	TemplateHooks[name] = hook
+}
+
+// A hook and what it parsed from one template
+type templateHook struct {
+	hook *TemplateHook
+	data interface{}
+}
+
+// Runs the currency's hooks over the raw template it was decoded from
+func (b *BlockTemplate) applyHooks(raw []byte, config *service.ChainConfig) error {
+	b.hooks = nil
+	for _, name := range config.TemplateHooks {
+		hook, ok := TemplateHooks[name]
+		if !ok {
+			return errors.Errorf("No template hook %s for %s", name, config.Code)
+		}
+		applied := templateHook{hook: hook}
+		if hook.Parse != nil {
+			data, err := hook.Parse(raw)
+			if err != nil {
+				return errors.Wrapf(err, "Template hook %s", name)
+			}
+			applied.data = data
+		}
+		b.hooks = append(b.hooks, applied)
+	}
+	return nil
+}
+
+func (b *BlockTemplate) hookPayees() []*GBTPayee {
+	var payees []*GBTPayee
+	for _, h := range b.hooks {
+		if h.hook.Payees != nil {
+			payees = append(payees, h.hook.Payees(h.data)...)
+		}
+	}
+	return payees
+}
+
+func (b *BlockTemplate) hookVersion(version uint32) uint32 {
+	for _, h := range b.hooks {
+		if h.hook.Version != nil {
+			version = h.hook.Version(h.data, version)
+		}
+	}
+	return version
+}
+
+func (b *BlockTemplate) blockSuffix() []byte {
+	var suffix []byte
+	for _, h := range b.hooks {
+		if h.hook.BlockSuffix != nil {
+			suffix = append(suffix, h.hook.BlockSuffix(h.data)...)
+		}
+	}
+	return suffix
+}
+
+// Checks every currency's TemplateHooks are registered, so a typo shows up at
+// startup rather than as a failing job
+func checkTemplateHooks() error {
+	for code, config := range service.Currencies() {
+		for _, name := range config.TemplateHooks {
+			if _, ok := TemplateHooks[name]; !ok {
+				return errors.Errorf("No template hook %s for %s", name, code)
+			}
+		}
+	}
+	return nil
+}
+
+func init() {
+	// Litecoin's MimbleWimble extension block. Once it's active the template
+	// carries the serialized MWEB block, which follows the transactions
+	// behind a flag byte. The HogEx transaction is already the template's
+	// last. Coinservers must request the rule, TemplateRules ["mweb", "segwit"]
+	RegisterTemplateHook("mweb", &TemplateHook{
+		Parse: func(raw []byte) (interface{}, error) {
+			var tmpl struct {
+				MWEB string
+			}
+			if err := json.Unmarshal(raw, &tmpl); err != nil {
+				return nil, err
+			}
+			if tmpl.MWEB == "" {
+				return []byte(nil), nil
+			}
+			mweb, err := hex.DecodeString(tmpl.MWEB)
+			if err != nil {
+				return nil, errors.Wrap(err, "Invalid mweb")
+			}
+			return mweb, nil
+		},
+		BlockSuffix: func(data interface{}) []byte {
+			mweb := data.([]byte)
+			if len(mweb) == 0 {
+				return nil
+			}
+			return append([]byte{0x01}, mweb...)
+		},
+	})
+}
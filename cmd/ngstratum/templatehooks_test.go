@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/icook/ngpool/pkg/service"
+)
+
+func TestTemplateHooks(t *testing.T) {
+	TemplateHooks["test_treasury"] = &TemplateHook{
+		Parse: func(raw []byte) (interface{}, error) {
+			return &GBTPayee{Script: "51", Amount: 100}, nil
+		},
+		Payees: func(data interface{}) []*GBTPayee {
+			return []*GBTPayee{data.(*GBTPayee)}
+		},
+		Version: func(data interface{}, version uint32) uint32 {
+			return version | 0x1000
+		},
+	}
+	defer delete(TemplateHooks, "test_treasury")
+
+	raw := []byte(`{"height": 10, "mweb": "0a0b"}`)
+	tmpl := &BlockTemplate{}
+	config := &service.ChainConfig{Code: "LTC", TemplateHooks: []string{"mweb", "test_treasury"}}
+	assert.NoError(t, tmpl.applyHooks(raw, config))
+	assert.Equal(t, []byte{0x01, 0x0a, 0x0b}, tmpl.blockSuffix())
+	assert.Equal(t, uint32(0x1002), tmpl.hookVersion(2))
+	payees := tmpl.requiredPayees()
+	assert.Len(t, payees, 1)
+	assert.Equal(t, int64(100), payees[0].Amount)
+
+	// Before MWEB activates there's nothing to add
+	assert.NoError(t, tmpl.applyHooks([]byte(`{"height": 10}`), config))
+	assert.Empty(t, tmpl.blockSuffix())
+
+	assert.Error(t, tmpl.applyHooks([]byte(`{"mweb": "zz"}`), config))
+	config.TemplateHooks = []string{"missing"}
+	assert.Error(t, tmpl.applyHooks(raw, config))
+}
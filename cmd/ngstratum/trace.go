@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Picks out sessions to have every stratum frame they send and receive
+// logged, from the TraceSessions config key, so one misbehaving rig can be
+// watched without turning on debug logging for everyone. Entries are an IP,
+// a username, or username.worker
+type SessionTracer struct {
+	// Holds a *traceSelectors
+	selectors atomic.Value
+}
+
+type traceSelectors struct {
+	ips     map[string]bool
+	users   map[string]bool
+	workers map[string]bool
+}
+
+func NewSessionTracer(entries []string) *SessionTracer {
+	t := &SessionTracer{}
+	t.Set(entries)
+	return t
+}
+
+// Replaces the sessions traced. Sessions already connected pick it up when
+// their trace is next updated
+func (t *SessionTracer) Set(entries []string) {
+	sel := &traceSelectors{
+		ips:     map[string]bool{},
+		users:   map[string]bool{},
+		workers: map[string]bool{},
+	}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		switch {
+		case entry == "":
+		case net.ParseIP(entry) != nil:
+			sel.ips[net.ParseIP(entry).String()] = true
+		case strings.Contains(entry, "."):
+			sel.workers[entry] = true
+		default:
+			sel.users[entry] = true
+		}
+	}
+	t.selectors.Store(sel)
+}
+
+// Safe to call on a nil tracer, which traces nobody
+func (t *SessionTracer) Matches(ip string, username string, worker string) bool {
+	if t == nil {
+		return false
+	}
+	sel := t.selectors.Load().(*traceSelectors)
+	if parsed := net.ParseIP(ip); parsed != nil && sel.ips[parsed.String()] {
+		return true
+	}
+	if username == "" {
+		return false
+	}
+	return sel.users[username] || sel.workers[username+"."+worker]
+}
+
+// Checks the session against the port's tracer, turning frame logging on or
+// off. Run when the session starts, when it authorizes, and when
+// TraceSessions is reloaded
+func (c *StratumClient) updateTrace() {
+	var tracing int32
+	if c.port.Trace.Matches(c.remoteIP, c.username, c.worker) {
+		tracing = 1
+	}
+	if atomic.SwapInt32(&c.tracing, tracing) != tracing {
+		c.log.Info("Session tracing changed", "tracing", tracing == 1)
+	}
+}
+
+// Logs a frame sent ("out") or received ("in") if the session is traced.
+// The time is logged to the microsecond, since the log's own timestamp only
+// has seconds
+func (c *StratumClient) trace(dir string, frames ...[]byte) {
+	if atomic.LoadInt32(&c.tracing) == 0 {
+		return
+	}
+	c.log.Info("Stratum frame", "dir", dir,
+		"at", time.Now().UTC().Format("15:04:05.000000"),
+		"frame", string(bytes.TrimRight(bytes.Join(frames, nil), "\n")))
+}
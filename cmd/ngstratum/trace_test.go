@@ -0,0 +1,22 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionTracerMatches(t *testing.T) {
+	tracer := NewSessionTracer([]string{"10.0.0.5", "alice", "bob.rig3", " "})
+	assert.True(t, tracer.Matches("10.0.0.5", "", ""))
+	assert.True(t, tracer.Matches("10.0.0.6", "alice", "anything"))
+	assert.True(t, tracer.Matches("10.0.0.6", "bob", "rig3"))
+	assert.False(t, tracer.Matches("10.0.0.6", "bob", "rig4"))
+	assert.False(t, tracer.Matches("10.0.0.6", "", ""))
+
+	tracer.Set(nil)
+	assert.False(t, tracer.Matches("10.0.0.5", "alice", ""))
+
+	var none *SessionTracer
+	assert.False(t, none.Matches("10.0.0.5", "alice", ""))
+}
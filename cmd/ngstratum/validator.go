@@ -0,0 +1,134 @@
+package main
+
+import (
+	"hash"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/seehuhn/sha256d"
+)
+
+// sha256d hashers get used several times for every share, so they're pooled
+// rather than allocated each time
+var hasherPool = sync.Pool{
+	New: func() interface{} { return sha256d.New() },
+}
+
+func getHasher() hash.Hash {
+	hasher := hasherPool.Get().(hash.Hash)
+	hasher.Reset()
+	return hasher
+}
+
+func putHasher(hasher hash.Hash) {
+	hasherPool.Put(hasher)
+}
+
+// Jobs a client can submit against. Once stored it's never modified, adding
+// a job builds a new book, so submissions look jobs up without locking while
+// the write loop hands out new ones
+type clientJobBook struct {
+	jobs map[string]*ClientJob
+	// Oldest first, for dropping jobs past the port's retention
+	order []string
+}
+
+// Adds job, dropping the oldest past maxJobs and any sent more than maxAge
+// before it. 0 for maxAge keeps jobs until they're pushed out
+func (b *clientJobBook) with(job *ClientJob, maxJobs int, maxAge time.Duration) *clientJobBook {
+	order := b.order
+	if len(order) >= maxJobs {
+		order = order[len(order)-maxJobs+1:]
+	}
+	for maxAge > 0 && len(order) > 0 && job.sent.Sub(b.jobs[order[0]].sent) > maxAge {
+		order = order[1:]
+	}
+	next := &clientJobBook{
+		jobs:  make(map[string]*ClientJob, len(order)+1),
+		order: make([]string, 0, len(order)+1),
+	}
+	for _, id := range order {
+		next.jobs[id] = b.jobs[id]
+		next.order = append(next.order, id)
+	}
+	next.jobs[job.id] = job
+	next.order = append(next.order, job.id)
+	return next
+}
+
+// The most recently added job, nil if there aren't any yet
+func (b *clientJobBook) latest() *ClientJob {
+	if len(b.order) == 0 {
+		return nil
+	}
+	return b.jobs[b.order[len(b.order)-1]]
+}
+
+type ClientJob struct {
+	job        *Job
+	id         string
+	difficulty float64
+	sent       time.Time
+	// The share target for difficulty, worked out once up front
+	target *big.Int
+	// Keys of submissions that have been accepted or are being checked.
+	// Checked from validator goroutines
+	submissions sync.Map
+}
+
+func NewClientJob(id string, job *Job, difficulty float64, sent time.Time) *ClientJob {
+	return &ClientJob{
+		job:        job,
+		id:         id,
+		difficulty: difficulty,
+		sent:       sent,
+		target:     job.algo.ShareTarget(difficulty),
+	}
+}
+
+type shareTask struct {
+	client     *StratumClient
+	clientJob  *ClientJob
+	submission *MiningSubmit
+	key        string
+	received   time.Time
+	// Already answered as accepted, see FastAck
+	acked bool
+	// For a job behind the latest block, within StaleShareDepth
+	stale bool
+}
+
+// Checks shares for every client on a fixed number of goroutines, so a burst
+// of shares doesn't mean a burst of goroutines, and a slow connection doesn't
+// hold up share checking for its own submissions
+type ShareValidator struct {
+	workers int
+	tasks   chan *shareTask
+}
+
+// Buffered so readers rarely block handing off a share
+const shareQueueSize = 4096
+
+func NewShareValidator(workers int) *ShareValidator {
+	return &ShareValidator{
+		workers: workers,
+		tasks:   make(chan *shareTask, shareQueueSize),
+	}
+}
+
+func (v *ShareValidator) Start() {
+	for i := 0; i < v.workers; i++ {
+		go v.work()
+	}
+}
+
+func (v *ShareValidator) Submit(task *shareTask) {
+	v.tasks <- task
+}
+
+func (v *ShareValidator) work() {
+	for task := range v.tasks {
+		task.client.checkShare(task)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/seehuhn/sha256d"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientJobBook(t *testing.T) {
+	book := &clientJobBook{}
+	for i := 0; i < defaultRetainedJobs+2; i++ {
+		prevLen := len(book.order)
+		next := book.with(&ClientJob{id: fmt.Sprint(i)}, defaultRetainedJobs, 0)
+		// Earlier books are left alone for anyone still reading them
+		assert.Len(t, book.order, prevLen)
+		book = next
+	}
+	assert.Len(t, book.jobs, defaultRetainedJobs)
+	assert.Equal(t, "2", book.order[0])
+	assert.Equal(t, fmt.Sprint(defaultRetainedJobs+1), book.order[defaultRetainedJobs-1])
+	_, ok := book.jobs["1"]
+	assert.False(t, ok, "oldest jobs are dropped")
+
+	// Jobs sent too long before the newest are dropped too
+	now := time.Unix(1500000000, 0)
+	book = &clientJobBook{}
+	book = book.with(&ClientJob{id: "a", sent: now}, 4, time.Minute)
+	book = book.with(&ClientJob{id: "b", sent: now.Add(time.Second * 30)}, 4, time.Minute)
+	book = book.with(&ClientJob{id: "c", sent: now.Add(time.Second * 90)}, 4, time.Minute)
+	assert.Equal(t, []string{"b", "c"}, book.order)
+}
+
+func TestPooledHasher(t *testing.T) {
+	hasher := getHasher()
+	hasher.Write([]byte("dirty"))
+	putHasher(hasher)
+
+	fresh := sha256d.New()
+	fresh.Write([]byte("coinbase"))
+	hasher = getHasher()
+	hasher.Write([]byte("coinbase"))
+	assert.True(t, bytes.Equal(fresh.Sum(nil), hasher.Sum(nil)))
+}
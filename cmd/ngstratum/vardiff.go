@@ -45,3 +45,29 @@ func (v *VarDiff) ComputeNew(currentDiff float64, shareRate float64) float64 {
 	}
 	return newDiff
 }
+
+// Keeps a difficulty the miner asked for within VardiffMin and VardiffMax
+func (v *VarDiff) Clamp(diff float64) float64 {
+	return math.Max(v.tiers[0], math.Min(diff, v.tiers[len(v.tiers)-1]))
+}
+
+func (v *VarDiff) Min() float64 {
+	return v.tiers[0]
+}
+
+func (v *VarDiff) Max() float64 {
+	return v.tiers[len(v.tiers)-1]
+}
+
+// Whether o hands out the same difficulties as v
+func (v *VarDiff) Equal(o *VarDiff) bool {
+	if v.targetSubmissionRate != o.targetSubmissionRate || len(v.tiers) != len(o.tiers) {
+		return false
+	}
+	for i := range v.tiers {
+		if v.tiers[i] != o.tiers[i] {
+			return false
+		}
+	}
+	return true
+}
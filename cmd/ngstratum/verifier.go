@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/icook/ngpool/pkg/service"
+)
+
+// PoW hashing for expensive algos can be moved out of the stratum process to
+// verifier processes (ngstratum verifier) on local sockets, so a flood of
+// shares can't starve the goroutines serving miners. Integers are big endian.
+// A request is the id (uint32), algo length (uint8), algo, input length
+// (uint32) and input. A response is the id, status (uint8), then the length
+// (uint32) and either the hash or error text
+const (
+	verifierOK  = 0
+	verifierErr = 1
+	// Block headers are 80 bytes, anything near this is garbage
+	verifierMaxInput = 1 << 16
+)
+
+func init() {
+	var workers int
+	verifierCmd := &cobra.Command{
+		Use:   "verifier [socket]",
+		Short: "Hash shares for stratums with Verifiers set",
+		Long: `Hash shares for stratums with Verifiers set. Listens on a unix socket path,
+or host:port for TCP`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			network, addr := verifierNetwork(args[0])
+			if network == "unix" {
+				// A socket left behind by a previous run
+				os.Remove(addr)
+			}
+			ln, err := net.Listen(network, addr)
+			if err != nil {
+				log.Crit("Failed to listen", "addr", args[0], "err", err)
+				os.Exit(1)
+			}
+			if workers <= 0 {
+				workers = runtime.NumCPU()
+			}
+			log.Info("Verifier listening", "addr", args[0], "workers", workers)
+			ServeVerifier(ln, workers)
+		}}
+	verifierCmd.Flags().IntVar(&workers, "workers", 0, "Hashing goroutines, 0 for one per CPU")
+	RootCmd.AddCommand(verifierCmd)
+}
+
+// Paths are unix sockets, anything else is TCP
+func verifierNetwork(addr string) (string, string) {
+	if strings.HasPrefix(addr, "unix:") {
+		return "unix", strings.TrimPrefix(addr, "unix:")
+	}
+	if strings.HasPrefix(addr, "/") || strings.HasPrefix(addr, ".") {
+		return "unix", addr
+	}
+	return "tcp", addr
+}
+
+type verifierRequest struct {
+	id    uint32
+	algo  string
+	input []byte
+}
+
+func writeVerifierRequest(w io.Writer, req *verifierRequest) error {
+	buf := make([]byte, 0, 9+len(req.algo)+len(req.input))
+	buf = appendUint32(buf, req.id)
+	buf = append(buf, byte(len(req.algo)))
+	buf = append(buf, req.algo...)
+	buf = appendUint32(buf, uint32(len(req.input)))
+	buf = append(buf, req.input...)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readVerifierRequest(r *bufio.Reader) (*verifierRequest, error) {
+	var head [5]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	req := &verifierRequest{id: binary.BigEndian.Uint32(head[:4])}
+	algo := make([]byte, head[4])
+	if _, err := io.ReadFull(r, algo); err != nil {
+		return nil, err
+	}
+	req.algo = string(algo)
+	input, err := readVerifierBytes(r)
+	if err != nil {
+		return nil, err
+	}
+	req.input = input
+	return req, nil
+}
+
+type verifierResponse struct {
+	id   uint32
+	hash []byte
+	err  error
+}
+
+func writeVerifierResponse(w io.Writer, resp *verifierResponse) error {
+	status, payload := byte(verifierOK), resp.hash
+	if resp.err != nil {
+		status, payload = verifierErr, []byte(resp.err.Error())
+	}
+	buf := make([]byte, 0, 9+len(payload))
+	buf = appendUint32(buf, resp.id)
+	buf = append(buf, status)
+	buf = appendUint32(buf, uint32(len(payload)))
+	buf = append(buf, payload...)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readVerifierResponse(r *bufio.Reader) (*verifierResponse, error) {
+	var head [5]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	resp := &verifierResponse{id: binary.BigEndian.Uint32(head[:4])}
+	payload, err := readVerifierBytes(r)
+	if err != nil {
+		return nil, err
+	}
+	if head[4] != verifierOK {
+		resp.err = errors.New(string(payload))
+	} else {
+		resp.hash = payload
+	}
+	return resp, nil
+}
+
+func readVerifierBytes(r *bufio.Reader) ([]byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if n > verifierMaxInput {
+		return nil, errors.Errorf("Frame of %d bytes is too long", n)
+	}
+	buf := make([]byte, n)
+	_, err := io.ReadFull(r, buf)
+	return buf, err
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return append(buf, b[:]...)
+}
+
+type verifierTask struct {
+	req  *verifierRequest
+	conn net.Conn
+	// Guards writes to conn, shared by every task from it
+	writeMtx *sync.Mutex
+}
+
+// Answers hash requests from any number of stratum connections with a fixed
+// number of hashing goroutines
+func ServeVerifier(ln net.Listener, workers int) {
+	tasks := make(chan *verifierTask, workers*4)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for task := range tasks {
+				resp := &verifierResponse{id: task.req.id}
+				algo, ok := service.AlgoConfig[task.req.algo]
+				if !ok {
+					resp.err = errors.Errorf("Unknown algo %s", task.req.algo)
+				} else {
+					resp.hash, resp.err = algo.PoWHash(task.req.input)
+				}
+				task.writeMtx.Lock()
+				err := writeVerifierResponse(task.conn, resp)
+				task.writeMtx.Unlock()
+				if err != nil {
+					log.Debug("Failed to write verifier response", "err", err)
+				}
+			}
+		}()
+	}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Error("Verifier accept failed", "err", err)
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+			writeMtx := &sync.Mutex{}
+			for {
+				req, err := readVerifierRequest(reader)
+				if err != nil {
+					if err != io.EOF {
+						log.Info("Dropping verifier client", "err", err)
+					}
+					return
+				}
+				tasks <- &verifierTask{req, conn, writeMtx}
+			}
+		}(conn)
+	}
+}
+
+// How long to wait before redialing a verifier that's gone away
+const verifierRedialInterval = time.Second * 5
+
+// One connection to a verifier, with requests multiplexed by id
+type verifierConn struct {
+	addr     string
+	conn     net.Conn
+	lastDial time.Time
+	nextID   uint32
+	pending  map[uint32]chan *verifierResponse
+	mtx      sync.Mutex
+	writeMtx sync.Mutex
+}
+
+// Returns the connection, dialing if it's down and we haven't tried lately
+func (v *verifierConn) get(now time.Time) (net.Conn, error) {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	if v.conn != nil {
+		return v.conn, nil
+	}
+	if now.Sub(v.lastDial) < verifierRedialInterval {
+		return nil, errors.Errorf("Verifier %s is down", v.addr)
+	}
+	v.lastDial = now
+	network, addr := verifierNetwork(v.addr)
+	conn, err := net.DialTimeout(network, addr, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	v.conn = conn
+	go v.readLoop(conn)
+	return conn, nil
+}
+
+func (v *verifierConn) readLoop(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	for {
+		resp, err := readVerifierResponse(reader)
+		if err != nil {
+			log.Warn("Lost verifier", "addr", v.addr, "err", err)
+			v.mtx.Lock()
+			conn.Close()
+			if v.conn == conn {
+				v.conn = nil
+			}
+			// Everyone waiting falls back to hashing locally
+			for id, ch := range v.pending {
+				close(ch)
+				delete(v.pending, id)
+			}
+			v.mtx.Unlock()
+			return
+		}
+		v.mtx.Lock()
+		ch, ok := v.pending[resp.id]
+		delete(v.pending, resp.id)
+		v.mtx.Unlock()
+		if ok {
+			ch <- resp
+		}
+	}
+}
+
+func (v *verifierConn) hash(algo string, input []byte, timeout time.Duration) ([]byte, error) {
+	conn, err := v.get(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan *verifierResponse, 1)
+	v.mtx.Lock()
+	v.nextID++
+	id := v.nextID
+	v.pending[id] = ch
+	v.mtx.Unlock()
+
+	v.writeMtx.Lock()
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	err = writeVerifierRequest(conn, &verifierRequest{id, algo, input})
+	v.writeMtx.Unlock()
+	if err != nil {
+		// The read loop will notice too, and clean up
+		conn.Close()
+		return nil, err
+	}
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return nil, errors.Errorf("Verifier %s went away", v.addr)
+		}
+		return resp.hash, resp.err
+	case <-time.After(timeout):
+		v.mtx.Lock()
+		delete(v.pending, id)
+		v.mtx.Unlock()
+		return nil, errors.Errorf("Verifier %s timed out", v.addr)
+	}
+}
+
+// VerifierPool spreads PoW hashing over verifier processes. If none of them
+// answer, shares are hashed locally rather than rejected, and counted as
+// fallbacks in the status
+type VerifierPool struct {
+	conns   []*verifierConn
+	timeout time.Duration
+	next    uint32
+
+	requests  uint64
+	fallbacks uint64
+}
+
+func NewVerifierPool(addrs []string, timeout time.Duration) *VerifierPool {
+	if len(addrs) == 0 {
+		return nil
+	}
+	p := &VerifierPool{timeout: timeout}
+	for _, addr := range addrs {
+		p.conns = append(p.conns, &verifierConn{
+			addr:    addr,
+			pending: map[uint32]chan *verifierResponse{},
+		})
+	}
+	return p
+}
+
+// Asks each verifier in turn, starting from the next in rotation, until one
+// answers
+func (p *VerifierPool) Hash(algo string, input []byte) ([]byte, error) {
+	atomic.AddUint64(&p.requests, 1)
+	start := atomic.AddUint32(&p.next, 1)
+	var lastErr error
+	for i := range p.conns {
+		v := p.conns[(int(start)+i)%len(p.conns)]
+		hash, err := v.hash(algo, input, p.timeout)
+		if err == nil {
+			return hash, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// A copy of algo that hashes through the pool. Nil safe, a nil pool returns
+// algo as is
+func (p *VerifierPool) Algo(algo *service.Algo) *service.Algo {
+	if p == nil {
+		return algo
+	}
+	local := algo.PoWHash
+	remote := *algo
+	remote.PoWHash = func(input []byte) ([]byte, error) {
+		hash, err := p.Hash(algo.Name, input)
+		if err != nil {
+			log.Debug("Hashing share locally", "err", err)
+			atomic.AddUint64(&p.fallbacks, 1)
+			return local(input)
+		}
+		return hash, nil
+	}
+	return &remote
+}
+
+func (p *VerifierPool) Stats() map[string]uint64 {
+	if p == nil {
+		return nil
+	}
+	var up uint64
+	for _, v := range p.conns {
+		v.mtx.Lock()
+		if v.conn != nil {
+			up++
+		}
+		v.mtx.Unlock()
+	}
+	return map[string]uint64{
+		"requests":  atomic.LoadUint64(&p.requests),
+		"fallbacks": atomic.LoadUint64(&p.fallbacks),
+		"up":        up,
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/icook/ngpool/pkg/service"
+)
+
+func TestVerifierFrames(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, writeVerifierRequest(&buf, &verifierRequest{7, "sha256d", []byte{1, 2}}))
+	req, err := readVerifierRequest(bufio.NewReader(&buf))
+	assert.NoError(t, err)
+	assert.Equal(t, &verifierRequest{7, "sha256d", []byte{1, 2}}, req)
+
+	assert.NoError(t, writeVerifierResponse(&buf, &verifierResponse{id: 9, err: os.ErrInvalid}))
+	resp, err := readVerifierResponse(bufio.NewReader(&buf))
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(9), resp.id)
+	assert.EqualError(t, resp.err, os.ErrInvalid.Error())
+
+	buf.Write([]byte{0, 0, 0, 1, 0, 0xff, 0xff, 0xff, 0xff})
+	_, err = readVerifierResponse(bufio.NewReader(&buf))
+	assert.Error(t, err)
+}
+
+func TestVerifierPool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verifier")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "verifier.sock")
+	ln, err := net.Listen("unix", sock)
+	assert.NoError(t, err)
+	go ServeVerifier(ln, 2)
+
+	algo := service.AlgoConfig["sha256d"]
+	header := []byte("an 80 byte header would go here")
+	expected, _ := algo.PoWHash(header)
+
+	// The second verifier never comes up, so its share of requests go to
+	// the first
+	pool := NewVerifierPool([]string{sock, filepath.Join(dir, "missing.sock")}, time.Second)
+	remote := pool.Algo(algo)
+	assert.Equal(t, "sha256d", remote.Name)
+	for i := 0; i < 4; i++ {
+		hash, err := remote.PoWHash(header)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, hash)
+	}
+	_, err = pool.Hash("nope", header)
+	assert.Error(t, err)
+
+	// With everything gone shares are hashed here
+	ln.Close()
+	pool.conns[0].mtx.Lock()
+	pool.conns[0].conn.Close()
+	pool.conns[0].mtx.Unlock()
+	time.Sleep(time.Millisecond * 50)
+	hash, err := remote.PoWHash(header)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, hash)
+	stats := pool.Stats()
+	assert.Equal(t, uint64(1), stats["fallbacks"])
+	assert.Equal(t, uint64(0), stats["up"])
+
+	var nilPool *VerifierPool
+	assert.Equal(t, algo, nilPool.Algo(algo))
+	assert.Nil(t, NewVerifierPool(nil, time.Second))
+}
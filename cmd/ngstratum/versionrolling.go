@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/hex"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	"github.com/icook/ngpool/pkg/service"
+)
+
+// BIP310 version rolling (overt ASICBoost). Miners ask for it with
+// mining.configure, we answer with the version bits they may change, and
+// their submits carry the version they used as a sixth param. Masks and
+// version bits are hex encoded big endian numbers on the wire
+
+// The general purpose bits from BIP320
+const DefaultVersionRollingMask = 0x1fffe000
+
+// The version bits a MultiAlgo chain uses to identify the algo. Rolling
+// these would make the block for another algo
+func multiAlgoMask(config *service.ChainConfig) uint32 {
+	if config == nil || !config.MultiAlgo {
+		return 0
+	}
+	return uint32((uint64(1)<<config.MultiAlgoBitWidth)-1) << config.MultiAlgoBitShift
+}
+
+func parseVersionMask(raw string) (uint32, error) {
+	mask, err := strconv.ParseUint(raw, 16, 32)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Invalid version mask '%s'", raw)
+	}
+	return uint32(mask), nil
+}
+
+func formatVersionMask(mask uint32) string {
+	return hex.EncodeToString([]byte{
+		byte(mask >> 24), byte(mask >> 16), byte(mask >> 8), byte(mask)})
+}
+
+// Applies submitted version bits to a job's version. Miners send either the
+// whole rolled version or only the rolled bits, anything else outside the
+// mask is an error
+func rollVersion(jobVersion uint32, submitted uint32, mask uint32) (uint32, error) {
+	outside := submitted &^ mask
+	if outside != 0 && outside != jobVersion&^mask {
+		return 0, errors.Errorf("Version %08x changes bits outside of mask %08x",
+			submitted, mask)
+	}
+	return (jobVersion &^ mask) | (submitted & mask), nil
+}
+
+type MiningConfigure struct {
+	Extensions []string
+	Params     map[string]interface{}
+}
+
+// [["version-rolling"], {"version-rolling.mask": "ffffffff", "version-rolling.min-bit-count": 2}]
+func DecodeMiningConfigure(raw interface{}) (*MiningConfigure, error) {
+	params, ok := raw.([]interface{})
+	if !ok || len(params) != 2 {
+		return nil, errors.New("Configure must have 2 fields")
+	}
+	mc := &MiningConfigure{Params: map[string]interface{}{}}
+	extensions, ok := params[0].([]interface{})
+	if !ok {
+		return nil, errors.New("Extensions must be a list")
+	}
+	for _, ext := range extensions {
+		name, ok := ext.(string)
+		if !ok {
+			return nil, errors.New("Extension names must be strings")
+		}
+		mc.Extensions = append(mc.Extensions, name)
+	}
+	if extParams, ok := params[1].(map[string]interface{}); ok {
+		mc.Params = extParams
+	}
+	return mc, nil
+}
+
+// Builds the mining.configure result, returning the version mask the client
+// may roll, 0 if it didn't ask for version rolling. Extensions we don't
+// support are answered with false
+func (mc *MiningConfigure) negotiate(poolMask uint32) (map[string]interface{}, uint32, error) {
+	result := map[string]interface{}{}
+	var mask uint32
+	for _, ext := range mc.Extensions {
+		if ext != "version-rolling" {
+			result[ext] = false
+			continue
+		}
+		requested := uint32(0xffffffff)
+		if raw, ok := mc.Params["version-rolling.mask"].(string); ok {
+			var err error
+			requested, err = parseVersionMask(raw)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		mask = poolMask & requested
+		result["version-rolling"] = mask != 0
+		result["version-rolling.mask"] = formatVersionMask(mask)
+	}
+	return result, mask, nil
+}
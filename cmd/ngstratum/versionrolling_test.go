@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/icook/ngpool/pkg/service"
+)
+
+func TestMultiAlgoMask(t *testing.T) {
+	assert.Equal(t, uint32(0), multiAlgoMask(nil))
+	config := &service.ChainConfig{MultiAlgo: true, MultiAlgoBitShift: 9, MultiAlgoBitWidth: 4,
+		MultiAlgoMap: map[string]uint32{"scrypt": 2}}
+	assert.Equal(t, uint32(0x1e00), multiAlgoMask(config))
+	assert.Equal(t, uint32(0x20000400), setAlgoVersion(0x20001e00, config, &service.Algo{Name: "scrypt"}))
+}
+
+func TestRollVersion(t *testing.T) {
+	mask := uint32(DefaultVersionRollingMask)
+	// Only the rolled bits
+	version, err := rollVersion(0x20000000, 0x00006000, mask)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0x20006000), version)
+	// The whole version
+	version, err = rollVersion(0x20000000, 0x3fffe000, mask)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0x3fffe000), version)
+
+	_, err = rollVersion(0x20000000, 0x00000001, mask)
+	assert.Error(t, err)
+	_, err = rollVersion(0x20000000, 0x00006000, 0)
+	assert.Error(t, err)
+}
+
+func TestMiningConfigure(t *testing.T) {
+	mc, err := DecodeMiningConfigure([]interface{}{
+		[]interface{}{"version-rolling", "minimum-difficulty"},
+		map[string]interface{}{"version-rolling.mask": "00fff000"},
+	})
+	assert.NoError(t, err)
+	result, mask, err := mc.negotiate(DefaultVersionRollingMask)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0x00ffe000), mask)
+	assert.Equal(t, map[string]interface{}{
+		"version-rolling":      true,
+		"version-rolling.mask": "00ffe000",
+		"minimum-difficulty":   false,
+	}, result)
+
+	_, err = DecodeMiningConfigure([]interface{}{"version-rolling"})
+	assert.Error(t, err)
+}
+
+func TestDecodeMiningSubmitVersionBits(t *testing.T) {
+	ms, err := DecodeMiningSubmit([]interface{}{
+		"user", "job", "00000000", "5a5a5a5a", "01020304", "00006000"})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0, 0, 0x60, 0}, ms.VersionBits)
+
+	_, err = DecodeMiningSubmit([]interface{}{
+		"user", "job", "00000000", "5a5a5a5a", "01020304", "6000"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Remembers each worker's difficulty after it disconnects, so a rig that
+// reconnects (a restart, a flaky link, a miner switching pools back) picks up
+// where it left off instead of climbing back up from VardiffMin. Workers are
+// the username and the rig name after the dot, ie address.rig1
+type WorkerDiffs struct {
+	ttl   time.Duration
+	diffs map[workerKey]savedDiff
+	mtx   sync.Mutex
+}
+
+type workerKey struct {
+	username string
+	worker   string
+}
+
+type savedDiff struct {
+	diff float64
+	at   time.Time
+}
+
+// Nil if ttl is zero, which disables it. A nil WorkerDiffs remembers nothing
+func NewWorkerDiffs(ttl time.Duration) *WorkerDiffs {
+	if ttl <= 0 {
+		return nil
+	}
+	return &WorkerDiffs{ttl: ttl, diffs: map[workerKey]savedDiff{}}
+}
+
+func (w *WorkerDiffs) Save(username string, worker string, diff float64, now time.Time) {
+	if w == nil || username == "" || diff <= 0 {
+		return
+	}
+	w.mtx.Lock()
+	w.diffs[workerKey{username, worker}] = savedDiff{diff, now}
+	w.mtx.Unlock()
+}
+
+// The worker's difficulty when it last disconnected, if that was within ttl
+func (w *WorkerDiffs) Load(username string, worker string, now time.Time) (float64, bool) {
+	if w == nil {
+		return 0, false
+	}
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	saved, ok := w.diffs[workerKey{username, worker}]
+	if !ok || now.Sub(saved.at) > w.ttl {
+		return 0, false
+	}
+	return saved.diff, true
+}
+
+func (w *WorkerDiffs) Prune(now time.Time) {
+	if w == nil {
+		return
+	}
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	for key, saved := range w.diffs {
+		if now.Sub(saved.at) > w.ttl {
+			delete(w.diffs, key)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerDiffs(t *testing.T) {
+	now := time.Now()
+	w := NewWorkerDiffs(time.Minute * 30)
+	w.Save("alice", "rig1", 512, now)
+	w.Save("alice", "rig2", 64, now)
+	// Nobody to remember it for before authorizing
+	w.Save("", "", 64, now)
+
+	diff, ok := w.Load("alice", "rig1", now.Add(time.Minute))
+	assert.True(t, ok)
+	assert.Equal(t, 512.0, diff)
+	_, ok = w.Load("alice", "rig3", now)
+	assert.False(t, ok)
+	_, ok = w.Load("alice", "rig1", now.Add(time.Hour))
+	assert.False(t, ok)
+
+	w.Save("alice", "rig2", 128, now.Add(time.Minute*20))
+	w.Prune(now.Add(time.Minute * 40))
+	assert.Len(t, w.diffs, 1)
+	diff, _ = w.Load("alice", "rig2", now.Add(time.Minute*40))
+	assert.Equal(t, 128.0, diff)
+
+	disabled := NewWorkerDiffs(0)
+	disabled.Save("alice", "rig1", 512, now)
+	_, ok = disabled.Load("alice", "rig1", now)
+	assert.False(t, ok)
+	disabled.Prune(now)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/icook/ngpool/pkg/adminrpc"
+)
+
+// Serves adminrpc.PayoutAdmin and LogAdmin on AdminBind, if set
+func (q *NgWebAPI) StartAdmin() error {
+	bind := q.config.GetString("AdminBind")
+	if bind == "" {
+		return nil
+	}
+	server, err := adminrpc.NewServer(adminrpc.TLSFiles{
+		CertFile: q.config.GetString("AdminCert"),
+		KeyFile:  q.config.GetString("AdminKey"),
+		CAFile:   q.config.GetString("AdminCA"),
+	})
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", bind)
+	if err != nil {
+		return errors.Wrap(err, "Admin listen")
+	}
+	adminrpc.RegisterPayoutAdminServer(server, &payoutAdmin{q})
+	adminrpc.RegisterLogs(server, q.logs.Buffer())
+	q.log.Info("Serving admin API", "bind", bind)
+	go func() {
+		err := server.Serve(listener)
+		q.log.Error("Admin API stopped", "err", err)
+	}()
+	return nil
+}
+
+// Whether payouts of currency are paused, by a pause of it or of everything.
+// Pauses are kept in the database so every ngweb sees them and they outlast
+// restarts
+func (q *NgWebAPI) payoutsPaused(currency string) (bool, error) {
+	var paused bool
+	err := q.db.Get(&paused,
+		`SELECT EXISTS (SELECT 1 FROM payout_pause WHERE currency IN ('', $1))`,
+		currency)
+	return paused, err
+}
+
+type payoutAdmin struct {
+	q *NgWebAPI
+}
+
+func (a *payoutAdmin) PausePayouts(ctx context.Context,
+	req *adminrpc.PausePayoutsRequest) (*adminrpc.PausePayoutsResponse, error) {
+	currency := strings.ToUpper(req.Currency)
+	_, err := a.q.db.Exec(
+		`INSERT INTO payout_pause (currency, reason) VALUES ($1, $2)
+		ON CONFLICT (currency) DO UPDATE SET reason = $2`,
+		currency, req.Reason)
+	if err != nil {
+		return nil, err
+	}
+	a.q.log.Warn("Payouts paused", "currency", currency, "reason", req.Reason)
+	return &adminrpc.PausePayoutsResponse{}, nil
+}
+
+func (a *payoutAdmin) ResumePayouts(ctx context.Context,
+	req *adminrpc.ResumePayoutsRequest) (*adminrpc.ResumePayoutsResponse, error) {
+	currency := strings.ToUpper(req.Currency)
+	result, err := a.q.db.Exec(`DELETE FROM payout_pause WHERE currency = $1`, currency)
+	if err != nil {
+		return nil, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if deleted > 0 {
+		a.q.log.Info("Payouts resumed", "currency", currency)
+	}
+	return &adminrpc.ResumePayoutsResponse{Resumed: deleted > 0}, nil
+}
+
+func (a *payoutAdmin) ListPauses(ctx context.Context,
+	req *adminrpc.ListPausesRequest) (*adminrpc.ListPausesResponse, error) {
+	var pauses []struct {
+		Currency string
+		Reason   string
+		PausedAt time.Time `db:"paused_at"`
+	}
+	err := a.q.db.Select(&pauses,
+		`SELECT currency, reason, paused_at FROM payout_pause ORDER BY currency`)
+	if err != nil {
+		return nil, err
+	}
+	resp := &adminrpc.ListPausesResponse{}
+	for _, p := range pauses {
+		resp.Pauses = append(resp.Pauses, &adminrpc.PayoutPause{
+			Currency: p.Currency,
+			Reason:   p.Reason,
+			PausedAt: p.PausedAt.Unix(),
+		})
+	}
+	return resp, nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"io/ioutil"
+	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -15,10 +16,14 @@ import (
 	"github.com/itsjamie/gin-cors"
 	"github.com/jmoiron/sqlx"
 	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/cast"
 	"github.com/spf13/viper"
 	"gopkg.in/go-playground/validator.v9"
 
+	"github.com/icook/ngpool/pkg/alert"
 	"github.com/icook/ngpool/pkg/common"
+	"github.com/icook/ngpool/pkg/logging"
+	ngrpc "github.com/icook/ngpool/pkg/rpcclient"
 	"github.com/icook/ngpool/pkg/service"
 )
 
@@ -32,6 +37,8 @@ type NgWebAPI struct {
 	engine  *gin.Engine
 	service *service.Service
 
+	// btcd's client rather than pkg/rpcclient, payouts build transactions
+	// with its btcjson types
 	currencyRPC    map[string]*rpcclient.Client
 	currencyRPCMtx *sync.RWMutex
 
@@ -40,12 +47,29 @@ type NgWebAPI struct {
 
 	stratums       map[string]*service.ServiceStatus
 	stratumClients map[string][]*common.StratumClientStatus
-	stratumsMtx    *sync.RWMutex
+	// Summed across all stratum ports, which are keyed by service ID
+	hashrate  *common.HashrateStatus
+	portRates map[string]float64
+	// Summed across the ports of each sharechain
+	chainRates  map[string]*common.HashrateStatus
+	stratumsMtx *sync.RWMutex
+
+	// Payout schedules for each configured user tier. These apply to all
+	// currencies, overriding the currency's PayoutSchedule
+	payoutTiers map[string]*service.Schedule
+
+	// For /v1/public/, see publicapi.go
+	publicCache   *publicCache
+	publicLimiter *rateLimiter
+
+	// Orphaned blocks and failed payouts, nil with no Alerts configured
+	alerts *alert.Alerter
+	logs   *logging.Logging
 }
 
 func NewNgWebAPI() *NgWebAPI {
 	var ngw = NgWebAPI{
-		log: log.New(),
+		log: logging.New("web"),
 
 		currencyRPC:    map[string]*rpcclient.Client{},
 		currencyRPCMtx: &sync.RWMutex{},
@@ -55,7 +79,12 @@ func NewNgWebAPI() *NgWebAPI {
 
 		stratums:       map[string]*service.ServiceStatus{},
 		stratumClients: map[string][]*common.StratumClientStatus{},
+		hashrate:       common.NewHashrateStatus(),
+		portRates:      map[string]float64{},
+		chainRates:     map[string]*common.HashrateStatus{},
 		stratumsMtx:    &sync.RWMutex{},
+
+		payoutTiers: map[string]*service.Schedule{},
 	}
 
 	return &ngw
@@ -68,23 +97,144 @@ func (q *NgWebAPI) ParseConfig() {
 	config := q.service.LoadCommonConfig()
 
 	config.SetDefault("LogLevel", "info")
+	logging.SetDefaults(config)
+	config.SetDefault("LogFormat", logging.FormatConsole)
 	config.SetDefault("DbConnectionString",
 		"user=ngpool dbname=ngpool sslmode=disable password=knight")
 	config.SetDefault("CORSOrigins", "http://localhost:3000/")
+	// Maximum number of users paid in a single payout transaction
+	config.SetDefault("PayoutBatchSize", 250)
+	// How often a user can request an on-demand payout of each currency, and
+	// the fraction of the payout the pool keeps for doing it
+	config.SetDefault("OnDemandPayoutCooldown", "24h")
+	config.SetDefault("OnDemandPayoutFee", 0.0)
+	// Shares are rolled into per worker minute and hour buckets every
+	// RollupInterval ("0s" disables), and raw shares pruned once older than
+	// ShareRetention. ShareRetention must cover the longest PPLNS window and
+	// the longest gap between blocks of any currency. Minute buckets (and
+	// minute_share) are kept for MinuteRollupRetention, hour buckets forever
+	config.SetDefault("RollupInterval", "1m")
+	config.SetDefault("ShareRetention", "168h")
+	config.SetDefault("MinuteRollupRetention", "48h")
+	// Network height, difficulty and price are sampled every
+	// NetworkStatsInterval ("0s" disables) and kept for NetworkStatsRetention.
+	// Prices are only looked up if PriceURL is set, see fetchPrice
+	config.SetDefault("NetworkStatsInterval", "5m")
+	config.SetDefault("NetworkStatsRetention", "2160h")
+	config.SetDefault("PriceURL", "")
+	config.SetDefault("PricePath", "")
+	// How far the pool wallet can drift from unpaid credits and pending
+	// payouts, as a fraction, before reconcile alerts
+	config.SetDefault("ReconcileTolerance", 0.01)
+	// Workers are checked for block withholding over WithholdingWindow (no
+	// longer than ShareRetention), counting shares within WithholdingFactor of
+	// the block target (no more than the stratums' NearTargetFactor). Those
+	// less likely than WithholdingAlpha to be honest are flagged
+	config.SetDefault("WithholdingWindow", "168h")
+	config.SetDefault("WithholdingFactor", 16.0)
+	config.SetDefault("WithholdingAlpha", 0.001)
+	// Serves /v1/estimates and /v1/estimates/:username, expected time to a
+	// block and share of the pool for the pool, a user and their workers.
+	// Off by default since anyone can look up any username's workers
+	config.SetDefault("EstimatesAPI", false)
+	// Serves the gRPC admin API (adminrpc.PayoutAdmin) when set. Clients
+	// must present a certificate signed by AdminCA
+	config.SetDefault("AdminBind", "")
+	config.SetDefault("AdminCert", "")
+	config.SetDefault("AdminKey", "")
+	config.SetDefault("AdminCA", "")
+	// Proxies for reaching each currency's coinservers, keyed by currency
+	// code, ie {"BTC": "socks5://127.0.0.1:9050"} for Tor. http:// proxies
+	// get CONNECT from reconcile and confirmblocks, payouts send them plain
+	// HTTP requests, which bastions like squid forward all the same
+	config.SetDefault("CoinserverProxies", map[string]interface{}{})
+	// How a multi-algo currency's blocks are split between sharechains of
+	// different algos, "none" by raw share difficulty, "static" weighted by
+	// AlgoWeights (algo to factor above 0, default 1), or "network" by the
+	// fraction of a block each share was worth at the network difficulty
+	// RunNetworkStats last sampled. See normalizeModes
+	config.SetDefault("AlgoNormalization", normalizeNone)
+	config.SetDefault("AlgoWeights", map[string]interface{}{})
+	// The public API (/v1/public/) caches responses for PublicCacheTTL, lets
+	// each client IP make PublicRateLimit requests per PublicRateWindow (0 for
+	// no limit), and pages no bigger than PublicMaxPageSize. It's meant to be
+	// called from any site, so PublicCORSOrigins is separate from CORSOrigins
+	config.SetDefault("PublicCacheTTL", "30s")
+	config.SetDefault("PublicRateLimit", 120)
+	config.SetDefault("PublicRateWindow", "1m")
+	config.SetDefault("PublicMaxPageSize", 100)
+	config.SetDefault("PublicCORSOrigins", "*")
+	// Users' worker webhooks are checked every WorkerWebhookInterval ("0s"
+	// disables), and each user may register up to WorkerWebhookLimit
+	config.SetDefault("WorkerWebhookInterval", "1m")
+	config.SetDefault("WorkerWebhookLimit", 5)
+	// Alerts, AlertRateLimit and AlertTemplates, see pkg/alert
+	alert.SetDefaults(config)
 	q.config = config
 
 	// TODO: Check for secure JWTSecret
 
-	levelConfig := q.config.GetString("LogLevel")
-	level, err := log.LvlFromString(levelConfig)
+	logs, err := logging.Setup(logging.ReadConfig(q.config))
+	if err != nil {
+		log.Crit("Unable to set up logging", "err", err)
+		os.Exit(1)
+	}
+	q.logs = logs
+
+	alertConfig, err := alert.ReadConfig(q.config, "ngweb")
 	if err != nil {
-		log.Crit("Unable to parse log level", "configval", levelConfig, "err", err)
+		log.Crit("Invalid alert config", "err", err)
+		os.Exit(1)
+	}
+	q.alerts, err = alert.New(alertConfig)
+	if err != nil {
+		log.Crit("Invalid alert config", "err", err)
+		os.Exit(1)
+	}
+
+	if !validNormalization(q.config.GetString("AlgoNormalization")) {
+		log.Crit("Invalid AlgoNormalization", "options", normalizeModes)
+		os.Exit(1)
+	}
+	for algo, weight := range q.config.GetStringMap("AlgoWeights") {
+		if w, err := cast.ToFloat64E(weight); err != nil || w <= 0 {
+			log.Crit("Invalid AlgoWeights entry", "algo", algo, "weight", weight)
+			os.Exit(1)
+		}
+	}
+
+	if q.config.GetInt("PublicMaxPageSize") < 1 {
+		log.Crit("PublicMaxPageSize must be at least 1")
+		os.Exit(1)
+	}
+	q.publicCache = newPublicCache(q.config.GetDuration("PublicCacheTTL"))
+	q.publicLimiter = newRateLimiter(q.config.GetInt("PublicRateLimit"),
+		q.config.GetDuration("PublicRateWindow"))
+
+	if q.config.GetFloat64("WithholdingFactor") <= 1 {
+		log.Crit("WithholdingFactor must be above 1")
+		os.Exit(1)
+	}
+	// A share of the balance paid out, so 1 or more leaves nothing to pay
+	// and a negative fee pays more than the balance
+	if fee := q.config.GetFloat64("OnDemandPayoutFee"); fee < 0 || fee >= 1 {
+		log.Crit("OnDemandPayoutFee must be at least 0 and below 1", "fee", fee)
 		os.Exit(1)
 	}
-	handler := log.CallerFileHandler(log.StreamHandler(os.Stdout, log.TerminalFormat()))
-	handler = log.LvlFilterHandler(level, handler)
-	q.log.SetHandler(handler)
-	q.log.Info("Set log level", "level", level)
+
+	// A map of tier name to schedule spec, ie {"large": "@always"}
+	for tier, spec := range q.config.GetStringMapString("PayoutTiers") {
+		if tier == defaultTier || tier == onDemandTier {
+			log.Crit("PayoutTiers can't configure a builtin tier", "tier", tier)
+			os.Exit(1)
+		}
+		schedule, err := service.ParseSchedule(spec)
+		if err != nil {
+			log.Crit("Invalid PayoutTiers schedule", "tier", tier, "err", err)
+			os.Exit(1)
+		}
+		q.payoutTiers[tier] = schedule
+	}
 }
 
 func (q *NgWebAPI) ConnectDB() {
@@ -100,6 +250,26 @@ func (q *NgWebAPI) SetupGin() {
 	// Setup our database connection
 	// Configure webserver
 	r := gin.Default()
+	// Registered before the CORS middleware below, which would turn away
+	// origins that aren't the pool's own
+	public := r.Group("/v1/public/")
+	public.Use(cors.Middleware(cors.Config{
+		Origins:         q.config.GetString("PublicCORSOrigins"),
+		Methods:         "GET",
+		RequestHeaders:  "Origin, If-None-Match",
+		ExposedHeaders:  "ETag, Retry-After",
+		MaxAge:          time.Hour,
+		Credentials:     false,
+		ValidateHeaders: false,
+	}))
+	public.Use(q.publicMiddleware)
+	{
+		public.GET("blocks", q.getPublicBlocks)
+		public.GET("hashrate", q.getPublicHashrate)
+		public.GET("miners", q.getPublicMiners)
+		public.GET("payouts", q.getPublicPayouts)
+	}
+
 	r.Use(cors.Middleware(cors.Config{
 		Origins:         q.config.GetString("CORSOrigins"),
 		Methods:         "GET, PUT, POST, DELETE",
@@ -116,11 +286,22 @@ func (q *NgWebAPI) SetupGin() {
 	r.GET("/v1/block/:hash", q.getBlock)
 	r.GET("/v1/common", q.getCommon)
 	r.GET("/v1/services", q.getServices)
+	r.GET("/v1/hashrate", q.getHashrate)
+	r.GET("/v1/networkstats", q.getNetworkStats)
+	r.GET("/v1/networkstats/:currency", q.getCurrencyNetworkStats)
+	r.GET("/v1/luck", q.getLuck)
+	r.GET("/v1/rewards", q.getRewards)
+	r.GET("/v1/withholding", q.getWithholding)
 	r.GET("/v1/minute_shares/:cat", q.getMinuteShares)
 	r.GET("/v1/minute_shares/:cat/:key", q.getMinuteShares)
+	if q.config.GetBool("EstimatesAPI") {
+		r.GET("/v1/estimates", q.getEstimates)
+		r.GET("/v1/estimates/:username", q.getEstimates)
+	}
 
 	r.GET("/v1/createpayout/:currency", q.getCreatePayout)
 	r.POST("/v1/payout", q.postPayout)
+	r.GET("/v1/payoutschedule", q.getPayoutSchedule)
 
 	api := r.Group("/v1/user/")
 	api.Use(q.authMiddleware)
@@ -128,13 +309,21 @@ func (q *NgWebAPI) SetupGin() {
 		api.POST("tfa", q.postTFA)
 		api.POST("tfa_setup", q.postTFASetup)
 		api.POST("setpayout", q.postSetPayout)
+		api.POST("requestpayout", q.postRequestPayout)
+		api.GET("payoutprefs", q.getPayoutPreferences)
+		api.POST("payoutprefs", q.postPayoutPreference)
 		api.POST("changepass", q.postChangePassword)
 
 		api.GET("workers", q.getWorkers)
+		api.GET("hashrate", q.getUserHashrate)
 		api.GET("unpaid", q.getUnpaid)
 		api.GET("payouts", q.getPayouts)
 		api.GET("payout/:hash", q.getPayout)
 		api.GET("me", q.getMe)
+		api.POST("publicstats", q.postPublicStats)
+		api.GET("webhooks", q.getWorkerWebhooks)
+		api.POST("webhooks", q.postWorkerWebhook)
+		api.DELETE("webhook/:id", q.deleteWorkerWebhook)
 	}
 
 	q.engine = r
@@ -160,7 +349,10 @@ func (q *NgWebAPI) WatchStratum() {
 				q.log.Warn("Unrecognized action from service watcher", "action", update.Action)
 			}
 			clients := map[string][]*common.StratumClientStatus{}
-			for _, rawStatus := range q.stratums {
+			hashrate := common.NewHashrateStatus()
+			portRates := map[string]float64{}
+			chainRates := map[string]*common.HashrateStatus{}
+			for serviceID, rawStatus := range q.stratums {
 				var status common.StratumStatus
 				err := mapstructure.Decode(rawStatus.Status, &status)
 				if err != nil {
@@ -168,10 +360,21 @@ func (q *NgWebAPI) WatchStratum() {
 					continue
 				}
 				for _, client := range status.Clients {
+					client := client
 					clients[client.Username] = append(clients[client.Username], &client)
 				}
+				portRates[serviceID] = status.Hashrate.Port
+				hashrate.Merge(&status.Hashrate)
+				chain := rawStatus.Labels["sharechain"]
+				if _, ok := chainRates[chain]; !ok {
+					chainRates[chain] = common.NewHashrateStatus()
+				}
+				chainRates[chain].Merge(&status.Hashrate)
 			}
 			q.stratumClients = clients
+			q.hashrate = hashrate
+			q.portRates = portRates
+			q.chainRates = chainRates
 			q.stratumsMtx.Unlock()
 
 		}
@@ -206,7 +409,14 @@ func (q *NgWebAPI) WatchCoinservers() {
 					HTTPPostMode: true, // Bitcoin core only supports HTTP POST mode
 					DisableTLS:   true, // Bitcoin core does not provide TLS by default
 				}
-				client, err := rpcclient.New(connCfg, nil)
+				proxy, err := q.coinserverProxy(currency)
+				if proxy != nil {
+					connCfg.Proxy = proxy.String()
+				}
+				var client *rpcclient.Client
+				if err == nil {
+					client, err = rpcclient.New(connCfg, nil)
+				}
 				if err != nil {
 					q.log.Error("Failed to init RPC client obj", "err", err)
 				} else {
@@ -251,6 +461,25 @@ func (q *NgWebAPI) mustRunSQL(sql []byte) {
 	}
 }
 
+// Nil if the currency's coinservers are reached directly
+func (q *NgWebAPI) coinserverProxy(currency string) (*url.URL, error) {
+	// viper lowercases map keys
+	raw := q.config.GetStringMapString("CoinserverProxies")[strings.ToLower(currency)]
+	if raw == "" {
+		return nil, nil
+	}
+	return ngrpc.ParseProxy(raw)
+}
+
+// A client for the /rpc proxy of a coinbuddy found through discovery
+func (q *NgWebAPI) coinserverClient(endpoint string, currency string) (*ngrpc.Client, error) {
+	proxy, err := q.coinserverProxy(currency)
+	if err != nil {
+		return nil, err
+	}
+	return ngrpc.New(ngrpc.Config{URL: endpoint + "rpc", Proxy: proxy}), nil
+}
+
 func (q *NgWebAPI) getRPC(currency string) (*rpcclient.Client, bool) {
 	q.currencyRPCMtx.Lock()
 	defer q.currencyRPCMtx.Unlock()
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/icook/ngpool/pkg/service"
+)
+
+// Credits for a block a "coinbase" payout sharechain mined, or nil if it
+// wasn't split in the coinbase (aux chains, or jobs built before the stratum
+// loaded its window). Miners with an address were paid by the coinbase, so
+// only those held in the output to SubsidyAddress get a credit
+func (q *NgWebAPI) coinbaseCredits(block *payoutBlock) (*blockPayout, error) {
+	var payees []struct {
+		UserID  int `db:"user_id"`
+		Amount  int64
+		Address *string
+	}
+	err := q.db.Select(&payees,
+		`SELECT user_id, amount, address FROM coinbase_payout WHERE blockhash = $1`,
+		block.Hash)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(payees) == 0 {
+		return nil, nil
+	}
+
+	var name string
+	err = q.db.QueryRowx(`SELECT sharechain FROM block WHERE hash = $1`,
+		block.Hash).Scan(&name)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	config, ok := service.ShareChain[name]
+	if !ok {
+		return nil, errors.Errorf("Unknown ShareChain %s", name)
+	}
+
+	var (
+		credits []*CreditMap
+		held    int64
+		paid    int64
+	)
+	for _, p := range payees {
+		if p.Address != nil {
+			paid += p.Amount
+			continue
+		}
+		credits = append(credits, &CreditMap{UserID: p.UserID, Amount: p.Amount})
+		held += p.Amount
+	}
+	// The subsidy is the output to SubsidyAddress, which is exactly what was
+	// held back
+	if held != block.Subsidy {
+		return nil, errors.Errorf("Block %s subsidy is %d but coinbase payouts held %d",
+			block.Hash, block.Subsidy, held)
+	}
+	sc := &ShareChainPayout{
+		Name:           name,
+		config:         config,
+		Subsidy:        block.Subsidy,
+		SubsidyPayable: block.Subsidy,
+		Data: map[string]interface{}{
+			"type":          "coinbase",
+			"paid_directly": paid,
+			"payees":        len(payees) - len(credits),
+		},
+	}
+	q.log.Info("Crediting coinbase payout block", "block", block.Hash,
+		"credits", len(credits), "held", held, "paid", paid)
+	return &blockPayout{
+		sharechains: []*ShareChainPayout{sc},
+		credits:     map[string][]*CreditMap{name: credits},
+	}, nil
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/hex"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
-	"github.com/icook/btcd/rpcclient"
+	"github.com/icook/ngpool/pkg/alert"
+	"github.com/icook/ngpool/pkg/rpcclient"
 	"github.com/icook/ngpool/pkg/service"
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 )
 
@@ -19,6 +22,7 @@ func init() {
 			if err != nil {
 				ng.log.Crit("Failed", "err", err)
 			}
+			ng.alerts.Close()
 		},
 	}
 	RootCmd.AddCommand(confirmBlocks)
@@ -35,12 +39,7 @@ func (q *NgWebAPI) ConfirmBlocks() error {
 		// TODO: Fail gracefully
 		endpoint := service.Labels["endpoint"]
 		currency := service.Labels["currency"]
-		connCfg := &rpcclient.ConnConfig{
-			Host:         endpoint[7:] + "rpc",
-			HTTPPostMode: true, // Bitcoin core only supports HTTP POST mode
-			DisableTLS:   true, // Bitcoin core does not provide TLS by default
-		}
-		client, err := rpcclient.New(connCfg, nil)
+		client, err := q.coinserverClient(endpoint, currency)
 		if err != nil {
 			return err
 		}
@@ -51,19 +50,22 @@ func (q *NgWebAPI) ConfirmBlocks() error {
 		Height   int64 // Only for logging/debugging
 		Hash     string
 		Currency string
-		// For setting the utxo spendable
+		// For setting the utxo spendable. Empty for blocks the coinserver
+		// built (createauxblock), whose coinbase we learn here
 		CoinbaseHash string `db:"coinbase_hash"`
+		Subsidy      int64
 	}
 	var blocks []HashCurrency
 	err = q.db.Select(&blocks,
-		`SELECT hash, currency, height, coinbase_hash FROM block WHERE status = 'immature'`)
+		`SELECT hash, currency, height, coinbase_hash, subsidy FROM block
+		WHERE status = 'immature'`)
 	if err != nil {
 		return err
 	}
 	currencyHeights := map[string]int64{}
 	for _, block := range blocks {
 
-		config, ok := service.CurrencyConfig[block.Currency]
+		config, ok := service.Currency(block.Currency)
 		if !ok {
 			q.log.Error("Couldn't locate currency config", "block", block, "err", err)
 			continue
@@ -84,7 +86,7 @@ func (q *NgWebAPI) ConfirmBlocks() error {
 			q.log.Error("Invalid block hash in db", "block", block, "err", err)
 			continue
 		}
-		resp, err := rpc.GetBlockVerbose(hashObj)
+		resp, err := rpc.GetBlock(hashObj.String())
 		if err != nil {
 			q.log.Error("Failed to get block information from rpc", "block", block, "err", err)
 			continue
@@ -115,6 +117,11 @@ func (q *NgWebAPI) ConfirmBlocks() error {
 				"chainHeight", height,
 				"blockHeight", resp.Height,
 				"reqorphanconfirms", config.BlockMatureConfirms)
+			q.alerts.Fire(alert.BlockOrphaned, block.Currency, map[string]interface{}{
+				"currency": block.Currency,
+				"height":   resp.Height,
+				"hash":     block.Hash,
+			})
 		} else {
 			q.log.Debug("Block not mature",
 				"block", block,
@@ -134,7 +141,15 @@ func (q *NgWebAPI) ConfirmBlocks() error {
 				continue
 			}
 
-			if newStatus == "mature" {
+			if newStatus == "mature" && block.CoinbaseHash == "" {
+				err = recordCoinbase(tx, block.Hash, block.Currency, block.Subsidy, resp)
+				if err != nil {
+					tx.Rollback()
+					q.log.Error("Failed to record coinbase utxo",
+						"block", block, "err", err)
+					continue
+				}
+			} else if newStatus == "mature" {
 				_, err := tx.Exec(
 					`UPDATE utxo SET spendable = true WHERE hash = $1`, block.CoinbaseHash)
 				if err != nil {
@@ -160,3 +175,30 @@ func (q *NgWebAPI) ConfirmBlocks() error {
 	}
 	return nil
 }
+
+// Adds the spendable coinbase UTXO of a block the coinserver built, which
+// pays the whole subsidy to BlockSubsidyAddress, see coinbuddy's
+// createauxblock
+func recordCoinbase(tx *sql.Tx, hash string, currency string, subsidy int64, block *rpcclient.Block) error {
+	if len(block.Tx) == 0 {
+		return errors.New("Block has no transactions")
+	}
+	config, ok := service.Currency(currency)
+	if !ok {
+		return errors.Errorf("No currency config for %s", currency)
+	}
+	coinbaseHash, err := chainhash.NewHashFromStr(block.Tx[0])
+	if err != nil {
+		return err
+	}
+	encoded := hex.EncodeToString(coinbaseHash[:])
+	_, err = tx.Exec(
+		`INSERT INTO utxo (hash, vout, amount, currency, address, spendable)
+		VALUES ($1, 0, $2, $3, $4, true)`,
+		encoded, subsidy, currency, (*config.BlockSubsidyAddress).String())
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE block SET coinbase_hash = $1 WHERE hash = $2`, encoded, hash)
+	return err
+}
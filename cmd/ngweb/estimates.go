@@ -0,0 +1,122 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/icook/ngpool/pkg/common"
+	"github.com/icook/ngpool/pkg/service"
+)
+
+// How long a miner (or the whole pool) should expect to wait between blocks
+// of a currency at their current hashrate, from the coinservers' live network
+// difficulty and the stratums' decayed hashrates. These are averages, actual
+// time to a block is exponentially distributed around them
+type rateEstimate struct {
+	Hashrate float64 `json:"hashrate"`
+	// Fraction of the pool's hashrate on the currency's algo
+	PoolShare *float64 `json:"pool_share"`
+	// Seconds, nil with no hashrate
+	BlockTime *float64 `json:"block_time"`
+}
+
+type currencyEstimate struct {
+	Currency   string  `json:"currency"`
+	PowAlgo    string  `json:"powalgo"`
+	Difficulty float64 `json:"difficulty"`
+	// Hashes the network needs on average to find a block
+	BlockHashes float64       `json:"block_hashes"`
+	Pool        *rateEstimate `json:"pool"`
+	// Only when asked about a user, keyed by worker name
+	User    *rateEstimate            `json:"user,omitempty"`
+	Workers map[string]*rateEstimate `json:"workers,omitempty"`
+}
+
+func newRateEstimate(hashrate float64, poolHashrate float64, blockHashes float64) *rateEstimate {
+	est := &rateEstimate{Hashrate: hashrate}
+	if poolHashrate > 0 {
+		share := hashrate / poolHashrate
+		est.PoolShare = &share
+	}
+	if hashrate > 0 && blockHashes > 0 {
+		seconds := blockHashes / hashrate
+		est.BlockTime = &seconds
+	}
+	return est
+}
+
+// chainRates are hashrates by sharechain, and chainAlgos the algo each
+// sharechain mines. A sharechain only counts toward currencies of its algo.
+// username "" leaves out the user and worker estimates
+func estimateBlockTimes(samples []*networkStat, algos map[string]*service.Algo,
+	chainAlgos map[string]string, chainRates map[string]*common.HashrateStatus,
+	username string) []*currencyEstimate {
+	estimates := []*currencyEstimate{}
+	for _, sample := range samples {
+		algo, ok := algos[sample.PowAlgo]
+		if !ok || sample.Difficulty <= 0 {
+			continue
+		}
+		shares, _ := algo.Diff1SharesForTarget(algo.NetTarget(sample.Difficulty))
+		blockHashes := shares * float64(algo.HashesPerShare)
+
+		var (
+			pool    float64
+			user    float64
+			workers = map[string]float64{}
+		)
+		for chain, rates := range chainRates {
+			if chainAlgos[chain] != sample.PowAlgo {
+				continue
+			}
+			pool += rates.Port
+			user += rates.Addresses[username]
+			for name, rate := range rates.Workers[username] {
+				workers[name] += rate
+			}
+		}
+		est := &currencyEstimate{
+			Currency:    sample.Currency,
+			PowAlgo:     sample.PowAlgo,
+			Difficulty:  sample.Difficulty,
+			BlockHashes: blockHashes,
+			Pool:        newRateEstimate(pool, pool, blockHashes),
+		}
+		if username != "" {
+			est.User = newRateEstimate(user, pool, blockHashes)
+			est.Workers = map[string]*rateEstimate{}
+			for name, rate := range workers {
+				est.Workers[name] = newRateEstimate(rate, pool, blockHashes)
+			}
+		}
+		estimates = append(estimates, est)
+	}
+	sort.Slice(estimates, func(i, j int) bool {
+		if estimates[i].Currency != estimates[j].Currency {
+			return estimates[i].Currency < estimates[j].Currency
+		}
+		return estimates[i].PowAlgo < estimates[j].PowAlgo
+	})
+	return estimates
+}
+
+// Only served with EstimatesAPI on. A username adds estimates for them and
+// each of their workers
+func (q *NgWebAPI) getEstimates(c *gin.Context) {
+	q.coinserversMtx.RLock()
+	samples := sampleNetworkStats(q.coinservers, time.Now())
+	q.coinserversMtx.RUnlock()
+
+	chainAlgos := map[string]string{}
+	for name, chain := range service.ShareChain {
+		chainAlgos[name] = chain.AlgoName
+	}
+
+	q.stratumsMtx.RLock()
+	estimates := estimateBlockTimes(samples, service.AlgoConfig, chainAlgos, q.chainRates,
+		c.Param("username"))
+	q.stratumsMtx.RUnlock()
+	q.apiSuccess(c, 200, res{"estimates": estimates})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/icook/ngpool/pkg/common"
+	"github.com/icook/ngpool/pkg/service"
+)
+
+func TestEstimateBlockTimes(t *testing.T) {
+	// A difficulty 1 block is one difficulty 1 share, of 1000 hashes
+	algos := map[string]*service.Algo{
+		"scrypt": {ShareDiff1: big.NewFloat(1 << 16), NetDiff1: 1 << 16, HashesPerShare: 1000},
+	}
+	chainAlgos := map[string]string{"ltc": "scrypt", "btc": "sha256d"}
+	chainRates := map[string]*common.HashrateStatus{
+		"ltc": {
+			Port:      4000,
+			Addresses: map[string]float64{"alice": 1000},
+			Workers:   map[string]map[string]float64{"alice": {"rig1": 750, "rig2": 250}},
+		},
+		// Another algo doesn't count toward LTC
+		"btc": {
+			Port:      1e12,
+			Addresses: map[string]float64{"alice": 1e12},
+		},
+	}
+	samples := []*networkStat{
+		{Currency: "LTC", PowAlgo: "scrypt", Difficulty: 8},
+		{Currency: "DOGE", PowAlgo: "scrypt", Difficulty: 0},
+		{Currency: "BTC", PowAlgo: "sha256d", Difficulty: 1e12},
+	}
+
+	estimates := estimateBlockTimes(samples, algos, chainAlgos, chainRates, "alice")
+	assert.Len(t, estimates, 1)
+	ltc := estimates[0]
+	assert.Equal(t, "LTC", ltc.Currency)
+	assert.InEpsilon(t, 8000, ltc.BlockHashes, 1e-9)
+	assert.InEpsilon(t, 2, *ltc.Pool.BlockTime, 1e-9)
+	assert.InEpsilon(t, 1, *ltc.Pool.PoolShare, 1e-9)
+	assert.InEpsilon(t, 8, *ltc.User.BlockTime, 1e-9)
+	assert.InEpsilon(t, 0.25, *ltc.User.PoolShare, 1e-9)
+	assert.InEpsilon(t, 32, *ltc.Workers["rig2"].BlockTime, 1e-9)
+	assert.InEpsilon(t, 0.1875, *ltc.Workers["rig1"].PoolShare, 1e-9)
+
+	// Unknown users have no hashrate, so no block time
+	estimates = estimateBlockTimes(samples, algos, chainAlgos, chainRates, "bob")
+	assert.Nil(t, estimates[0].User.BlockTime)
+	assert.Len(t, estimates[0].Workers, 0)
+
+	estimates = estimateBlockTimes(samples, algos, chainAlgos, chainRates, "")
+	assert.Nil(t, estimates[0].User)
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
-	"fmt"
 	"github.com/icook/ngpool/pkg/service"
 	"github.com/lib/pq"
 	"github.com/pkg/errors"
@@ -38,12 +37,19 @@ type payoutBlock struct {
 
 	algoConfig    *service.Algo
 	lastBlockTime time.Time
+	// Orphaned blocks since lastBlockTime, whose rounds roll into this one
+	orphansCarried int
 }
 
 type ShareChainPayout struct {
-	// Loaded from SQL GROUP BY
-	Difficulty float64
-	Name       string `db:"sharechain"`
+	// Loaded from SQL GROUP BY. Difficulty is scaled by payout weights for
+	// the block's currency, RawDifficulty isn't
+	Difficulty    float64
+	RawDifficulty float64 `db:"raw_difficulty"`
+	Name          string  `db:"sharechain"`
+	// Difficulty is multiplied by this when splitting between sharechains,
+	// see AlgoNormalization
+	Normalization float64
 
 	// Values used for computing user payouts
 	config         *service.ShareChainConfig
@@ -61,83 +67,195 @@ type CreditMap struct {
 	UserID     int `db:"user_id"`
 }
 
-func (q *NgWebAPI) processBlock(block *payoutBlock) error {
-	q.log.Info("Starting payout", "block", block)
+// When the block before height on currency was mined, which is when the round
+// for the block at height started. Zero if there wasn't one
+func (q *NgWebAPI) lastBlockTime(currency string, height int64) (time.Time, error) {
+	var minedAt time.Time
+	err := q.db.QueryRowx(
+		`SELECT mined_at FROM block
+		WHERE height < $1 AND currency = $2
+		ORDER BY height DESC LIMIT 1`,
+		height, currency).Scan(&minedAt)
+	if err != nil && err != sql.ErrNoRows {
+		return minedAt, err
+	}
+	return minedAt, nil
+}
+
+// When the round for the block at height on currency started. That's when
+// the last block before it that wasn't orphaned was mined, so an orphaned
+// block's round rolls into the next and its shares still get paid. Also
+// returns how many orphans were rolled in
+func (q *NgWebAPI) roundStart(currency string, height int64) (time.Time, int, error) {
+	var (
+		start   time.Time
+		orphans int
+	)
+	err := q.db.QueryRowx(
+		`SELECT mined_at FROM block
+		WHERE height < $1 AND currency = $2 AND status != 'orphan'
+		ORDER BY height DESC LIMIT 1`,
+		height, currency).Scan(&start)
+	if err != nil && err != sql.ErrNoRows {
+		return start, 0, err
+	}
+	err = q.db.QueryRowx(
+		`SELECT COUNT(*) FROM block
+		WHERE height < $1 AND currency = $2 AND status = 'orphan' AND mined_at >= $3`,
+		height, currency, start).Scan(&orphans)
+	if err != nil {
+		return start, 0, err
+	}
+	return start, orphans, nil
+}
+
+// A block's subsidy split between sharechains, and each sharechain's part
+// between users
+type blockPayout struct {
+	sharechains []*ShareChainPayout
+	// By sharechain name
+	credits          map[string][]*CreditMap
+	shareChainsTotal float64
+	// Satoshis left over from splitting between sharechains, given to the
+	// first
+	rounded int64
+}
+
+// Works out the credits for a block from the shares in the database, without
+// writing anything
+func (q *NgWebAPI) blockCredits(block *payoutBlock) (*blockPayout, error) {
 	// Get all the shares involced in the block solve by chain. This number is
 	// used to split the block reward between share chains proportionally for
 	// their effort
 	// =====
 	// get last block solve time
-	err := q.db.QueryRowx(
-		`SELECT mined_at FROM block
-		WHERE height < $1 AND currency = $2
-		ORDER BY height DESC`,
-		block.Height, block.Currency).Scan(&block.lastBlockTime)
-	if err != nil && err != sql.ErrNoRows {
-		return err
+	var err error
+	block.lastBlockTime, block.orphansCarried, err = q.roundStart(block.Currency, block.Height)
+	if err != nil {
+		return nil, err
+	}
+	q.log.Debug("Got last block time", "time", block.lastBlockTime,
+		"orphans_carried", block.orphansCarried)
+
+	// Blocks paid in the coinbase were already split by the stratum
+	payout, err := q.coinbaseCredits(block)
+	if err != nil || payout != nil {
+		return payout, err
 	}
-	q.log.Debug("Got last block time", "time", block.lastBlockTime)
 
 	// get share count for each chain
 	var sharechains []*ShareChainPayout
 	err = q.db.Select(&sharechains,
 		`SELECT sharechain, 
-		SUM (difficulty) as difficulty
+		SUM (difficulty * `+payoutWeightSQL("$4")+`) as difficulty,
+		SUM (difficulty) as raw_difficulty
 		FROM share 
 		WHERE mined_at >= $1 AND mined_at <= $2 AND currencies @> $3
 		GROUP BY sharechain`,
-		block.lastBlockTime, block.MinedAt, pq.StringArray([]string{block.Currency}))
+		block.lastBlockTime, block.MinedAt, pq.StringArray([]string{block.Currency}),
+		block.Currency)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if len(sharechains) == 0 {
+		return nil, errors.Errorf("No shares in the round for block %s", block.Hash)
 	}
 	// Lookup the config for each chain
 	for _, sc := range sharechains {
 		config, ok := service.ShareChain[sc.Name]
 		if !ok {
-			return errors.Errorf("Unknown ShareChain %s", sc.Name)
+			return nil, errors.Errorf("Unknown ShareChain %s", sc.Name)
 		}
 		sc.config = config
 		q.log.Info("Loaded ShareChainConfig", "config", config)
+		sc.Normalization, err = q.normalizeFactor(config, block)
+		if err != nil {
+			return nil, err
+		}
+	}
+	shareChainsTotal, rounded, err := splitSubsidy(sharechains, block.Subsidy)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Splitting block %s", block.Hash)
+	}
+	q.log.Debug("Giving rounded sharechain remainder",
+		"remainder", rounded, "sharechain", sharechains[0].Name)
+
+	// Calculate fees for all chains and run payout function
+	payout = &blockPayout{
+		sharechains:      sharechains,
+		credits:          map[string][]*CreditMap{},
+		shareChainsTotal: shareChainsTotal,
+		rounded:          rounded,
+	}
+	for _, sc := range sharechains {
+		sc.SubsidyFee = int64(sc.config.Fee * float64(sc.Subsidy))
+		sc.SubsidyPayable = sc.Subsidy - sc.SubsidyFee
+
+		method, ok := PayoutMethods[sc.config.PayoutMethod]
+		if !ok {
+			return nil, errors.Errorf("Invalid payout method %s during payout!", sc.config.PayoutMethod)
+		}
+		credits, err := method.Credit(q, sc, block)
+		if err != nil {
+			return nil, err
+		}
+		payout.credits[sc.Name] = credits
+	}
+	return payout, nil
+}
+
+// Splits subsidy between sharechains by their normalized difficulty. Payout
+// weights are left out when they'd leave nothing to split by, which happens
+// when everyone in the round picked other payout currencies with pc=. None of
+// their users are owed any of it then, so it all goes to the fee user. The
+// satoshi lost to rounding goes to the first sharechain, it won't ever be
+// much (if any). This keeps accounting clean
+func splitSubsidy(sharechains []*ShareChainPayout, subsidy int64) (float64, int64, error) {
+	weight := func(sc *ShareChainPayout) float64 {
+		return sc.Difficulty * sc.Normalization
 	}
-	var shareChainsTotal float64 = 0
+	var total float64
 	for _, sc := range sharechains {
-		shareChainsTotal += sc.Difficulty
+		total += weight(sc)
 	}
-	var totalCredited int64 = 0
+	if total <= 0 {
+		weight = func(sc *ShareChainPayout) float64 {
+			return sc.RawDifficulty * sc.Normalization
+		}
+		for _, sc := range sharechains {
+			total += weight(sc)
+		}
+	}
+	if total <= 0 {
+		return 0, 0, errors.New("No share difficulty to split by")
+	}
+	var credited int64
 	for _, sc := range sharechains {
-		sc.Subsidy = int64((sc.Difficulty / shareChainsTotal) * float64(block.Subsidy))
-		totalCredited += sc.Subsidy
+		sc.Subsidy = int64(weight(sc) / total * float64(subsidy))
+		credited += sc.Subsidy
 	}
-	// Give the rounded satoshi to the first sharechain, it won't ever be much
-	// (if any). This keeps accounting clean
-	if totalCredited > block.Subsidy {
-		return errors.New("Float math rounding overflow")
+	if credited > subsidy {
+		return 0, 0, errors.New("Float math rounding overflow")
 	}
-	rounded := block.Subsidy - totalCredited
-	q.log.Debug("Giving rounded sharechain remainder",
-		"remainder", rounded, "sharechain", sharechains[0].Name)
+	rounded := subsidy - credited
 	sharechains[0].Subsidy += rounded
+	return total, rounded, nil
+}
+
+func (q *NgWebAPI) processBlock(block *payoutBlock) error {
+	q.log.Info("Starting payout", "block", block)
+	payout, err := q.blockCredits(block)
+	if err != nil {
+		return err
+	}
+	sharechains := payout.sharechains
 
-	// Calculate fees for all chains and run payout function
 	tx, err := q.db.Begin()
 	if err != nil {
 		return err
 	}
 	for _, sc := range sharechains {
-		sc.SubsidyFee = int64(sc.config.Fee * float64(sc.Subsidy))
-		sc.SubsidyPayable = sc.Subsidy - sc.SubsidyFee
-
-		var credits []*CreditMap
-		switch sc.config.PayoutMethod {
-		case "pplns":
-			credits, err = q.payoutPPLNS(sc, block)
-			if err != nil {
-				return err
-			}
-		default:
-			return errors.New("Invalid payout method during payout!")
-		}
-		for _, c := range credits {
+		for _, c := range payout.credits[sc.Name] {
 			q.log.Info("Inserting credit", "credit", c, "sc", sc.Name, "block", block)
 			_, err = tx.Exec(
 				`INSERT INTO credit
@@ -156,11 +274,12 @@ func (q *NgWebAPI) processBlock(block *payoutBlock) error {
 	// are operating, debugging, and testing
 	payoutData := map[string]interface{}{
 		"credited_at":                   time.Now(),
-		"sharechain_rounding_amount":    rounded,
+		"sharechain_rounding_amount":    payout.rounded,
 		"sharechain_rounding_recipient": sharechains[0].Name,
 		"sharechains":                   sharechains,
-		"sharechain_total":              shareChainsTotal,
+		"sharechain_total":              payout.shareChainsTotal,
 		"last_block_time":               block.lastBlockTime,
+		"orphans_carried":               block.orphansCarried,
 	}
 	serial, err := json.Marshal(payoutData)
 	if err != nil {
@@ -197,7 +316,14 @@ func (q *NgWebAPI) payoutPPLNS(sc *ShareChainPayout, block *payoutBlock) ([]*Cre
 	q.log.Info("Calculated required shares",
 		"accuracy", acc, "requiredShares", sharesToFind, "target", block.Target, "diff1", block.algoConfig.ShareDiff1)
 
-	userShares, total, err := q.collectShares(sharesToFind, sc.Name, block.MinedAt)
+	// The window reaches back at least as far as the rounds of any orphaned
+	// blocks before this one, so their shares aren't lost
+	carryFrom := block.MinedAt
+	if block.orphansCarried > 0 {
+		carryFrom = block.lastBlockTime
+	}
+	userShares, total, err := q.collectShares(sharesToFind, sc.Name, block.Currency,
+		block.MinedAt, carryFrom)
 	if err != nil {
 		return nil, err
 	}
@@ -207,56 +333,44 @@ func (q *NgWebAPI) payoutPPLNS(sc *ShareChainPayout, block *payoutBlock) ([]*Cre
 		"diff1":        block.algoConfig.ShareDiff1,
 		"sharesToFind": sharesToFind,
 		"sharesFound":  total,
+		"carriedFrom":  carryFrom,
 	}
 
-	q.log.Info("Computing credits for users")
-	var credits []*CreditMap
-	for userID, shares := range userShares {
-		fract := shares / total
-		amount := int64(float64(sc.SubsidyPayable) * fract)
-		if userID == 1 {
-			amount += sc.SubsidyFee
-		}
-		// A fee percentage of 0 will often create empty fee entries, so we
-		// must check to ensure we don't create empty credits which break
-		// things later on
-		if amount <= 0 {
-			continue
-		}
-		c := &CreditMap{
-			UserID:     userID,
-			Difficulty: shares,
-			Amount:     amount,
-			Fee:        float64(sc.SubsidyFee) * fract,
-		}
-		fmt.Printf("%+v\n", c)
-		credits = append(credits, c)
-	}
-	return credits, nil
+	return creditsFromShares(sc, userShares, total), nil
 }
 
+// The window is counted in difficulty, but each share is credited by its
+// payoutWeightSQL for currency. Returns the credited total, so what miners
+// gave up with pc= goes to the rest of the window rather than the fee user.
+// Shares mined after carryFrom are always in the window, however many there
+// are
 func (q *NgWebAPI) collectShares(shareCount float64, shareChainName string,
-	start time.Time) (map[int]float64, float64, error) {
+	currency string, start time.Time, carryFrom time.Time) (map[int]float64, float64, error) {
 	// Our userShares map always has an entry for the fee user, to ensure a
 	// credit is always generated for them
 	var (
 		accumulatedShares float64 = 0
+		credited          float64 = 0
 		userShares                = map[int]float64{1: 0}
 		selectOffset              = 0
 	)
 	type Share struct {
 		Difficulty float64
-		UserID     *int `db:"id"`
+		Weight     float64
+		UserID     *int      `db:"id"`
+		MinedAt    time.Time `db:"mined_at"`
 	}
 	for {
 		var shares []Share
 		err := q.db.Select(&shares,
-			`SELECT share.difficulty, users.id FROM share
+			`SELECT share.difficulty, `+payoutWeightSQL("$4")+` AS weight, users.id,
+			share.mined_at
+			FROM share
 			LEFT JOIN users ON users.username = share.username
 			WHERE share.mined_at < $1 AND share.sharechain = $2
 			ORDER BY share.mined_at DESC
 			LIMIT 100 OFFSET $3`,
-			start, shareChainName, selectOffset)
+			start, shareChainName, selectOffset, currency)
 		if err != nil && err != sql.ErrNoRows {
 			return nil, 0, err
 		}
@@ -274,27 +388,45 @@ func (q *NgWebAPI) collectShares(shareCount float64, shareChainName string,
 			} else {
 				userID = *share.UserID
 			}
-			userShares[userID] += share.Difficulty
+			userShares[userID] += share.Difficulty * share.Weight
+			credited += share.Difficulty * share.Weight
 
 			// Exit if we have the amount of shares we need
 			accumulatedShares += share.Difficulty
-			if accumulatedShares >= shareCount {
+			if accumulatedShares >= shareCount && !share.MinedAt.After(carryFrom) {
 				// TODO: With very large share difficulties and low block diff
 				// we might have unbalanced, we should remove the excess ideally
-				return userShares, accumulatedShares, nil
+				return userShares, credited, nil
 			}
 		}
 		selectOffset += 100
 	}
-	return userShares, accumulatedShares, nil
+	return userShares, credited, nil
 }
 
-func (q *NgWebAPI) GenerateCredits() error {
+// Mature blocks that haven't been credited. A block waits while an earlier
+// one on its currency is still immature, since if that's orphaned its round
+// becomes part of this block's
+func (q *NgWebAPI) creditableBlocks() ([]payoutBlock, error) {
 	var blocks []payoutBlock
 	// TODO: This for update isn't implemented in a transaction, so it does nothing
 	err := q.db.Select(&blocks,
 		`SELECT currency, height, hash, powalgo, subsidy, mined_at, target
-		FROM block WHERE status = 'mature' AND credited = false FOR UPDATE`)
+		FROM block WHERE status = 'mature' AND credited = false
+		AND NOT EXISTS (SELECT 1 FROM block earlier
+			WHERE earlier.currency = block.currency AND earlier.height < block.height
+			AND earlier.status = 'immature')
+		FOR UPDATE`)
+	return blocks, err
+}
+
+func (q *NgWebAPI) GenerateCredits() error {
+	// Blocks on shift sharechains can't be credited until their shift closes
+	err := q.CloseShifts()
+	if err != nil {
+		return err
+	}
+	blocks, err := q.creditableBlocks()
 	if err != nil {
 		return err
 	}
@@ -307,6 +439,10 @@ func (q *NgWebAPI) GenerateCredits() error {
 		q.log.Debug("Loaded AlgoConfig", "config", config, "block", block.Hash)
 
 		err := q.processBlock(&block)
+		if err == errShiftOpen {
+			q.log.Info("Block's shift isn't closed yet, skipping", "block", block.Hash)
+			continue
+		}
 		if err != nil {
 			return err
 		}
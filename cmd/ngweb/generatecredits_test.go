@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
 	"math/rand"
 	"strconv"
 	"testing"
@@ -45,7 +46,7 @@ func NewHarness(t *testing.T, configs ...string) *TestHarness {
 		fmt.Sprintf("user=%s dbname=ngpool sslmode=disable password=knight", username))
 	adminClient := qt.db
 	qt.ConnectDB()
-	qt.LoadFixtures("tables")
+	qt.mustMigrate()
 	qt.ParseConfig()
 
 	h := TestHarness{
@@ -93,3 +94,120 @@ Currencies:
 	}
 	t.FailNow()
 }
+
+const roundTestConfig = `
+ShareChains:
+    "LTC_T":
+        name: "LTC_T"
+        fee: 0.01
+        payoutmethod: "pplns"
+`
+
+// Adds a block on LTC_T, and the coinbase UTXO it references
+func (h *TestHarness) addBlock(height int64, status string, minedAt time.Time) {
+	hash := fmt.Sprintf("%064d", height)
+	h.db.MustExec(`INSERT INTO utxo (currency, address, hash, vout, amount)
+		VALUES ('LTC_T', '', $1, 0, 2000000000)`, "cb"+hash)
+	h.db.MustExec(`INSERT INTO block (currency, powalgo, height, hash,
+		coinbase_hash, powhash, subsidy, mined_at, mined_by, target, status)
+		VALUES ('LTC_T', 'scrypt', $1, $2, $3, '', 2000000000, $4, '', 1, $5)`,
+		height, hash, "cb"+hash, minedAt, status)
+}
+
+// Adds a share on LTC_T for each of minedAt
+func (h *TestHarness) addShares(username string, minedAt ...time.Time) {
+	for _, at := range minedAt {
+		h.db.MustExec(`INSERT INTO share (username, difficulty, mined_at, sharechain, currencies)
+			VALUES ($1, 1, $2, 'LTC_T', '{LTC_T}')`, username, at)
+	}
+}
+
+func TestRoundCarriesOrphans(t *testing.T) {
+	ng := NewHarness(t, roundTestConfig)
+	defer ng.Cleanup()
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	ng.addBlock(10, "mature", start)
+	ng.addBlock(11, "orphan", start.Add(time.Hour))
+	ng.addBlock(12, "mature", start.Add(2*time.Hour))
+	ng.addShares("icook", start.Add(30*time.Minute), start.Add(90*time.Minute),
+		start.Add(100*time.Minute))
+
+	// The orphan's round rolls into block 12's, back to block 10
+	roundStart, orphans, err := ng.roundStart("LTC_T", 12)
+	assert.NoError(t, err)
+	assert.True(t, start.Equal(roundStart))
+	assert.Equal(t, 1, orphans)
+
+	// So every share since block 10 is credited, though the window was
+	// filled by the first
+	_, total, err := ng.collectShares(1, "LTC_T", "LTC_T",
+		start.Add(2*time.Hour), roundStart)
+	assert.NoError(t, err)
+	assert.Equal(t, 3.0, total)
+}
+
+func TestRoundWithoutOrphans(t *testing.T) {
+	ng := NewHarness(t, roundTestConfig)
+	defer ng.Cleanup()
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	ng.addBlock(10, "mature", start)
+	ng.addBlock(12, "mature", start.Add(2*time.Hour))
+	ng.addShares("icook", start.Add(30*time.Minute), start.Add(90*time.Minute),
+		start.Add(100*time.Minute))
+
+	roundStart, orphans, err := ng.roundStart("LTC_T", 12)
+	assert.NoError(t, err)
+	assert.True(t, start.Equal(roundStart))
+	assert.Equal(t, 0, orphans)
+
+	// payoutPPLNS carries from the block itself, so the window stops once
+	// it's filled
+	minedAt := start.Add(2 * time.Hour)
+	_, total, err := ng.collectShares(1, "LTC_T", "LTC_T", minedAt, minedAt)
+	assert.NoError(t, err)
+	assert.Equal(t, 1.0, total)
+}
+
+func TestCreditableBlocksWaitForImmature(t *testing.T) {
+	ng := NewHarness(t, roundTestConfig)
+	defer ng.Cleanup()
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	ng.addBlock(10, "immature", start)
+	ng.addBlock(12, "mature", start.Add(2*time.Hour))
+
+	// Block 10 might yet be orphaned and roll into block 12's round
+	blocks, err := ng.creditableBlocks()
+	assert.NoError(t, err)
+	assert.Empty(t, blocks)
+
+	ng.db.MustExec(`UPDATE block SET status = 'orphan' WHERE height = 10`)
+	blocks, err = ng.creditableBlocks()
+	assert.NoError(t, err)
+	if assert.Len(t, blocks, 1) {
+		assert.Equal(t, int64(12), blocks[0].Height)
+	}
+}
+
+func TestSplitSubsidy(t *testing.T) {
+	a := &ShareChainPayout{Name: "a", Difficulty: 30, RawDifficulty: 60, Normalization: 1}
+	b := &ShareChainPayout{Name: "b", Difficulty: 70, RawDifficulty: 70, Normalization: 1}
+	total, rounded, err := splitSubsidy([]*ShareChainPayout{a, b}, 1001)
+	assert.NoError(t, err)
+	assert.Equal(t, 100.0, total)
+	assert.Equal(t, int64(1), rounded)
+	assert.Equal(t, int64(301), a.Subsidy)
+	assert.Equal(t, int64(700), b.Subsidy)
+
+	// Everyone picked other payout currencies, so it's split unweighted
+	// rather than by NaN
+	a.Difficulty, b.Difficulty = 0, 0
+	total, _, err = splitSubsidy([]*ShareChainPayout{a, b}, 1300)
+	assert.NoError(t, err)
+	assert.Equal(t, 130.0, total)
+	assert.Equal(t, int64(600), a.Subsidy)
+	assert.Equal(t, int64(700), b.Subsidy)
+
+	a.RawDifficulty, b.RawDifficulty = 0, 0
+	_, _, err = splitSubsidy([]*ShareChainPayout{a, b}, 1300)
+	assert.Error(t, err)
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"database/sql"
+	"encoding/hex"
 	sq "github.com/Masterminds/squirrel"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/gin-gonic/gin"
 	"github.com/icook/ngpool/pkg/service"
 	"github.com/jmoiron/sqlx/types"
@@ -22,7 +24,36 @@ type Block struct {
 	MinedAt  time.Time `db:"mined_at" json:"mined_at"`
 	Target   float64   `json:"target"`
 
-	Difficulty float64 `json:"difficulty"`
+	// How the reward split between fees and the chain's subsidy, its
+	// transaction count with the coinbase, and its size in bytes. Nil for
+	// blocks saved before these were recorded
+	Fees        *int64 `json:"fees"`
+	BaseSubsidy *int64 `db:"base_subsidy" json:"base_subsidy"`
+	TxCount     *int   `db:"tx_count" json:"tx_count"`
+	Size        *int   `json:"size"`
+
+	// Nil until the round's shares have been tallied, see UpdateBlockEfforts
+	Effort      *float64 `json:"effort"`
+	Difficulty  float64  `json:"difficulty"`
+	ExplorerURL string   `json:"explorer_url,omitempty"`
+}
+
+// Blocks are stored with their hash in internal byte order, explorers want it
+// reversed like the coinserver displays it
+func blockExplorerURL(currency string, hash string) string {
+	config, ok := service.Currency(currency)
+	if !ok {
+		return ""
+	}
+	decoded, err := hex.DecodeString(hash)
+	if err != nil {
+		return ""
+	}
+	hashObj, err := chainhash.NewHash(decoded)
+	if err != nil {
+		return ""
+	}
+	return config.BlockURL(hashObj.String())
 }
 
 type Credit struct {
@@ -40,7 +71,8 @@ func (q *NgWebAPI) getBlocks(c *gin.Context) {
 	psql := sq.StatementBuilder.PlaceholderFormat(sq.Dollar)
 	page, _ := strconv.Atoi(c.DefaultQuery("page", "0"))
 	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "100"))
-	base := psql.Select("currency, height, hash, powalgo, subsidy, mined_at, target, status").
+	base := psql.Select("currency, height, hash, powalgo, subsidy, mined_at, target, status, effort",
+		"fees, base_subsidy, tx_count, size").
 		From("block").OrderBy("mined_at DESC").
 		Limit(uint64(pageSize)).Offset(uint64(page * pageSize))
 	if maturity, ok := c.GetQuery("maturity"); ok && maturity != "" {
@@ -65,8 +97,9 @@ func (q *NgWebAPI) getBlocks(c *gin.Context) {
 	for _, block := range blocks {
 		algo, ok := service.AlgoConfig[block.PowAlgo]
 		if ok {
-			block.Difficulty = algo.NetDiff1 / block.Target
+			block.Difficulty = algo.NetDifficulty(block.Target)
 		}
+		block.ExplorerURL = blockExplorerURL(block.Currency, block.Hash)
 	}
 	q.apiSuccess(c, 200, res{"blocks": blocks})
 }
@@ -84,7 +117,8 @@ func (q *NgWebAPI) getBlock(c *gin.Context) {
 	err := q.db.QueryRowx(
 		`SELECT
 		currency, height, hash, powalgo, subsidy, mined_at, target, status,
-		payout_data, powhash, credited
+		effort, fees, base_subsidy, tx_count, size, payout_data, powhash,
+		credited
 		FROM block WHERE hash = $1`, blockhash).StructScan(&block)
 	if err == sql.ErrNoRows {
 		q.apiError(c, 404, APIError{
@@ -96,6 +130,8 @@ func (q *NgWebAPI) getBlock(c *gin.Context) {
 		return
 	}
 
+	block.ExplorerURL = blockExplorerURL(block.Currency, block.Hash)
+
 	var credits = []Credit{}
 	err = q.db.Select(&credits,
 		`SELECT users.username, credit.user_id, credit.amount, credit.sharechain
@@ -106,14 +142,23 @@ func (q *NgWebAPI) getBlock(c *gin.Context) {
 		return
 	}
 
-	q.apiSuccess(c, 200, res{"block": block, "credits": credits})
+	var efforts = []blockEffort{}
+	err = q.db.Select(&efforts,
+		`SELECT sharechain, difficulty, effort FROM block_effort
+		WHERE blockhash = $1 ORDER BY sharechain`, blockhash)
+	if err != nil {
+		q.apiException(c, 500, errors.WithStack(err), SQLError)
+		return
+	}
+
+	q.apiSuccess(c, 200, res{"block": block, "credits": credits, "efforts": efforts})
 }
 
 func (q *NgWebAPI) getCommon(c *gin.Context) {
 	q.apiSuccess(c, 200, res{
-		"raw_currencies": service.RawCurrencyConfig,
+		"raw_currencies": service.RawCurrencies(),
 		"sharechains":    service.ShareChain,
-		"currencies":     service.CurrencyConfig,
+		"currencies":     service.Currencies(),
 		"algos":          service.AlgoConfig,
 	})
 }
@@ -181,6 +226,18 @@ func (q *NgWebAPI) getMinuteShares(c *gin.Context) {
 	q.apiSuccess(c, 200, res{"minute_shares": keys})
 }
 
+// Decayed hashrate estimates published by the stratum servers. Pool is the
+// sum of all ports
+func (q *NgWebAPI) getHashrate(c *gin.Context) {
+	q.stratumsMtx.RLock()
+	defer q.stratumsMtx.RUnlock()
+	q.apiSuccess(c, 200, res{
+		"pool":   q.hashrate.Port,
+		"ports":  q.portRates,
+		"miners": len(q.hashrate.Addresses),
+	})
+}
+
 func (q *NgWebAPI) getServices(c *gin.Context) {
 	// TODO: This structure could be serialized on each update in the listener
 	// to avoid possible funkiness with locks here
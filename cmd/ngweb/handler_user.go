@@ -9,10 +9,10 @@ import (
 
 	sq "github.com/Masterminds/squirrel"
 	"github.com/btcsuite/btcd/btcjson"
-	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcutil"
 	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
 	"golang.org/x/crypto/bcrypt"
 
@@ -29,11 +29,19 @@ type Payout struct {
 	Address  string `json:"address"`
 	Amount   int64  `json:"amount"`
 	MinerFee int64  `db:"fee" json:"miner_fee"`
+	PoolFee  int64  `db:"pool_fee" json:"pool_fee"`
 	Currency string `json:"currency"`
 
-	TXID      string     `db:"hash" json:"txid"`
-	Sent      *time.Time `json:"sent"`
-	Confirmed bool       `json:"confirmed"`
+	TXID        string     `db:"hash" json:"txid"`
+	Sent        *time.Time `json:"sent"`
+	Confirmed   bool       `json:"confirmed"`
+	ExplorerURL string     `db:"-" json:"explorer_url,omitempty"`
+}
+
+func (p *Payout) setExplorerURL() {
+	if config, ok := service.Currency(p.Currency); ok {
+		p.ExplorerURL = config.TxURL(p.TXID)
+	}
 }
 
 func (q *NgWebAPI) getUnpaid(c *gin.Context) {
@@ -60,7 +68,7 @@ func (q *NgWebAPI) getPayout(c *gin.Context) {
 	psql := sq.StatementBuilder.PlaceholderFormat(sq.Dollar)
 	page, _ := strconv.Atoi(c.DefaultQuery("page", "0"))
 	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "100"))
-	base := psql.Select("p.address, p.amount, p.fee, pt.sent, pt.hash, pt.confirmed, pt.currency").
+	base := psql.Select("p.address, p.amount, p.fee, p.pool_fee, pt.sent, pt.hash, pt.confirmed, pt.currency").
 		From("payout as p").
 		Join("payout_transaction as pt ON pt.hash = p.payout_transaction").
 		OrderBy("pt.sent DESC").
@@ -81,6 +89,7 @@ func (q *NgWebAPI) getPayout(c *gin.Context) {
 		q.apiException(c, 500, errors.WithStack(err), SQLError)
 		return
 	}
+	payout.setExplorerURL()
 
 	var credits = []Credit{}
 	err = q.db.Select(&credits,
@@ -103,7 +112,7 @@ func (q *NgWebAPI) getPayouts(c *gin.Context) {
 	psql := sq.StatementBuilder.PlaceholderFormat(sq.Dollar)
 	page, _ := strconv.Atoi(c.DefaultQuery("page", "0"))
 	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "100"))
-	base := psql.Select("p.address, p.amount, p.fee, pt.sent, pt.hash, pt.confirmed, pt.currency").
+	base := psql.Select("p.address, p.amount, p.fee, p.pool_fee, pt.sent, pt.hash, pt.confirmed, pt.currency").
 		From("payout as p").
 		Join("payout_transaction as pt ON pt.hash = p.payout_transaction").
 		OrderBy("pt.sent DESC").
@@ -119,6 +128,9 @@ func (q *NgWebAPI) getPayouts(c *gin.Context) {
 		q.apiException(c, 500, errors.WithStack(err), SQLError)
 		return
 	}
+	for _, payout := range payouts {
+		payout.setExplorerURL()
+	}
 	q.apiSuccess(c, 200, res{"payouts": payouts})
 }
 
@@ -126,7 +138,7 @@ func (q *NgWebAPI) getMe(c *gin.Context) {
 	userID := c.GetInt("userID")
 	user := make(map[string]interface{})
 	err := q.db.QueryRowx(
-		"SELECT id, email, username FROM users WHERE id = $1",
+		"SELECT id, email, username, public_stats FROM users WHERE id = $1",
 		userID).MapScan(user)
 	if err != nil {
 		q.apiException(c, 500, errors.WithStack(err), SQLError)
@@ -141,7 +153,7 @@ func (q *NgWebAPI) getMe(c *gin.Context) {
 		return
 	}
 	addrMap := map[string]string{}
-	for _, currency := range service.CurrencyConfig {
+	for _, currency := range service.Currencies() {
 		addrMap[currency.Code] = ""
 	}
 	for _, addr := range payoutAddrs {
@@ -196,14 +208,30 @@ func (q *NgWebAPI) postSetPayout(c *gin.Context) {
 		return
 	}
 	userID := c.GetInt("userID")
-	config, ok := service.CurrencyConfig[req.Currency]
+	config, ok := service.Currency(req.Currency)
 	if !ok {
 		q.apiError(c, 400, APIError{
 			Code:  "invalid_currency",
 			Title: "No currency with that code"})
 		return
 	}
-	_, err := btcutil.DecodeAddress(req.Address, config.Params)
+	codec, err := common.GetAddressCodec(config.Code)
+	if err != nil {
+		q.apiException(c, 500, errors.WithStack(err), APIError{
+			Code:  "invalid_currency",
+			Title: "Currency has no address codec"})
+		return
+	}
+	script, err := codec.PayToScript(req.Address)
+	if err != nil {
+		q.apiError(c, 400, APIError{
+			Code:  "invalid_address",
+			Title: "Address given is not valid for that network"})
+		return
+	}
+	// Store addresses in the currency's preferred encoding, ie a legacy
+	// address given for a cashaddr currency gets converted
+	address, err := codec.ScriptAddress(script)
 	if err != nil {
 		q.apiError(c, 400, APIError{
 			Code:  "invalid_address",
@@ -215,7 +243,7 @@ func (q *NgWebAPI) postSetPayout(c *gin.Context) {
 		(address, currency, user_id)
 		VALUES ($1, $2, $3) ON CONFLICT (user_id, currency) DO UPDATE
 		SET address = $1`,
-		req.Address, req.Currency, userID)
+		address, req.Currency, userID)
 	if err != nil {
 		q.apiException(c, 500, errors.WithStack(err), SQLError)
 		return
@@ -223,10 +251,98 @@ func (q *NgWebAPI) postSetPayout(c *gin.Context) {
 	c.Status(200)
 }
 
+// Queues an immediate payout of the user's unpaid balance. The next
+// createpayout call from the signer starts an on-demand run to pay it
+func (q *NgWebAPI) postRequestPayout(c *gin.Context) {
+	type PayoutRequest struct {
+		Currency string `validate:"required" json:"currency"`
+	}
+	var req PayoutRequest
+	if !q.BindValid(c, &req) {
+		return
+	}
+	userID := c.GetInt("userID")
+	config, ok := service.Currency(req.Currency)
+	if !ok {
+		q.apiError(c, 400, APIError{
+			Code:  "invalid_currency",
+			Title: "No currency with that code"})
+		return
+	}
+
+	var hasAddress bool
+	err := q.db.Get(&hasAddress,
+		`SELECT EXISTS (SELECT 1 FROM payout_address
+		WHERE user_id = $1 AND currency = $2)`, userID, config.Code)
+	if err != nil {
+		q.apiException(c, 500, errors.WithStack(err), SQLError)
+		return
+	}
+	if !hasAddress {
+		q.apiError(c, 400, APIError{
+			Code:  "no_payout_address",
+			Title: "No payout address set for that currency"})
+		return
+	}
+
+	var lastRequest *time.Time
+	err = q.db.Get(&lastRequest,
+		`SELECT max(requested_at) FROM payout_request
+		WHERE user_id = $1 AND currency = $2`, userID, config.Code)
+	if err != nil {
+		q.apiException(c, 500, errors.WithStack(err), SQLError)
+		return
+	}
+	cooldown := q.config.GetDuration("OnDemandPayoutCooldown")
+	if lastRequest != nil && time.Since(*lastRequest) < cooldown {
+		q.apiError(c, 429, APIError{
+			Code:   "payout_cooldown",
+			Title:  "Payout requested too recently",
+			Detail: "Next request allowed at " + lastRequest.Add(cooldown).Format(time.RFC3339)})
+		return
+	}
+
+	var balance int64
+	err = q.db.Get(&balance,
+		`SELECT COALESCE(sum(amount), 0) FROM credit
+		WHERE user_id = $1 AND currency = $2 AND payout_transaction IS NULL`,
+		userID, config.Code)
+	if err != nil {
+		q.apiException(c, 500, errors.WithStack(err), SQLError)
+		return
+	}
+	if balance < config.OnDemandPayoutMinimum {
+		q.apiError(c, 400, APIError{
+			Code:  "below_minimum",
+			Title: "Unpaid balance is below the on-demand payout minimum"})
+		return
+	}
+
+	// The unique index on pending requests makes this safe against double
+	// submits
+	_, err = q.db.Exec(
+		`INSERT INTO payout_request (user_id, currency) VALUES ($1, $2)`,
+		userID, config.Code)
+	if pqe, ok := err.(*pq.Error); ok && pqe.Code == "23505" {
+		q.apiError(c, 400, APIError{
+			Code:  "payout_pending",
+			Title: "A payout request is already pending"})
+		return
+	}
+	if err != nil {
+		q.apiException(c, 500, errors.WithStack(err), SQLError)
+		return
+	}
+	q.apiSuccess(c, 200, res{
+		"balance": balance,
+		"fee":     int64(float64(balance) * q.config.GetFloat64("OnDemandPayoutFee")),
+	})
+}
+
 func (q *NgWebAPI) getCreatePayout(c *gin.Context) {
 	var currency = c.Param("currency")
 
-	config, ok := service.CurrencyConfig[currency]
+	config, ok := service.Currency(currency)
 	if !ok {
 		q.apiError(c, 400, APIError{
 			Code:  "unrecognized_currency",
@@ -243,58 +359,164 @@ func (q *NgWebAPI) getCreatePayout(c *gin.Context) {
 		return
 	}
 
-	type Credit struct {
-		ID      int
-		UserID  int `db:"user_id"`
-		Amount  int64
-		Address string
+	paused, err := q.payoutsPaused(currency)
+	if err != nil {
+		q.apiException(c, 500, errors.WithStack(err), SQLError)
+		return
 	}
-	var credits []Credit
-	err := q.db.Select(&credits,
-		`SELECT credit.id, credit.user_id, credit.amount, payout_address.address
-		FROM credit LEFT JOIN payout_address ON
-		credit.user_id = payout_address.user_id AND payout_address.currency = $1
-		WHERE credit.currency = $2 AND payout_address.address IS NOT NULL
-		AND credit.payout_transaction IS NULL`, currency, currency)
+	if paused {
+		q.log.Info("Payouts paused", "currency", currency)
+		q.apiSuccess(c, 200, res{})
+		return
+	}
+
+	run, err := q.nextPayoutRun(config)
 	if err != nil {
 		q.apiException(c, 500, errors.WithStack(err), SQLError)
 		return
 	}
-	if len(credits) == 0 {
+	if run == nil {
+		q.log.Debug("No payout scheduled", "currency", currency)
 		q.apiSuccess(c, 200, res{})
 		return
 	}
-	var maps = map[int]*common.PayoutMap{}
-	var totalPayout int64 = 0
-	defaultNet := &chaincfg.MainNetParams
-	for _, credit := range credits {
-		// Add to a datastructure to pass to signer that provides metadata for
-		// an output
-		pm, ok := maps[credit.UserID]
-		if !ok {
-			// Add to our list of Outputs
-			addr, err := btcutil.DecodeAddress(credit.Address, defaultNet)
-			// TODO: consider handling this more elegantly by ignoring invalid addresses
+
+	type Credit struct {
+		ID      int
+		UserID  int `db:"user_id"`
+		Amount  int64
+		Address string
+	}
+	var (
+		cursor      int
+		maps        map[int]*common.PayoutMap
+		totalPayout int64
+	)
+	// Keep grabbing batches until we find one with something worth paying.
+	// Batches made up entirely of dust are skipped over
+	for {
+		// Grab the next batch of users in the run's tier after the run's
+		// cursor. Users with a tier that isn't configured fall into the
+		// default tier, and on-demand runs pay anyone with a pending request.
+		// Held addresses are skipped until released. Outside on-demand runs,
+		// users are skipped until their balance reaches their minimum payout
+		// (or the currency's MinimumPayout) and their payout interval has
+		// passed since they were last paid. ngctl payouts preview mirrors
+		// this query
+		var credits []Credit
+		err = q.db.Select(&credits,
+			`SELECT credit.id, credit.user_id, credit.amount, payout_address.address
+			FROM credit JOIN payout_address ON
+			credit.user_id = payout_address.user_id AND payout_address.currency = $1
+			WHERE credit.currency = $1 AND credit.payout_transaction IS NULL
+			AND credit.user_id IN (
+				SELECT credit.user_id FROM credit
+				JOIN payout_address ON
+				credit.user_id = payout_address.user_id AND payout_address.currency = $1
+				JOIN users ON credit.user_id = users.id
+				LEFT JOIN payout_preference AS pref ON
+				pref.user_id = credit.user_id AND pref.currency = $1
+				LEFT JOIN payout_preference AS pref_all ON
+				pref_all.user_id = credit.user_id AND pref_all.currency = ''
+				WHERE credit.currency = $1 AND credit.payout_transaction IS NULL
+				AND credit.user_id > $2
+				AND payout_address.address NOT IN (
+					SELECT address FROM payout_hold WHERE currency = $1)
+				AND (users.payout_tier = $4 OR
+					($4 = 'default' AND users.payout_tier <> ALL($5)) OR
+					($4 = 'ondemand' AND users.id IN (
+						SELECT user_id FROM payout_request
+						WHERE currency = $1 AND payout_transaction IS NULL
+						AND dropped_at IS NULL)))
+				AND ($4 = 'ondemand' OR NOT EXISTS (
+					SELECT 1 FROM payout JOIN payout_transaction ON
+					payout_transaction.hash = payout.payout_transaction
+					WHERE payout.user_id = credit.user_id AND payout_transaction.currency = $1
+					AND COALESCE(payout_transaction.sent, now()) > now() - interval '1 second' *
+						COALESCE(pref.payout_interval, pref_all.payout_interval, 0)))
+				GROUP BY credit.user_id
+				HAVING $4 = 'ondemand' OR SUM(credit.amount) >=
+					COALESCE(MAX(pref.min_payout), MAX(pref_all.min_payout), $6)
+				ORDER BY credit.user_id LIMIT $3)
+			ORDER BY credit.user_id`,
+			currency, run.UserCursor, q.config.GetInt("PayoutBatchSize"),
+			run.Tier, pq.Array(q.tierNames()), config.MinimumPayout)
+		if err != nil {
+			q.apiException(c, 500, errors.WithStack(err), SQLError)
+			return
+		}
+		if len(credits) == 0 {
+			// Nothing past the cursor, this run is complete. The next call will
+			// start over from the beginning
+			err = q.finishPayoutRun(run)
 			if err != nil {
-				q.apiException(c, 500, errors.WithStack(err), APIError{
-					Code:  "invalid_address",
-					Title: "One or more payout addresses are invalid"})
+				q.apiException(c, 500, errors.WithStack(err), SQLError)
 				return
 			}
-			pm = &common.PayoutMap{
-				UserID:     credit.UserID,
-				Address:    credit.Address,
-				AddressObj: addr,
+			q.apiSuccess(c, 200, res{})
+			return
+		}
+		cursor = 0
+		for _, credit := range credits {
+			if credit.UserID > cursor {
+				cursor = credit.UserID
+			}
+		}
+		maps = map[int]*common.PayoutMap{}
+		for _, credit := range credits {
+			// Add to a datastructure to pass to signer that provides metadata for
+			// an output
+			pm, ok := maps[credit.UserID]
+			if !ok {
+				// Add to our list of Outputs
+				addr, err := common.DecodeAddress(currency, credit.Address, config.Params)
+				// TODO: consider handling this more elegantly by ignoring invalid addresses
+				if err != nil {
+					q.apiException(c, 500, errors.WithStack(err), APIError{
+						Code:  "invalid_address",
+						Title: "One or more payout addresses are invalid"})
+					return
+				}
+				pm = &common.PayoutMap{
+					UserID:     credit.UserID,
+					Address:    credit.Address,
+					AddressObj: addr,
+				}
+				maps[credit.UserID] = pm
+			}
+			pm.Amount += credit.Amount
+			pm.CreditIDs = append(pm.CreditIDs, credit.ID)
+		}
+		if run.Tier == onDemandTier {
+			feeRate := q.config.GetFloat64("OnDemandPayoutFee")
+			for _, pm := range maps {
+				pm.PoolFee = int64(float64(pm.Amount) * feeRate)
 			}
-			maps[credit.UserID] = pm
 		}
-		pm.Amount += credit.Amount
-		pm.CreditIDs = append(pm.CreditIDs, credit.ID)
 
-		totalPayout += credit.Amount
+		deferred := deferDust(maps, config.DustThreshold)
+		if len(deferred) > 0 {
+			q.log.Info("Deferred dust payouts",
+				"run", run.ID,
+				"count", len(deferred),
+				"dust_threshold", config.DustThreshold)
+		}
+		if len(maps) > 0 {
+			break
+		}
+		err = q.advancePayoutRun(run, cursor)
+		if err != nil {
+			q.apiException(c, 500, errors.WithStack(err), SQLError)
+			return
+		}
+	}
+	for _, pm := range maps {
+		totalPayout += pm.Amount
 	}
 	q.log.Info("Credits accumulated",
-		"credit_count", len(credits),
+		"run", run.ID,
+		"tier", run.Tier,
+		"cursor", cursor,
 		"payout_map_count", len(maps),
 		"total", totalPayout)
 
@@ -307,6 +529,26 @@ func (q *NgWebAPI) getCreatePayout(c *gin.Context) {
 		q.apiException(c, 500, errors.WithStack(err), SQLError)
 		return
 	}
+	// Everything spendable is the hot wallet's balance
+	var balance int64
+	for _, utxo := range utxos {
+		balance += utxo.Amount
+	}
+	urgency := config.PayoutUrgency
+	if run.Tier == onDemandTier {
+		urgency = config.OnDemandPayoutUrgency
+	}
+	feeRate := q.payoutFeeRate(config, urgency)
+	// When the pool pays the fee it comes out of the change, so enough is
+	// picked to cover it too. Outputs are the payees, change and a possible
+	// cold wallet sweep
+	required := func(inputs int) int64 {
+		needed := totalPayout + config.DustThreshold
+		if config.PayoutFeePaidBy == "pool" {
+			needed += payoutFee(config, feeRate, estimatedPayoutSize(inputs, len(maps)+2))
+		}
+		return needed
+	}
 	var selectedUTXO []common.UTXO
 	var totalPaid int64 = 0
 	inputs := []btcjson.TransactionInput{}
@@ -329,66 +571,127 @@ func (q *NgWebAPI) getCreatePayout(c *gin.Context) {
 			Vout: uint32(utxo.Vout),
 		})
 		totalPaid += utxo.Amount
-		if totalPaid >= totalPayout {
+		// The change output must not be dust either, or the transaction
+		// won't relay
+		if totalPaid >= required(len(inputs)) {
 			break
 		}
 	}
 	q.log.Info("Picked UTXOs", "utxo_count", len(inputs), "total", totalPaid)
-	if totalPaid < totalPayout {
+	if needed := required(len(inputs)); totalPaid < needed {
 		q.log.Warn("Insufficient funds for payout",
 			"currency", currency,
 			"utxosum", totalPaid,
-			"payoutsum", totalPayout)
+			"payoutsum", totalPayout,
+			"needed", needed)
+		q.requestTopUp(config, balance, needed-config.DustThreshold)
 		q.apiError(c, 500, APIError{
 			Code:  "insufficient_funds",
 			Title: "Not enough utxos to pay"})
 		return
 	}
 
-	// Encode maps to outputs
-	var amounts = map[btcutil.Address]btcutil.Amount{}
-	for _, pm := range maps {
-		amounts[pm.AddressObj] = btcutil.Amount(pm.Amount)
-	}
-	// Add change address to outputs
-	change := totalPaid - totalPayout
-	q.log.Info("Change calculated", "change", change)
-	if change > 0 {
-		amounts[*config.BlockSubsidyAddress] += btcutil.Amount(change)
-	}
+	// Taking the fee out of each payout can push small ones under the dust
+	// threshold. Those get deferred, which shrinks the transaction, so
+	// recalculate until every output is valid
+	var amounts map[btcutil.Address]btcutil.Amount
+	// The fee when the pool pays it rather than the payees
+	var change, sweep, poolPaid int64
+	for {
+		// Encode maps to outputs
+		amounts = map[btcutil.Address]btcutil.Amount{}
+		for _, pm := range maps {
+			amounts[pm.AddressObj] = btcutil.Amount(pm.Amount)
+		}
+		// Add change address to outputs
+		change = totalPaid - totalPayout
+		// Past the hot wallet's float, change goes to the cold wallet
+		sweep = coldSweep(config, balance-totalPaid, change)
+		q.log.Info("Change calculated", "change", change, "cold_sweep", sweep)
+		amounts[*config.BlockSubsidyAddress] += btcutil.Amount(change - sweep)
+		if sweep > 0 {
+			amounts[config.ColdWalletAddress] += btcutil.Amount(sweep)
+		}
 
-	// Create our transaction
-	locktime := int64(0)
-	tx, err := rpc.CreateRawTransaction(inputs, amounts, nil)
-	if err != nil {
-		q.apiException(c, 500, errors.WithStack(err), APIError{
-			Code:  "rpc_failure",
-			Title: "RPC failed to run CreateRawTransaction"})
-		return
+		// Create our transaction
+		tx, err := rpc.CreateRawTransaction(inputs, amounts, nil)
+		if err != nil {
+			q.apiException(c, 500, errors.WithStack(err), APIError{
+				Code:  "rpc_failure",
+				Title: "RPC failed to run CreateRawTransaction"})
+			return
+		}
+
+		// Compute the fee, then extract it from each of the amounts...
+		size := tx.SerializeSize() + int(float32(106.5)*float32(len(selectedUTXO)))
+		fee := payoutFee(config, feeRate, size)
+		q.log.Info("Generated tx for fee calc", "tx", tx)
+		q.log.Info("Calculating fee for payout",
+			"fee per byte", feeRate,
+			"urgency", urgency,
+			"min relay fee", config.MinimumRelayFee,
+			"tx size", size,
+			"total fee", fee,
+			"paid by", config.PayoutFeePaidBy)
+		if config.PayoutFeePaidBy == "pool" {
+			// Payees keep their whole payout, so none can become dust
+			poolPaid = fee
+			break
+		}
+		splitFee(maps, fee)
+
+		deferred := deferDust(maps, config.DustThreshold)
+		if len(deferred) == 0 {
+			break
+		}
+		for _, pm := range deferred {
+			totalPayout -= pm.Amount
+		}
+		q.log.Info("Deferred payouts left as dust after fee",
+			"run", run.ID,
+			"count", len(deferred))
+		if len(maps) == 0 {
+			// Nothing left worth sending. Move past this batch, the signer
+			// will pick up the rest of the run next time
+			err = q.advancePayoutRun(run, cursor)
+			if err != nil {
+				q.apiException(c, 500, errors.WithStack(err), SQLError)
+				return
+			}
+			q.apiSuccess(c, 200, res{})
+			return
+		}
 	}
 
-	// Compute the fee, then extract it from each of the amounts...
-	size := tx.SerializeSize() + int(float32(106.5)*float32(len(selectedUTXO)))
-	fee := size * config.PayoutTransactionFee
-	q.log.Info("Generated tx for fee calc", "tx", tx)
-	feePerPayee := fee / len(maps)
-	q.log.Info("Calculating fee for payout",
-		"fee per byte", config.PayoutTransactionFee,
-		"tx size", size,
-		"total fee", fee,
-		"fee per payee", feePerPayee)
+	if poolPaid > 0 {
+		change -= poolPaid
+		// Only if the estimate reserved while picking UTXOs fell short
+		if change < config.DustThreshold {
+			q.log.Warn("Insufficient funds for payout fee",
+				"currency", currency,
+				"utxosum", totalPaid,
+				"payoutsum", totalPayout,
+				"fee", poolPaid)
+			q.requestTopUp(config, balance, totalPayout+poolPaid)
+			q.apiError(c, 500, APIError{
+				Code:  "insufficient_funds",
+				Title: "Not enough utxos to pay"})
+			return
+		}
+		sweep = coldSweep(config, balance-totalPaid, change)
+	}
 
-	// Remove the fee from each payee proportional to their payout
+	// Remove the fee from each payee proportional to their payout, unless the
+	// pool pays it. Pool fees stay with us in the change output
 	amounts = map[btcutil.Address]btcutil.Amount{}
 	for _, pm := range maps {
-		fract := float64(pm.Amount) / float64(totalPaid)
-		feePortion := int64(fract * float64(fee))
-		amounts[pm.AddressObj] = btcutil.Amount(int64(pm.Amount) - feePortion)
-		pm.MinerFee = feePortion
+		amounts[pm.AddressObj] = btcutil.Amount(pm.Amount - pm.MinerFee - pm.PoolFee)
+		change += pm.PoolFee
 	}
 	// readd the change
-	if change > 0 {
-		amounts[*config.BlockSubsidyAddress] += btcutil.Amount(change)
+	amounts[*config.BlockSubsidyAddress] += btcutil.Amount(change - sweep)
+	if sweep > 0 {
+		amounts[config.ColdWalletAddress] += btcutil.Amount(sweep)
 	}
 
 	var realFee int64 = totalPaid
@@ -397,7 +700,8 @@ func (q *NgWebAPI) getCreatePayout(c *gin.Context) {
 	}
 	q.log.Info("Real fee", "fee", realFee, "perc", float64(realFee)/float64(totalPaid)*100)
 
-	tx, err = rpc.CreateRawTransaction(inputs, amounts, &locktime)
+	locktime := int64(0)
+	tx, err := rpc.CreateRawTransaction(inputs, amounts, &locktime)
 	if err != nil {
 		q.apiException(c, 500, errors.WithStack(err), APIError{
 			Code:  "rpc_failure",
@@ -418,7 +722,10 @@ func (q *NgWebAPI) getCreatePayout(c *gin.Context) {
 		"payout_meta": common.PayoutMeta{
 			PayoutMaps:    maps,
 			ChangeAddress: (*config.BlockSubsidyAddress).EncodeAddress(),
+			ColdSweep:     sweep,
 			Inputs:        selectedUTXO,
+			RunID:         run.ID,
+			Cursor:        cursor,
 		},
 		"tx": hex.EncodeToString(txWriter.Bytes()),
 	})
@@ -438,7 +745,7 @@ func (q *NgWebAPI) postPayout(c *gin.Context) {
 	// TODO: Ensure exclusivity of UTXO update. Right now interleaving will
 	// make a big mess
 	// TODO: Extract this into common function like BindValid
-	config, ok := service.CurrencyConfig[req.Currency]
+	config, ok := service.Currency(req.Currency)
 	if !ok {
 		q.apiError(c, 400, APIError{
 			Code:  "invalid_currency",
@@ -455,8 +762,12 @@ func (q *NgWebAPI) postPayout(c *gin.Context) {
 	}
 
 	// Simple sanity check. +1 is for the change address, which isn't
-	// represented by a payoutmap
-	if len(payoutTx.TxOut) != len(req.PayoutMeta.PayoutMaps)+1 {
+	// represented by a payoutmap, and another for any cold wallet sweep
+	outputs := len(req.PayoutMeta.PayoutMaps) + 1
+	if req.PayoutMeta.ColdSweep > 0 {
+		outputs++
+	}
+	if len(payoutTx.TxOut) != outputs {
 		q.apiException(c, 500, err, APIError{
 			Code:  "output_mismatch",
 			Title: "SignedTX outputs dont match payout maps"})
@@ -548,9 +859,22 @@ func (q *NgWebAPI) postPayout(c *gin.Context) {
 	for _, pm := range req.PayoutMeta.PayoutMaps {
 		_, err = tx.Exec(
 			`INSERT INTO payout
-			(user_id, amount, payout_transaction, fee, address)
-			VALUES ($1, $2, $3, $4, $5)`,
-			pm.UserID, pm.Amount, payoutTxHash, pm.MinerFee, pm.Address)
+			(user_id, amount, payout_transaction, fee, pool_fee, address)
+			VALUES ($1, $2, $3, $4, $5, $6)`,
+			pm.UserID, pm.Amount, payoutTxHash, pm.MinerFee, pm.PoolFee, pm.Address)
+		if err != nil {
+			tx.Rollback()
+			q.apiException(c, 500, errors.WithStack(err), SQLError)
+			return
+		}
+
+		// Any pending on-demand request is satisfied by this payout, whether
+		// or not it was paid by an on-demand run
+		_, err = tx.Exec(
+			`UPDATE payout_request SET payout_transaction = $1, fee = $2
+			WHERE user_id = $3 AND currency = $4 AND payout_transaction IS NULL
+			AND dropped_at IS NULL`,
+			payoutTxHash, pm.PoolFee, pm.UserID, config.Code)
 		if err != nil {
 			tx.Rollback()
 			q.apiException(c, 500, errors.WithStack(err), SQLError)
@@ -574,6 +898,20 @@ func (q *NgWebAPI) postPayout(c *gin.Context) {
 		}
 	}
 
+	// Advance the payout run past this batch in the same transaction, so the
+	// cursor never gets ahead of (or behind) what's actually been paid
+	if req.PayoutMeta.RunID != 0 {
+		_, err = tx.Exec(
+			`UPDATE payout_run SET user_cursor = $1, batches = batches + 1
+			WHERE id = $2 AND user_cursor < $1`,
+			req.PayoutMeta.Cursor, req.PayoutMeta.RunID)
+		if err != nil {
+			tx.Rollback()
+			q.apiException(c, 500, errors.WithStack(err), SQLError)
+			return
+		}
+	}
+
 	// We're commiting everything to the database before sending to ensure
 	// against a double payout scenario. ngsigner will never try to payout
 	// credits with populated payout_transaction attributes, so we make sure to
@@ -593,6 +931,76 @@ func (q *NgWebAPI) postPayout(c *gin.Context) {
 	}
 }
 
+// Shows the payout schedule state of every currency and tier, for operators
+func (q *NgWebAPI) getPayoutSchedule(c *gin.Context) {
+	type TierSchedule struct {
+		Schedule string     `json:"schedule"`
+		LastRun  *PayoutRun `json:"last_run"`
+		OpenRun  *PayoutRun `json:"open_run"`
+		NextDue  *time.Time `json:"next_due"`
+		Users    int        `json:"users"`
+	}
+	var tierUsers = map[string]int{}
+	rows, err := q.db.Query(
+		`SELECT payout_tier, count(*) FROM users GROUP BY payout_tier`)
+	if err != nil {
+		q.apiException(c, 500, errors.WithStack(err), SQLError)
+		return
+	}
+	for rows.Next() {
+		var (
+			tier  string
+			count int
+		)
+		err = rows.Scan(&tier, &count)
+		if err != nil {
+			rows.Close()
+			q.apiException(c, 500, errors.WithStack(err), SQLError)
+			return
+		}
+		if _, ok := q.payoutTiers[tier]; !ok {
+			tier = defaultTier
+		}
+		tierUsers[tier] += count
+	}
+	rows.Close()
+
+	var schedules = map[string]map[string]*TierSchedule{}
+	for code, config := range service.Currencies() {
+		schedules[code] = map[string]*TierSchedule{}
+		for _, tier := range append([]string{defaultTier}, q.tierNames()...) {
+			schedule := q.tierSchedule(config, tier)
+			ts := &TierSchedule{
+				Schedule: schedule.Spec,
+				Users:    tierUsers[tier],
+			}
+			ts.LastRun, err = q.lastPayoutRun(code, tier)
+			if err != nil {
+				q.apiException(c, 500, errors.WithStack(err), SQLError)
+				return
+			}
+			if ts.LastRun != nil {
+				next := schedule.Next(ts.LastRun.StartedAt)
+				ts.NextDue = &next
+			}
+			var run PayoutRun
+			err = q.db.QueryRowx(
+				`SELECT id, currency, tier, user_cursor, batches, started_at, finished_at
+				FROM payout_run WHERE currency = $1 AND tier = $2 AND finished_at IS NULL`,
+				code, tier).StructScan(&run)
+			if err != nil && err != sql.ErrNoRows {
+				q.apiException(c, 500, errors.WithStack(err), SQLError)
+				return
+			}
+			if err == nil {
+				ts.OpenRun = &run
+			}
+			schedules[code][tier] = ts
+		}
+	}
+	q.apiSuccess(c, 200, res{"payout_schedules": schedules})
+}
+
 func (q *NgWebAPI) getWorkers(c *gin.Context) {
 	username := c.GetString("username")
 	q.stratumsMtx.RLock()
@@ -610,3 +1018,23 @@ func (q *NgWebAPI) getWorkers(c *gin.Context) {
 	}
 	q.apiSuccess(c, 200, res{"workers": workers})
 }
+
+func (q *NgWebAPI) getUserHashrate(c *gin.Context) {
+	username := c.GetString("username")
+	q.stratumsMtx.RLock()
+	defer q.stratumsMtx.RUnlock()
+	workers := q.hashrate.Workers[username]
+	if workers == nil {
+		workers = map[string]float64{}
+	}
+	// Unix time of each rig's last share
+	lastSeen := q.hashrate.LastSeen[username]
+	if lastSeen == nil {
+		lastSeen = map[string]int64{}
+	}
+	q.apiSuccess(c, 200, res{
+		"hashrate":  q.hashrate.Addresses[username],
+		"workers":   workers,
+		"last_seen": lastSeen,
+	})
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"github.com/icook/ngpool/pkg/alert"
+	"github.com/icook/ngpool/pkg/service"
+)
+
+// How much of a payout's change goes to the cold wallet so the hot wallet is
+// left with its HotWalletFloat. unspent is what the hot wallet holds outside
+// of this transaction. Neither the sweep nor what's left of the change may be
+// dust, the change being the hot wallet's next UTXO
+func coldSweep(config *service.ChainConfig, unspent int64, change int64) int64 {
+	if config.ColdWalletAddress == nil {
+		return 0
+	}
+	sweep := unspent + change - config.HotWalletFloat
+	if most := change - config.DustThreshold; sweep > most {
+		sweep = most
+	}
+	if sweep < config.DustThreshold {
+		return 0
+	}
+	return sweep
+}
+
+// How much the cold wallet has to send for the hot wallet to pay payout and
+// still hold its float afterwards. Payouts stop until it arrives
+func hotWalletTopUp(config *service.ChainConfig, balance int64, payout int64) int64 {
+	needed := payout + config.DustThreshold + config.HotWalletFloat - balance
+	if needed < 0 {
+		return 0
+	}
+	return needed
+}
+
+// Asks the operator to move coins from the cold wallet, since the hot wallet
+// can't cover a payout. Without a cold wallet there's nowhere to ask
+func (q *NgWebAPI) requestTopUp(config *service.ChainConfig, balance int64, payout int64) {
+	needed := hotWalletTopUp(config, balance, payout)
+	q.log.Warn("Payouts halted until the hot wallet is topped up", "currency", config.Code,
+		"needed", needed, "balance", balance, "payout", payout)
+	if config.ColdWalletAddress == nil {
+		return
+	}
+	q.alerts.Fire(alert.HotWalletLow, config.Code, map[string]interface{}{
+		"currency":     config.Code,
+		"needed":       needed,
+		"balance":      balance,
+		"payout":       payout,
+		"cold_address": config.ColdWalletAddress.String(),
+	})
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/icook/ngpool/pkg/service"
+)
+
+func TestColdSweep(t *testing.T) {
+	config := &service.ChainConfig{DustThreshold: 546, HotWalletFloat: 100000}
+	// No cold wallet, everything stays hot
+	assert.Equal(t, int64(0), coldSweep(config, 500000, 50000))
+
+	cold, err := btcutil.DecodeAddress("mipcBbFg9gMiCh81Kj8tqqdgoZub1ZJRfn", &chaincfg.TestNet3Params)
+	assert.NoError(t, err)
+	config.ColdWalletAddress = cold
+	// Back down to the float
+	assert.Equal(t, int64(30000), coldSweep(config, 80000, 50000))
+	// Only the change can be swept, less enough to keep it from being dust
+	assert.Equal(t, int64(50000-546), coldSweep(config, 500000, 50000))
+	// Under the float, or a dust sweep
+	assert.Equal(t, int64(0), coldSweep(config, 10000, 50000))
+	assert.Equal(t, int64(0), coldSweep(config, 50100, 50000))
+}
+
+func TestHotWalletTopUp(t *testing.T) {
+	config := &service.ChainConfig{DustThreshold: 546, HotWalletFloat: 100000}
+	assert.Equal(t, int64(100000+546+50000-20000), hotWalletTopUp(config, 20000, 50000))
+	assert.Equal(t, int64(0), hotWalletTopUp(config, 200000, 50000))
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"database/sql"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/icook/ngpool/pkg/service"
+)
+
+func init() {
+	blockeffortCmd := &cobra.Command{
+		Use:   "blockeffort",
+		Short: "Records round effort for blocks that don't have it yet",
+		Long: `Records round effort for blocks that don't have it yet. This normally runs
+in the background of "ngweb run" after each network stats sample`,
+		Run: func(cmd *cobra.Command, args []string) {
+			ng := NewNgWebAPI()
+			ng.ParseConfig()
+			ng.ConnectDB()
+			err := ng.UpdateBlockEfforts(time.Now())
+			if err != nil {
+				ng.log.Crit("Failed", "err", err)
+			}
+		},
+	}
+	RootCmd.AddCommand(blockeffortCmd)
+}
+
+// A sharechain's effort for a block is the share difficulty it submitted
+// during the block's round, as a fraction of the shares the network expected
+// per block. The network difficulty can move a long way over a round, so
+// shares are weighted by the network stats sample in effect when they were
+// mined rather than the block's final target. An effort of 1 across all
+// sharechains is a block found exactly on time
+type blockEffort struct {
+	ShareChain string  `db:"sharechain" json:"sharechain"`
+	Difficulty float64 `json:"difficulty"`
+	Effort     float64 `json:"effort"`
+}
+
+// Shares per block expected by the network from a given time
+type expectedShares struct {
+	From   time.Time
+	Shares float64
+}
+
+// A sharechain's share difficulty for a minute of the round
+type effortBucket struct {
+	ShareChain string `db:"sharechain"`
+	Minute     time.Time
+	Difficulty float64
+}
+
+// Weights each bucket by the expected shares in effect at its minute.
+// expected must be sorted oldest first, buckets before the first of them use
+// fallback
+func roundEffort(buckets []effortBucket, expected []expectedShares,
+	fallback float64) []*blockEffort {
+	efforts := map[string]*blockEffort{}
+	for _, bucket := range buckets {
+		shares := fallback
+		for _, e := range expected {
+			if e.From.After(bucket.Minute) {
+				break
+			}
+			shares = e.Shares
+		}
+		effort, ok := efforts[bucket.ShareChain]
+		if !ok {
+			effort = &blockEffort{ShareChain: bucket.ShareChain}
+			efforts[bucket.ShareChain] = effort
+		}
+		effort.Difficulty += bucket.Difficulty
+		if shares > 0 {
+			effort.Effort += bucket.Difficulty / shares
+		}
+	}
+	ret := []*blockEffort{}
+	for _, effort := range efforts {
+		ret = append(ret, effort)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ShareChain < ret[j].ShareChain })
+	return ret
+}
+
+// Records effort for every block old enough that all its round's shares have
+// been saved
+func (q *NgWebAPI) UpdateBlockEfforts(now time.Time) error {
+	var blocks []payoutBlock
+	err := q.db.Select(&blocks,
+		`SELECT currency, height, hash, powalgo, subsidy, mined_at, target
+		FROM block WHERE effort IS NULL AND mined_at < $1
+		ORDER BY mined_at`, now.Add(-rollupLag))
+	if err != nil {
+		return err
+	}
+	for i := range blocks {
+		block := &blocks[i]
+		algo, ok := service.AlgoConfig[block.PowAlgo]
+		if !ok {
+			return errors.Errorf("Couldn't locate pow alogo %s", block.PowAlgo)
+		}
+		efforts, err := q.blockEfforts(block, algo)
+		if err != nil {
+			return err
+		}
+		err = q.saveBlockEfforts(block, efforts)
+		if err != nil {
+			return err
+		}
+		q.log.Debug("Recorded block effort", "block", block.Hash, "efforts", efforts)
+	}
+	return nil
+}
+
+func (q *NgWebAPI) blockEfforts(block *payoutBlock, algo *service.Algo) ([]*blockEffort, error) {
+	start, err := q.lastBlockTime(block.Currency, block.Height)
+	if err != nil {
+		return nil, err
+	}
+	// The sample in effect at the start of the round and all those during it
+	var samples []struct {
+		RecordedAt time.Time `db:"recorded_at"`
+		Difficulty float64
+	}
+	err = q.db.Select(&samples,
+		`SELECT recorded_at, difficulty FROM network_stats
+		WHERE currency = $1 AND powalgo = $2 AND recorded_at <= $4
+		AND recorded_at >= COALESCE((SELECT MAX(recorded_at) FROM network_stats
+			WHERE currency = $1 AND powalgo = $2 AND recorded_at <= $3), $3)
+		ORDER BY recorded_at`,
+		block.Currency, block.PowAlgo, start, block.MinedAt)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	expected := []expectedShares{}
+	for _, sample := range samples {
+		if sample.Difficulty <= 0 {
+			continue
+		}
+		shares, _ := algo.Diff1SharesForTarget(algo.NetTarget(sample.Difficulty))
+		expected = append(expected, expectedShares{sample.RecordedAt, shares})
+	}
+	// Without samples the block's own target is the best we have
+	fallback, _ := algo.Diff1SharesForTarget(block.Target)
+
+	var buckets []effortBucket
+	err = q.db.Select(&buckets,
+		`SELECT sharechain, date_trunc('minute', mined_at) AS minute,
+		SUM(difficulty) AS difficulty
+		FROM share
+		WHERE mined_at >= $1 AND mined_at <= $2 AND currencies @> $3
+		GROUP BY sharechain, minute`,
+		start, block.MinedAt, pq.StringArray([]string{block.Currency}))
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return roundEffort(buckets, expected, fallback), nil
+}
+
+func (q *NgWebAPI) saveBlockEfforts(block *payoutBlock, efforts []*blockEffort) error {
+	tx, err := q.db.Begin()
+	if err != nil {
+		return err
+	}
+	var total float64
+	for _, effort := range efforts {
+		total += effort.Effort
+		_, err = tx.Exec(
+			`INSERT INTO block_effort (blockhash, sharechain, difficulty, effort)
+			VALUES ($1, $2, $3, $4)`,
+			block.Hash, effort.ShareChain, effort.Difficulty, effort.Effort)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	_, err = tx.Exec(`UPDATE block SET effort = $1 WHERE hash = $2`,
+		total, block.Hash)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Luck is blocks found over blocks expected, where a sharechain's expected
+// blocks is the sum of its effort on every round that ended in the window.
+// Nil until the sharechain has put any work in
+type shareChainLuck struct {
+	ShareChain string   `db:"sharechain" json:"sharechain"`
+	Currency   string   `json:"currency"`
+	Blocks     int      `json:"blocks"`
+	Expected   float64  `json:"expected"`
+	Luck       *float64 `json:"luck"`
+}
+
+var luckWindows = []struct {
+	Name   string
+	Length time.Duration
+}{
+	{"7d", time.Hour * 24 * 7},
+	{"30d", time.Hour * 24 * 30},
+}
+
+func computeLuck(blocks int, expected float64) *float64 {
+	if expected <= 0 {
+		return nil
+	}
+	luck := float64(blocks) / expected
+	return &luck
+}
+
+func (q *NgWebAPI) loadLuck(since time.Time) ([]*shareChainLuck, error) {
+	var lucks = []*shareChainLuck{}
+	err := q.db.Select(&lucks,
+		`SELECT block_effort.sharechain, block.currency,
+		COUNT(*) FILTER (WHERE block.sharechain = block_effort.sharechain) AS blocks,
+		SUM(block_effort.effort) AS expected
+		FROM block_effort JOIN block ON block.hash = block_effort.blockhash
+		WHERE block.mined_at >= $1
+		GROUP BY block_effort.sharechain, block.currency
+		ORDER BY block_effort.sharechain, block.currency`, since)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	for _, luck := range lucks {
+		luck.Luck = computeLuck(luck.Blocks, luck.Expected)
+	}
+	return lucks, nil
+}
+
+func (q *NgWebAPI) getLuck(c *gin.Context) {
+	now := time.Now()
+	windows := map[string][]*shareChainLuck{}
+	for _, window := range luckWindows {
+		lucks, err := q.loadLuck(now.Add(-window.Length))
+		if err != nil {
+			q.apiException(c, 500, errors.WithStack(err), SQLError)
+			return
+		}
+		windows[window.Name] = lucks
+	}
+	q.apiSuccess(c, 200, res{"luck": windows})
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoundEffort(t *testing.T) {
+	at := func(m int) time.Time { return time.Date(2018, 1, 1, 0, m, 0, 0, time.UTC) }
+	buckets := []effortBucket{
+		{"main", at(0), 50},
+		{"main", at(5), 100},
+		{"main", at(12), 100},
+		{"solo", at(12), 25},
+	}
+	// Difficulty doubles at minute 10
+	expected := []expectedShares{{at(2), 500}, {at(10), 1000}}
+	efforts := roundEffort(buckets, expected, 250)
+	assert.Equal(t, []*blockEffort{
+		// 50/250 before the first sample, 100/500, then 100/1000
+		{ShareChain: "main", Difficulty: 250, Effort: 0.5},
+		{ShareChain: "solo", Difficulty: 25, Effort: 0.025},
+	}, efforts)
+
+	assert.Empty(t, roundEffort(nil, expected, 250))
+}
+
+func TestComputeLuck(t *testing.T) {
+	assert.Nil(t, computeLuck(0, 0))
+	assert.Equal(t, 0.0, *computeLuck(0, 2.5))
+	assert.Equal(t, 2.0, *computeLuck(3, 1.5))
+}
@@ -26,9 +26,19 @@ func init() {
 			ng := NewNgWebAPI()
 			ng.ParseConfig()
 			ng.ConnectDB()
+			ng.warnPendingMigrations()
 			ng.SetupGin()
+			err := ng.StartAdmin()
+			if err != nil {
+				ng.log.Crit("Failed to start admin API", "err", err)
+				os.Exit(1)
+			}
 			ng.WatchCoinservers()
 			ng.WatchStratum()
+			go ng.service.WatchCurrencies()
+			ng.RunRollups()
+			ng.RunNetworkStats()
+			ng.RunWorkerWebhooks()
 			ng.engine.Run()
 
 			// Wait until we recieve sigint
@@ -71,6 +81,31 @@ func init() {
 			}
 		},
 	})
+
+	RootCmd.AddCommand(&cobra.Command{
+		Use:   "settier [username] [tier]",
+		Short: "Set the payout tier for a user",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			ng := NewNgWebAPI()
+			ng.ParseConfig()
+			ng.ConnectDB()
+
+			tier := args[1]
+			if _, ok := ng.payoutTiers[tier]; !ok && tier != defaultTier {
+				fmt.Println("Warning: tier not in PayoutTiers, user will be paid on the default schedule")
+			}
+			res, err := ng.db.Exec(
+				`UPDATE users SET payout_tier = $1 WHERE username = $2`, tier, args[0])
+			if err != nil {
+				panic(err)
+			}
+			affect, err := res.RowsAffected()
+			if err == nil && affect == 0 {
+				fmt.Println("Error: No such user")
+			}
+		},
+	})
 }
 
 func main() {
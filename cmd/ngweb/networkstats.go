@@ -0,0 +1,253 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/gin-gonic/gin"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+
+	"github.com/icook/ngpool/pkg/service"
+)
+
+// Network height, difficulty and price are recorded for each currency and
+// algo every NetworkStatsInterval, so round effort and luck can be worked out
+// against the difficulty at the time rather than now
+type networkStat struct {
+	Currency   string    `json:"currency"`
+	PowAlgo    string    `json:"powalgo" db:"powalgo"`
+	RecordedAt time.Time `json:"recorded_at" db:"recorded_at"`
+	Height     int64     `json:"height"`
+	Difficulty float64   `json:"difficulty"`
+	// Nil without a PriceURL, or if the lookup failed
+	Price *float64 `json:"price"`
+}
+
+// coinbuddy pushes its status every 30 seconds, anything much older is from a
+// coinserver that's stopped reporting
+const networkStatsMaxAge = time.Minute * 5
+
+// Takes one sample per currency and algo from the coinserver statuses. With
+// more than one coinserver for a currency the one furthest ahead wins
+func sampleNetworkStats(coinservers map[string]*service.ServiceStatus,
+	now time.Time) []*networkStat {
+	type key struct {
+		currency string
+		algo     string
+	}
+	samples := map[key]*networkStat{}
+	order := []key{}
+	for _, status := range coinservers {
+		if now.Sub(status.UpdateTime) > networkStatsMaxAge {
+			continue
+		}
+		var info struct {
+			Blocks     int64
+			Difficulty float64
+		}
+		err := mapstructure.WeakDecode(status.Status["getblockchaininfo"], &info)
+		if err != nil || info.Blocks == 0 {
+			continue
+		}
+		k := key{status.Labels["currency"], status.Labels["algo"]}
+		if prev, ok := samples[k]; ok && prev.Height >= info.Blocks {
+			continue
+		} else if !ok {
+			order = append(order, k)
+		}
+		samples[k] = &networkStat{
+			Currency:   k.currency,
+			PowAlgo:    k.algo,
+			RecordedAt: now,
+			Height:     info.Blocks,
+			Difficulty: info.Difficulty,
+		}
+	}
+	ret := []*networkStat{}
+	for _, k := range order {
+		ret = append(ret, samples[k])
+	}
+	return ret
+}
+
+// Reads a number out of a JSON document by a dot separated path of keys
+func priceAtPath(raw []byte, path string) (float64, error) {
+	var doc interface{}
+	err := json.Unmarshal(raw, &doc)
+	if err != nil {
+		return 0, err
+	}
+	for _, part := range strings.Split(path, ".") {
+		obj, ok := doc.(map[string]interface{})
+		if !ok {
+			return 0, errors.Errorf("No %s in price response", path)
+		}
+		doc = obj[part]
+	}
+	switch price := doc.(type) {
+	case float64:
+		return price, nil
+	case string:
+		// Some exchanges quote prices as strings to keep precision
+		return strconv.ParseFloat(price, 64)
+	}
+	return 0, errors.Errorf("No %s in price response", path)
+}
+
+// PriceURL and PricePath both have {ticker} replaced by the currency's
+// PriceTicker, ie "https://api.coingecko.com/api/v3/simple/price?ids={ticker}&vs_currencies=usd"
+// and "{ticker}.usd"
+func (q *NgWebAPI) fetchPrice(ticker string) (float64, error) {
+	url := strings.Replace(q.config.GetString("PriceURL"), "{ticker}", ticker, -1)
+	path := strings.Replace(q.config.GetString("PricePath"), "{ticker}", ticker, -1)
+	client := &http.Client{Timeout: time.Second * 10}
+	resp, err := client.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return 0, errors.Errorf("Price API returned HTTP %d", resp.StatusCode)
+	}
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	return priceAtPath(raw, path)
+}
+
+// Starts recording network stats and block effort every NetworkStatsInterval
+func (q *NgWebAPI) RunNetworkStats() {
+	interval := q.config.GetDuration("NetworkStatsInterval")
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			<-ticker.C
+			if err := q.RecordNetworkStats(time.Now()); err != nil {
+				q.log.Error("Failed to record network stats", "err", err)
+			}
+			// Effort is weighted by the samples, so it's recorded after
+			if err := q.UpdateBlockEfforts(time.Now()); err != nil {
+				q.log.Error("Failed to record block effort", "err", err)
+			}
+		}
+	}()
+}
+
+func (q *NgWebAPI) RecordNetworkStats(now time.Time) error {
+	q.coinserversMtx.RLock()
+	samples := sampleNetworkStats(q.coinservers, now)
+	q.coinserversMtx.RUnlock()
+
+	prices := map[string]*float64{}
+	for _, sample := range samples {
+		price, ok := prices[sample.Currency]
+		if !ok {
+			price = q.lookupPrice(sample.Currency)
+			prices[sample.Currency] = price
+		}
+		sample.Price = price
+		_, err := q.db.Exec(
+			`INSERT INTO network_stats
+			(currency, powalgo, recorded_at, height, difficulty, price)
+			VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT DO NOTHING`,
+			sample.Currency, sample.PowAlgo, sample.RecordedAt, sample.Height,
+			sample.Difficulty, sample.Price)
+		if err != nil {
+			return err
+		}
+	}
+
+	retention := q.config.GetDuration("NetworkStatsRetention")
+	if retention > 0 {
+		_, err := q.db.Exec(`DELETE FROM network_stats WHERE recorded_at < $1`,
+			now.Add(-retention))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A failed price lookup still records the rest of the sample
+func (q *NgWebAPI) lookupPrice(currency string) *float64 {
+	config, ok := service.Currency(currency)
+	if !ok || config.PriceTicker == "" || q.config.GetString("PriceURL") == "" {
+		return nil
+	}
+	price, err := q.fetchPrice(config.PriceTicker)
+	if err != nil {
+		q.log.Warn("Failed to fetch price", "currency", currency, "err", err)
+		return nil
+	}
+	return &price
+}
+
+// The latest sample for each currency and algo
+func (q *NgWebAPI) getNetworkStats(c *gin.Context) {
+	var stats = []*networkStat{}
+	err := q.db.Select(&stats,
+		`SELECT DISTINCT ON (currency, powalgo)
+		currency, powalgo, recorded_at, height, difficulty, price
+		FROM network_stats ORDER BY currency, powalgo, recorded_at DESC`)
+	if err != nil && err != sql.ErrNoRows {
+		q.apiException(c, 500, errors.WithStack(err), SQLError)
+		return
+	}
+	q.apiSuccess(c, 200, res{"network_stats": stats})
+}
+
+// Samples for a currency between start and end, unix timestamps. Defaults to
+// the last day
+func (q *NgWebAPI) getCurrencyNetworkStats(c *gin.Context) {
+	end := time.Now()
+	start := end.Add(-time.Hour * 24)
+	if startRaw, ok := c.GetQuery("start"); ok && startRaw != "" {
+		startInt, err := strconv.Atoi(startRaw)
+		if err != nil {
+			q.apiError(c, 400, APIError{Code: "invalid_start"})
+			return
+		}
+		start = time.Unix(int64(startInt), 0)
+	}
+	if endRaw, ok := c.GetQuery("end"); ok && endRaw != "" {
+		endInt, err := strconv.Atoi(endRaw)
+		if err != nil {
+			q.apiError(c, 400, APIError{Code: "invalid_end"})
+			return
+		}
+		end = time.Unix(int64(endInt), 0)
+	}
+	psql := sq.StatementBuilder.PlaceholderFormat(sq.Dollar)
+	base := psql.Select("currency, powalgo, recorded_at, height, difficulty, price").
+		From("network_stats").OrderBy("recorded_at").
+		Where(sq.Eq{"currency": strings.ToUpper(c.Param("currency"))}).
+		Where(sq.GtOrEq{"recorded_at": start}).
+		Where(sq.LtOrEq{"recorded_at": end})
+	if algo, ok := c.GetQuery("powalgo"); ok && algo != "" {
+		base = base.Where(sq.Eq{"powalgo": algo})
+	}
+	qstring, args, err := base.ToSql()
+	if err != nil {
+		q.apiException(c, 500, errors.WithStack(err), SQLError)
+		return
+	}
+	var stats = []*networkStat{}
+	err = q.db.Select(&stats, qstring, args...)
+	if err != nil && err != sql.ErrNoRows {
+		q.apiException(c, 500, errors.WithStack(err), SQLError)
+		return
+	}
+	q.apiSuccess(c, 200, res{"network_stats": stats})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/icook/ngpool/pkg/service"
+)
+
+func TestSampleNetworkStats(t *testing.T) {
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	status := func(currency string, blocks int64, updated time.Time) *service.ServiceStatus {
+		return &service.ServiceStatus{
+			Labels: map[string]string{"currency": currency, "algo": "scrypt"},
+			Status: map[string]interface{}{
+				"getblockchaininfo": map[string]interface{}{
+					"blocks":     float64(blocks),
+					"difficulty": 1.5,
+				},
+			},
+			UpdateTime: updated,
+		}
+	}
+	samples := sampleNetworkStats(map[string]*service.ServiceStatus{
+		"a": status("LTC", 100, now),
+		"b": status("LTC", 102, now.Add(-time.Minute)),
+		// Stale coinservers are ignored
+		"c": status("DOGE", 500, now.Add(-time.Hour)),
+		// As are ones that haven't reported chain info
+		"d": {Labels: map[string]string{"currency": "BTC", "algo": "sha256d"},
+			UpdateTime: now},
+	}, now)
+	assert.Len(t, samples, 1)
+	assert.Equal(t, &networkStat{
+		Currency:   "LTC",
+		PowAlgo:    "scrypt",
+		RecordedAt: now,
+		Height:     102,
+		Difficulty: 1.5,
+	}, samples[0])
+}
+
+func TestPriceAtPath(t *testing.T) {
+	price, err := priceAtPath([]byte(`{"litecoin":{"usd":101.5}}`), "litecoin.usd")
+	assert.NoError(t, err)
+	assert.Equal(t, 101.5, price)
+
+	price, err = priceAtPath([]byte(`{"data":{"price":"0.25"}}`), "data.price")
+	assert.NoError(t, err)
+	assert.Equal(t, 0.25, price)
+
+	_, err = priceAtPath([]byte(`{"litecoin":{"usd":101.5}}`), "litecoin.eur")
+	assert.Error(t, err)
+	_, err = priceAtPath([]byte(`{"litecoin":5}`), "litecoin.usd")
+	assert.Error(t, err)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cast"
+
+	"github.com/icook/ngpool/pkg/service"
+)
+
+// How share difficulty from sharechains of different algos is made
+// comparable when a multi-algo currency's block is split between them.
+// Difficulty is relative to each algo's ShareDiff1, so without this a scrypt
+// share is worth the same as a sha256d share of the same difficulty
+const (
+	// Raw difficulty, as before normalization existed
+	normalizeNone = "none"
+	// Multiplied by the algo's AlgoWeights entry, 1 if it has none
+	normalizeStatic = "static"
+	// Divided by the shares it took on average to find a block on the
+	// algo, from the network difficulty last sampled before the block. Each
+	// share then counts for the fraction of a block it was worth
+	normalizeNetwork = "network"
+)
+
+var normalizeModes = []string{normalizeNone, normalizeStatic, normalizeNetwork}
+
+func validNormalization(mode string) bool {
+	for _, m := range normalizeModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// Shares needed on average to find a block at a network difficulty
+func sharesPerBlock(algo *service.Algo, difficulty float64) (float64, error) {
+	if difficulty <= 0 {
+		return 0, errors.Errorf("Invalid %s network difficulty %v", algo.Name, difficulty)
+	}
+	shares, _ := algo.Diff1SharesForTarget(algo.NetTarget(difficulty))
+	return shares, nil
+}
+
+func staticFactor(weights map[string]float64, algo string) float64 {
+	for name, weight := range weights {
+		if strings.EqualFold(name, algo) {
+			return weight
+		}
+	}
+	return 1
+}
+
+// The network difficulty of currency on algo last sampled by
+// RunNetworkStats at or before at
+func (q *NgWebAPI) networkDifficulty(currency string, algo string, at time.Time) (float64, error) {
+	var difficulty float64
+	err := q.db.QueryRowx(
+		`SELECT difficulty FROM network_stats
+		WHERE currency = $1 AND powalgo = $2 AND recorded_at <= $3
+		ORDER BY recorded_at DESC LIMIT 1`,
+		currency, algo, at).Scan(&difficulty)
+	if err == sql.ErrNoRows {
+		return 0, errors.Errorf("No %s network stats on %s before %s, can't normalize",
+			currency, algo, at)
+	}
+	return difficulty, err
+}
+
+// The factor share difficulty on a sharechain is multiplied by before the
+// block's subsidy is split between sharechains
+func (q *NgWebAPI) normalizeFactor(sc *service.ShareChainConfig, block *payoutBlock) (float64, error) {
+	switch q.config.GetString("AlgoNormalization") {
+	case normalizeStatic:
+		weights := map[string]float64{}
+		for algo, weight := range q.config.GetStringMap("AlgoWeights") {
+			weights[algo] = cast.ToFloat64(weight)
+		}
+		return staticFactor(weights, sc.AlgoName), nil
+	case normalizeNetwork:
+		algo, ok := service.AlgoConfig[sc.AlgoName]
+		if !ok {
+			return 0, errors.Errorf("Unknown algo %s on sharechain %s", sc.AlgoName, sc.Name)
+		}
+		difficulty, err := q.networkDifficulty(block.Currency, sc.AlgoName, block.MinedAt)
+		if err != nil {
+			return 0, err
+		}
+		shares, err := sharesPerBlock(algo, difficulty)
+		if err != nil {
+			return 0, err
+		}
+		return 1 / shares, nil
+	}
+	return 1, nil
+}
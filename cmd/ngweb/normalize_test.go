@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/icook/ngpool/pkg/service"
+)
+
+func TestSharesPerBlock(t *testing.T) {
+	// At the same network difficulty a scrypt block takes 65536 times the
+	// shares of a sha256d block, since scrypt's share diff1 is that much
+	// easier
+	sha, err := sharesPerBlock(service.AlgoConfig["sha256d"], 1000)
+	assert.NoError(t, err)
+	assert.InEpsilon(t, 1000, sha, 0.0001)
+	scrypt, err := sharesPerBlock(service.AlgoConfig["scrypt"], 1000)
+	assert.NoError(t, err)
+	assert.InEpsilon(t, 65536*1000, scrypt, 0.0001)
+
+	_, err = sharesPerBlock(service.AlgoConfig["sha256d"], 0)
+	assert.Error(t, err)
+}
+
+func TestStaticFactor(t *testing.T) {
+	weights := map[string]float64{"scrypt": 0.5}
+	assert.Equal(t, 0.5, staticFactor(weights, "Scrypt"))
+	assert.Equal(t, 1.0, staticFactor(weights, "sha256d"))
+	assert.True(t, validNormalization(normalizeNetwork))
+	assert.False(t, validNormalization("price"))
+}
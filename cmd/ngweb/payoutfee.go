@@ -0,0 +1,118 @@
+package main
+
+import (
+	"github.com/btcsuite/btcutil"
+	"github.com/pkg/errors"
+
+	"github.com/icook/ngpool/pkg/common"
+	"github.com/icook/ngpool/pkg/rpcclient"
+	"github.com/icook/ngpool/pkg/service"
+)
+
+// Removes payees whose payout is below the dust threshold from maps and
+// returns them. Their credits are left unpaid, so they'll be picked up again
+// in a later run once they've accumulated enough
+func deferDust(maps map[int]*common.PayoutMap, dust int64) []*common.PayoutMap {
+	var deferred []*common.PayoutMap
+	for userID, pm := range maps {
+		if pm.Amount-pm.MinerFee-pm.PoolFee < dust {
+			deferred = append(deferred, pm)
+			delete(maps, userID)
+		}
+	}
+	return deferred
+}
+
+// The fee rate, in satoshis / byte, for a payout of the given urgency. With
+// PayoutFeeEstimate the coinserver is asked, falling back to
+// PayoutTransactionFee when it can't be reached or has no estimate yet
+func (q *NgWebAPI) payoutFeeRate(config *service.ChainConfig, urgency string) int {
+	if !config.PayoutFeeEstimate {
+		return config.PayoutTransactionFee
+	}
+	mode := "CONSERVATIVE"
+	if urgency == "economy" {
+		mode = "ECONOMICAL"
+	}
+	target := service.PayoutConfTargets[urgency]
+	var estimate *rpcclient.FeeEstimate
+	client, err := q.currencyClient(config.Code)
+	if err == nil {
+		estimate, err = client.EstimateSmartFee(target, mode)
+	}
+	if err != nil {
+		q.log.Warn("Failed to estimate payout fee, using PayoutTransactionFee",
+			"currency", config.Code, "err", err)
+	} else if estimate.FeeRate <= 0 {
+		q.log.Warn("Coinserver has no fee estimate, using PayoutTransactionFee",
+			"currency", config.Code, "errors", estimate.Errors)
+	}
+	return estimatedFeeRate(config, estimate)
+}
+
+// Converts estimatesmartfee's rate, in coins / kB, to satoshis / byte,
+// rounding up and limiting it to PayoutFeeMax. A missing estimate gives
+// PayoutTransactionFee
+func estimatedFeeRate(config *service.ChainConfig, estimate *rpcclient.FeeEstimate) int {
+	if estimate == nil || estimate.FeeRate <= 0 {
+		return config.PayoutTransactionFee
+	}
+	perKB, err := btcutil.NewAmount(estimate.FeeRate)
+	if err != nil {
+		return config.PayoutTransactionFee
+	}
+	rate := int((int64(perKB) + 999) / 1000)
+	if config.PayoutFeeMax > 0 && rate > config.PayoutFeeMax {
+		return config.PayoutFeeMax
+	}
+	return rate
+}
+
+// A client for one of currency's coinservers, for calls the btcd client
+// payouts are built with doesn't have
+func (q *NgWebAPI) currencyClient(currency string) (*rpcclient.Client, error) {
+	q.coinserversMtx.RLock()
+	defer q.coinserversMtx.RUnlock()
+	for _, status := range q.coinservers {
+		if status.Labels["currency"] == currency {
+			return q.coinserverClient(status.Labels["endpoint"], currency)
+		}
+	}
+	return nil, errors.Errorf("No coinserver for %s", currency)
+}
+
+// An upper bound on the size of a payout transaction, for reserving the fee
+// while picking UTXOs, before the transaction can be built. Inputs are counted
+// signed, like the fee calculation does, and outputs as P2WSH, the largest
+// standard output
+func estimatedPayoutSize(inputs int, outputs int) int {
+	return 10 + inputs*(41+107) + outputs*43
+}
+
+// Calculates the fee for a payout transaction of the given size at rate
+// satoshis / byte, unless that's below the network's minimum relay fee rate
+func payoutFee(config *service.ChainConfig, rate int, size int) int64 {
+	fee := int64(size * rate)
+	// Minimum relay fee is per kB, and nodes round partial kB up
+	minFee := (int64(size)*int64(config.MinimumRelayFee) + 999) / 1000
+	if fee < minFee {
+		return minFee
+	}
+	return fee
+}
+
+// Splits fee among payees proportional to their payout, setting MinerFee on
+// each. Portions are rounded up so the total collected never falls short of
+// fee
+func splitFee(maps map[int]*common.PayoutMap, fee int64) {
+	var total int64
+	for _, pm := range maps {
+		total += pm.Amount
+	}
+	if total == 0 {
+		return
+	}
+	for _, pm := range maps {
+		pm.MinerFee = (fee*pm.Amount + total - 1) / total
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/icook/ngpool/pkg/common"
+	"github.com/icook/ngpool/pkg/rpcclient"
+	"github.com/icook/ngpool/pkg/service"
+)
+
+func TestPayoutFeeMinRelay(t *testing.T) {
+	config := &service.ChainConfig{PayoutTransactionFee: 1, MinimumRelayFee: 100000}
+	assert.Equal(t, int64(25000), payoutFee(config, 1, 250))
+	config.MinimumRelayFee = 0
+	assert.Equal(t, int64(250), payoutFee(config, 1, 250))
+	assert.Equal(t, int64(5000), payoutFee(config, 20, 250))
+}
+
+func TestEstimatedFeeRate(t *testing.T) {
+	config := &service.ChainConfig{PayoutTransactionFee: 5}
+	assert.Equal(t, 5, estimatedFeeRate(config, nil))
+	assert.Equal(t, 5, estimatedFeeRate(config, &rpcclient.FeeEstimate{
+		Errors: []string{"Insufficient data or no feerate found"}}))
+	// 12000 satoshis / kB
+	assert.Equal(t, 12, estimatedFeeRate(config, &rpcclient.FeeEstimate{FeeRate: 0.00012}))
+	// Partial satoshis round up
+	assert.Equal(t, 2, estimatedFeeRate(config, &rpcclient.FeeEstimate{FeeRate: 0.00001001}))
+
+	config.PayoutFeeMax = 10
+	assert.Equal(t, 10, estimatedFeeRate(config, &rpcclient.FeeEstimate{FeeRate: 0.00012}))
+}
+
+func TestEstimatedPayoutSize(t *testing.T) {
+	for _, inputs := range []int{1, 3, 50} {
+		// Measured like getCreatePayout measures the built transaction
+		tx := wire.NewMsgTx(wire.TxVersion)
+		for i := 0; i < inputs; i++ {
+			tx.AddTxIn(wire.NewTxIn(&wire.OutPoint{}, nil, nil))
+		}
+		for i := 0; i < 20; i++ {
+			// P2WSH
+			tx.AddTxOut(wire.NewTxOut(1000, make([]byte, 34)))
+		}
+		size := tx.SerializeSize() + int(float32(106.5)*float32(inputs))
+		assert.True(t, estimatedPayoutSize(inputs, 20) >= size)
+		assert.True(t, estimatedPayoutSize(inputs, 20) < size+inputs+10)
+	}
+}
+
+func TestDeferDust(t *testing.T) {
+	maps := map[int]*common.PayoutMap{
+		1: {UserID: 1, Amount: 100000},
+		2: {UserID: 2, Amount: 550},
+	}
+	assert.Len(t, deferDust(maps, 546), 0)
+
+	splitFee(maps, 1000)
+	assert.Equal(t, int64(995), maps[1].MinerFee)
+	assert.Equal(t, int64(6), maps[2].MinerFee)
+	deferred := deferDust(maps, 546)
+	assert.Len(t, deferred, 1)
+	assert.Equal(t, 2, deferred[0].UserID)
+	assert.Len(t, maps, 1)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/lib/pq"
+)
+
+// A PayoutMethod splits a sharechain's part of a block between users. Each
+// method gathers share weights its own way and hands them to
+// creditsFromShares, so rounding is the same whatever the method. Selected by
+// ShareChainConfig.PayoutMethod
+type PayoutMethod interface {
+	Credit(q *NgWebAPI, sc *ShareChainPayout, block *payoutBlock) ([]*CreditMap, error)
+}
+
+type PayoutMethodFunc func(q *NgWebAPI, sc *ShareChainPayout, block *payoutBlock) ([]*CreditMap, error)
+
+func (f PayoutMethodFunc) Credit(q *NgWebAPI, sc *ShareChainPayout, block *payoutBlock) ([]*CreditMap, error) {
+	return f(q, sc, block)
+}
+
+// Keep in step with service.PayoutMethods, which config is checked against
+var PayoutMethods = map[string]PayoutMethod{
+	"pplns": PayoutMethodFunc((*NgWebAPI).payoutPPLNS),
+	"prop":  PayoutMethodFunc((*NgWebAPI).payoutProp),
+	"score": PayoutMethodFunc((*NgWebAPI).payoutScore),
+	"shift": PayoutMethodFunc((*NgWebAPI).payoutShift),
+	// Blocks the sharechain mined are credited by coinbaseCredits instead.
+	// This covers its part of everyone else's
+	"coinbase": PayoutMethodFunc((*NgWebAPI).payoutPPLNS),
+}
+
+// Proportional. Every share in the round, since the currency's last block,
+// counts the same
+func (q *NgWebAPI) payoutProp(sc *ShareChainPayout, block *payoutBlock) ([]*CreditMap, error) {
+	userShares, total, err := q.roundShares(sc, block, `share.difficulty`)
+	if err != nil {
+		return nil, err
+	}
+	sc.Data = map[string]interface{}{
+		"type":        "prop",
+		"round_start": block.lastBlockTime,
+		"sharesFound": total,
+	}
+	return creditsFromShares(sc, userShares, total), nil
+}
+
+// Score based (slush). Shares are weighted by exp(age/ScoreDecay), so hopping
+// in late in a round pays no better than mining the whole of it. Weights are
+// relative to the block's time to keep the exponent from overflowing, and
+// clamped so shares from long rounds weigh ~0 rather than underflowing EXP,
+// which PostgreSQL raises as an error
+func (q *NgWebAPI) payoutScore(sc *ShareChainPayout, block *payoutBlock) ([]*CreditMap, error) {
+	decay := sc.config.ScoreDecayLength.Seconds()
+	userShares, total, err := q.roundShares(sc, block,
+		`share.difficulty * EXP(GREATEST(EXTRACT(EPOCH FROM share.mined_at - $6) / $7, -700))`,
+		block.MinedAt, decay)
+	if err != nil {
+		return nil, err
+	}
+	sc.Data = map[string]interface{}{
+		"type":        "score",
+		"round_start": block.lastBlockTime,
+		"decay":       decay,
+		"scoreTotal":  total,
+	}
+	return creditsFromShares(sc, userShares, total), nil
+}
+
+// Sums a weight per user over the sharechain's shares for the block's round,
+// scaled by payoutWeightSQL. Extra args start at $6. Shares that don't match a
+// user go to the fee user
+func (q *NgWebAPI) roundShares(sc *ShareChainPayout, block *payoutBlock,
+	weight string, args ...interface{}) (map[int]float64, float64, error) {
+	type userWeight struct {
+		UserID *int `db:"id"`
+		Weight float64
+	}
+	var weights []userWeight
+	err := q.db.Select(&weights,
+		`SELECT users.id, SUM((`+weight+`) * `+payoutWeightSQL("$5")+`) AS weight FROM share
+		LEFT JOIN users ON users.username = share.username
+		WHERE share.mined_at >= $1 AND share.mined_at <= $2
+		AND share.sharechain = $3 AND share.currencies @> $4
+		GROUP BY users.id`,
+		append([]interface{}{block.lastBlockTime, block.MinedAt, sc.Name,
+			pq.StringArray([]string{block.Currency}), block.Currency}, args...)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	userShares := map[int]float64{1: 0}
+	var total float64
+	for _, w := range weights {
+		userID := 1
+		if w.UserID != nil {
+			userID = *w.UserID
+		}
+		userShares[userID] += w.Weight
+		total += w.Weight
+	}
+	return userShares, total, nil
+}
+
+// How much of a share counts toward a block of the currency in placeholder
+// arg. Miners who picked payout currencies with pc= in the password only count
+// toward those, by the weight the stratum recorded; everyone else fully
+func payoutWeightSQL(arg string) string {
+	return `COALESCE((share.payout_weights->>` + arg + `)::float8,
+		CASE WHEN share.payout_weights IS NULL THEN 1 ELSE 0 END)`
+}
+
+// Splits the sharechain's payable subsidy between users proportional to their
+// shares. The fee user (id 1) also gets the sharechain fee, and anything that
+// can't be split (no shares at all) so credits always add up to the subsidy
+func creditsFromShares(sc *ShareChainPayout, userShares map[int]float64,
+	total float64) []*CreditMap {
+	amounts := splitAmount(sc.SubsidyPayable, userShares, total)
+	var split int64
+	for _, amount := range amounts {
+		split += amount
+	}
+	amounts[1] += sc.SubsidyPayable - split + sc.SubsidyFee
+
+	var credits []*CreditMap
+	for _, userID := range sortedUserIDs(userShares) {
+		amount := amounts[userID]
+		// A fee percentage of 0 will often create empty fee entries, so we
+		// must check to ensure we don't create empty credits which break
+		// things later on
+		if amount <= 0 {
+			continue
+		}
+		var fract float64
+		if total > 0 {
+			fract = userShares[userID] / total
+		}
+		credits = append(credits, &CreditMap{
+			UserID:     userID,
+			Difficulty: userShares[userID],
+			Amount:     amount,
+			Fee:        float64(sc.SubsidyFee) * fract,
+		})
+	}
+	return credits
+}
+
+// Splits amount by weight. Each share is rounded down, then the satoshis left
+// over go one each to the largest remainders (lowest user id on a tie), so the
+// result always sums to amount. Empty if there's no weight to split by
+func splitAmount(amount int64, weights map[int]float64, total float64) map[int]int64 {
+	out := map[int]int64{}
+	if total <= 0 || amount <= 0 {
+		return out
+	}
+	ids := sortedUserIDs(weights)
+	remainders := map[int]float64{}
+	var given int64
+	for _, id := range ids {
+		exact := float64(amount) * weights[id] / total
+		out[id] = int64(exact)
+		remainders[id] = exact - float64(out[id])
+		given += out[id]
+	}
+	sort.SliceStable(ids, func(i, j int) bool {
+		return remainders[ids[i]] > remainders[ids[j]]
+	})
+	// Less than one satoshi per user is left over, bar float error
+	for i := 0; given < amount; i = (i + 1) % len(ids) {
+		out[ids[i]]++
+		given++
+	}
+	for i := len(ids) - 1; i >= 0 && given > amount; i-- {
+		if out[ids[i]] > 0 {
+			out[ids[i]]--
+			given--
+		}
+	}
+	return out
+}
+
+func sortedUserIDs(m map[int]float64) []int {
+	ids := []int{}
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"github.com/icook/ngpool/pkg/service"
+)
+
+// Longer and a user's coins could sit unpaid for good. ngstratum's pi=
+// password option has the same limit
+const maxPayoutInterval = time.Hour * 24 * 30
+
+// A user's own payout settings for a currency, or every currency when
+// Currency is empty. Nil fields use the pool's default: the currency's
+// MinimumPayout, and the payout tier's schedule
+type PayoutPreference struct {
+	Currency string `json:"currency"`
+	// Satoshis
+	MinPayout *int64 `db:"min_payout" json:"min_payout"`
+	// Seconds
+	PayoutInterval *int `db:"payout_interval" json:"payout_interval"`
+}
+
+// Checks a preference sent to the API, returning what's wrong with it
+func (p *PayoutPreference) validate() string {
+	if p.Currency != "" {
+		if _, ok := service.Currency(p.Currency); !ok {
+			return "No currency with that code"
+		}
+	}
+	if p.MinPayout != nil && *p.MinPayout < 0 {
+		return "Minimum payout can't be negative"
+	}
+	if p.PayoutInterval != nil && (*p.PayoutInterval < 0 ||
+		time.Duration(*p.PayoutInterval)*time.Second > maxPayoutInterval) {
+		return "Payout interval must be between 0 and 30 days"
+	}
+	return ""
+}
+
+func (q *NgWebAPI) getPayoutPreferences(c *gin.Context) {
+	userID := c.GetInt("userID")
+	prefs := []PayoutPreference{}
+	err := q.db.Select(&prefs,
+		`SELECT currency, min_payout, payout_interval FROM payout_preference
+		WHERE user_id = $1 ORDER BY currency`, userID)
+	if err != nil {
+		q.apiException(c, 500, errors.WithStack(err), SQLError)
+		return
+	}
+	defaults := map[string]int64{}
+	for code, config := range service.Currencies() {
+		defaults[code] = config.MinimumPayout
+	}
+	q.apiSuccess(c, 200, res{"preferences": prefs, "minimum_payouts": defaults})
+}
+
+// Sets a preference, replacing any the user had for the currency. With
+// neither field set the preference is removed
+func (q *NgWebAPI) postPayoutPreference(c *gin.Context) {
+	var req PayoutPreference
+	if !q.BindValid(c, &req) {
+		return
+	}
+	if problem := req.validate(); problem != "" {
+		q.apiError(c, 400, APIError{
+			Code:  "invalid_preference",
+			Title: problem})
+		return
+	}
+	userID := c.GetInt("userID")
+	var err error
+	if req.MinPayout == nil && req.PayoutInterval == nil {
+		_, err = q.db.Exec(
+			`DELETE FROM payout_preference WHERE user_id = $1 AND currency = $2`,
+			userID, req.Currency)
+	} else {
+		_, err = q.db.Exec(
+			`INSERT INTO payout_preference (user_id, currency, min_payout, payout_interval, source)
+			VALUES ($1, $2, $3, $4, 'api') ON CONFLICT (user_id, currency) DO UPDATE
+			SET min_payout = $3, payout_interval = $4, source = 'api', updated_at = now()`,
+			userID, req.Currency, req.MinPayout, req.PayoutInterval)
+	}
+	if err != nil {
+		q.apiException(c, 500, errors.WithStack(err), SQLError)
+		return
+	}
+	q.apiSuccess(c, 200, res{"preference": req})
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPayoutPreferenceValidate(t *testing.T) {
+	amount, negative := int64(50000000), int64(-1)
+	day, year := 86400, 86400*365
+	assert.Equal(t, "", (&PayoutPreference{MinPayout: &amount, PayoutInterval: &day}).validate())
+	assert.Equal(t, "", (&PayoutPreference{}).validate())
+	assert.NotEmpty(t, (&PayoutPreference{Currency: "NOPE"}).validate())
+	assert.NotEmpty(t, (&PayoutPreference{MinPayout: &negative}).validate())
+	assert.NotEmpty(t, (&PayoutPreference{PayoutInterval: &year}).validate())
+}
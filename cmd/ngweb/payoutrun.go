@@ -0,0 +1,183 @@
+package main
+
+import (
+	"database/sql"
+	"sort"
+	"time"
+
+	"github.com/icook/ngpool/pkg/service"
+)
+
+// Users not assigned a configured tier are paid on their currency's
+// PayoutSchedule
+const defaultTier = "default"
+
+// Runs for this tier pay users with pending on-demand payout requests,
+// whatever tier they're in
+const onDemandTier = "ondemand"
+
+// A payout run walks all users with unpaid credits for a currency in user_id
+// order, one batch (transaction) at a time. The cursor is the highest user_id
+// included in a committed batch, so if the signer or an RPC dies mid run the
+// next batch picks up where the last one left off. Each payout tier gets its
+// own runs, so users in a faster tier aren't held to the default schedule
+type PayoutRun struct {
+	ID         int        `json:"id"`
+	Currency   string     `json:"currency"`
+	Tier       string     `json:"tier"`
+	UserCursor int        `db:"user_cursor" json:"user_cursor"`
+	Batches    int        `json:"batches"`
+	StartedAt  time.Time  `db:"started_at" json:"started_at"`
+	FinishedAt *time.Time `db:"finished_at" json:"finished_at"`
+}
+
+// Returns the configured tier names, not including the default tier
+func (q *NgWebAPI) tierNames() []string {
+	names := []string{}
+	for name := range q.payoutTiers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (q *NgWebAPI) tierSchedule(config *service.ChainConfig, tier string) *service.Schedule {
+	if schedule, ok := q.payoutTiers[tier]; ok {
+		return schedule
+	}
+	return config.PayoutSchedule
+}
+
+// Returns the payout run to work on for the currency. An open run is always
+// finished before starting another, otherwise a new run is started for the
+// first tier whose schedule is due. Configured tiers are checked before the
+// default tier, since the default tier is due on every pass with the default
+// "@always" PayoutSchedule and would otherwise starve them. Returns nil if
+// nothing is due
+func (q *NgWebAPI) nextPayoutRun(config *service.ChainConfig) (*PayoutRun, error) {
+	var run PayoutRun
+	err := q.db.QueryRowx(
+		`SELECT id, currency, tier, user_cursor, batches, started_at, finished_at
+		FROM payout_run WHERE currency = $1 AND finished_at IS NULL
+		ORDER BY started_at LIMIT 1`,
+		config.Code).StructScan(&run)
+	if err == nil {
+		return &run, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	// On-demand requests don't wait on any schedule
+	var pending bool
+	err = q.db.Get(&pending,
+		`SELECT EXISTS (SELECT 1 FROM payout_request
+		WHERE currency = $1 AND payout_transaction IS NULL
+		AND dropped_at IS NULL)`, config.Code)
+	if err != nil {
+		return nil, err
+	}
+	if pending {
+		return q.startPayoutRun(config.Code, onDemandTier)
+	}
+
+	for _, tier := range append(q.tierNames(), defaultTier) {
+		last, err := q.lastPayoutRun(config.Code, tier)
+		if err != nil {
+			return nil, err
+		}
+		var lastStart *time.Time
+		if last != nil {
+			lastStart = &last.StartedAt
+		}
+		if q.tierSchedule(config, tier).Due(lastStart, time.Now()) {
+			return q.startPayoutRun(config.Code, tier)
+		}
+	}
+	return nil, nil
+}
+
+// Returns the most recently finished run, or nil if there's never been one
+func (q *NgWebAPI) lastPayoutRun(currency string, tier string) (*PayoutRun, error) {
+	var run PayoutRun
+	err := q.db.QueryRowx(
+		`SELECT id, currency, tier, user_cursor, batches, started_at, finished_at
+		FROM payout_run WHERE currency = $1 AND tier = $2
+		AND finished_at IS NOT NULL ORDER BY started_at DESC LIMIT 1`,
+		currency, tier).StructScan(&run)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+func (q *NgWebAPI) startPayoutRun(currency string, tier string) (*PayoutRun, error) {
+	var run PayoutRun
+	// ON CONFLICT guards against two signers racing to start a run
+	err := q.db.QueryRowx(
+		`INSERT INTO payout_run (currency, tier) VALUES ($1, $2)
+		ON CONFLICT DO NOTHING
+		RETURNING id, currency, tier, user_cursor, batches, started_at, finished_at`,
+		currency, tier).StructScan(&run)
+	if err == sql.ErrNoRows {
+		err = q.db.QueryRowx(
+			`SELECT id, currency, tier, user_cursor, batches, started_at, finished_at
+			FROM payout_run WHERE currency = $1 AND tier = $2 AND finished_at IS NULL`,
+			currency, tier).StructScan(&run)
+		if err != nil {
+			return nil, err
+		}
+		return &run, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	q.log.Info("Started new payout run",
+		"currency", currency, "tier", tier, "run", run.ID)
+	return &run, nil
+}
+
+func (q *NgWebAPI) finishPayoutRun(run *PayoutRun) error {
+	_, err := q.db.Exec(
+		`UPDATE payout_run SET finished_at = now() WHERE id = $1`, run.ID)
+	if err != nil {
+		return err
+	}
+	if run.Tier == onDemandTier {
+		// Anything the run couldn't pay (dust after fees, no UTXOs) is
+		// dropped, otherwise we'd start a new run for it forever. Dropped
+		// requests are kept so they still count towards the cooldown
+		res, err := q.db.Exec(
+			`UPDATE payout_request SET dropped_at = now() WHERE currency = $1
+			AND payout_transaction IS NULL AND dropped_at IS NULL
+			AND requested_at <= $2`,
+			run.Currency, run.StartedAt)
+		if err != nil {
+			return err
+		}
+		if dropped, err := res.RowsAffected(); err == nil && dropped > 0 {
+			q.log.Info("Dropped unfulfilled payout requests",
+				"currency", run.Currency, "run", run.ID, "count", dropped)
+		}
+	}
+	q.log.Info("Finished payout run",
+		"currency", run.Currency, "tier", run.Tier, "run", run.ID,
+		"batches", run.Batches)
+	return nil
+}
+
+// Moves the run's cursor forward without a payout transaction. Used when a
+// batch has nothing worth paying
+func (q *NgWebAPI) advancePayoutRun(run *PayoutRun, cursor int) error {
+	_, err := q.db.Exec(
+		`UPDATE payout_run SET user_cursor = $1 WHERE id = $2 AND user_cursor < $1`,
+		cursor, run.ID)
+	if err != nil {
+		return err
+	}
+	run.UserCursor = cursor
+	return nil
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"github.com/spf13/cobra"
+
+	"github.com/icook/ngpool/pkg/migrate"
 )
 
 func init() {
@@ -17,8 +19,7 @@ func init() {
 				drop := ng.mustLoadAsset("sql/drop.sql")
 				ng.mustRunSQL(drop)
 			}
-			tables := ng.mustLoadAsset("sql/tables.sql")
-			ng.mustRunSQL(tables)
+			ng.mustMigrate()
 		},
 	}
 	provisionCmd.Flags().BoolVarP(&drop, "drop", "d", false, "whether to drop existing schemas")
@@ -28,7 +29,41 @@ func init() {
 func (q *NgWebAPI) mustLoadAsset(asset string) []byte {
 	data, err := Asset(asset)
 	if err != nil {
-		panic("no tables.sql to load")
+		panic("no " + asset + " to load")
 	}
 	return data
 }
+
+// Brings the schema up to date with the migrations compiled in
+func (q *NgWebAPI) mustMigrate() {
+	migrations, err := migrate.Embedded()
+	if err != nil {
+		panic(err)
+	}
+	applied, err := migrate.NewMigrator(q.db, migrations).Up(0)
+	for _, m := range applied {
+		q.log.Info("Applied migration", "version", m.Version, "name", m.Name)
+	}
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Running against a schema that's behind the binary fails in confusing ways,
+// so at least make it obvious in the logs
+func (q *NgWebAPI) warnPendingMigrations() {
+	migrations, err := migrate.Embedded()
+	if err != nil {
+		q.log.Error("Invalid embedded migrations", "err", err)
+		return
+	}
+	todo, err := migrate.NewMigrator(q.db, migrations).Pending()
+	if err != nil {
+		q.log.Error("Failed to check migrations", "err", err)
+		return
+	}
+	if len(todo) > 0 {
+		q.log.Warn("Database schema is behind, run ngctl db migrate",
+			"pending", len(todo), "latest", todo[len(todo)-1].Version)
+	}
+}
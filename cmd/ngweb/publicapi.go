@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"github.com/icook/ngpool/pkg/service"
+)
+
+// The public API, /v1/public/, is read only and meant for third party sites
+// and the pool's own web UI to call directly. Responses are cached for
+// PublicCacheTTL with ETags, requests are limited per client IP, and it has
+// its own CORS origins, PublicCORSOrigins
+
+// Longest span of buckets /v1/public/hashrate returns for each period
+var publicHashratePeriods = map[string]time.Duration{
+	"minute": 24 * time.Hour,
+	"hour":   31 * 24 * time.Hour,
+}
+
+// How far back /v1/public/miners looks
+const publicMinersWindow = 24 * time.Hour
+
+type publicPage struct {
+	Page     int `json:"page"`
+	PageSize int `json:"page_size"`
+	Total    int `json:"total"`
+}
+
+// Page numbers count from 0. Sizes default to and are capped at max
+func parsePage(pageRaw string, sizeRaw string, max int) (int, int, error) {
+	page, size := 0, max
+	var err error
+	if pageRaw != "" {
+		page, err = strconv.Atoi(pageRaw)
+		if err != nil || page < 0 {
+			return 0, 0, errors.Errorf("Invalid page %q", pageRaw)
+		}
+	}
+	if sizeRaw != "" {
+		size, err = strconv.Atoi(sizeRaw)
+		if err != nil || size < 1 {
+			return 0, 0, errors.Errorf("Invalid page_size %q", sizeRaw)
+		}
+		if size > max {
+			size = max
+		}
+	}
+	return page, size, nil
+}
+
+func (q *NgWebAPI) publicPage(c *gin.Context) (publicPage, bool) {
+	page, size, err := parsePage(c.Query("page"), c.Query("page_size"),
+		q.config.GetInt("PublicMaxPageSize"))
+	if err != nil {
+		q.apiError(c, 400, APIError{Code: "invalid_page", Title: err.Error()})
+		return publicPage{}, false
+	}
+	return publicPage{Page: page, PageSize: size}, true
+}
+
+func (q *NgWebAPI) publicMiddleware(c *gin.Context) {
+	now := time.Now()
+	if !q.publicLimiter.allow(c.ClientIP(), now) {
+		wait := q.publicLimiter.retryAfter(now)
+		c.Header("Retry-After", strconv.Itoa(int(wait/time.Second)+1))
+		c.Abort()
+		q.apiError(c, 429, APIError{
+			Code:  "rate_limited",
+			Title: "Too many requests, try again later"})
+		return
+	}
+	c.Next()
+}
+
+// Answers from the cache when it can, otherwise with what load returns.
+// Clients that already have the response get a 304
+func (q *NgWebAPI) publicServe(c *gin.Context, load func() (interface{}, error)) {
+	key := c.Request.URL.RequestURI()
+	now := time.Now()
+	entry := q.publicCache.get(key, now)
+	if entry == nil {
+		data, err := load()
+		if err != nil {
+			q.apiException(c, 500, errors.WithStack(err), SQLError)
+			return
+		}
+		body, err := json.Marshal(gin.H{"data": data})
+		if err != nil {
+			q.apiException(c, 500, errors.WithStack(err), APIError{
+				Code:  "serialize_err",
+				Title: "Response serialization failed"})
+			return
+		}
+		entry = q.publicCache.put(key, body, now)
+	}
+	c.Header("ETag", entry.etag)
+	c.Header("Cache-Control", "public, max-age="+
+		strconv.Itoa(int(q.publicCache.ttl/time.Second)))
+	if c.GetHeader("If-None-Match") == entry.etag {
+		c.Status(304)
+		return
+	}
+	c.Data(200, "application/json; charset=utf-8", entry.body)
+}
+
+func (q *NgWebAPI) getPublicBlocks(c *gin.Context) {
+	page, ok := q.publicPage(c)
+	if !ok {
+		return
+	}
+	currency := c.Query("currency")
+	q.publicServe(c, func() (interface{}, error) {
+		psql := sq.StatementBuilder.PlaceholderFormat(sq.Dollar)
+		count := psql.Select("COUNT(*)").From("block")
+		base := psql.Select("currency, height, hash, powalgo, subsidy, mined_at, target, status, effort",
+			"fees, base_subsidy, tx_count, size").
+			From("block").OrderBy("mined_at DESC").
+			Limit(uint64(page.PageSize)).Offset(uint64(page.Page * page.PageSize))
+		if currency != "" {
+			count = count.Where(sq.Eq{"currency": currency})
+			base = base.Where(sq.Eq{"currency": currency})
+		}
+		qstring, args, err := count.ToSql()
+		if err != nil {
+			return nil, err
+		}
+		if err := q.db.Get(&page.Total, qstring, args...); err != nil {
+			return nil, err
+		}
+		qstring, args, err = base.ToSql()
+		if err != nil {
+			return nil, err
+		}
+		var blocks = []*Block{}
+		if err := q.db.Select(&blocks, qstring, args...); err != nil {
+			return nil, err
+		}
+		for _, block := range blocks {
+			if algo, ok := service.AlgoConfig[block.PowAlgo]; ok {
+				block.Difficulty = algo.NetDifficulty(block.Target)
+			}
+			block.ExplorerURL = blockExplorerURL(block.Currency, block.Hash)
+		}
+		return res{"blocks": blocks, "page": page}, nil
+	})
+}
+
+type hashratePoint struct {
+	Bucket     time.Time `json:"bucket"`
+	ShareChain string    `json:"-"`
+	Difficulty float64   `json:"-"`
+	Shares     int       `json:"shares"`
+	Hashrate   float64   `json:"hashrate"`
+}
+
+// Pool hashrate per sharechain from the share rollups, over ?start and ?end
+// (unix times, the last day by default) in ?period "hour" (the default) or
+// "minute" buckets
+func (q *NgWebAPI) getPublicHashrate(c *gin.Context) {
+	period := c.DefaultQuery("period", "hour")
+	span, ok := publicHashratePeriods[period]
+	if !ok {
+		q.apiError(c, 400, APIError{Code: "invalid_period", Title: "Period must be hour or minute"})
+		return
+	}
+	end := time.Now()
+	if raw := c.Query("end"); raw != "" {
+		unix, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			q.apiError(c, 400, APIError{Code: "invalid_end"})
+			return
+		}
+		end = time.Unix(unix, 0)
+	}
+	start := end.Add(-24 * time.Hour)
+	if raw := c.Query("start"); raw != "" {
+		unix, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			q.apiError(c, 400, APIError{Code: "invalid_start"})
+			return
+		}
+		start = time.Unix(unix, 0)
+	}
+	if end.Sub(start) > span {
+		start = end.Add(-span)
+	}
+	seconds := time.Minute.Seconds()
+	if period == "hour" {
+		seconds = time.Hour.Seconds()
+	}
+	q.publicServe(c, func() (interface{}, error) {
+		var points []*hashratePoint
+		err := q.db.Select(&points,
+			`SELECT bucket, sharechain, SUM(difficulty) AS difficulty, SUM(shares) AS shares
+			FROM share_rollup WHERE period = $1 AND bucket >= $2 AND bucket < $3
+			GROUP BY bucket, sharechain ORDER BY bucket`, period, start, end)
+		if err != nil {
+			return nil, err
+		}
+		chains := map[string][]*hashratePoint{}
+		for _, point := range points {
+			chain, ok := service.ShareChain[point.ShareChain]
+			if !ok {
+				continue
+			}
+			point.Hashrate = point.Difficulty * float64(chain.Algo.HashesPerShare) / seconds
+			chains[point.ShareChain] = append(chains[point.ShareChain], point)
+		}
+		return res{"hashrate": chains, "period": period, "start": start, "end": end}, nil
+	})
+}
+
+type publicMiner struct {
+	Username   string  `json:"username"`
+	ShareChain string  `json:"sharechain"`
+	Difficulty float64 `json:"-"`
+	Hashrate   float64 `json:"hashrate"`
+	// Among everyone who opted in
+	Rank int `json:"rank"`
+	// Fraction of the sharechain's work, opted in or not
+	Share float64 `json:"share"`
+}
+
+// Each sharechain's top miners over the last day, of those who opted in with
+// /v1/user/publicstats. Everyone else only counts toward the totals
+func (q *NgWebAPI) getPublicMiners(c *gin.Context) {
+	page, ok := q.publicPage(c)
+	if !ok {
+		return
+	}
+	q.publicServe(c, func() (interface{}, error) {
+		since := time.Now().Add(-publicMinersWindow).Truncate(time.Hour)
+		var totals []struct {
+			ShareChain string
+			Difficulty float64
+		}
+		err := q.db.Select(&totals,
+			`SELECT sharechain, SUM(difficulty) AS difficulty FROM share_rollup
+			WHERE period = 'hour' AND bucket >= $1 GROUP BY sharechain`, since)
+		if err != nil {
+			return nil, err
+		}
+		chainTotals := map[string]float64{}
+		for _, total := range totals {
+			chainTotals[total.ShareChain] = total.Difficulty
+		}
+		var miners []*publicMiner
+		err = q.db.Select(&miners,
+			`SELECT * FROM (
+				SELECT r.username, r.sharechain, SUM(r.difficulty) AS difficulty,
+				rank() OVER (PARTITION BY r.sharechain ORDER BY SUM(r.difficulty) DESC) AS rank
+				FROM share_rollup r JOIN users u ON u.username = r.username
+				WHERE r.period = 'hour' AND r.bucket >= $1 AND u.public_stats
+				GROUP BY r.username, r.sharechain
+			) ranked WHERE rank > $2 AND rank <= $3
+			ORDER BY sharechain, rank`,
+			since, page.Page*page.PageSize, (page.Page+1)*page.PageSize)
+		if err != nil {
+			return nil, err
+		}
+		chains := map[string][]*publicMiner{}
+		for _, miner := range miners {
+			chain, ok := service.ShareChain[miner.ShareChain]
+			if !ok {
+				continue
+			}
+			miner.Hashrate = miner.Difficulty * float64(chain.Algo.HashesPerShare) /
+				publicMinersWindow.Seconds()
+			if total := chainTotals[miner.ShareChain]; total > 0 {
+				miner.Share = miner.Difficulty / total
+			}
+			chains[miner.ShareChain] = append(chains[miner.ShareChain], miner)
+		}
+		return res{"miners": chains, "page": page}, nil
+	})
+}
+
+type publicPayout struct {
+	TXID        string     `db:"hash" json:"txid"`
+	Currency    string     `json:"currency"`
+	Sent        *time.Time `json:"sent"`
+	Confirmed   bool       `json:"confirmed"`
+	Payees      int        `json:"payees"`
+	Total       int64      `json:"total"`
+	ExplorerURL string     `db:"-" json:"explorer_url,omitempty"`
+}
+
+// Sent payout transactions, newest first, without who they paid
+func (q *NgWebAPI) getPublicPayouts(c *gin.Context) {
+	page, ok := q.publicPage(c)
+	if !ok {
+		return
+	}
+	currency := c.Query("currency")
+	q.publicServe(c, func() (interface{}, error) {
+		psql := sq.StatementBuilder.PlaceholderFormat(sq.Dollar)
+		count := psql.Select("COUNT(*)").From("payout_transaction").
+			Where("sent IS NOT NULL")
+		base := psql.Select("pt.hash, pt.currency, pt.sent, pt.confirmed",
+			"COUNT(p.user_id) AS payees", "COALESCE(SUM(p.amount), 0) AS total").
+			From("payout_transaction as pt").
+			LeftJoin("payout as p ON p.payout_transaction = pt.hash").
+			Where("pt.sent IS NOT NULL").
+			GroupBy("pt.hash").
+			OrderBy("pt.sent DESC").
+			Limit(uint64(page.PageSize)).Offset(uint64(page.Page * page.PageSize))
+		if currency != "" {
+			count = count.Where(sq.Eq{"currency": currency})
+			base = base.Where(sq.Eq{"pt.currency": currency})
+		}
+		qstring, args, err := count.ToSql()
+		if err != nil {
+			return nil, err
+		}
+		if err := q.db.Get(&page.Total, qstring, args...); err != nil {
+			return nil, err
+		}
+		qstring, args, err = base.ToSql()
+		if err != nil {
+			return nil, err
+		}
+		var payouts = []*publicPayout{}
+		if err := q.db.Select(&payouts, qstring, args...); err != nil {
+			return nil, err
+		}
+		for _, payout := range payouts {
+			if config, ok := service.Currency(payout.Currency); ok {
+				payout.ExplorerURL = config.TxURL(payout.TXID)
+			}
+		}
+		return res{"payouts": payouts, "page": page}, nil
+	})
+}
+
+// Whether the user is listed by name on /v1/public/miners
+func (q *NgWebAPI) postPublicStats(c *gin.Context) {
+	var req struct {
+		PublicStats bool `json:"public_stats"`
+	}
+	if !q.BindValid(c, &req) {
+		return
+	}
+	_, err := q.db.Exec(`UPDATE users SET public_stats = $1 WHERE id = $2`,
+		req.PublicStats, c.GetInt("userID"))
+	if err != nil {
+		q.apiException(c, 500, errors.WithStack(err), SQLError)
+		return
+	}
+	q.apiSuccess(c, 200, res{"public_stats": req.PublicStats})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// Rendered public API responses, keyed by request URI. Third party sites
+// poll these, so each is only built once per PublicCacheTTL however many of
+// them ask
+type publicCache struct {
+	ttl     time.Duration
+	mtx     sync.Mutex
+	entries map[string]*cachedResponse
+}
+
+type cachedResponse struct {
+	body    []byte
+	etag    string
+	expires time.Time
+}
+
+// Past this many entries expired ones are dropped on each put, query strings
+// are the client's to pick
+const publicCacheSoftLimit = 1000
+
+func newPublicCache(ttl time.Duration) *publicCache {
+	return &publicCache{ttl: ttl, entries: map[string]*cachedResponse{}}
+}
+
+// Nil unless there's an unexpired response for key
+func (p *publicCache) get(key string, now time.Time) *cachedResponse {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	entry, ok := p.entries[key]
+	if !ok || !now.Before(entry.expires) {
+		return nil
+	}
+	return entry
+}
+
+func (p *publicCache) put(key string, body []byte, now time.Time) *cachedResponse {
+	entry := &cachedResponse{
+		body:    body,
+		etag:    responseETag(body),
+		expires: now.Add(p.ttl),
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if len(p.entries) >= publicCacheSoftLimit {
+		for k, e := range p.entries {
+			if !now.Before(e.expires) {
+				delete(p.entries, k)
+			}
+		}
+	}
+	if p.ttl > 0 {
+		p.entries[key] = entry
+	}
+	return entry
+}
+
+// A strong ETag from the body, so an unchanged response gets a 304 even
+// after it's rebuilt
+func responseETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// Counts requests per client in fixed windows. Coarser than a token bucket,
+// but every counter is dropped when the window rolls over so idle clients
+// cost nothing
+type rateLimiter struct {
+	limit  int
+	window time.Duration
+	mtx    sync.Mutex
+	start  time.Time
+	counts map[string]int
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{limit: limit, window: window, counts: map[string]int{}}
+}
+
+// Whether client may make another request. A limit of 0 allows everything
+func (r *rateLimiter) allow(client string, now time.Time) bool {
+	if r.limit <= 0 {
+		return true
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if now.Sub(r.start) >= r.window {
+		r.start = now
+		r.counts = map[string]int{}
+	}
+	r.counts[client]++
+	return r.counts[client] <= r.limit
+}
+
+// How long until the current window ends and client can try again
+func (r *rateLimiter) retryAfter(now time.Time) time.Duration {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	wait := r.start.Add(r.window).Sub(now)
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
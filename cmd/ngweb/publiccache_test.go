@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublicCache(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	cache := newPublicCache(30 * time.Second)
+	assert.Nil(t, cache.get("/v1/public/blocks", now))
+
+	entry := cache.put("/v1/public/blocks", []byte(`{"data":{}}`), now)
+	assert.Equal(t, entry, cache.get("/v1/public/blocks", now.Add(29*time.Second)))
+	assert.Nil(t, cache.get("/v1/public/blocks", now.Add(30*time.Second)))
+	assert.Nil(t, cache.get("/v1/public/blocks?page=1", now))
+
+	// The same body rebuilt keeps its ETag
+	again := cache.put("/v1/public/blocks", []byte(`{"data":{}}`), now.Add(time.Minute))
+	assert.Equal(t, entry.etag, again.etag)
+	other := cache.put("/v1/public/blocks", []byte(`{"data":[]}`), now)
+	assert.NotEqual(t, entry.etag, other.etag)
+
+	// Without a TTL nothing is kept
+	cache = newPublicCache(0)
+	cache.put("/v1/public/blocks", []byte(`{}`), now)
+	assert.Nil(t, cache.get("/v1/public/blocks", now))
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	limiter := newRateLimiter(2, time.Minute)
+	assert.True(t, limiter.allow("1.2.3.4", now))
+	assert.True(t, limiter.allow("1.2.3.4", now))
+	assert.False(t, limiter.allow("1.2.3.4", now.Add(time.Second)))
+	assert.True(t, limiter.allow("5.6.7.8", now.Add(time.Second)))
+	assert.Equal(t, 59*time.Second, limiter.retryAfter(now.Add(time.Second)))
+
+	// A new window starts over
+	assert.True(t, limiter.allow("1.2.3.4", now.Add(time.Minute)))
+
+	limiter = newRateLimiter(0, time.Minute)
+	for i := 0; i < 10; i++ {
+		assert.True(t, limiter.allow("1.2.3.4", now))
+	}
+}
+
+func TestParsePage(t *testing.T) {
+	page, size, err := parsePage("", "", 100)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, page)
+	assert.Equal(t, 100, size)
+
+	page, size, err = parsePage("3", "20", 100)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, page)
+	assert.Equal(t, 20, size)
+
+	_, size, err = parsePage("0", "5000", 100)
+	assert.NoError(t, err)
+	assert.Equal(t, 100, size)
+
+	_, _, err = parsePage("-1", "", 100)
+	assert.Error(t, err)
+	_, _, err = parsePage("", "0", 100)
+	assert.Error(t, err)
+	_, _, err = parsePage("x", "", 100)
+	assert.Error(t, err)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"math"
+	"sort"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/icook/ngpool/pkg/rpcclient"
+	"github.com/icook/ngpool/pkg/service"
+)
+
+func init() {
+	reconcileCmd := &cobra.Command{
+		Use:   "reconcile",
+		Short: "Checks each currency's pool wallet covers what miners are owed",
+		Long: `Checks each currency's pool wallet covers what miners are owed. The wallet
+balance is read from a coinserver with the BlockSubsidyAddress imported as
+watch-only (importaddress), and compared against unpaid credits plus payouts
+that haven't been sent yet. Currencies with a ColdWalletAddress count its
+balance too, so it needs importing as well. Meant to be run from cron`,
+		Run: func(cmd *cobra.Command, args []string) {
+			ng := NewNgWebAPI()
+			ng.ParseConfig()
+			ng.ConnectDB()
+			err := ng.Reconcile()
+			if err != nil {
+				ng.log.Crit("Failed", "err", err)
+			}
+		},
+	}
+	RootCmd.AddCommand(reconcileCmd)
+}
+
+// All amounts in satoshis
+type walletReconciliation struct {
+	Currency string
+	// Unspent outputs paying the BlockSubsidyAddress and ColdWalletAddress,
+	// as the coinserver sees them
+	Wallet int64
+	// Credits from mature blocks not yet in a payout transaction
+	Outstanding int64
+	// Payouts in transactions that have been signed but not sent, the coins
+	// are still in the wallet
+	Pending int64
+	// Wallet less what it should hold. Negative is a shortfall, which means
+	// something was paid twice or paid from the wrong place
+	Discrepancy int64
+	Alert       bool
+}
+
+// Flags a discrepancy larger than tolerance, a fraction of what the wallet
+// should hold. A surplus is flagged too, it's either credits that were never
+// generated or coins we don't know about. Anything under dust is ignored,
+// credits are rounded when they're paid
+func reconcileBalance(currency string, wallet int64, outstanding int64, pending int64,
+	tolerance float64, dust int64) *walletReconciliation {
+	r := &walletReconciliation{
+		Currency:    currency,
+		Wallet:      wallet,
+		Outstanding: outstanding,
+		Pending:     pending,
+		Discrepancy: wallet - outstanding - pending,
+	}
+	off := math.Abs(float64(r.Discrepancy))
+	r.Alert = off > float64(dust) && off > float64(outstanding+pending)*tolerance
+	return r
+}
+
+func walletBalance(rpc *rpcclient.Client, address string) (int64, error) {
+	validated, err := rpc.ValidateAddress(address)
+	if err != nil {
+		return 0, err
+	}
+	if !validated.IsMine && !validated.IsWatchOnly {
+		return 0, errors.Errorf("%s isn't in the coinserver's wallet, import it with importaddress", address)
+	}
+	outputs, err := rpc.ListUnspent(0, 9999999, []string{address})
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, output := range outputs {
+		amount, err := btcutil.NewAmount(output.Amount)
+		if err != nil {
+			return 0, err
+		}
+		total += int64(amount)
+	}
+	return total, nil
+}
+
+func (q *NgWebAPI) Reconcile() error {
+	services, err := q.service.LoadServices("coinserver")
+	if err != nil {
+		return err
+	}
+	currencyCoinservers := map[string]*rpcclient.Client{}
+	for _, service := range services {
+		endpoint := service.Labels["endpoint"]
+		currency := service.Labels["currency"]
+		client, err := q.coinserverClient(endpoint, currency)
+		if err != nil {
+			return err
+		}
+		currencyCoinservers[currency] = client
+	}
+
+	configs := service.Currencies()
+	currencies := []string{}
+	for code := range configs {
+		currencies = append(currencies, code)
+	}
+	sort.Strings(currencies)
+
+	tolerance := q.config.GetFloat64("ReconcileTolerance")
+	var alerts int
+	for _, code := range currencies {
+		config := configs[code]
+		logger := q.log.New("currency", code)
+		rpc, ok := currencyCoinservers[code]
+		if !ok {
+			logger.Warn("Skipping currency, no coinserver live")
+			continue
+		}
+		address := (*config.BlockSubsidyAddress).EncodeAddress()
+		wallet, err := walletBalance(rpc, address)
+		if err != nil {
+			logger.Error("Failed to read wallet balance", "address", address, "err", err)
+			continue
+		}
+		if config.ColdWalletAddress != nil {
+			cold := config.ColdWalletAddress.EncodeAddress()
+			coldBalance, err := walletBalance(rpc, cold)
+			if err != nil {
+				logger.Error("Failed to read cold wallet balance", "address", cold, "err", err)
+				continue
+			}
+			wallet += coldBalance
+		}
+
+		var outstanding, pending float64
+		err = q.db.QueryRow(
+			`SELECT COALESCE(SUM(amount), 0) FROM credit
+			WHERE currency = $1 AND payout_transaction IS NULL`, code).Scan(&outstanding)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		err = q.db.QueryRow(
+			`SELECT COALESCE(SUM(payout.amount), 0) FROM payout
+			JOIN payout_transaction ON payout_transaction.hash = payout.payout_transaction
+			WHERE payout_transaction.currency = $1 AND payout_transaction.sent IS NULL`,
+			code).Scan(&pending)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		r := reconcileBalance(code, wallet, int64(outstanding), int64(pending),
+			tolerance, config.DustThreshold)
+		if r.Alert {
+			alerts++
+			logger.Error("Pool wallet doesn't match the books",
+				"wallet", r.Wallet, "outstanding", r.Outstanding,
+				"pending", r.Pending, "discrepancy", r.Discrepancy)
+			continue
+		}
+		logger.Info("Pool wallet reconciled",
+			"wallet", r.Wallet, "outstanding", r.Outstanding,
+			"pending", r.Pending, "discrepancy", r.Discrepancy)
+	}
+	if alerts > 0 {
+		return errors.Errorf("%d currencies failed to reconcile", alerts)
+	}
+	return nil
+}
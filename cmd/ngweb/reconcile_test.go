@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReconcileBalance(t *testing.T) {
+	// Rounding leaves a little behind
+	r := reconcileBalance("LTC", 1000000100, 900000000, 100000000, 0.01, 546)
+	assert.False(t, r.Alert)
+	assert.Equal(t, int64(100), r.Discrepancy)
+
+	// Paid twice
+	r = reconcileBalance("LTC", 800000000, 900000000, 100000000, 0.01, 546)
+	assert.True(t, r.Alert)
+	assert.Equal(t, int64(-200000000), r.Discrepancy)
+
+	// Coins nobody was credited for
+	r = reconcileBalance("LTC", 1500000000, 900000000, 100000000, 0.01, 546)
+	assert.True(t, r.Alert)
+
+	// Nothing owed, only dust left over
+	r = reconcileBalance("LTC", 500, 0, 0, 0.01, 546)
+	assert.False(t, r.Alert)
+	r = reconcileBalance("LTC", 5000, 0, 0, 0.01, 546)
+	assert.True(t, r.Alert)
+}
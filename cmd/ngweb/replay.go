@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/icook/ngpool/pkg/service"
+)
+
+func init() {
+	var onlyChanged bool
+	replayCmd := &cobra.Command{
+		Use:   "replaycredits [blockhash]...",
+		Short: "Recomputes credits for credited blocks and diffs them against the database",
+		Long: `Recomputes credits for credited blocks and diffs them against the database.
+Credits are worked out from the shares still in the database with the current
+sharechain config, the same way generatecredits does, and nothing is written.
+Useful for auditing after a payout method or fee change, or a payout bug fix.
+Shares older than ShareRetention have been pruned, so old rounds can't be
+replayed in full`,
+		Args: cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			ng := NewNgWebAPI()
+			ng.ParseConfig()
+			ng.ConnectDB()
+			for _, hash := range args {
+				replay, err := ng.ReplayCredits(hash)
+				if err != nil {
+					ng.log.Crit("Failed", "block", hash, "err", err)
+					os.Exit(1)
+				}
+				replay.Print(os.Stdout, onlyChanged)
+			}
+		},
+	}
+	replayCmd.Flags().BoolVar(&onlyChanged, "changed", false, "Only list users whose credit changed")
+	RootCmd.AddCommand(replayCmd)
+}
+
+// One user's credit from a sharechain for a block, as recorded and as
+// replayed. Amounts in satoshis
+type creditDiff struct {
+	ShareChain string
+	UserID     int
+	Username   string
+	Recorded   int64
+	Replayed   int64
+}
+
+func (d *creditDiff) Change() int64 {
+	return d.Replayed - d.Recorded
+}
+
+type creditReplay struct {
+	Block *payoutBlock
+	Diffs []*creditDiff
+	// Why the replay may not match even if nothing changed, ie shares were
+	// pruned
+	Warnings []string
+}
+
+type creditKey struct {
+	shareChain string
+	userID     int
+}
+
+// Lines up recorded and replayed credits by sharechain and user, sorted the
+// same way. A user missing on one side has a 0 there
+func diffCredits(recorded map[string][]*CreditMap,
+	replayed map[string][]*CreditMap) []*creditDiff {
+	diffs := map[creditKey]*creditDiff{}
+	get := func(shareChain string, userID int) *creditDiff {
+		key := creditKey{shareChain, userID}
+		diff, ok := diffs[key]
+		if !ok {
+			diff = &creditDiff{ShareChain: shareChain, UserID: userID}
+			diffs[key] = diff
+		}
+		return diff
+	}
+	for shareChain, credits := range recorded {
+		for _, credit := range credits {
+			get(shareChain, credit.UserID).Recorded += credit.Amount
+		}
+	}
+	for shareChain, credits := range replayed {
+		for _, credit := range credits {
+			get(shareChain, credit.UserID).Replayed += credit.Amount
+		}
+	}
+	ret := []*creditDiff{}
+	for _, diff := range diffs {
+		ret = append(ret, diff)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].ShareChain != ret[j].ShareChain {
+			return ret[i].ShareChain < ret[j].ShareChain
+		}
+		return ret[i].UserID < ret[j].UserID
+	})
+	return ret
+}
+
+func (q *NgWebAPI) ReplayCredits(hash string) (*creditReplay, error) {
+	var block payoutBlock
+	err := q.db.Get(&block,
+		`SELECT currency, height, hash, powalgo, subsidy, mined_at, target
+		FROM block WHERE hash = $1 AND credited = true`, hash)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Loading credited block %s", hash)
+	}
+	algo, ok := service.AlgoConfig[block.PowAlgo]
+	if !ok {
+		return nil, errors.Errorf("Couldn't locate pow alogo %s", block.PowAlgo)
+	}
+	block.algoConfig = algo
+
+	payout, err := q.blockCredits(&block)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []struct {
+		ShareChain string `db:"sharechain"`
+		UserID     int    `db:"user_id"`
+		Amount     int64
+	}
+	err = q.db.Select(&rows,
+		`SELECT sharechain, user_id, amount FROM credit WHERE blockhash = $1`, hash)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	recorded := map[string][]*CreditMap{}
+	for _, row := range rows {
+		recorded[row.ShareChain] = append(recorded[row.ShareChain],
+			&CreditMap{UserID: row.UserID, Amount: row.Amount})
+	}
+
+	replay := &creditReplay{
+		Block: &block,
+		Diffs: diffCredits(recorded, payout.credits),
+	}
+	for _, sc := range payout.sharechains {
+		// Shares from before the oldest one left have been pruned. Windows
+		// reaching past the round start (PPLNS) can come up short too
+		var oldest *time.Time
+		err := q.db.Get(&oldest,
+			`SELECT MIN(mined_at) FROM share WHERE sharechain = $1`, sc.Name)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if oldest != nil && oldest.After(block.lastBlockTime) {
+			replay.Warnings = append(replay.Warnings, fmt.Sprintf(
+				"%s shares before %s have been pruned", sc.Name, oldest.Format(time.RFC3339)))
+		}
+		if sc.Data["type"] == "pplns" {
+			toFind, _ := sc.Data["sharesToFind"].(float64)
+			found, _ := sc.Data["sharesFound"].(float64)
+			if found < toFind {
+				replay.Warnings = append(replay.Warnings, fmt.Sprintf(
+					"%s PPLNS window only found %.0f of %.0f shares", sc.Name, found, toFind))
+			}
+		}
+	}
+
+	var users []struct {
+		ID       int
+		Username string
+	}
+	err = q.db.Select(&users, `SELECT id, username FROM users`)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	usernames := map[int]string{}
+	for _, user := range users {
+		usernames[user.ID] = user.Username
+	}
+	for _, diff := range replay.Diffs {
+		diff.Username = usernames[diff.UserID]
+	}
+	return replay, nil
+}
+
+func (r *creditReplay) Print(out io.Writer, onlyChanged bool) {
+	var changed int
+	var moved int64
+	for _, diff := range r.Diffs {
+		if diff.Change() != 0 {
+			changed++
+		}
+		if diff.Change() > 0 {
+			moved += diff.Change()
+		}
+	}
+	fmt.Fprintf(out, "%s %d %s: %d of %d credits changed, %d satoshis moved\n",
+		r.Block.Currency, r.Block.Height, r.Block.Hash, changed, len(r.Diffs), moved)
+	for _, warning := range r.Warnings {
+		fmt.Fprintf(out, "WARNING: %s\n", warning)
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SHARECHAIN\tUSER\tRECORDED\tREPLAYED\tCHANGE")
+	for _, diff := range r.Diffs {
+		if onlyChanged && diff.Change() == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%d %s\t%d\t%d\t%+d\n", diff.ShareChain, diff.UserID,
+			diff.Username, diff.Recorded, diff.Replayed, diff.Change())
+	}
+	w.Flush()
+	fmt.Fprintln(out)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffCredits(t *testing.T) {
+	recorded := map[string][]*CreditMap{
+		"LTC_T1": {
+			{UserID: 2, Amount: 700},
+			{UserID: 1, Amount: 300},
+		},
+		"LTC_T2": {
+			{UserID: 1, Amount: 50},
+		},
+	}
+	replayed := map[string][]*CreditMap{
+		"LTC_T1": {
+			{UserID: 1, Amount: 400},
+			{UserID: 2, Amount: 500},
+			{UserID: 3, Amount: 100},
+		},
+	}
+	diffs := diffCredits(recorded, replayed)
+	assert.Len(t, diffs, 4)
+	expected := []creditDiff{
+		{ShareChain: "LTC_T1", UserID: 1, Recorded: 300, Replayed: 400},
+		{ShareChain: "LTC_T1", UserID: 2, Recorded: 700, Replayed: 500},
+		{ShareChain: "LTC_T1", UserID: 3, Recorded: 0, Replayed: 100},
+		{ShareChain: "LTC_T2", UserID: 1, Recorded: 50, Replayed: 0},
+	}
+	for i, diff := range diffs {
+		assert.Equal(t, expected[i], *diff)
+	}
+	assert.Equal(t, int64(-200), diffs[1].Change())
+
+	replay := &creditReplay{
+		Block:    &payoutBlock{Currency: "LTC", Height: 10, Hash: "abc"},
+		Diffs:    diffs,
+		Warnings: []string{"LTC_T2 shares before then have been pruned"},
+	}
+	var out bytes.Buffer
+	replay.Print(&out, false)
+	assert.Contains(t, out.String(), "4 of 4 credits changed, 200 satoshis moved")
+	assert.Contains(t, out.String(), "WARNING: LTC_T2")
+
+	// Matching credits are dropped with onlyChanged
+	diffs[0].Replayed = 300
+	out.Reset()
+	replay.Print(&out, true)
+	assert.Contains(t, out.String(), "3 of 4 credits changed, 100 satoshis moved")
+	assert.Equal(t, 2, strings.Count(out.String(), "LTC_T1"))
+}
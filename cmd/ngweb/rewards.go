@@ -0,0 +1,72 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// Fee and subsidy revenue from a currency's blocks, leaving out orphans and
+// blocks saved before the split was recorded
+type currencyRewards struct {
+	Currency    string  `json:"currency"`
+	Blocks      int     `json:"blocks"`
+	Fees        int64   `json:"fees"`
+	BaseSubsidy int64   `db:"base_subsidy" json:"base_subsidy"`
+	AvgTxCount  float64 `db:"avg_tx_count" json:"avg_tx_count"`
+	AvgSize     float64 `db:"avg_size" json:"avg_size"`
+	// Fees as a fraction of the whole reward, nil without any reward
+	FeeShare *float64 `json:"fee_share"`
+}
+
+var rewardWindows = []struct {
+	Name   string
+	Length time.Duration
+}{
+	{"24h", time.Hour * 24},
+	{"7d", time.Hour * 24 * 7},
+	{"30d", time.Hour * 24 * 30},
+}
+
+func computeFeeShare(fees int64, baseSubsidy int64) *float64 {
+	if fees+baseSubsidy <= 0 {
+		return nil
+	}
+	share := float64(fees) / float64(fees+baseSubsidy)
+	return &share
+}
+
+func (q *NgWebAPI) loadRewards(since time.Time) ([]*currencyRewards, error) {
+	var rewards = []*currencyRewards{}
+	err := q.db.Select(&rewards,
+		`SELECT currency, COUNT(*) AS blocks, SUM(fees) AS fees,
+		SUM(base_subsidy) AS base_subsidy, AVG(tx_count) AS avg_tx_count,
+		AVG(size) AS avg_size
+		FROM block
+		WHERE mined_at >= $1 AND status != 'orphan' AND fees IS NOT NULL
+		GROUP BY currency
+		ORDER BY currency`, since)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	for _, reward := range rewards {
+		reward.FeeShare = computeFeeShare(reward.Fees, reward.BaseSubsidy)
+	}
+	return rewards, nil
+}
+
+func (q *NgWebAPI) getRewards(c *gin.Context) {
+	now := time.Now()
+	windows := map[string][]*currencyRewards{}
+	for _, window := range rewardWindows {
+		rewards, err := q.loadRewards(now.Add(-window.Length))
+		if err != nil {
+			q.apiException(c, 500, errors.WithStack(err), SQLError)
+			return
+		}
+		windows[window.Name] = rewards
+	}
+	q.apiSuccess(c, 200, res{"rewards": windows})
+}
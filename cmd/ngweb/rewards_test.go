@@ -0,0 +1,13 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestComputeFeeShare(t *testing.T) {
+	assert.Nil(t, computeFeeShare(0, 0))
+	assert.Equal(t, 0.0, *computeFeeShare(0, 2500000000))
+	assert.Equal(t, 0.2, *computeFeeShare(25, 100))
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/spf13/cobra"
+
+	"github.com/icook/ngpool/pkg/service"
+)
+
+func init() {
+	var from string
+	rollupsharesCmd := &cobra.Command{
+		Use:   "rollupshares",
+		Short: "Rolls shares into per worker minute and hour buckets, then prunes old shares",
+		Long: `Rolls shares into per worker minute and hour buckets, then prunes old shares.
+This normally runs in the background of "ngweb run", and catches up on its own
+after downtime. --from rebuilds the buckets from an earlier time, as far back
+as shares are kept`,
+		Run: func(cmd *cobra.Command, args []string) {
+			ng := NewNgWebAPI()
+			ng.ParseConfig()
+			ng.ConnectDB()
+			if from != "" {
+				start, err := time.Parse(time.RFC3339, from)
+				if err != nil {
+					fmt.Println("Invalid --from, must be RFC3339:", err)
+					os.Exit(1)
+				}
+				err = ng.ResetRollups(start)
+				if err != nil {
+					ng.log.Crit("Failed", "err", err)
+					os.Exit(1)
+				}
+			}
+			err := ng.RollupShares(time.Now())
+			if err != nil {
+				ng.log.Crit("Failed", "err", err)
+				os.Exit(1)
+			}
+			err = ng.PruneShares(time.Now())
+			if err != nil {
+				ng.log.Crit("Failed", "err", err)
+			}
+		},
+	}
+	rollupsharesCmd.Flags().StringVar(&from, "from", "",
+		"Rebuild buckets starting at this time, ie 2018-01-02T15:04:05Z")
+	RootCmd.AddCommand(rollupsharesCmd)
+}
+
+// Shares are inserted as they arrive, so we hold off on rolling up a minute
+// until it's been over for this long
+const rollupLag = time.Minute
+
+// A range of shares to roll up in one transaction. Ranges never cross an hour
+// boundary, so the hour bucket can be rebuilt from the minute buckets
+type rollupRange struct {
+	from time.Time
+	to   time.Time
+}
+
+// Splits [from, to) into ranges ending on hour boundaries. from and to should
+// already be truncated to the minute
+func rollupRanges(from time.Time, to time.Time) []rollupRange {
+	ranges := []rollupRange{}
+	for from.Before(to) {
+		end := from.Truncate(time.Hour).Add(time.Hour)
+		if end.After(to) {
+			end = to
+		}
+		ranges = append(ranges, rollupRange{from, end})
+		from = end
+	}
+	return ranges
+}
+
+// Returns the time before which a sharechain's shares can be deleted. Shares
+// newer than retention are kept, along with any not rolled up yet, any not in
+// a closed shift, and any that might be in the PPLNS window of a block that
+// hasn't been credited
+func shareCutoff(now time.Time, retention time.Duration, rolledTo time.Time,
+	shiftEnd *time.Time, oldestUncredited *time.Time) time.Time {
+	cutoff := now.Add(-retention)
+	if rolledTo.Before(cutoff) {
+		cutoff = rolledTo
+	}
+	if shiftEnd != nil && shiftEnd.Before(cutoff) {
+		cutoff = *shiftEnd
+	}
+	if oldestUncredited != nil {
+		window := oldestUncredited.Add(-retention)
+		if window.Before(cutoff) {
+			cutoff = window
+		}
+	}
+	return cutoff
+}
+
+func sortedShareChains() []*service.ShareChainConfig {
+	chains := []*service.ShareChainConfig{}
+	for _, sc := range service.ShareChain {
+		chains = append(chains, sc)
+	}
+	sort.Slice(chains, func(i, j int) bool { return chains[i].Name < chains[j].Name })
+	return chains
+}
+
+// Starts rolling up and pruning shares every RollupInterval
+func (q *NgWebAPI) RunRollups() {
+	interval := q.config.GetDuration("RollupInterval")
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			now := time.Now()
+			if err := q.RollupShares(now); err != nil {
+				q.log.Error("Failed to roll up shares", "err", err)
+			} else if err := q.PruneShares(now); err != nil {
+				q.log.Error("Failed to prune shares", "err", err)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// Moves every sharechain's cursor back to start, so the next rollup rebuilds
+// buckets from there
+func (q *NgWebAPI) ResetRollups(start time.Time) error {
+	start = start.Truncate(time.Minute)
+	for _, sc := range sortedShareChains() {
+		_, err := q.db.Exec(
+			`INSERT INTO share_rollup_cursor (sharechain, rolled_to) VALUES ($1, $2)
+			ON CONFLICT (sharechain) DO UPDATE SET rolled_to = LEAST(share_rollup_cursor.rolled_to, $2)`,
+			sc.Name, start)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rolls up all finished minutes since each sharechain's cursor. After
+// downtime this works through the backlog an hour at a time
+func (q *NgWebAPI) RollupShares(now time.Time) error {
+	target := now.Add(-rollupLag).Truncate(time.Minute)
+	for _, sc := range sortedShareChains() {
+		var rolledTo time.Time
+		err := q.db.Get(&rolledTo,
+			`SELECT rolled_to FROM share_rollup_cursor WHERE sharechain = $1`, sc.Name)
+		if err == sql.ErrNoRows {
+			var first *time.Time
+			err = q.db.Get(&first,
+				`SELECT MIN(mined_at) FROM share WHERE sharechain = $1`, sc.Name)
+			if err != nil {
+				return err
+			}
+			if first == nil {
+				continue
+			}
+			rolledTo = first.Truncate(time.Minute)
+		} else if err != nil {
+			return err
+		}
+
+		ranges := rollupRanges(rolledTo, target)
+		for _, r := range ranges {
+			err = q.rollupRange(sc.Name, r)
+			if err != nil {
+				return err
+			}
+		}
+		if len(ranges) > 1 {
+			q.log.Info("Backfilled share rollups", "sharechain", sc.Name,
+				"from", rolledTo, "to", target)
+		}
+	}
+	return nil
+}
+
+func (q *NgWebAPI) rollupRange(shareChain string, r rollupRange) error {
+	tx, err := q.db.Beginx()
+	if err != nil {
+		return err
+	}
+	err = rollupRangeTx(tx, shareChain, r)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Buckets are rebuilt rather than added to, so rolling up a range again (ie
+// after ResetRollups) gives the same result
+func rollupRangeTx(tx *sqlx.Tx, shareChain string, r rollupRange) error {
+	_, err := tx.Exec(
+		`DELETE FROM share_rollup WHERE period = 'minute' AND sharechain = $1
+		AND bucket >= $2 AND bucket < $3`, shareChain, r.from, r.to)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		`INSERT INTO share_rollup
+		(period, bucket, sharechain, username, worker, difficulty, shares)
+		SELECT 'minute', date_trunc('minute', mined_at), sharechain, username,
+		worker, SUM(difficulty), COUNT(*)
+		FROM share WHERE sharechain = $1 AND mined_at >= $2 AND mined_at < $3
+		GROUP BY 2, 3, 4, 5`, shareChain, r.from, r.to)
+	if err != nil {
+		return err
+	}
+
+	hour := r.from.Truncate(time.Hour)
+	_, err = tx.Exec(
+		`DELETE FROM share_rollup WHERE period = 'hour' AND sharechain = $1
+		AND bucket = $2`, shareChain, hour)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		`INSERT INTO share_rollup
+		(period, bucket, sharechain, username, worker, difficulty, shares)
+		SELECT 'hour', $2, sharechain, username, worker, SUM(difficulty), SUM(shares)
+		FROM share_rollup WHERE period = 'minute' AND sharechain = $1
+		AND bucket >= $2 AND bucket < $3
+		GROUP BY 3, 4, 5`, shareChain, hour, hour.Add(time.Hour))
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO share_rollup_cursor (sharechain, rolled_to) VALUES ($1, $2)
+		ON CONFLICT (sharechain) DO UPDATE SET rolled_to = $2`, shareChain, r.to)
+	return err
+}
+
+// Deletes shares older than ShareRetention that are no longer needed, and
+// minute buckets older than MinuteRollupRetention
+func (q *NgWebAPI) PruneShares(now time.Time) error {
+	retention := q.config.GetDuration("ShareRetention")
+	minuteRetention := q.config.GetDuration("MinuteRollupRetention")
+
+	var oldestUncredited *time.Time
+	err := q.db.Get(&oldestUncredited,
+		`SELECT MIN(mined_at) FROM block WHERE credited = false AND status != 'orphan'`)
+	if err != nil {
+		return err
+	}
+
+	for _, sc := range sortedShareChains() {
+		var rolledTo time.Time
+		err := q.db.Get(&rolledTo,
+			`SELECT rolled_to FROM share_rollup_cursor WHERE sharechain = $1`, sc.Name)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		var shiftEnd *time.Time
+		if sc.PayoutMethod == "shift" {
+			err = q.db.Get(&shiftEnd,
+				`SELECT MAX(ended_at) FROM shift WHERE sharechain = $1`, sc.Name)
+			if err != nil {
+				return err
+			}
+			if shiftEnd == nil {
+				continue
+			}
+		}
+
+		cutoff := shareCutoff(now, retention, rolledTo, shiftEnd, oldestUncredited)
+		res, err := q.db.Exec(
+			`DELETE FROM share WHERE sharechain = $1 AND mined_at < $2`, sc.Name, cutoff)
+		if err != nil {
+			return err
+		}
+		if pruned, _ := res.RowsAffected(); pruned > 0 {
+			q.log.Info("Pruned shares", "sharechain", sc.Name, "before", cutoff, "count", pruned)
+		}
+
+		// Keep minute buckets for the current hour since it gets rebuilt
+		// from them
+		minuteCutoff := now.Add(-minuteRetention)
+		if hour := rolledTo.Truncate(time.Hour); hour.Before(minuteCutoff) {
+			minuteCutoff = hour
+		}
+		_, err = q.db.Exec(
+			`DELETE FROM share_rollup WHERE period = 'minute' AND sharechain = $1
+			AND bucket < $2`, sc.Name, minuteCutoff)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = q.db.Exec(`DELETE FROM minute_share WHERE minute < $1`,
+		now.Add(-minuteRetention))
+	return err
+}
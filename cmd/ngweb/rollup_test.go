@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRollupRanges(t *testing.T) {
+	at := func(h, m int) time.Time { return time.Date(2018, 1, 1, h, m, 0, 0, time.UTC) }
+	assert.Equal(t, []rollupRange{{at(10, 17), at(10, 30)}},
+		rollupRanges(at(10, 17), at(10, 30)))
+	// Backfilling splits on hour boundaries
+	assert.Equal(t, []rollupRange{
+		{at(10, 17), at(11, 0)},
+		{at(11, 0), at(12, 0)},
+		{at(12, 0), at(12, 5)},
+	}, rollupRanges(at(10, 17), at(12, 5)))
+	assert.Empty(t, rollupRanges(at(10, 17), at(10, 17)))
+}
+
+func TestShareCutoff(t *testing.T) {
+	now := time.Date(2018, 1, 10, 0, 0, 0, 0, time.UTC)
+	week := time.Hour * 24 * 7
+	rolled := now.Add(-time.Minute)
+	assert.Equal(t, now.Add(-week), shareCutoff(now, week, rolled, nil, nil))
+
+	// Unrolled shares are kept
+	behind := now.Add(-week - time.Hour)
+	assert.Equal(t, behind, shareCutoff(now, week, behind, nil, nil))
+
+	// As are shares not in a closed shift
+	shiftEnd := now.Add(-week - time.Hour*2)
+	assert.Equal(t, shiftEnd, shareCutoff(now, week, rolled, &shiftEnd, nil))
+
+	// And the window before an uncredited block
+	block := now.Add(-time.Hour * 3)
+	assert.Equal(t, block.Add(-week), shareCutoff(now, week, rolled, nil, &block))
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/icook/ngpool/pkg/service"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	closeshiftsCmd := &cobra.Command{
+		Use:   "closeshifts",
+		Short: "Closes all finished shifts for shift payout sharechains",
+		Run: func(cmd *cobra.Command, args []string) {
+			ng := NewNgWebAPI()
+			ng.ParseConfig()
+			ng.ConnectDB()
+			err := ng.CloseShifts()
+			if err != nil {
+				ng.log.Crit("Failed", "err", err)
+			}
+		},
+	}
+	RootCmd.AddCommand(closeshiftsCmd)
+}
+
+// Returned when a block was mined in a shift that hasn't closed yet
+var errShiftOpen = errors.New("Shift not closed")
+
+// A shift is a window of shares for a sharechain, closed after a fixed time or
+// amount of difficulty. Once closed the per user share totals are stored in
+// shift_share and never change, so payouts for a block can be recomputed from
+// the shift records alone. The checksum covers the shift and its user totals
+// so any later edits are detected. Shifts cover shares mined in (StartedAt,
+// EndedAt]
+type Shift struct {
+	ID         int       `json:"id"`
+	ShareChain string    `db:"sharechain" json:"sharechain"`
+	Number     int       `json:"number"`
+	StartedAt  time.Time `db:"started_at" json:"started_at"`
+	EndedAt    time.Time `db:"ended_at" json:"ended_at"`
+	Difficulty float64   `json:"difficulty"`
+	Checksum   string    `json:"checksum"`
+
+	// Total difficulty by user id
+	Shares map[int]float64 `db:"-" json:"-"`
+}
+
+// Computes the checksum of the shift and its shares. Users are hashed in id
+// order, and times at microsecond precision since that's what postgres
+// stores
+func (s *Shift) computeChecksum() string {
+	hasher := sha256.New()
+	fmt.Fprintf(hasher, "%s\n%d\n%s\n%s\n%s\n",
+		s.ShareChain, s.Number,
+		s.StartedAt.UTC().Truncate(time.Microsecond).Format(time.RFC3339Nano),
+		s.EndedAt.UTC().Truncate(time.Microsecond).Format(time.RFC3339Nano),
+		strconv.FormatFloat(s.Difficulty, 'g', -1, 64))
+	userIDs := []int{}
+	for userID := range s.Shares {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Ints(userIDs)
+	for _, userID := range userIDs {
+		fmt.Fprintf(hasher, "%d:%s\n", userID,
+			strconv.FormatFloat(s.Shares[userID], 'g', -1, 64))
+	}
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// Returns the end of the time based shift starting at start. Shifts are
+// aligned to multiples of length, so the first one may be short
+func timeShiftEnd(start time.Time, length time.Duration) time.Time {
+	return start.Truncate(length).Add(length)
+}
+
+// Closes every shift that can be closed for each shift sharechain
+func (q *NgWebAPI) CloseShifts() error {
+	for _, sc := range service.ShareChain {
+		if sc.PayoutMethod != "shift" {
+			continue
+		}
+		for {
+			shift, err := q.closeShift(sc)
+			if err != nil {
+				return err
+			}
+			if shift == nil {
+				break
+			}
+			q.log.Info("Closed shift", "sharechain", sc.Name,
+				"number", shift.Number, "difficulty", shift.Difficulty,
+				"users", len(shift.Shares), "checksum", shift.Checksum)
+		}
+	}
+	return nil
+}
+
+// Closes the next shift for the sharechain if it's finished. Returns nil if
+// there's nothing to close
+func (q *NgWebAPI) closeShift(sc *service.ShareChainConfig) (*Shift, error) {
+	shift := &Shift{ShareChain: sc.Name}
+	var last Shift
+	err := q.db.QueryRowx(
+		`SELECT number, ended_at FROM shift WHERE sharechain = $1
+		ORDER BY number DESC LIMIT 1`, sc.Name).StructScan(&last)
+	if err == sql.ErrNoRows {
+		// First shift starts just before the first share
+		var first *time.Time
+		err = q.db.Get(&first,
+			`SELECT MIN(mined_at) FROM share WHERE sharechain = $1`, sc.Name)
+		if err != nil {
+			return nil, err
+		}
+		if first == nil {
+			return nil, nil
+		}
+		shift.StartedAt = first.Add(-time.Microsecond)
+	} else if err != nil {
+		return nil, err
+	} else {
+		shift.Number = last.Number + 1
+		shift.StartedAt = last.EndedAt
+	}
+
+	if sc.ShiftLength > 0 {
+		shift.EndedAt = timeShiftEnd(shift.StartedAt, sc.ShiftLength)
+		if shift.EndedAt.After(time.Now()) {
+			return nil, nil
+		}
+	} else {
+		end, err := q.difficultyShiftEnd(sc, shift.StartedAt)
+		if err != nil {
+			return nil, err
+		}
+		if end == nil {
+			return nil, nil
+		}
+		shift.EndedAt = *end
+	}
+
+	type userShare struct {
+		UserID     int `db:"user_id"`
+		Difficulty float64
+	}
+	var shares []userShare
+	// Shares we can't match to a user go to the fee user, like PPLNS
+	err = q.db.Select(&shares,
+		`SELECT COALESCE(users.id, 1) AS user_id, SUM(share.difficulty) AS difficulty
+		FROM share LEFT JOIN users ON users.username = share.username
+		WHERE share.sharechain = $1 AND share.mined_at > $2 AND share.mined_at <= $3
+		GROUP BY 1`,
+		sc.Name, shift.StartedAt, shift.EndedAt)
+	if err != nil {
+		return nil, err
+	}
+	shift.Shares = map[int]float64{}
+	for _, share := range shares {
+		shift.Shares[share.UserID] = share.Difficulty
+		shift.Difficulty += share.Difficulty
+	}
+	shift.Checksum = shift.computeChecksum()
+
+	tx, err := q.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	err = tx.QueryRowx(
+		`INSERT INTO shift
+		(sharechain, number, started_at, ended_at, difficulty, checksum)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		shift.ShareChain, shift.Number, shift.StartedAt, shift.EndedAt,
+		shift.Difficulty, shift.Checksum).Scan(&shift.ID)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	for userID, difficulty := range shift.Shares {
+		_, err = tx.Exec(
+			`INSERT INTO shift_share (shift_id, user_id, difficulty)
+			VALUES ($1, $2, $3)`, shift.ID, userID, difficulty)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return shift, nil
+}
+
+// Finds the time of the share that brings the shift to ShiftDifficulty.
+// Returns nil if there aren't enough shares yet
+func (q *NgWebAPI) difficultyShiftEnd(sc *service.ShareChainConfig,
+	start time.Time) (*time.Time, error) {
+	var (
+		accumulated float64
+		offset      = 0
+	)
+	type Share struct {
+		Difficulty float64
+		MinedAt    time.Time `db:"mined_at"`
+	}
+	for {
+		var shares []Share
+		err := q.db.Select(&shares,
+			`SELECT difficulty, mined_at FROM share
+			WHERE sharechain = $1 AND mined_at > $2
+			ORDER BY mined_at LIMIT 1000 OFFSET $3`,
+			sc.Name, start, offset)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		if len(shares) == 0 {
+			return nil, nil
+		}
+		for _, share := range shares {
+			accumulated += share.Difficulty
+			if accumulated >= sc.ShiftDifficulty {
+				// Any other shares at the same time are included too, since
+				// shifts are split by time
+				return &share.MinedAt, nil
+			}
+		}
+		offset += 1000
+	}
+}
+
+// Loads a closed shift by number along with its shares, and checks they
+// still match the checksum recorded when it was closed
+func (q *NgWebAPI) loadShift(shareChain string, number int) (*Shift, error) {
+	var shift Shift
+	err := q.db.QueryRowx(
+		`SELECT id, sharechain, number, started_at, ended_at, difficulty, checksum
+		FROM shift WHERE sharechain = $1 AND number = $2`,
+		shareChain, number).StructScan(&shift)
+	if err != nil {
+		return nil, err
+	}
+	type userShare struct {
+		UserID     int `db:"user_id"`
+		Difficulty float64
+	}
+	var shares []userShare
+	err = q.db.Select(&shares,
+		`SELECT user_id, difficulty FROM shift_share WHERE shift_id = $1`, shift.ID)
+	if err != nil {
+		return nil, err
+	}
+	shift.Shares = map[int]float64{}
+	for _, share := range shares {
+		shift.Shares[share.UserID] = share.Difficulty
+	}
+	if checksum := shift.computeChecksum(); checksum != shift.Checksum {
+		return nil, errors.Errorf("Shift %s #%d checksum mismatch, recorded %s computed %s",
+			shareChain, number, shift.Checksum, checksum)
+	}
+	return &shift, nil
+}
+
+// Credits the block from the shift it was mined in and the ShiftCount-1
+// before it. Returns errShiftOpen if the block's shift hasn't closed
+func (q *NgWebAPI) payoutShift(sc *ShareChainPayout, block *payoutBlock) ([]*CreditMap, error) {
+	var number int
+	err := q.db.Get(&number,
+		`SELECT number FROM shift WHERE sharechain = $1
+		AND started_at < $2 AND ended_at >= $2`,
+		sc.Name, block.MinedAt)
+	if err == sql.ErrNoRows {
+		return nil, errShiftOpen
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	userShares := map[int]float64{1: 0}
+	var (
+		total     float64
+		shiftData []map[string]interface{}
+	)
+	for n := number; n > number-sc.config.ShiftCount && n >= 0; n-- {
+		shift, err := q.loadShift(sc.Name, n)
+		if err != nil {
+			return nil, err
+		}
+		for userID, difficulty := range shift.Shares {
+			userShares[userID] += difficulty
+		}
+		total += shift.Difficulty
+		shiftData = append(shiftData, map[string]interface{}{
+			"number":     shift.Number,
+			"difficulty": shift.Difficulty,
+			"checksum":   shift.Checksum,
+		})
+	}
+	if total == 0 {
+		return nil, errors.Errorf("No shares in shifts for block %s", block.Hash)
+	}
+	sc.Data = map[string]interface{}{
+		"type":   "shift",
+		"shifts": shiftData,
+		"total":  total,
+	}
+	return creditsFromShares(sc, userShares, total), nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimeShiftEnd(t *testing.T) {
+	start := time.Date(2018, 1, 1, 10, 17, 0, 0, time.UTC)
+	assert.Equal(t, time.Date(2018, 1, 1, 11, 0, 0, 0, time.UTC),
+		timeShiftEnd(start, time.Hour))
+	// Shifts after the first are aligned
+	assert.Equal(t, time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC),
+		timeShiftEnd(time.Date(2018, 1, 1, 11, 0, 0, 0, time.UTC), time.Hour))
+}
+
+func TestShiftChecksum(t *testing.T) {
+	shift := &Shift{
+		ShareChain: "LTC_T",
+		Number:     3,
+		StartedAt:  time.Date(2018, 1, 1, 10, 0, 0, 0, time.UTC),
+		EndedAt:    time.Date(2018, 1, 1, 11, 0, 0, 0, time.UTC),
+		Difficulty: 3.5,
+		Shares:     map[int]float64{1: 0.5, 2: 1, 7: 2},
+	}
+	sum := shift.computeChecksum()
+	assert.Len(t, sum, 64)
+
+	// Timezone and sub microsecond precision don't matter, since they don't
+	// survive a trip through postgres
+	same := *shift
+	same.StartedAt = shift.StartedAt.In(time.FixedZone("X", 3600)).Add(time.Nanosecond)
+	assert.Equal(t, sum, same.computeChecksum())
+
+	edited := *shift
+	edited.Shares = map[int]float64{1: 0.5, 2: 2, 7: 1}
+	assert.NotEqual(t, sum, edited.computeChecksum())
+}
+
+func TestCreditsFromShares(t *testing.T) {
+	sc := &ShareChainPayout{SubsidyPayable: 990, SubsidyFee: 10}
+	credits := creditsFromShares(sc, map[int]float64{1: 0, 2: 1, 3: 3}, 4)
+	amounts := map[int]int64{}
+	for _, c := range credits {
+		amounts[c.UserID] = c.Amount
+	}
+	assert.Equal(t, map[int]int64{1: 10, 2: 248, 3: 742}, amounts)
+}
+
+func TestSplitAmount(t *testing.T) {
+	weights := map[int]float64{1: 1, 2: 1, 3: 1, 4: 0.37, 5: 12.5}
+	var total float64
+	for _, w := range weights {
+		total += w
+	}
+	for _, amount := range []int64{0, 1, 7, 999, 123456789, 2100000000000000} {
+		var sum int64
+		for _, v := range splitAmount(amount, weights, total) {
+			sum += v
+		}
+		assert.Equal(t, amount, sum)
+	}
+	assert.Equal(t, map[int]int64{1: 1, 2: 1, 3: 0},
+		splitAmount(2, map[int]float64{1: 1, 2: 1, 3: 1}, 3))
+	assert.Empty(t, splitAmount(100, map[int]float64{1: 0}, 0))
+}
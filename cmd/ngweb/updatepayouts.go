@@ -1,12 +1,17 @@
 package main
 
 import (
-	"github.com/pkg/errors"
-	"github.com/spf13/cobra"
+	"encoding/json"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	log "github.com/inconshreveable/log15"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
 
+	"github.com/icook/ngpool/pkg/alert"
 	"github.com/icook/ngpool/pkg/common"
 )
 
@@ -22,6 +27,7 @@ func init() {
 			if err != nil {
 				ng.log.Crit("Failed", "err", err)
 			}
+			ng.alerts.Close()
 		},
 	}
 	RootCmd.AddCommand(updatePayoutsCmd)
@@ -34,10 +40,14 @@ func (q *NgWebAPI) updatePayoutTransactions() error {
 		Hash     string
 		Vout     int
 		Sent     *time.Time
+		// When we last went to broadcast it. Set with no sent means we may
+		// have died between broadcasting and recording it
+		SendStarted *time.Time `db:"send_started"`
 	}
 	var txs []PayoutTransaction
 	err := q.db.Select(&txs,
-		`SELECT encode(pt.signed_tx, 'hex') as signed_tx, pt.hash, pt.currency, pt.sent, utxo.vout
+		`SELECT encode(pt.signed_tx, 'hex') as signed_tx, pt.hash, pt.currency, pt.sent,
+		pt.send_started, utxo.vout
 		FROM payout_transaction as pt
 		LEFT JOIN utxo ON pt.hash = utxo.hash
 		WHERE confirmed = false`)
@@ -88,35 +98,150 @@ func (q *NgWebAPI) updatePayoutTransactions() error {
 			}
 		}
 
+		// A broadcast that went out without being recorded is only recorded,
+		// so a restart never looks like a payout that still needs sending
+		if tx.Sent == nil && tx.SendStarted != nil {
+			known, err := walletHasTx(func(count int, skip int) ([]walletTx, error) {
+				return listWalletTransactions(rpc.RawRequest, count, skip)
+			}, tx.Hash, *tx.SendStarted)
+			if err != nil {
+				logger.Error("Failed to check wallet for unrecorded send", "err", err)
+				continue
+			}
+			if known {
+				logger.Info("Payout transaction was sent before a restart, recording it",
+					"send_started", tx.SendStarted)
+				q.markPayoutSent(logger, tx.Hash, *tx.SendStarted)
+				continue
+			}
+		}
+
 		// If it hasn't been sent in 24 hours, and it isn't in a block yet,
 		// resend it to keep it in mempools
 		if tx.Sent == nil || time.Now().Sub(*tx.Sent) > time.Hour*24 {
 			txObj, err := common.HexStringToTX(tx.SignedTX)
-			if !ok {
+			if err != nil {
 				logger.Error("Failed to deser signed_tx", "err", err)
 				continue
 			}
 
+			// Written before every broadcast so we know to check the wallet
+			// if we don't get to record the result
+			_, err = q.db.Exec(
+				`UPDATE payout_transaction SET send_started = now() WHERE hash = $1`, tx.Hash)
+			if err != nil {
+				logger.Error("Failed to record send start, not sending", "err", err)
+				continue
+			}
+
 			resp, err := rpc.SendRawTransaction(txObj, false)
+			if err != nil && alreadyBroadcast(err) {
+				logger.Info("Payout transaction already known to coinserver", "err", err)
+				q.markPayoutSent(logger, tx.Hash, time.Now())
+				continue
+			}
 			if err != nil {
 				logger.Error("Failed sending pushed raw tx", "err", err, "tx", tx.SignedTX)
+				q.alerts.Fire(alert.PayoutFailed, tx.Currency, map[string]interface{}{
+					"currency": tx.Currency,
+					"hash":     tx.Hash,
+					"err":      err.Error(),
+				})
 				continue
 			}
 			// Double check here for safety
 			if resp.String() != tx.Hash {
 				logger.Crit("Payout transaction mismatch, database is inconsistent!",
 					"rpc_tx_hash", resp.String())
+				q.alerts.Fire(alert.PayoutFailed, tx.Currency, map[string]interface{}{
+					"currency": tx.Currency,
+					"hash":     tx.Hash,
+					"err":      "coinserver returned hash " + resp.String(),
+				})
 				return errors.New("Invalid state") // Abort so operator has to fix problem
 			}
 
-			_, err = q.db.Exec(
-				`UPDATE payout_transaction SET sent = now() WHERE hash = $1`, tx.Hash)
-			if err != nil {
-				logger.Error("Error sending transaction")
-			}
-
+			q.markPayoutSent(logger, tx.Hash, time.Now())
 			logger.Info("Sent payout transaction", "last_send", tx.Sent)
 		}
 	}
 	return nil
 }
+
+func (q *NgWebAPI) markPayoutSent(logger log.Logger, hash string, sent time.Time) {
+	_, err := q.db.Exec(
+		`UPDATE payout_transaction SET sent = $1 WHERE hash = $2`, sent, hash)
+	if err != nil {
+		logger.Error("Error marking payout transaction sent", "err", err)
+	}
+}
+
+// Coinservers refuse a transaction they already have, which for us means an
+// earlier broadcast made it
+func alreadyBroadcast(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, known := range []string{"already in block chain", "already in the block chain",
+		"txn-already-known", "txn-already-in-mempool"} {
+		if strings.Contains(msg, known) {
+			return true
+		}
+	}
+	return false
+}
+
+type walletTx struct {
+	TxID string `json:"txid"`
+	Time int64  `json:"time"`
+}
+
+// How many wallet transactions are fetched at a time while looking for a
+// payout
+const walletTxPage = 100
+
+// Wallet transactions are listed in pages newest first, so we can stop once
+// a page reaches past the time we started sending, with an hour's slack for
+// clock differences
+func walletHasTx(list func(count int, skip int) ([]walletTx, error), hash string,
+	since time.Time) (bool, error) {
+	cutoff := since.Add(-time.Hour).Unix()
+	for skip := 0; ; skip += walletTxPage {
+		page, err := list(walletTxPage, skip)
+		if err != nil {
+			return false, err
+		}
+		pastCutoff := false
+		for _, tx := range page {
+			if tx.TxID == hash {
+				return true, nil
+			}
+			if tx.Time < cutoff {
+				pastCutoff = true
+			}
+		}
+		if len(page) < walletTxPage || pastCutoff {
+			return false, nil
+		}
+	}
+}
+
+// listtransactions with watch-only addresses included, since the payout
+// coinserver only watches the addresses ngsign holds keys for. Each page is
+// returned oldest first, pages are counted back from the newest
+func listWalletTransactions(rawRequest func(string, []json.RawMessage) (json.RawMessage, error),
+	count int, skip int) ([]walletTx, error) {
+	params := []json.RawMessage{
+		json.RawMessage(`"*"`),
+		json.RawMessage(strconv.Itoa(count)),
+		json.RawMessage(strconv.Itoa(skip)),
+		json.RawMessage(`true`),
+	}
+	raw, err := rawRequest("listtransactions", params)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var txs []walletTx
+	if err := json.Unmarshal(raw, &txs); err != nil {
+		return nil, errors.Wrap(err, "Invalid listtransactions result")
+	}
+	return txs, nil
+}
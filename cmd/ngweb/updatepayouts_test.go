@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWalletHasTx(t *testing.T) {
+	now := time.Now()
+	// Newest last, like the wallet
+	var wallet []walletTx
+	for i := 0; i < 250; i++ {
+		wallet = append(wallet, walletTx{
+			TxID: string(rune('a'+i%26)) + string(rune('a'+i/26)),
+			Time: now.Add(time.Duration(i-250) * time.Minute).Unix(),
+		})
+	}
+	var calls int
+	list := func(count int, skip int) ([]walletTx, error) {
+		calls++
+		end := len(wallet) - skip
+		if end < 0 {
+			end = 0
+		}
+		start := end - count
+		if start < 0 {
+			start = 0
+		}
+		return wallet[start:end], nil
+	}
+
+	found, err := walletHasTx(list, wallet[10].TxID, now.Add(-time.Hour*5))
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, 3, calls)
+
+	// Stops once it's looked back an hour before the send started
+	calls = 0
+	found, err = walletHasTx(list, "missing", now.Add(-time.Minute*30))
+	assert.NoError(t, err)
+	assert.False(t, found)
+	assert.Equal(t, 1, calls)
+
+	_, err = walletHasTx(func(int, int) ([]walletTx, error) {
+		return nil, errors.New("wallet down")
+	}, "missing", now)
+	assert.Error(t, err)
+}
+
+func TestListWalletTransactions(t *testing.T) {
+	txs, err := listWalletTransactions(func(method string, params []json.RawMessage) (json.RawMessage, error) {
+		assert.Equal(t, "listtransactions", method)
+		assert.Equal(t, []json.RawMessage{
+			json.RawMessage(`"*"`), json.RawMessage(`100`), json.RawMessage(`200`), json.RawMessage(`true`),
+		}, params)
+		return json.RawMessage(`[{"txid": "ab", "time": 1500000000, "category": "send"}]`), nil
+	}, 100, 200)
+	assert.NoError(t, err)
+	assert.Equal(t, []walletTx{{TxID: "ab", Time: 1500000000}}, txs)
+}
+
+func TestAlreadyBroadcast(t *testing.T) {
+	assert.True(t, alreadyBroadcast(errors.New("-27: transaction already in block chain")))
+	assert.True(t, alreadyBroadcast(errors.New("-26: txn-already-in-mempool")))
+	assert.False(t, alreadyBroadcast(errors.New("-26: 16: mandatory-script-verify-flag-failed")))
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"database/sql"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// Block withholding is submitting shares but keeping back those that solve a
+// block. Stratums save a share's hash over the main chain target as
+// block_ratio when it's within NearTargetFactor. Below factor times the target
+// hashes are spread evenly, so 1 in factor of those shares should be a block.
+// A worker with far fewer is flagged
+type workerWithholding struct {
+	Username   string  `json:"username"`
+	Worker     string  `json:"worker"`
+	NearTarget int     `db:"near_target" json:"near_target"`
+	Solves     int     `json:"solves"`
+	Expected   float64 `json:"expected"`
+	// Chance of an honest worker finding this few blocks or fewer
+	Probability float64 `json:"probability"`
+	Flagged     bool    `json:"flagged"`
+}
+
+// Chance of k or fewer successes in n tries of probability p
+func binomialCDF(k int, n int, p float64) float64 {
+	if k >= n {
+		return 1
+	}
+	lgN, _ := math.Lgamma(float64(n + 1))
+	var cdf float64
+	for i := 0; i <= k; i++ {
+		lgI, _ := math.Lgamma(float64(i + 1))
+		lgNI, _ := math.Lgamma(float64(n - i + 1))
+		cdf += math.Exp(lgN - lgI - lgNI + float64(i)*math.Log(p) + float64(n-i)*math.Log1p(-p))
+	}
+	return math.Min(cdf, 1)
+}
+
+// Fills in expectations and flags workers less likely than alpha to be
+// honest. Least likely first
+func assessWithholding(workers []*workerWithholding, factor float64, alpha float64) {
+	for _, w := range workers {
+		w.Expected = float64(w.NearTarget) / factor
+		w.Probability = binomialCDF(w.Solves, w.NearTarget, 1/factor)
+		w.Flagged = w.Probability < alpha
+	}
+	sort.SliceStable(workers, func(i, j int) bool {
+		if workers[i].Probability != workers[j].Probability {
+			return workers[i].Probability < workers[j].Probability
+		}
+		return workers[i].NearTarget > workers[j].NearTarget
+	})
+}
+
+// Workers with near target shares since, assessed. Only shares within factor
+// are counted, so factor can't be more than the stratums' NearTargetFactor
+func (q *NgWebAPI) loadWithholding(since time.Time, factor float64,
+	alpha float64) ([]*workerWithholding, error) {
+	var workers = []*workerWithholding{}
+	err := q.db.Select(&workers,
+		`SELECT username, worker,
+		COUNT(*) FILTER (WHERE block_ratio <= $2) AS near_target,
+		COUNT(*) FILTER (WHERE block_ratio <= 1) AS solves
+		FROM share WHERE mined_at >= $1 AND block_ratio IS NOT NULL
+		GROUP BY username, worker`, since, factor)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	assessWithholding(workers, factor, alpha)
+	return workers, nil
+}
+
+func (q *NgWebAPI) getWithholding(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit <= 0 {
+		q.apiError(c, 400, APIError{
+			Code:  "invalid_limit",
+			Title: "limit must be a positive number"})
+		return
+	}
+	window := q.config.GetDuration("WithholdingWindow")
+	workers, err := q.loadWithholding(time.Now().Add(-window),
+		q.config.GetFloat64("WithholdingFactor"), q.config.GetFloat64("WithholdingAlpha"))
+	if err != nil {
+		q.apiException(c, 500, errors.WithStack(err), SQLError)
+		return
+	}
+	var flagged int
+	for _, w := range workers {
+		if w.Flagged {
+			flagged++
+		}
+	}
+	if len(workers) > limit {
+		workers = workers[:limit]
+	}
+	q.apiSuccess(c, 200, res{
+		"window":  window.String(),
+		"flagged": flagged,
+		"workers": workers,
+	})
+}
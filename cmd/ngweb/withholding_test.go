@@ -0,0 +1,32 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBinomialCDF(t *testing.T) {
+	assert.InEpsilon(t, math.Pow(15.0/16, 160), binomialCDF(0, 160, 1.0/16), 1e-9)
+	assert.InEpsilon(t, 0.75, binomialCDF(1, 2, 0.5), 1e-9)
+	assert.Equal(t, 1.0, binomialCDF(3, 3, 0.5))
+	assert.Equal(t, 1.0, binomialCDF(0, 0, 0.5))
+	// Large counts don't underflow to nothing
+	assert.InEpsilon(t, 0.5, binomialCDF(50000, 100000, 0.5), 0.01)
+}
+
+func TestAssessWithholding(t *testing.T) {
+	workers := []*workerWithholding{
+		{Username: "honest", NearTarget: 320, Solves: 19},
+		{Username: "new", NearTarget: 8, Solves: 0},
+		{Username: "withholder", NearTarget: 320, Solves: 0},
+	}
+	assessWithholding(workers, 16, 0.001)
+	assert.Equal(t, "withholder", workers[0].Username)
+	assert.True(t, workers[0].Flagged)
+	assert.Equal(t, 20.0, workers[0].Expected)
+	// Too few shares to tell
+	assert.False(t, workers[1].Flagged)
+	assert.False(t, workers[2].Flagged)
+}
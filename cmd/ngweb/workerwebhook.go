@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// Webhooks users register to hear about their own workers, so farms can feed
+// them into their monitoring. Every WorkerWebhookInterval each hook's
+// workers are checked against its thresholds, and the events since the last
+// check are posted together. Events fire when a worker crosses a threshold
+// and again when it recovers, not on every check. Firing state is kept in
+// memory, so a restart can repeat an event
+
+// Reject rates over fewer submissions than this aren't judged
+const workerRejectMinShares = 20
+
+// Workers gone this long are forgotten, after their offline event
+const workerForgetAfter = 7 * 24 * time.Hour
+
+// Any user can set a webhook URL, so it mustn't reach the pool's own network,
+// ie etcd or coinserver RPC. Names are checked once they've resolved, at dial
+// time, so one can't point somewhere else after it's validated
+var webhookClient = &http.Client{
+	Timeout: time.Second * 10,
+	Transport: &http.Transport{
+		DialContext: webhookDialContext,
+	},
+}
+
+var webhookDialer = &net.Dialer{
+	Timeout: time.Second * 10,
+	Control: func(network string, address string, c syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(host); ip == nil || !webhookAllowedIP(ip) {
+			return errors.Errorf("Webhook destination %s isn't allowed", host)
+		}
+		return nil
+	},
+}
+
+func webhookDialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	return webhookDialer.DialContext(ctx, network, address)
+}
+
+var webhookPrivateNets []*net.IPNet
+
+func init() {
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"} {
+		_, network, _ := net.ParseCIDR(cidr)
+		webhookPrivateNets = append(webhookPrivateNets, network)
+	}
+}
+
+// Whether webhooks can be posted to ip. Loopback, private, link-local and
+// unspecified addresses are refused
+func webhookAllowedIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsUnspecified() {
+		return false
+	}
+	for _, network := range webhookPrivateNets {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+type WorkerWebhook struct {
+	ID             int     `json:"id"`
+	URL            string  `json:"url"`
+	Secret         string  `json:"secret,omitempty"`
+	OfflineMinutes int     `db:"offline_minutes" json:"offline_minutes"`
+	RejectPercent  float64 `db:"reject_percent" json:"reject_percent"`
+	// Only loaded for checking
+	Username string `json:"-"`
+}
+
+// Checks a webhook sent to the API, returning what's wrong with it
+func (w *WorkerWebhook) validate() string {
+	parsed, err := url.Parse(w.URL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return "URL must be an http or https URL"
+	}
+	// Names are checked again when they're dialed
+	host := strings.ToLower(parsed.Hostname())
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return "URL can't be a loopback, private or link-local address"
+	}
+	if ip := net.ParseIP(host); ip != nil && !webhookAllowedIP(ip) {
+		return "URL can't be a loopback, private or link-local address"
+	}
+	if w.OfflineMinutes < 0 {
+		return "Offline minutes can't be negative"
+	}
+	if w.RejectPercent < 0 || w.RejectPercent > 100 {
+		return "Reject percent must be between 0 and 100"
+	}
+	if w.OfflineMinutes == 0 && w.RejectPercent == 0 {
+		return "Set offline minutes, reject percent, or both"
+	}
+	return ""
+}
+
+// What's known of a worker at a check. Share counts are summed over its
+// connections and only ever grow while they stay connected
+type workerSample struct {
+	LastSeen time.Time
+	Accepted uint64
+	Rejected uint64
+}
+
+type workerEvent struct {
+	Type     string    `json:"type"`
+	Worker   string    `json:"worker"`
+	LastSeen time.Time `json:"last_seen"`
+	// For the reject rate events, over the submissions since the last check
+	RejectRate float64 `json:"reject_rate,omitempty"`
+	Accepted   uint64  `json:"accepted,omitempty"`
+	Rejected   uint64  `json:"rejected,omitempty"`
+}
+
+const (
+	workerOffline        = "worker_offline"
+	workerOnline         = "worker_online"
+	workerRejectHigh     = "reject_rate_high"
+	workerRejectRecovery = "reject_rate_normal"
+)
+
+// One webhook's view of its user's workers between checks
+type workerWatch struct {
+	samples   map[string]workerSample
+	offline   map[string]bool
+	rejecting map[string]bool
+}
+
+func newWorkerWatch() *workerWatch {
+	return &workerWatch{
+		samples:   map[string]workerSample{},
+		offline:   map[string]bool{},
+		rejecting: map[string]bool{},
+	}
+}
+
+// Compares samples with the last check's and returns the events for hook.
+// Workers missing from samples keep their last sample, so ones that
+// disconnect still go offline
+func (w *workerWatch) check(hook *WorkerWebhook, samples map[string]workerSample, now time.Time) []workerEvent {
+	var events []workerEvent
+	for name, sample := range samples {
+		prev, seen := w.samples[name]
+		if prev.LastSeen.After(sample.LastSeen) {
+			sample.LastSeen = prev.LastSeen
+		}
+		w.samples[name] = sample
+		if !seen || hook.RejectPercent == 0 {
+			continue
+		}
+		accepted, rejected := sample.Accepted, sample.Rejected
+		// Counts went down, so connections were replaced. Everything counted
+		// is new
+		if accepted >= prev.Accepted && rejected >= prev.Rejected {
+			accepted -= prev.Accepted
+			rejected -= prev.Rejected
+		}
+		if accepted+rejected < workerRejectMinShares {
+			continue
+		}
+		rate := float64(rejected) / float64(accepted+rejected)
+		high := rate*100 >= hook.RejectPercent
+		if high == w.rejecting[name] {
+			continue
+		}
+		w.rejecting[name] = high
+		event := workerEvent{Type: workerRejectRecovery, Worker: name,
+			LastSeen: sample.LastSeen, RejectRate: rate,
+			Accepted: accepted, Rejected: rejected}
+		if high {
+			event.Type = workerRejectHigh
+		}
+		events = append(events, event)
+	}
+
+	if hook.OfflineMinutes > 0 {
+		limit := time.Duration(hook.OfflineMinutes) * time.Minute
+		for name, sample := range w.samples {
+			// Connected, but yet to send a share
+			if sample.LastSeen.IsZero() {
+				continue
+			}
+			offline := now.Sub(sample.LastSeen) > limit
+			if offline == w.offline[name] {
+				continue
+			}
+			w.offline[name] = offline
+			event := workerEvent{Type: workerOnline, Worker: name, LastSeen: sample.LastSeen}
+			if offline {
+				event.Type = workerOffline
+			}
+			events = append(events, event)
+		}
+	}
+	for name, sample := range w.samples {
+		if now.Sub(sample.LastSeen) > workerForgetAfter && !sample.LastSeen.IsZero() &&
+			(hook.OfflineMinutes == 0 || w.offline[name]) {
+			delete(w.samples, name)
+			delete(w.offline, name)
+			delete(w.rejecting, name)
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].Worker != events[j].Worker {
+			return events[i].Worker < events[j].Worker
+		}
+		return events[i].Type < events[j].Type
+	})
+	return events
+}
+
+// The stratums' view of each user's workers
+func (q *NgWebAPI) workerSamples() map[string]map[string]workerSample {
+	q.stratumsMtx.RLock()
+	defer q.stratumsMtx.RUnlock()
+	users := map[string]map[string]workerSample{}
+	if q.hashrate == nil {
+		return users
+	}
+	for username, workers := range q.hashrate.LastSeen {
+		samples := map[string]workerSample{}
+		for name, lastSeen := range workers {
+			samples[name] = workerSample{LastSeen: time.Unix(lastSeen, 0)}
+		}
+		users[username] = samples
+	}
+	for username, clients := range q.stratumClients {
+		samples, ok := users[username]
+		if !ok {
+			samples = map[string]workerSample{}
+			users[username] = samples
+		}
+		for _, client := range clients {
+			sample := samples[client.Name]
+			sample.Accepted += client.Shares.Accepted
+			sample.Rejected += client.Shares.Rejected()
+			samples[client.Name] = sample
+		}
+	}
+	return users
+}
+
+func (q *NgWebAPI) RunWorkerWebhooks() {
+	interval := q.config.GetDuration("WorkerWebhookInterval")
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		watches := map[int]*workerWatch{}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			<-ticker.C
+			if err := q.checkWorkerWebhooks(watches, time.Now()); err != nil {
+				q.log.Error("Failed to check worker webhooks", "err", err)
+			}
+		}
+	}()
+}
+
+func (q *NgWebAPI) checkWorkerWebhooks(watches map[int]*workerWatch, now time.Time) error {
+	var hooks []*WorkerWebhook
+	err := q.db.Select(&hooks,
+		`SELECT w.id, w.url, w.secret, w.offline_minutes, w.reject_percent, u.username
+		FROM worker_webhook w JOIN users u ON u.id = w.user_id`)
+	if err != nil {
+		return err
+	}
+	samples := q.workerSamples()
+	current := map[int]bool{}
+	for _, hook := range hooks {
+		current[hook.ID] = true
+		watch, ok := watches[hook.ID]
+		if !ok {
+			watch = newWorkerWatch()
+			watches[hook.ID] = watch
+		}
+		events := watch.check(hook, samples[hook.Username], now)
+		if len(events) == 0 {
+			continue
+		}
+		go func(hook *WorkerWebhook) {
+			err := postWorkerEvents(hook, events, now)
+			if err != nil {
+				q.log.Warn("Failed to post worker webhook",
+					"id", hook.ID, "username", hook.Username, "err", err)
+			}
+		}(hook)
+	}
+	for id := range watches {
+		if !current[id] {
+			delete(watches, id)
+		}
+	}
+	return nil
+}
+
+// The body's HMAC-SHA256 under the hook's secret, so receivers can tell the
+// events came from us
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func postWorkerEvents(hook *WorkerWebhook, events []workerEvent, now time.Time) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"username": hook.Username,
+		"webhook":  hook.ID,
+		"time":     now,
+		"events":   events,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Ngpool-Signature", webhookSignature(hook.Secret, body))
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("Got %s", resp.Status)
+	}
+	return nil
+}
+
+func (q *NgWebAPI) getWorkerWebhooks(c *gin.Context) {
+	hooks := []*WorkerWebhook{}
+	err := q.db.Select(&hooks,
+		`SELECT id, url, offline_minutes, reject_percent FROM worker_webhook
+		WHERE user_id = $1 ORDER BY id`, c.GetInt("userID"))
+	if err != nil {
+		q.apiException(c, 500, errors.WithStack(err), SQLError)
+		return
+	}
+	q.apiSuccess(c, 200, res{"webhooks": hooks})
+}
+
+// Registers a webhook. Its secret is only ever returned here
+func (q *NgWebAPI) postWorkerWebhook(c *gin.Context) {
+	var req WorkerWebhook
+	if !q.BindValid(c, &req) {
+		return
+	}
+	if problem := req.validate(); problem != "" {
+		q.apiError(c, 400, APIError{
+			Code:  "invalid_webhook",
+			Title: problem})
+		return
+	}
+	userID := c.GetInt("userID")
+	var count int
+	err := q.db.Get(&count,
+		`SELECT COUNT(*) FROM worker_webhook WHERE user_id = $1`, userID)
+	if err != nil {
+		q.apiException(c, 500, errors.WithStack(err), SQLError)
+		return
+	}
+	if count >= q.config.GetInt("WorkerWebhookLimit") {
+		q.apiError(c, 400, APIError{
+			Code:  "webhook_limit",
+			Title: "Too many webhooks, remove one first"})
+		return
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		q.apiException(c, 500, errors.WithStack(err), APIError{
+			Code:  "secret_failure",
+			Title: "Failed to generate webhook secret"})
+		return
+	}
+	req.Secret = hex.EncodeToString(secret)
+	err = q.db.Get(&req.ID,
+		`INSERT INTO worker_webhook (user_id, url, secret, offline_minutes, reject_percent)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+		userID, req.URL, req.Secret, req.OfflineMinutes, req.RejectPercent)
+	if err != nil {
+		q.apiException(c, 500, errors.WithStack(err), SQLError)
+		return
+	}
+	q.apiSuccess(c, 200, res{"webhook": req})
+}
+
+func (q *NgWebAPI) deleteWorkerWebhook(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		q.apiError(c, 400, APIError{Code: "invalid_webhook", Title: "Invalid webhook id"})
+		return
+	}
+	result, err := q.db.Exec(
+		`DELETE FROM worker_webhook WHERE id = $1 AND user_id = $2`, id, c.GetInt("userID"))
+	if err != nil {
+		q.apiException(c, 500, errors.WithStack(err), SQLError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		q.apiError(c, 404, APIError{Code: "invalid_webhook", Title: "Webhook not found"})
+		return
+	}
+	q.apiSuccess(c, 200, res{})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerWebhookValidate(t *testing.T) {
+	hook := WorkerWebhook{URL: "https://farm.example/hook", OfflineMinutes: 10}
+	assert.Equal(t, "", hook.validate())
+	hook.URL = "ftp://farm.example/hook"
+	assert.NotEqual(t, "", hook.validate())
+	hook.URL = "https://farm.example/hook"
+	hook.OfflineMinutes = 0
+	assert.NotEqual(t, "", hook.validate())
+	hook.RejectPercent = 150
+	assert.NotEqual(t, "", hook.validate())
+	hook.RejectPercent = 5
+	assert.Equal(t, "", hook.validate())
+
+	for _, url := range []string{
+		"http://127.0.0.1:2379/v2/keys",
+		"http://localhost/hook",
+		"http://10.0.0.5:8332",
+		"http://172.20.1.1/hook",
+		"http://192.168.1.1/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://0.0.0.0/hook",
+		"http://[::1]/hook",
+		"http://[fd00::1]/hook",
+		"http://[fe80::1]/hook",
+	} {
+		hook.URL = url
+		assert.NotEqual(t, "", hook.validate(), url)
+	}
+	hook.URL = "http://203.0.113.5/hook"
+	assert.Equal(t, "", hook.validate())
+}
+
+func TestWorkerWatchOffline(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	hook := &WorkerWebhook{OfflineMinutes: 10}
+	watch := newWorkerWatch()
+	samples := map[string]workerSample{
+		"rig1": {LastSeen: now},
+		"rig2": {LastSeen: now},
+		"new":  {},
+	}
+	assert.Len(t, watch.check(hook, samples, now), 0)
+
+	// rig2 disconnects and is forgotten by the stratums
+	delete(samples, "rig2")
+	samples["rig1"] = workerSample{LastSeen: now.Add(10 * time.Minute)}
+	events := watch.check(hook, samples, now.Add(11*time.Minute))
+	assert.Equal(t, []workerEvent{{Type: workerOffline, Worker: "rig2", LastSeen: now}}, events)
+	// Only once
+	assert.Len(t, watch.check(hook, samples, now.Add(12*time.Minute)), 0)
+
+	samples["rig2"] = workerSample{LastSeen: now.Add(13 * time.Minute)}
+	events = watch.check(hook, samples, now.Add(13*time.Minute))
+	assert.Equal(t, []workerEvent{{Type: workerOnline, Worker: "rig2",
+		LastSeen: now.Add(13 * time.Minute)}}, events)
+}
+
+func TestWorkerWatchRejects(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	hook := &WorkerWebhook{RejectPercent: 10}
+	watch := newWorkerWatch()
+	check := func(accepted, rejected uint64) []workerEvent {
+		return watch.check(hook, map[string]workerSample{
+			"rig1": {LastSeen: now, Accepted: accepted, Rejected: rejected},
+		}, now)
+	}
+	assert.Len(t, check(100, 0), 0)
+	// Too few submissions since the last check to judge
+	assert.Len(t, check(105, 5), 0)
+
+	events := check(180, 25)
+	assert.Len(t, events, 1)
+	assert.Equal(t, workerRejectHigh, events[0].Type)
+	assert.Equal(t, uint64(75), events[0].Accepted)
+	assert.Equal(t, uint64(20), events[0].Rejected)
+	assert.Len(t, check(200, 30), 0)
+
+	// Reconnected, counting from zero
+	events = check(50, 1)
+	assert.Len(t, events, 1)
+	assert.Equal(t, workerRejectRecovery, events[0].Type)
+}
+
+func TestPostWorkerEvents(t *testing.T) {
+	var body []byte
+	var signature string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		signature = r.Header.Get("X-Ngpool-Signature")
+	}))
+	defer server.Close()
+
+	now := time.Unix(1500000000, 0)
+	hook := &WorkerWebhook{ID: 3, URL: server.URL, Secret: "s3cret", Username: "farm"}
+	events := []workerEvent{{Type: workerOffline, Worker: "rig1", LastSeen: now}}
+	// The test server is on loopback, which is refused however the URL
+	// names it
+	err := postWorkerEvents(hook, events, now)
+	assert.Error(t, err)
+	hook.URL = strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+	err = postWorkerEvents(hook, events, now)
+	assert.Error(t, err)
+	assert.Nil(t, body)
+
+	hook.URL = server.URL
+	defer func(client *http.Client) { webhookClient = client }(webhookClient)
+	webhookClient = server.Client()
+	err = postWorkerEvents(hook, events, now)
+	assert.NoError(t, err)
+	assert.Equal(t, webhookSignature("s3cret", body), signature)
+
+	var posted struct {
+		Username string
+		Events   []workerEvent
+	}
+	assert.NoError(t, json.Unmarshal(body, &posted))
+	assert.Equal(t, "farm", posted.Username)
+	assert.Len(t, posted.Events, 1)
+}
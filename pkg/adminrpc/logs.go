@@ -0,0 +1,80 @@
+package adminrpc
+
+import (
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/icook/ngpool/pkg/logging"
+)
+
+const tailBatchDelay = time.Millisecond * 100
+
+// Serves LogAdmin from buffer, so `ngctl logs` can tail the service. Nothing
+// is registered when the buffer is off
+func RegisterLogs(server *grpc.Server, buffer *logging.Buffer) {
+	if buffer == nil {
+		return
+	}
+	RegisterLogAdminServer(server, &logAdmin{buffer})
+}
+
+type logAdmin struct {
+	buffer *logging.Buffer
+}
+
+func (a *logAdmin) TailLogs(req *TailLogsRequest, stream LogAdmin_TailLogsServer) error {
+	max := log.LvlDebug
+	if req.Level != "" {
+		lvl, err := log.LvlFromString(req.Level)
+		if err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		max = lvl
+	}
+	after := req.AfterSeq
+	for first := true; ; first = false {
+		tail := a.buffer.Since(after)
+		resp := &TailLogsResponse{LastSeq: tail.Last, Missed: tail.Missed}
+		if first && req.AfterSeq == 0 {
+			// Asked for whatever's buffered, so nothing was missed
+			resp.Missed = 0
+		}
+		for _, entry := range tail.Entries {
+			if entry.Lvl > max {
+				continue
+			}
+			resp.Entries = append(resp.Entries, &LogEntry{
+				Seq:   entry.Seq,
+				Time:  entry.Time.UnixNano(),
+				Level: entry.Lvl.String(),
+				Msg:   entry.Msg,
+				Ctx:   entry.Ctx,
+			})
+		}
+		if first && req.Limit > 0 && len(resp.Entries) > int(req.Limit) {
+			resp.Entries = resp.Entries[len(resp.Entries)-int(req.Limit):]
+		}
+		// The first response goes out even if empty, so the client knows
+		// where the buffer's up to
+		if first || len(resp.Entries) > 0 || resp.Missed > 0 {
+			if err := stream.Send(resp); err != nil {
+				return err
+			}
+		}
+		if !req.Follow {
+			return nil
+		}
+		after = tail.Last
+		select {
+		case <-tail.Wait:
+		case <-stream.Context().Done():
+			return nil
+		}
+		// Gathers a burst of records into one response
+		time.Sleep(tailBatchDelay)
+	}
+}
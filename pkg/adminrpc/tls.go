@@ -0,0 +1,82 @@
+// Package adminrpc holds the gRPC admin APIs services expose, the mutual TLS
+// both ends use, and the LogAdmin server every service shares. Everything
+// else in the package is generated from admin.proto.
+package adminrpc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// Where a service or client finds its certificate and the CA its peers'
+// certificates must be signed by. Admin access is granted to anyone with a
+// certificate from CAFile, so it should be a CA used for nothing else
+type TLSFiles struct {
+	CertFile string
+	KeyFile  string
+	CAFile   string
+}
+
+func (f TLSFiles) load() (tls.Certificate, *x509.CertPool, error) {
+	cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+	if err != nil {
+		return cert, nil, errors.Wrap(err, "Loading admin certificate")
+	}
+	raw, err := ioutil.ReadFile(f.CAFile)
+	if err != nil {
+		return cert, nil, errors.Wrap(err, "Loading admin CA")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(raw) {
+		return cert, nil, errors.Errorf("No certificates in %s", f.CAFile)
+	}
+	return cert, pool, nil
+}
+
+// Requires clients to present a certificate signed by CAFile
+func (f TLSFiles) ServerConfig() (*tls.Config, error) {
+	cert, pool, err := f.load()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// Only trusts servers with a certificate signed by CAFile
+func (f TLSFiles) ClientConfig() (*tls.Config, error) {
+	cert, pool, err := f.load()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+func NewServer(files TLSFiles) (*grpc.Server, error) {
+	config, err := files.ServerConfig()
+	if err != nil {
+		return nil, err
+	}
+	return grpc.NewServer(grpc.Creds(credentials.NewTLS(config))), nil
+}
+
+func Dial(addr string, files TLSFiles) (*grpc.ClientConn, error) {
+	config, err := files.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	return grpc.Dial(addr, grpc.WithTransportCredentials(credentials.NewTLS(config)))
+}
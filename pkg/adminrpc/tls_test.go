@@ -0,0 +1,118 @@
+package adminrpc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	dir  string
+	file string
+}
+
+func writePEM(t *testing.T, path string, kind string, der []byte) {
+	raw := pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der})
+	assert.NoError(t, ioutil.WriteFile(path, raw, 0600))
+}
+
+func newTestCA(t *testing.T, dir string, name string) *testCA {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, _ := x509.ParseCertificate(der)
+	file := filepath.Join(dir, name+".pem")
+	writePEM(t, file, "CERTIFICATE", der)
+	return &testCA{cert: cert, key: key, dir: dir, file: file}
+}
+
+// Issues a certificate good for both ends, and returns files using it
+func (ca *testCA) issue(t *testing.T, name string) TLSFiles {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	assert.NoError(t, err)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	files := TLSFiles{
+		CertFile: filepath.Join(ca.dir, name+".crt"),
+		KeyFile:  filepath.Join(ca.dir, name+".key"),
+		CAFile:   ca.file,
+	}
+	writePEM(t, files.CertFile, "CERTIFICATE", der)
+	writePEM(t, files.KeyFile, "EC PRIVATE KEY", keyDER)
+	return files
+}
+
+// Runs a handshake between the two configs, returning the server's error
+func handshake(server *tls.Config, client *tls.Config) error {
+	serverConn, clientConn := net.Pipe()
+	client.ServerName = "localhost"
+	go func() {
+		tls.Client(clientConn, client).Handshake()
+		clientConn.Close()
+	}()
+	conn := tls.Server(serverConn, server)
+	defer conn.Close()
+	return conn.Handshake()
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "adminrpc")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, dir, "ca")
+	serverConfig, err := ca.issue(t, "stratum").ServerConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, tls.RequireAndVerifyClientCert, serverConfig.ClientAuth)
+
+	clientConfig, err := ca.issue(t, "admin").ClientConfig()
+	assert.NoError(t, err)
+	assert.NoError(t, handshake(serverConfig, clientConfig))
+
+	// A certificate from any other CA is turned away
+	other := newTestCA(t, dir, "other")
+	otherConfig, err := other.issue(t, "intruder").ClientConfig()
+	assert.NoError(t, err)
+	otherConfig.RootCAs = clientConfig.RootCAs
+	assert.Error(t, handshake(serverConfig, otherConfig))
+
+	// As is a client without one
+	clientConfig.Certificates = nil
+	assert.Error(t, handshake(serverConfig, clientConfig))
+
+	_, err = TLSFiles{CertFile: filepath.Join(dir, "missing")}.ServerConfig()
+	assert.Error(t, err)
+}
@@ -0,0 +1,295 @@
+// Package alert sends operators notifications of events worth waking up for,
+// through webhooks, PagerDuty or Telegram
+package alert
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Events alerts are raised for
+const (
+	BlockFound     = "block_found"
+	BlockOrphaned  = "block_orphaned"
+	CoinserverDown = "coinserver_down"
+	DiscoveryDown  = "discovery_down"
+	HotWalletLow   = "hot_wallet_low"
+	PayoutFailed   = "payout_failed"
+	RejectRate     = "reject_rate"
+)
+
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+var severityRank = map[string]int{
+	SeverityInfo:     0,
+	SeverityWarning:  1,
+	SeverityCritical: 2,
+}
+
+var eventSeverity = map[string]string{
+	BlockFound:     SeverityInfo,
+	BlockOrphaned:  SeverityWarning,
+	CoinserverDown: SeverityCritical,
+	DiscoveryDown:  SeverityCritical,
+	HotWalletLow:   SeverityWarning,
+	PayoutFailed:   SeverityCritical,
+	RejectRate:     SeverityWarning,
+}
+
+// Messages are text/templates over an Alert, overridable per event with
+// AlertTemplates
+var defaultTemplates = map[string]string{
+	BlockFound:     `{{.Fields.currency}} block {{.Fields.height}} found by {{.Fields.miner}} ({{.Fields.hash}})`,
+	BlockOrphaned:  `{{.Fields.currency}} block {{.Fields.height}} was orphaned ({{.Fields.hash}})`,
+	CoinserverDown: `Coinserver {{.Key}} is down: {{.Fields.reason}}`,
+	DiscoveryDown:  `{{.Source}} can't reach service discovery: {{.Fields.err}}`,
+	HotWalletLow:   `{{.Fields.currency}} hot wallet needs a top-up of {{.Fields.needed}} satoshis from the cold wallet {{.Fields.cold_address}}`,
+	PayoutFailed:   `{{.Fields.currency}} payout failed: {{.Fields.err}}`,
+	RejectRate:     `{{.Source}} is rejecting {{printf "%.1f" .Fields.percent}}% of shares ({{.Fields.rejected}} of {{.Fields.total}})`,
+}
+
+// Where alerts are sent, from the Alerts list. Events and MinSeverity narrow
+// down what's sent here
+type SinkConfig struct {
+	// webhook, pagerduty or telegram
+	Type string
+	// The webhook to POST to. Overrides the API URL for the others
+	URL string
+	// PagerDuty Events API v2 integration key
+	RoutingKey string
+	// Telegram bot and the chat it posts to
+	BotToken string
+	ChatID   string
+	// Every event when empty
+	Events      []string
+	MinSeverity string
+}
+
+type Config struct {
+	Sinks []SinkConfig
+	// Least time between alerts of the same event and key. Those in between
+	// are counted and the count sent with the next
+	RateLimit time.Duration
+	// Message templates keyed by event
+	Templates map[string]string
+	// Put in every alert, ie the service name
+	Source string
+}
+
+func SetDefaults(config *viper.Viper) {
+	// A list of sinks, ie [{"type": "telegram", "bottoken": "...", "chatid":
+	// "..."}], see SinkConfig. No alerts are sent without any
+	config.SetDefault("Alerts", []interface{}{})
+	config.SetDefault("AlertRateLimit", "10m")
+	config.SetDefault("AlertTemplates", map[string]string{})
+}
+
+func ReadConfig(config *viper.Viper, source string) (Config, error) {
+	c := Config{
+		RateLimit: config.GetDuration("AlertRateLimit"),
+		Templates: config.GetStringMapString("AlertTemplates"),
+		Source:    source,
+	}
+	err := mapstructure.WeakDecode(config.Get("Alerts"), &c.Sinks)
+	if err != nil {
+		return c, errors.Wrap(err, "Invalid Alerts")
+	}
+	return c, nil
+}
+
+// One notification
+type Alert struct {
+	Event    string
+	Severity string
+	// What the alert is about, ie a currency or service ID. Rate limits are
+	// per event and key
+	Key     string
+	Source  string
+	Message string
+	Time    time.Time
+	Fields  map[string]interface{}
+	// Alerts dropped by the rate limit since the last one sent
+	Suppressed int
+}
+
+type sender interface {
+	send(alert *Alert) error
+}
+
+type sink struct {
+	sender
+	config SinkConfig
+	events map[string]bool
+}
+
+func (s *sink) wants(alert *Alert) bool {
+	if len(s.events) > 0 && !s.events[alert.Event] {
+		return false
+	}
+	return severityRank[alert.Severity] >= severityRank[s.config.MinSeverity]
+}
+
+type limit struct {
+	sent       time.Time
+	suppressed int
+}
+
+// Alerts still to go out before new ones are dropped
+const alertQueue = 100
+
+// Alerter renders, rate limits and sends alerts in the background, so firing
+// one never blocks. A nil Alerter drops everything
+type Alerter struct {
+	config    Config
+	sinks     []*sink
+	templates map[string]*template.Template
+	queue     chan *Alert
+	// Closed once everything queued before Close is sent
+	done chan struct{}
+
+	limits map[string]*limit
+	closed bool
+	mtx    sync.Mutex
+}
+
+// Returns nil without any sinks
+func New(config Config) (*Alerter, error) {
+	if len(config.Sinks) == 0 {
+		return nil, nil
+	}
+	a := &Alerter{
+		config:    config,
+		templates: map[string]*template.Template{},
+		queue:     make(chan *Alert, alertQueue),
+		done:      make(chan struct{}),
+		limits:    map[string]*limit{},
+	}
+	for event, text := range defaultTemplates {
+		if custom, ok := config.Templates[event]; ok {
+			text = custom
+		}
+		tmpl, err := template.New(event).Option("missingkey=zero").Parse(text)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid template for %s", event)
+		}
+		a.templates[event] = tmpl
+	}
+	for _, sc := range config.Sinks {
+		s := &sink{config: sc, events: map[string]bool{}}
+		for _, event := range sc.Events {
+			if _, ok := eventSeverity[event]; !ok {
+				return nil, errors.Errorf("Unknown alert event %s", event)
+			}
+			s.events[event] = true
+		}
+		if _, ok := severityRank[strings.ToLower(sc.MinSeverity)]; sc.MinSeverity != "" && !ok {
+			return nil, errors.Errorf("Unknown alert severity %s", sc.MinSeverity)
+		}
+		s.config.MinSeverity = strings.ToLower(sc.MinSeverity)
+		var err error
+		s.sender, err = newSender(sc)
+		if err != nil {
+			return nil, err
+		}
+		a.sinks = append(a.sinks, s)
+	}
+	go a.run()
+	return a, nil
+}
+
+// Raises an alert for event, unless one for the same event and key went out
+// within the rate limit
+func (a *Alerter) Fire(event string, key string, fields map[string]interface{}) {
+	if a == nil {
+		return
+	}
+	alert := &Alert{
+		Event:    event,
+		Severity: eventSeverity[event],
+		Key:      key,
+		Source:   a.config.Source,
+		Time:     time.Now(),
+		Fields:   fields,
+	}
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if a.closed || !a.allow(alert) {
+		return
+	}
+	select {
+	case a.queue <- alert:
+	default:
+		log.Warn("Alert queue full, dropping alert", "event", event, "key", key)
+	}
+}
+
+// Must hold mtx
+func (a *Alerter) allow(alert *Alert) bool {
+	id := alert.Event + "/" + alert.Key
+	l, ok := a.limits[id]
+	if !ok {
+		l = &limit{}
+		a.limits[id] = l
+	}
+	if !l.sent.IsZero() && alert.Time.Sub(l.sent) < a.config.RateLimit {
+		l.suppressed++
+		return false
+	}
+	alert.Suppressed = l.suppressed
+	l.sent = alert.Time
+	l.suppressed = 0
+	return true
+}
+
+// Sends what's queued and stops taking alerts. Commands that exit when
+// they're done must call it, or alerts they fired may never go out
+func (a *Alerter) Close() {
+	if a == nil {
+		return
+	}
+	a.mtx.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.queue)
+	}
+	a.mtx.Unlock()
+	<-a.done
+}
+
+func (a *Alerter) render(alert *Alert) string {
+	var buf bytes.Buffer
+	err := a.templates[alert.Event].Execute(&buf, alert)
+	if err != nil {
+		log.Warn("Failed to render alert", "event", alert.Event, "err", err)
+		return alert.Event + " " + alert.Key
+	}
+	return buf.String()
+}
+
+func (a *Alerter) run() {
+	defer close(a.done)
+	for alert := range a.queue {
+		alert.Message = a.render(alert)
+		for _, s := range a.sinks {
+			if !s.wants(alert) {
+				continue
+			}
+			if err := s.send(alert); err != nil {
+				log.Error("Failed to send alert", "sink", s.config.Type,
+					"event", alert.Event, "err", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package alert
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/icook/ngpool/pkg/service"
+)
+
+type recorder struct {
+	bodies []map[string]interface{}
+	paths  []string
+	mtx    sync.Mutex
+}
+
+func (r *recorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	raw, _ := ioutil.ReadAll(req.Body)
+	var body map[string]interface{}
+	json.Unmarshal(raw, &body)
+	r.mtx.Lock()
+	r.bodies = append(r.bodies, body)
+	r.paths = append(r.paths, req.URL.Path)
+	r.mtx.Unlock()
+}
+
+func TestAlerterSinks(t *testing.T) {
+	rec := &recorder{}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+
+	a, err := New(Config{
+		Sinks: []SinkConfig{
+			{Type: "webhook", URL: srv.URL + "/hook"},
+			{Type: "pagerduty", URL: srv.URL + "/pd", RoutingKey: "key",
+				MinSeverity: "Critical"},
+			{Type: "telegram", URL: srv.URL, BotToken: "tok", ChatID: "42",
+				Events: []string{BlockFound}},
+		},
+		Templates: map[string]string{BlockFound: "{{.Fields.currency}} at {{.Fields.height}}"},
+		Source:    "stratum_a",
+	})
+	assert.NoError(t, err)
+	a.Fire(BlockFound, "BTC", map[string]interface{}{"currency": "BTC", "height": 100})
+	a.Fire(PayoutFailed, "LTC", map[string]interface{}{"currency": "LTC", "err": "no funds"})
+	a.Close()
+	// Fired after close, dropped
+	a.Fire(PayoutFailed, "BTC", nil)
+
+	assert.Equal(t, []string{"/hook", "/bottok/sendMessage", "/hook", "/pd"}, rec.paths)
+	assert.Equal(t, "BTC at 100", rec.bodies[0]["message"])
+	assert.Equal(t, "stratum_a", rec.bodies[0]["source"])
+	assert.Equal(t, "[info] BTC at 100", rec.bodies[1]["text"])
+	assert.Equal(t, "42", rec.bodies[1]["chat_id"])
+	assert.Equal(t, "payout_failed/LTC", rec.bodies[3]["dedup_key"])
+	payload := rec.bodies[3]["payload"].(map[string]interface{})
+	assert.Equal(t, "LTC payout failed: no funds", payload["summary"])
+	assert.Equal(t, "critical", payload["severity"])
+}
+
+func TestAlerterRateLimit(t *testing.T) {
+	a := &Alerter{config: Config{RateLimit: time.Minute}, limits: map[string]*limit{}}
+	now := time.Now()
+	fire := func(key string, at time.Time) *Alert {
+		alert := &Alert{Event: RejectRate, Key: key, Time: at}
+		if !a.allow(alert) {
+			return nil
+		}
+		return alert
+	}
+	assert.NotNil(t, fire("", now))
+	assert.Nil(t, fire("", now.Add(time.Second*10)))
+	assert.Nil(t, fire("", now.Add(time.Second*20)))
+	// Other keys are limited separately
+	assert.NotNil(t, fire("other", now.Add(time.Second*20)))
+	sent := fire("", now.Add(time.Minute))
+	assert.NotNil(t, sent)
+	assert.Equal(t, 2, sent.Suppressed)
+}
+
+func TestAlerterConfig(t *testing.T) {
+	a, err := New(Config{})
+	assert.NoError(t, err)
+	assert.Nil(t, a)
+	a.Fire(BlockFound, "", nil)
+	a.Close()
+
+	_, err = New(Config{Sinks: []SinkConfig{{Type: "email"}}})
+	assert.Error(t, err)
+	_, err = New(Config{Sinks: []SinkConfig{{Type: "telegram", BotToken: "tok"}}})
+	assert.Error(t, err)
+	_, err = New(Config{Sinks: []SinkConfig{{Type: "webhook", URL: "http://x",
+		Events: []string{"block_lost"}}}})
+	assert.Error(t, err)
+	_, err = New(Config{Sinks: []SinkConfig{{Type: "webhook", URL: "http://x"}},
+		Templates: map[string]string{BlockFound: "{{.Fields"}})
+	assert.Error(t, err)
+}
+
+func TestAlerterEvents(t *testing.T) {
+	a := &Alerter{config: Config{RateLimit: time.Minute}, limits: map[string]*limit{},
+		queue: make(chan *Alert, 10)}
+	a.handleEvent(service.Event{Data: service.BlockEvent{Currency: "BTC", Height: 5}})
+	a.handleEvent(service.Event{Data: service.ServiceStatusUpdate{ServiceType: "stratum"}})
+	a.handleEvent(service.Event{Data: service.ServiceStatusUpdate{
+		ServiceType: "coinserver", ServiceID: "btc1"}})
+	a.handleEvent(service.Event{Data: service.DiscoveryEvent{}})
+	close(a.queue)
+	var got []string
+	for alert := range a.queue {
+		got = append(got, alert.Event+"/"+alert.Key)
+	}
+	assert.Equal(t, []string{"block_found/BTC", "coinserver_down/btc1", "discovery_down/"}, got)
+}
@@ -0,0 +1,123 @@
+package alert
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	pagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+	telegramURL  = "https://api.telegram.org"
+)
+
+var httpClient = &http.Client{Timeout: time.Second * 10}
+
+func newSender(config SinkConfig) (sender, error) {
+	switch config.Type {
+	case "webhook":
+		if config.URL == "" {
+			return nil, errors.New("Webhook alert sink needs a URL")
+		}
+		return &webhook{url: config.URL}, nil
+	case "pagerduty":
+		if config.RoutingKey == "" {
+			return nil, errors.New("PagerDuty alert sink needs a RoutingKey")
+		}
+		url := config.URL
+		if url == "" {
+			url = pagerDutyURL
+		}
+		return &pagerDuty{url: url, routingKey: config.RoutingKey}, nil
+	case "telegram":
+		if config.BotToken == "" || config.ChatID == "" {
+			return nil, errors.New("Telegram alert sink needs a BotToken and ChatID")
+		}
+		url := config.URL
+		if url == "" {
+			url = telegramURL
+		}
+		return &telegram{
+			url:    fmt.Sprintf("%s/bot%s/sendMessage", url, config.BotToken),
+			chatID: config.ChatID,
+		}, nil
+	}
+	return nil, errors.Errorf("Unknown alert sink type '%s'", config.Type)
+}
+
+func postJSON(url string, body interface{}) error {
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Post(url, "application/json", bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("Got %s", resp.Status)
+	}
+	return nil
+}
+
+// Posts the whole alert as JSON
+type webhook struct {
+	url string
+}
+
+func (w *webhook) send(alert *Alert) error {
+	return postJSON(w.url, map[string]interface{}{
+		"event":      alert.Event,
+		"severity":   alert.Severity,
+		"key":        alert.Key,
+		"source":     alert.Source,
+		"message":    alert.Message,
+		"time":       alert.Time,
+		"fields":     alert.Fields,
+		"suppressed": alert.Suppressed,
+	})
+}
+
+// Triggers an incident through the Events API v2. Repeats of an event and key
+// share a dedup key, so they pile onto the open incident
+type pagerDuty struct {
+	url        string
+	routingKey string
+}
+
+func (p *pagerDuty) send(alert *Alert) error {
+	return postJSON(p.url, map[string]interface{}{
+		"routing_key":  p.routingKey,
+		"event_action": "trigger",
+		"dedup_key":    alert.Event + "/" + alert.Key,
+		"payload": map[string]interface{}{
+			"summary":        alert.Message,
+			"source":         alert.Source,
+			"severity":       alert.Severity,
+			"timestamp":      alert.Time.UTC().Format(time.RFC3339),
+			"class":          alert.Event,
+			"custom_details": alert.Fields,
+		},
+	})
+}
+
+type telegram struct {
+	url    string
+	chatID string
+}
+
+func (t *telegram) send(alert *Alert) error {
+	text := fmt.Sprintf("[%s] %s", alert.Severity, alert.Message)
+	if alert.Suppressed > 0 {
+		text += fmt.Sprintf(" (%d more since last alert)", alert.Suppressed)
+	}
+	return postJSON(t.url, map[string]interface{}{
+		"chat_id": t.chatID,
+		"text":    text,
+	})
+}
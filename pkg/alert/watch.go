@@ -0,0 +1,45 @@
+package alert
+
+import (
+	"github.com/icook/ngpool/pkg/service"
+)
+
+// Turns events from a service's bus into alerts: blocks found, watched
+// coinservers expiring from service discovery, and our own status updates to
+// discovery failing. Runs until the bus subscription is closed
+func (a *Alerter) WatchEvents(bus *service.EventBus) {
+	if a == nil || bus == nil {
+		return
+	}
+	events := bus.Subscribe(100, service.EventBlockFound, service.EventServiceDown,
+		service.EventDiscoveryDown)
+	for event := range events {
+		a.handleEvent(event)
+	}
+}
+
+func (a *Alerter) handleEvent(event service.Event) {
+	switch data := event.Data.(type) {
+	case service.BlockEvent:
+		a.Fire(BlockFound, data.Currency, map[string]interface{}{
+			"currency": data.Currency,
+			"height":   data.Height,
+			"hash":     data.Hash,
+			"subsidy":  data.Subsidy,
+			"powalgo":  data.PowAlgo,
+			"miner":    data.MinedBy,
+		})
+	case service.ServiceStatusUpdate:
+		if data.ServiceType != "coinserver" {
+			return
+		}
+		a.Fire(CoinserverDown, data.ServiceID, map[string]interface{}{
+			"reason": "expired from service discovery",
+		})
+	case service.DiscoveryEvent:
+		a.Fire(DiscoveryDown, "", map[string]interface{}{
+			"err":   data.Err,
+			"since": data.Since,
+		})
+	}
+}
@@ -0,0 +1,188 @@
+// Package blockarchive keeps every block candidate a stratum submits, along
+// with the template it was built from, the share that solved it and what the
+// coinservers made of it, so a rejected or orphaned block can be picked apart
+// afterwards. Each block is a gzipped JSON file in one directory, named by
+// its hash
+package blockarchive
+
+import (
+	"compress/gzip"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Bumped whenever a field of Record changes meaning or is removed
+const FormatVersion = 1
+
+const fileSuffix = ".json.gz"
+
+// The share that solved a block
+type Share struct {
+	Username   string    `json:"username"`
+	Worker     string    `json:"worker"`
+	Difficulty float64   `json:"difficulty"`
+	MinedAt    time.Time `json:"mined_at"`
+	// The share's hash over the main chain target
+	BlockRatio float64 `json:"block_ratio"`
+}
+
+// A coinserver's answer to submitblock
+type Response struct {
+	// accepted, rejected or error
+	Result string `json:"result"`
+	// The node's reject reason, or the RPC error
+	Reason string `json:"reason,omitempty"`
+	// Milliseconds from handing the block out to getting an answer
+	LatencyMS int64 `json:"latency_ms"`
+}
+
+type Record struct {
+	Version     int       `json:"version"`
+	Currency    string    `json:"currency"`
+	Height      int64     `json:"height"`
+	Hash        string    `json:"hash"`
+	PowAlgo     string    `json:"powalgo,omitempty"`
+	PowHash     string    `json:"powhash"`
+	Target      string    `json:"target"`
+	SubmittedAt time.Time `json:"submitted_at"`
+	// The serialized block as given to submitblock, hex encoded
+	Block string `json:"block"`
+	// The getblocktemplate result the block was built from
+	Template json.RawMessage `json:"template"`
+	// Nil for blocks from ngstratum's own CPU miner
+	Share *Share `json:"share"`
+	// By coinserver. Empty when nothing answered, or there were no
+	// coinservers to submit to
+	Responses map[string]*Response `json:"responses"`
+}
+
+// A directory of records, pruned to at most maxBlocks files none older than
+// maxAge. Zero disables either limit
+type Store struct {
+	dir       string
+	maxAge    time.Duration
+	maxBlocks int
+}
+
+func NewStore(dir string, maxAge time.Duration, maxBlocks int) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "Unable to create archive directory")
+	}
+	return &Store{dir: dir, maxAge: maxAge, maxBlocks: maxBlocks}, nil
+}
+
+// Writes a record, replacing any earlier one for the same block. The file is
+// renamed into place so a reader never sees half of it
+func (s *Store) Write(rec *Record) error {
+	tmp, err := ioutil.TempFile(s.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	zw := gzip.NewWriter(tmp)
+	err = json.NewEncoder(zw).Encode(rec)
+	if err == nil {
+		err = zw.Close()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrap(err, "Failed writing archived block")
+	}
+	return os.Rename(tmp.Name(), filepath.Join(s.dir, rec.Hash+fileSuffix))
+}
+
+// Removes records past the limits, oldest first. Returns how many went
+func (s *Store) Prune(now time.Time) (int, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return 0, err
+	}
+	var records []os.FileInfo
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), fileSuffix) {
+			records = append(records, file)
+		}
+	}
+	// Newest first
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].ModTime().After(records[j].ModTime())
+	})
+	removed := 0
+	for i, file := range records {
+		tooMany := s.maxBlocks > 0 && i >= s.maxBlocks
+		tooOld := s.maxAge > 0 && now.Sub(file.ModTime()) > s.maxAge
+		if !tooMany && !tooOld {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.dir, file.Name())); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+func Load(path string) (*Record, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "Not an archived block")
+	}
+	var rec Record
+	if err := json.NewDecoder(zr).Decode(&rec); err != nil {
+		return nil, errors.Wrap(err, "Not an archived block")
+	}
+	return &rec, nil
+}
+
+// The path of the record for hash in dir. A unique prefix is enough, and the
+// hash may be in either byte order, since explorers show it reversed
+func Find(dir string, hash string) (string, error) {
+	hash = strings.ToLower(hash)
+	prefixes := []string{hash}
+	if raw, err := hex.DecodeString(hash); err == nil && len(raw) == 32 {
+		for i, j := 0, len(raw)-1; i < j; i, j = i+1, j-1 {
+			raw[i], raw[j] = raw[j], raw[i]
+		}
+		prefixes = append(prefixes, hex.EncodeToString(raw))
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	var matches []string
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, fileSuffix) {
+			continue
+		}
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(name, prefix) {
+				matches = append(matches, name)
+				break
+			}
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", errors.Errorf("No archived block matches %s", hash)
+	case 1:
+		return filepath.Join(dir, matches[0]), nil
+	default:
+		return "", errors.Errorf("%s matches %d archived blocks", hash, len(matches))
+	}
+}
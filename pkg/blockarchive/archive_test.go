@@ -0,0 +1,106 @@
+package blockarchive
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	hashA = "6fe28c0ab6f1b372c1a6a246ae63f74f931e8365e15a089c68d6190000000000"
+	// hashA in the order explorers show it
+	hashAReversed = "000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f"
+	hashB         = "6f00000000000000000000000000000000000000000000000000000000000000"
+)
+
+func testStore(t *testing.T, maxAge time.Duration, maxBlocks int) (*Store, string) {
+	dir, err := ioutil.TempDir("", "blockarchive")
+	assert.NoError(t, err)
+	store, err := NewStore(dir, maxAge, maxBlocks)
+	assert.NoError(t, err)
+	return store, dir
+}
+
+func TestWriteLoad(t *testing.T) {
+	store, dir := testStore(t, 0, 0)
+	defer os.RemoveAll(dir)
+
+	rec := &Record{
+		Version:   FormatVersion,
+		Currency:  "BTC",
+		Height:    10,
+		Hash:      hashA,
+		Block:     "0100",
+		Template:  []byte(`{"height":10}`),
+		Share:     &Share{Username: "user", Difficulty: 8},
+		Responses: map[string]*Response{},
+	}
+	assert.NoError(t, store.Write(rec))
+	// Answers arriving later replace the file
+	rec.Responses["cs1"] = &Response{Result: "rejected", Reason: "bad-txnmrklroot"}
+	assert.NoError(t, store.Write(rec))
+
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 1)
+	loaded, err := Load(filepath.Join(dir, hashA+fileSuffix))
+	assert.NoError(t, err)
+	assert.Equal(t, rec, loaded)
+
+	ioutil.WriteFile(filepath.Join(dir, "junk"+fileSuffix), []byte("nope"), 0644)
+	_, err = Load(filepath.Join(dir, "junk"+fileSuffix))
+	assert.Error(t, err)
+}
+
+func TestFind(t *testing.T) {
+	store, dir := testStore(t, 0, 0)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, store.Write(&Record{Hash: hashA}))
+	assert.NoError(t, store.Write(&Record{Hash: hashB}))
+	expected := filepath.Join(dir, hashA+fileSuffix)
+
+	for _, hash := range []string{hashA, hashAReversed, "6fe2", "6FE28C"} {
+		path, err := Find(dir, hash)
+		assert.NoError(t, err, hash)
+		assert.Equal(t, expected, path, hash)
+	}
+	_, err := Find(dir, "6f")
+	assert.Error(t, err)
+	_, err = Find(dir, "ff")
+	assert.Error(t, err)
+}
+
+func TestPrune(t *testing.T) {
+	store, dir := testStore(t, time.Hour*45, 2)
+	defer os.RemoveAll(dir)
+	now := time.Now()
+	for i, hash := range []string{"aa", "bb", "cc", "dd"} {
+		assert.NoError(t, store.Write(&Record{Hash: hash}))
+		// Oldest first, aa a couple of days old
+		mod := now.Add(-time.Hour * time.Duration(50-i*10))
+		os.Chtimes(filepath.Join(dir, hash+fileSuffix), mod, mod)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("keep"), 0644)
+
+	removed, err := store.Prune(now)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, removed)
+	_, err = Find(dir, "cc")
+	assert.NoError(t, err)
+	_, err = Find(dir, "dd")
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dir, "notes.txt"))
+	assert.NoError(t, err)
+
+	// Past the age limit goes even under the count
+	store.maxBlocks = 0
+	store.maxAge = time.Hour * 25
+	removed, err = store.Prune(now)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	_, err = Find(dir, "dd")
+	assert.NoError(t, err)
+}
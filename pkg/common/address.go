@@ -0,0 +1,153 @@
+package common
+
+import (
+	"sync"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcutil"
+	"github.com/pkg/errors"
+)
+
+// Converts between address strings and output scripts for a currency. Output
+// scripts are the same across all the bitcoin-like coins we support, it's
+// only the string encoding that varies
+type AddressCodec interface {
+	// Returns the script paying to address, or an error if the address isn't
+	// valid for the currency
+	PayToScript(address string) ([]byte, error)
+	// Encodes the address a standard single address output script pays
+	ScriptAddress(script []byte) (string, error)
+}
+
+// A lookup of currency code to the codec for its addresses. Populated by
+// SetupCurrencies, and again when currencies are reloaded
+var (
+	addressCodecsMtx sync.RWMutex
+	addressCodecs    = map[string]AddressCodec{}
+)
+
+func RegisterAddressCodec(currency string, codec AddressCodec) {
+	addressCodecsMtx.Lock()
+	addressCodecs[currency] = codec
+	addressCodecsMtx.Unlock()
+}
+
+// Drops the codec of a currency that's no longer configured
+func UnregisterAddressCodec(currency string) {
+	addressCodecsMtx.Lock()
+	delete(addressCodecs, currency)
+	addressCodecsMtx.Unlock()
+}
+
+func GetAddressCodec(currency string) (AddressCodec, error) {
+	addressCodecsMtx.RLock()
+	codec, ok := addressCodecs[currency]
+	addressCodecsMtx.RUnlock()
+	if !ok {
+		return nil, errors.Errorf("No address codec registered for %s", currency)
+	}
+	return codec, nil
+}
+
+// Handles base58check addresses using the network's version bytes, and bech32
+// segwit addresses if the network has an HRP set
+type Base58Codec struct {
+	Params *chaincfg.Params
+}
+
+func (c *Base58Codec) PayToScript(address string) ([]byte, error) {
+	addr, err := btcutil.DecodeAddress(address, c.Params)
+	if err != nil {
+		return nil, err
+	}
+	// DecodeAddress will happily decode an address from another network that
+	// happens to be registered
+	if !addr.IsForNet(c.Params) {
+		return nil, errors.Errorf("Address %s is for a different network", address)
+	}
+	return txscript.PayToAddrScript(addr)
+}
+
+func (c *Base58Codec) ScriptAddress(script []byte) (string, error) {
+	_, addrs, count, err := txscript.ExtractPkScriptAddrs(script, c.Params)
+	if err != nil {
+		return "", err
+	}
+	if count != 1 || len(addrs) != 1 {
+		return "", errors.New("Script doesn't pay a single address")
+	}
+	return addrs[0].EncodeAddress(), nil
+}
+
+// Bitcoin Cash style addresses. Legacy base58 addresses are still accepted
+// when decoding, but we always encode to cashaddr
+type CashAddrCodec struct {
+	Prefix string
+	Legacy *Base58Codec
+}
+
+func (c *CashAddrCodec) PayToScript(address string) ([]byte, error) {
+	addrType, hash, err := DecodeCashAddr(c.Prefix, address)
+	if err != nil {
+		// Might be a legacy address
+		if script, legacyErr := c.Legacy.PayToScript(address); legacyErr == nil {
+			return script, nil
+		}
+		return nil, err
+	}
+	switch addrType {
+	case CashAddrP2PKH:
+		return txscript.NewScriptBuilder().AddOp(txscript.OP_DUP).
+			AddOp(txscript.OP_HASH160).AddData(hash).
+			AddOp(txscript.OP_EQUALVERIFY).AddOp(txscript.OP_CHECKSIG).Script()
+	case CashAddrP2SH:
+		return txscript.NewScriptBuilder().AddOp(txscript.OP_HASH160).
+			AddData(hash).AddOp(txscript.OP_EQUAL).Script()
+	}
+	return nil, errors.Errorf("Unsupported cashaddr type %d", addrType)
+}
+
+func (c *CashAddrCodec) ScriptAddress(script []byte) (string, error) {
+	class, addrs, count, err := txscript.ExtractPkScriptAddrs(script, c.Legacy.Params)
+	if err != nil {
+		return "", err
+	}
+	if count != 1 || len(addrs) != 1 {
+		return "", errors.New("Script doesn't pay a single address")
+	}
+	switch class {
+	case txscript.PubKeyHashTy:
+		return EncodeCashAddr(c.Prefix, CashAddrP2PKH, addrs[0].ScriptAddress())
+	case txscript.ScriptHashTy:
+		return EncodeCashAddr(c.Prefix, CashAddrP2SH, addrs[0].ScriptAddress())
+	}
+	return "", errors.Errorf("No cashaddr encoding for %s scripts", class)
+}
+
+// Decodes an address with the currency's codec and returns the equivalent
+// btcutil address, which is what btcd's libraries and RPC client expect. For
+// cashaddr currencies this is the legacy encoding
+func DecodeAddress(currency string, address string, params *chaincfg.Params) (btcutil.Address, error) {
+	codec, err := GetAddressCodec(currency)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeAddressWith(codec, address, params)
+}
+
+// DecodeAddress with a codec that may not be registered yet
+func DecodeAddressWith(codec AddressCodec, address string, params *chaincfg.Params) (btcutil.Address, error) {
+	script, err := codec.PayToScript(address)
+	if err != nil {
+		return nil, err
+	}
+	_, addrs, count, err := txscript.ExtractPkScriptAddrs(script, params)
+	if err != nil {
+		return nil, err
+	}
+	if count != 1 || len(addrs) != 1 {
+		return nil, errors.New("Script doesn't pay a single address")
+	}
+	return addrs[0], nil
+}
@@ -0,0 +1,140 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+)
+
+// Bitcoin Cash address format, see
+// https://github.com/bitcoincashorg/bitcoincash.org/blob/master/spec/cashaddr.md
+// Only 160 bit hashes are supported, which covers P2PKH and P2SH
+
+const cashAddrCharset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+const (
+	CashAddrP2PKH byte = 0
+	CashAddrP2SH  byte = 1
+)
+
+func cashAddrPolymod(values []byte) uint64 {
+	c := uint64(1)
+	for _, d := range values {
+		c0 := byte(c >> 35)
+		c = ((c & 0x07ffffffff) << 5) ^ uint64(d)
+		if c0&0x01 != 0 {
+			c ^= 0x98f2bc8e61
+		}
+		if c0&0x02 != 0 {
+			c ^= 0x79b76d99e2
+		}
+		if c0&0x04 != 0 {
+			c ^= 0xf33e5fb3c4
+		}
+		if c0&0x08 != 0 {
+			c ^= 0xae2eabe2a8
+		}
+		if c0&0x10 != 0 {
+			c ^= 0x1e4f43e470
+		}
+	}
+	return c ^ 1
+}
+
+func cashAddrPrefixData(prefix string) []byte {
+	ret := make([]byte, 0, len(prefix)+1)
+	for i := 0; i < len(prefix); i++ {
+		ret = append(ret, prefix[i]&0x1f)
+	}
+	return append(ret, 0)
+}
+
+// Regroups bits, ie from 8 bit bytes to 5 bit cashaddr characters
+func convertBits(data []byte, from uint, to uint, pad bool) ([]byte, error) {
+	var (
+		acc  uint
+		bits uint
+		ret  []byte
+		max  uint = (1 << to) - 1
+	)
+	for _, value := range data {
+		if uint(value)>>from != 0 {
+			return nil, errors.New("Invalid data range")
+		}
+		acc = (acc << from) | uint(value)
+		bits += from
+		for bits >= to {
+			bits -= to
+			ret = append(ret, byte((acc>>bits)&max))
+		}
+	}
+	if pad {
+		if bits > 0 {
+			ret = append(ret, byte((acc<<(to-bits))&max))
+		}
+	} else if bits >= from || (acc<<(to-bits))&max != 0 {
+		return nil, errors.New("Invalid padding")
+	}
+	return ret, nil
+}
+
+func EncodeCashAddr(prefix string, addrType byte, hash []byte) (string, error) {
+	if len(hash) != 20 {
+		return "", errors.New("Only 160 bit hashes are supported")
+	}
+	payload, err := convertBits(append([]byte{addrType << 3}, hash...), 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+	checksumInput := append(cashAddrPrefixData(prefix), payload...)
+	checksumInput = append(checksumInput, make([]byte, 8)...)
+	mod := cashAddrPolymod(checksumInput)
+	for i := 0; i < 8; i++ {
+		payload = append(payload, byte((mod>>uint(5*(7-i)))&0x1f))
+	}
+
+	out := bytes.Buffer{}
+	out.WriteString(prefix)
+	out.WriteByte(':')
+	for _, b := range payload {
+		out.WriteByte(cashAddrCharset[b])
+	}
+	return out.String(), nil
+}
+
+// Decodes a cashaddr, with or without the prefix. Returns the address type
+// and hash
+func DecodeCashAddr(prefix string, address string) (byte, []byte, error) {
+	lower := strings.ToLower(address)
+	if lower != address && strings.ToUpper(address) != address {
+		return 0, nil, errors.New("Mixed case address")
+	}
+	if idx := strings.IndexByte(lower, ':'); idx != -1 {
+		if lower[:idx] != prefix {
+			return 0, nil, errors.New("Wrong address prefix")
+		}
+		lower = lower[idx+1:]
+	}
+	var data []byte
+	for i := 0; i < len(lower); i++ {
+		idx := strings.IndexByte(cashAddrCharset, lower[i])
+		if idx == -1 {
+			return 0, nil, errors.New("Invalid character in address")
+		}
+		data = append(data, byte(idx))
+	}
+	if len(data) <= 8 {
+		return 0, nil, errors.New("Address too short")
+	}
+	if cashAddrPolymod(append(cashAddrPrefixData(prefix), data...)) != 0 {
+		return 0, nil, errors.New("Invalid checksum")
+	}
+	payload, err := convertBits(data[:len(data)-8], 5, 8, false)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(payload) != 21 || payload[0]&0x07 != 0 {
+		return 0, nil, errors.New("Unsupported hash size")
+	}
+	return payload[0] >> 3, payload[1:], nil
+}
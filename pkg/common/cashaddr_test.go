@@ -0,0 +1,40 @@
+package common
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCashAddrRoundTrip(t *testing.T) {
+	// Test vectors from the cashaddr spec
+	hash, _ := hex.DecodeString("f5bf48b397dae70be82b3cca4793f8eb2b6cdac9")
+	vectors := []struct {
+		prefix   string
+		addrType byte
+		address  string
+	}{
+		{"bitcoincash", CashAddrP2PKH, "bitcoincash:qr6m7j9njldwwzlg9v7v53unlr4jkmx6eylep8ekg2"},
+		{"bchtest", CashAddrP2SH, "bchtest:pr6m7j9njldwwzlg9v7v53unlr4jkmx6eyvwc0uz5t"},
+	}
+	for _, v := range vectors {
+		encoded, err := EncodeCashAddr(v.prefix, v.addrType, hash)
+		assert.NoError(t, err)
+		assert.Equal(t, v.address, encoded)
+
+		addrType, decoded, err := DecodeCashAddr(v.prefix, v.address)
+		assert.NoError(t, err)
+		assert.Equal(t, v.addrType, addrType)
+		assert.Equal(t, hash, decoded)
+	}
+}
+
+func TestCashAddrDecodeInvalid(t *testing.T) {
+	_, _, err := DecodeCashAddr("bitcoincash", "qr6m7j9njldwwzlg9v7v53unlr4jkmx6eylep8ekg3")
+	assert.Error(t, err)
+	_, _, err = DecodeCashAddr("bchtest", "bitcoincash:qr6m7j9njldwwzlg9v7v53unlr4jkmx6eylep8ekg2")
+	assert.Error(t, err)
+	_, _, err = DecodeCashAddr("bitcoincash", "bitcoincash:Qr6m7j9njldwwzlg9v7v53unlr4jkmx6eylep8ekg2")
+	assert.Error(t, err)
+}
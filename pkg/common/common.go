@@ -12,18 +12,71 @@ import (
 type PayoutMeta struct {
 	ChangeAddress string
 	PayoutMaps    map[int]*PayoutMap `json:"payout_maps"`
-	Inputs        []UTXO
+	// Change sent to the currency's ColdWalletAddress as its own output
+	ColdSweep int64 `json:"cold_sweep"`
+	Inputs    []UTXO
+	// The payout run this batch belongs to, and the highest user_id in the
+	// batch. Committing the batch advances the run to Cursor
+	RunID  int `json:"run_id"`
+	Cursor int `json:"cursor"`
 }
 
 type StratumStatus struct {
-	Clients []StratumClientStatus `json:"clients"`
+	Clients     []StratumClientStatus       `json:"clients"`
+	ProtocolIPs map[string]IPProtocolStatus `json:"protocol_ips" mapstructure:"protocol_ips"`
+	Hashrate    HashrateStatus              `json:"hashrate"`
+	Draining    bool                        `json:"draining"`
+}
+
+// An IP's protocol errors across all its connections. The counts are kept
+// while it's banned for them, and start again once the ban ends
+type IPProtocolStatus struct {
+	ProtocolStats `mapstructure:",squash"`
+	// Unix seconds, 0 if the IP isn't banned
+	BannedUntil int64 `json:"banned_until,omitempty" mapstructure:"banned_until"`
 }
 
 type StratumClientStatus struct {
-	Username   string  `json:"username"`
-	Hashrate   float64 `json:"hashrate"`
-	Name       string  `json:"name"`
-	Difficulty float64 `json:"difficulty"`
+	Username   string        `json:"username"`
+	Hashrate   float64       `json:"hashrate"`
+	Name       string        `json:"name"`
+	Difficulty float64       `json:"difficulty"`
+	RemoteIP   string        `json:"remote_ip" mapstructure:"remote_ip"`
+	Currency   string        `json:"currency"`
+	Protocol   ProtocolStats `json:"protocol"`
+	Shares     ShareStats    `json:"shares"`
+	// Difficulty still owed for bad shares acknowledged with FastAck
+	PenaltyOwed float64 `json:"penalty_owed,omitempty" mapstructure:"penalty_owed"`
+}
+
+// Counts of a connection's share submissions, by what became of them
+type ShareStats struct {
+	Accepted     uint64 `json:"accepted"`
+	JobNotFound  uint64 `json:"job_not_found" mapstructure:"job_not_found"`
+	Stale        uint64 `json:"stale"`
+	Duplicate    uint64 `json:"duplicate"`
+	LowDiff      uint64 `json:"low_difficulty" mapstructure:"low_difficulty"`
+	BadNonceSize uint64 `json:"bad_nonce_size" mapstructure:"bad_nonce_size"`
+	BadVersion   uint64 `json:"bad_version" mapstructure:"bad_version"`
+	BadResult    uint64 `json:"bad_result" mapstructure:"bad_result"`
+	Other        uint64 `json:"other"`
+}
+
+func (s ShareStats) Rejected() uint64 {
+	return s.JobNotFound + s.Stale + s.Duplicate + s.LowDiff + s.BadNonceSize +
+		s.BadVersion + s.BadResult + s.Other
+}
+
+// Counters of malformed or unexpected stratum requests, kept per connection
+// and per remote IP
+type ProtocolStats struct {
+	ParseErrors    uint64 `json:"parse_errors" mapstructure:"parse_errors"`
+	UnknownMethods uint64 `json:"unknown_methods" mapstructure:"unknown_methods"`
+	OutOfOrder     uint64 `json:"out_of_order" mapstructure:"out_of_order"`
+}
+
+func (p ProtocolStats) Total() uint64 {
+	return p.ParseErrors + p.UnknownMethods + p.OutOfOrder
 }
 
 // Contains information the
@@ -33,6 +86,8 @@ type PayoutMap struct {
 	Address   string
 	Amount    int64
 	MinerFee  int64
+	// Charged by the pool for on-demand payouts. Kept in the change output
+	PoolFee int64
 
 	AddressObj btcutil.Address `json:"-"`
 }
@@ -0,0 +1,112 @@
+package common
+
+import (
+	"math"
+	"time"
+)
+
+// Estimates a rate from weighted events (ie shares weighted by difficulty)
+// with exponential decay, so recent work counts more than old work and the
+// estimate falls smoothly towards zero when events stop. Unlike Window it
+// doesn't hold onto samples, so it's cheap to keep one for every worker
+type DecayedRate struct {
+	// Time for the weight of an event to fall by 1/e
+	tau   float64
+	sum   float64
+	start time.Time
+	last  time.Time
+}
+
+func NewDecayedRate(tau time.Duration, now time.Time) *DecayedRate {
+	return &DecayedRate{
+		tau:   tau.Seconds(),
+		start: now,
+		last:  now,
+	}
+}
+
+func (d *DecayedRate) decay(now time.Time) float64 {
+	elapsed := now.Sub(d.last).Seconds()
+	if elapsed <= 0 {
+		return d.sum
+	}
+	return d.sum * math.Exp(-elapsed/d.tau)
+}
+
+func (d *DecayedRate) Add(weight float64, now time.Time) {
+	if now.Before(d.last) {
+		now = d.last
+	}
+	d.sum = d.decay(now) + weight
+	d.last = now
+}
+
+// Returns the estimated rate per second. While the estimator is younger than
+// a few tau the decayed sum hasn't had time to fill, so it's scaled up to
+// avoid reporting new workers as slower than they are
+func (d *DecayedRate) Rate(now time.Time) float64 {
+	age := now.Sub(d.start).Seconds()
+	if age <= 0 {
+		return 0
+	}
+	fill := 1 - math.Exp(-age/d.tau)
+	return d.decay(now) / (d.tau * fill)
+}
+
+// Time since the last event was added
+func (d *DecayedRate) Idle(now time.Time) time.Duration {
+	return now.Sub(d.last)
+}
+
+func (d *DecayedRate) Last() time.Time {
+	return d.last
+}
+
+// Hashrates (hashes per second) estimated by a stratum server, published in
+// its status
+type HashrateStatus struct {
+	// Everything on this stratum port
+	Port float64 `json:"port"`
+	// Keyed by username
+	Addresses map[string]float64 `json:"addresses"`
+	// Keyed by username, then worker name
+	Workers map[string]map[string]float64 `json:"workers"`
+	// Unix time of each worker's last share, keyed like Workers
+	LastSeen map[string]map[string]int64 `json:"last_seen" mapstructure:"last_seen"`
+}
+
+func NewHashrateStatus() *HashrateStatus {
+	return &HashrateStatus{
+		Addresses: map[string]float64{},
+		Workers:   map[string]map[string]float64{},
+		LastSeen:  map[string]map[string]int64{},
+	}
+}
+
+// Adds the rates in other to h. Used to sum the status of several stratum
+// ports into a pool wide view, where Port becomes the pool hashrate
+func (h *HashrateStatus) Merge(other *HashrateStatus) {
+	h.Port += other.Port
+	for username, rate := range other.Addresses {
+		h.Addresses[username] += rate
+	}
+	for username, workers := range other.Workers {
+		if _, ok := h.Workers[username]; !ok {
+			h.Workers[username] = map[string]float64{}
+		}
+		for name, rate := range workers {
+			h.Workers[username][name] += rate
+		}
+	}
+	// A rig can move between ports, the latest share is the one that counts
+	for username, workers := range other.LastSeen {
+		if _, ok := h.LastSeen[username]; !ok {
+			h.LastSeen[username] = map[string]int64{}
+		}
+		for name, seen := range workers {
+			if seen > h.LastSeen[username][name] {
+				h.LastSeen[username][name] = seen
+			}
+		}
+	}
+}
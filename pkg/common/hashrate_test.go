@@ -0,0 +1,62 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecayedRateSteady(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	d := NewDecayedRate(time.Minute, now)
+	// 10 per second for 10 minutes
+	for i := 0; i < 600; i++ {
+		now = now.Add(time.Second)
+		d.Add(10, now)
+	}
+	assert.InEpsilon(t, 10, d.Rate(now), 0.1)
+}
+
+func TestDecayedRateWarmup(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	d := NewDecayedRate(time.Minute, now)
+	// Only 10 seconds in, so the estimate relies on the fill correction
+	for i := 0; i < 10; i++ {
+		now = now.Add(time.Second)
+		d.Add(10, now)
+	}
+	assert.InEpsilon(t, 10, d.Rate(now), 0.1)
+}
+
+func TestDecayedRateDecays(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	d := NewDecayedRate(time.Minute, now)
+	for i := 0; i < 600; i++ {
+		now = now.Add(time.Second)
+		d.Add(10, now)
+	}
+	before := d.Rate(now)
+	now = now.Add(time.Minute)
+	assert.InEpsilon(t, before/2.718, d.Rate(now), 0.01)
+	assert.Equal(t, time.Minute, d.Idle(now))
+}
+
+func TestHashrateStatusMerge(t *testing.T) {
+	h := NewHashrateStatus()
+	h.Merge(&HashrateStatus{
+		Port:      100,
+		Addresses: map[string]float64{"alice": 100},
+		Workers:   map[string]map[string]float64{"alice": {"rig1": 100}},
+		LastSeen:  map[string]map[string]int64{"alice": {"rig1": 1000}},
+	})
+	h.Merge(&HashrateStatus{
+		Port:      50,
+		Addresses: map[string]float64{"alice": 50},
+		Workers:   map[string]map[string]float64{"alice": {"rig1": 50}},
+		LastSeen:  map[string]map[string]int64{"alice": {"rig1": 900}},
+	})
+	assert.Equal(t, 150.0, h.Port)
+	assert.Equal(t, 150.0, h.Workers["alice"]["rig1"])
+	assert.Equal(t, int64(1000), h.LastSeen["alice"]["rig1"])
+}
@@ -1,24 +1,32 @@
 package common
 
-import "time"
+import (
+	"sync"
+	"time"
+)
 
 type sample struct {
 	time   time.Time
 	amount float64
 }
 
+// Safe to add to and read from multiple goroutines
 type Window struct {
 	samples []*sample
 	head    int
+	mtx     *sync.Mutex
 }
 
 func NewWindow(size int) Window {
 	return Window{
 		samples: make([]*sample, size),
+		mtx:     &sync.Mutex{},
 	}
 }
 
 func (w *Window) Add(val float64) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
 	w.samples[w.head] = &sample{time.Now(), val}
 	w.head += 1
 	if w.head >= len(w.samples) {
@@ -35,6 +43,8 @@ func (w *Window) RateMinute() float64 {
 }
 
 func (w *Window) Rate(interval time.Duration) float64 {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
 	var total float64
 	var newest *time.Time
 	for _, sam := range w.samples {
@@ -0,0 +1,106 @@
+package logging
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// A record kept in a Buffer. Context values are formatted when logged, since
+// they can change after
+type Entry struct {
+	// Counts up from 1 over the life of the process
+	Seq  uint64
+	Time time.Time
+	Lvl  log.Lvl
+	Msg  string
+	// Keys and values, alternating
+	Ctx []string
+}
+
+// What Buffer.Since found
+type Tail struct {
+	Entries []Entry
+	// The latest Seq logged, to ask from next time
+	Last uint64
+	// Entries after the one asked from that had already been dropped
+	Missed uint64
+	// Closed when the next entry is logged
+	Wait <-chan struct{}
+}
+
+// Keeps the latest records logged, so they can be read back through the admin
+// API without access to the host. A log15 handler
+type Buffer struct {
+	mtx     sync.Mutex
+	entries []Entry
+	// Seq of the latest entry
+	last uint64
+	wake chan struct{}
+}
+
+func NewBuffer(size int) *Buffer {
+	return &Buffer{entries: make([]Entry, size)}
+}
+
+func (b *Buffer) Log(r *log.Record) error {
+	ctx := make([]string, 0, len(r.Ctx)+1)
+	for i := 0; i < len(r.Ctx); i += 2 {
+		ctx = append(ctx, fmt.Sprint(r.Ctx[i]))
+		if i+1 < len(r.Ctx) {
+			ctx = append(ctx, formatValue(r.Ctx[i+1]))
+		} else {
+			ctx = append(ctx, "")
+		}
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.last++
+	b.entries[b.last%uint64(len(b.entries))] = Entry{
+		Seq:  b.last,
+		Time: r.Time,
+		Lvl:  r.Lvl,
+		Msg:  r.Msg,
+		Ctx:  ctx,
+	}
+	if b.wake != nil {
+		close(b.wake)
+		b.wake = nil
+	}
+	return nil
+}
+
+func formatValue(value interface{}) string {
+	if t, ok := value.(time.Time); ok {
+		return t.Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(value)
+}
+
+// The entries logged after the one numbered after, oldest first
+func (b *Buffer) Since(after uint64) Tail {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	tail := Tail{Last: b.last}
+	if after > b.last {
+		after = b.last
+	}
+	oldest := uint64(1)
+	if b.last > uint64(len(b.entries)) {
+		oldest = b.last - uint64(len(b.entries)) + 1
+	}
+	if after+1 < oldest {
+		tail.Missed = oldest - after - 1
+		after = oldest - 1
+	}
+	for seq := after + 1; seq <= b.last; seq++ {
+		tail.Entries = append(tail.Entries, b.entries[seq%uint64(len(b.entries))])
+	}
+	if b.wake == nil {
+		b.wake = make(chan struct{})
+	}
+	tail.Wait = b.wake
+	return tail
+}
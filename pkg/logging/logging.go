@@ -0,0 +1,233 @@
+// Package logging sets up log15 the same way for every service: console,
+// logfmt or JSON output, to stdout or to a file it can rotate itself, with
+// levels set per module
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+const (
+	// log15's colored terminal format
+	FormatConsole = "console"
+	FormatLogfmt  = "logfmt"
+	// One JSON object per line, for shipping to a log store
+	FormatJSON = "json"
+)
+
+// The context key New tags records with, and which LogModules levels match
+const ModuleKey = "module"
+
+type Config struct {
+	Level string
+	// Levels by module, overriding Level for records from New(module)
+	Modules map[string]string
+	Format  string
+	// Stdout if empty
+	File string
+	// Megabytes File can grow to before it's rotated to File.1, File.1 to
+	// File.2 and so on, keeping MaxBackups. 0 leaves rotation to logrotate
+	// and the rotate-logs control command
+	MaxSize    int
+	MaxBackups int
+	// Records kept for reading back through the admin API, 0 for none
+	BufferSize int
+}
+
+// Sets defaults for the keys ReadConfig reads besides LogLevel, which each
+// service defaults itself
+func SetDefaults(config *viper.Viper) {
+	// Logs go to stdout unless LogFile is set. The rotate-logs control
+	// command reopens it
+	config.SetDefault("LogFile", "")
+	config.SetDefault("LogFormat", FormatLogfmt)
+	// Module name to level, ie {"client": "debug"}
+	config.SetDefault("LogModules", map[string]string{})
+	config.SetDefault("LogMaxSize", 0)
+	config.SetDefault("LogMaxBackups", 5)
+	// The latest records logged are kept in memory for `ngctl logs` to tail
+	// through the admin API
+	config.SetDefault("LogBuffer", 1000)
+}
+
+func ReadConfig(config *viper.Viper) Config {
+	return Config{
+		Level:      config.GetString("LogLevel"),
+		Modules:    config.GetStringMapString("LogModules"),
+		Format:     config.GetString("LogFormat"),
+		File:       config.GetString("LogFile"),
+		MaxSize:    config.GetInt("LogMaxSize"),
+		MaxBackups: config.GetInt("LogMaxBackups"),
+		BufferSize: config.GetInt("LogBuffer"),
+	}
+}
+
+// The keys Logging.Apply changes at runtime, for leaving out of
+// service.ChangedKeys
+var RuntimeKeys = []string{"LogLevel", "LogModules", "LogFormat"}
+
+// A logger whose records are tagged with the module, so LogModules can set
+// its level
+func New(module string, ctx ...interface{}) log.Logger {
+	return log.New(append([]interface{}{ModuleKey, module}, ctx...)...)
+}
+
+type levels struct {
+	root    log.Lvl
+	modules map[string]log.Lvl
+}
+
+func parseLevels(config Config) (*levels, error) {
+	root, err := log.LvlFromString(config.Level)
+	if err != nil {
+		return nil, err
+	}
+	lv := &levels{root: root, modules: map[string]log.Lvl{}}
+	for module, name := range config.Modules {
+		lvl, err := log.LvlFromString(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "LogModules %s", module)
+		}
+		lv.modules[module] = lvl
+	}
+	return lv, nil
+}
+
+func (lv *levels) enabled(r *log.Record) bool {
+	max := lv.root
+	if len(lv.modules) > 0 {
+		// A logger made from another can be given a new module, which comes
+		// later in the context
+		for i := 0; i+1 < len(r.Ctx); i += 2 {
+			if r.Ctx[i] != ModuleKey {
+				continue
+			}
+			if lvl, ok := lv.modules[fmt.Sprint(r.Ctx[i+1])]; ok {
+				max = lvl
+			} else {
+				max = lv.root
+			}
+		}
+	}
+	return r.Lvl <= max
+}
+
+func parseFormat(name string) (log.Format, error) {
+	switch name {
+	case FormatConsole:
+		return log.TerminalFormat(), nil
+	case "", FormatLogfmt:
+		return log.LogfmtFormat(), nil
+	case FormatJSON:
+		return log.JsonFormat(), nil
+	}
+	return nil, errors.Errorf("Invalid log format %q, must be %s, %s or %s",
+		name, FormatConsole, FormatLogfmt, FormatJSON)
+}
+
+// The root log handler's state. Levels and format are swapped atomically, so
+// they can change while logging carries on
+type Logging struct {
+	config  Config
+	out     io.Writer
+	file    *RotatingFile
+	buffer  *Buffer
+	levels  atomic.Value
+	handler atomic.Value
+}
+
+// Opens the log file if there is one and points the root logger at it
+func Setup(config Config) (*Logging, error) {
+	l := &Logging{out: os.Stdout}
+	if config.File != "" {
+		file, err := OpenRotatingFile(config.File, int64(config.MaxSize)<<20,
+			config.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		l.file = file
+		l.out = file
+	}
+	if config.BufferSize > 0 {
+		l.buffer = NewBuffer(config.BufferSize)
+	}
+	lv, err := l.apply(config)
+	if err != nil {
+		return nil, err
+	}
+	log.Root().SetHandler(log.FuncHandler(l.log))
+	log.Info("Set log level", "level", lv.root, "modules", config.Modules)
+	return l, nil
+}
+
+func (l *Logging) log(r *log.Record) error {
+	if !l.levels.Load().(*levels).enabled(r) {
+		return nil
+	}
+	if l.buffer != nil {
+		l.buffer.Log(r)
+	}
+	return l.handler.Load().(log.Handler).Log(r)
+}
+
+// The records kept for the admin API, nil if LogBuffer is 0
+func (l *Logging) Buffer() *Buffer {
+	return l.buffer
+}
+
+// Applies the level, module levels and format of config. The file it writes
+// to is only set by Setup
+func (l *Logging) Apply(config Config) error {
+	lv, err := l.apply(config)
+	if err != nil {
+		return err
+	}
+	log.Info("Set log level", "level", lv.root, "modules", config.Modules)
+	return nil
+}
+
+func (l *Logging) apply(config Config) (*levels, error) {
+	lv, err := parseLevels(config)
+	if err != nil {
+		return nil, err
+	}
+	format, err := parseFormat(config.Format)
+	if err != nil {
+		return nil, err
+	}
+	l.config = config
+	l.levels.Store(lv)
+	l.handler.Store(log.CallerFileHandler(log.StreamHandler(l.out, format)))
+	return lv, nil
+}
+
+// Applies the RuntimeKeys set in a freshly fetched service config, for the
+// reload-config control command. Unset keys keep their current values
+func (l *Logging) Reload(config *viper.Viper) error {
+	next := l.config
+	if config.IsSet("LogLevel") {
+		next.Level = config.GetString("LogLevel")
+	}
+	if config.IsSet("LogModules") {
+		next.Modules = config.GetStringMapString("LogModules")
+	}
+	if config.IsSet("LogFormat") {
+		next.Format = config.GetString("LogFormat")
+	}
+	return l.Apply(next)
+}
+
+// Reopens the log file after logrotate has moved it
+func (l *Logging) Reopen() error {
+	if l.file == nil {
+		return errors.New("Logging to stdout, LogFile isn't set")
+	}
+	return l.file.Reopen()
+}
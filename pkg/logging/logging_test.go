@@ -0,0 +1,115 @@
+package logging
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModuleLevels(t *testing.T) {
+	lv, err := parseLevels(Config{
+		Level:   "info",
+		Modules: map[string]string{"client": "debug", "web": "error"},
+	})
+	assert.NoError(t, err)
+
+	record := func(lvl log.Lvl, ctx ...interface{}) *log.Record {
+		return &log.Record{Lvl: lvl, Ctx: ctx}
+	}
+	assert.True(t, lv.enabled(record(log.LvlInfo)))
+	assert.False(t, lv.enabled(record(log.LvlDebug)))
+	assert.True(t, lv.enabled(record(log.LvlDebug, ModuleKey, "client", "id", 1)))
+	assert.False(t, lv.enabled(record(log.LvlWarn, ModuleKey, "web")))
+	assert.False(t, lv.enabled(record(log.LvlDebug, ModuleKey, "other")))
+	// The latest module wins
+	assert.False(t, lv.enabled(record(log.LvlDebug, ModuleKey, "client", ModuleKey, "other")))
+
+	_, err = parseLevels(Config{Level: "info", Modules: map[string]string{"client": "loud"}})
+	assert.Error(t, err)
+	_, err = parseFormat("xml")
+	assert.Error(t, err)
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logging")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.log")
+
+	f, err := OpenRotatingFile(path, 10, 2)
+	assert.NoError(t, err)
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		_, err := f.Write([]byte(line))
+		assert.NoError(t, err)
+	}
+	read := func(path string) string {
+		raw, _ := ioutil.ReadFile(path)
+		return string(raw)
+	}
+	assert.Equal(t, "fourth\n", read(path))
+	assert.Equal(t, "third\n", read(path+".1"))
+	assert.Equal(t, "second\n", read(path+".2"))
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	// After logrotate moves it, writes carry on in the moved file until
+	// reopened
+	assert.NoError(t, os.Rename(path, path+".moved"))
+	f.Write([]byte("a\n"))
+	assert.NoError(t, f.Reopen())
+	f.Write([]byte("b\n"))
+	assert.Equal(t, "fourth\na\n", read(path+".moved"))
+	assert.Equal(t, "b\n", read(path))
+
+	// Backups that can't be replaced leave writes going to the same file
+	for _, backup := range []string{path + ".1", path + ".2"} {
+		assert.NoError(t, os.Remove(backup))
+		assert.NoError(t, os.MkdirAll(filepath.Join(backup, "blocked"), 0755))
+	}
+	_, err = f.Write([]byte("fifth line\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "b\nfifth line\n", read(path))
+}
+
+func TestBuffer(t *testing.T) {
+	b := NewBuffer(3)
+	tail := b.Since(0)
+	assert.Len(t, tail.Entries, 0)
+	assert.Equal(t, uint64(0), tail.Last)
+	wait := tail.Wait
+
+	now := time.Now()
+	b.Log(&log.Record{Time: now, Lvl: log.LvlInfo, Msg: "first",
+		Ctx: []interface{}{"height", 10, "err", errors.New("bad"), "odd"}})
+	select {
+	case <-wait:
+	default:
+		t.Fatal("Waiters weren't woken")
+	}
+	tail = b.Since(0)
+	assert.Equal(t, []Entry{{Seq: 1, Time: now, Lvl: log.LvlInfo, Msg: "first",
+		Ctx: []string{"height", "10", "err", "bad", "odd", ""}}}, tail.Entries)
+
+	for _, msg := range []string{"second", "third", "fourth", "fifth"} {
+		b.Log(&log.Record{Msg: msg})
+	}
+	tail = b.Since(1)
+	assert.Equal(t, uint64(5), tail.Last)
+	assert.Equal(t, uint64(1), tail.Missed)
+	assert.Len(t, tail.Entries, 3)
+	assert.Equal(t, uint64(3), tail.Entries[0].Seq)
+	assert.Equal(t, "fifth", tail.Entries[2].Msg)
+
+	tail = b.Since(4)
+	assert.Equal(t, uint64(0), tail.Missed)
+	assert.Len(t, tail.Entries, 1)
+	assert.Len(t, b.Since(5).Entries, 0)
+	// Asking from beyond the end, ie after a restart, gets what's new
+	assert.Len(t, b.Since(50).Entries, 0)
+}
@@ -0,0 +1,95 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// A log file that rotates itself once it passes maxSize bytes, and can be
+// reopened at the same path after logrotate moves it away
+type RotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+	mtx        sync.Mutex
+}
+
+// A maxSize of 0 never rotates
+func OpenRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	f := &RotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	return f, f.Reopen()
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *RotatingFile) backup(i int) string {
+	return fmt.Sprintf("%s.%d", f.path, i)
+}
+
+// Shifts each backup up one, dropping the oldest, and starts a new file. If
+// the file can't be moved aside it's reopened, so logging carries on in it
+// rather than in a closed file, and rotation is tried again once another
+// maxSize has been written
+func (f *RotatingFile) rotate() error {
+	f.file.Close()
+	var err error
+	if f.maxBackups > 0 {
+		os.Remove(f.backup(f.maxBackups))
+		for i := f.maxBackups - 1; i > 0; i-- {
+			os.Rename(f.backup(i), f.backup(i+1))
+		}
+		err = os.Rename(f.path, f.backup(1))
+	} else {
+		err = os.Remove(f.path)
+	}
+	if openErr := f.open(); openErr != nil {
+		return openErr
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to rotate %s: %s\n", f.path, err)
+		f.size = 0
+	}
+	return nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *RotatingFile) Reopen() error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	old := f.file
+	if err := f.open(); err != nil {
+		return err
+	}
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+package migrate
+
+// bindata.go is generated from sql/migrations by buildall.sh and the
+// goreleaser before hook, so the migrations ship inside every binary that
+// imports this package
+
+// The migrations compiled into this binary
+func Embedded() ([]*Migration, error) {
+	files := map[string][]byte{}
+	for _, name := range AssetNames() {
+		data, err := Asset(name)
+		if err != nil {
+			return nil, err
+		}
+		files[name] = data
+	}
+	return Parse(files)
+}
@@ -0,0 +1,298 @@
+package migrate
+
+import (
+	"database/sql"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// Migrations live in sql/migrations as pairs of files named like
+// 0002_add_worker_index.up.sql and 0002_add_worker_index.down.sql. Versions
+// must be unique and are applied in order. A migration without a down file
+// can't be rolled back
+var fileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Builds the ordered list of migrations from file names and their contents
+func Parse(files map[string][]byte) ([]*Migration, error) {
+	byVersion := map[int]*Migration{}
+	for name, contents := range files {
+		parts := fileName.FindStringSubmatch(name)
+		if parts == nil {
+			return nil, errors.Errorf("Invalid migration file name %s", name)
+		}
+		version, err := strconv.Atoi(parts[1])
+		if err != nil || version <= 0 {
+			return nil, errors.Errorf("Invalid migration version in %s", name)
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: parts[2]}
+			byVersion[version] = m
+		} else if m.Name != parts[2] {
+			return nil, errors.Errorf("Migration version %d used by both %s and %s",
+				version, m.Name, parts[2])
+		}
+		if parts[3] == "up" {
+			m.Up = string(contents)
+		} else {
+			m.Down = string(contents)
+		}
+	}
+	migrations := []*Migration{}
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, errors.Errorf("Migration %d_%s has no up file", m.Version, m.Name)
+		}
+		migrations = append(migrations, m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// The migrations to apply, in order, to get to target. A target of 0 means
+// the latest
+func pending(migrations []*Migration, applied map[int]time.Time, target int) []*Migration {
+	ret := []*Migration{}
+	for _, m := range migrations {
+		if target > 0 && m.Version > target {
+			break
+		}
+		if _, ok := applied[m.Version]; !ok {
+			ret = append(ret, m)
+		}
+	}
+	return ret
+}
+
+// The most recently applied migrations to undo, newest first
+func rollbackPlan(migrations []*Migration, applied map[int]time.Time, steps int) ([]*Migration, error) {
+	known := map[int]*Migration{}
+	for _, m := range migrations {
+		known[m.Version] = m
+	}
+	versions := []int{}
+	for version := range applied {
+		versions = append(versions, version)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+	if steps > len(versions) {
+		steps = len(versions)
+	}
+	ret := []*Migration{}
+	for _, version := range versions[:steps] {
+		m, ok := known[version]
+		if !ok {
+			return nil, errors.Errorf(
+				"Migration %d is applied but unknown to this version", version)
+		}
+		if m.Down == "" {
+			return nil, errors.Errorf("Migration %d_%s can't be rolled back", m.Version, m.Name)
+		}
+		ret = append(ret, m)
+	}
+	return ret, nil
+}
+
+type Status struct {
+	*Migration
+	// Nil if it hasn't been applied
+	AppliedAt *time.Time
+}
+
+// Applies and rolls back migrations, tracking which have been applied in the
+// schema_migrations table
+type Migrator struct {
+	db         *sqlx.DB
+	migrations []*Migration
+}
+
+func NewMigrator(db *sqlx.DB, migrations []*Migration) *Migrator {
+	return &Migrator{db: db, migrations: migrations}
+}
+
+const createMigrationsTable = `CREATE TABLE IF NOT EXISTS schema_migrations
+(
+    version integer PRIMARY KEY,
+    name varchar NOT NULL,
+    applied_at timestamp with time zone NOT NULL DEFAULT now()
+)`
+
+func (m *Migrator) applied() (map[int]time.Time, error) {
+	_, err := m.db.Exec(createMigrationsTable)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create schema_migrations")
+	}
+	type row struct {
+		Version   int
+		AppliedAt time.Time `db:"applied_at"`
+	}
+	var rows []row
+	err = m.db.Select(&rows, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	ret := map[int]time.Time{}
+	for _, r := range rows {
+		ret[r.Version] = r.AppliedAt
+	}
+	return ret, nil
+}
+
+func (m *Migrator) Status() ([]Status, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	ret := []Status{}
+	for _, migration := range m.migrations {
+		status := Status{Migration: migration}
+		if at, ok := applied[migration.Version]; ok {
+			status.AppliedAt = &at
+		}
+		ret = append(ret, status)
+	}
+	return ret, nil
+}
+
+// Migrations that haven't been applied yet, for warning about a database
+// that's behind the binary
+func (m *Migrator) Pending() ([]*Migration, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	return pending(m.migrations, applied, 0), nil
+}
+
+// Applies migrations up to target, or all of them if target is 0. Each
+// migration gets its own transaction, so a failure leaves the ones before it
+// applied
+func (m *Migrator) Up(target int) ([]*Migration, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	if len(applied) == 0 {
+		if err := m.checkUntracked(); err != nil {
+			return nil, err
+		}
+	}
+	todo := pending(m.migrations, applied, target)
+	for i, migration := range todo {
+		err := m.run(migration, true)
+		if err != nil {
+			return todo[:i], err
+		}
+	}
+	return todo, nil
+}
+
+// Rolls back the last steps applied migrations, newest first
+func (m *Migrator) Down(steps int) ([]*Migration, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	todo, err := rollbackPlan(m.migrations, applied, steps)
+	if err != nil {
+		return nil, err
+	}
+	for i, migration := range todo {
+		err := m.run(migration, false)
+		if err != nil {
+			return todo[:i], err
+		}
+	}
+	return todo, nil
+}
+
+// Marks migrations up to version as applied without running them, for a
+// database provisioned before migrations were tracked
+func (m *Migrator) Baseline(version int) error {
+	_, err := m.applied()
+	if err != nil {
+		return err
+	}
+	for _, migration := range m.migrations {
+		if migration.Version > version {
+			break
+		}
+		_, err := m.db.Exec(`INSERT INTO schema_migrations (version, name)
+			VALUES ($1, $2) ON CONFLICT DO NOTHING`, migration.Version, migration.Name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A database provisioned from tables.sql has the schema but no record of it,
+// and running the initial migration over it would fail part way
+func (m *Migrator) checkUntracked() error {
+	var exists bool
+	err := m.db.Get(&exists, `SELECT to_regclass('share') IS NOT NULL`)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errors.New("Database has tables but no migration history, " +
+			"baseline it to the version it's at first")
+	}
+	return nil
+}
+
+func (m *Migrator) run(migration *Migration, up bool) error {
+	tx, err := m.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// Serializes migrators, so two deploys can't apply the same migration
+	_, err = tx.Exec(`LOCK TABLE schema_migrations IN EXCLUSIVE MODE`)
+	if err != nil {
+		return err
+	}
+	var count int
+	err = tx.Get(&count, `SELECT COUNT(*) FROM schema_migrations WHERE version = $1`,
+		migration.Version)
+	if err != nil {
+		return err
+	}
+	if up && count > 0 || !up && count == 0 {
+		// Someone else got here first
+		return tx.Commit()
+	}
+
+	body := migration.Up
+	if !up {
+		body = migration.Down
+	}
+	_, err = tx.Exec(body)
+	if err != nil {
+		return errors.Wrapf(err, "Migration %d_%s failed", migration.Version, migration.Name)
+	}
+	if up {
+		_, err = tx.Exec(`INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`,
+			migration.Version, migration.Name)
+	} else {
+		_, err = tx.Exec(`DELETE FROM schema_migrations WHERE version = $1`, migration.Version)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
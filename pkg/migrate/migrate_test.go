@@ -0,0 +1,66 @@
+package migrate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testFiles = map[string][]byte{
+	"0002_add_index.up.sql":   []byte("CREATE INDEX"),
+	"0002_add_index.down.sql": []byte("DROP INDEX"),
+	"0001_initial.up.sql":     []byte("CREATE TABLE"),
+	"0001_initial.down.sql":   []byte("DROP TABLE"),
+	"0010_backfill.up.sql":    []byte("UPDATE"),
+}
+
+func TestParse(t *testing.T) {
+	migrations, err := Parse(testFiles)
+	assert.NoError(t, err)
+	assert.Len(t, migrations, 3)
+	assert.Equal(t, 1, migrations[0].Version)
+	assert.Equal(t, "initial", migrations[0].Name)
+	assert.Equal(t, "DROP TABLE", migrations[0].Down)
+	assert.Equal(t, 10, migrations[2].Version)
+	assert.Equal(t, "", migrations[2].Down)
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, files := range []map[string][]byte{
+		{"initial.up.sql": nil},
+		{"0001_initial.sql": nil},
+		{"0001_initial.down.sql": []byte("DROP TABLE")},
+		{"0001_initial.up.sql": []byte("a"), "0001_other.up.sql": []byte("b")},
+	} {
+		_, err := Parse(files)
+		assert.Error(t, err)
+	}
+}
+
+func TestPending(t *testing.T) {
+	migrations, _ := Parse(testFiles)
+	applied := map[int]time.Time{1: time.Now()}
+	todo := pending(migrations, applied, 0)
+	assert.Len(t, todo, 2)
+	assert.Equal(t, 2, todo[0].Version)
+
+	todo = pending(migrations, applied, 2)
+	assert.Len(t, todo, 1)
+	assert.Empty(t, pending(migrations, applied, 1))
+}
+
+func TestRollbackPlan(t *testing.T) {
+	migrations, _ := Parse(testFiles)
+	now := time.Now()
+
+	plan, err := rollbackPlan(migrations, map[int]time.Time{1: now, 2: now}, 5)
+	assert.NoError(t, err)
+	assert.Len(t, plan, 2)
+	assert.Equal(t, 2, plan[0].Version)
+
+	_, err = rollbackPlan(migrations, map[int]time.Time{1: now, 10: now}, 1)
+	assert.Error(t, err, "no down migration")
+	_, err = rollbackPlan(migrations, map[int]time.Time{1: now, 11: now}, 1)
+	assert.Error(t, err, "unknown migration")
+}
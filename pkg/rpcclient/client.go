@@ -0,0 +1,213 @@
+package rpcclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A bitcoind style JSON-RPC 1.0 client, shared by every service that talks to
+// a coinserver, either directly or through coinbuddy's /rpc proxy.
+// Connections are kept alive and reused between requests, and requests that
+// fail before the coinserver could answer them are retried with jittered
+// backoff. Errors returned by the coinserver itself are never retried
+type Config struct {
+	// ie http://localhost:19332/ or http://127.0.0.1:6080/rpc
+	URL  string
+	User string
+	Pass string
+	// For each attempt, not the request as a whole
+	Timeout time.Duration
+	// Additional attempts after the first fails. Negative for none
+	Retries int
+	// Delay before the first retry, doubling for each after. The actual delay
+	// is randomized between half and one and a half times this
+	RetryBackoff time.Duration
+	// Idle connections kept open to the coinserver
+	MaxIdleConns int
+	// Reaches the coinserver through a SOCKS5 or HTTP CONNECT proxy, from
+	// ParseProxy. Nil uses the environment's HTTP_PROXY like net/http
+	Proxy *url.URL
+}
+
+const (
+	DefaultTimeout      = time.Second * 30
+	DefaultRetries      = 2
+	DefaultRetryBackoff = time.Millisecond * 250
+	DefaultMaxIdleConns = 4
+)
+
+// An error response from the coinserver
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("%d: %s", e.Code, e.Message)
+}
+
+type Client struct {
+	config Config
+	http   *http.Client
+	nextID uint64
+}
+
+func New(config Config) *Client {
+	if config.Timeout == 0 {
+		config.Timeout = DefaultTimeout
+	}
+	if config.RetryBackoff == 0 {
+		config.RetryBackoff = DefaultRetryBackoff
+	}
+	if config.MaxIdleConns == 0 {
+		config.MaxIdleConns = DefaultMaxIdleConns
+	}
+	if config.Retries == 0 {
+		config.Retries = DefaultRetries
+	} else if config.Retries < 0 {
+		config.Retries = 0
+	}
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   config.Timeout,
+			KeepAlive: time.Second * 30,
+		}).DialContext,
+		MaxIdleConns:        config.MaxIdleConns,
+		MaxIdleConnsPerHost: config.MaxIdleConns,
+		IdleConnTimeout:     time.Second * 90,
+	}
+	if config.Proxy != nil {
+		useProxy(transport, config.Proxy)
+	}
+	return &Client{
+		config: config,
+		http:   &http.Client{Transport: transport, Timeout: config.Timeout},
+	}
+}
+
+type request struct {
+	JSONRPC string            `json:"jsonrpc"`
+	ID      uint64            `json:"id"`
+	Method  string            `json:"method"`
+	Params  []json.RawMessage `json:"params"`
+}
+
+type response struct {
+	Result json.RawMessage `json:"result"`
+	Error  *RPCError       `json:"error"`
+}
+
+// Runs a request, retrying if it couldn't be delivered or the coinserver was
+// too busy to answer. Only for requests that are safe to run twice
+func (c *Client) RawRequest(method string, params []json.RawMessage) (json.RawMessage, error) {
+	var (
+		res   json.RawMessage
+		err   error
+		retry bool
+	)
+	for attempt := 0; attempt <= c.config.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff(c.config.RetryBackoff, attempt))
+		}
+		res, retry, err = c.do(method, params)
+		if err == nil || !retry {
+			return res, err
+		}
+	}
+	return nil, errors.Wrapf(err, "%s failed after %d attempts", method, c.config.Retries+1)
+}
+
+// Runs a request exactly once, for those that mustn't be repeated or where
+// the caller has its own caller to report to (a proxy)
+func (c *Client) RawRequestOnce(method string, params []json.RawMessage) (json.RawMessage, error) {
+	res, _, err := c.do(method, params)
+	return res, err
+}
+
+// Marshals params, runs the request with retries and unmarshals the result
+// into result, if it's not nil
+func (c *Client) Call(result interface{}, method string, params ...interface{}) error {
+	rawParams := make([]json.RawMessage, len(params))
+	for i, param := range params {
+		raw, err := json.Marshal(param)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to marshal %s param %d", method, i)
+		}
+		rawParams[i] = raw
+	}
+	res, err := c.RawRequest(method, rawParams)
+	if err != nil || result == nil {
+		return err
+	}
+	err = json.Unmarshal(res, result)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid %s result", method)
+	}
+	return nil
+}
+
+// Returns whether a failed request is worth retrying along with the error
+func (c *Client) do(method string, params []json.RawMessage) (json.RawMessage, bool, error) {
+	if params == nil {
+		params = []json.RawMessage{}
+	}
+	body, err := json.Marshal(&request{
+		JSONRPC: "1.0",
+		ID:      atomic.AddUint64(&c.nextID, 1),
+		Method:  method,
+		Params:  params,
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	req, err := http.NewRequest("POST", c.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.config.User != "" || c.config.Pass != "" {
+		req.SetBasicAuth(c.config.User, c.config.Pass)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+	// The body must be read to the end for the connection to be reused
+	raw, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, true, err
+	}
+
+	// bitcoind answers RPC errors with a 500 or 404 and a JSON body, so the
+	// body is checked before the status
+	var decoded response
+	if json.Unmarshal(raw, &decoded) == nil && (decoded.Error != nil || resp.StatusCode == 200) {
+		if decoded.Error != nil {
+			return nil, false, decoded.Error
+		}
+		return decoded.Result, false, nil
+	}
+	err = errors.Errorf("%s returned HTTP %d: %s", method, resp.StatusCode,
+		bytes.TrimSpace(raw))
+	// 503 is bitcoind's full work queue
+	return nil, resp.StatusCode >= 500, err
+}
+
+// Exponential, randomized so clients that failed together don't retry
+// together
+func backoff(base time.Duration, attempt int) time.Duration {
+	delay := base << uint(attempt-1)
+	return delay/2 + time.Duration(rand.Int63n(int64(delay)+1))
+}
@@ -0,0 +1,145 @@
+package rpcclient
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A coinserver that fails the first failures requests with status, then
+// answers with result
+func testServer(failures int32, status int, result string) (*httptest.Server, *int32) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		ioutil.ReadAll(r.Body)
+		if n <= failures {
+			w.WriteHeader(status)
+			w.Write([]byte("Work queue depth exceeded"))
+			return
+		}
+		w.Write([]byte(`{"result":` + result + `,"error":null,"id":1}`))
+	}))
+	return server, &calls
+}
+
+func testClient(url string) *Client {
+	return New(Config{URL: url, RetryBackoff: time.Millisecond})
+}
+
+func TestRetry(t *testing.T) {
+	server, calls := testServer(2, 503, "100")
+	defer server.Close()
+	count, err := testClient(server.URL).GetBlockCount()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100), count)
+	assert.Equal(t, int32(3), atomic.LoadInt32(calls))
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	server, calls := testServer(10, 503, "100")
+	defer server.Close()
+	_, err := testClient(server.URL).GetBlockCount()
+	assert.Error(t, err)
+	assert.Equal(t, int32(DefaultRetries+1), atomic.LoadInt32(calls))
+}
+
+func TestNoRetryForClientErrors(t *testing.T) {
+	server, calls := testServer(10, 401, "100")
+	defer server.Close()
+	_, err := testClient(server.URL).GetBlockCount()
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(calls))
+}
+
+func TestRawRequestOnceNotRetried(t *testing.T) {
+	server, calls := testServer(1, 503, `"abcd"`)
+	defer server.Close()
+	_, err := testClient(server.URL).RawRequestOnce("getinfo", nil)
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(calls))
+}
+
+func TestRPCError(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		var req request
+		json.NewDecoder(r.Body).Decode(&req)
+		assert.Equal(t, "getblock", req.Method)
+		user, pass, _ := r.BasicAuth()
+		assert.Equal(t, "user", user)
+		assert.Equal(t, "pass", pass)
+		w.WriteHeader(500)
+		w.Write([]byte(`{"result":null,"error":{"code":-5,"message":"Block not found"},"id":1}`))
+	}))
+	defer server.Close()
+	client := New(Config{URL: server.URL, User: "user", Pass: "pass"})
+	_, err := client.GetBlock("00")
+	rpcErr, ok := err.(*RPCError)
+	assert.True(t, ok)
+	assert.Equal(t, -5, rpcErr.Code)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestSubmitBlock(t *testing.T) {
+	server, _ := testServer(0, 0, "null")
+	defer server.Close()
+	reason, err := testClient(server.URL).SubmitBlock([]byte{1})
+	assert.NoError(t, err)
+	assert.Equal(t, "", reason)
+
+	server, _ = testServer(0, 0, `"duplicate"`)
+	defer server.Close()
+	reason, err = testClient(server.URL).SubmitBlock([]byte{1})
+	assert.NoError(t, err)
+	assert.Equal(t, "duplicate", reason)
+}
+
+func TestSubmitAuxBlock(t *testing.T) {
+	server, _ := testServer(0, 0, "true")
+	defer server.Close()
+	reason, err := testClient(server.URL).SubmitAuxBlock("00", []byte{1})
+	assert.NoError(t, err)
+	assert.Equal(t, "", reason)
+
+	server, _ = testServer(0, 0, "false")
+	defer server.Close()
+	reason, err = testClient(server.URL).SubmitAuxBlock("00", []byte{1})
+	assert.NoError(t, err)
+	assert.Equal(t, "rejected", reason)
+}
+
+func TestListUnspent(t *testing.T) {
+	server, _ := testServer(0, 0, `[{"txid": "ab", "vout": 1, "address": "mx",
+		"amount": 12.5, "confirmations": 3, "spendable": false}]`)
+	defer server.Close()
+	outputs, err := testClient(server.URL).ListUnspent(0, 9999999, []string{"mx"})
+	assert.NoError(t, err)
+	assert.Equal(t, []UnspentOutput{{TxID: "ab", Vout: 1, Address: "mx",
+		Amount: 12.5, Confirmations: 3}}, outputs)
+}
+
+func TestEstimateSmartFee(t *testing.T) {
+	server, _ := testServer(0, 0, `{"feerate": 0.00012, "blocks": 6}`)
+	defer server.Close()
+	estimate, err := testClient(server.URL).EstimateSmartFee(6, "CONSERVATIVE")
+	assert.NoError(t, err)
+	assert.Equal(t, &FeeEstimate{FeeRate: 0.00012, Blocks: 6}, estimate)
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt := 1; attempt < 5; attempt++ {
+		delay := time.Second << uint(attempt-1)
+		for i := 0; i < 20; i++ {
+			d := backoff(time.Second, attempt)
+			assert.True(t, d >= delay/2 && d <= delay*3/2)
+		}
+	}
+}
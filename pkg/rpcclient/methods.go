@@ -0,0 +1,122 @@
+package rpcclient
+
+import (
+	"encoding/hex"
+	"encoding/json"
+)
+
+// Typed wrappers for the calls ngpool makes. Results only carry the fields we
+// use, coins disagree on the rest
+
+// Returned raw since templates are passed on to stratum as is. A nil request
+// sends no params at all, which older coins require
+func (c *Client) GetBlockTemplate(request map[string]interface{}) (json.RawMessage, error) {
+	if request == nil {
+		return c.RawRequest("getblocktemplate", nil)
+	}
+	var res json.RawMessage
+	err := c.Call(&res, "getblocktemplate", request)
+	return res, err
+}
+
+// Returns the coinserver's reason the block wasn't accepted, ie "duplicate"
+// or "inconclusive", or "" if it was. Retrying a submission is harmless, it
+// comes back as a duplicate
+func (c *Client) SubmitBlock(block []byte) (string, error) {
+	var reason *string
+	err := c.Call(&reason, "submitblock", hex.EncodeToString(block))
+	if err != nil || reason == nil {
+		return "", err
+	}
+	return *reason, nil
+}
+
+// Submits the AuxPoW for createauxblock work with the block's hash. Nodes
+// only say whether it was accepted, so a rejection's reason is "rejected"
+func (c *Client) SubmitAuxBlock(hash string, auxPoW []byte) (string, error) {
+	var accepted bool
+	err := c.Call(&accepted, "submitauxblock", hash, hex.EncodeToString(auxPoW))
+	if err != nil || accepted {
+		return "", err
+	}
+	return "rejected", nil
+}
+
+type Block struct {
+	Hash string `json:"hash"`
+	// -1 if the block isn't in the main chain
+	Confirmations int64  `json:"confirmations"`
+	Height        int64  `json:"height"`
+	Time          int64  `json:"time"`
+	PreviousHash  string `json:"previousblockhash"`
+	// Txids, the coinbase's first
+	Tx []string `json:"tx"`
+}
+
+func (c *Client) GetBlock(hash string) (*Block, error) {
+	var block Block
+	err := c.Call(&block, "getblock", hash)
+	if err != nil {
+		return nil, err
+	}
+	return &block, nil
+}
+
+func (c *Client) GetBlockCount() (int64, error) {
+	var count int64
+	err := c.Call(&count, "getblockcount")
+	return count, err
+}
+
+type ValidatedAddress struct {
+	IsValid      bool   `json:"isvalid"`
+	Address      string `json:"address"`
+	ScriptPubKey string `json:"scriptPubKey"`
+	IsMine       bool   `json:"ismine"`
+	// Set once the address is imported with importaddress
+	IsWatchOnly bool `json:"iswatchonly"`
+}
+
+func (c *Client) ValidateAddress(address string) (*ValidatedAddress, error) {
+	var res ValidatedAddress
+	err := c.Call(&res, "validateaddress", address)
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+type UnspentOutput struct {
+	TxID          string  `json:"txid"`
+	Vout          uint32  `json:"vout"`
+	Address       string  `json:"address"`
+	Amount        float64 `json:"amount"`
+	Confirmations int64   `json:"confirmations"`
+}
+
+// Outputs the wallet knows of paying addresses, including watch-only ones.
+// Immature coinbases aren't listed until they can be spent
+func (c *Client) ListUnspent(minConf int, maxConf int, addresses []string) ([]UnspentOutput, error) {
+	var res []UnspentOutput
+	err := c.Call(&res, "listunspent", minConf, maxConf, addresses)
+	return res, err
+}
+
+type FeeEstimate struct {
+	// In whole coins per kB. Zero when the node has no estimate, with the
+	// reason in Errors
+	FeeRate float64  `json:"feerate"`
+	Errors  []string `json:"errors"`
+	Blocks  int      `json:"blocks"`
+}
+
+// The fee rate the node expects to confirm within confTarget blocks. mode is
+// "ECONOMICAL" or "CONSERVATIVE"
+func (c *Client) EstimateSmartFee(confTarget int, mode string) (*FeeEstimate, error) {
+	var res FeeEstimate
+	err := c.Call(&res, "estimatesmartfee", confTarget, mode)
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
@@ -0,0 +1,80 @@
+package rpcclient
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// An HTTP proxy that only speaks CONNECT, recording where it was asked to go
+func testConnectProxy(t *testing.T) (net.Listener, chan *http.Request) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	reqs := make(chan *http.Request, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				req, err := http.ReadRequest(reader)
+				if err != nil {
+					return
+				}
+				reqs <- req
+				if req.Method != "CONNECT" {
+					conn.Write([]byte("HTTP/1.1 405 Method Not Allowed\r\n\r\n"))
+					return
+				}
+				upstream, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+					return
+				}
+				defer upstream.Close()
+				conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+				go io.Copy(upstream, reader)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return l, reqs
+}
+
+func TestConnectProxy(t *testing.T) {
+	server, calls := testServer(0, 0, "100")
+	defer server.Close()
+	l, reqs := testConnectProxy(t)
+	defer l.Close()
+
+	proxy, err := ParseProxy("http://user:pass@" + l.Addr().String())
+	assert.NoError(t, err)
+	client := New(Config{URL: server.URL, Proxy: proxy})
+	count, err := client.GetBlockCount()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100), count)
+	assert.Equal(t, int32(1), atomic.LoadInt32(calls))
+
+	req := <-reqs
+	assert.Equal(t, "CONNECT", req.Method)
+	assert.Equal(t, server.Listener.Addr().String(), req.Host)
+	assert.Equal(t, "Basic dXNlcjpwYXNz", req.Header.Get("Proxy-Authorization"))
+}
+
+func TestParseProxy(t *testing.T) {
+	proxy, err := ParseProxy("socks5://127.0.0.1:9050")
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:9050", proxy.Host)
+	_, err = ParseProxy("ftp://127.0.0.1:21")
+	assert.Error(t, err)
+	_, err = ParseProxy("socks5://")
+	assert.Error(t, err)
+}
@@ -3,10 +3,14 @@ package service
 import (
 	"encoding/json"
 	"math/big"
+	"strings"
 
 	"github.com/bitgoin/lyra2rev2"
 	"github.com/icook/powalgo-go"
+	log "github.com/inconshreveable/log15"
 	"github.com/majestrate/cryptonight"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
 	// "github.com/sammy007/go-equihash"
 	"github.com/seehuhn/sha256d"
 	"golang.org/x/crypto/scrypt"
@@ -30,9 +34,14 @@ func sha256dHash(input []byte) ([]byte, error) {
 }
 
 type Algo struct {
-	Name           string
-	PoWHash        HashFunc
-	ShareDiff1     *big.Float
+	Name    string
+	PoWHash HashFunc
+	// The target of a difficulty 1 share. Miners (and other pools) expect a
+	// particular one for each algo, ie scrypt shares are 65536 times easier
+	// than sha256d shares of the same difficulty
+	ShareDiff1 *big.Float
+	// The target of a difficulty 1 block, which is what the coin daemon's
+	// getdifficulty is relative to
 	NetDiff1       float64
 	HashesPerShare int64
 }
@@ -52,25 +61,72 @@ func (u *Algo) MarshalJSON() ([]byte, error) {
 	})
 }
 
+// The share target for a stratum difficulty. A hash meets it if it's less
+// than or equal to it, when read as a little endian number like block hashes
+func (a *Algo) ShareTarget(difficulty float64) *big.Int {
+	target := new(big.Float).Set(a.ShareDiff1)
+	if difficulty > 0 {
+		target.Quo(target, big.NewFloat(difficulty))
+	}
+	ret, _ := target.Int(nil)
+	return ret
+}
+
+// The stratum difficulty of a target, the reverse of ShareTarget
+func (a *Algo) ShareDifficulty(target *big.Int) float64 {
+	if target.Sign() <= 0 {
+		return 0
+	}
+	diff := new(big.Float).Set(a.ShareDiff1)
+	diff.Quo(diff, new(big.Float).SetInt(target))
+	ret, _ := diff.Float64()
+	return ret
+}
+
+// The difficulty of a block target as the coin daemon displays it
+func (a *Algo) NetDifficulty(blockTarget float64) float64 {
+	return a.NetDiff1 / blockTarget
+}
+
+// The block target for a network difficulty, the reverse of NetDifficulty
+func (a *Algo) NetTarget(difficulty float64) float64 {
+	return a.NetDiff1 / difficulty
+}
+
 func (a *Algo) Diff1SharesForTarget(blockTarget float64) (float64, big.Accuracy) {
 	blockTargetBig := big.NewFloat(blockTarget)
 	diff1 := new(big.Float).Set(a.ShareDiff1)
 	return diff1.Quo(diff1, blockTargetBig).Float64()
 }
 
-func NewAlgoConfig(name string, diff1Hex string, powFunc HashFunc, hps int64) *Algo {
-	diff1 := big.Float{}
+func parseDiff1(diff1Hex string) (*big.Float, error) {
+	diff1 := new(big.Float)
 	_, _, err := diff1.Parse(diff1Hex, 16)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	if diff1.Sign() <= 0 {
+		return nil, errors.Errorf("diff1 target %s must be positive", diff1Hex)
 	}
+	return diff1, nil
+}
 
-	shareDiff1, _ := diff1.Float64()
+func NewAlgoConfig(name string, shareDiff1Hex string, netDiff1Hex string,
+	powFunc HashFunc, hps int64) *Algo {
+	shareDiff1, err := parseDiff1(shareDiff1Hex)
+	if err != nil {
+		panic(err)
+	}
+	netDiff1, err := parseDiff1(netDiff1Hex)
+	if err != nil {
+		panic(err)
+	}
+	netDiff1Float, _ := netDiff1.Float64()
 
 	ac := &Algo{
 		Name:           name,
-		ShareDiff1:     &diff1,
-		NetDiff1:       shareDiff1 / (0xFFFF - 1),
+		ShareDiff1:     shareDiff1,
+		NetDiff1:       netDiff1Float,
 		PoWHash:        powFunc,
 		HashesPerShare: hps,
 	}
@@ -80,46 +136,94 @@ func NewAlgoConfig(name string, diff1Hex string, powFunc HashFunc, hps int64) *A
 
 var AlgoConfig = map[string]*Algo{}
 
+// Overrides an algo's diff1 targets, for coins or miners that count
+// difficulty differently. Both are hex, like the defaults in init
+type AlgoDiff1Decoder struct {
+	ShareDiff1 string
+	NetDiff1   string
+}
+
+// Applies the "Algos" section of the common config, keyed by algo name
+func SetupAlgos(rawConfig map[string]interface{}) {
+	for name, raw := range rawConfig {
+		algo, ok := AlgoConfig[strings.ToLower(name)]
+		if !ok {
+			panic("Unknown algo " + name)
+		}
+		var config AlgoDiff1Decoder
+		err := mapstructure.Decode(raw, &config)
+		if err != nil {
+			panic(err)
+		}
+		if config.ShareDiff1 != "" {
+			algo.ShareDiff1, err = parseDiff1(config.ShareDiff1)
+			if err != nil {
+				panic(err)
+			}
+		}
+		if config.NetDiff1 != "" {
+			netDiff1, err := parseDiff1(config.NetDiff1)
+			if err != nil {
+				panic(err)
+			}
+			algo.NetDiff1, _ = netDiff1.Float64()
+		}
+		log.Info("Configured algo diff1", "algo", algo.Name,
+			"share_diff1", algo.ShareDiff1.Text('g', 10), "net_diff1", algo.NetDiff1)
+	}
+}
+
+// Bitcoin's difficulty 1 target, which getdifficulty is relative to for
+// bitcoin derived daemons whatever their algo
+const bitcoinDiff1 = "00000000ffff0000000000000000000000000000000000000000000000000000"
+
 func init() {
 	NewAlgoConfig(
 		"scrypt",
 		"0000ffff00000000000000000000000000000000000000000000000000000000",
+		bitcoinDiff1,
 		scryptHash,
 		0xFFFF,
 	)
 	NewAlgoConfig(
 		"sha256d",
 		"00000000FFFF0000000000000000000000000000000000000000000000000000",
+		bitcoinDiff1,
 		sha256dHash,
 		0xFFFFFFFF,
 	)
 	NewAlgoConfig(
 		"lyra2rev2",
 		"0000ffff00000000000000000000000000000000000000000000000000000000",
+		bitcoinDiff1,
 		lyra2rev2.Sum,
 		0xFFFFFFFF,
 	)
 	NewAlgoConfig(
 		"x17",
 		"0000ffff00000000000000000000000000000000000000000000000000000000",
+		bitcoinDiff1,
 		powalgo.X17hash,
 		0xFFFF,
 	)
 	NewAlgoConfig(
 		"argon2",
 		"0000ffff00000000000000000000000000000000000000000000000000000000",
+		bitcoinDiff1,
 		powalgo.Argon2Hash,
 		0xFFFF,
 	)
 	// NewAlgoConfig(
 	// 	"equihash",
 	// 	"0000ffff00000000000000000000000000000000000000000000000000000000",
+	// 	bitcoinDiff1,
 	// 	equihash.Verify,
 	// 	0xFFFF,
 	// )
 	NewAlgoConfig(
 		"cryptonight",
 		"0000ffff00000000000000000000000000000000000000000000000000000000",
+		bitcoinDiff1,
 		cryptonightHash,
 		0xFFFF,
 	)
@@ -2,6 +2,8 @@ package service
 
 import (
 	"encoding/hex"
+	"math/big"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -52,3 +54,51 @@ func TestArgon2(t *testing.T) {
 	// 00004186e967f1f34ef97290ff354ad014fbf3188fd8ba220506b755f6be8201 from explorer (rpc byte order)
 	assert.Equal(t, "0182bef655b7060522bad88f18f3fb14d04a35ff9072f94ef3f167e986410000", hshHex)
 }
+
+func TestShareTarget(t *testing.T) {
+	scrypt := AlgoConfig["scrypt"]
+	sha256d := AlgoConfig["sha256d"]
+	assert.Equal(t, "ffff"+strings.Repeat("0", 56), scrypt.ShareTarget(1).Text(16))
+	// Scrypt difficulty is 65536 times easier
+	assert.Equal(t, sha256d.ShareTarget(1), scrypt.ShareTarget(65536))
+	assert.Equal(t, 1024.0, scrypt.ShareDifficulty(scrypt.ShareTarget(1024)))
+	assert.Equal(t, 0.0, scrypt.ShareDifficulty(new(big.Int)))
+
+	// A hash just under the target meets it, one just over doesn't
+	target := scrypt.ShareTarget(16)
+	assert.True(t, new(big.Int).Sub(target, big.NewInt(1)).Cmp(target) <= 0)
+	assert.True(t, new(big.Int).Add(target, big.NewInt(1)).Cmp(target) > 0)
+}
+
+func TestNetDifficulty(t *testing.T) {
+	// Bits 1d00ffff, bitcoin's genesis block, is difficulty 1 for any algo
+	genesis, _ := new(big.Float).SetInt(
+		new(big.Int).Lsh(big.NewInt(0xffff), 208)).Float64()
+	for _, name := range []string{"scrypt", "sha256d"} {
+		algo := AlgoConfig[name]
+		assert.InEpsilon(t, 1.0, algo.NetDifficulty(genesis), 1e-9)
+		assert.InEpsilon(t, genesis/8, algo.NetTarget(8), 1e-9)
+	}
+}
+
+func TestSetupAlgos(t *testing.T) {
+	algo := AlgoConfig["x17"]
+	defer func(share *big.Float, net float64) {
+		algo.ShareDiff1, algo.NetDiff1 = share, net
+	}(algo.ShareDiff1, algo.NetDiff1)
+
+	SetupAlgos(map[string]interface{}{
+		"X17": map[string]interface{}{
+			"ShareDiff1": "000000ffff000000000000000000000000000000000000000000000000000000",
+		},
+	})
+	assert.Equal(t, "ffff"+strings.Repeat("0", 54), algo.ShareTarget(1).Text(16))
+	assert.Equal(t, AlgoConfig["sha256d"].NetDiff1, algo.NetDiff1)
+
+	assert.Panics(t, func() {
+		SetupAlgos(map[string]interface{}{"nope": map[string]interface{}{}})
+	})
+	assert.Panics(t, func() {
+		SetupAlgos(map[string]interface{}{"x17": map[string]interface{}{"NetDiff1": "zz"}})
+	})
+}
@@ -0,0 +1,163 @@
+package service
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Which backend services read their config from, publish status to and
+// discover each other through: etcd (the default), consul or static. It's
+// picked from the environment since the rest of our config lives in it
+const (
+	DiscoveryEnv = "NGPOOL_DISCOVERY"
+	// etcd endpoints separated by commas, the consul agent's address or the
+	// static config directory
+	DiscoveryAddrEnv = "NGPOOL_DISCOVERY_ADDR"
+	// Domain static looks up SRV records under
+	DiscoveryDomainEnv = "NGPOOL_DISCOVERY_DOMAIN"
+)
+
+var (
+	// A config key that isn't set, as opposed to a backend we can't reach
+	ErrKeyNotFound = errors.New("Key not found")
+	// The backend has nowhere for control commands to be sent
+	ErrNoControl = errors.New("Control commands not supported")
+	// The backend can't hold a key for one service, see Claimer
+	ErrNoClaims = errors.New("Claims not supported")
+)
+
+// Where a service's config, status and control commands live. Keys are
+// written like etcd's, ie /config/common, and backends that support
+// deployments put them under the deployment's root
+type Backend interface {
+	// A key's value, ErrKeyNotFound if it isn't set
+	Get(key string) (string, error)
+	// The values of the keys under prefix by name, the last part of their
+	// key, and an index to wait on. With a non zero index it first blocks
+	// until they may have changed since
+	List(prefix string, index uint64) (map[string]string, uint64, error)
+	// The services currently in namespace by ID, and an index to watch for
+	// changes after
+	Services(namespace string) (map[string]*ServiceStatus, uint64, error)
+	// Changes to namespace's services after index, when they were known.
+	// Once Next errors the watch is finished, and the caller starts over
+	// from Services
+	WatchServices(namespace string, known map[string]*ServiceStatus, index uint64) ServiceWatch
+	// Publishes serviceID's status, which lapses if it isn't written again
+	// within ttl. With refresh value is the same as the last successful
+	// write, and only the ttl needs extending
+	SetStatus(namespace string, serviceID string, value string, ttl time.Duration, refresh bool) error
+	// Commands written to serviceID's control key after the watch started,
+	// or ErrNoControl
+	WatchControl(namespace string, serviceID string) (ControlWatch, error)
+}
+
+// Backends that can hold a key for one service at a time, so services can
+// split something between themselves. Only etcd is one
+type Claimer interface {
+	// Takes key for owner until ttl passes without it being claimed again.
+	// false if someone else holds it, claiming a key owner already holds
+	// extends it
+	Claim(key string, owner string, ttl time.Duration) (bool, error)
+	// Gives up key if owner holds it
+	Release(key string, owner string) error
+}
+
+type ServiceWatch interface {
+	// Blocks until a service changes, returning its new status, or nil if
+	// it's gone
+	Next() (string, *ServiceStatus, error)
+}
+
+type ControlWatch interface {
+	// Blocks until the control key is written, returning its value and an
+	// index to write the result against
+	Next() (string, uint64, error)
+	// Writes a command's result back, unless the key was written again
+	// since index
+	Result(value string, index uint64) error
+}
+
+// Picks the backend from DiscoveryEnv. etcdEndpoints are used when etcd
+// is picked without DiscoveryAddrEnv
+func BackendFromEnv(etcdEndpoints []string, deployment string) (Backend, error) {
+	addr := os.Getenv(DiscoveryAddrEnv)
+	switch kind := os.Getenv(DiscoveryEnv); kind {
+	case "", "etcd":
+		if addr != "" {
+			etcdEndpoints = strings.Split(addr, ",")
+		}
+		return NewEtcdBackend(etcdEndpoints, deployment)
+	case "consul":
+		if addr == "" {
+			addr = "http://127.0.0.1:8500"
+		}
+		return NewConsulBackend(addr, deployment), nil
+	case "static":
+		if addr == "" {
+			addr = "/etc/ngpool"
+		}
+		domain := os.Getenv(DiscoveryDomainEnv)
+		if domain == "" {
+			return nil, errors.Errorf("%s is required for static discovery", DiscoveryDomainEnv)
+		}
+		return NewStaticBackend(addr, domain), nil
+	default:
+		return nil, errors.Errorf("Unknown discovery backend %q, use etcd, consul or static", kind)
+	}
+}
+
+type serviceChange struct {
+	serviceID string
+	status    *ServiceStatus
+}
+
+// A ServiceWatch for backends that can only list services. Each fetch is
+// compared with the last, and services whose status didn't change are
+// skipped
+type pollWatch struct {
+	namespace string
+	// Blocks until the services may have changed since index
+	fetch   func(index uint64) (map[string]*ServiceStatus, uint64, error)
+	index   uint64
+	known   map[string]*ServiceStatus
+	pending []serviceChange
+}
+
+func newPollWatch(namespace string, known map[string]*ServiceStatus, index uint64,
+	fetch func(uint64) (map[string]*ServiceStatus, uint64, error)) *pollWatch {
+	copied := map[string]*ServiceStatus{}
+	for id, status := range known {
+		copied[id] = status
+	}
+	return &pollWatch{namespace: namespace, fetch: fetch, index: index, known: copied}
+}
+
+func (w *pollWatch) Next() (string, *ServiceStatus, error) {
+	for len(w.pending) == 0 {
+		current, index, err := w.fetch(w.index)
+		if err != nil {
+			return "", nil, err
+		}
+		w.index = index
+		for _, update := range diffServices(w.namespace, w.known, current) {
+			switch {
+			case update.Action == "removed":
+				w.pending = append(w.pending, serviceChange{update.ServiceID, nil})
+			case update.Action == "added" || !reflect.DeepEqual(w.known[update.ServiceID], update.Status):
+				w.pending = append(w.pending, serviceChange{update.ServiceID, update.Status})
+			}
+		}
+		w.known = current
+		if w.known == nil {
+			w.known = map[string]*ServiceStatus{}
+		}
+	}
+	change := w.pending[0]
+	w.pending = w.pending[1:]
+	return change.serviceID, change.status, nil
+}
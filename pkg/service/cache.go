@@ -0,0 +1,100 @@
+package service
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Where the last config and services read from etcd are kept, so a service
+// can start, and keep finding the others, while etcd is unreachable.
+// Defaults to ~/.ngpool/cache
+const CacheDirEnv = "NGPOOL_CACHE_DIR"
+
+func CacheDirFromEnv() string {
+	if dir := os.Getenv(CacheDirEnv); dir != "" {
+		return dir
+	}
+	return filepath.Join(os.Getenv("HOME"), ".ngpool", "cache")
+}
+
+// DiskCache stores JSON values by etcd key, one file each. Deployments get
+// their own directory since they reuse the same keys
+type DiskCache struct {
+	dir string
+}
+
+func NewDiskCache(dir string, deployment string) *DiskCache {
+	if deployment == "" {
+		deployment = "default"
+	}
+	return &DiskCache{dir: filepath.Join(dir, deployment)}
+}
+
+func (c *DiskCache) path(key string) string {
+	name := strings.Replace(strings.Trim(key, "/"), "/", "_", -1)
+	return filepath.Join(c.dir, name+".json")
+}
+
+// Written to a temporary file first, so a crash never leaves half a value
+func (c *DiskCache) Save(key string, value interface{}) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(c.dir, 0700)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	tmp, err := ioutil.TempFile(c.dir, ".tmp")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = tmp.Write(raw)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmp.Name(), c.path(key)))
+}
+
+// Loads key's value into value, and returns when it was saved
+func (c *DiskCache) Load(key string, value interface{}) (time.Time, error) {
+	path := c.path(key)
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return time.Time{}, errors.WithStack(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, errors.WithStack(err)
+	}
+	err = json.Unmarshal(raw, value)
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "Corrupt cache %s", path)
+	}
+	return info.ModTime(), nil
+}
+
+// Keeps this service's own state on disk beside the cache, such as what a
+// stratum held in memory when it stopped, so a restart can pick it up
+func (s *Service) SaveState(name string, value interface{}) error {
+	return s.cache.Save(s.stateKey(name), value)
+}
+
+// Loads state saved by SaveState, and returns when it was saved
+func (s *Service) LoadState(name string, value interface{}) (time.Time, error) {
+	return s.cache.Load(s.stateKey(name), value)
+}
+
+func (s *Service) stateKey(name string) string {
+	return "/state/" + s.namespace + "/" + s.Name + "/" + name
+}
@@ -0,0 +1,62 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ngpool-cache")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	cache := NewDiskCache(dir, "")
+	var value string
+	_, err = cache.Load("/config/common", &value)
+	assert.Error(t, err)
+
+	assert.NoError(t, cache.Save("/config/common", "Algos: {}"))
+	_, err = cache.Load("/config/common", &value)
+	assert.NoError(t, err)
+	assert.Equal(t, "Algos: {}", value)
+
+	statuses := map[string]*ServiceStatus{
+		"btc1": {ServiceID: "btc1", Labels: map[string]string{"currency": "BTC"}},
+	}
+	assert.NoError(t, cache.Save("/status/coinserver", statuses))
+	var loaded map[string]*ServiceStatus
+	_, err = cache.Load("/status/coinserver", &loaded)
+	assert.NoError(t, err)
+	assert.Equal(t, "btc1", loaded["btc1"].ServiceID)
+	assert.Equal(t, "BTC", loaded["btc1"].Labels["currency"])
+
+	// Deployments don't see each other's keys
+	_, err = NewDiskCache(dir, "ltc-eu").Load("/config/common", &value)
+	assert.Error(t, err)
+}
+
+func TestDiffServices(t *testing.T) {
+	known := map[string]*ServiceStatus{
+		"a": {ServiceID: "a"},
+		"b": {ServiceID: "b"},
+	}
+	current := map[string]*ServiceStatus{
+		"b": {ServiceID: "b"},
+		"c": {ServiceID: "c"},
+	}
+	updates := diffServices("coinserver", known, current)
+	assert.Len(t, updates, 3)
+	actions := map[string]string{}
+	for _, update := range updates {
+		assert.Equal(t, "coinserver", update.ServiceType)
+		actions[update.ServiceID] = update.Action
+	}
+	assert.Equal(t, map[string]string{"a": "removed", "b": "updated", "c": "added"}, actions)
+
+	assert.Len(t, diffServices("coinserver", known, nil), 2)
+}
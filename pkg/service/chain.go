@@ -4,6 +4,7 @@ import (
 	log "github.com/inconshreveable/log15"
 	"github.com/mitchellh/mapstructure"
 	"strings"
+	"time"
 )
 
 type ShareChainConfig struct {
@@ -12,8 +13,27 @@ type ShareChainConfig struct {
 	Fee          float64 `json:"fee"`
 	AlgoName     string  `mapstructure:"algo" json:"algo"`
 	Algo         *Algo   `mapstructure:"-" json:"-"`
+
+	// For the "shift" payout method. Shifts are closed either after a fixed
+	// time (ShiftDuration) or once they hold ShiftDifficulty worth of shares.
+	// Blocks are paid from the shift they were mined in plus the ShiftCount-1
+	// shifts before it
+	ShiftDuration   string        `json:"-"`
+	ShiftDifficulty float64       `json:"shift_difficulty,omitempty"`
+	ShiftCount      int           `json:"shift_count,omitempty"`
+	ShiftLength     time.Duration `mapstructure:"-" json:"shift_length,omitempty"`
+
+	// For the "score" payout method. A share's weight grows by e every
+	// ScoreDecay through the round, so late shares count for more
+	ScoreDecay       string        `json:"-"`
+	ScoreDecayLength time.Duration `mapstructure:"-" json:"score_decay,omitempty"`
 }
 
+// Payout methods ngweb knows how to credit with. "coinbase" is PPLNS paid
+// straight to miners' payout addresses in the coinbase of blocks the
+// sharechain's stratums mine, and credited as PPLNS otherwise
+var PayoutMethods = []string{"pplns", "prop", "score", "shift", "coinbase"}
+
 var ShareChain = map[string]*ShareChainConfig{}
 
 func SetupShareChains(rawConfig map[string]interface{}) {
@@ -32,7 +52,41 @@ func SetupShareChains(rawConfig map[string]interface{}) {
 			panic("Must specify sharechain algorithm")
 		}
 		log.Debug("Decoded share chain config", "chain", chain, "rawConfig", rawConfig)
-		// TODO: Ensure supported PayoutMethod to avoid misconfiguration
+		known := false
+		for _, method := range PayoutMethods {
+			if chain.PayoutMethod == method {
+				known = true
+			}
+		}
+		if !known {
+			panic("Unknown PayoutMethod " + chain.PayoutMethod)
+		}
+		if chain.PayoutMethod == "score" {
+			chain.ScoreDecayLength = time.Minute * 5
+			if chain.ScoreDecay != "" {
+				chain.ScoreDecayLength, err = time.ParseDuration(chain.ScoreDecay)
+				if err != nil {
+					panic(err)
+				}
+			}
+			if chain.ScoreDecayLength <= 0 {
+				panic("ScoreDecay must be positive")
+			}
+		}
+		if chain.PayoutMethod == "shift" {
+			if chain.ShiftDuration != "" {
+				chain.ShiftLength, err = time.ParseDuration(chain.ShiftDuration)
+				if err != nil {
+					panic(err)
+				}
+			}
+			if (chain.ShiftLength > 0) == (chain.ShiftDifficulty > 0) {
+				panic("Shift sharechains need exactly one of ShiftDuration or ShiftDifficulty")
+			}
+			if chain.ShiftCount < 1 {
+				chain.ShiftCount = 1
+			}
+		}
 		ShareChain[chain.Name] = &chain
 	}
 }
@@ -0,0 +1,26 @@
+package service
+
+import (
+	"time"
+)
+
+// Holds key for this service until ttl passes without it being claimed
+// again, see Claimer. false if another service holds it, ErrNoClaims if the
+// backend can't do it
+func (s *Service) Claim(key string, ttl time.Duration) (bool, error) {
+	claimer, ok := s.backend.(Claimer)
+	if !ok {
+		return false, ErrNoClaims
+	}
+	return claimer.Claim(key, s.namespace+"/"+s.Name, ttl)
+}
+
+// Gives up a key this service claimed. Keys held by other services are left
+// alone
+func (s *Service) Release(key string) error {
+	claimer, ok := s.backend.(Claimer)
+	if !ok {
+		return ErrNoClaims
+	}
+	return claimer.Release(key, s.namespace+"/"+s.Name)
+}
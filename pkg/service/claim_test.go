@@ -0,0 +1,56 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A backend that holds keys in memory, ignoring ttl
+type claimBackend struct {
+	Backend
+	owners map[string]string
+}
+
+func (b *claimBackend) Claim(key string, owner string, ttl time.Duration) (bool, error) {
+	if held, ok := b.owners[key]; ok && held != owner {
+		return false, nil
+	}
+	b.owners[key] = owner
+	return true, nil
+}
+
+func (b *claimBackend) Release(key string, owner string) error {
+	if b.owners[key] == owner {
+		delete(b.owners, key)
+	}
+	return nil
+}
+
+func TestClaim(t *testing.T) {
+	s := &Service{namespace: "stratum", Name: "a", backend: NewStaticBackend("/etc/ngpool", "example.com")}
+	_, err := s.Claim("/extranonce/LTC_T/00", time.Minute)
+	assert.Equal(t, ErrNoClaims, err)
+
+	backend := &claimBackend{owners: map[string]string{}}
+	a := &Service{namespace: "stratum", Name: "a", backend: backend}
+	b := &Service{namespace: "stratum", Name: "b", backend: backend}
+	ok, err := a.Claim("/extranonce/LTC_T/00", time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, _ = b.Claim("/extranonce/LTC_T/00", time.Minute)
+	assert.False(t, ok)
+	// Renewing our own claim
+	ok, _ = a.Claim("/extranonce/LTC_T/00", time.Minute)
+	assert.True(t, ok)
+	assert.Equal(t, "stratum/a", backend.owners["/extranonce/LTC_T/00"])
+
+	// Only the holder can give it up
+	assert.NoError(t, b.Release("/extranonce/LTC_T/00"))
+	ok, _ = b.Claim("/extranonce/LTC_T/00", time.Minute)
+	assert.False(t, ok)
+	assert.NoError(t, a.Release("/extranonce/LTC_T/00"))
+	ok, _ = b.Claim("/extranonce/LTC_T/00", time.Minute)
+	assert.True(t, ok)
+}
@@ -0,0 +1,282 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// How long requests to the consul agent get, other than blocking queries
+const consulTimeout = time.Second * 2
+
+// How long a blocking query waits for a change before returning anyway
+const consulWait = time.Minute
+
+// Config and control commands live in consul's KV store, under the same keys
+// etcd uses without the leading slash. A service publishing its status is
+// registered with the local agent with a TTL health check, and its status
+// is written to KV under a session tied to that check, so consul deletes it
+// when the check goes critical
+type consulBackend struct {
+	addr   string
+	prefix string
+	client *http.Client
+
+	// Our status session, created on the first write and again after any
+	// write fails
+	sessionMtx sync.Mutex
+	session    string
+}
+
+func NewConsulBackend(addr string, deployment string) Backend {
+	return &consulBackend{
+		addr:   strings.TrimSuffix(addr, "/"),
+		prefix: strings.TrimPrefix(DeploymentRoot(deployment), "/"),
+		client: &http.Client{},
+	}
+}
+
+func (c *consulBackend) kvPath(key string) string {
+	key = strings.TrimPrefix(key, "/")
+	if c.prefix != "" {
+		key = c.prefix + "/" + key
+	}
+	return "/v1/kv/" + key
+}
+
+// Makes a request to the agent, decoding the response into out when it's
+// given. Returns the response's X-Consul-Index. A 404 is ErrKeyNotFound
+func (c *consulBackend) do(method string, path string, query url.Values,
+	body []byte, out interface{}) (uint64, error) {
+	timeout := consulTimeout
+	if query.Get("index") != "" {
+		timeout += consulWait
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	u := c.addr + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	index, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return index, errors.WithStack(err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return index, ErrKeyNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return index, errors.Errorf("consul %s %s: %s %s", method, path, resp.Status,
+			strings.TrimSpace(string(raw)))
+	}
+	if out != nil {
+		if err := json.Unmarshal(raw, out); err != nil {
+			return index, errors.Wrapf(err, "Invalid response from consul %s", path)
+		}
+	}
+	return index, nil
+}
+
+type consulKV struct {
+	Key         string
+	Value       []byte
+	ModifyIndex uint64
+}
+
+func (c *consulBackend) Get(key string) (string, error) {
+	var kvs []consulKV
+	_, err := c.do("GET", c.kvPath(key), nil, nil, &kvs)
+	if err != nil {
+		return "", err
+	}
+	if len(kvs) == 0 {
+		return "", ErrKeyNotFound
+	}
+	return string(kvs[0].Value), nil
+}
+
+func (c *consulBackend) List(prefix string, index uint64) (map[string]string, uint64, error) {
+	query := url.Values{"recurse": {""}}
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", consulWait.String())
+	}
+	var kvs []consulKV
+	newIndex, err := c.do("GET", c.kvPath(prefix+"/"), query, nil, &kvs)
+	// An empty prefix is a 404, with an index to wait on all the same
+	if err != nil && err != ErrKeyNotFound {
+		return nil, 0, err
+	}
+	values := map[string]string{}
+	for _, kv := range kvs {
+		name := kv.Key[strings.LastIndexByte(kv.Key, '/')+1:]
+		if name != "" {
+			values[name] = string(kv.Value)
+		}
+	}
+	return values, newIndex, nil
+}
+
+func (c *consulBackend) fetchServices(namespace string, index uint64) (map[string]*ServiceStatus, uint64, error) {
+	values, newIndex, err := c.List("/status/"+namespace, index)
+	if err != nil {
+		return nil, 0, err
+	}
+	services := map[string]*ServiceStatus{}
+	for name, value := range values {
+		serviceID, status := parseStatus(name, value)
+		services[serviceID] = status
+	}
+	return services, newIndex, nil
+}
+
+func (c *consulBackend) Services(namespace string) (map[string]*ServiceStatus, uint64, error) {
+	return c.fetchServices(namespace, 0)
+}
+
+func (c *consulBackend) WatchServices(namespace string, known map[string]*ServiceStatus,
+	index uint64) ServiceWatch {
+	return newPollWatch(namespace, known, index, func(index uint64) (map[string]*ServiceStatus, uint64, error) {
+		return c.fetchServices(namespace, index)
+	})
+}
+
+// The agent's ID for a service, unique across namespaces and deployments
+func (c *consulBackend) registrationID(namespace string, serviceID string) string {
+	return strings.Replace(strings.TrimPrefix(c.kvPath("/status/"+namespace+"/"+serviceID),
+		"/v1/kv/"), "/", ":", -1)
+}
+
+func (c *consulBackend) SetStatus(namespace string, serviceID string, value string,
+	ttl time.Duration, refresh bool) error {
+	c.sessionMtx.Lock()
+	defer c.sessionMtx.Unlock()
+	regID := c.registrationID(namespace, serviceID)
+	checkID := "service:" + regID
+	err := c.setStatus(namespace, serviceID, regID, checkID, value, ttl, refresh)
+	if err != nil {
+		c.session = ""
+	}
+	return err
+}
+
+func (c *consulBackend) setStatus(namespace string, serviceID string, regID string,
+	checkID string, value string, ttl time.Duration, refresh bool) error {
+	if c.session == "" {
+		raw, _ := json.Marshal(map[string]interface{}{
+			"ID":   regID,
+			"Name": namespace,
+			"Check": map[string]string{
+				"TTL":                            ttl.String(),
+				"DeregisterCriticalServiceAfter": "1m",
+			},
+		})
+		if _, err := c.do("PUT", "/v1/agent/service/register", nil, raw, nil); err != nil {
+			return err
+		}
+		// Sessions can only be tied to passing checks
+		if _, err := c.do("PUT", "/v1/agent/check/pass/"+checkID, nil, nil, nil); err != nil {
+			return err
+		}
+		raw, _ = json.Marshal(map[string]interface{}{
+			"Name":      regID,
+			"Checks":    []string{"serfHealth", checkID},
+			"Behavior":  "delete",
+			"LockDelay": "0s",
+		})
+		var session struct {
+			ID string
+		}
+		if _, err := c.do("PUT", "/v1/session/create", nil, raw, &session); err != nil {
+			return err
+		}
+		c.session = session.ID
+		refresh = false
+	}
+	if _, err := c.do("PUT", "/v1/agent/check/pass/"+checkID, nil, nil, nil); err != nil {
+		return err
+	}
+	if refresh {
+		return nil
+	}
+	var acquired bool
+	_, err := c.do("PUT", c.kvPath("/status/"+namespace+"/"+serviceID),
+		url.Values{"acquire": {c.session}}, []byte(value), &acquired)
+	if err != nil {
+		return err
+	}
+	if !acquired {
+		return errors.Errorf("Status key for %s is held by another session", serviceID)
+	}
+	return nil
+}
+
+func (c *consulBackend) WatchControl(namespace string, serviceID string) (ControlWatch, error) {
+	key := ControlKey(namespace, serviceID)
+	var kvs []consulKV
+	index, err := c.do("GET", c.kvPath(key), nil, nil, &kvs)
+	if err != nil && err != ErrKeyNotFound {
+		return nil, err
+	}
+	return &consulControlWatch{backend: c, path: c.kvPath(key), index: index}, nil
+}
+
+// Consul's KV has no TTLs, so results stay until the next command
+type consulControlWatch struct {
+	backend *consulBackend
+	path    string
+	index   uint64
+}
+
+func (w *consulControlWatch) Next() (string, uint64, error) {
+	for {
+		var kvs []consulKV
+		index, err := w.backend.do("GET", w.path, url.Values{
+			"index": {strconv.FormatUint(w.index, 10)},
+			"wait":  {consulWait.String()},
+		}, nil, &kvs)
+		if err != nil && err != ErrKeyNotFound {
+			return "", 0, err
+		}
+		// The wait ran out, or the key was deleted
+		if len(kvs) == 0 || kvs[0].ModifyIndex <= w.index {
+			w.index = index
+			continue
+		}
+		w.index = index
+		return string(kvs[0].Value), kvs[0].ModifyIndex, nil
+	}
+}
+
+func (w *consulControlWatch) Result(value string, index uint64) error {
+	var written bool
+	_, err := w.backend.do("PUT", w.path, url.Values{
+		"cas": {strconv.FormatUint(index, 10)},
+	}, []byte(value), &written)
+	if err != nil {
+		return err
+	}
+	if !written {
+		return errors.New("Control key was written again")
+	}
+	return nil
+}
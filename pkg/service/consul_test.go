@@ -0,0 +1,135 @@
+package service
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Just enough of a consul agent's KV, session and registration endpoints.
+// Blocking queries return right away
+type fakeConsul struct {
+	mtx   sync.Mutex
+	index uint64
+	kv    map[string]consulKV
+	calls []string
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.calls = append(f.calls, r.Method+" "+r.URL.Path)
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+	if !strings.HasPrefix(r.URL.Path, "/v1/kv/") {
+		if r.URL.Path == "/v1/session/create" {
+			w.Write([]byte(`{"ID": "session1"}`))
+		}
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	query := r.URL.Query()
+	if r.Method == "PUT" {
+		if cas := query.Get("cas"); cas != "" && cas != strconv.FormatUint(f.kv[key].ModifyIndex, 10) {
+			w.Write([]byte("false"))
+			return
+		}
+		value, _ := ioutil.ReadAll(r.Body)
+		f.index++
+		f.kv[key] = consulKV{Key: key, Value: value, ModifyIndex: f.index}
+		w.Write([]byte("true"))
+		return
+	}
+	var found []consulKV
+	for k, kv := range f.kv {
+		if k == key || (query["recurse"] != nil && strings.HasPrefix(k, key)) {
+			found = append(found, kv)
+		}
+	}
+	if len(found) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].Key < found[j].Key })
+	json.NewEncoder(w).Encode(found)
+}
+
+func (f *fakeConsul) put(key string, value string) {
+	f.mtx.Lock()
+	f.index++
+	f.kv[key] = consulKV{Key: key, Value: []byte(value), ModifyIndex: f.index}
+	f.mtx.Unlock()
+}
+
+func TestConsulBackend(t *testing.T) {
+	fake := &fakeConsul{index: 1, kv: map[string]consulKV{}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	backend := NewConsulBackend(srv.URL, "ltc-eu")
+
+	fake.put("ngpool/ltc-eu/config/common", "stratum: {}")
+	value, err := backend.Get("/config/common")
+	assert.NoError(t, err)
+	assert.Equal(t, "stratum: {}", value)
+	_, err = backend.Get("/config/stratum/missing")
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	fake.put("ngpool/ltc-eu/config/currencies/LTC_T", "CoinbaseTag: /ngpool/")
+	values, _, err := backend.List("/config/currencies", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"LTC_T": "CoinbaseTag: /ngpool/"}, values)
+	values, _, err = backend.List("/config/missing", 0)
+	assert.NoError(t, err)
+	assert.Empty(t, values)
+
+	// No services yet is an empty namespace, not an error
+	services, _, err := backend.Services("coinserver")
+	assert.NoError(t, err)
+	assert.Len(t, services, 0)
+
+	// The first write registers us and takes a session, refreshes after
+	// that only pass the check
+	assert.NoError(t, backend.SetStatus("coinserver", "btc1",
+		`{"labels": {"currency": "BTC"}}`, time.Second*2, false))
+	assert.NoError(t, backend.SetStatus("coinserver", "btc1", "", time.Second*2, true))
+	assert.Equal(t, []string{
+		"PUT /v1/agent/service/register",
+		"PUT /v1/agent/check/pass/service:ngpool:ltc-eu:status:coinserver:btc1",
+		"PUT /v1/session/create",
+		"PUT /v1/agent/check/pass/service:ngpool:ltc-eu:status:coinserver:btc1",
+		"PUT /v1/kv/ngpool/ltc-eu/status/coinserver/btc1",
+		"PUT /v1/agent/check/pass/service:ngpool:ltc-eu:status:coinserver:btc1",
+	}, fake.calls[5:])
+
+	services, index, err := backend.Services("coinserver")
+	assert.NoError(t, err)
+	assert.Equal(t, "BTC", services["btc1"].Labels["currency"])
+
+	// Only services whose status changed come through the watch
+	fake.put("ngpool/ltc-eu/status/coinserver/ltc1", `{"labels": {"currency": "LTC"}}`)
+	watch := backend.WatchServices("coinserver", services, index)
+	id, status, err := watch.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, "ltc1", id)
+	assert.Equal(t, "LTC", status.Labels["currency"])
+
+	// Commands written before the watch started are skipped
+	fake.put("ngpool/ltc-eu/control/stratum/3333", `{"command": "drain"}`)
+	control, err := backend.WatchControl("stratum", "3333")
+	assert.NoError(t, err)
+	fake.put("ngpool/ltc-eu/control/stratum/3333", `{"command": "rotate-logs"}`)
+	value, cmdIndex, err := control.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, `{"command": "rotate-logs"}`, value)
+	assert.NoError(t, control.Result(`{"command": "rotate-logs", "handled_at": "2018-01-01T00:00:00Z"}`, cmdIndex))
+	value, _ = backend.Get("/control/stratum/3333")
+	assert.Contains(t, value, "handled_at")
+}
@@ -0,0 +1,179 @@
+package service
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Commands operators can send a running service through its control key. Services
+// register handlers for those that mean something to them, except restart
+// which every service supports
+const (
+	ControlReloadConfig = "reload-config"
+	ControlRotateLogs   = "rotate-logs"
+	ControlDrain        = "drain"
+	ControlRestart      = "restart"
+	ControlSnapshot     = "snapshot"
+)
+
+var ControlCommands = []string{
+	ControlReloadConfig, ControlRotateLogs, ControlDrain, ControlRestart, ControlSnapshot}
+
+// How long a handled command stays in etcd, so whoever sent it can read the
+// result
+const controlResultTTL = time.Minute
+
+// Written to /control/<namespace>/<serviceID> by ngctl, and written back by
+// the service with HandledAt set once it's run
+type ControlCommand struct {
+	Command  string    `json:"command"`
+	IssuedAt time.Time `json:"issued_at"`
+	// Set by the service
+	HandledAt *time.Time `json:"handled_at,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+type ControlHandler func(ControlCommand) error
+
+func ControlKey(namespace string, serviceID string) string {
+	return "/control/" + namespace + "/" + serviceID
+}
+
+// Handlers must be registered before WatchControl is started
+func (s *Service) HandleControl(command string, handler ControlHandler) {
+	if s.controlHandlers == nil {
+		s.controlHandlers = map[string]ControlHandler{}
+	}
+	s.controlHandlers[command] = handler
+}
+
+// Run before the process is replaced on restart, to stop anything that
+// would outlive it, like a coinserver child process
+func (s *Service) BeforeRestart(fn func()) {
+	s.beforeRestart = append(s.beforeRestart, fn)
+}
+
+// Returns the command in a control key's value if it still needs running.
+// Our own writes of the result come back through the watch, and are skipped
+func parseControl(value string) (*ControlCommand, bool) {
+	if value == "" {
+		return nil, false
+	}
+	var cmd ControlCommand
+	err := json.Unmarshal([]byte(value), &cmd)
+	if err != nil {
+		log.Warn("Ignoring invalid control command", "value", value, "err", err)
+		return nil, false
+	}
+	return &cmd, cmd.HandledAt == nil
+}
+
+// Runs a command's handler, returning the command with the result filled in
+func (s *Service) runControl(cmd ControlCommand, now time.Time) ControlCommand {
+	cmd.HandledAt = &now
+	if cmd.Command == ControlRestart {
+		// Run after the result is written, there's nobody left to write it
+		return cmd
+	}
+	handler, ok := s.controlHandlers[cmd.Command]
+	if !ok {
+		cmd.Error = "Unsupported command " + cmd.Command
+		return cmd
+	}
+	if err := handler(cmd); err != nil {
+		cmd.Error = err.Error()
+	}
+	return cmd
+}
+
+// Watches our control key and runs commands written to it. Commands written
+// before we started are ignored, so an old restart can't put us in a loop.
+// Blocks forever, unless the backend has no control commands
+func (s *Service) WatchControl() {
+	var watch ControlWatch
+	for {
+		// Commands written while the backend was unreachable to us are
+		// skipped too, since we can't tell how old they are
+		if watch == nil {
+			var err error
+			watch, err = s.backend.WatchControl(s.namespace, s.Name)
+			if err == ErrNoControl {
+				log.Info("Discovery backend has no control commands, not watching")
+				return
+			} else if err != nil {
+				log.Warn("Failed to read control key, retrying", "err", err)
+				time.Sleep(time.Second * 2)
+				continue
+			}
+		}
+		value, index, err := watch.Next()
+		if err != nil {
+			log.Warn("Error from control watcher", "err", err)
+			time.Sleep(time.Second * 2)
+			watch = nil
+			continue
+		}
+		cmd, ok := parseControl(value)
+		if !ok {
+			continue
+		}
+		log.Info("Running control command", "command", cmd.Command)
+		result := s.runControl(*cmd, time.Now())
+		if result.Error != "" {
+			log.Error("Control command failed", "command", cmd.Command, "err", result.Error)
+		}
+		raw, _ := json.Marshal(result)
+		// A newer command may have been written while this one ran, leave it
+		err = watch.Result(string(raw), index)
+		if err != nil {
+			log.Warn("Failed to write control command result", "err", err)
+		}
+		if result.Command == ControlRestart {
+			s.restart()
+		}
+	}
+}
+
+// Replaces the process with a fresh copy of itself, same arguments and
+// environment, so nothing outside (systemd, docker) needs to be involved
+func (s *Service) restart() {
+	for _, fn := range s.beforeRestart {
+		fn()
+	}
+	binary, err := os.Executable()
+	if err == nil {
+		log.Info("Restarting", "binary", binary)
+		err = syscall.Exec(binary, os.Args, os.Environ())
+	}
+	log.Crit("Failed to restart", "err", errors.WithStack(err))
+	os.Exit(1)
+}
+
+// Keys set in next whose values differ from current, other than those
+// already applied, along with anything nested under them. reload-config
+// only applies a few settings live, the rest are logged so the operator
+// knows a restart is needed
+func ChangedKeys(current *viper.Viper, next *viper.Viper, applied ...string) []string {
+	skip := map[string]bool{}
+	for _, key := range applied {
+		skip[strings.ToLower(key)] = true
+	}
+	var changed []string
+	for _, key := range next.AllKeys() {
+		top := strings.SplitN(key, ".", 2)[0]
+		if !skip[key] && !skip[top] && !reflect.DeepEqual(current.Get(key), next.Get(key)) {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
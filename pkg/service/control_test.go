@@ -0,0 +1,71 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseControl(t *testing.T) {
+	cmd, ok := parseControl(`{"command": "drain", "issued_at": "2018-01-01T00:00:00Z"}`)
+	assert.True(t, ok)
+	assert.Equal(t, ControlDrain, cmd.Command)
+
+	// Our own result coming back through the watch
+	_, ok = parseControl(`{"command": "drain", "handled_at": "2018-01-01T00:00:01Z"}`)
+	assert.False(t, ok)
+
+	_, ok = parseControl("")
+	assert.False(t, ok)
+	_, ok = parseControl("drain")
+	assert.False(t, ok)
+}
+
+func TestRunControl(t *testing.T) {
+	var ran []string
+	s := &Service{}
+	s.HandleControl(ControlDrain, func(cmd ControlCommand) error {
+		ran = append(ran, cmd.Command)
+		return nil
+	})
+	s.HandleControl(ControlRotateLogs, func(cmd ControlCommand) error {
+		return errors.New("no log file")
+	})
+	now := time.Unix(1500000000, 0)
+
+	result := s.runControl(ControlCommand{Command: ControlDrain}, now)
+	assert.Equal(t, now, *result.HandledAt)
+	assert.Equal(t, "", result.Error)
+	assert.Equal(t, []string{ControlDrain}, ran)
+
+	result = s.runControl(ControlCommand{Command: ControlRotateLogs}, now)
+	assert.Equal(t, "no log file", result.Error)
+
+	result = s.runControl(ControlCommand{Command: ControlReloadConfig}, now)
+	assert.Equal(t, "Unsupported command reload-config", result.Error)
+
+	// Restart is acknowledged first and run by the watcher afterwards
+	result = s.runControl(ControlCommand{Command: ControlRestart}, now)
+	assert.Equal(t, "", result.Error)
+	assert.Equal(t, []string{ControlDrain}, ran)
+}
+
+func TestChangedKeys(t *testing.T) {
+	current := viper.New()
+	current.Set("LogLevel", "info")
+	current.Set("StratumBind", "0.0.0.0:3333")
+	current.Set("VardiffMin", 0.125)
+	next := viper.New()
+	next.Set("LogLevel", "debug")
+	next.Set("StratumBind", "0.0.0.0:3334")
+	next.Set("VardiffMin", 0.125)
+
+	assert.Equal(t, []string{"loglevel", "stratumbind"}, ChangedKeys(current, next))
+	assert.Equal(t, []string{"stratumbind"}, ChangedKeys(current, next, "LogLevel"))
+
+	next.Set("Ports", map[string]interface{}{"3334": map[string]interface{}{"VardiffMin": 1}})
+	assert.Equal(t, []string{"stratumbind"}, ChangedKeys(current, next, "LogLevel", "Ports"))
+}
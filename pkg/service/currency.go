@@ -8,8 +8,14 @@ import (
 	"github.com/btcsuite/btcutil"
 	log "github.com/inconshreveable/log15"
 	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
 	"os"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
+
+	"github.com/icook/ngpool/pkg/common"
 )
 
 // This is the structure for the config file represnetation of a "ChainConfig".
@@ -36,11 +42,76 @@ type ChainConfigDecoder struct {
 	FlushAux bool
 	// This is the transaction fee to use for payouts. Given in satoshis / byte
 	PayoutTransactionFee int
+	// How often to pay users in the default tier, see Schedule. Aux chains
+	// with low value blocks might want "@daily" to save on transaction fees
+	PayoutSchedule string
+	// The lowest fee rate the network will relay, given in satoshis / kB. If
+	// PayoutTransactionFee works out lower than this the payout fee is raised
+	// to match, otherwise the transaction would never leave our node
+	MinimumRelayFee int
+	// Ask the coinserver for a fee rate with estimatesmartfee when paying
+	// out, rather than always using PayoutTransactionFee. PayoutTransactionFee
+	// is still used when the node has no estimate, as nodes fresh off sync
+	// don't
+	PayoutFeeEstimate bool
+	// How soon payouts should confirm, which picks the estimatesmartfee
+	// target: "economy" (24 blocks), "normal" (6, the default) or "priority"
+	// (2). OnDemandPayoutUrgency is used for on-demand payouts instead, and
+	// defaults to "priority" since the user is waiting on them
+	PayoutUrgency         string
+	OnDemandPayoutUrgency string
+	// The most an estimated fee rate may be, in satoshis / byte, so a fee
+	// spike can't eat into payouts unbounded. 0 (the default) is no limit
+	PayoutFeeMax int
+	// Who pays payout transaction fees. "miners" (the default) deducts them
+	// from payees in proportion to their payout, "pool" takes them out of
+	// the pool's change, so users get their whole balance
+	PayoutFeePaidBy string
+	// Outputs smaller than this (in satoshis) are considered dust and will be
+	// rejected by the network. Users whose payout would fall below it are
+	// deferred until they've accumulated more credit. Defaults to 546
+	DustThreshold int64
+	// The smallest balance a user can request an on-demand payout of, in
+	// satoshis. Never less than DustThreshold
+	OnDemandPayoutMinimum int64
+	// The balance, in satoshis, users are paid at unless they've picked their
+	// own minimum. 0 (the default) pays anything over DustThreshold
+	MinimumPayout int64
+	// The most the hot wallet (SubsidyAddress) keeps for payouts, in
+	// satoshis. Payout change past it goes to ColdWalletAddress, and payouts
+	// that would leave less ask the operator for a top-up from the cold
+	// wallet. 0 (the default) keeps everything in the hot wallet
+	HotWalletFloat int64
+	// Links to a block explorer for blocks and transactions, with {hash}
+	// replaced by the hash. Optional
+	BlockExplorerURL string
+	TxExplorerURL    string
+	// The currency's id with the price API, see ngweb's PriceURL. Optional
+	PriceTicker string
 
 	// Parsed - These options get parsed in SetupCurrencies
 
 	// The address to send newly mined coins
 	SubsidyAddress string
+	// Where payout change past HotWalletFloat is sent. Required with it
+	ColdWalletAddress string
+	// Additional coinbase outputs, each paid a percentage of the block reward
+	// (after any outputs the template requires). Used for pool fee, donation
+	// and dev fee addresses. SubsidyAddress gets whatever is left
+	CoinbaseSplits []CoinbaseSplitDecoder
+	// Text written into the coinbase scriptSig of every block we mine, ie the
+	// pool name or URL. At most MaxCoinbaseTagLen bytes
+	CoinbaseTag string
+	// Include the template's coinbaseaux data (ie "flags") in the coinbase.
+	// Some chains use it for soft fork signalling
+	CoinbaseAuxFlags bool
+	// The most miners a "coinbase" payout sharechain pays directly in one
+	// coinbase, each is an output. The smallest balances past this wait in
+	// SubsidyAddress to be credited instead. Defaults to 100
+	CoinbaseMaxPayees int
+	// Names of stratum template hooks to run on this chain's templates, for
+	// fields the generic template handling doesn't know, ie ["mweb"]
+	TemplateHooks []string
 	// The name of an algorithm. Current options are scrypt, sha256d, lyra2rev2, x17, argon2
 	PowAlgorithm string
 
@@ -55,6 +126,15 @@ type ChainConfigDecoder struct {
 	PrivKeyID string
 	// Private key version for Wallet Import Format (WIF) given in hex (1 byte)
 	PrivKeyAddrID string
+	// Script hash (P2SH) address version given in hex (1 byte). Optional
+	ScriptAddrID string
+	// Human readable part for bech32 segwit addresses, ie "ltc". Optional
+	Bech32HRP string
+	// How addresses are encoded. "base58" (the default) covers base58check
+	// and bech32, "cashaddr" is for Bitcoin Cash style chains and requires
+	// CashAddrPrefix
+	AddressFormat  string
+	CashAddrPrefix string
 	// The p2p message magic bytes. This is a sequence of 4 bytes that allow
 	// bitcoin to reject connections from litecoin nodes, etc. It is sent at
 	// the beginning of every message on bitcoin p2p networks, and is unique to
@@ -74,14 +154,42 @@ type ChainConfigDecoder struct {
 	MultiAlgoBitWidth uint32
 }
 
+type CoinbaseSplitDecoder struct {
+	// A label for logging, ie "donation"
+	Name    string
+	Address string
+	// Percentage of the block reward, 1.5 is 1.5%
+	Percent float64
+}
+
+type CoinbaseSplit struct {
+	Name    string
+	Address btcutil.Address
+	Percent float64
+}
+
 // This encodes network rules and pool wide preferences for handling of that
 // currency. There would be a different one of these for testnet, mainnet, or
 // regtest blockchains for a single currency.
 type ChainConfig struct {
-	Code                 string
-	BlockMatureConfirms  int64
-	FlushAux             bool
-	PayoutTransactionFee int
+	Code                  string
+	BlockMatureConfirms   int64
+	FlushAux              bool
+	PayoutTransactionFee  int
+	MinimumRelayFee       int
+	PayoutFeeEstimate     bool
+	PayoutUrgency         string
+	OnDemandPayoutUrgency string
+	PayoutFeeMax          int
+	PayoutFeePaidBy       string
+	DustThreshold         int64
+	PayoutSchedule        *Schedule
+	OnDemandPayoutMinimum int64
+	MinimumPayout         int64
+	HotWalletFloat        int64
+	BlockExplorerURL      string
+	TxExplorerURL         string
+	PriceTicker           string
 
 	MultiAlgo         bool
 	MultiAlgoMap      map[string]uint32
@@ -89,30 +197,94 @@ type ChainConfig struct {
 	MultiAlgoBitWidth uint32
 
 	Algo                *Algo
-	Params              *chaincfg.Params `json:"-"`
+	Params              *chaincfg.Params    `json:"-"`
+	AddressCodec        common.AddressCodec `json:"-"`
 	BlockSubsidyAddress *btcutil.Address
+	// nil without a HotWalletFloat
+	ColdWalletAddress btcutil.Address
+	CoinbaseSplits    []CoinbaseSplit
+	CoinbaseTag       []byte
+	CoinbaseAuxFlags  bool
+	CoinbaseMaxPayees int
+	TemplateHooks     []string
+}
+
+// The coinbase scriptSig is limited to 100 bytes by consensus. The BIP34
+// height takes up to 5 of those, and the push of our merged mining commitment
+// and extranonce takes 53. This leaves room for a 41 byte tag and its push
+// opcode. Aux flags come out of the same space, so they're checked when the
+// coinbase is built since they vary per block
+const MaxCoinbaseTagLen = 41
+
+// The estimatesmartfee confirmation target for each payout urgency
+var PayoutConfTargets = map[string]int{
+	"economy":  24,
+	"normal":   6,
+	"priority": 2,
 }
 
 func (u *ChainConfig) MarshalJSON() ([]byte, error) {
+	splits := map[string]float64{}
+	for _, split := range u.CoinbaseSplits {
+		splits[split.Address.String()] = split.Percent
+	}
+	var coldAddress string
+	if u.ColdWalletAddress != nil {
+		coldAddress = u.ColdWalletAddress.String()
+	}
 	return json.Marshal(&struct {
-		Code                 string `json:"code"`
-		BlockMatureConfirms  int64  `json:"block_mature_confirms"`
-		FlushAux             bool   `json:"flush_aux"`
-		PayoutTransactionFee int    `json:"payout_transaction_fee"`
+		Code                  string `json:"code"`
+		BlockMatureConfirms   int64  `json:"block_mature_confirms"`
+		FlushAux              bool   `json:"flush_aux"`
+		PayoutTransactionFee  int    `json:"payout_transaction_fee"`
+		MinimumRelayFee       int    `json:"minimum_relay_fee"`
+		PayoutFeeEstimate     bool   `json:"payout_fee_estimate"`
+		PayoutUrgency         string `json:"payout_urgency"`
+		OnDemandPayoutUrgency string `json:"on_demand_payout_urgency"`
+		PayoutFeeMax          int    `json:"payout_fee_max"`
+		PayoutFeePaidBy       string `json:"payout_fee_paid_by"`
+		DustThreshold         int64  `json:"dust_threshold"`
+		PayoutSchedule        string `json:"payout_schedule"`
+		OnDemandPayoutMinimum int64  `json:"on_demand_payout_minimum"`
+		MinimumPayout         int64  `json:"minimum_payout"`
+		HotWalletFloat        int64  `json:"hot_wallet_float"`
+		BlockExplorerURL      string `json:"block_explorer_url"`
+		TxExplorerURL         string `json:"tx_explorer_url"`
+		PriceTicker           string `json:"price_ticker"`
 
 		MultiAlgo         bool              `json:"multi_algo"`
 		MultiAlgoMap      map[string]uint32 `json:"multi_algo_map"`
 		MultiAlgoBitShift uint32            `json:"multi_algo_bit_shift"`
 		MultiAlgoBitWidth uint32            `json:"multi_algo_bit_width"`
 
-		Algo                string `json:"algo"`
-		BlockSubsidyAddress string `json:"block_subsidy_address"`
+		Algo                string             `json:"algo"`
+		BlockSubsidyAddress string             `json:"block_subsidy_address"`
+		ColdWalletAddress   string             `json:"cold_wallet_address,omitempty"`
+		CoinbaseSplits      map[string]float64 `json:"coinbase_splits"`
+		CoinbaseTag         string             `json:"coinbase_tag"`
+		CoinbaseAuxFlags    bool               `json:"coinbase_aux_flags"`
+		CoinbaseMaxPayees   int                `json:"coinbase_max_payees"`
+		TemplateHooks       []string           `json:"template_hooks"`
 	}{
-		Code:                 u.Code,
-		BlockMatureConfirms:  u.BlockMatureConfirms,
-		FlushAux:             u.FlushAux,
-		PayoutTransactionFee: u.PayoutTransactionFee,
-		Algo:                 u.Algo.Name,
+		Code:                  u.Code,
+		BlockMatureConfirms:   u.BlockMatureConfirms,
+		FlushAux:              u.FlushAux,
+		PayoutTransactionFee:  u.PayoutTransactionFee,
+		MinimumRelayFee:       u.MinimumRelayFee,
+		PayoutFeeEstimate:     u.PayoutFeeEstimate,
+		PayoutUrgency:         u.PayoutUrgency,
+		OnDemandPayoutUrgency: u.OnDemandPayoutUrgency,
+		PayoutFeeMax:          u.PayoutFeeMax,
+		PayoutFeePaidBy:       u.PayoutFeePaidBy,
+		DustThreshold:         u.DustThreshold,
+		PayoutSchedule:        u.PayoutSchedule.Spec,
+		OnDemandPayoutMinimum: u.OnDemandPayoutMinimum,
+		MinimumPayout:         u.MinimumPayout,
+		HotWalletFloat:        u.HotWalletFloat,
+		BlockExplorerURL:      u.BlockExplorerURL,
+		TxExplorerURL:         u.TxExplorerURL,
+		PriceTicker:           u.PriceTicker,
+		Algo:                  u.Algo.Name,
 
 		MultiAlgo:         u.MultiAlgo,
 		MultiAlgoMap:      u.MultiAlgoMap,
@@ -120,80 +292,349 @@ func (u *ChainConfig) MarshalJSON() ([]byte, error) {
 		MultiAlgoBitWidth: u.MultiAlgoBitWidth,
 
 		BlockSubsidyAddress: (*u.BlockSubsidyAddress).String(),
+		ColdWalletAddress:   coldAddress,
+		CoinbaseSplits:      splits,
+		CoinbaseTag:         string(u.CoinbaseTag),
+		CoinbaseAuxFlags:    u.CoinbaseAuxFlags,
+		CoinbaseMaxPayees:   u.CoinbaseMaxPayees,
+		TemplateHooks:       u.TemplateHooks,
 	})
 }
 
+// Empty if there's no BlockExplorerURL configured
+func (u *ChainConfig) BlockURL(hash string) string {
+	if u.BlockExplorerURL == "" {
+		return ""
+	}
+	return strings.Replace(u.BlockExplorerURL, "{hash}", hash, -1)
+}
+
+// Empty if there's no TxExplorerURL configured
+func (u *ChainConfig) TxURL(hash string) string {
+	if u.TxExplorerURL == "" {
+		return ""
+	}
+	return strings.Replace(u.TxExplorerURL, "{hash}", hash, -1)
+}
+
 // This is a global lookup for currency information. All programs load "common"
-// configuration on start and populate this by calling "SetupCurrencies"
-var CurrencyConfig = map[string]*ChainConfig{}
-var RawCurrencyConfig map[string]interface{}
+// configuration on start and populate it by calling "SetupCurrencies". It
+// can be replaced while running (see WatchCurrencies), so it's only reached
+// through Currency and Currencies. A ChainConfig is never modified once
+// decoded, a changed currency gets a new one
+var (
+	currencyMtx    sync.RWMutex
+	currencyConfig = map[string]*ChainConfig{}
+	rawCurrencies  = map[string]interface{}{}
+	// The currency that registered each network magic with btcd
+	registeredNets = map[wire.BitcoinNet]string{}
+)
+
+// The config of a currency by code, ie "LTC_T"
+func Currency(code string) (*ChainConfig, bool) {
+	currencyMtx.RLock()
+	defer currencyMtx.RUnlock()
+	config, ok := currencyConfig[code]
+	return config, ok
+}
+
+// A copy of every configured currency by code
+func Currencies() map[string]*ChainConfig {
+	currencyMtx.RLock()
+	defer currencyMtx.RUnlock()
+	configs := make(map[string]*ChainConfig, len(currencyConfig))
+	for code, config := range currencyConfig {
+		configs[code] = config
+	}
+	return configs
+}
+
+// The undecoded config of every currency, as given to SetupCurrencies
+func RawCurrencies() map[string]interface{} {
+	currencyMtx.RLock()
+	defer currencyMtx.RUnlock()
+	raw := make(map[string]interface{}, len(rawCurrencies))
+	for code, config := range rawCurrencies {
+		raw[code] = config
+	}
+	return raw
+}
+
+// Adds an already built currency, for tests and tools that don't decode one
+// from config
+func RegisterCurrency(config *ChainConfig) {
+	currencyMtx.Lock()
+	currencyConfig[config.Code] = config
+	currencyMtx.Unlock()
+}
 
 // This parses the viper config structure using ChainConfigDecoder to populate
-// CurrencyConfig with ChainConfig structures
+// the currency lookup with ChainConfig structures. Any invalid currency is
+// fatal
 func SetupCurrencies(rawConfig map[string]interface{}) {
-	RawCurrencyConfig = rawConfig
-	for code, rawConfig := range rawConfig {
-		var config ChainConfigDecoder
-		var code = strings.ToUpper(code)
-		err := mapstructure.Decode(rawConfig, &config)
+	if _, _, err := ReloadCurrencies(rawConfig); err != nil {
+		log.Crit("Invalid currency config", "err", err)
+		os.Exit(1)
+	}
+}
+
+// Replaces the currency lookup with the currencies in rawConfig. Currencies
+// whose config is the same as last time keep their ChainConfig, others are
+// decoded again. If any is invalid nothing is changed. Returns the codes
+// added or changed, and those removed
+func ReloadCurrencies(rawConfig map[string]interface{}) ([]string, []string, error) {
+	currencyMtx.RLock()
+	previous := rawCurrencies
+	current := currencyConfig
+	currencyMtx.RUnlock()
+
+	configs := map[string]*ChainConfig{}
+	raws := map[string]interface{}{}
+	var changed, removed []string
+	for code, raw := range rawConfig {
+		code = strings.ToUpper(code)
+		raws[code] = raw
+		if config, ok := current[code]; ok && reflect.DeepEqual(previous[code], raw) {
+			configs[code] = config
+			continue
+		}
+		config, err := DecodeCurrency(code, raw)
 		if err != nil {
-			panic(err)
+			return nil, nil, errors.Wrap(err, code)
 		}
-		log.Debug("Decoded currency config", "config", config, "rawConfig", rawConfig)
+		configs[code] = config
+		changed = append(changed, code)
+	}
+	for code := range current {
+		if _, ok := configs[code]; !ok {
+			removed = append(removed, code)
+		}
+	}
+	sort.Strings(changed)
+	sort.Strings(removed)
 
-		params := &chaincfg.Params{
-			Name: code,
-			Net:  wire.BitcoinNet(config.NetMagic),
+	// Codecs are swapped along with the configs, so a codec is never
+	// registered for a currency that isn't configured
+	currencyMtx.Lock()
+	currencyConfig = configs
+	rawCurrencies = raws
+	for _, code := range changed {
+		common.RegisterAddressCodec(code, configs[code].AddressCodec)
+	}
+	for _, code := range removed {
+		common.UnregisterAddressCodec(code)
+	}
+	currencyMtx.Unlock()
+	return changed, removed, nil
+}
+
+// Decodes and validates a single currency's config, registering its network
+// with btcd. Its address codec is only registered once it's loaded by
+// ReloadCurrencies
+func DecodeCurrency(code string, raw interface{}) (*ChainConfig, error) {
+	var config ChainConfigDecoder
+	err := mapstructure.Decode(raw, &config)
+	if err != nil {
+		return nil, err
+	}
+	log.Debug("Decoded currency config", "config", config, "rawConfig", raw)
+
+	params := &chaincfg.Params{
+		Name: code,
+		Net:  wire.BitcoinNet(config.NetMagic),
+	}
+
+	decoded, err := hex.DecodeString(config.PrivKeyAddrID)
+	if err != nil || len(decoded) != 1 {
+		return nil, errors.Errorf("Invalid PrivKeyAddrID %q", config.PrivKeyAddrID)
+	}
+	params.PrivateKeyID = decoded[0]
+
+	decoded, err = hex.DecodeString(config.PubKeyAddrID)
+	if err != nil || len(decoded) != 1 {
+		return nil, errors.Errorf("Invalid PubKeyAddrID %q", config.PubKeyAddrID)
+	}
+	params.PubKeyHashAddrID = decoded[0]
+
+	if config.ScriptAddrID != "" {
+		decoded, err = hex.DecodeString(config.ScriptAddrID)
+		if err != nil || len(decoded) != 1 {
+			return nil, errors.Errorf("Invalid ScriptAddrID %q", config.ScriptAddrID)
 		}
+		params.ScriptHashAddrID = decoded[0]
+	}
+	params.Bech32HRPSegwit = config.Bech32HRP
 
-		decoded, err := hex.DecodeString(config.PrivKeyAddrID)
-		if err != nil {
-			panic(err)
+	algo, ok := AlgoConfig[config.PowAlgorithm]
+	if !ok {
+		return nil, errors.Errorf("Unknown PowAlgorithm %q", config.PowAlgorithm)
+	}
+	if config.BlockMatureConfirms == 0 {
+		return nil, errors.New("You must specify a BlockMatureConfirms")
+	}
+	if config.PayoutTransactionFee == 0 {
+		return nil, errors.New("You must specify a PayoutTransactionFee")
+	}
+	if len(config.CoinbaseTag) > MaxCoinbaseTagLen {
+		return nil, errors.Errorf("CoinbaseTag is %d bytes, at most %d are allowed",
+			len(config.CoinbaseTag), MaxCoinbaseTagLen)
+	}
+	schedule, err := ParseSchedule(config.PayoutSchedule)
+	if err != nil {
+		return nil, err
+	}
+
+	legacy := &common.Base58Codec{Params: params}
+	var codec common.AddressCodec
+	switch config.AddressFormat {
+	case "", "base58":
+		codec = legacy
+	case "cashaddr":
+		if config.CashAddrPrefix == "" {
+			return nil, errors.New("You must specify a CashAddrPrefix for cashaddr")
 		}
-		params.PrivateKeyID = decoded[0]
+		codec = &common.CashAddrCodec{
+			Prefix: config.CashAddrPrefix,
+			Legacy: legacy,
+		}
+	default:
+		return nil, errors.Errorf("Unrecognized AddressFormat %q", config.AddressFormat)
+	}
+
+	if err := registerNet(code, params); err != nil {
+		return nil, err
+	}
+	bsa, err := common.DecodeAddressWith(codec, config.SubsidyAddress, params)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error decoding SubsidyAddress %q", config.SubsidyAddress)
+	}
 
-		decoded, err = hex.DecodeString(config.PubKeyAddrID)
+	var splits []CoinbaseSplit
+	var splitTotal float64
+	for _, split := range config.CoinbaseSplits {
+		addr, err := common.DecodeAddressWith(codec, split.Address, params)
 		if err != nil {
-			panic(err)
+			return nil, errors.Wrapf(err, "Error decoding CoinbaseSplits address %q (%s)",
+				split.Address, split.Name)
 		}
-		params.PubKeyHashAddrID = decoded[0]
-
-		if err := chaincfg.Register(params); err != nil {
-			panic("failed to register network: " + err.Error())
+		if split.Percent <= 0 {
+			return nil, errors.New("CoinbaseSplits percent must be positive")
 		}
+		splitTotal += split.Percent
+		splits = append(splits, CoinbaseSplit{
+			Name:    split.Name,
+			Address: addr,
+			Percent: split.Percent,
+		})
+	}
+	if splitTotal >= 100 {
+		return nil, errors.New("CoinbaseSplits must total less than 100 percent")
+	}
 
-		bsa, err := btcutil.DecodeAddress(config.SubsidyAddress, params)
+	var coldAddress btcutil.Address
+	if config.HotWalletFloat < 0 {
+		return nil, errors.New("HotWalletFloat can't be negative")
+	}
+	if config.HotWalletFloat > 0 {
+		if config.ColdWalletAddress == "" {
+			return nil, errors.New("HotWalletFloat needs a ColdWalletAddress")
+		}
+		coldAddress, err = common.DecodeAddressWith(codec, config.ColdWalletAddress, params)
 		if err != nil {
-			log.Crit("Error decoding SubsidyAddress",
-				"address", config.SubsidyAddress,
-				"err", err,
-				"currency", config.Code)
-			os.Exit(1)
+			return nil, errors.Wrapf(err, "Error decoding ColdWalletAddress %q", config.ColdWalletAddress)
 		}
-
-		if config.BlockMatureConfirms == 0 {
-			panic("You must specify a BlockMatureConfirms")
+		if coldAddress.String() == bsa.String() {
+			return nil, errors.New("ColdWalletAddress can't be the SubsidyAddress")
 		}
+	}
 
-		if config.PayoutTransactionFee == 0 {
-			panic("You must specify a PayoutTransactionFee")
+	if config.DustThreshold == 0 {
+		config.DustThreshold = 546
+	}
+	if config.MinimumPayout < 0 {
+		return nil, errors.New("MinimumPayout can't be negative")
+	}
+	if config.OnDemandPayoutMinimum < config.DustThreshold {
+		config.OnDemandPayoutMinimum = config.DustThreshold
+	}
+	if config.CoinbaseMaxPayees == 0 {
+		config.CoinbaseMaxPayees = 100
+	}
+	if config.PayoutUrgency == "" {
+		config.PayoutUrgency = "normal"
+	}
+	if config.OnDemandPayoutUrgency == "" {
+		config.OnDemandPayoutUrgency = "priority"
+	}
+	for _, urgency := range []string{config.PayoutUrgency, config.OnDemandPayoutUrgency} {
+		if _, ok := PayoutConfTargets[urgency]; !ok {
+			return nil, errors.Errorf("Unrecognized payout urgency %q", urgency)
 		}
+	}
+	if config.PayoutFeeMax < 0 {
+		return nil, errors.New("PayoutFeeMax can't be negative")
+	}
+	switch config.PayoutFeePaidBy {
+	case "":
+		config.PayoutFeePaidBy = "miners"
+	case "miners", "pool":
+	default:
+		return nil, errors.Errorf("Unrecognized PayoutFeePaidBy %q", config.PayoutFeePaidBy)
+	}
 
-		cc := &ChainConfig{
-			Code:                 code,
-			BlockMatureConfirms:  config.BlockMatureConfirms,
-			PayoutTransactionFee: config.PayoutTransactionFee,
+	return &ChainConfig{
+		Code:                  code,
+		BlockMatureConfirms:   config.BlockMatureConfirms,
+		FlushAux:              config.FlushAux,
+		PayoutTransactionFee:  config.PayoutTransactionFee,
+		MinimumRelayFee:       config.MinimumRelayFee,
+		PayoutFeeEstimate:     config.PayoutFeeEstimate,
+		PayoutUrgency:         config.PayoutUrgency,
+		OnDemandPayoutUrgency: config.OnDemandPayoutUrgency,
+		PayoutFeeMax:          config.PayoutFeeMax,
+		PayoutFeePaidBy:       config.PayoutFeePaidBy,
+		DustThreshold:         config.DustThreshold,
+		PayoutSchedule:        schedule,
+		OnDemandPayoutMinimum: config.OnDemandPayoutMinimum,
+		MinimumPayout:         config.MinimumPayout,
+		HotWalletFloat:        config.HotWalletFloat,
+		BlockExplorerURL:      config.BlockExplorerURL,
+		TxExplorerURL:         config.TxExplorerURL,
+		PriceTicker:           config.PriceTicker,
 
-			MultiAlgo:         config.MultiAlgo,
-			MultiAlgoMap:      config.MultiAlgoMap,
-			MultiAlgoBitShift: config.MultiAlgoBitShift,
-			MultiAlgoBitWidth: config.MultiAlgoBitWidth,
+		MultiAlgo:         config.MultiAlgo,
+		MultiAlgoMap:      config.MultiAlgoMap,
+		MultiAlgoBitShift: config.MultiAlgoBitShift,
+		MultiAlgoBitWidth: config.MultiAlgoBitWidth,
 
-			Params:              params,
-			BlockSubsidyAddress: &bsa,
-			Algo:                AlgoConfig[config.PowAlgorithm],
-		}
+		Params:              params,
+		AddressCodec:        codec,
+		BlockSubsidyAddress: &bsa,
+		ColdWalletAddress:   coldAddress,
+		CoinbaseSplits:      splits,
+		CoinbaseTag:         []byte(config.CoinbaseTag),
+		CoinbaseAuxFlags:    config.CoinbaseAuxFlags,
+		CoinbaseMaxPayees:   config.CoinbaseMaxPayees,
+		TemplateHooks:       config.TemplateHooks,
+		Algo:                algo,
+	}, nil
+}
 
-		CurrencyConfig[code] = cc
+// btcd keeps a registry of networks that can't be changed once registered.
+// A currency decoded again keeps the network it registered as long as its
+// NetMagic is the same, so changes to its Bech32HRP need a restart
+func registerNet(code string, params *chaincfg.Params) error {
+	currencyMtx.Lock()
+	defer currencyMtx.Unlock()
+	if owner, ok := registeredNets[params.Net]; ok {
+		if owner != code {
+			return errors.Errorf("NetMagic %#x is already used by %s", uint32(params.Net), owner)
+		}
+		return nil
+	}
+	if err := chaincfg.Register(params); err != nil {
+		return errors.Wrap(err, "Failed to register network")
 	}
+	registeredNets[params.Net] = code
+	return nil
 }
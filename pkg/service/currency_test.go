@@ -0,0 +1,157 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/icook/ngpool/pkg/common"
+)
+
+func testCurrency(netMagic uint32, tag string) map[string]interface{} {
+	return map[string]interface{}{
+		"subsidyaddress":       "mucHkBoHAF8DTQWFuwQXHiewqi3ZBDNNWh",
+		"powalgorithm":         "sha256d",
+		"pubkeyaddrid":         "6f",
+		"privkeyaddrid":        "ef",
+		"netmagic":             netMagic,
+		"blockmatureconfirms":  100,
+		"payouttransactionfee": 10,
+		"coinbasetag":          tag,
+	}
+}
+
+func TestReloadCurrencies(t *testing.T) {
+	changed, removed, err := ReloadCurrencies(map[string]interface{}{
+		"rel_a": testCurrency(0xfeed0001, "/a/"),
+		"rel_b": testCurrency(0xfeed0002, "/b/"),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"REL_A", "REL_B"}, changed)
+	assert.Empty(t, removed)
+	a, ok := Currency("REL_A")
+	assert.True(t, ok)
+	codec, err := common.GetAddressCodec("REL_A")
+	assert.NoError(t, err)
+	assert.True(t, a.AddressCodec == codec)
+	assert.Equal(t, []byte("/a/"), a.CoinbaseTag)
+	assert.Equal(t, int64(546), a.DustThreshold)
+	b, _ := Currency("REL_B")
+
+	// An unchanged currency keeps its config, a changed one is decoded again
+	// under the network it already registered
+	changed, removed, err = ReloadCurrencies(map[string]interface{}{
+		"REL_A": testCurrency(0xfeed0001, "/a/"),
+		"REL_B": testCurrency(0xfeed0002, "/b2/"),
+		"REL_C": testCurrency(0xfeed0003, "/c/"),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"REL_B", "REL_C"}, changed)
+	again, _ := Currency("REL_A")
+	assert.True(t, a == again)
+	b2, _ := Currency("REL_B")
+	assert.Equal(t, []byte("/b2/"), b2.CoinbaseTag)
+	assert.Equal(t, []byte("/b/"), b.CoinbaseTag)
+
+	// Anything invalid leaves every currency as it was, including the
+	// address codecs of those that were decoded first
+	bad := testCurrency(0xfeed0004, "/d/")
+	bad["powalgorithm"] = "nope"
+	_, _, err = ReloadCurrencies(map[string]interface{}{
+		"REL_A": testCurrency(0xfeed0001, "/a2/"),
+		"REL_D": bad,
+		"REL_F": testCurrency(0xfeed0006, "/f/"),
+	})
+	assert.Error(t, err)
+	_, ok = Currency("REL_D")
+	assert.False(t, ok)
+	_, err = common.GetAddressCodec("REL_F")
+	assert.Error(t, err)
+	codec, _ = common.GetAddressCodec("REL_A")
+	assert.True(t, a.AddressCodec == codec)
+	assert.Len(t, Currencies(), 3)
+	// Nor can a currency take another's network
+	_, _, err = ReloadCurrencies(map[string]interface{}{
+		"REL_E": testCurrency(0xfeed0001, "/e/"),
+	})
+	assert.Error(t, err)
+
+	changed, removed, err = ReloadCurrencies(map[string]interface{}{
+		"REL_A": testCurrency(0xfeed0001, "/a/"),
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, changed)
+	assert.Equal(t, []string{"REL_B", "REL_C"}, removed)
+	assert.Len(t, Currencies(), 1)
+	assert.Len(t, RawCurrencies(), 1)
+	_, err = common.GetAddressCodec("REL_B")
+	assert.Error(t, err)
+}
+
+func TestMergeCurrencies(t *testing.T) {
+	common := map[string]interface{}{
+		"ltc_t": map[string]interface{}{"coinbasetag": "/common/"},
+		"btc_t": map[string]interface{}{"coinbasetag": "/common/"},
+	}
+	merged, err := mergeCurrencies(common, map[string]string{
+		"LTC_T": "CoinbaseTag: /key/\nBlockMatureConfirms: 100\n",
+	})
+	assert.NoError(t, err)
+	assert.Len(t, merged, 2)
+	assert.Equal(t, map[string]interface{}{"coinbasetag": "/common/"}, merged["BTC_T"])
+	assert.Equal(t, map[string]interface{}{"coinbasetag": "/key/", "blockmatureconfirms": 100},
+		merged["LTC_T"])
+
+	_, err = mergeCurrencies(common, map[string]string{"LTC_T": "[not a map"})
+	assert.Error(t, err)
+}
+
+func TestDecodeCurrencyColdWallet(t *testing.T) {
+	raw := testCurrency(0xfeed0101, "")
+	raw["hotwalletfloat"] = 100000000
+	_, err := DecodeCurrency("COLD_A", raw)
+	assert.Error(t, err)
+
+	raw["coldwalletaddress"] = raw["subsidyaddress"]
+	_, err = DecodeCurrency("COLD_A", raw)
+	assert.Error(t, err)
+
+	raw["coldwalletaddress"] = "mipcBbFg9gMiCh81Kj8tqqdgoZub1ZJRfn"
+	config, err := DecodeCurrency("COLD_A", raw)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100000000), config.HotWalletFloat)
+	assert.Equal(t, "mipcBbFg9gMiCh81Kj8tqqdgoZub1ZJRfn", config.ColdWalletAddress.String())
+
+	// Without a float there's no cold wallet
+	config, err = DecodeCurrency("COLD_B", testCurrency(0xfeed0102, ""))
+	assert.NoError(t, err)
+	assert.Nil(t, config.ColdWalletAddress)
+}
+
+func TestDecodeCurrencyPayoutFees(t *testing.T) {
+	config, err := DecodeCurrency("FEE_A", testCurrency(0xfeed0201, ""))
+	assert.NoError(t, err)
+	assert.Equal(t, "normal", config.PayoutUrgency)
+	assert.Equal(t, "priority", config.OnDemandPayoutUrgency)
+	assert.Equal(t, "miners", config.PayoutFeePaidBy)
+
+	raw := testCurrency(0xfeed0202, "")
+	raw["payouturgency"] = "whenever"
+	_, err = DecodeCurrency("FEE_B", raw)
+	assert.Error(t, err)
+
+	raw["payouturgency"] = "economy"
+	raw["payoutfeepaidby"] = "nobody"
+	_, err = DecodeCurrency("FEE_B", raw)
+	assert.Error(t, err)
+
+	raw["payoutfeepaidby"] = "pool"
+	raw["payoutfeeestimate"] = true
+	raw["payoutfeemax"] = 50
+	config, err = DecodeCurrency("FEE_B", raw)
+	assert.NoError(t, err)
+	assert.Equal(t, "economy", config.PayoutUrgency)
+	assert.Equal(t, "pool", config.PayoutFeePaidBy)
+	assert.True(t, config.PayoutFeeEstimate)
+	assert.Equal(t, 50, config.PayoutFeeMax)
+}
@@ -0,0 +1,47 @@
+package service
+
+import (
+	"os"
+	"regexp"
+
+	"github.com/coreos/etcd/client"
+	"github.com/pkg/errors"
+)
+
+// Several separate pools can share one etcd cluster by each setting a
+// deployment name. Every key a deployment uses then lives under
+// /ngpool/<deployment>, ie /ngpool/ltc-eu/config/common, and services only
+// discover others in the same deployment. Unset keeps keys at the root
+const DeploymentEnv = "NGPOOL_DEPLOYMENT"
+
+// The etcd client's own prefix for the v2 keys API, which our prefix goes on
+const etcdKeysPrefix = "/v2/keys"
+
+var deploymentRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+func ValidateDeployment(deployment string) error {
+	if deployment != "" && !deploymentRegexp.MatchString(deployment) {
+		return errors.Errorf("Invalid deployment %q, use letters, numbers, '_', '.' and '-', starting with a letter or number",
+			deployment)
+	}
+	return nil
+}
+
+// Where a deployment's keys live, "" for the root
+func DeploymentRoot(deployment string) string {
+	if deployment == "" {
+		return ""
+	}
+	return "/ngpool/" + deployment
+}
+
+// A keys API that puts every key under the deployment's root. Keys in
+// responses still have the full path, and nothing we do looks past their
+// last segment
+func NewDeploymentKeysAPI(etcd client.Client, deployment string) client.KeysAPI {
+	return client.NewKeysAPIWithPrefix(etcd, etcdKeysPrefix+DeploymentRoot(deployment))
+}
+
+func DeploymentFromEnv() string {
+	return os.Getenv(DeploymentEnv)
+}
@@ -0,0 +1,18 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeployment(t *testing.T) {
+	assert.NoError(t, ValidateDeployment(""))
+	assert.NoError(t, ValidateDeployment("ltc-eu.2"))
+	assert.Error(t, ValidateDeployment("ltc/eu"))
+	assert.Error(t, ValidateDeployment("a b"))
+	assert.Error(t, ValidateDeployment(".."))
+
+	assert.Equal(t, "", DeploymentRoot(""))
+	assert.Equal(t, "/ngpool/ltc-eu", DeploymentRoot("ltc-eu"))
+}
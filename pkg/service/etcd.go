@@ -0,0 +1,217 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	log "github.com/inconshreveable/log15"
+	"github.com/pkg/errors"
+)
+
+// The default backend, etcd's v2 keys API. Statuses are keys with a TTL
+// under /status/<namespace>, and watches follow etcd's index
+type etcdBackend struct {
+	keys client.KeysAPI
+}
+
+func NewEtcdBackend(endpoints []string, deployment string) (Backend, error) {
+	cfg := client.Config{
+		Endpoints: endpoints,
+		Transport: client.DefaultTransport,
+		// set timeout per request to fail fast when the target endpoint is unavailable
+		HeaderTimeoutPerRequest: time.Second,
+	}
+	etcd, err := client.New(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to make etcd client")
+	}
+	return &etcdBackend{keys: NewDeploymentKeysAPI(etcd, deployment)}, nil
+}
+
+func isKeyNotFound(err error) bool {
+	cerr, ok := err.(client.Error)
+	return ok && cerr.Code == client.ErrorCodeKeyNotFound
+}
+
+func (e *etcdBackend) Get(key string) (string, error) {
+	res, err := e.keys.Get(context.Background(), key, nil)
+	if isKeyNotFound(err) {
+		return "", ErrKeyNotFound
+	} else if err != nil {
+		return "", err
+	}
+	return res.Node.Value, nil
+}
+
+func (e *etcdBackend) List(prefix string, index uint64) (map[string]string, uint64, error) {
+	if index > 0 {
+		watcher := e.keys.Watcher(prefix, &client.WatcherOptions{
+			AfterIndex: index,
+			Recursive:  true,
+		})
+		if _, err := watcher.Next(context.Background()); err != nil {
+			return nil, 0, err
+		}
+	}
+	values := map[string]string{}
+	res, err := e.keys.Get(context.Background(), prefix, &client.GetOptions{Recursive: true})
+	if cerr, ok := err.(client.Error); ok && cerr.Code == client.ErrorCodeKeyNotFound {
+		return values, cerr.Index, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+	for _, node := range res.Node.Nodes {
+		if !node.Dir {
+			values[node.Key[strings.LastIndexByte(node.Key, '/')+1:]] = node.Value
+		}
+	}
+	return values, res.Index, nil
+}
+
+// Parses a status value stored under key, which ends in the service's ID
+func parseStatus(key string, value string) (string, *ServiceStatus) {
+	lbi := strings.LastIndexByte(key, '/') + 1
+	serviceID := key[lbi:]
+	var status ServiceStatus
+	json.Unmarshal([]byte(value), &status)
+	status.ServiceID = serviceID
+	return serviceID, &status
+}
+
+func (e *etcdBackend) Services(namespace string) (map[string]*ServiceStatus, uint64, error) {
+	var services map[string]*ServiceStatus = make(map[string]*ServiceStatus)
+	var watchStatusKeypath string = "/status/" + namespace
+
+	getOpt := &client.GetOptions{
+		Recursive: true,
+	}
+	res, err := e.keys.Get(context.Background(), watchStatusKeypath, getOpt)
+	// If service key doesn't exist, create it so watcher can start
+	if isKeyNotFound(err) {
+		log.Info("Creating empty dir in etcd", "dir", watchStatusKeypath)
+		res, err := e.keys.Set(context.Background(), watchStatusKeypath,
+			"", &client.SetOptions{Dir: true})
+		if err != nil {
+			return nil, 0, err
+		}
+		return services, res.Index, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+	for _, node := range res.Node.Nodes {
+		serviceID, serviceStatus := parseStatus(node.Key, node.Value)
+		services[serviceID] = serviceStatus
+	}
+	return services, res.Index, nil
+}
+
+func (e *etcdBackend) WatchServices(namespace string, known map[string]*ServiceStatus,
+	index uint64) ServiceWatch {
+	return &etcdServiceWatch{
+		watcher: e.keys.Watcher("/status/"+namespace, &client.WatcherOptions{
+			AfterIndex: index,
+			Recursive:  true,
+		}),
+	}
+}
+
+type etcdServiceWatch struct {
+	watcher client.Watcher
+}
+
+func (w *etcdServiceWatch) Next() (string, *ServiceStatus, error) {
+	for {
+		res, err := w.watcher.Next(context.Background())
+		if err != nil {
+			return "", nil, err
+		}
+		serviceID, serviceStatus := parseStatus(res.Node.Key, res.Node.Value)
+		switch res.Action {
+		case "expire":
+			return serviceID, nil, nil
+		case "set", "update":
+			return serviceID, serviceStatus, nil
+		}
+		log.Debug("Ignoring watch update type ", res.Action)
+	}
+}
+
+func (e *etcdBackend) SetStatus(namespace string, serviceID string, value string,
+	ttl time.Duration, refresh bool) error {
+	opt := &client.SetOptions{TTL: ttl}
+	if refresh {
+		opt.Refresh = true
+		opt.PrevExist = client.PrevExist
+		value = ""
+	}
+	_, err := e.keys.Set(context.Background(), "/status/"+namespace+"/"+serviceID, value, opt)
+	return err
+}
+
+func (e *etcdBackend) Claim(key string, owner string, ttl time.Duration) (bool, error) {
+	_, err := e.keys.Set(context.Background(), key, owner,
+		&client.SetOptions{TTL: ttl, PrevExist: client.PrevNoExist})
+	if cerr, ok := err.(client.Error); ok && cerr.Code == client.ErrorCodeNodeExist {
+		// Ours already if it's still got our name on it
+		_, err = e.keys.Set(context.Background(), key, owner,
+			&client.SetOptions{TTL: ttl, PrevValue: owner})
+		if cerr, ok := err.(client.Error); ok &&
+			(cerr.Code == client.ErrorCodeTestFailed || cerr.Code == client.ErrorCodeKeyNotFound) {
+			return false, nil
+		}
+	}
+	return err == nil, err
+}
+
+func (e *etcdBackend) Release(key string, owner string) error {
+	_, err := e.keys.Delete(context.Background(), key,
+		&client.DeleteOptions{PrevValue: owner})
+	if cerr, ok := err.(client.Error); ok &&
+		(cerr.Code == client.ErrorCodeTestFailed || cerr.Code == client.ErrorCodeKeyNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (e *etcdBackend) WatchControl(namespace string, serviceID string) (ControlWatch, error) {
+	key := ControlKey(namespace, serviceID)
+	// Watch from the key's current index, so commands written before we
+	// started are skipped
+	var startIndex uint64
+	res, err := e.keys.Get(context.Background(), key, nil)
+	if cerr, ok := err.(client.Error); ok && cerr.Code == client.ErrorCodeKeyNotFound {
+		startIndex = cerr.Index
+	} else if err != nil {
+		return nil, err
+	} else {
+		startIndex = res.Index
+	}
+	return &etcdControlWatch{
+		keys:    e.keys,
+		key:     key,
+		watcher: e.keys.Watcher(key, &client.WatcherOptions{AfterIndex: startIndex}),
+	}, nil
+}
+
+type etcdControlWatch struct {
+	keys    client.KeysAPI
+	key     string
+	watcher client.Watcher
+}
+
+func (w *etcdControlWatch) Next() (string, uint64, error) {
+	res, err := w.watcher.Next(context.Background())
+	if err != nil {
+		return "", 0, err
+	}
+	return res.Node.Value, res.Node.ModifiedIndex, nil
+}
+
+func (w *etcdControlWatch) Result(value string, index uint64) error {
+	_, err := w.keys.Set(context.Background(), w.key, value,
+		&client.SetOptions{PrevIndex: index, TTL: controlResultTTL})
+	return err
+}
@@ -0,0 +1,146 @@
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+// Topics published on a service's EventBus
+const (
+	// A new job was sent to miners. Data is a JobEvent
+	EventJobNew = "job.new"
+	// A share passed validation. Data is a ShareEvent
+	EventShareAccepted = "share.accepted"
+	// A share solved a block, published once per currency. Data is a BlockEvent
+	EventBlockFound = "block.found"
+	// A watched service appeared in or expired from etcd. Data is a
+	// ServiceStatusUpdate
+	EventServiceUp   = "service.up"
+	EventServiceDown = "service.down"
+	// Our own status updates to service discovery started failing, or
+	// recovered. Data is a DiscoveryEvent
+	EventDiscoveryDown = "discovery.down"
+	EventDiscoveryUp   = "discovery.up"
+)
+
+type Event struct {
+	Topic string
+	Time  time.Time
+	Data  interface{}
+}
+
+type JobEvent struct {
+	Currency string
+	// Heights of the main chain and every aux chain in the job
+	Heights map[string]int64
+	Flush   bool
+}
+
+type ShareEvent struct {
+	Username   string
+	Worker     string
+	Difficulty float64
+	Currencies []string
+	Blocks     int
+	MinedAt    time.Time
+}
+
+type BlockEvent struct {
+	Currency string
+	Height   int64
+	Hash     string
+	Subsidy  int64
+	PowAlgo  string
+	MinedBy  string
+	MinedAt  time.Time
+}
+
+type DiscoveryEvent struct {
+	Err   error
+	Since time.Time
+}
+
+// EventBus lets things that only watch what a service is doing (metrics,
+// websockets, persistence) attach without being wired into the loops doing
+// the work. Publishing never blocks: a subscriber whose buffer is full misses
+// the event, and it's counted in Dropped. Anything that can't miss events
+// should keep getting them over its own channel
+type EventBus struct {
+	subs    map[chan Event]map[string]bool
+	dropped map[string]int64
+	mtx     sync.RWMutex
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subs:    map[chan Event]map[string]bool{},
+		dropped: map[string]int64{},
+	}
+}
+
+// Returns a channel getting events for the given topics, or every topic if
+// none are given
+func (b *EventBus) Subscribe(buflen int, topics ...string) <-chan Event {
+	ch := make(chan Event, buflen)
+	var filter map[string]bool
+	if len(topics) > 0 {
+		filter = map[string]bool{}
+		for _, topic := range topics {
+			filter[topic] = true
+		}
+	}
+	b.mtx.Lock()
+	b.subs[ch] = filter
+	b.mtx.Unlock()
+	return ch
+}
+
+// Stops and closes a channel from Subscribe
+func (b *EventBus) Unsubscribe(sub <-chan Event) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	for ch := range b.subs {
+		if ch == sub {
+			delete(b.subs, ch)
+			close(ch)
+			return
+		}
+	}
+}
+
+// Safe to call on a nil bus, so publishers don't need to check for one
+func (b *EventBus) Publish(topic string, data interface{}) {
+	if b == nil {
+		return
+	}
+	event := Event{Topic: topic, Time: time.Now(), Data: data}
+	b.mtx.RLock()
+	var dropped int64
+	for ch, filter := range b.subs {
+		if filter != nil && !filter[topic] {
+			continue
+		}
+		select {
+		case ch <- event:
+		default:
+			dropped++
+		}
+	}
+	b.mtx.RUnlock()
+	if dropped > 0 {
+		b.mtx.Lock()
+		b.dropped[topic] += dropped
+		b.mtx.Unlock()
+	}
+}
+
+// Events missed by slow subscribers since startup, by topic
+func (b *EventBus) Dropped() map[string]int64 {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+	dropped := map[string]int64{}
+	for topic, count := range b.dropped {
+		dropped[topic] = count
+	}
+	return dropped
+}
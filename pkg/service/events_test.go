@@ -0,0 +1,45 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventBus(t *testing.T) {
+	bus := NewEventBus()
+	all := bus.Subscribe(10)
+	blocks := bus.Subscribe(10, EventBlockFound)
+
+	bus.Publish(EventShareAccepted, ShareEvent{Username: "joe"})
+	bus.Publish(EventBlockFound, BlockEvent{Currency: "LTC", Height: 10})
+
+	event := <-all
+	assert.Equal(t, EventShareAccepted, event.Topic)
+	assert.Equal(t, "joe", event.Data.(ShareEvent).Username)
+	event = <-all
+	assert.Equal(t, EventBlockFound, event.Topic)
+
+	event = <-blocks
+	assert.Equal(t, int64(10), event.Data.(BlockEvent).Height)
+	assert.Len(t, blocks, 0)
+
+	bus.Unsubscribe(blocks)
+	_, ok := <-blocks
+	assert.False(t, ok)
+	bus.Publish(EventBlockFound, BlockEvent{})
+	assert.Len(t, all, 1)
+}
+
+func TestEventBusDropped(t *testing.T) {
+	bus := NewEventBus()
+	slow := bus.Subscribe(1)
+	bus.Publish(EventJobNew, JobEvent{Currency: "LTC"})
+	bus.Publish(EventJobNew, JobEvent{Currency: "LTC"})
+	bus.Publish(EventJobNew, JobEvent{Currency: "LTC"})
+	assert.Len(t, slow, 1)
+	assert.Equal(t, map[string]int64{EventJobNew: 2}, bus.Dropped())
+
+	var nilBus *EventBus
+	nilBus.Publish(EventJobNew, nil)
+}
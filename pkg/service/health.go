@@ -0,0 +1,123 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Health backs the /healthz and /readyz endpoints services expose for
+// orchestration probes. /healthz only runs liveness checks, which should fail
+// when the process is wedged and needs restarting. /readyz runs every check,
+// and failing it just means we shouldn't be sent traffic yet
+type Health struct {
+	checks map[string]healthCheck
+	mtx    sync.RWMutex
+}
+
+type healthCheck struct {
+	liveness bool
+	check    func() error
+}
+
+func NewHealth() *Health {
+	return &Health{checks: map[string]healthCheck{}}
+}
+
+// Checks are called on every probe, so they should read state that's already
+// been collected rather than making network calls
+func (h *Health) AddCheck(name string, liveness bool, check func() error) {
+	h.mtx.Lock()
+	h.checks[name] = healthCheck{liveness, check}
+	h.mtx.Unlock()
+}
+
+// Runs the checks for a probe, returning the HTTP status to answer with and
+// the result of each check, "ok" or the error
+func (h *Health) Status(liveness bool) (int, map[string]string) {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+	status := http.StatusOK
+	results := map[string]string{}
+	for name, hc := range h.checks {
+		if liveness && !hc.liveness {
+			continue
+		}
+		if err := hc.check(); err != nil {
+			status = http.StatusServiceUnavailable
+			results[name] = err.Error()
+		} else {
+			results[name] = "ok"
+		}
+	}
+	return status, results
+}
+
+// Names of the registered checks, sorted
+func (h *Health) Checks() []string {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+	names := []string{}
+	for name := range h.checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Handler for /healthz when liveness is set, /readyz otherwise
+func (h *Health) Handler(liveness bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status, results := h.Status(liveness)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"healthy": status == http.StatusOK,
+			"checks":  results,
+		})
+	}
+}
+
+// A check that fails if mark hasn't been called within maxAge, or at all
+type Heartbeat struct {
+	name string
+	last time.Time
+	err  error
+	mtx  sync.Mutex
+}
+
+func NewHeartbeat(name string) *Heartbeat {
+	return &Heartbeat{name: name}
+}
+
+// Records the outcome of an attempt. A nil error counts as a beat
+func (b *Heartbeat) Mark(err error, now time.Time) {
+	b.mtx.Lock()
+	b.err = err
+	if err == nil {
+		b.last = now
+	}
+	b.mtx.Unlock()
+}
+
+func (b *Heartbeat) Check(maxAge time.Duration, now time.Time) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.last.IsZero() {
+		if b.err != nil {
+			return errors.Wrapf(b.err, "No %s yet", b.name)
+		}
+		return errors.Errorf("No %s yet", b.name)
+	}
+	if b.err != nil {
+		return errors.Wrapf(b.err, "Last %s failed", b.name)
+	}
+	if maxAge > 0 && now.Sub(b.last) > maxAge {
+		return errors.Errorf("Last %s was %s ago", b.name, now.Sub(b.last).Truncate(time.Second))
+	}
+	return nil
+}
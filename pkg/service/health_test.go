@@ -0,0 +1,40 @@
+package service
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthStatus(t *testing.T) {
+	h := NewHealth()
+	h.AddCheck("listener", true, func() error { return nil })
+	h.AddCheck("etcd", false, func() error { return errors.New("unreachable") })
+
+	status, results := h.Status(true)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, map[string]string{"listener": "ok"}, results)
+
+	status, results = h.Status(false)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, map[string]string{"listener": "ok", "etcd": "unreachable"}, results)
+	assert.Equal(t, []string{"etcd", "listener"}, h.Checks())
+}
+
+func TestHeartbeat(t *testing.T) {
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := NewHeartbeat("ping")
+	assert.Error(t, b.Check(time.Minute, now))
+
+	b.Mark(nil, now)
+	assert.NoError(t, b.Check(time.Minute, now.Add(time.Second*30)))
+	assert.Error(t, b.Check(time.Minute, now.Add(time.Minute*2)))
+	// No max age only cares about the last attempt
+	assert.NoError(t, b.Check(0, now.Add(time.Hour)))
+
+	b.Mark(errors.New("refused"), now.Add(time.Second))
+	assert.Error(t, b.Check(time.Minute, now.Add(time.Second)))
+}
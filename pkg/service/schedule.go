@@ -0,0 +1,63 @@
+package service
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// How often payouts are made. The spec is a small subset of cron
+// descriptors: "@always" pays every time the signer runs, "@hourly", "@daily"
+// and "@weekly" do what you'd expect, and "@every 6h" takes any Go duration.
+// An empty spec is the same as "@always"
+type Schedule struct {
+	Spec     string
+	Interval time.Duration
+}
+
+func ParseSchedule(spec string) (*Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	s := &Schedule{Spec: spec}
+	switch spec {
+	case "", "@always":
+		s.Spec = "@always"
+	case "@hourly":
+		s.Interval = time.Hour
+	case "@daily":
+		s.Interval = 24 * time.Hour
+	case "@weekly":
+		s.Interval = 7 * 24 * time.Hour
+	default:
+		if !strings.HasPrefix(spec, "@every ") {
+			return nil, errors.Errorf("Unrecognized schedule '%s'", spec)
+		}
+		interval, err := time.ParseDuration(strings.TrimPrefix(spec, "@every "))
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid schedule '%s'", spec)
+		}
+		if interval <= 0 {
+			return nil, errors.Errorf("Schedule interval must be positive '%s'", spec)
+		}
+		s.Interval = interval
+	}
+	return s, nil
+}
+
+// Returns when the next payout is due given when the last one started. Times
+// are aligned to the interval, so "@daily" is due at midnight UTC no matter
+// what time yesterday's payout happened
+func (s *Schedule) Next(last time.Time) time.Time {
+	if s.Interval == 0 {
+		return last
+	}
+	return last.UTC().Truncate(s.Interval).Add(s.Interval)
+}
+
+// last is nil if there's never been a payout
+func (s *Schedule) Due(last *time.Time, now time.Time) bool {
+	if last == nil {
+		return true
+	}
+	return !now.Before(s.Next(*last))
+}
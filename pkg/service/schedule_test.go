@@ -0,0 +1,36 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSchedule(t *testing.T) {
+	s, err := ParseSchedule("")
+	assert.NoError(t, err)
+	assert.Equal(t, "@always", s.Spec)
+	assert.Equal(t, time.Duration(0), s.Interval)
+
+	s, err = ParseSchedule("@every 30m")
+	assert.NoError(t, err)
+	assert.Equal(t, 30*time.Minute, s.Interval)
+
+	_, err = ParseSchedule("0 * * * *")
+	assert.Error(t, err)
+	_, err = ParseSchedule("@every -1h")
+	assert.Error(t, err)
+}
+
+func TestScheduleDue(t *testing.T) {
+	s, _ := ParseSchedule("@daily")
+	last := time.Date(2018, 1, 1, 18, 30, 0, 0, time.UTC)
+	assert.Equal(t, time.Date(2018, 1, 2, 0, 0, 0, 0, time.UTC), s.Next(last))
+	assert.False(t, s.Due(&last, last.Add(time.Hour)))
+	assert.True(t, s.Due(&last, last.Add(6*time.Hour)))
+	assert.True(t, s.Due(nil, last))
+
+	always, _ := ParseSchedule("@always")
+	assert.True(t, always.Due(&last, last))
+}
@@ -1,13 +1,14 @@
 package service
 
 import (
-	"context"
 	"encoding/json"
-	"github.com/coreos/etcd/client"
 	log "github.com/inconshreveable/log15"
+	"github.com/pkg/errors"
 	"github.com/spf13/viper"
 	_ "github.com/spf13/viper/remote"
 	"os"
+	"reflect"
+	"sort"
 	"strings"
 	"time"
 )
@@ -16,9 +17,29 @@ type Service struct {
 	Name       string
 	PushStatus chan map[string]interface{}
 	namespace  string
-	etcdKeys   client.KeysAPI
+	backend    Backend
+	// Beats each time KeepAlive writes our status
+	statusHealth *Heartbeat
+	// Config and services last read from the backend, used while it's
+	// unreachable
+	cache *DiskCache
+
+	controlHandlers map[string]ControlHandler
+	beforeRestart   []func()
+
+	// ServiceWatcher publishes service.up and service.down here
+	Events *EventBus
+
+	// The common config's Currencies and the currency keys last applied,
+	// see WatchCurrencies
+	commonCurrencies map[string]interface{}
+	currencyKeys     map[string]string
 }
 
+// Currencies can also be kept one to a key, ie /config/currencies/LTC_T, in
+// the same form as an entry of the common config's Currencies
+const currencyConfigPrefix = "/config/currencies"
+
 type ServiceStatusUpdate struct {
 	ServiceType string
 	ServiceID   string
@@ -33,51 +54,90 @@ type ServiceStatus struct {
 	UpdateTime time.Time              `json:"update_time"`
 }
 
+// Uses the discovery backend picked in the environment, see BackendFromEnv,
+// which is etcd at etcdEndpoints unless told otherwise
 func NewService(namespace string, etcdEndpoints []string) *Service {
-	cfg := client.Config{
-		Endpoints: etcdEndpoints,
-		Transport: client.DefaultTransport,
-		// set timeout per request to fail fast when the target endpoint is unavailable
-		HeaderTimeoutPerRequest: time.Second,
+	deployment := DeploymentFromEnv()
+	if err := ValidateDeployment(deployment); err != nil {
+		log.Crit("Invalid "+DeploymentEnv, "err", err)
+		os.Exit(1)
 	}
-	etcd, err := client.New(cfg)
+	backend, err := BackendFromEnv(etcdEndpoints, deployment)
 	if err != nil {
-		log.Crit("Failed to make etcd client", "err", err)
+		log.Crit("Failed to set up discovery", "err", err)
 		os.Exit(1)
 	}
 
 	s := &Service{
-		namespace:  namespace,
-		etcdKeys:   client.NewKeysAPI(etcd),
-		PushStatus: make(chan map[string]interface{}),
+		namespace:    namespace,
+		backend:      backend,
+		PushStatus:   make(chan map[string]interface{}),
+		Events:       NewEventBus(),
+		statusHealth: NewHeartbeat("status update"),
+		cache:        NewDiskCache(CacheDirFromEnv(), deployment),
 	}
 	return s
 }
 
+// Reads a config key from the backend, keeping a copy on disk. If it can't
+// be reached the copy is used instead, so we can start during an outage
+func (s *Service) getConfig(key string) (string, error) {
+	value, err := s.backend.Get(key)
+	if err == nil {
+		if err := s.cache.Save(key, value); err != nil {
+			log.Warn("Failed to cache config", "key", key, "err", err)
+		}
+		return value, nil
+	}
+	// A missing key is a real answer, not an outage
+	if err == ErrKeyNotFound {
+		return "", errors.Wrap(err, key)
+	}
+	savedAt, cacheErr := s.cache.Load(key, &value)
+	if cacheErr != nil {
+		return "", err
+	}
+	log.Warn("Unable to contact discovery backend, using cached config", "key", key,
+		"cached_at", savedAt, "err", err)
+	return value, nil
+}
+
 func (s *Service) LoadServiceConfig(config *viper.Viper, name string) {
 	s.Name = name
 
-	keyPath := "/config/" + s.namespace + "/" + s.Name
-	res, err := s.etcdKeys.Get(context.Background(), keyPath, nil)
+	value, err := s.getConfig("/config/" + s.namespace + "/" + s.Name)
 	if err != nil {
-		log.Crit("Unable to contact etcd", "err", err)
+		log.Crit("Unable to load config", "err", err)
 		os.Exit(1)
 	}
 	config.SetConfigType("yaml")
-	config.MergeConfig(strings.NewReader(res.Node.Value))
+	config.MergeConfig(strings.NewReader(value))
 }
 
 func (s *Service) LoadCommonConfig() *viper.Viper {
-	res, err := s.etcdKeys.Get(context.Background(), "/config/common", nil)
+	value, err := s.getConfig("/config/common")
 	if err != nil {
-		log.Crit("Unable to contact etcd", "err", err)
+		log.Crit("Unable to load config", "err", err)
 		os.Exit(1)
 	}
 	config := viper.New()
 	config.SetConfigType("yaml")
-	config.MergeConfig(strings.NewReader(res.Node.Value))
+	config.MergeConfig(strings.NewReader(value))
 
-	SetupCurrencies(config.GetStringMap("Currencies"))
+	SetupAlgos(config.GetStringMap("Algos"))
+	s.commonCurrencies = config.GetStringMap("Currencies")
+	keys, err := s.listCurrencies()
+	if err != nil {
+		log.Crit("Unable to load currencies", "err", err)
+		os.Exit(1)
+	}
+	currencies, err := mergeCurrencies(s.commonCurrencies, keys)
+	if err != nil {
+		log.Crit("Unable to load currencies", "err", err)
+		os.Exit(1)
+	}
+	SetupCurrencies(currencies)
+	s.currencyKeys = keys
 	SetupShareChains(config.GetStringMap("ShareChains"))
 	sub := config.Sub(s.namespace)
 	if sub == nil {
@@ -86,49 +146,170 @@ func (s *Service) LoadCommonConfig() *viper.Viper {
 	return sub
 }
 
-func (s *Service) parseNode(node *client.Node) (string, *ServiceStatus) {
-	// Parse all the node details about the watcher
-	lbi := strings.LastIndexByte(node.Key, '/') + 1
-	serviceID := node.Key[lbi:]
-	var status ServiceStatus
-	json.Unmarshal([]byte(node.Value), &status)
-	status.ServiceID = serviceID
-	return serviceID, &status
+// Lists the currency keys, keeping a copy on disk like getConfig
+func (s *Service) listCurrencies() (map[string]string, error) {
+	keys, _, err := s.backend.List(currencyConfigPrefix, 0)
+	if err == nil {
+		if err := s.cache.Save(currencyConfigPrefix, keys); err != nil {
+			log.Warn("Failed to cache currencies", "err", err)
+		}
+		return keys, nil
+	}
+	savedAt, cacheErr := s.cache.Load(currencyConfigPrefix, &keys)
+	if cacheErr != nil {
+		return nil, err
+	}
+	log.Warn("Unable to contact discovery backend, using cached currencies",
+		"cached_at", savedAt, "err", err)
+	return keys, nil
+}
+
+// Currencies from the common config with those in currency keys laid over
+// them. A currency key replaces the common config's currency of the same
+// code entirely
+func mergeCurrencies(common map[string]interface{}, keys map[string]string) (map[string]interface{}, error) {
+	currencies := map[string]interface{}{}
+	for code, raw := range common {
+		currencies[strings.ToUpper(code)] = raw
+	}
+	for code, value := range keys {
+		parsed := viper.New()
+		parsed.SetConfigType("yaml")
+		if err := parsed.ReadConfig(strings.NewReader(value)); err != nil {
+			return nil, errors.Wrapf(err, "Invalid YAML in %s/%s", currencyConfigPrefix, code)
+		}
+		currencies[strings.ToUpper(code)] = parsed.AllSettings()
+	}
+	return currencies, nil
+}
+
+// Watches the currency keys, applying currencies added, changed or removed
+// there while we run. A change that doesn't parse or validate is logged and
+// ignored, leaving every currency as it was. Changes to the common config's
+// Currencies still need a restart
+func (s *Service) WatchCurrencies() {
+	var index uint64
+	for {
+		keys, newIndex, err := s.backend.List(currencyConfigPrefix, index)
+		if err != nil {
+			log.Warn("Error from currency watcher", "err", err)
+			time.Sleep(time.Second * 2)
+			// Our index may be too old to wait on, start over from a
+			// fresh pull
+			index = 0
+			continue
+		}
+		index = newIndex
+		if reflect.DeepEqual(keys, s.currencyKeys) {
+			continue
+		}
+		if err := s.cache.Save(currencyConfigPrefix, keys); err != nil {
+			log.Warn("Failed to cache currencies", "err", err)
+		}
+		s.currencyKeys = keys
+		currencies, err := mergeCurrencies(s.commonCurrencies, keys)
+		if err != nil {
+			log.Error("Ignoring invalid currency config", "err", err)
+			continue
+		}
+		changed, removed, err := ReloadCurrencies(currencies)
+		if err != nil {
+			log.Error("Ignoring invalid currency config", "err", err)
+			continue
+		}
+		if len(changed) > 0 || len(removed) > 0 {
+			log.Info("Reloaded currencies", "changed", changed, "removed", removed)
+		}
+	}
+}
+
+// Reads our config from the backend again, the same as LoadCommonConfig and
+// LoadServiceConfig at startup, for reload-config. Currencies and
+// sharechains are left as they were
+func (s *Service) FetchConfig() (*viper.Viper, error) {
+	value, err := s.backend.Get("/config/common")
+	if err != nil {
+		return nil, err
+	}
+	common := viper.New()
+	common.SetConfigType("yaml")
+	err = common.MergeConfig(strings.NewReader(value))
+	if err != nil {
+		return nil, err
+	}
+	config := common.Sub(s.namespace)
+	if config == nil {
+		config = viper.New()
+	}
+	value, err = s.backend.Get("/config/" + s.namespace + "/" + s.Name)
+	if err != nil {
+		return nil, err
+	}
+	config.SetConfigType("yaml")
+	err = config.MergeConfig(strings.NewReader(value))
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
 }
 
 // Requests all services of a specific namespace. This is used in the same
-// context as ServiceWatcher, except for simple script executions
+// context as ServiceWatcher, except for simple script executions. While the
+// backend is unreachable the services last seen are returned
 func (s *Service) LoadServices(namespace string) (map[string]*ServiceStatus, error) {
 	statuses, _, err := s.loadServices(namespace)
-	return statuses, err
+	if err != nil {
+		return s.cachedServices(namespace, err)
+	}
+	return statuses, nil
+}
+
+func (s *Service) cachedServices(namespace string, backendErr error) (map[string]*ServiceStatus, error) {
+	var statuses map[string]*ServiceStatus
+	savedAt, err := s.cache.Load("/status/"+namespace, &statuses)
+	if err != nil {
+		return nil, backendErr
+	}
+	log.Warn("Unable to contact discovery backend, using cached services", "namespace", namespace,
+		"services", len(statuses), "cached_at", savedAt, "err", backendErr)
+	return statuses, nil
 }
 
 func (s *Service) loadServices(namespace string) (map[string]*ServiceStatus, uint64, error) {
-	var services map[string]*ServiceStatus = make(map[string]*ServiceStatus)
-	var watchStatusKeypath string = "/status/" + namespace
-
-	getOpt := &client.GetOptions{
-		Recursive: true,
-	}
-	res, err := s.etcdKeys.Get(context.Background(), watchStatusKeypath, getOpt)
-	// If service key doesn't exist, create it so watcher can start
-	if cerr, ok := err.(client.Error); ok && cerr.Code == client.ErrorCodeKeyNotFound {
-		log.Info("Creating empty dir in etcd", "dir", watchStatusKeypath)
-		_, err := s.etcdKeys.Set(context.Background(), watchStatusKeypath,
-			"", &client.SetOptions{Dir: true})
-		if err != nil {
-			return nil, 0, err
-		}
-		return nil, 0, nil
-	} else if err != nil {
+	services, index, err := s.backend.Services(namespace)
+	if err != nil {
 		return nil, 0, err
-	} else {
-		for _, node := range res.Node.Nodes {
-			serviceID, serviceStatus := s.parseNode(node)
-			services[serviceID] = serviceStatus
+	}
+	if err := s.cache.Save("/status/"+namespace, services); err != nil {
+		log.Warn("Failed to cache services", "namespace", namespace, "err", err)
+	}
+	return services, index, nil
+}
+
+// The updates that take known to current, for catching up after the watch
+// was interrupted. Every service still present counts as updated, the same
+// as a status write would
+func diffServices(namespace string, known map[string]*ServiceStatus,
+	current map[string]*ServiceStatus) []ServiceStatusUpdate {
+	var updates []ServiceStatusUpdate
+	for id, status := range known {
+		if _, ok := current[id]; !ok {
+			updates = append(updates, ServiceStatusUpdate{
+				ServiceType: namespace, ServiceID: id, Status: status, Action: "removed"})
+		}
+	}
+	for id, status := range current {
+		action := "added"
+		if _, ok := known[id]; ok {
+			action = "updated"
 		}
+		updates = append(updates, ServiceStatusUpdate{
+			ServiceType: namespace, ServiceID: id, Status: status, Action: action})
 	}
-	return services, res.Index, nil
+	sort.Slice(updates, func(i, j int) bool {
+		return updates[i].ServiceID < updates[j].ServiceID
+	})
+	return updates
 }
 
 // This watches for services of a specific namespace to change, and broadcasts
@@ -136,54 +317,83 @@ func (s *Service) loadServices(namespace string) (map[string]*ServiceStatus, uin
 // to the reciever
 func (s *Service) ServiceWatcher(watchNamespace string) (chan ServiceStatusUpdate, error) {
 	var (
-		services           map[string]*ServiceStatus = make(map[string]*ServiceStatus)
-		watchStatusKeypath string                    = "/status/" + watchNamespace
 		// We assume you have no more than 1000 services... Sloppy!
 		updates chan ServiceStatusUpdate = make(chan ServiceStatusUpdate, 1000)
 	)
 
+	// Without the backend we start from the services last seen, and catch
+	// up once it's back
 	services, startIndex, err := s.loadServices(watchNamespace)
+	resync := false
 	if err != nil {
-		return nil, err
+		services, err = s.cachedServices(watchNamespace, err)
+		if err != nil {
+			return nil, err
+		}
+		resync = true
+	}
+	if services == nil {
+		services = map[string]*ServiceStatus{}
 	}
 	for _, svc := range services {
-		services[svc.ServiceID] = svc
-		updates <- ServiceStatusUpdate{
+		update := ServiceStatusUpdate{
 			ServiceType: watchNamespace,
 			ServiceID:   svc.ServiceID,
 			Status:      svc,
 			Action:      "added",
 		}
+		updates <- update
+		s.Events.Publish(EventServiceUp, update)
 	}
 
-	// Start a watcher for all changes after the pull we're doing
-	watchOpt := &client.WatcherOptions{
-		AfterIndex: startIndex,
-		Recursive:  true,
-	}
-	watcher := s.etcdKeys.Watcher(watchStatusKeypath, watchOpt)
 	go func() {
+		var watch ServiceWatch
 		for {
-			res, err := watcher.Next(context.Background())
+			// After an error we may have missed changes, or our index may be
+			// too old to watch from, so start over from a fresh pull
+			if resync {
+				current, index, err := s.loadServices(watchNamespace)
+				if err != nil {
+					log.Warn("Unable to resync services", "namespace", watchNamespace, "err", err)
+					time.Sleep(time.Second * 2)
+					continue
+				}
+				for _, update := range diffServices(watchNamespace, services, current) {
+					if update.Action == "removed" {
+						delete(services, update.ServiceID)
+					} else {
+						services[update.ServiceID] = update.Status
+					}
+					s.publishUpdate(updates, update)
+				}
+				log.Info("Resynced services", "namespace", watchNamespace,
+					"services", len(services))
+				startIndex = index
+				watch = nil
+				resync = false
+			}
+			// Start a watcher for all changes after the pull we're doing
+			if watch == nil {
+				watch = s.backend.WatchServices(watchNamespace, services, startIndex)
+			}
+			serviceID, serviceStatus, err := watch.Next()
 			if err != nil {
-				log.Warn("Error from coinserver watcher", "err", err)
+				log.Warn("Error from service watcher", "namespace", watchNamespace, "err", err)
 				time.Sleep(time.Second * 2)
+				resync = true
 				continue
 			}
-			serviceID, serviceStatus := s.parseNode(res.Node)
-			if serviceStatus == nil {
-			}
 			_, exists := services[serviceID]
 			var action string
-			if res.Action == "expire" {
+			if serviceStatus == nil {
 				if exists {
-					// Service status from the etcd notification will be nil,
-					// so pull it
+					// The backend doesn't give the status of services that
+					// are gone, so pull it
 					serviceStatus = services[serviceID]
 					delete(services, serviceID)
 					action = "removed"
 				}
-			} else if res.Action == "set" || res.Action == "update" {
+			} else {
 				services[serviceID] = serviceStatus
 				// NOTE: Will fire event even when no change is actually made.
 				// Shouldn't happen, but might.
@@ -192,29 +402,46 @@ func (s *Service) ServiceWatcher(watchNamespace string) (chan ServiceStatusUpdat
 				} else {
 					action = "added"
 				}
-			} else {
-				log.Debug("Ignoring watch update type ", res.Action)
 			}
 
 			// A little sloppy, but more DRY
 			if action != "" {
-				log.Debug("Broadcasting service update", "action", action, "id", serviceID)
-				updates <- ServiceStatusUpdate{
+				s.publishUpdate(updates, ServiceStatusUpdate{
 					ServiceType: watchNamespace,
 					ServiceID:   serviceID,
 					Status:      serviceStatus,
 					Action:      action,
-				}
+				})
 			}
 		}
 	}()
 	return updates, nil
 }
 
+func (s *Service) publishUpdate(updates chan ServiceStatusUpdate, update ServiceStatusUpdate) {
+	log.Debug("Broadcasting service update", "action", update.Action, "id", update.ServiceID)
+	updates <- update
+	switch update.Action {
+	case "added":
+		s.Events.Publish(EventServiceUp, update)
+	case "removed":
+		s.Events.Publish(EventServiceDown, update)
+	}
+}
+
+// Health check for our discovery backend connection. Status is written every
+// second with a 2 second TTL, so after a few misses other services will have
+// dropped us
+func (s *Service) DiscoveryCheck() error {
+	return s.statusHealth.Check(time.Second*5, time.Now())
+}
+
 func (s *Service) KeepAlive(labels map[string]string) error {
 	var (
 		lastValue  string
 		lastStatus map[string]interface{} = make(map[string]interface{})
+		// When updates started failing, zero while they're working
+		failingSince time.Time
 	)
 	if s.Name == "" {
 		log.Crit(`Cannot start service KeepAlive without name set.
@@ -242,13 +469,9 @@ func (s *Service) KeepAlive(labels map[string]string) error {
 			continue
 		}
 
-		opt := &client.SetOptions{TTL: time.Second * 2}
 		// Don't update if no new information, just refresh TTL
-		if value == lastValue {
-			opt.Refresh = true
-			opt.PrevExist = client.PrevExist
-			value = ""
-		} else {
+		refresh := value == lastValue
+		if !refresh {
 			lastValue = value
 
 			// Now add the timestamp. This should'nt be included in the
@@ -259,12 +482,27 @@ func (s *Service) KeepAlive(labels map[string]string) error {
 		}
 
 		// Set TTL update, or new information
-		_, err = s.etcdKeys.Set(
-			context.Background(), "/status/"+s.namespace+"/"+s.Name, value, opt)
+		err = s.backend.SetStatus(s.namespace, s.Name, value, time.Second*2, refresh)
+		s.statusHealth.Mark(err, time.Now())
 		if err != nil {
-			log.Warn("Failed to update etcd status entry", "err", err)
+			if failingSince.IsZero() {
+				failingSince = time.Now()
+				log.Warn("Failed to update status entry, retrying", "err", err)
+				s.Events.Publish(EventDiscoveryDown, DiscoveryEvent{Err: err, Since: failingSince})
+			} else {
+				log.Debug("Failed to update status entry", "err", err)
+			}
+			// Our entry will have expired, so the next write has to be the
+			// whole status rather than a refresh. Only the latest status
+			// matters, so nothing else is kept
+			lastValue = ""
 			continue
 		}
+		if !failingSince.IsZero() {
+			log.Info("Status updates resumed", "down_for", time.Since(failingSince))
+			s.Events.Publish(EventDiscoveryUp, DiscoveryEvent{Since: failingSince})
+			failingSince = time.Time{}
+		}
 	}
 	return nil
 }
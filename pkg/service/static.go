@@ -0,0 +1,130 @@
+package service
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// How often static discovery looks up SRV records again
+const staticPollInterval = time.Second * 30
+
+// For deployments without etcd or consul. Config is read from files laid out
+// like the keys, ie <dir>/config/common and <dir>/config/stratum/<name>.
+// Services are found with SRV records, _<namespace>._tcp.<domain>, and each
+// target's TXT records of key=value give its labels. Without an endpoint
+// label the target's host:port is used. There's nowhere to publish our own
+// status or receive control commands, so records have to be kept up to date
+// by whoever runs the services. Deployments aren't used, give each its own
+// directory and domain
+type staticBackend struct {
+	dir    string
+	domain string
+
+	lookupSRV func(service, proto, name string) (string, []*net.SRV, error)
+	lookupTXT func(name string) ([]string, error)
+	interval  time.Duration
+}
+
+func NewStaticBackend(dir string, domain string) Backend {
+	return &staticBackend{
+		dir:       dir,
+		domain:    domain,
+		lookupSRV: net.LookupSRV,
+		lookupTXT: net.LookupTXT,
+		interval:  staticPollInterval,
+	}
+}
+
+func (b *staticBackend) Get(key string) (string, error) {
+	raw, err := ioutil.ReadFile(filepath.Join(b.dir, filepath.FromSlash(key)))
+	if os.IsNotExist(err) {
+		return "", ErrKeyNotFound
+	} else if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return string(raw), nil
+}
+
+// Files have no index to wait on, so any index we return is only a sign to
+// read them again after the poll interval
+func (b *staticBackend) List(prefix string, index uint64) (map[string]string, uint64, error) {
+	if index > 0 {
+		time.Sleep(b.interval)
+	}
+	dir := filepath.Join(b.dir, filepath.FromSlash(prefix))
+	values := map[string]string{}
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return values, 1, nil
+	} else if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		raw, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, 0, errors.WithStack(err)
+		}
+		values[file.Name()] = string(raw)
+	}
+	return values, 1, nil
+}
+
+func (b *staticBackend) Services(namespace string) (map[string]*ServiceStatus, uint64, error) {
+	_, records, err := b.lookupSRV(namespace, "tcp", b.domain)
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.Err == "no such host" {
+		return map[string]*ServiceStatus{}, 0, nil
+	} else if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	services := map[string]*ServiceStatus{}
+	for _, srv := range records {
+		target := strings.TrimSuffix(srv.Target, ".")
+		serviceID := strings.SplitN(target, ".", 2)[0]
+		labels := map[string]string{}
+		txts, err := b.lookupTXT(target)
+		if dnsErr, ok := err.(*net.DNSError); err != nil && !(ok && dnsErr.Err == "no such host") {
+			return nil, 0, errors.WithStack(err)
+		}
+		for _, txt := range txts {
+			parts := strings.SplitN(txt, "=", 2)
+			if len(parts) == 2 {
+				labels[parts[0]] = parts[1]
+			}
+		}
+		if _, ok := labels["endpoint"]; !ok {
+			labels["endpoint"] = net.JoinHostPort(target, strconv.Itoa(int(srv.Port)))
+		}
+		services[serviceID] = &ServiceStatus{
+			ServiceID: serviceID,
+			Labels:    labels,
+		}
+	}
+	return services, 0, nil
+}
+
+func (b *staticBackend) WatchServices(namespace string, known map[string]*ServiceStatus,
+	index uint64) ServiceWatch {
+	return newPollWatch(namespace, known, index, func(uint64) (map[string]*ServiceStatus, uint64, error) {
+		time.Sleep(b.interval)
+		return b.Services(namespace)
+	})
+}
+
+func (b *staticBackend) SetStatus(namespace string, serviceID string, value string,
+	ttl time.Duration, refresh bool) error {
+	return nil
+}
+
+func (b *staticBackend) WatchControl(namespace string, serviceID string) (ControlWatch, error) {
+	return nil, ErrNoControl
+}
@@ -0,0 +1,74 @@
+package service
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStaticBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "static")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "config", "stratum"), 0700))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "config", "stratum", "3333"),
+		[]byte("StratumBind: 0.0.0.0:3333"), 0600))
+
+	srvs := []*net.SRV{
+		{Target: "btc1.coinservers.example.com.", Port: 20000},
+		{Target: "ltc1.coinservers.example.com.", Port: 20001},
+	}
+	backend := &staticBackend{
+		dir:    dir,
+		domain: "example.com",
+		lookupSRV: func(service, proto, name string) (string, []*net.SRV, error) {
+			assert.Equal(t, "coinserver", service)
+			assert.Equal(t, "example.com", name)
+			return "", srvs, nil
+		},
+		lookupTXT: func(name string) ([]string, error) {
+			if name == "btc1.coinservers.example.com" {
+				return []string{"currency=BTC", "endpoint=http://10.0.0.1:20000/", "junk"}, nil
+			}
+			return nil, &net.DNSError{Err: "no such host", Name: name}
+		},
+	}
+
+	value, err := backend.Get("/config/stratum/3333")
+	assert.NoError(t, err)
+	assert.Equal(t, "StratumBind: 0.0.0.0:3333", value)
+	_, err = backend.Get("/config/common")
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	values, _, err := backend.List("/config/stratum", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"3333": "StratumBind: 0.0.0.0:3333"}, values)
+	values, _, err = backend.List("/config/currencies", 0)
+	assert.NoError(t, err)
+	assert.Empty(t, values)
+
+	services, index, err := backend.Services("coinserver")
+	assert.NoError(t, err)
+	assert.Len(t, services, 2)
+	assert.Equal(t, map[string]string{"currency": "BTC", "endpoint": "http://10.0.0.1:20000/"},
+		services["btc1"].Labels)
+	// Without an endpoint label the target is used
+	assert.Equal(t, map[string]string{"endpoint": "ltc1.coinservers.example.com:20001"},
+		services["ltc1"].Labels)
+
+	// Unchanged records don't come through the watch
+	srvs = srvs[:1]
+	watch := backend.WatchServices("coinserver", services, index)
+	id, status, err := watch.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, "ltc1", id)
+	assert.Nil(t, status)
+
+	assert.NoError(t, backend.SetStatus("stratum", "3333", "{}", 0, false))
+	_, err = backend.WatchControl("stratum", "3333")
+	assert.Equal(t, ErrNoControl, err)
+}
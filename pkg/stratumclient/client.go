@@ -0,0 +1,464 @@
+// Package stratumclient is a scripted stratum miner for testing pools. Shares
+// are ground on the CPU with the algo's PoW hash, so it's only quick enough at
+// the tiny difficulties a test pool is configured for. It can also make bad
+// shares on purpose: low difficulty, stale and duplicate
+package stratumclient
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/icook/ngpool/pkg/service"
+)
+
+// A job from mining.notify, with the fields decoded as ngstratum sends them:
+// already in block header byte order
+type Job struct {
+	ID           string
+	PrevHash     []byte
+	Coinbase1    []byte
+	Coinbase2    []byte
+	MerkleBranch [][]byte
+	Version      []byte
+	Bits         []byte
+	Time         []byte
+	CleanJobs    bool
+}
+
+// A share to submit, and once it has been, the pool's answer
+type Share struct {
+	JobID       string
+	Extranonce2 []byte
+	Time        []byte
+	Nonce       []byte
+	Hash        []byte
+
+	Accepted bool
+	// The stratum error code and description, if it was rejected
+	ErrorCode int
+	Error     string
+	Latency   time.Duration
+}
+
+type message struct {
+	ID     *int            `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  json.RawMessage `json:"error"`
+}
+
+type Client struct {
+	conn     net.Conn
+	algo     *service.Algo
+	username string
+	nextID   int
+
+	extranonce1     []byte
+	extranonce2Size int
+	// Each search for a share starts on a new extranonce2, so shares are
+	// never repeated by accident
+	searches uint64
+
+	diff float64
+	job  *Job
+	// The job before the last clean one, which the pool now calls stale
+	staleJob *Job
+	newJob   chan struct{}
+	pending  map[int]chan *message
+	err      error
+	mtx      sync.Mutex
+}
+
+// Connects, subscribes and authorizes. Miners pick their difficulty in the
+// password with ngstratum, ie "d=0.001"
+func Dial(addr string, username string, password string, algo *service.Algo) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, time.Second*5)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{
+		conn:     conn,
+		algo:     algo,
+		username: username,
+		newJob:   make(chan struct{}, 1),
+		pending:  map[int]chan *message{},
+	}
+	go c.readLoop()
+
+	var subscribe []json.RawMessage
+	err = c.call(&subscribe, "mining.subscribe", "ngpool-stratumclient/1.0")
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "mining.subscribe")
+	}
+	if len(subscribe) < 3 {
+		conn.Close()
+		return nil, errors.New("Short mining.subscribe result")
+	}
+	var extranonce1 string
+	if err := json.Unmarshal(subscribe[1], &extranonce1); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "Invalid extranonce1")
+	}
+	c.extranonce1, err = hex.DecodeString(extranonce1)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "Invalid extranonce1")
+	}
+	if err := json.Unmarshal(subscribe[2], &c.extranonce2Size); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "Invalid extranonce2 size")
+	}
+
+	var authorized bool
+	err = c.call(&authorized, "mining.authorize", username, password)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "mining.authorize")
+	}
+	if !authorized {
+		conn.Close()
+		return nil, errors.New("Not authorized")
+	}
+	return c, nil
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// The error that closed the connection, nil while it's open
+func (c *Client) Err() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.err
+}
+
+func (c *Client) readLoop() {
+	reader := bufio.NewReader(c.conn)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			c.mtx.Lock()
+			c.err = err
+			for id, ch := range c.pending {
+				close(ch)
+				delete(c.pending, id)
+			}
+			c.mtx.Unlock()
+			return
+		}
+		var msg message
+		if err := json.Unmarshal(line, &msg); err != nil {
+			continue
+		}
+		switch msg.Method {
+		case "mining.set_difficulty":
+			var params []float64
+			if json.Unmarshal(msg.Params, &params) == nil && len(params) > 0 {
+				c.mtx.Lock()
+				c.diff = params[0]
+				c.mtx.Unlock()
+			}
+		case "mining.notify":
+			job, err := decodeJob(msg.Params)
+			if err != nil {
+				continue
+			}
+			c.mtx.Lock()
+			if job.CleanJobs && c.job != nil {
+				c.staleJob = c.job
+			}
+			c.job = job
+			c.mtx.Unlock()
+			select {
+			case c.newJob <- struct{}{}:
+			default:
+			}
+		case "":
+			if msg.ID == nil {
+				continue
+			}
+			c.mtx.Lock()
+			ch, ok := c.pending[*msg.ID]
+			delete(c.pending, *msg.ID)
+			c.mtx.Unlock()
+			if ok {
+				ch <- &msg
+			}
+		}
+	}
+}
+
+func decodeJob(raw json.RawMessage) (*Job, error) {
+	var params []json.RawMessage
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, err
+	}
+	if len(params) < 9 {
+		return nil, errors.New("Short mining.notify")
+	}
+	job := &Job{}
+	var branch []string
+	var fields = []struct {
+		raw json.RawMessage
+		out interface{}
+	}{
+		{params[0], &job.ID},
+		{params[4], &branch},
+		{params[8], &job.CleanJobs},
+	}
+	for _, field := range fields {
+		if err := json.Unmarshal(field.raw, field.out); err != nil {
+			return nil, err
+		}
+	}
+	var hexFields = []struct {
+		raw json.RawMessage
+		out *[]byte
+	}{
+		{params[1], &job.PrevHash},
+		{params[2], &job.Coinbase1},
+		{params[3], &job.Coinbase2},
+		{params[5], &job.Version},
+		{params[6], &job.Bits},
+		{params[7], &job.Time},
+	}
+	for _, field := range hexFields {
+		var encoded string
+		if err := json.Unmarshal(field.raw, &encoded); err != nil {
+			return nil, err
+		}
+		decoded, err := hex.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		*field.out = decoded
+	}
+	for _, b := range branch {
+		decoded, err := hex.DecodeString(b)
+		if err != nil {
+			return nil, err
+		}
+		job.MerkleBranch = append(job.MerkleBranch, decoded)
+	}
+	return job, nil
+}
+
+// Sends a request and waits for its answer, which is decoded into result
+func (c *Client) call(result interface{}, method string, params ...interface{}) error {
+	msg, err := c.request(method, params...)
+	if err != nil {
+		return err
+	}
+	if len(msg.Error) > 0 && string(msg.Error) != "null" {
+		return errors.Errorf("%s failed: %s", method, msg.Error)
+	}
+	return json.Unmarshal(msg.Result, result)
+}
+
+func (c *Client) request(method string, params ...interface{}) (*message, error) {
+	ch := make(chan *message, 1)
+	c.mtx.Lock()
+	if c.err != nil {
+		c.mtx.Unlock()
+		return nil, c.err
+	}
+	c.nextID++
+	id := c.nextID
+	c.pending[id] = ch
+	c.mtx.Unlock()
+
+	raw, err := json.Marshal(map[string]interface{}{
+		"id":     id,
+		"method": method,
+		"params": params,
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(time.Second * 5))
+	_, err = c.conn.Write(append(raw, '\n'))
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case msg, ok := <-ch:
+		if !ok {
+			return nil, errors.Errorf("Connection lost waiting for %s", method)
+		}
+		return msg, nil
+	case <-time.After(time.Second * 30):
+		return nil, errors.Errorf("No answer to %s", method)
+	}
+}
+
+// Returns the latest job, waiting for one if none has come yet
+func (c *Client) WaitJob(timeout time.Duration) (*Job, error) {
+	deadline := time.After(timeout)
+	for {
+		c.mtx.Lock()
+		job, err := c.job, c.err
+		c.mtx.Unlock()
+		if job != nil {
+			return job, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case <-c.newJob:
+		case <-deadline:
+			return nil, errors.New("No job received")
+		}
+	}
+}
+
+// The job before the last clean job, nil if there hasn't been one
+func (c *Client) StaleJob() *Job {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.staleJob
+}
+
+func (c *Client) Difficulty() float64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.diff
+}
+
+func sha256d(data []byte) []byte {
+	first := sha256.Sum256(data)
+	second := sha256.Sum256(first[:])
+	return second[:]
+}
+
+// The block header for a job, built the same way ngstratum checks shares
+func (j *Job) Header(extranonce []byte, nonce []byte) []byte {
+	coinbase := make([]byte, 0, len(j.Coinbase1)+len(extranonce)+len(j.Coinbase2))
+	coinbase = append(coinbase, j.Coinbase1...)
+	coinbase = append(coinbase, extranonce...)
+	coinbase = append(coinbase, j.Coinbase2...)
+	root := sha256d(coinbase)
+	for _, branch := range j.MerkleBranch {
+		root = sha256d(append(root, branch...))
+	}
+	header := make([]byte, 0, 80)
+	header = append(header, j.Version...)
+	header = append(header, j.PrevHash...)
+	header = append(header, root...)
+	header = append(header, j.Time...)
+	header = append(header, j.Bits...)
+	header = append(header, nonce...)
+	return header
+}
+
+// Hashes are compared against targets as little endian numbers
+func hashToBig(hash []byte) *big.Int {
+	reversed := make([]byte, len(hash))
+	for i, b := range hash {
+		reversed[len(hash)-1-i] = b
+	}
+	return new(big.Int).SetBytes(reversed)
+}
+
+// Grinds job for a share whose hash meets (good) or misses the share target.
+// A share that misses is found almost immediately, and is rejected as low
+// difficulty
+func (c *Client) search(job *Job, good bool, deadline time.Time) (*Share, error) {
+	diff := c.Difficulty()
+	if diff <= 0 {
+		return nil, errors.New("No difficulty set")
+	}
+	target := c.algo.ShareTarget(diff)
+
+	extranonce2 := make([]byte, c.extranonce2Size)
+	var rolled [8]byte
+	binary.LittleEndian.PutUint64(rolled[:], atomic.AddUint64(&c.searches, 1))
+	copy(extranonce2, rolled[:])
+	extranonce := append(append([]byte{}, c.extranonce1...), extranonce2...)
+
+	nonce := make([]byte, 4)
+	for counter := uint64(0); counter <= 0xffffffff; counter++ {
+		if counter%(1<<12) == 0 && time.Now().After(deadline) {
+			return nil, errors.New("No share found in time")
+		}
+		binary.LittleEndian.PutUint32(nonce, uint32(counter))
+		hash, err := c.algo.PoWHash(job.Header(extranonce, nonce))
+		if err != nil {
+			return nil, err
+		}
+		if (hashToBig(hash).Cmp(target) <= 0) == good {
+			return &Share{
+				JobID:       job.ID,
+				Extranonce2: extranonce2,
+				Time:        job.Time,
+				Nonce:       nonce,
+				Hash:        hash,
+			}, nil
+		}
+	}
+	return nil, errors.New("Nonce range exhausted")
+}
+
+// Finds a share that meets the difficulty for job
+func (c *Client) FindShare(job *Job, deadline time.Time) (*Share, error) {
+	return c.search(job, true, deadline)
+}
+
+// Finds a share for job that falls short of the difficulty
+func (c *Client) LowDiffShare(job *Job) (*Share, error) {
+	return c.search(job, false, time.Now().Add(time.Minute))
+}
+
+// Submits share, filling in the pool's answer. Rejections aren't errors
+func (c *Client) Submit(share *Share) error {
+	start := time.Now()
+	msg, err := c.request("mining.submit", c.username, share.JobID,
+		hex.EncodeToString(share.Extranonce2), hex.EncodeToString(share.Time),
+		hex.EncodeToString(share.Nonce))
+	if err != nil {
+		return err
+	}
+	share.Latency = time.Since(start)
+	share.Accepted = false
+	if len(msg.Error) > 0 && string(msg.Error) != "null" {
+		// [code, description, traceback]
+		var stratumErr []interface{}
+		if json.Unmarshal(msg.Error, &stratumErr) == nil && len(stratumErr) >= 2 {
+			if code, ok := stratumErr[0].(float64); ok {
+				share.ErrorCode = int(code)
+			}
+			share.Error, _ = stratumErr[1].(string)
+		} else {
+			share.Error = string(msg.Error)
+		}
+		return nil
+	}
+	return json.Unmarshal(msg.Result, &share.Accepted)
+}
+
+// Grinds the latest job until a hash meets the share difficulty, then submits
+// it
+func (c *Client) Mine(timeout time.Duration) (*Share, error) {
+	job, err := c.WaitJob(timeout)
+	if err != nil {
+		return nil, err
+	}
+	share, err := c.FindShare(job, time.Now().Add(timeout))
+	if err != nil {
+		return nil, err
+	}
+	return share, c.Submit(share)
+}
@@ -0,0 +1,135 @@
+package stratumclient
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/icook/ngpool/pkg/service"
+)
+
+// The bitcoin genesis block's coinbase, split around four bytes of its
+// scriptSig as if they were the extranonce
+const (
+	genesisCoinbase1  = "01000000010000000000000000000000000000000000000000000000000000000000000000ffffffff4d"
+	genesisExtranonce = "04ffff00"
+	genesisCoinbase2  = "1d0104455468652054696d65732030332f4a616e2f32303039204368616e63656c6c6f72206f6e206272696e6b206f66207365636f6e64206261696c6f757420666f722062616e6b73ffffffff0100f2052a01000000434104678afdb0fe5548271967f1a67130b7105cd6a828e03909a67962e0ea1f61deb649f6bc3f4cef38c4f35504e51ec112de5c384df7ba0b8d578a4c702b6bf11d5fac00000000"
+)
+
+func TestJobHeader(t *testing.T) {
+	params := []interface{}{
+		"job1",
+		"0000000000000000000000000000000000000000000000000000000000000000",
+		genesisCoinbase1,
+		genesisCoinbase2,
+		[]string{},
+		"01000000",
+		"ffff001d",
+		"29ab5f49",
+		true,
+	}
+	raw, err := json.Marshal(params)
+	assert.NoError(t, err)
+	job, err := decodeJob(raw)
+	assert.NoError(t, err)
+	assert.Equal(t, "job1", job.ID)
+	assert.True(t, job.CleanJobs)
+	assert.Len(t, job.MerkleBranch, 0)
+
+	extranonce, _ := hex.DecodeString(genesisExtranonce)
+	nonce, _ := hex.DecodeString("1dac2b7c")
+	header := job.Header(extranonce, nonce)
+	assert.Len(t, header, 80)
+
+	expected, _ := new(big.Int).SetString(
+		"000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f", 16)
+	assert.Equal(t, 0, hashToBig(sha256d(header)).Cmp(expected))
+}
+
+func TestDecodeJobInvalid(t *testing.T) {
+	_, err := decodeJob(json.RawMessage(`["job1", "00"]`))
+	assert.Error(t, err)
+	_, err = decodeJob(json.RawMessage(
+		`["job1", "zz", "", "", [], "", "", "", true]`))
+	assert.Error(t, err)
+}
+
+// Answers like ngstratum, rejecting every other share as a duplicate
+func fakePool(ln net.Listener) {
+	conn, err := ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	var submits int
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		var req struct {
+			ID     int
+			Method string
+		}
+		json.Unmarshal(line, &req)
+		switch req.Method {
+		case "mining.subscribe":
+			fmt.Fprintf(conn, `{"id": %d, "result": [[], "0a0b0c0d", 4], "error": null}`+"\n", req.ID)
+		case "mining.authorize":
+			fmt.Fprintf(conn, `{"id": %d, "result": true, "error": null}`+"\n", req.ID)
+			fmt.Fprintf(conn, `{"id": null, "method": "mining.set_difficulty", "params": [0.0001]}`+"\n")
+			fmt.Fprintf(conn, `{"id": null, "method": "mining.notify", "params": ["job1", "00", "%s", "%s", [], "01000000", "ffff001d", "29ab5f49", true]}`+"\n",
+				genesisCoinbase1, genesisCoinbase2)
+		case "mining.submit":
+			submits++
+			if submits%2 == 0 {
+				fmt.Fprintf(conn, `{"id": %d, "result": null, "error": [22, "Duplicate share", null]}`+"\n", req.ID)
+				continue
+			}
+			fmt.Fprintf(conn, `{"id": %d, "result": true, "error": null}`+"\n", req.ID)
+		}
+	}
+}
+
+func TestMineAndSubmit(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ln.Close()
+	go fakePool(ln)
+
+	client, err := Dial(ln.Addr().String(), "joe.rig1", "d=0.0001", service.AlgoConfig["sha256d"])
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+
+	share, err := client.Mine(time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, share.Accepted)
+	target := service.AlgoConfig["sha256d"].ShareTarget(0.0001)
+	assert.True(t, hashToBig(share.Hash).Cmp(target) <= 0)
+
+	err = client.Submit(share)
+	assert.NoError(t, err)
+	assert.False(t, share.Accepted)
+	assert.Equal(t, 22, share.ErrorCode)
+	assert.Equal(t, "Duplicate share", share.Error)
+
+	job, err := client.WaitJob(time.Second)
+	assert.NoError(t, err)
+	low, err := client.LowDiffShare(job)
+	assert.NoError(t, err)
+	assert.True(t, hashToBig(low.Hash).Cmp(target) > 0)
+	assert.NotEqual(t, share.Extranonce2, low.Extranonce2)
+	assert.Nil(t, client.StaleJob())
+}
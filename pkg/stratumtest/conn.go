@@ -0,0 +1,249 @@
+// Package stratumtest checks a stratum server's protocol handling with
+// scripted conversations. A script sends requests and waits for the answers
+// it expects, and everything received is kept in a transcript with the parts
+// that change between runs (job ids, extranonces, hashes) replaced by
+// placeholders, so transcripts can be compared against golden files. The
+// same scripts run in tests and against live servers, see ngminersim check
+package stratumtest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The default wait for a message from the server
+const DefaultTimeout = time.Second * 10
+
+// Values a script can use in what it sends, ie {{.User}}. Those after
+// Password are filled in from what the server sends
+type Vars struct {
+	User     string
+	Password string
+	// From the mining.subscribe result. Extranonce2 is zeros of the size
+	// the server asked for
+	Extranonce1 string
+	Extranonce2 string
+	// From the last mining.notify
+	JobID string
+	NTime string
+}
+
+func DefaultVars() Vars {
+	return Vars{User: "stratumtest", Password: "x"}
+}
+
+// A message from the server, with the fields left as raw JSON
+type Message struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  json.RawMessage `json:"error"`
+}
+
+// The message's id as written, "null" if it has none
+func (m *Message) IDString() string {
+	if len(m.ID) == 0 {
+		return "null"
+	}
+	return string(m.ID)
+}
+
+func (m *Message) IsError() bool {
+	return len(m.Error) > 0 && string(m.Error) != "null"
+}
+
+// One connection to a stratum server, recording everything sent and
+// received
+type Conn struct {
+	Timeout time.Duration
+	Vars    Vars
+
+	conn       net.Conn
+	reader     *bufio.Reader
+	transcript bytes.Buffer
+	// The method of each request we're waiting on an answer to, by id
+	pending map[string]string
+}
+
+// Connects to a server, timeout applies to connecting and to each wait after.
+// Zero uses DefaultTimeout
+func Dial(addr string, timeout time.Duration) (*Conn, error) {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := NewConn(conn)
+	c.Timeout = timeout
+	return c, nil
+}
+
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{
+		Timeout: DefaultTimeout,
+		Vars:    DefaultVars(),
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+		pending: map[string]string{},
+	}
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// Everything sent and received so far, one line each. Sent lines are
+// prefixed with "> ", received with "< "
+func (c *Conn) Transcript() string {
+	return c.transcript.String()
+}
+
+// Sends line as it is. recorded is what goes in the transcript, which for a
+// script is the line before its vars were filled in
+func (c *Conn) Send(line string, recorded string) error {
+	c.transcript.WriteString("> " + recorded + "\n")
+	var req struct {
+		ID     json.RawMessage `json:"id"`
+		Method string          `json:"method"`
+	}
+	if json.Unmarshal([]byte(line), &req) == nil && req.Method != "" {
+		if id := (&Message{ID: req.ID}).IDString(); id != "null" {
+			c.pending[id] = req.Method
+		}
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(c.Timeout))
+	_, err := c.conn.Write([]byte(line + "\n"))
+	return err
+}
+
+// Reads the next message. io.EOF means the server closed the connection
+func (c *Conn) Recv() (*Message, error) {
+	c.conn.SetReadDeadline(time.Now().Add(c.Timeout))
+	line, err := c.reader.ReadBytes('\n')
+	if err == io.EOF && len(bytes.TrimSpace(line)) == 0 {
+		c.transcript.WriteString("< (closed)\n")
+		return nil, io.EOF
+	}
+	if err != nil && err != io.EOF {
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			return nil, errors.New("Timed out waiting for the server")
+		}
+		return nil, err
+	}
+	line = bytes.TrimSpace(line)
+	var msg Message
+	if err := json.Unmarshal(line, &msg); err != nil {
+		c.transcript.WriteString("< " + string(line) + "\n")
+		return nil, errors.Wrap(err, "Server sent invalid JSON")
+	}
+	method := msg.Method
+	if method == "" {
+		method = c.pending[msg.IDString()]
+		delete(c.pending, msg.IDString())
+	}
+	c.transcript.WriteString("< " + c.normalize(line, method) + "\n")
+	return &msg, nil
+}
+
+// Re-encodes a message with sorted keys and its run specific values replaced
+// by placeholders, noting the values scripts use as it goes. Anything not
+// shaped as expected is left alone, so it shows up in a diff
+func (c *Conn) normalize(line []byte, method string) string {
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.UseNumber()
+	var msg map[string]interface{}
+	if dec.Decode(&msg) != nil {
+		return string(line)
+	}
+	switch method {
+	case "mining.subscribe":
+		result, ok := msg["result"].([]interface{})
+		if !ok || len(result) != 3 {
+			break
+		}
+		if subs, ok := result[0].([]interface{}); ok {
+			for _, sub := range subs {
+				if pair, ok := sub.([]interface{}); ok && len(pair) == 2 {
+					pair[1] = "<subscription>"
+				}
+			}
+		}
+		if extranonce1, ok := hexField(result[1], -1); ok {
+			c.Vars.Extranonce1 = extranonce1
+			result[1] = "<extranonce1>"
+		}
+		if size, ok := result[2].(json.Number); ok {
+			if n, err := size.Int64(); err == nil && n >= 0 && n <= 32 {
+				c.Vars.Extranonce2 = strings.Repeat("00", int(n))
+			}
+		}
+	case "mining.notify":
+		params, ok := msg["params"].([]interface{})
+		if !ok || len(params) != 9 {
+			break
+		}
+		if jobID, ok := params[0].(string); ok {
+			c.Vars.JobID = jobID
+			params[0] = "<job>"
+		}
+		if ntime, ok := hexField(params[7], 4); ok {
+			c.Vars.NTime = ntime
+		}
+		placeholders := []struct {
+			index int
+			size  int
+			name  string
+		}{
+			{1, 32, "<prevhash>"},
+			{2, -1, "<coinbase1>"},
+			{3, -1, "<coinbase2>"},
+			{5, 4, "<version>"},
+			{6, 4, "<nbits>"},
+			{7, 4, "<ntime>"},
+		}
+		for _, p := range placeholders {
+			if _, ok := hexField(params[p.index], p.size); ok {
+				params[p.index] = p.name
+			}
+		}
+		if branches, ok := params[4].([]interface{}); ok {
+			for i, branch := range branches {
+				if _, ok := hexField(branch, 32); ok {
+					branches[i] = "<branch>"
+				}
+			}
+		}
+	}
+
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	enc.SetEscapeHTML(false)
+	if enc.Encode(msg) != nil {
+		return string(line)
+	}
+	return strings.TrimSpace(out.String())
+}
+
+// Returns value if it's a hex string of size bytes, any size if size is -1
+func hexField(value interface{}, size int) (string, bool) {
+	str, ok := value.(string)
+	if !ok {
+		return "", false
+	}
+	raw, err := hex.DecodeString(str)
+	if err != nil || (size >= 0 && len(raw) != size) {
+		return "", false
+	}
+	return str, true
+}
@@ -0,0 +1,158 @@
+package stratumtest
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// A conversation with a server, one step per line:
+//
+//	send <json>              sends a request, {{.Var}}s are filled in
+//	raw <text>               sends text as it is, for malformed requests
+//	expect <id> result       waits for a successful answer to id
+//	expect <id> error        waits for an error answer to id, null for one
+//	                         the server couldn't tie to a request
+//	expect <method>          waits for a notification, ie mining.notify
+//	expect close             waits for the server to hang up
+//
+// Blank lines and lines starting with # are ignored. Messages that arrive
+// while waiting are fine, they just end up in the transcript
+type Script struct {
+	Name  string
+	steps []step
+}
+
+type step struct {
+	line   int
+	kind   string
+	text   string
+	tmpl   *template.Template
+	id     string
+	method string
+	isErr  bool
+}
+
+func ParseScript(name string, text string) (*Script, error) {
+	script := &Script{Name: name}
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		st, err := parseStep(line)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s line %d", name, i+1)
+		}
+		st.line = i + 1
+		script.steps = append(script.steps, st)
+	}
+	return script, nil
+}
+
+// Like ParseScript, for scripts built into programs
+func MustParseScript(name string, text string) *Script {
+	script, err := ParseScript(name, text)
+	if err != nil {
+		panic(err)
+	}
+	return script
+}
+
+func parseStep(line string) (step, error) {
+	parts := strings.SplitN(line, " ", 2)
+	st := step{kind: parts[0]}
+	if len(parts) == 2 {
+		st.text = strings.TrimSpace(parts[1])
+	}
+	switch st.kind {
+	case "send", "raw":
+		if st.text == "" {
+			return st, errors.New("Nothing to send")
+		}
+		tmpl, err := template.New("").Option("missingkey=error").Parse(st.text)
+		if err != nil {
+			return st, err
+		}
+		st.tmpl = tmpl
+	case "expect":
+		args := strings.Fields(st.text)
+		switch {
+		case len(args) == 1:
+			st.method = args[0]
+		case len(args) == 2 && (args[1] == "result" || args[1] == "error"):
+			st.id = args[0]
+			st.isErr = args[1] == "error"
+		default:
+			return st, errors.Errorf("Can't expect %q", st.text)
+		}
+	default:
+		return st, errors.Errorf("Unknown step %q", st.kind)
+	}
+	return st, nil
+}
+
+// Runs the script's steps in order, stopping at the first one that fails
+func (s *Script) Run(c *Conn) error {
+	for _, st := range s.steps {
+		if err := st.run(c); err != nil {
+			return errors.Wrapf(err, "%s line %d", s.Name, st.line)
+		}
+	}
+	return nil
+}
+
+func (st *step) run(c *Conn) error {
+	if st.tmpl != nil {
+		var line bytes.Buffer
+		if err := st.tmpl.Execute(&line, c.Vars); err != nil {
+			return err
+		}
+		return c.Send(line.String(), st.text)
+	}
+	for {
+		msg, err := c.Recv()
+		if err == io.EOF {
+			if st.method == "close" {
+				return nil
+			}
+			return errors.Errorf("Connection closed waiting for %s", st.text)
+		}
+		if err != nil {
+			return err
+		}
+		switch {
+		case st.method == "close":
+		case st.method != "":
+			if msg.Method == st.method {
+				return nil
+			}
+		case msg.Method == "" && msg.IDString() == st.id:
+			if msg.IsError() != st.isErr {
+				return errors.Errorf("Expected %s, got error %s result %s",
+					st.text, msg.Error, msg.Result)
+			}
+			return nil
+		}
+	}
+}
+
+// Compares a transcript to a golden file, or with update rewrites the file
+func Golden(path string, transcript string, update bool) error {
+	if update {
+		return ioutil.WriteFile(path, []byte(transcript), 0644)
+	}
+	golden, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if string(golden) == transcript {
+		return nil
+	}
+	return errors.Errorf("Transcript differs from %s\n--- expected\n%s--- got\n%s",
+		path, golden, transcript)
+}
@@ -0,0 +1,167 @@
+package stratumtest
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A bare bones stratum server, answering each connection the same way
+func fakeServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go fakeSession(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func fakeSession(conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var msg struct {
+			ID     *int64 `json:"id"`
+			Method string `json:"method"`
+		}
+		if json.Unmarshal(scanner.Bytes(), &msg) != nil || msg.ID == nil {
+			fmt.Fprintln(conn, `{"id":null,"result":null,"error":[20,"Other/unknown",null]}`)
+			continue
+		}
+		switch msg.Method {
+		case "mining.subscribe":
+			fmt.Fprintf(conn, `{"id":%d,"result":[[["mining.notify","ab12"]],"deadbeef",4],"error":null}`+"\n", *msg.ID)
+		case "mining.authorize":
+			fmt.Fprintf(conn, `{"id":%d,"result":true,"error":null}`+"\n", *msg.ID)
+			fmt.Fprintln(conn, `{"id":null,"method":"mining.set_difficulty","params":[0.5]}`)
+			fmt.Fprintln(conn, `{"id":null,"method":"mining.notify","params":["j1",`+
+				`"00000000000000000000000000000000000000000000000000000000000000ff","01","02",`+
+				`["1111111111111111111111111111111111111111111111111111111111111111"],`+
+				`"20000000","1d00ffff","5a000000",true]}`)
+		case "mining.submit":
+			fmt.Fprintf(conn, `{"id":%d,"result":null,"error":[23,"Low difficulty share",null]}`+"\n", *msg.ID)
+		case "bye":
+			return
+		}
+	}
+}
+
+func TestScriptTranscript(t *testing.T) {
+	addr := fakeServer(t)
+	conn, err := Dial(addr, time.Second)
+	assert.NoError(t, err)
+	defer conn.Close()
+	conn.Vars.User = "工人"
+
+	script := MustParseScript("test", `
+send {"id": 1, "method": "mining.subscribe", "params": []}
+expect 1 result
+send {"id": 2, "method": "mining.authorize", "params": ["{{.User}}", "x"]}
+expect mining.notify
+send {"id": 3, "method": "mining.submit", "params": ["{{.User}}", "{{.JobID}}", "{{.Extranonce2}}", "{{.NTime}}", "00000000"]}
+expect 3 error
+raw {oops
+expect null error
+send {"id": 4, "method": "bye"}
+expect close
+`)
+	assert.NoError(t, script.Run(conn))
+	assert.Equal(t, `> {"id": 1, "method": "mining.subscribe", "params": []}
+< {"error":null,"id":1,"result":[[["mining.notify","<subscription>"]],"<extranonce1>",4]}
+> {"id": 2, "method": "mining.authorize", "params": ["{{.User}}", "x"]}
+< {"error":null,"id":2,"result":true}
+< {"id":null,"method":"mining.set_difficulty","params":[0.5]}
+< {"id":null,"method":"mining.notify","params":["<job>","<prevhash>","<coinbase1>","<coinbase2>",["<branch>"],"<version>","<nbits>","<ntime>",true]}
+> {"id": 3, "method": "mining.submit", "params": ["{{.User}}", "{{.JobID}}", "{{.Extranonce2}}", "{{.NTime}}", "00000000"]}
+< {"error":[23,"Low difficulty share",null],"id":3,"result":null}
+> {oops
+< {"error":[20,"Other/unknown",null],"id":null,"result":null}
+> {"id": 4, "method": "bye"}
+< (closed)
+`, conn.Transcript())
+	assert.Equal(t, "deadbeef", conn.Vars.Extranonce1)
+	assert.Equal(t, "00000000", conn.Vars.Extranonce2)
+	assert.Equal(t, "j1", conn.Vars.JobID)
+	assert.Equal(t, "5a000000", conn.Vars.NTime)
+}
+
+func TestScriptFailures(t *testing.T) {
+	addr := fakeServer(t)
+	run := func(text string) error {
+		conn, err := Dial(addr, time.Millisecond*200)
+		assert.NoError(t, err)
+		defer conn.Close()
+		return MustParseScript("test", text).Run(conn)
+	}
+	// An error when a result was expected
+	assert.Error(t, run(`
+send {"id": 1, "method": "mining.submit", "params": []}
+expect 1 result`))
+	// Nothing ever comes
+	assert.Error(t, run(`
+send {"id": 1, "method": "mining.subscribe", "params": []}
+expect mining.notify`))
+	// Hung up on
+	assert.Error(t, run(`
+send {"id": 1, "method": "bye"}
+expect 1 result`))
+	// A var that doesn't exist
+	assert.Error(t, run(`send {"id": 1, "method": "{{.Nope}}"}`))
+}
+
+func TestParseScriptInvalid(t *testing.T) {
+	for _, text := range []string{
+		"shout hello",
+		"send",
+		"expect 1 maybe",
+		"expect",
+		"send {{.User",
+	} {
+		_, err := ParseScript("test", text)
+		assert.Error(t, err, text)
+	}
+	script, err := ParseScript("test", "# a comment\n\nexpect close\n")
+	assert.NoError(t, err)
+	assert.Len(t, script.steps, 1)
+	assert.Equal(t, 3, script.steps[0].line)
+}
+
+func TestCheckSuite(t *testing.T) {
+	// The fake server gets some of these wrong, but every script runs on its
+	// own connection and reports
+	results := Check(fakeServer(t), Suite, DefaultVars(), time.Millisecond*200)
+	assert.Len(t, results, len(Suite))
+	for i, result := range results {
+		assert.Equal(t, Suite[i], result.Script)
+		assert.NotEmpty(t, result.Transcript)
+	}
+	assert.NoError(t, results[0].Err)
+}
+
+func TestGolden(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stratumtest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.golden")
+
+	assert.Error(t, Golden(path, "> a\n", false))
+	assert.NoError(t, Golden(path, "> a\n", true))
+	assert.NoError(t, Golden(path, "> a\n", false))
+	assert.Error(t, Golden(path, "> b\n", false))
+}
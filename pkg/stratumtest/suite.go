@@ -0,0 +1,106 @@
+package stratumtest
+
+import (
+	"time"
+)
+
+// The checks every stratum server should pass. Submits never carry a real
+// solution, so they're safe against a production pool and need no hashing
+var Suite = []*Script{
+	MustParseScript("subscribe_authorize", `
+# The happy path, a miner gets a difficulty and work after authorizing
+send {"id": 1, "method": "mining.subscribe", "params": ["stratumtest/1.0"]}
+expect 1 result
+send {"id": 2, "method": "mining.authorize", "params": ["{{.User}}", "{{.Password}}"]}
+expect 2 result
+expect mining.set_difficulty
+expect mining.notify
+`),
+	MustParseScript("out_of_order", `
+# Nothing but subscribe is answered before subscribing, and only once
+send {"id": 1, "method": "mining.authorize", "params": ["{{.User}}", "{{.Password}}"]}
+expect 1 error
+send {"id": 2, "method": "mining.submit", "params": ["{{.User}}", "00", "00000000", "00000000", "00000000"]}
+expect 2 error
+send {"id": 3, "method": "mining.subscribe", "params": []}
+expect 3 result
+send {"id": 4, "method": "mining.subscribe", "params": []}
+expect 4 error
+`),
+	MustParseScript("request_ids", `
+# Answers go to the id asked with, whatever order ids come in
+send {"id": 10, "method": "mining.subscribe", "params": []}
+send {"id": 7, "method": "mining.authorize", "params": ["{{.User}}", "{{.Password}}"]}
+expect 10 result
+expect 7 result
+expect mining.notify
+send {"id": 3, "method": "mining.submit", "params": ["{{.User}}", "nosuchjob", "{{.Extranonce2}}", "{{.NTime}}", "00000000"]}
+expect 3 error
+send {"id": 4294967296, "method": "mining.submit", "params": ["{{.User}}", "nosuchjob", "{{.Extranonce2}}", "{{.NTime}}", "00000000"]}
+expect 4294967296 error
+`),
+	MustParseScript("bad_json", `
+# Garbage gets an error without an id, and the connection keeps working
+raw {"id": 1, "method": "mining.subscribe", "params": [
+expect null error
+raw {"method": "mining.subscribe", "params": []}
+expect null error
+send {"id": 2, "method": "mining.subscribe", "params": []}
+expect 2 result
+`),
+	MustParseScript("unicode_username", `
+# Multibyte usernames, long enough to be cut short by a length limit
+send {"id": 1, "method": "mining.subscribe", "params": []}
+expect 1 result
+send {"id": 2, "method": "mining.authorize", "params": ["矿工矿工矿工矿工矿工矿工矿工矿工矿工矿工矿工.工人1", "{{.Password}}"]}
+expect 2 result
+expect mining.notify
+`),
+	MustParseScript("submit_rejects", `
+# Bad shares are rejected with a reason, and don't end the session
+send {"id": 1, "method": "mining.subscribe", "params": []}
+expect 1 result
+send {"id": 2, "method": "mining.authorize", "params": ["{{.User}}", "{{.Password}}"]}
+expect 2 result
+expect mining.notify
+send {"id": 3, "method": "mining.submit", "params": ["{{.User}}", "nosuchjob", "{{.Extranonce2}}", "{{.NTime}}", "00000000"]}
+expect 3 error
+send {"id": 4, "method": "mining.submit", "params": ["{{.User}}", "{{.JobID}}", "00", "{{.NTime}}", "00000000"]}
+expect 4 error
+send {"id": 5, "method": "mining.submit", "params": ["{{.User}}", "{{.JobID}}", "{{.Extranonce2}}", "{{.NTime}}", "00000000"]}
+expect 5 error
+send {"id": 6, "method": "mining.submit", "params": ["{{.User}}", "{{.JobID}}", "{{.Extranonce2}}", "{{.NTime}}", "00000000"]}
+expect 6 error
+send {"id": 7, "method": "mining.submit", "params": ["{{.User}}"]}
+expect 7 error
+send {"id": 8, "method": "mining.submit", "params": ["{{.User}}", "{{.JobID}}", "zz", "{{.NTime}}", "00000000"]}
+expect 8 error
+`),
+}
+
+// The outcome of running a script on its own connection
+type Result struct {
+	Script     *Script
+	Transcript string
+	Err        error
+}
+
+// Runs each script on a new connection to addr
+func Check(addr string, scripts []*Script, vars Vars, timeout time.Duration) []Result {
+	var results []Result
+	for _, script := range scripts {
+		result := Result{Script: script}
+		conn, err := Dial(addr, timeout)
+		if err != nil {
+			result.Err = err
+			results = append(results, result)
+			continue
+		}
+		conn.Vars = vars
+		result.Err = script.Run(conn)
+		result.Transcript = conn.Transcript()
+		conn.Close()
+		results = append(results, result)
+	}
+	return results
+}
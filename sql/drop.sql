@@ -7,6 +7,20 @@ DROP TABLE IF EXISTS minute_share CASCADE;
 DROP TABLE IF EXISTS credit CASCADE;
 DROP TABLE IF EXISTS users CASCADE;
 DROP TABLE IF EXISTS payout CASCADE;
+DROP TABLE IF EXISTS payout_run CASCADE;
+DROP TABLE IF EXISTS payout_request CASCADE;
+DROP TABLE IF EXISTS payout_hold CASCADE;
+DROP TABLE IF EXISTS shift_share CASCADE;
+DROP TABLE IF EXISTS shift CASCADE;
+DROP TABLE IF EXISTS share_rollup CASCADE;
+DROP TABLE IF EXISTS share_rollup_cursor CASCADE;
+DROP TABLE IF EXISTS network_stats CASCADE;
+DROP TABLE IF EXISTS block_effort CASCADE;
+DROP TABLE IF EXISTS coinbase_payout CASCADE;
+DROP TABLE IF EXISTS payout_pause CASCADE;
+DROP TABLE IF EXISTS payout_preference CASCADE;
+DROP TABLE IF EXISTS worker_webhook CASCADE;
+DROP TABLE IF EXISTS schema_migrations CASCADE;
 DROP TYPE IF EXISTS block_status CASCADE;
 DROP TYPE IF EXISTS aggregation_type CASCADE;
 
@@ -0,0 +1,11 @@
+DROP TABLE IF EXISTS share_rollup_cursor CASCADE;
+DROP TABLE IF EXISTS share_rollup CASCADE;
+DROP TABLE IF EXISTS shift_share CASCADE;
+DROP TABLE IF EXISTS shift CASCADE;
+DROP TABLE IF EXISTS payout_hold CASCADE;
+DROP TABLE IF EXISTS payout_request CASCADE;
+DROP TABLE IF EXISTS payout_run CASCADE;
+ALTER TABLE payout DROP COLUMN IF EXISTS pool_fee;
+ALTER TABLE users DROP COLUMN IF EXISTS payout_tier;
+DROP INDEX IF EXISTS share_sharechain_mined_at;
+ALTER TABLE share DROP COLUMN IF EXISTS worker;
@@ -0,0 +1,99 @@
+-- Schema changes made to tables.sql before migrations were tracked: share
+-- workers, payout tiers and pool fees, payout runs, on-demand payout requests,
+-- payout holds, shifts and share rollups
+ALTER TABLE share ADD COLUMN worker varchar NOT NULL DEFAULT '';
+CREATE INDEX share_sharechain_mined_at ON share (sharechain, mined_at);
+ALTER TABLE users ADD COLUMN payout_tier varchar NOT NULL DEFAULT 'default';
+ALTER TABLE payout ADD COLUMN pool_fee bigint NOT NULL DEFAULT 0;
+
+CREATE TABLE payout_run
+(
+    id SERIAL NOT NULL,
+    currency varchar NOT NULL,
+    tier varchar NOT NULL DEFAULT 'default',
+    user_cursor integer NOT NULL DEFAULT 0,
+    batches integer NOT NULL DEFAULT 0,
+    started_at timestamp with time zone NOT NULL DEFAULT now(),
+    finished_at timestamp with time zone,
+    CONSTRAINT payout_run_pkey PRIMARY KEY (id)
+);
+CREATE UNIQUE INDEX payout_run_open ON payout_run (currency, tier) WHERE finished_at IS NULL;
+
+CREATE TABLE payout_request
+(
+    id SERIAL NOT NULL,
+    user_id integer NOT NULL,
+    currency varchar NOT NULL,
+    requested_at timestamp with time zone NOT NULL DEFAULT now(),
+    fee bigint NOT NULL DEFAULT 0,
+    payout_transaction varchar,
+    CONSTRAINT payout_request_pkey PRIMARY KEY (id),
+    CONSTRAINT user_id_fk FOREIGN KEY (user_id)
+        REFERENCES users (id) MATCH SIMPLE
+        ON UPDATE NO ACTION
+        ON DELETE NO ACTION,
+    CONSTRAINT payout_transaction_fkey FOREIGN KEY (payout_transaction)
+        REFERENCES payout_transaction (hash) MATCH SIMPLE
+        ON UPDATE NO ACTION
+        ON DELETE NO ACTION
+);
+CREATE UNIQUE INDEX payout_request_pending ON payout_request (user_id, currency) WHERE payout_transaction IS NULL;
+
+-- Addresses an operator has held back from payouts, see ngctl payouts hold
+CREATE TABLE payout_hold
+(
+    currency varchar NOT NULL,
+    address varchar NOT NULL,
+    reason varchar NOT NULL DEFAULT '',
+    held_at timestamp with time zone NOT NULL DEFAULT now(),
+    CONSTRAINT payout_hold_pkey PRIMARY KEY (currency, address)
+);
+
+CREATE TABLE shift
+(
+    id SERIAL NOT NULL,
+    sharechain varchar NOT NULL,
+    number integer NOT NULL,
+    started_at timestamp with time zone NOT NULL,
+    ended_at timestamp with time zone NOT NULL,
+    difficulty double precision NOT NULL,
+    checksum varchar NOT NULL,
+    closed_at timestamp with time zone NOT NULL DEFAULT now(),
+    CONSTRAINT shift_pkey PRIMARY KEY (id),
+    CONSTRAINT unique_shift UNIQUE (sharechain, number)
+);
+
+CREATE TABLE shift_share
+(
+    shift_id integer NOT NULL,
+    user_id integer NOT NULL,
+    difficulty double precision NOT NULL,
+    CONSTRAINT shift_id_fk FOREIGN KEY (shift_id)
+        REFERENCES shift (id) MATCH SIMPLE
+        ON UPDATE NO ACTION
+        ON DELETE NO ACTION,
+    CONSTRAINT user_id_fk FOREIGN KEY (user_id)
+        REFERENCES users (id) MATCH SIMPLE
+        ON UPDATE NO ACTION
+        ON DELETE NO ACTION,
+    CONSTRAINT shift_share_pkey PRIMARY KEY (shift_id, user_id)
+);
+
+CREATE TABLE share_rollup
+(
+    period varchar NOT NULL,
+    bucket timestamp with time zone NOT NULL,
+    sharechain varchar NOT NULL,
+    username varchar NOT NULL,
+    worker varchar NOT NULL,
+    difficulty double precision NOT NULL,
+    shares integer NOT NULL,
+    CONSTRAINT share_rollup_pkey PRIMARY KEY (period, sharechain, bucket, username, worker)
+);
+
+CREATE TABLE share_rollup_cursor
+(
+    sharechain varchar NOT NULL,
+    rolled_to timestamp with time zone NOT NULL,
+    CONSTRAINT share_rollup_cursor_pkey PRIMARY KEY (sharechain)
+);
@@ -0,0 +1,10 @@
+CREATE TABLE network_stats
+(
+    currency varchar NOT NULL,
+    powalgo varchar NOT NULL,
+    recorded_at timestamp with time zone NOT NULL,
+    height bigint NOT NULL,
+    difficulty double precision NOT NULL,
+    price double precision,
+    CONSTRAINT network_stats_pkey PRIMARY KEY (currency, powalgo, recorded_at)
+);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS block_effort;
+ALTER TABLE block DROP COLUMN IF EXISTS effort;
+ALTER TABLE block DROP COLUMN IF EXISTS sharechain;
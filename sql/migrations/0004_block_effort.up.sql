@@ -0,0 +1,14 @@
+ALTER TABLE block ADD COLUMN sharechain varchar;
+ALTER TABLE block ADD COLUMN effort double precision;
+CREATE TABLE block_effort
+(
+    blockhash varchar NOT NULL,
+    sharechain varchar NOT NULL,
+    difficulty double precision NOT NULL,
+    effort double precision NOT NULL,
+    CONSTRAINT block_effort_pkey PRIMARY KEY (blockhash, sharechain),
+    CONSTRAINT blockhash_fk FOREIGN KEY (blockhash)
+        REFERENCES block (hash) MATCH SIMPLE
+        ON UPDATE NO ACTION
+        ON DELETE CASCADE
+);
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS coinbase_payout;
@@ -0,0 +1,16 @@
+CREATE TABLE coinbase_payout
+(
+    blockhash varchar NOT NULL,
+    user_id integer NOT NULL,
+    amount bigint NOT NULL,
+    address varchar,
+    CONSTRAINT coinbase_payout_pkey PRIMARY KEY (blockhash, user_id),
+    CONSTRAINT blockhash_fk FOREIGN KEY (blockhash)
+        REFERENCES block (hash) MATCH SIMPLE
+        ON UPDATE NO ACTION
+        ON DELETE CASCADE,
+    CONSTRAINT user_id_fk FOREIGN KEY (user_id)
+        REFERENCES users (id) MATCH SIMPLE
+        ON UPDATE NO ACTION
+        ON DELETE NO ACTION
+);
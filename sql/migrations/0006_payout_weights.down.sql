@@ -0,0 +1 @@
+ALTER TABLE share DROP COLUMN IF EXISTS payout_weights;
@@ -0,0 +1 @@
+ALTER TABLE share ADD COLUMN payout_weights jsonb;
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS share_near_target;
+ALTER TABLE share DROP COLUMN IF EXISTS block_ratio;
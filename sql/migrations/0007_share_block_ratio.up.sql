@@ -0,0 +1,2 @@
+ALTER TABLE share ADD COLUMN block_ratio double precision;
+CREATE INDEX share_near_target ON share (mined_at) WHERE block_ratio IS NOT NULL;
@@ -0,0 +1,9 @@
+-- Payouts an operator has paused through the admin API. currency is '' for
+-- all currencies
+CREATE TABLE payout_pause
+(
+    currency varchar NOT NULL,
+    reason varchar NOT NULL DEFAULT '',
+    paused_at timestamp with time zone NOT NULL DEFAULT now(),
+    CONSTRAINT payout_pause_pkey PRIMARY KEY (currency)
+);
@@ -0,0 +1,4 @@
+ALTER TABLE block DROP COLUMN IF EXISTS size;
+ALTER TABLE block DROP COLUMN IF EXISTS tx_count;
+ALTER TABLE block DROP COLUMN IF EXISTS base_subsidy;
+ALTER TABLE block DROP COLUMN IF EXISTS fees;
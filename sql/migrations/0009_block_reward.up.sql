@@ -0,0 +1,7 @@
+-- How each block's reward split between transaction fees and the chain's
+-- subsidy, and its transaction count (with the coinbase) and size in bytes.
+-- Null for blocks saved before these were recorded
+ALTER TABLE block ADD COLUMN fees bigint;
+ALTER TABLE block ADD COLUMN base_subsidy bigint;
+ALTER TABLE block ADD COLUMN tx_count integer;
+ALTER TABLE block ADD COLUMN size integer;
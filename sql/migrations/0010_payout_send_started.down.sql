@@ -0,0 +1 @@
+ALTER TABLE payout_transaction DROP COLUMN IF EXISTS send_started;
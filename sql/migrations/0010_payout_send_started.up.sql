@@ -0,0 +1,4 @@
+-- When ngweb last went to broadcast a payout transaction, written before the
+-- RPC call. Set without sent means the broadcast may have gone out without
+-- being recorded, and the wallet is checked before sending it again
+ALTER TABLE payout_transaction ADD COLUMN send_started timestamp with time zone;
@@ -0,0 +1,17 @@
+-- Payout settings users pick for themselves, through the API or their
+-- stratum password. currency is '' for every currency, a currency's own row
+-- wins over it. min_payout is in satoshis and payout_interval in seconds,
+-- NULL for the pool's default
+CREATE TABLE payout_preference
+(
+    user_id integer NOT NULL,
+    currency varchar NOT NULL DEFAULT '',
+    min_payout bigint,
+    payout_interval integer,
+    updated_at timestamp with time zone NOT NULL DEFAULT now(),
+    CONSTRAINT payout_preference_pkey PRIMARY KEY (user_id, currency),
+    CONSTRAINT user_id_fk FOREIGN KEY (user_id)
+        REFERENCES users (id) MATCH SIMPLE
+        ON UPDATE NO ACTION
+        ON DELETE CASCADE
+);
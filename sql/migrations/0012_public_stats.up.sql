@@ -0,0 +1,2 @@
+-- Users who opted into being listed by name on the public API's top miners
+ALTER TABLE users ADD COLUMN public_stats boolean NOT NULL DEFAULT false;
@@ -0,0 +1,18 @@
+-- Where a user wants their workers' events posted. Events are signed with
+-- secret. offline_minutes and reject_percent are the thresholds, 0 for
+-- events the user doesn't want
+CREATE TABLE worker_webhook
+(
+    id SERIAL NOT NULL,
+    user_id integer NOT NULL,
+    url varchar NOT NULL,
+    secret varchar NOT NULL,
+    offline_minutes integer NOT NULL DEFAULT 0,
+    reject_percent double precision NOT NULL DEFAULT 0,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    CONSTRAINT worker_webhook_pkey PRIMARY KEY (id),
+    CONSTRAINT user_id_fk FOREIGN KEY (user_id)
+        REFERENCES users (id) MATCH SIMPLE
+        ON UPDATE NO ACTION
+        ON DELETE CASCADE
+);
@@ -0,0 +1 @@
+ALTER TABLE payout_preference DROP COLUMN IF EXISTS source;
@@ -0,0 +1,4 @@
+-- Where a payout preference was set, 'api' or 'password'. Stratum passwords
+-- aren't checked, so they never overwrite what a user set through the API.
+-- Rows from before this are kept from passwords too
+ALTER TABLE payout_preference ADD COLUMN source varchar NOT NULL DEFAULT 'api';
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS payout_request_pending;
+DELETE FROM payout_request WHERE dropped_at IS NOT NULL;
+ALTER TABLE payout_request DROP COLUMN IF EXISTS dropped_at;
+CREATE UNIQUE INDEX payout_request_pending ON payout_request (user_id, currency) WHERE payout_transaction IS NULL;
@@ -0,0 +1,6 @@
+-- When an on-demand run finished without paying a request. Dropped requests
+-- aren't pending any more, but still count towards OnDemandPayoutCooldown
+ALTER TABLE payout_request ADD COLUMN dropped_at timestamp with time zone;
+DROP INDEX payout_request_pending;
+CREATE UNIQUE INDEX payout_request_pending ON payout_request (user_id, currency)
+    WHERE payout_transaction IS NULL AND dropped_at IS NULL;
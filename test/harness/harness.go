@@ -0,0 +1,402 @@
+// Package harness runs a whole pool on regtest for integration tests: etcd,
+// bitcoind with namecoind merge mined under it, a coinbuddy for each, and a
+// stratum to point a stratumclient miner at. The tests only build with
+// the integration tag:
+//
+//	go test -tags=integration ./test/harness
+//
+// bitcoind, namecoind and curl (for blocknotify) must be on the PATH, and
+// etcd too unless one is already listening on 127.0.0.1:2379, which is where
+// the services look for it. NGPOOL_TEST_DB must be a postgres connection
+// string for a database the harness can migrate and write shares to.
+// Everything runs under its own NGPOOL_DEPLOYMENT, so a shared etcd is left
+// alone
+package harness
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil"
+	"github.com/coreos/etcd/client"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	"github.com/pkg/errors"
+
+	"github.com/icook/ngpool/pkg/migrate"
+	"github.com/icook/ngpool/pkg/rpcclient"
+	"github.com/icook/ngpool/pkg/service"
+	"github.com/icook/ngpool/pkg/stratumclient"
+)
+
+// The services have the etcd endpoints compiled in
+const etcdEndpoint = "http://127.0.0.1:2379"
+
+// Set to a postgres connection string to run the integration tests
+const DBEnv = "NGPOOL_TEST_DB"
+
+// The miner's password fixes its difficulty low enough to find shares on a
+// CPU in well under a second. Regtest blocks are easier still, so every share
+// solves a block
+const (
+	StratumBind  = "127.0.0.1:23333"
+	MinerDiff    = 0.0001
+	MinerAddress = "harness.rig1"
+)
+
+// A regtest daemon and the coinbuddy running it
+type Node struct {
+	Currency     string
+	Binary       string
+	TemplateType string
+	Port         int
+	RPCPort      int
+	// The coinbuddy's block notification and event listener ports
+	BlockPort int
+	EventPort int
+	RPC       *rpcclient.Client
+}
+
+func (n *Node) serviceName() string {
+	return strings.ToLower(strings.Split(n.Currency, "_")[0])
+}
+
+// Harness is a running regtest pool. Start it with Start and always Stop it
+type Harness struct {
+	Dir        string
+	Deployment string
+	DB         *sqlx.DB
+	Nodes      []*Node
+	// Where the subsidy of every block goes
+	Address string
+
+	t     *testing.T
+	etcd  client.KeysAPI
+	procs []*exec.Cmd
+}
+
+// Skips the test if anything the harness needs is missing
+func Start(t *testing.T) *Harness {
+	dbConnectionString := os.Getenv(DBEnv)
+	if dbConnectionString == "" {
+		t.Skip(DBEnv + " isn't set")
+	}
+	for _, bin := range []string{"bitcoind", "namecoind", "curl"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			t.Skip(bin + " isn't on the PATH")
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "ngpool-harness")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Harness{
+		Dir:        dir,
+		Deployment: fmt.Sprintf("harness-%d", os.Getpid()),
+		t:          t,
+		Nodes: []*Node{
+			{Currency: "BTC_R", Binary: "bitcoind", TemplateType: "getblocktemplate",
+				Port: 23010, RPCPort: 23011, BlockPort: 23012, EventPort: 23013},
+			{Currency: "NMC_R", Binary: "namecoind", TemplateType: "getblocktemplate_aux",
+				Port: 23020, RPCPort: 23021, BlockPort: 23022, EventPort: 23023},
+		},
+	}
+	// Inherited by every service we start
+	os.Setenv(service.DeploymentEnv, h.Deployment)
+
+	if err := h.start(dbConnectionString); err != nil {
+		h.Stop()
+		t.Fatal(err)
+	}
+	return h
+}
+
+func (h *Harness) start(dbConnectionString string) error {
+	if err := h.startEtcd(); err != nil {
+		return err
+	}
+	db, err := sqlx.Connect("postgres", dbConnectionString)
+	if err != nil {
+		return errors.Wrap(err, "Failed to connect to db")
+	}
+	h.DB = db
+	migrations, err := migrate.Embedded()
+	if err != nil {
+		return err
+	}
+	if _, err := migrate.NewMigrator(db, migrations).Up(0); err != nil {
+		return errors.Wrap(err, "Failed to migrate db")
+	}
+
+	address, err := newRegtestAddress()
+	if err != nil {
+		return err
+	}
+	h.Address = address
+	if err := h.writeConfig(dbConnectionString); err != nil {
+		return err
+	}
+
+	bin := filepath.Join(h.Dir, "bin")
+	for _, cmd := range []string{"ngcoinserver", "ngstratum"} {
+		build := exec.Command("go", "build", "-o", filepath.Join(bin, cmd),
+			"github.com/icook/ngpool/cmd/"+cmd)
+		if out, err := build.CombinedOutput(); err != nil {
+			return errors.Errorf("Failed to build %s: %s", cmd, out)
+		}
+	}
+	for _, node := range h.Nodes {
+		err := h.run(filepath.Join(bin, "ngcoinserver"), "run", node.serviceName())
+		if err != nil {
+			return err
+		}
+		node.RPC = rpcclient.New(rpcclient.Config{
+			URL:  fmt.Sprintf("http://127.0.0.1:%d/", node.RPCPort),
+			User: "admin1",
+			Pass: "123",
+		})
+	}
+	for _, node := range h.Nodes {
+		err := waitFor(time.Minute*3, func() error {
+			_, err := node.RPC.GetBlockCount()
+			return err
+		})
+		if err != nil {
+			return errors.Wrapf(err, "%s never came up", node.Binary)
+		}
+	}
+	if err := h.run(filepath.Join(bin, "ngstratum"), "run", "harness"); err != nil {
+		return err
+	}
+	return waitFor(time.Minute, func() error {
+		conn, err := net.Dial("tcp", StratumBind)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	})
+}
+
+// Uses an etcd that's already running, or starts one
+func (h *Harness) startEtcd() error {
+	etcd, err := client.New(client.Config{
+		Endpoints:               []string{etcdEndpoint},
+		Transport:               client.DefaultTransport,
+		HeaderTimeoutPerRequest: time.Second,
+	})
+	if err != nil {
+		return err
+	}
+	h.etcd = service.NewDeploymentKeysAPI(etcd, h.Deployment)
+	ping := func() error {
+		_, err := client.NewKeysAPI(etcd).Get(context.Background(), "/", nil)
+		return err
+	}
+	if ping() == nil {
+		return nil
+	}
+	if _, err := exec.LookPath("etcd"); err != nil {
+		return errors.New("etcd isn't running on " + etcdEndpoint + " or on the PATH")
+	}
+	err = h.run("etcd", "--data-dir", filepath.Join(h.Dir, "etcd"),
+		"--listen-client-urls", etcdEndpoint,
+		"--advertise-client-urls", etcdEndpoint)
+	if err != nil {
+		return err
+	}
+	return waitFor(time.Second*30, ping)
+}
+
+// Each process logs to <name>.log in Dir, which is kept if the test fails
+func (h *Harness) run(bin string, args ...string) error {
+	name := filepath.Base(bin)
+	if len(args) > 1 {
+		name += "-" + args[len(args)-1]
+	}
+	logFile, err := os.Create(filepath.Join(h.Dir, name+".log"))
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(bin, args...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	if err := cmd.Start(); err != nil {
+		logFile.Close()
+		return errors.Wrapf(err, "Failed to start %s", name)
+	}
+	h.procs = append(h.procs, cmd)
+	return nil
+}
+
+func (h *Harness) setConfig(key string, value string) error {
+	_, err := h.etcd.Set(context.Background(), key, value, nil)
+	return errors.Wrapf(err, "Failed to set %s", key)
+}
+
+func (h *Harness) writeConfig(dbConnectionString string) error {
+	common := fmt.Sprintf(`
+stratum:
+    DbConnectionString: %q
+ShareChains:
+    BTC_R:
+        fee: 0.01
+        payoutmethod: "pplns"
+        algo: "sha256d"
+Currencies:
+    BTC_R:
+        subsidyAddress: %q
+        powalgorithm: "sha256d"
+        pubkeyaddrid: "6f"
+        privkeyaddrid: "ef"
+        netmagic: 0xdab5bffa
+        blockmatureconfirms: 100
+        payouttransactionfee: 110
+        payoutschedule: "@hourly"
+        minimumrelayfee: 1000
+    NMC_R:
+        subsidyAddress: %q
+        powalgorithm: "sha256d"
+        pubkeyaddrid: "6f"
+        privkeyaddrid: "ef"
+        netmagic: 0xdab5bffa
+        blockmatureconfirms: 100
+        payouttransactionfee: 110
+        payoutschedule: "@hourly"
+        minimumrelayfee: 1000
+`, dbConnectionString, h.Address, h.Address)
+	if err := h.setConfig("/config/common", common); err != nil {
+		return err
+	}
+
+	stratum := fmt.Sprintf(`
+loglevel: debug
+sharechainname: BTC_R
+stratumbind: %s
+vardiffmin: %v
+basecurrency:
+    currency: BTC_R
+    algo: sha256d
+    templatetype: getblocktemplate
+auxcurrencies:
+    - currency: NMC_R
+      algo: sha256d
+      templatetype: getblocktemplate_aux
+`, StratumBind, MinerDiff)
+	if err := h.setConfig("/config/stratum/harness", stratum); err != nil {
+		return err
+	}
+
+	for _, node := range h.Nodes {
+		coinserver := fmt.Sprintf(`
+loglevel: debug
+coinserverbinary: %s
+currencycode: %s
+hashingalgo: sha256d
+templatetype: %s
+blocklistenerbind: 127.0.0.1:%d
+eventlistenerbind: 127.0.0.1:%d
+nodeconfig:
+    port: "%d"
+    rpcport: "%d"
+    rpcuser: admin1
+    rpcpassword: "123"
+    server: "1"
+    regtest: "1"
+    listen: "0"
+    datadir: %q
+`, node.Binary, node.Currency, node.TemplateType, node.BlockPort,
+			node.EventPort, node.Port, node.RPCPort,
+			filepath.Join(h.Dir, node.serviceName()))
+		err := h.setConfig("/config/coinserver/"+node.serviceName(), coinserver)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The subsidy address only has to be valid, nothing ever spends from it
+func newRegtestAddress() (string, error) {
+	key, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		return "", err
+	}
+	address, err := btcutil.NewAddressPubKeyHash(
+		btcutil.Hash160(key.PubKey().SerializeCompressed()),
+		&chaincfg.RegressionNetParams)
+	if err != nil {
+		return "", err
+	}
+	return address.EncodeAddress(), nil
+}
+
+// Connects a miner to the stratum with the harness difficulty
+func (h *Harness) Miner() (*stratumclient.Client, error) {
+	return stratumclient.Dial(StratumBind, MinerAddress,
+		fmt.Sprintf("d=%v", MinerDiff), service.AlgoConfig["sha256d"])
+}
+
+// Stops everything, newest first, and deletes the deployment's etcd keys.
+// Dir is left behind if the test failed
+func (h *Harness) Stop() {
+	for i := len(h.procs) - 1; i >= 0; i-- {
+		proc := h.procs[i]
+		proc.Process.Signal(os.Interrupt)
+		done := make(chan struct{})
+		go func() {
+			proc.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second * 30):
+			proc.Process.Kill()
+			<-done
+		}
+	}
+	if h.etcd != nil {
+		h.etcd.Delete(context.Background(), "/",
+			&client.DeleteOptions{Recursive: true, Dir: true})
+	}
+	if h.DB != nil {
+		h.DB.Close()
+	}
+	if h.t.Failed() {
+		h.t.Logf("Logs kept in %s", h.Dir)
+		return
+	}
+	os.RemoveAll(h.Dir)
+}
+
+// Polls check until it passes or timeout runs out, returning its last error
+func waitFor(timeout time.Duration, check func() error) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := check()
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(time.Millisecond * 250)
+	}
+}
+
+// Waits until check passes, failing the test if it doesn't in time
+func (h *Harness) Eventually(timeout time.Duration, what string, check func() error) {
+	if err := waitFor(timeout, check); err != nil {
+		h.t.Fatalf("%s: %v", what, err)
+	}
+}
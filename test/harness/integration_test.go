@@ -0,0 +1,99 @@
+//go:build integration
+// +build integration
+
+package harness
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/icook/ngpool/pkg/stratumclient"
+)
+
+func TestMineBlock(t *testing.T) {
+	h := Start(t)
+	defer h.Stop()
+	// The database may have rows from earlier runs
+	started := time.Now()
+
+	heights := map[string]int64{}
+	for _, node := range h.Nodes {
+		height, err := node.RPC.GetBlockCount()
+		if !assert.NoError(t, err) {
+			return
+		}
+		heights[node.Currency] = height
+	}
+
+	// Templates have to make it from each node through its coinbuddy to the
+	// stratum before there's a job
+	var miner *stratumclient.Client
+	h.Eventually(time.Minute*2, "Miner never got a job", func() error {
+		var err error
+		if miner == nil {
+			miner, err = h.Miner()
+			if err != nil {
+				return err
+			}
+		}
+		_, err = miner.WaitJob(time.Second * 5)
+		if err != nil {
+			miner.Close()
+			miner = nil
+		}
+		return err
+	})
+	defer miner.Close()
+
+	share, err := miner.Mine(time.Minute)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, share.Accepted, "share rejected: %s", share.Error)
+
+	h.Eventually(time.Second*30, "Share never saved", func() error {
+		var count int
+		err := h.DB.Get(&count,
+			`SELECT COUNT(*) FROM share WHERE username = $1 AND mined_at >= $2`,
+			"harness", started)
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return errors.New("No shares")
+		}
+		return nil
+	})
+
+	// Every share meets both regtest targets, so the bitcoin block and the
+	// merge mined namecoin block should both land
+	for _, node := range h.Nodes {
+		node := node
+		h.Eventually(time.Second*30, node.Currency+" block never submitted", func() error {
+			height, err := node.RPC.GetBlockCount()
+			if err != nil {
+				return err
+			}
+			if height <= heights[node.Currency] {
+				return errors.Errorf("Still at height %d", height)
+			}
+			return nil
+		})
+	}
+	h.Eventually(time.Second*30, "Block never saved", func() error {
+		var count int
+		err := h.DB.Get(&count,
+			`SELECT COUNT(*) FROM block WHERE mined_by = $1 AND mined_at >= $2`,
+			"harness", started)
+		if err != nil {
+			return err
+		}
+		if count < len(h.Nodes) {
+			return errors.Errorf("%d of %d blocks saved", count, len(h.Nodes))
+		}
+		return nil
+	})
+}